@@ -0,0 +1,195 @@
+package kvcache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ----- Access control -----
+
+// An ACL says which clients may do which actions on which keys. KVStoreWith
+// enforces the one in its StoreConfig, by the Client each KVRequest names, and
+// answers a request the ACL does not allow with ErrForbidden: a read or a
+// validate of a key is a get of it, and a write, a delete, or an import a put of
+// each of its keys. A scan lists only the keys its client may get. A front end
+// serving clients over a network names in each request the client it
+// authenticated.
+//
+// Access is denied unless a rule allows it. A rule names a client, or * for
+// every client, a key prefix, or * for every key, and the actions it allows.
+
+// ErrForbidden is the error of an action the ACL does not allow.
+var ErrForbidden = errors.New("forbidden by ACL")
+
+// Forbidden reports whether r is the reply to an action the ACL refused.
+func Forbidden(r ClientReply) bool {
+	return r.Err == ErrForbidden.Error()
+}
+
+// ACLRule allows Client to do Ops on the keys starting with Prefix.
+type ACLRule struct {
+	Client string // or * for every client
+	Prefix string // or * for every key
+	Ops    []ClientActionType
+}
+
+// ACL is a set of rules, and counts of the actions they refused. A nil *ACL
+// allows everything.
+type ACL struct {
+	mu     sync.RWMutex
+	rules  []ACLRule
+	denied map[string]int // by client
+}
+
+// NewACL returns an ACL with rules.
+func NewACL(rules ...ACLRule) *ACL {
+	return &ACL{rules: rules, denied: make(map[string]int)}
+}
+
+// Allow adds a rule allowing client to do ops on the keys starting with prefix.
+func (a *ACL) Allow(client, prefix string, ops ...ClientActionType) {
+	a.mu.Lock()
+	a.rules = append(a.rules, ACLRule{Client: client, Prefix: prefix, Ops: ops})
+	a.mu.Unlock()
+}
+
+// Allowed reports whether client may do op on key.
+func (a *ACL) Allowed(client string, op ClientActionType, key string) bool {
+	if a == nil {
+		return true
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, r := range a.rules {
+		if r.Client != "*" && r.Client != client {
+			continue
+		}
+		if r.Prefix != "*" && !strings.HasPrefix(key, r.Prefix) {
+			continue
+		}
+		for _, o := range r.Ops {
+			if o == op {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Denied returns how many actions of each client the ACL refused.
+func (a *ACL) Denied() map[string]int {
+	out := make(map[string]int)
+	if a == nil {
+		return out
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for c, n := range a.denied {
+		out[c] = n
+	}
+	return out
+}
+
+// permits reports whether the ACL allows req, counting it against its client if
+// not. Scans and sweeps are always allowed.
+func (a *ACL) permits(req KVRequest) bool {
+	if a == nil {
+		return true
+	}
+	ok := true
+	switch req.Op {
+	case KVRead, KVValidate, KVGetChunk:
+		ok = a.Allowed(req.Client, ClientGet, req.Key)
+	case KVWrite, KVDelete, KVPutChunk:
+		ok = a.Allowed(req.Client, ClientPut, req.Key)
+	case KVImport:
+		for _, e := range req.Entries {
+			if ok = a.Allowed(req.Client, ClientPut, e.Key); !ok {
+				break
+			}
+		}
+	}
+	if !ok {
+		a.mu.Lock()
+		a.denied[req.Client]++
+		a.mu.Unlock()
+	}
+	return ok
+}
+
+// visible returns the entries whose key client may get.
+func (a *ACL) visible(client string, entries []KVEntry) []KVEntry {
+	if a == nil {
+		return entries
+	}
+	var out []KVEntry
+	for _, e := range entries {
+		if a.Allowed(client, ClientGet, e.Key) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// LoadACL reads an ACL from a file (see ParseACL).
+func LoadACL(path string) (*ACL, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseACL(f)
+}
+
+// ParseACL reads an ACL, a rule per line: a client, a key prefix, and the
+// comma-separated actions allowed, with # starting a comment:
+//
+//	client1  client1-  get,put   # client1 has its own keys
+//	*        shared/   get       # everyone may read the shared ones
+func ParseACL(r io.Reader) (*ACL, error) {
+	a := NewACL()
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		if len(f) != 3 {
+			return nil, fmt.Errorf("line %d: want <client> <prefix> <actions>", n)
+		}
+		var ops []ClientActionType
+		for _, o := range strings.Split(f[2], ",") {
+			op := ClientActionType(o)
+			if op != ClientGet && op != ClientPut {
+				return nil, fmt.Errorf("line %d: unknown action %q (want get or put)", n, o)
+			}
+			ops = append(ops, op)
+		}
+		a.Allow(f[0], f[1], ops...)
+	}
+	return a, sc.Err()
+}
+
+// formatDenied describes the actions refused, by client.
+func formatDenied(denied map[string]int) string {
+	var clients []string
+	for c := range denied {
+		clients = append(clients, c)
+	}
+	sort.Strings(clients)
+	var parts []string
+	for _, c := range clients {
+		parts = append(parts, fmt.Sprintf("%s=%d", c, denied[c]))
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, " ")
+}
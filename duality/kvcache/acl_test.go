@@ -0,0 +1,105 @@
+package kvcache
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// With shared keys every client only may read, each refused put must give its
+// key back, or the other client's next get of it waits forever.
+func TestStoreGivesBackRefusedPuts(t *testing.T) {
+	acl := NewACL(ACLRule{Client: "*", Prefix: "k", Ops: []ClientActionType{ClientGet}})
+	done := make(chan BenchResult)
+	go func() {
+		res, err := Bench(BenchConfig{Clients: 2, Ops: 200, Keys: 4, Shared: true, ACL: acl})
+		if err != nil {
+			t.Error(err)
+		}
+		done <- res
+	}()
+	select {
+	case res := <-done:
+		if res.Gets != 400 || res.Puts != 400 {
+			t.Fatalf("gets=%d puts=%d, want 400 each", res.Gets, res.Puts)
+		}
+		if d := acl.Denied(); d["client1"] != 200 || d["client2"] != 200 {
+			t.Fatalf("denied %v, want every put of both clients", d)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("bench hung: a refused put left its key owned")
+	}
+}
+
+// The store checks each request by the client it names.
+func TestStoreChecksClients(t *testing.T) {
+	acl := NewACL(
+		ACLRule{Client: "a", Prefix: "a-", Ops: []ClientActionType{ClientGet, ClientPut}},
+		ACLRule{Client: "*", Prefix: "shared/", Ops: []ClientActionType{ClientGet}},
+	)
+	ch, _ := startStore(StoreConfig{ACL: acl})
+	call := func(req KVRequest) KVReply {
+		req.Reply = make(chan KVReply, 1)
+		ch <- req
+		return <-req.Reply
+	}
+	forbidden := func(r KVReply) bool { return !r.Ok && r.Err == ErrForbidden.Error() }
+
+	if r := call(KVRequest{Op: KVRead, Key: "a-1", Client: "a"}); !r.Ok {
+		t.Fatalf("a reading a-1: %+v", r)
+	}
+	if r := call(KVRequest{Op: KVWrite, Key: "a-1", Value: 7, Client: "a"}); !r.Ok {
+		t.Fatalf("a writing a-1: %+v", r)
+	}
+	if r := call(KVRequest{Op: KVRead, Key: "a-1", Client: "b"}); !forbidden(r) {
+		t.Fatalf("b reading a-1: %+v, want forbidden", r)
+	}
+	if r := call(KVRequest{Op: KVValidate, Key: "a-1"}); !forbidden(r) {
+		t.Fatalf("nobody validating a-1: %+v, want forbidden", r)
+	}
+	if r := call(KVRequest{Op: KVDelete, Key: "a-1", Client: "b"}); !forbidden(r) {
+		t.Fatalf("b deleting a-1: %+v, want forbidden", r)
+	}
+	if r := call(KVRequest{Op: KVImport, Client: "a", Entries: []KVEntry{{"a-2", 1}, {"shared/x", 2}}}); !forbidden(r) {
+		t.Fatalf("a importing shared/x: %+v, want forbidden", r)
+	}
+	if r := call(KVRequest{Op: KVRead, Key: "a-2", Client: "a"}); !r.Ok || r.Value != 0 {
+		t.Fatalf("a-2 = %+v: a refused import set part of it", r)
+	}
+	call(KVRequest{Op: KVWrite, Key: "a-2", Client: "a"})
+	call(KVRequest{Op: KVRead, Key: "shared/x", Client: "b"})
+	call(KVRequest{Op: KVWrite, Key: "shared/x", Client: "b"})
+
+	r := call(KVRequest{Op: KVScan, Client: "b"})
+	if !r.Ok || len(r.Entries) != 1 || r.Entries[0].Key != "shared/x" {
+		t.Fatalf("b's scan listed %+v, want shared/x only", r.Entries)
+	}
+	if d := acl.Denied(); d["a"] != 1 || d["b"] != 3 || d[""] != 1 {
+		t.Fatalf("denied %v, want a=1 b=3 and 1 for nobody", d)
+	}
+}
+
+func TestParseACL(t *testing.T) {
+	acl, err := ParseACL(strings.NewReader("client1 client1- get,put # own keys\n* shared/ get\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		client string
+		op     ClientActionType
+		key    string
+		want   bool
+	}{
+		{"client1", ClientPut, "client1-a", true},
+		{"client2", ClientGet, "client1-a", false},
+		{"client2", ClientGet, "shared/x", true},
+		{"client2", ClientPut, "shared/x", false},
+	} {
+		if got := acl.Allowed(c.client, c.op, c.key); got != c.want {
+			t.Errorf("%s %s %s: allowed=%v, want %v", c.client, c.op, c.key, got, c.want)
+		}
+	}
+	if _, err := ParseACL(strings.NewReader("client1 k- delete\n")); err == nil {
+		t.Error("want an error for an unknown action")
+	}
+}
@@ -0,0 +1,250 @@
+package kvcache
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ----- Audit log -----
+
+// An AuditLog records every write a store accepts: who wrote, the key, the value
+// it had and the one written, and when. The store records them itself, in its
+// loop (set StoreConfig.Audit), so the writer is the Client of the request and
+// the old value is the store's, and the records of a key chain together. An
+// import records each key it sets, as a write.
+//
+// Records go to a file, a JSON object per line, which is rotated once it reaches
+// MaxSize or MaxAge: audit.log becomes audit.log.1, audit.log.1 becomes
+// audit.log.2, and so on, keeping Keep old files. The last few records of each
+// key are also kept in memory, for History; ReadAudit searches the files.
+
+// AuditRecord is a write KVStore accepted.
+type AuditRecord struct {
+	Time   time.Time `json:"time"`
+	Client string    `json:"client"`
+	Key    string    `json:"key"`
+	Old    int       `json:"old"`
+	New    int       `json:"new"`
+}
+
+// AuditConfig configures an AuditLog.
+type AuditConfig struct {
+	Path    string        // the current file; rotated ones get .1, .2, ... after it
+	MaxSize int64         // bytes after which the file is rotated; default 1MB
+	MaxAge  time.Duration // age after which the file is rotated; 0 is no limit
+	Keep    int           // rotated files kept; default 5
+	Recent  int           // records kept in memory per key; default 16
+	Unknown string        // the client of requests that name none; default "unknown"
+}
+
+// AuditLog is an open audit log; see OpenAuditLog.
+type AuditLog struct {
+	cfg AuditConfig
+
+	mu      sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	size    int64
+	opened  time.Time
+	recent  map[string][]AuditRecord
+	records int
+	err     error // the first write error, after which nothing more is written
+}
+
+// OpenAuditLog opens the audit log of cfg, appending to its current file.
+func OpenAuditLog(cfg AuditConfig) (*AuditLog, error) {
+	if cfg.Path == "" {
+		return nil, fmt.Errorf("audit log needs a path")
+	}
+	if cfg.MaxSize <= 0 {
+		cfg.MaxSize = 1 << 20
+	}
+	if cfg.Keep <= 0 {
+		cfg.Keep = 5
+	}
+	if cfg.Recent <= 0 {
+		cfg.Recent = 16
+	}
+	if cfg.Unknown == "" {
+		cfg.Unknown = "unknown"
+	}
+	a := &AuditLog{cfg: cfg, recent: make(map[string][]AuditRecord)}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// open opens the current file, taking its age from when it was last rotated.
+func (a *AuditLog) open() error {
+	f, err := os.OpenFile(a.cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.f, a.w, a.size, a.opened = f, bufio.NewWriter(f), fi.Size(), time.Now()
+	if a.size > 0 {
+		a.opened = fi.ModTime()
+	}
+	return nil
+}
+
+// rotate closes the current file and shifts it and the old ones up by one,
+// dropping the oldest beyond Keep.
+func (a *AuditLog) rotate() error {
+	if err := a.w.Flush(); err != nil {
+		return err
+	}
+	if err := a.f.Close(); err != nil {
+		return err
+	}
+	os.Remove(fmt.Sprintf("%s.%d", a.cfg.Path, a.cfg.Keep))
+	for i := a.cfg.Keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", a.cfg.Path, i), fmt.Sprintf("%s.%d", a.cfg.Path, i+1))
+	}
+	if err := os.Rename(a.cfg.Path, a.cfg.Path+".1"); err != nil {
+		return err
+	}
+	return a.open()
+}
+
+// Record adds rec to the log.
+func (a *AuditLog) Record(rec AuditRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.records++
+	h := append(a.recent[rec.Key], rec)
+	if len(h) > a.cfg.Recent {
+		h = h[len(h)-a.cfg.Recent:]
+	}
+	a.recent[rec.Key] = h
+	if a.err != nil {
+		return a.err
+	}
+	if a.size > 0 && (a.size+int64(len(line))+1 > a.cfg.MaxSize ||
+		a.cfg.MaxAge > 0 && rec.Time.Sub(a.opened) >= a.cfg.MaxAge) {
+		if a.err = a.rotate(); a.err != nil {
+			return a.err
+		}
+	}
+	a.w.Write(line)
+	a.w.WriteByte('\n')
+	a.size += int64(len(line)) + 1
+	return nil
+}
+
+// History returns the last n records of key kept in memory, oldest first; n <= 0
+// means all of them.
+func (a *AuditLog) History(key string, n int) []AuditRecord {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	h := a.recent[key]
+	if n > 0 && len(h) > n {
+		h = h[len(h)-n:]
+	}
+	return append([]AuditRecord(nil), h...)
+}
+
+// Records returns how many writes were recorded.
+func (a *AuditLog) Records() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.records
+}
+
+// Flush writes the buffered records to the file.
+func (a *AuditLog) Flush() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.err != nil {
+		return a.err
+	}
+	return a.w.Flush()
+}
+
+// Close flushes and closes the file.
+func (a *AuditLog) Close() error {
+	err := a.Flush()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if cerr := a.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// write records that client set key from old to new. The store calls it; the
+// first error writing the file is kept, and returned by Flush.
+func (a *AuditLog) write(client, key string, old, new int) {
+	if a == nil {
+		return
+	}
+	if client == "" {
+		client = a.cfg.Unknown
+	}
+	a.Record(AuditRecord{Time: time.Now(), Client: client, Key: key, Old: old, New: new})
+}
+
+// ReadAudit returns the last n records of key in the audit log at path, its
+// rotated files included, oldest first; n <= 0 means all of them.
+func ReadAudit(path, key string, n int) ([]AuditRecord, error) {
+	files, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	// oldest first: the highest number first, then the current file
+	var ordered []string
+	for i := len(files); i >= 1; i-- {
+		if p := fmt.Sprintf("%s.%d", path, i); fileExists(p) {
+			ordered = append(ordered, p)
+		}
+	}
+	ordered = append(ordered, path)
+	var out []AuditRecord
+	for _, p := range ordered {
+		f, err := os.Open(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return out, err
+		}
+		sc := bufio.NewScanner(f)
+		for line := 1; sc.Scan(); line++ {
+			var rec AuditRecord
+			if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+				f.Close()
+				return out, fmt.Errorf("%s:%d: %v", p, line, err)
+			}
+			if rec.Key == key {
+				out = append(out, rec)
+			}
+		}
+		f.Close()
+		if err := sc.Err(); err != nil {
+			return out, err
+		}
+	}
+	if n > 0 && len(out) > n {
+		out = out[len(out)-n:]
+	}
+	return out, nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
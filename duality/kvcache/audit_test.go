@@ -0,0 +1,80 @@
+package kvcache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The store records who wrote each key, from what to what, for writes and
+// imports alike, and nothing for a write it refused.
+func TestStoreAuditsWrites(t *testing.T) {
+	audit, err := OpenAuditLog(AuditConfig{Path: filepath.Join(t.TempDir(), "audit.log")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+	acl := NewACL(ACLRule{Client: "*", Prefix: "*", Ops: []ClientActionType{ClientGet}},
+		ACLRule{Client: "alice", Prefix: "*", Ops: []ClientActionType{ClientPut}},
+		ACLRule{Client: "carol", Prefix: "*", Ops: []ClientActionType{ClientPut}},
+		ACLRule{Client: "", Prefix: "*", Ops: []ClientActionType{ClientPut}})
+	ch, shutdown := startStore(StoreConfig{ACL: acl, Audit: audit})
+	for _, w := range []struct {
+		client string
+		value  int
+	}{{"alice", 1}, {"carol", 2}, {"bob", 3}} {
+		bulkCall(ch, KVRequest{Op: KVRead, Key: "k", Client: w.client})
+		bulkCall(ch, KVRequest{Op: KVWrite, Key: "k", Value: w.value, Client: w.client})
+	}
+	bulkCall(ch, KVRequest{Op: KVImport, Entries: []KVEntry{{"k", 4}}})
+	shutdown()
+
+	var got []string
+	for _, r := range audit.History("k", 0) {
+		got = append(got, fmt.Sprintf("%s %d->%d", r.Client, r.Old, r.New))
+	}
+	if want := "[alice 0->1 carol 1->2 unknown 2->4]"; fmt.Sprint(got) != want {
+		t.Errorf("history %v, want %v", got, want)
+	}
+}
+
+// The log rotates past MaxSize, keeps Keep old files, and ReadAudit finds the
+// writes of a key across the ones kept, oldest first.
+func TestAuditRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := OpenAuditLog(AuditConfig{Path: path, MaxSize: 200, Keep: 2, Recent: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 20 {
+		audit.write("c", fmt.Sprintf("k%d", i%2), i, i+1)
+	}
+	if err := audit.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".2"); err != nil {
+		t.Errorf("no second rotated file: %v", err)
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Error("kept more than 2 rotated files")
+	}
+	if h := audit.History("k0", 0); len(h) != 3 || h[2].New != 19 {
+		t.Errorf("history in memory %+v, want the last 3 writes of k0", h)
+	}
+	recs, err := ReadAudit(path, "k1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) == 0 || len(recs) == 10 || recs[len(recs)-1].New != 20 {
+		t.Fatalf("read %d records of k1, want the last ones kept, not all 10", len(recs))
+	}
+	for i := 1; i < len(recs); i++ {
+		if recs[i].Old != recs[i-1].New+1 {
+			t.Fatalf("records out of order: %+v then %+v", recs[i-1], recs[i])
+		}
+	}
+	if last, _ := ReadAudit(path, "k1", 2); len(last) != 2 || last[1].New != 20 {
+		t.Errorf("last 2 records %+v", last)
+	}
+}
@@ -0,0 +1,639 @@
+package kvcache
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ----- Benchmark -----
+
+// BenchConfig describes a benchmark run: Clients client goroutines, each doing
+// Ops get/put pairs over Keys keys of its own. With Shared, the clients use the
+// same keys instead, so they contend for ownership; KVStore may assume at most
+// one waiter per key, so Shared is only valid with two clients, unless they share
+// an L2Cache, which queues any number of waiters. Closing Stop,
+// if set, ends the run early: each client finishes its current pair and stops.
+type BenchConfig struct {
+	Clients int
+	Ops     int
+	Keys    int
+	Shared  bool
+	Stop    <-chan struct{}
+
+	// ReadAhead, if positive, runs ReadAheadClients that keep this many keys
+	// read ahead, instead of KVClients; it cannot be combined with Shared.
+	// Latency, if positive, delays every request on its way to KVStore, as a
+	// network would, which is what reading ahead hides.
+	ReadAhead int
+	Latency   time.Duration
+
+	// L2, if set, puts an L2Cache shared by all the clients between them and
+	// KVStore (and Latency), holding idle keys for L2Hold (0 means its default).
+	L2     bool
+	L2Hold time.Duration
+
+	// Messages, if set, counts the messages to and from KVStore by kind (see
+	// MessageCounts). With L2, they are the L2 cache's, not the clients'.
+	Messages bool
+
+	// Timeline, if set, records who owned each key when (see Timeline). With
+	// L2, the owner is the L2 cache.
+	Timeline bool
+
+	// Sched, if set, makes the store queue each client's requests and pick
+	// them by this policy (see StoreConfig.Sched). It cannot be combined with
+	// L2 or Timeline.
+	Sched SchedPolicy
+
+	// Inbox is how many requests the store queues ahead of serving them (see
+	// StoreConfig.Inbox); 0 is none without Sched, no limit with it.
+	// Backpressure, if set, reports how full it gets (see InboxStats), and
+	// needs Inbox or Sched.
+	Inbox        int
+	Backpressure bool
+
+	// Timeout, if positive, runs TimeoutClients that give up on the store after
+	// this long, serving the last value they saw if ServeStale is set; it cannot
+	// be combined with ReadAhead.
+	Timeout    time.Duration
+	ServeStale bool
+
+	// Watch, if set, counts the key events (see Watchers) seen by a watcher of
+	// every key: the writes that reach KVStore, the L2's expiries, and the keys
+	// the store expires or evicts.
+	Watch bool
+
+	// TTL, if positive, makes the store expire keys this long after their last
+	// write (see StoreConfig). An expired key reads as 0 again, so a get of it
+	// after its expiry counts as stale.
+	TTL time.Duration
+
+	// IdleAfter, if positive, makes the store evict keys idle this long (see
+	// StoreConfig). An evicted key reads as 0 again, so a get of it after its
+	// eviction counts as stale.
+	IdleAfter time.Duration
+
+	// Revalidate, if positive, runs KVClients that keep read copies of the keys
+	// they put and revalidate one every Revalidate actions (see ClientConfig);
+	// it cannot be combined with ReadAhead or Timeout. A get is then stale if
+	// the version it returned is older than that of a put already finished.
+	Revalidate int
+
+	// Mirror, if set, copies every write KVStore commits to this Redis or HTTP
+	// target (see NewMirrorSink and Mirror).
+	Mirror string
+
+	// ACL, if set, is KVStore's (see ACL); a refused action counts as failed.
+	// It cannot be combined with L2, which asks the store for all the clients.
+	ACL *ACL
+
+	// KeyPrefix is put in front of every key, to model long, repetitive keys.
+	// Intern, if set, numbers the keys of the store and of KVClients from one
+	// shared KeyTable, which keeps one copy of each (see StoreConfig.Keys); it
+	// cannot be combined with ReadAhead or Timeout.
+	KeyPrefix string
+	Intern    bool
+
+	// Audit, if set, is KVStore's audit log, which records every write it
+	// accepts (see AuditLog). With L2, the writer is the L2 cache. Bench flushes
+	// it but leaves it open.
+	Audit *AuditLog
+}
+
+// BenchResult is what a benchmark measured. A get is stale if it returned a value
+// other than the last one written to its key, which a consistent KVStore never does.
+type BenchResult struct {
+	BenchConfig
+	Elapsed    time.Duration
+	Gets, Puts int
+	Hits       int
+	Failed     int
+	Stale      int
+	GetP50     time.Duration
+	GetP99     time.Duration
+
+	Interrupted bool // Stop was closed before every pair was done
+
+	ReadAheadStats ReadAheadStats       // the clients' read-ahead, summed
+	L2Stats        L2Stats              // if L2 is set
+	MessageCounts  MessageCounts        // if Messages is set
+	Timeline       Timeline             // if Timeline is set
+	Service        []ClientServiceStats // if Sched is set, one per client
+	InboxStats     InboxStats           // if Backpressure is set
+	TimeoutStats   TimeoutStats         // the clients' timeouts, summed
+	KeyEvents      map[KeyEventKind]int // if Watch is set, by kind
+	EventsDropped  int                  // events the watcher was too slow for
+	StoreStats     StoreStats           // sweeps if TTL or IdleAfter is set
+	MirrorStats    MirrorStats          // if Mirror is set
+	ClientStats    ClientStats          // if Revalidate is set, the clients' copies, summed
+	Denied         map[string]int       // if ACL is set, actions refused by client
+	KeyStats       KeyTableStats        // if Intern is set
+	Audited        int                  // if Audit is set, writes recorded
+}
+
+// Bench runs KVStore and cfg.Clients KVClients, drives them with get/put pairs,
+// and shuts them down again.
+func Bench(cfg BenchConfig) (BenchResult, error) {
+	if cfg.Clients <= 0 || cfg.Ops <= 0 || cfg.Keys <= 0 {
+		return BenchResult{}, fmt.Errorf("clients, ops, and keys must be positive")
+	}
+	if cfg.Shared && cfg.Clients != 2 && !cfg.L2 {
+		return BenchResult{}, fmt.Errorf("shared keys need exactly two clients, or an L2 cache")
+	}
+	if cfg.Shared && cfg.ReadAhead > 0 {
+		return BenchResult{}, fmt.Errorf("read-ahead cannot be used with shared keys")
+	}
+	if cfg.Timeout > 0 && cfg.ReadAhead > 0 {
+		return BenchResult{}, fmt.Errorf("timeouts cannot be used with read-ahead")
+	}
+	var sink MirrorSink
+	if cfg.Mirror != "" {
+		var err error
+		if sink, err = NewMirrorSink(cfg.Mirror); err != nil {
+			return BenchResult{}, err
+		}
+	}
+	if cfg.Revalidate > 0 && (cfg.ReadAhead > 0 || cfg.Timeout > 0) {
+		return BenchResult{}, fmt.Errorf("revalidation cannot be used with read-ahead or timeouts")
+	}
+	if cfg.Intern && (cfg.ReadAhead > 0 || cfg.Timeout > 0) {
+		return BenchResult{}, fmt.Errorf("interning cannot be used with read-ahead or timeouts")
+	}
+	if cfg.Inbox < 0 {
+		return BenchResult{}, fmt.Errorf("inbox depth must not be negative")
+	}
+	if cfg.Backpressure && cfg.Inbox == 0 && cfg.Sched == "" {
+		return BenchResult{}, fmt.Errorf("backpressure is measured at the store's inbox: it needs an inbox depth or a scheduler")
+	}
+	if cfg.ACL != nil && cfg.L2 {
+		return BenchResult{}, fmt.Errorf("an ACL cannot be used with an L2 cache")
+	}
+	if cfg.Sched != "" && (cfg.L2 || cfg.Timeline) {
+		return BenchResult{}, fmt.Errorf("a scheduler cannot be used with an L2 cache or a timeline")
+	}
+	var watchers *Watchers
+	events := make(map[KeyEventKind]int)
+	var watching sync.WaitGroup
+	stopWatch := func() {}
+	if cfg.Watch || sink != nil {
+		watchers = NewWatchers()
+	}
+	var mirror *Mirror
+	if sink != nil {
+		mirror = StartMirror(watchers, sink, MirrorConfig{})
+	}
+	if cfg.Watch {
+		var evCh <-chan KeyEvent
+		evCh, stopWatch = watchers.Watch("", 1024)
+		watching.Add(1)
+		go func() {
+			defer watching.Done()
+			for ev := range evCh {
+				events[ev.Kind]++
+			}
+		}()
+	}
+	storeCh := make(chan KVRequest)
+	var storeWG sync.WaitGroup
+	var storeStats StoreStats
+	audited := 0 // writes the audit log held before
+	if cfg.Audit != nil {
+		audited = cfg.Audit.Records()
+	}
+	var keys *KeyTable
+	if cfg.Intern {
+		keys = NewKeyTable()
+	}
+	storeWG.Add(1)
+	go KVStoreWith(storeCh, &storeWG, StoreConfig{TTL: cfg.TTL, IdleAfter: cfg.IdleAfter, Watchers: watchers, ACL: cfg.ACL, Audit: cfg.Audit, Keys: keys,
+		Sched: cfg.Sched, Inbox: cfg.Inbox}, &storeStats)
+	kvReqCh := storeCh
+	var counter messageCounter
+	if cfg.Messages {
+		kvReqCh = countMessages(kvReqCh, &counter, &storeWG)
+	}
+	var timeline *timelineRecorder
+	if cfg.Timeline {
+		timeline = newTimelineRecorder("l2")
+		kvReqCh = timeline.record(kvReqCh, &storeWG)
+	}
+	if cfg.Latency > 0 {
+		kvReqCh = delayRequests(kvReqCh, cfg.Latency, &storeWG)
+	}
+	storeReqCh := kvReqCh
+	var l2Stats L2Stats
+	var l2WG sync.WaitGroup
+	if cfg.L2 {
+		kvReqCh = make(chan KVRequest)
+		l2WG.Add(1)
+		go L2Cache(kvReqCh, storeReqCh, &l2WG, L2Config{HoldFor: cfg.L2Hold, Watchers: watchers}, &l2Stats)
+	}
+	res := BenchResult{BenchConfig: cfg}
+	var wg, tagWG sync.WaitGroup
+	wg.Add(cfg.Clients)
+	var clientChs []chan KVRequest // with Timeline, each client's own requests
+	raStats := make([]ReadAheadStats, cfg.Clients)
+	toStats := make([]TimeoutStats, cfg.Clients)
+	clStats := make([]ClientStats, cfg.Clients)
+
+	var mu sync.Mutex
+	last := make(map[string]int)   // the last value put to each key
+	newest := make(map[string]int) // with Revalidate, the newest version a put of each key got
+	var getTimes []time.Duration
+
+	var drivers sync.WaitGroup
+	start := time.Now()
+	for c := range cfg.Clients {
+		name := fmt.Sprintf("client%d", c+1)
+		actCh := make(chan ClientAction)
+		reqCh := kvReqCh
+		if cfg.Timeline && !cfg.L2 {
+			reqCh = timeline.client(name, kvReqCh, &tagWG)
+			clientChs = append(clientChs, reqCh)
+		}
+		switch {
+		case cfg.ReadAhead > 0:
+			go ReadAheadClient(name, actCh, reqCh, &wg, ReadAheadConfig{Depth: cfg.ReadAhead}, &raStats[c])
+		case cfg.Timeout > 0:
+			go TimeoutClient(name, actCh, reqCh, &wg, TimeoutConfig{Timeout: cfg.Timeout, ServeStale: cfg.ServeStale}, &toStats[c])
+		case cfg.Revalidate > 0 || keys != nil:
+			go KVClientWith(name, actCh, reqCh, &wg, ClientConfig{Revalidate: cfg.Revalidate, Keys: keys}, &clStats[c])
+		default:
+			go KVClient(name, actCh, reqCh, &wg)
+		}
+		drivers.Add(1)
+		go func() {
+			defer drivers.Done()
+			defer close(actCh)
+			do := func(act ClientAction) ClientReply {
+				act.Reply = make(chan ClientReply)
+				actCh <- act
+				return <-act.Reply
+			}
+			for i := range cfg.Ops {
+				select {
+				case <-cfg.Stop:
+					return
+				default:
+				}
+				key := fmt.Sprintf("%s%s-k%d", cfg.KeyPrefix, name, i%cfg.Keys)
+				if cfg.Shared {
+					key = fmt.Sprintf("%sk%d", cfg.KeyPrefix, i%cfg.Keys)
+				}
+				t := time.Now()
+				get := do(ClientAction{Type: ClientGet, Key: key})
+				took := time.Since(t)
+				// The get made this client the owner of key, so nobody else may
+				// read it until the put below, and last can be set first. A value
+				// served stale after a timeout is not owned, and its put fails.
+				val := c*cfg.Ops + i + 1
+				mu.Lock()
+				stale := get.Ok && get.Value != last[key]
+				if get.Ok && !ServedStale(get) {
+					last[key] = val
+				}
+				if cfg.Revalidate > 0 {
+					// A get answered from a copy owns nothing, so last may be
+					// set by another client before this put; versions order
+					// the puts instead.
+					stale = get.Ok && get.Version < newest[key]
+				}
+				mu.Unlock()
+				put := do(ClientAction{Type: ClientPut, Key: key, Value: val})
+
+				mu.Lock()
+				newest[key] = max(newest[key], put.Version)
+				res.Gets++
+				res.Puts++
+				getTimes = append(getTimes, took)
+				if get.Hit {
+					res.Hits++
+				}
+				if stale {
+					res.Stale++
+				}
+				if !get.Ok || !put.Ok {
+					res.Failed++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	drivers.Wait()
+	res.Elapsed = time.Since(start)
+	wg.Wait() // a ReadAheadClient writes back its unused keys as it exits
+	for _, ch := range clientChs {
+		close(ch)
+	}
+	tagWG.Wait()
+	if cfg.L2 {
+		close(kvReqCh)
+		l2WG.Wait() // and so does the L2 cache
+	}
+	close(storeReqCh)
+	storeWG.Wait()
+	res.L2Stats = l2Stats
+	res.MessageCounts = counter.MessageCounts
+	res.Service = storeStats.Service
+	res.InboxStats = storeStats.Inbox
+	res.StoreStats = storeStats
+	if mirror != nil {
+		res.MirrorStats = mirror.Stop()
+	}
+	if cfg.ACL != nil {
+		res.Denied = cfg.ACL.Denied()
+	}
+	res.KeyStats = keys.Stats()
+	if cfg.Audit != nil {
+		res.Audited = cfg.Audit.Records() - audited
+		if err := cfg.Audit.Flush(); err != nil {
+			return res, fmt.Errorf("audit log: %v", err)
+		}
+	}
+	if cfg.Watch {
+		// no events come once the store has exited
+		stopWatch()
+		watching.Wait()
+		res.KeyEvents = events
+		res.EventsDropped = watchers.Dropped()
+	}
+	if timeline != nil {
+		res.Timeline = timeline.tl
+	}
+	res.Interrupted = res.Gets < cfg.Clients*cfg.Ops
+	for _, s := range raStats {
+		res.ReadAheadStats.Add(s)
+	}
+	for _, s := range toStats {
+		res.TimeoutStats.Add(s)
+	}
+	for _, s := range clStats {
+		res.ClientStats.Add(s)
+	}
+
+	sort.Slice(getTimes, func(i, j int) bool { return getTimes[i] < getTimes[j] })
+	if len(getTimes) > 0 {
+		res.GetP50 = getTimes[len(getTimes)*50/100]
+		res.GetP99 = getTimes[len(getTimes)*99/100]
+	}
+	return res, nil
+}
+
+// delayRequests returns a channel whose requests reach out after d, each on its
+// own, so that a client's requests overlap their delays as they would on a
+// network. It closes out once the returned channel is closed and every request
+// has been passed on.
+func delayRequests(out chan<- KVRequest, d time.Duration, wg *sync.WaitGroup) chan KVRequest {
+	in := make(chan KVRequest)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var pending sync.WaitGroup
+		for req := range in {
+			pending.Add(1)
+			time.AfterFunc(d, func() {
+				defer pending.Done()
+				out <- req
+			})
+		}
+		pending.Wait()
+		close(out)
+	}()
+	return in
+}
+
+// BenchReport is the machine-readable form of a BenchResult. Times are in
+// milliseconds.
+type BenchReport struct {
+	Clients     int     `json:"clients"`
+	Ops         int     `json:"ops"`
+	Keys        int     `json:"keys"`
+	Shared      bool    `json:"shared"`
+	ElapsedMs   float64 `json:"elapsedMs"`
+	OpsPerSec   float64 `json:"opsPerSec"`
+	Gets        int     `json:"gets"`
+	Puts        int     `json:"puts"`
+	Hits        int     `json:"hits"`
+	Failed      int     `json:"failed"`
+	Stale       int     `json:"stale"`
+	GetP50Ms    float64 `json:"getP50Ms"`
+	GetP99Ms    float64 `json:"getP99Ms"`
+	Interrupted bool    `json:"interrupted,omitempty"`
+
+	ReadAhead  int     `json:"readAhead,omitempty"`
+	LatencyMs  float64 `json:"latencyMs,omitempty"`
+	Detected   int     `json:"detected,omitempty"`
+	Prefetched int     `json:"prefetched,omitempty"`
+	Used       int     `json:"prefetchUsed,omitempty"`
+	Late       int     `json:"prefetchLate,omitempty"`
+	Wasted     int     `json:"prefetchWasted,omitempty"`
+
+	L2 *L2Stats `json:"l2,omitempty"`
+
+	Sched    SchedPolicy          `json:"sched,omitempty"`
+	Service  []ClientServiceStats `json:"service,omitempty"`
+	Fairness float64              `json:"fairness,omitempty"`
+
+	Inbox *InboxStats `json:"inbox,omitempty"`
+
+	TTLMs       float64     `json:"ttlMs,omitempty"`
+	IdleAfterMs float64     `json:"idleAfterMs,omitempty"`
+	Store       *StoreStats `json:"store,omitempty"`
+
+	KeyEvents     map[KeyEventKind]int `json:"keyEvents,omitempty"`
+	EventsDropped int                  `json:"eventsDropped,omitempty"`
+
+	Denied map[string]int `json:"denied,omitempty"`
+
+	Mirror   string       `json:"mirror,omitempty"`
+	Mirrored *MirrorStats `json:"mirrorStats,omitempty"`
+
+	Revalidate int          `json:"revalidate,omitempty"`
+	Copies     *ClientStats `json:"copies,omitempty"`
+
+	TimeoutMs  float64       `json:"timeoutMs,omitempty"`
+	ServeStale bool          `json:"serveStale,omitempty"`
+	Timeouts   *TimeoutStats `json:"timeouts,omitempty"`
+
+	Messages      *MessageCounts `json:"messages,omitempty"`
+	MessagesPerOp float64        `json:"messagesPerOp,omitempty"`
+
+	KeyPrefix string         `json:"keyPrefix,omitempty"`
+	Interned  *KeyTableStats `json:"interned,omitempty"`
+	KeysSaved int            `json:"keysSavedBytes,omitempty"` // with Interned, LiveSavedBytes
+	Audited   int            `json:"audited,omitempty"`
+}
+
+// Report returns r in machine-readable form.
+func (r BenchResult) Report() BenchReport {
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	rep := BenchReport{
+		Clients:     r.Clients,
+		Ops:         r.Ops,
+		Keys:        r.Keys,
+		Shared:      r.Shared,
+		ElapsedMs:   ms(r.Elapsed),
+		Gets:        r.Gets,
+		Puts:        r.Puts,
+		Hits:        r.Hits,
+		Failed:      r.Failed,
+		Stale:       r.Stale,
+		GetP50Ms:    ms(r.GetP50),
+		GetP99Ms:    ms(r.GetP99),
+		Interrupted: r.Interrupted,
+
+		ReadAhead:  r.ReadAhead,
+		LatencyMs:  ms(r.Latency),
+		Detected:   r.ReadAheadStats.Detected,
+		Prefetched: r.ReadAheadStats.Prefetched,
+		Used:       r.ReadAheadStats.Used,
+		Late:       r.ReadAheadStats.Late,
+		Wasted:     r.ReadAheadStats.Wasted,
+	}
+	if r.L2 {
+		l2 := r.L2Stats
+		rep.L2 = &l2
+	}
+	if r.Sched != "" {
+		rep.Sched = r.Sched
+		rep.Service = r.Service
+		rep.Fairness = FairnessIndex(r.Service)
+	}
+	if r.Backpressure {
+		ib := r.InboxStats
+		rep.Inbox = &ib
+	}
+	if r.TTL > 0 || r.IdleAfter > 0 {
+		st := r.StoreStats
+		rep.TTLMs = ms(r.TTL)
+		rep.IdleAfterMs = ms(r.IdleAfter)
+		rep.Store = &st
+	}
+	if r.ACL != nil {
+		rep.Denied = r.Denied
+	}
+	if r.Mirror != "" {
+		ms := r.MirrorStats
+		rep.Mirror = r.Mirror
+		rep.Mirrored = &ms
+	}
+	rep.KeyPrefix = r.KeyPrefix
+	rep.Audited = r.Audited
+	if r.Intern {
+		ks := r.KeyStats
+		rep.Interned = &ks
+		rep.KeysSaved = LiveSavedBytes(ks, r.StoreStats)
+	}
+	if r.Revalidate > 0 {
+		cs := r.ClientStats
+		rep.Revalidate = r.Revalidate
+		rep.Copies = &cs
+	}
+	if r.Watch {
+		rep.KeyEvents = r.KeyEvents
+		rep.EventsDropped = r.EventsDropped
+	}
+	if r.Timeout > 0 {
+		ts := r.TimeoutStats
+		rep.TimeoutMs = ms(r.Timeout)
+		rep.ServeStale = r.ServeStale
+		rep.Timeouts = &ts
+	}
+	if r.Messages {
+		m := r.MessageCounts
+		rep.Messages = &m
+		rep.MessagesPerOp = m.PerOp(r.Gets + r.Puts)
+	}
+	if s := r.Elapsed.Seconds(); s > 0 {
+		rep.OpsPerSec = float64(r.Gets+r.Puts) / s
+	}
+	return rep
+}
+
+// PrintBench writes a BenchResult to w.
+func PrintBench(w io.Writer, r BenchResult) {
+	fmt.Fprintf(w, "clients=%d ops=%d keys=%d shared=%v elapsed=%v", r.Clients, r.Ops, r.Keys, r.Shared, r.Elapsed.Round(time.Microsecond))
+	if r.Latency > 0 {
+		fmt.Fprintf(w, " latency=%v", r.Latency)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "throughput=%.0f ops/sec gets=%d puts=%d hits=%d failed=%d stale=%d\n",
+		float64(r.Gets+r.Puts)/r.Elapsed.Seconds(), r.Gets, r.Puts, r.Hits, r.Failed, r.Stale)
+	fmt.Fprintf(w, "get latency: p50=%v p99=%v\n", r.GetP50, r.GetP99)
+	if r.ReadAhead > 0 {
+		ra := r.ReadAheadStats
+		fmt.Fprintf(w, "read-ahead: depth=%d detected=%d prefetched=%d used=%d late=%d wasted=%d\n",
+			r.ReadAhead, ra.Detected, ra.Prefetched, ra.Used, ra.Late, ra.Wasted)
+	}
+	if r.L2 {
+		l2 := r.L2Stats
+		rate := 0.0
+		if l2.Reads > 0 {
+			rate = float64(l2.Hits) / float64(l2.Reads)
+		}
+		fmt.Fprintf(w, "l2: reads=%d hits=%d (%.1f%%) misses=%d waits=%d writes=%d writebacks=%d evictions=%d\n",
+			l2.Reads, l2.Hits, 100*rate, l2.Misses, l2.Waits, l2.Writes, l2.WriteBacks, l2.Evictions)
+	}
+	if r.Sched != "" {
+		fmt.Fprintf(w, "sched: policy=%s fairness=%.3f\n%s", r.Sched, FairnessIndex(r.Service), formatServiceStats(r.Service))
+	}
+	if r.Timeout > 0 {
+		ts := r.TimeoutStats
+		fmt.Fprintf(w, "timeouts: timeout=%v serve-stale=%v gets=%d puts=%d stale-serves=%d released=%d\n",
+			r.Timeout, r.ServeStale, ts.GetTimeouts, ts.PutTimeouts, ts.StaleServes, ts.Released)
+	}
+	if r.TTL > 0 || r.IdleAfter > 0 {
+		st := r.StoreStats
+		fmt.Fprintf(w, "store: ttl=%v idle-after=%v sweeps=%d expired=%d evicted=%d\n", r.TTL, r.IdleAfter, st.Sweeps, st.Expired, st.Evicted)
+	}
+	if r.ACL != nil {
+		fmt.Fprintf(w, "acl: denied %s\n", formatDenied(r.Denied))
+	}
+	if r.Mirror != "" {
+		ms := r.MirrorStats
+		fmt.Fprintf(w, "mirror: %s mirrored=%d retries=%d failed=%d dropped=%d max-outbox=%d\n",
+			r.Mirror, ms.Mirrored, ms.Retries, ms.Failed, ms.Dropped, ms.MaxOutbox)
+	}
+	if r.Revalidate > 0 {
+		cs := r.ClientStats
+		fmt.Fprintf(w, "copies: revalidate-every=%d copy-hits=%d revalidations=%d stale-found=%d gone=%d\n",
+			r.Revalidate, cs.CopyHits, cs.Revalidations, cs.StaleFound, cs.Gone)
+	}
+	if r.Watch {
+		fmt.Fprintf(w, "key events: updated=%d expired=%d deleted=%d dropped=%d\n",
+			r.KeyEvents[KeyUpdated], r.KeyEvents[KeyExpired], r.KeyEvents[KeyDeleted], r.EventsDropped)
+	}
+	if r.Backpressure {
+		ib := r.InboxStats
+		mean := time.Duration(0)
+		if ib.Blocked > 0 {
+			mean = ib.BlockTime / time.Duration(ib.Blocked)
+		}
+		fmt.Fprintf(w, "inbox: depth=%d high-water=%d sends=%d blocked=%d (%.1f%%) block-time=%v (mean %v)",
+			ib.Depth, ib.HighWater, ib.Sends, ib.Blocked, 100*float64(ib.Blocked)/float64(max(ib.Sends, 1)),
+			ib.BlockTime.Round(time.Microsecond), mean.Round(time.Microsecond))
+		if ib.Depth > 0 {
+			fmt.Fprintf(w, " full=%v (%.1f%%)", ib.FullTime.Round(time.Microsecond), 100*ib.FullTime.Seconds()/r.Elapsed.Seconds())
+		}
+		fmt.Fprintln(w)
+	}
+	if r.Messages {
+		m := r.MessageCounts
+		fmt.Fprintf(w, "messages: total=%d per-op=%.2f reads=%d writes=%d grants=%d handoffs=%d write-acks=%d failures=%d\n",
+			m.Total(), m.PerOp(r.Gets+r.Puts), m.Reads, m.Writes, m.Grants, m.Handoffs, m.WriteAcks, m.Failures)
+	}
+	if r.Audit != nil {
+		fmt.Fprintf(w, "audit: %d writes recorded\n", r.Audited)
+	}
+	if r.Intern {
+		ks, st := r.KeyStats, r.StoreStats
+		fmt.Fprintf(w, "keys: interned=%d (%d B) lookups=%d live: store=%d (%d B) owned-peak=%d (%d B) saved=%d B\n",
+			ks.Keys, ks.KeyBytes, ks.Lookups, st.Keys, st.KeyBytes, st.PeakOwned, st.PeakOwnedBytes, LiveSavedBytes(ks, st))
+	}
+	if r.Interrupted {
+		fmt.Fprintf(w, "interrupted: partial results of %d of %d pairs\n", r.Gets, r.Clients*r.Ops)
+	}
+}
@@ -0,0 +1,262 @@
+package kvcache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ----- Large values -----
+
+// A blob is a large value, bytes rather than an int, that moves between a client
+// and the store in chunks of at most BlobChunk bytes, so that no one message
+// holds all of it. Blobs are a keyspace of their own beside the int values: a
+// blob is replaced whole, when its last chunk arrives, and ownership, TTLs,
+// scans, and watchers do not apply to it.
+//
+// PutStream sends a value as KVPutChunk requests: each carries its Offset and
+// Data and, as Value, the size of the whole value. The store stages the chunks
+// of each client's upload in order, and once they add up to the size, replaces
+// the blob at once, giving it a new version; until then readers see the old one.
+// GetStream reads a blob back with KVGetChunk requests, each for the bytes from
+// an Offset on, and fails with ErrBlobChanged if the version changes under it.
+// Both keep up to a window of chunks in flight, so a slow side holds the other
+// back instead of piling chunks up.
+
+// BlobChunk is the most bytes a chunk carries.
+const BlobChunk = 64 << 10
+
+// maxUploads is the number of unfinished uploads a store keeps. Starting one more
+// drops the oldest, whose next chunk fails.
+const maxUploads = 16
+
+var (
+	// ErrNoBlob is the error of a read of a key with no blob.
+	ErrNoBlob = errors.New("no such blob")
+	// ErrChunk is the error of a chunk the store cannot take: too large, past the
+	// end of the value, or not the next of an upload in progress.
+	ErrChunk = errors.New("chunk out of order or too large")
+	// ErrBlobChanged is the error of a GetStream of a blob replaced while it was
+	// read.
+	ErrBlobChanged = errors.New("blob changed while it was read")
+)
+
+// blobUpload names an upload: one client's value for one key.
+type blobUpload struct {
+	client, key string
+}
+
+// upload is the staged part of a value on its way in.
+type upload struct {
+	data    []byte
+	size    int
+	started int // order among uploads, to drop the oldest
+}
+
+// blob is a committed value and its version.
+type blob struct {
+	data    []byte
+	version int
+}
+
+// blobStore is the blobs of a store and the uploads to it.
+type blobStore struct {
+	of      map[string]blob
+	uploads map[blobUpload]*upload
+	started int // uploads started
+	last    int // the last version given
+}
+
+func newBlobStore() *blobStore {
+	return &blobStore{of: make(map[string]blob), uploads: make(map[blobUpload]*upload)}
+}
+
+// putChunk serves a KVPutChunk. Its reply's Value is the bytes staged so far, or,
+// once the chunk completes the value, its size, with the new Version.
+func (b *blobStore) putChunk(req KVRequest) KVReply {
+	id := blobUpload{req.Client, req.Key}
+	if req.Offset == 0 {
+		b.start(id, req.Value)
+	}
+	u, ok := b.uploads[id]
+	if !ok || len(req.Data) > BlobChunk || req.Offset != len(u.data) || req.Value != u.size || len(u.data)+len(req.Data) > u.size {
+		delete(b.uploads, id)
+		return KVReply{Ok: false, Err: ErrChunk.Error()}
+	}
+	u.data = append(u.data, req.Data...)
+	if len(u.data) < u.size {
+		return KVReply{Value: len(u.data), Ok: true}
+	}
+	delete(b.uploads, id)
+	b.last++
+	b.of[req.Key] = blob{data: u.data, version: b.last}
+	return KVReply{Value: u.size, Ok: true, Version: b.last}
+}
+
+// start begins an upload of size bytes, in place of any under the same name.
+func (b *blobStore) start(id blobUpload, size int) {
+	delete(b.uploads, id)
+	if len(b.uploads) >= maxUploads {
+		var oldest blobUpload
+		first := b.started
+		for k, u := range b.uploads {
+			if u.started < first {
+				oldest, first = k, u.started
+			}
+		}
+		delete(b.uploads, oldest)
+	}
+	if size < 0 {
+		return
+	}
+	b.started++
+	b.uploads[id] = &upload{data: make([]byte, 0, min(size, 16*BlobChunk)), size: size, started: b.started}
+}
+
+// getChunk serves a KVGetChunk: up to Value bytes (BlobChunk if 0 or more) from
+// Offset on, with the size of the whole blob as Value and its Version. The
+// bytes are the store's, and must not be changed.
+func (b *blobStore) getChunk(req KVRequest) KVReply {
+	bl, ok := b.of[req.Key]
+	if !ok {
+		return KVReply{Ok: false, Err: ErrNoBlob.Error()}
+	}
+	if req.Offset < 0 || req.Offset > len(bl.data) {
+		return KVReply{Ok: false, Err: ErrChunk.Error()}
+	}
+	n := req.Value
+	if n <= 0 || n > BlobChunk {
+		n = BlobChunk
+	}
+	end := min(req.Offset+n, len(bl.data))
+	return KVReply{Value: len(bl.data), Ok: true, Version: bl.version, Data: bl.data[req.Offset:end:end]}
+}
+
+// StreamConfig configures PutStream and GetStream.
+type StreamConfig struct {
+	Client string // named in each request, for the store's ACL
+	Chunk  int    // bytes a chunk; default and at most BlobChunk
+	Window int    // chunks in flight at most; default 4
+}
+
+func (cfg StreamConfig) chunk() int {
+	if cfg.Chunk <= 0 || cfg.Chunk > BlobChunk {
+		return BlobChunk
+	}
+	return cfg.Chunk
+}
+
+func (cfg StreamConfig) window() int {
+	if cfg.Window <= 0 {
+		return 4
+	}
+	return cfg.Window
+}
+
+// chunkWindow is the chunks a stream has in flight, oldest first.
+type chunkWindow []chan KVReply
+
+// send sends req to the store with a reply channel of its own, without waiting
+// for the reply.
+func (w *chunkWindow) send(kvReqCh chan<- KVRequest, req KVRequest) {
+	req.Reply = make(chan KVReply, 1) // the store never waits for us
+	kvReqCh <- req
+	*w = append(*w, req.Reply)
+}
+
+// await waits for the reply to the oldest chunk in flight.
+func (w *chunkWindow) await() KVReply {
+	r := <-(*w)[0]
+	*w = (*w)[1:]
+	return r
+}
+
+// replyErr is the error of a failed reply.
+func replyErr(r KVReply) error {
+	for _, err := range []error{ErrNoBlob, ErrChunk, ErrForbidden} {
+		if r.Err == err.Error() {
+			return err
+		}
+	}
+	if r.Err != "" {
+		return errors.New(r.Err)
+	}
+	return errors.New("kv request failed")
+}
+
+// PutStream sets the blob key to the size bytes read from r, sent to the store a
+// chunk at a time, and returns the blob's new version. The store replaces the
+// blob once the last chunk arrives; if the stream fails first, it is left as it
+// was.
+func PutStream(kvReqCh chan<- KVRequest, key string, r io.Reader, size int, cfg StreamConfig) (int, error) {
+	if size < 0 {
+		return 0, fmt.Errorf("put %q: negative size", key)
+	}
+	var win chunkWindow
+	var err error
+	version := 0
+	for off := 0; err == nil; {
+		if len(win) == cfg.window() {
+			if resp := win.await(); !resp.Ok {
+				err = replyErr(resp)
+				break
+			}
+		}
+		buf := make([]byte, min(cfg.chunk(), size-off))
+		if _, err = io.ReadFull(r, buf); err != nil {
+			break
+		}
+		win.send(kvReqCh, KVRequest{Op: KVPutChunk, Key: key, Value: size, Offset: off, Data: buf, Client: cfg.Client})
+		if off += len(buf); off == size {
+			break
+		}
+	}
+	for len(win) > 0 {
+		resp := win.await()
+		if !resp.Ok && err == nil {
+			err = replyErr(resp)
+		}
+		version = resp.Version
+	}
+	if err != nil {
+		return 0, fmt.Errorf("put %q: %w", key, err)
+	}
+	return version, nil
+}
+
+// GetStream writes the blob key to w as the store sends it, a chunk at a time,
+// and returns its size and version.
+func GetStream(kvReqCh chan<- KVRequest, key string, w io.Writer, cfg StreamConfig) (int, int, error) {
+	var win chunkWindow
+	win.send(kvReqCh, KVRequest{Op: KVGetChunk, Key: key, Value: cfg.chunk(), Client: cfg.Client})
+	first := win.await()
+	if !first.Ok {
+		return 0, 0, fmt.Errorf("get %q: %w", key, replyErr(first))
+	}
+	size, version := first.Value, first.Version
+	_, err := w.Write(first.Data)
+	next := len(first.Data) // offset of the next chunk to ask for
+	for got := next; got < size && err == nil; {
+		for len(win) < cfg.window() && next < size {
+			win.send(kvReqCh, KVRequest{Op: KVGetChunk, Key: key, Value: cfg.chunk(), Offset: next, Client: cfg.Client})
+			next += cfg.chunk()
+		}
+		resp := win.await()
+		switch {
+		case !resp.Ok:
+			err = replyErr(resp)
+		case resp.Version != version:
+			err = ErrBlobChanged
+		default:
+			_, err = w.Write(resp.Data)
+			got += len(resp.Data)
+		}
+	}
+	for len(win) > 0 {
+		win.await()
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("get %q: %w", key, err)
+	}
+	return size, version, nil
+}
@@ -0,0 +1,130 @@
+package kvcache
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func randomBytes(n int, seed int64) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+// A value many chunks long goes in and comes out whole, with a window of
+// chunks in flight each way.
+func TestBlobRoundTrip(t *testing.T) {
+	ch, _ := startStore(StoreConfig{})
+	want := randomBytes(1<<20+123, 1)
+	cfg := StreamConfig{Chunk: 4096, Window: 3}
+	v, err := PutStream(ch, "big", bytes.NewReader(want), len(want), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got bytes.Buffer
+	size, gv, err := GetStream(ch, "big", &got, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != len(want) || gv != v || !bytes.Equal(got.Bytes(), want) {
+		t.Fatalf("got %d bytes at version %d, want %d at %d", size, gv, len(want), v)
+	}
+
+	if _, err := PutStream(ch, "empty", bytes.NewReader(nil), 0, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if size, _, err := GetStream(ch, "empty", io.Discard, cfg); err != nil || size != 0 {
+		t.Fatalf("empty blob: size %d, %v", size, err)
+	}
+	if _, _, err := GetStream(ch, "missing", io.Discard, cfg); !errors.Is(err, ErrNoBlob) {
+		t.Fatalf("missing blob: %v, want ErrNoBlob", err)
+	}
+}
+
+// An upload that stops short leaves the blob as it was, and no chunk can be
+// put out of order.
+func TestBlobUploadIsAtomic(t *testing.T) {
+	ch, _ := startStore(StoreConfig{})
+	old := randomBytes(10000, 2)
+	if _, err := PutStream(ch, "k", bytes.NewReader(old), len(old), StreamConfig{Chunk: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	short := io.LimitReader(bytes.NewReader(randomBytes(10000, 3)), 5000)
+	if _, err := PutStream(ch, "k", short, 10000, StreamConfig{Chunk: 1000}); err == nil {
+		t.Fatal("a short upload succeeded")
+	}
+	var got bytes.Buffer
+	if _, _, err := GetStream(ch, "k", &got, StreamConfig{}); err != nil || !bytes.Equal(got.Bytes(), old) {
+		t.Fatalf("after a short upload: %v, value changed=%v", err, !bytes.Equal(got.Bytes(), old))
+	}
+
+	reply := make(chan KVReply, 1)
+	ch <- KVRequest{Op: KVPutChunk, Key: "k", Value: 10, Offset: 5, Data: []byte("12345"), Reply: reply}
+	if r := <-reply; r.Ok || r.Err != ErrChunk.Error() {
+		t.Fatalf("a chunk with no upload: %+v, want ErrChunk", r)
+	}
+}
+
+// changer replaces the blob it reads the first time it is written to.
+type changer struct {
+	replace func()
+	once    sync.Once
+}
+
+func (c *changer) Write(p []byte) (int, error) {
+	c.once.Do(c.replace)
+	return len(p), nil
+}
+
+// A blob replaced while it is read fails the read rather than mixing versions.
+func TestBlobChangedWhileRead(t *testing.T) {
+	ch, _ := startStore(StoreConfig{})
+	v := randomBytes(8192, 4)
+	PutStream(ch, "k", bytes.NewReader(v), len(v), StreamConfig{})
+	w := &changer{replace: func() {
+		PutStream(ch, "k", bytes.NewReader(v), len(v), StreamConfig{})
+	}}
+	if _, _, err := GetStream(ch, "k", w, StreamConfig{Chunk: 1024, Window: 1}); !errors.Is(err, ErrBlobChanged) {
+		t.Fatalf("got %v, want ErrBlobChanged", err)
+	}
+}
+
+// Chunks go over a network connection, under the store's ACL, like any request.
+func TestBlobOverNetwork(t *testing.T) {
+	acl := NewACL(ACLRule{Client: "alice", Prefix: "files/", Ops: []ClientActionType{ClientGet, ClientPut}})
+	tokens := NewTokens(map[string]string{"alice": "s1", "bob": "s2"})
+	addr := startKVServer(t, acl, tokens)
+	forward := func(token string) chan<- KVRequest {
+		conn, err := DialKV(addr, DialConfig{Token: token})
+		if err != nil {
+			t.Fatal(err)
+		}
+		reqCh := make(chan KVRequest)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go conn.Forward(reqCh, &wg)
+		t.Cleanup(func() {
+			close(reqCh)
+			wg.Wait()
+			conn.Close()
+		})
+		return reqCh
+	}
+	alice, bob := forward("s1"), forward("s2")
+
+	want := randomBytes(300000, 5)
+	if _, err := PutStream(alice, "files/a", bytes.NewReader(want), len(want), StreamConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	var got bytes.Buffer
+	if _, _, err := GetStream(alice, "files/a", &got, StreamConfig{}); err != nil || !bytes.Equal(got.Bytes(), want) {
+		t.Fatalf("alice's read back: %v", err)
+	}
+	if _, _, err := GetStream(bob, "files/a", io.Discard, StreamConfig{}); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("bob's read: %v, want ErrForbidden", err)
+	}
+}
@@ -0,0 +1,221 @@
+package kvcache
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ----- Bulk import and export -----
+
+// ImportFrom and ExportTo move the keyspace a chunk of ScanLimit keys at a time,
+// with KVImport and KVScan requests that the store serves itself. The requests of
+// other clients interleave with theirs between chunks, so a large import or
+// export holds up nobody for longer than one chunk takes. An export lists every
+// key in the store when it starts, in order, without taking or creating any; it
+// is not a snapshot, since keys written between chunks are listed as they are
+// then (see keyScans). An import sets the keys nobody owns at once, and waits for
+// the owners of the rest through the ownership protocol, a read and a write per
+// key.
+//
+// The formats are CSV, a key,value record per line with an optional key,value
+// header, and JSON, an array of {"key": ..., "value": ...} objects. Both are
+// read and written as a stream, a record at a time.
+
+// BulkFormat is the format of a bulk import or export.
+type BulkFormat string
+
+const (
+	BulkCSV  BulkFormat = "csv"
+	BulkJSON BulkFormat = "json"
+)
+
+// ParseBulkFormat returns the format named s.
+func ParseBulkFormat(s string) (BulkFormat, error) {
+	switch f := BulkFormat(strings.ToLower(s)); f {
+	case BulkCSV, BulkJSON:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown format %q: want csv or json", s)
+}
+
+// bulkCall sends req to the store and waits for the reply.
+func bulkCall(kvReqCh chan<- KVRequest, req KVRequest) KVReply {
+	req.Reply = make(chan KVReply)
+	kvReqCh <- req
+	resp := <-req.Reply
+	close(req.Reply)
+	return resp
+}
+
+// bulkSet sets key to value in the store: it reads the key, which creates it if
+// missing and makes the caller its owner, and writes the value, which gives it up.
+func bulkSet(kvReqCh chan<- KVRequest, key string, value int) error {
+	if resp := bulkCall(kvReqCh, KVRequest{Op: KVRead, Key: key}); !resp.Ok {
+		return fmt.Errorf("kv read of %q failed", key)
+	}
+	if resp := bulkCall(kvReqCh, KVRequest{Op: KVWrite, Key: key, Value: value}); !resp.Ok {
+		return fmt.Errorf("kv write of %q failed", key)
+	}
+	return nil
+}
+
+// bulkImport sets entries in the store with a KVImport, and the keys it hands
+// back, which others own, with bulkSet.
+func bulkImport(kvReqCh chan<- KVRequest, entries []KVEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	resp := bulkCall(kvReqCh, KVRequest{Op: KVImport, Entries: entries})
+	if !resp.Ok {
+		return errors.New("kv import failed")
+	}
+	for _, e := range resp.Entries {
+		if err := bulkSet(kvReqCh, e.Key, e.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportFrom sets the keys read from r, in format, in the store on kvReqCh, a
+// chunk at a time. A key repeated takes its last value. It returns the keys
+// set, without repeats, in the order they first appear.
+func ImportFrom(r io.Reader, format BulkFormat, kvReqCh chan<- KVRequest) ([]string, error) {
+	var keys []string
+	seen := make(map[string]bool)
+	chunk := make([]KVEntry, 0, ScanLimit)
+	set := func(e KVEntry) error {
+		if e.Key == "" {
+			return errors.New("empty key")
+		}
+		if !seen[e.Key] {
+			seen[e.Key] = true
+			keys = append(keys, e.Key)
+		}
+		chunk = append(chunk, e)
+		if len(chunk) < ScanLimit {
+			return nil
+		}
+		err := bulkImport(kvReqCh, chunk)
+		chunk = chunk[:0]
+		return err
+	}
+	// flush sets what is left of the chunk, the records before a bad one too.
+	flush := func(err error) ([]string, error) {
+		if ierr := bulkImport(kvReqCh, chunk); err == nil {
+			err = ierr
+		}
+		return keys, err
+	}
+
+	switch format {
+	case BulkCSV:
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = 2
+		cr.TrimLeadingSpace = true
+		for first := true; ; first = false {
+			row, err := cr.Read()
+			if err == io.EOF {
+				return flush(nil)
+			}
+			if err != nil {
+				return flush(err)
+			}
+			line, _ := cr.FieldPos(0)
+			v, err := strconv.Atoi(strings.TrimSpace(row[1]))
+			if err != nil {
+				if first && row[0] == "key" && row[1] == "value" {
+					continue
+				}
+				return flush(fmt.Errorf("line %d: bad value %q", line, row[1]))
+			}
+			if err := set(KVEntry{Key: row[0], Value: v}); err != nil {
+				return flush(fmt.Errorf("line %d: %v", line, err))
+			}
+		}
+	case BulkJSON:
+		dec := json.NewDecoder(r)
+		if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+			return keys, errors.New("want a JSON array of {\"key\": ..., \"value\": ...} objects")
+		}
+		for n := 1; dec.More(); n++ {
+			var e KVEntry
+			if err := dec.Decode(&e); err != nil {
+				return flush(fmt.Errorf("record %d: %v", n, err))
+			}
+			if err := set(e); err != nil {
+				return flush(fmt.Errorf("record %d: %v", n, err))
+			}
+		}
+		_, err := dec.Token()
+		return flush(err)
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+// ExportTo writes every key in the store on kvReqCh and its value to w, in
+// format, in key order, a chunk at a time. Owned keys are written with their
+// last committed value. It returns the number of records written.
+func ExportTo(w io.Writer, format BulkFormat, kvReqCh chan<- KVRequest) (int, error) {
+	if format != BulkCSV && format != BulkJSON {
+		return 0, fmt.Errorf("unknown format %q", format)
+	}
+	bw := bufio.NewWriter(w)
+	var cw *csv.Writer
+	if format == BulkCSV {
+		cw = csv.NewWriter(bw)
+		cw.Write([]string{"key", "value"})
+	} else {
+		bw.WriteString("[")
+	}
+	n := 0
+	cursor := 0
+	// End the scan if the export stops before it is over.
+	defer func() {
+		if cursor != 0 {
+			bulkCall(kvReqCh, KVRequest{Op: KVScan, Cursor: cursor, Value: -1})
+		}
+	}()
+	for {
+		resp := bulkCall(kvReqCh, KVRequest{Op: KVScan, Cursor: cursor, Value: ScanLimit})
+		if !resp.Ok {
+			cursor = 0
+			return n, errors.New("kv scan failed: ended by newer scans")
+		}
+		cursor = resp.Cursor
+		for _, e := range resp.Entries {
+			if cw != nil {
+				cw.Write([]string{e.Key, strconv.Itoa(e.Value)})
+			} else {
+				b, err := json.Marshal(e)
+				if err != nil {
+					return n, err
+				}
+				if n > 0 {
+					bw.WriteString(",")
+				}
+				bw.WriteString("\n  ")
+				bw.Write(b)
+			}
+			n++
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	if cw != nil {
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return n, err
+		}
+	} else {
+		bw.WriteString("\n]\n")
+	}
+	return n, bw.Flush()
+}
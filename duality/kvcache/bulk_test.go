@@ -0,0 +1,110 @@
+package kvcache
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// A scan lists every key in order, a chunk at a time, owned keys with their
+// committed value, and creates nothing.
+func TestScanWalksStore(t *testing.T) {
+	ch, shutdown := startStore(StoreConfig{})
+	defer shutdown()
+	const n = 10
+	for i := range n {
+		bulkSet(ch, fmt.Sprintf("k%02d", i), i)
+	}
+	bulkCall(ch, KVRequest{Op: KVRead, Key: "k03"}) // owned by us
+
+	var got []KVEntry
+	for cursor := 0; ; {
+		rep := bulkCall(ch, KVRequest{Op: KVScan, Cursor: cursor, Value: 3})
+		if !rep.Ok || len(rep.Entries) > 3 {
+			t.Fatalf("scan reply = %+v, want at most 3 entries", rep)
+		}
+		got = append(got, rep.Entries...)
+		if cursor = rep.Cursor; cursor == 0 {
+			break
+		}
+	}
+	if len(got) != n {
+		t.Fatalf("scanned %d keys, want %d", len(got), n)
+	}
+	for i, e := range got {
+		if want := (KVEntry{Key: fmt.Sprintf("k%02d", i), Value: i}); e != want {
+			t.Errorf("entry %d = %v, want %v", i, e, want)
+		}
+	}
+	if rep := bulkCall(ch, KVRequest{Op: KVWrite, Key: "k03", Value: 3}); !rep.Ok {
+		t.Error("write of the owned key failed after the scan")
+	}
+}
+
+// An import sets the keys nobody owns and hands back the owned ones untouched.
+func TestImportSkipsOwnedKeys(t *testing.T) {
+	ch, shutdown := startStore(StoreConfig{})
+	defer shutdown()
+	bulkSet(ch, "a", 1)
+	bulkCall(ch, KVRequest{Op: KVRead, Key: "a"}) // owned by us
+
+	rep := bulkCall(ch, KVRequest{Op: KVImport, Entries: []KVEntry{{"a", 10}, {"b", 20}, {"b", 21}}})
+	if !rep.Ok || rep.Value != 2 || len(rep.Entries) != 1 || rep.Entries[0] != (KVEntry{"a", 10}) {
+		t.Fatalf("import reply = %+v, want 2 set and a handed back", rep)
+	}
+	if rep := bulkCall(ch, KVRequest{Op: KVWrite, Key: "a", Value: 2}); !rep.Ok {
+		t.Fatal("write of the owned key failed")
+	}
+	scan := bulkCall(ch, KVRequest{Op: KVScan}).Entries
+	if want := []KVEntry{{"a", 2}, {"b", 21}}; fmt.Sprint(scan) != fmt.Sprint(want) {
+		t.Errorf("store = %v, want %v", scan, want)
+	}
+}
+
+// A CSV import, exported as JSON and imported into a second store, comes out
+// the same, and an export lists only the keys the store holds.
+func TestBulkRoundTrip(t *testing.T) {
+	var in strings.Builder
+	in.WriteString("key,value\n")
+	const n = ScanLimit + 10 // more than one chunk
+	for i := range n {
+		fmt.Fprintf(&in, "key%04d,%d\n", i, i*7)
+	}
+	ch, shutdown := startStore(StoreConfig{})
+	defer shutdown()
+	keys, err := ImportFrom(strings.NewReader(in.String()), BulkCSV, ch)
+	if err != nil || len(keys) != n {
+		t.Fatalf("import: %d keys, %v", len(keys), err)
+	}
+	var js bytes.Buffer
+	if m, err := ExportTo(&js, BulkJSON, ch); err != nil || m != n {
+		t.Fatalf("export: %d records, %v", m, err)
+	}
+
+	ch2, shutdown2 := startStore(StoreConfig{})
+	defer shutdown2()
+	if _, err := ImportFrom(&js, BulkJSON, ch2); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if _, err := ExportTo(&out, BulkCSV, ch2); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != in.String() {
+		t.Error("CSV after the round trip differs from the input")
+	}
+}
+
+// Records before a bad one are still imported.
+func TestImportStopsAtBadRecord(t *testing.T) {
+	ch, shutdown := startStore(StoreConfig{})
+	defer shutdown()
+	_, err := ImportFrom(strings.NewReader("a,1\nb,x\nc,3\n"), BulkCSV, ch)
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("err = %v, want a line 2 error", err)
+	}
+	if got := bulkCall(ch, KVRequest{Op: KVScan}).Entries; fmt.Sprint(got) != fmt.Sprint([]KVEntry{{"a", 1}}) {
+		t.Errorf("store = %v, want only a", got)
+	}
+}
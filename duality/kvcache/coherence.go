@@ -0,0 +1,686 @@
+package kvcache
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----- Coherence protocol simulator -----
+
+// KVStore keeps the client caches coherent by ownership alone: a get takes a key,
+// a put gives it back, and nobody else may read it in between. Real caches keep
+// copies that outlive a single use, and a directory that knows who holds what
+// sends messages to the holders when that has to change. SimulateCoherence models
+// one such directory and its clients, goroutines of its own rather than KVStore
+// and KVClient, under a chosen Protocol, and counts the messages of each kind, so
+// the protocols can be compared on the same workload. KVStore itself runs only
+// the first and the last of them: own, and reval through KVClientWith with
+// ClientConfig.Revalidate.
+//
+//	own     the ownership scheme of KVStore: a get waits while another client
+//	        owns the key, and a put writes it back and releases it
+//	msi     write-invalidate: a get fetches a shared (S) copy, a put takes the key
+//	        modified (M) after the directory invalidates every other copy, and
+//	        the writer keeps it until another client asks
+//	mesi    msi, with a get of a key nobody else holds getting it exclusive (E),
+//	        so a put after it needs no message
+//	update  write-update: every copy stays valid, and a put is sent to the
+//	        directory, which sends the new value to every other holder
+//	reval   no invalidations: a put is sent to the directory, which gives the
+//	        key a new version and tells nobody, so other copies go stale; each
+//	        client keeps its copies fresh without TTLs by revalidating one of
+//	        them every RevalidateEvery of its operations, a conditional read
+//	        (Validate) the directory answers NotModified, or Modified with the
+//	        new value
+
+// Protocol is a coherence protocol for SimulateCoherence.
+type Protocol string
+
+const (
+	ProtoOwnership  Protocol = "own"
+	ProtoMSI        Protocol = "msi"
+	ProtoMESI       Protocol = "mesi"
+	ProtoUpdate     Protocol = "update"
+	ProtoRevalidate Protocol = "reval"
+)
+
+// Protocols lists the protocols SimulateCoherence knows, in the order they are described.
+var Protocols = []Protocol{ProtoOwnership, ProtoMSI, ProtoMESI, ProtoUpdate, ProtoRevalidate}
+
+// ParseProtocols parses a comma-separated list of protocols, or "all".
+func ParseProtocols(spec string) ([]Protocol, error) {
+	if spec == "all" {
+		return Protocols, nil
+	}
+	var out []Protocol
+	for _, f := range strings.Split(spec, ",") {
+		p := Protocol(strings.TrimSpace(f))
+		known := false
+		for _, q := range Protocols {
+			known = known || p == q
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown protocol %q (want own, msi, mesi, update, reval, or all)", p)
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+// CoherenceConfig describes a coherence run: Clients clients, each doing Ops
+// operations on Keys keys of its own, or with Shared, on the same Keys keys. An
+// operation is a get alone with probability Reads, and otherwise a get and a put
+// of a new value to the key.
+type CoherenceConfig struct {
+	Protocol Protocol
+	Clients  int
+	Ops      int
+	Keys     int
+	Shared   bool
+	Reads    float64
+	Seed     int64 // seeds the clients' choices of key and operation; 0 means 1
+
+	// RevalidateEvery is, under reval, how many of its operations a client does
+	// between revalidations of its cached keys, one key each, in turn; 0 means 1.
+	RevalidateEvery int
+}
+
+// CoherenceResult is what a coherence run measured. A get is stale if it returned
+// a value older than the last put to its key that finished before the get began.
+type CoherenceResult struct {
+	CoherenceConfig
+	Elapsed  time.Duration
+	Gets     int
+	Puts     int
+	Hits     int // gets and puts served without a message
+	Stale    int
+	Messages map[string]int // by kind
+
+	Revalidations int // under reval, conditional reads sent
+	StaleFound    int // of those, the ones that found the copy out of date
+}
+
+// TotalMessages returns the number of messages of every kind.
+func (r CoherenceResult) TotalMessages() int {
+	n := 0
+	for _, c := range r.Messages {
+		n += c
+	}
+	return n
+}
+
+// lineState is the state of a key in a client's cache.
+type lineState byte
+
+const (
+	stateI lineState = iota // invalid: not cached
+	stateS                  // shared: a read-only copy
+	stateE                  // exclusive: the only copy, unmodified
+	stateM                  // modified: the only copy; the directory's is out of date
+)
+
+// cohMsg is a message between the directory and a client.
+type cohMsg struct {
+	kind    string
+	from    int // the client that sent it, for requests and acks
+	key     string
+	value   int
+	state   lineState   // the state granted, on a reply
+	version int         // under reval, the version of value
+	reply   chan cohMsg // where the reply to a request goes
+}
+
+// cohNet carries and counts the messages of one run.
+type cohNet struct {
+	proto      Protocol
+	revalEvery int           // under reval, operations between revalidations
+	dirCh      chan cohMsg   // requests to the directory
+	ackCh      chan cohMsg   // acks of callbacks, to the directory
+	cbs        []chan cohMsg // callbacks to each client
+	history    *cohHistory
+
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (n *cohNet) count(kind string) {
+	n.mu.Lock()
+	n.counts[kind]++
+	n.mu.Unlock()
+}
+
+// cohHistory is the sequence of values written to each key, in the order the
+// writes took effect, for the check of stale gets.
+type cohHistory struct {
+	mu     sync.Mutex
+	values map[string][]int
+}
+
+func (h *cohHistory) record(key string, v int) {
+	h.mu.Lock()
+	h.values[key] = append(h.values[key], v)
+	h.mu.Unlock()
+}
+
+// writes returns the number of writes to key so far.
+func (h *cohHistory) writes(key string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.values[key])
+}
+
+// fresh reports whether v is the value of the first write to key at or after
+// from (the value current when a get began; 0 before any write) or a later one.
+func (h *cohHistory) fresh(key string, from, v int) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	vals := h.values[key]
+	if from == 0 && v == 0 {
+		return true
+	}
+	for _, w := range vals[max(from-1, 0):] {
+		if w == v {
+			return true
+		}
+	}
+	return false
+}
+
+// ----- Directory -----
+
+// dirEntry is what the directory knows of a key.
+type dirEntry struct {
+	value   int
+	version int          // under reval, bumped by every write
+	sharers map[int]bool // clients with an S copy
+	owner   int          // the client with the key in E or M (or owning it, under own); -1 if none
+	waiters []cohMsg     // under own, gets waiting for the owner's put
+}
+
+// directory serves the requests on n.dirCh until it is closed, then closes the
+// clients' callback channels.
+func (n *cohNet) directory(wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer func() {
+		for _, cb := range n.cbs {
+			close(cb)
+		}
+	}()
+	entries := make(map[string]*dirEntry)
+	entry := func(key string) *dirEntry {
+		e := entries[key]
+		if e == nil {
+			e = &dirEntry{sharers: make(map[int]bool), owner: -1}
+			entries[key] = e
+		}
+		return e
+	}
+	reply := func(req cohMsg, kind string, value int, state lineState) {
+		n.count(kind)
+		req.reply <- cohMsg{kind: kind, key: req.key, value: value, state: state, version: entries[req.key].version}
+	}
+	// callback sends kind to client c and waits for its ack.
+	callback := func(c int, kind, key string, value int) cohMsg {
+		n.count(kind)
+		n.cbs[c] <- cohMsg{kind: kind, key: key, value: value}
+		return <-n.ackCh
+	}
+
+	for req := range n.dirCh {
+		e := entry(req.key)
+		switch req.kind {
+		case "Acquire": // own
+			if e.owner >= 0 {
+				e.waiters = append(e.waiters, req)
+				continue
+			}
+			e.owner = req.from
+			reply(req, "Grant", e.value, stateM)
+		case "Release": // own: the put
+			e.value = req.value
+			n.history.record(req.key, req.value)
+			e.owner = -1
+			reply(req, "ReleaseAck", 0, stateI)
+			if len(e.waiters) > 0 {
+				next := e.waiters[0]
+				e.waiters = e.waiters[1:]
+				e.owner = next.from
+				reply(next, "Grant", e.value, stateM)
+			}
+		case "GetS":
+			if e.owner >= 0 && e.owner != req.from {
+				// the owner may have written: fetch its copy and make it shared
+				ack := callback(e.owner, "Fetch", req.key, 0)
+				e.value = ack.value
+				e.sharers[e.owner] = true
+				e.owner = -1
+			}
+			if n.proto == ProtoMESI && len(e.sharers) == 0 && e.owner < 0 {
+				e.owner = req.from
+				reply(req, "Data", e.value, stateE)
+				continue
+			}
+			e.sharers[req.from] = true
+			reply(req, "Data", e.value, stateS)
+		case "GetM":
+			for c := range e.sharers {
+				if c != req.from {
+					callback(c, "Inv", req.key, 0)
+				}
+			}
+			if e.owner >= 0 && e.owner != req.from {
+				ack := callback(e.owner, "Inv", req.key, 0)
+				e.value = ack.value
+			}
+			e.sharers = make(map[int]bool)
+			e.owner = req.from
+			reply(req, "Grant", e.value, stateM)
+		case "Write": // update
+			e.value = req.value
+			for c := range e.sharers {
+				if c != req.from {
+					callback(c, "Update", req.key, req.value)
+				}
+			}
+			n.history.record(req.key, req.value) // every copy is up to date
+			e.sharers[req.from] = true
+			reply(req, "WriteAck", 0, stateS)
+		case "Put": // reval
+			e.value = req.value
+			e.version++
+			n.history.record(req.key, req.value)
+			reply(req, "PutAck", 0, stateS)
+		case "Validate": // reval
+			if req.version == e.version {
+				reply(req, "NotModified", 0, stateS)
+			} else {
+				reply(req, "Modified", e.value, stateS)
+			}
+		}
+	}
+}
+
+// ----- Clients -----
+
+// cohLine is a key in a client's cache.
+type cohLine struct {
+	state   lineState
+	value   int
+	version int // under reval
+}
+
+// cohClient is a client's cache and its end of the network.
+type cohClient struct {
+	id    int
+	net   *cohNet
+	cb    chan cohMsg
+	lines map[string]*cohLine
+	hits  int
+
+	// under reval
+	ops        int      // operations done
+	cached     []string // keys cached, in the order they are revalidated
+	next       int      // the next of cached to revalidate
+	revals     int
+	staleFound int
+}
+
+func (c *cohClient) line(key string) *cohLine {
+	l := c.lines[key]
+	if l == nil {
+		l = &cohLine{}
+		c.lines[key] = l
+		c.cached = append(c.cached, key)
+	}
+	return l
+}
+
+// revalidate checks the next of the client's cached keys with the directory,
+// updating the copy if it is out of date.
+func (c *cohClient) revalidate() {
+	for range c.cached {
+		key := c.cached[c.next%len(c.cached)]
+		c.next++
+		l := c.lines[key]
+		if l.state == stateI {
+			continue
+		}
+		c.revals++
+		c.requestVersion("Validate", key, 0, l.version, func(rep cohMsg) {
+			if rep.kind == "Modified" {
+				c.staleFound++
+				l.value, l.version = rep.value, rep.version
+			}
+		})
+		return
+	}
+}
+
+// handle answers a callback from the directory.
+func (c *cohClient) handle(m cohMsg) {
+	l := c.line(m.key)
+	ack := cohMsg{from: c.id, key: m.key, value: l.value}
+	switch m.kind {
+	case "Inv":
+		ack.kind = "InvAck"
+		l.state = stateI
+	case "Fetch":
+		ack.kind = "FetchAck"
+		l.state = stateS
+	case "Update":
+		ack.kind = "UpdateAck"
+		l.value = m.value
+	}
+	c.net.count(ack.kind)
+	c.net.ackCh <- ack
+}
+
+// request sends kind to the directory and passes the reply to apply, answering
+// callbacks all the while. The directory waits for the ack of each callback, so
+// a reply that is waiting when a callback arrives was sent before it, and is
+// applied first.
+func (c *cohClient) request(kind, key string, value int, apply func(cohMsg)) {
+	c.requestVersion(kind, key, value, 0, apply)
+}
+
+// requestVersion is request with the version of the client's copy, for Validate.
+func (c *cohClient) requestVersion(kind, key string, value, version int, apply func(cohMsg)) {
+	req := cohMsg{kind: kind, from: c.id, key: key, value: value, version: version, reply: make(chan cohMsg, 1)}
+	c.net.count(kind)
+	for sent := false; !sent; {
+		select {
+		case c.net.dirCh <- req:
+			sent = true
+		case m := <-c.cb:
+			c.handle(m)
+		}
+	}
+	for {
+		select {
+		case rep := <-req.reply:
+			apply(rep)
+			return
+		case m := <-c.cb:
+			select {
+			case rep := <-req.reply:
+				apply(rep)
+				c.handle(m)
+				return
+			default:
+				c.handle(m)
+			}
+		}
+	}
+}
+
+// get returns the value of key.
+func (c *cohClient) get(key string) int {
+	l := c.line(key)
+	if l.state != stateI {
+		c.hits++
+		return l.value
+	}
+	kind := "GetS"
+	if c.net.proto == ProtoOwnership {
+		kind = "Acquire"
+	}
+	c.request(kind, key, 0, func(rep cohMsg) {
+		l.state, l.value, l.version = rep.state, rep.value, rep.version
+	})
+	return l.value
+}
+
+// put writes v to key.
+func (c *cohClient) put(key string, v int) {
+	l := c.line(key)
+	switch c.net.proto {
+	case ProtoOwnership:
+		c.request("Release", key, v, func(cohMsg) {
+			l.state = stateI
+		})
+	case ProtoUpdate:
+		c.request("Write", key, v, func(cohMsg) {
+			l.state, l.value = stateS, v
+		})
+	case ProtoRevalidate:
+		c.request("Put", key, v, func(rep cohMsg) {
+			l.state, l.value, l.version = stateS, v, rep.version
+		})
+	default:
+		write := func(cohMsg) {
+			// the key is held in M until the directory hears of another
+			// client's request, so this is the moment the write takes effect
+			l.state, l.value = stateM, v
+			c.net.history.record(key, v)
+		}
+		if l.state == stateM || l.state == stateE {
+			c.hits++
+			write(cohMsg{})
+		} else {
+			c.request("GetM", key, 0, write)
+		}
+	}
+}
+
+// cohOp is an operation sent to a client: a get, and a put of put if it is nonzero.
+type cohOp struct {
+	key   string
+	put   int
+	reply chan int // the value the get returned
+}
+
+// run serves ops until the channel is closed, then answers callbacks until the
+// directory closes its channel.
+func (c *cohClient) run(ops <-chan cohOp, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for ops != nil {
+		select {
+		case op, ok := <-ops:
+			if !ok {
+				ops = nil
+				continue
+			}
+			v := c.get(op.key)
+			if op.put != 0 {
+				c.put(op.key, op.put)
+			} else if c.net.proto == ProtoOwnership {
+				c.put(op.key, v) // a get alone must still give the key back
+			}
+			if c.net.proto == ProtoRevalidate {
+				if c.ops++; c.ops%c.net.revalEvery == 0 {
+					c.revalidate()
+				}
+			}
+			op.reply <- v
+		case m := <-c.cb:
+			c.handle(m)
+		}
+	}
+	for m := range c.cb {
+		c.handle(m)
+	}
+}
+
+// ----- Runs -----
+
+// SimulateCoherence runs the simulated directory and cfg.Clients clients under
+// cfg.Protocol, drives them with cfg.Ops operations each, and shuts them down again.
+func SimulateCoherence(cfg CoherenceConfig) (CoherenceResult, error) {
+	if cfg.Clients <= 0 || cfg.Ops <= 0 || cfg.Keys <= 0 {
+		return CoherenceResult{}, fmt.Errorf("clients, ops, and keys must be positive")
+	}
+	if cfg.Reads < 0 || cfg.Reads > 1 {
+		return CoherenceResult{}, fmt.Errorf("reads must be between 0 and 1")
+	}
+	if _, err := ParseProtocols(string(cfg.Protocol)); err != nil || cfg.Protocol == "all" {
+		return CoherenceResult{}, fmt.Errorf("unknown protocol %q", cfg.Protocol)
+	}
+	if cfg.Seed == 0 {
+		cfg.Seed = 1
+	}
+	if cfg.RevalidateEvery <= 0 {
+		cfg.RevalidateEvery = 1
+	}
+	n := &cohNet{
+		proto:      cfg.Protocol,
+		revalEvery: cfg.RevalidateEvery,
+		dirCh:      make(chan cohMsg),
+		ackCh:      make(chan cohMsg),
+		history:    &cohHistory{values: make(map[string][]int)},
+		counts:     make(map[string]int),
+	}
+	var dirWG, clientWG sync.WaitGroup
+	clients := make([]*cohClient, cfg.Clients)
+	opChs := make([]chan cohOp, cfg.Clients)
+	for i := range clients {
+		n.cbs = append(n.cbs, make(chan cohMsg, 1))
+		clients[i] = &cohClient{id: i, net: n, cb: n.cbs[i], lines: make(map[string]*cohLine)}
+		opChs[i] = make(chan cohOp)
+	}
+	dirWG.Add(1)
+	go n.directory(&dirWG)
+	clientWG.Add(cfg.Clients)
+	for i, c := range clients {
+		go c.run(opChs[i], &clientWG)
+	}
+
+	// One operation at a time, the clients in turn: the counts then depend on the
+	// workload alone, not on how the scheduler happens to interleave the clients.
+	res := CoherenceResult{CoherenceConfig: cfg}
+	rngs := make([]*rand.Rand, cfg.Clients)
+	for i := range rngs {
+		rngs[i] = rand.New(rand.NewSource(cfg.Seed + int64(i)))
+	}
+	start := time.Now()
+	for j := range cfg.Ops {
+		for i, rng := range rngs {
+			key := fmt.Sprintf("client%d-k%d", i+1, rng.Intn(cfg.Keys))
+			if cfg.Shared {
+				key = fmt.Sprintf("k%d", rng.Intn(cfg.Keys))
+			}
+			op := cohOp{key: key, reply: make(chan int, 1)}
+			if rng.Float64() >= cfg.Reads {
+				op.put = i*cfg.Ops + j + 1 // unique, so that the check can tell the writes apart
+				res.Puts++
+			}
+			from := n.history.writes(key)
+			opChs[i] <- op
+			res.Gets++
+			if v := <-op.reply; !n.history.fresh(key, from, v) {
+				res.Stale++
+			}
+		}
+	}
+	res.Elapsed = time.Since(start)
+	for _, ch := range opChs {
+		close(ch)
+	}
+	close(n.dirCh)
+	dirWG.Wait()
+	clientWG.Wait()
+	for _, c := range clients {
+		res.Hits += c.hits
+		res.Revalidations += c.revals
+		res.StaleFound += c.staleFound
+	}
+	res.Messages = n.counts
+	return res, nil
+}
+
+// CoherenceReport is the machine-readable form of a CoherenceResult.
+type CoherenceReport struct {
+	Protocol    Protocol       `json:"protocol"`
+	Clients     int            `json:"clients"`
+	Ops         int            `json:"ops"`
+	Keys        int            `json:"keys"`
+	Shared      bool           `json:"shared"`
+	Reads       float64        `json:"reads"`
+	ElapsedMs   float64        `json:"elapsedMs"`
+	Gets        int            `json:"gets"`
+	Puts        int            `json:"puts"`
+	Hits        int            `json:"hits"`
+	Stale       int            `json:"stale"`
+	Messages    int            `json:"messages"`
+	MessagesPer float64        `json:"messagesPerOp"`
+	ByKind      map[string]int `json:"byKind"`
+
+	RevalidateEvery int `json:"revalidateEvery,omitempty"`
+	Revalidations   int `json:"revalidations,omitempty"`
+	StaleFound      int `json:"staleFound,omitempty"`
+}
+
+// Report returns r in machine-readable form.
+func (r CoherenceResult) Report() CoherenceReport {
+	rep := CoherenceReport{
+		Protocol:  r.Protocol,
+		Clients:   r.Clients,
+		Ops:       r.Ops,
+		Keys:      r.Keys,
+		Shared:    r.Shared,
+		Reads:     r.Reads,
+		ElapsedMs: float64(r.Elapsed) / float64(time.Millisecond),
+		Gets:      r.Gets,
+		Puts:      r.Puts,
+		Hits:      r.Hits,
+		Stale:     r.Stale,
+		Messages:  r.TotalMessages(),
+		ByKind:    r.Messages,
+	}
+	if r.Protocol == ProtoRevalidate {
+		rep.RevalidateEvery = r.RevalidateEvery
+		rep.Revalidations = r.Revalidations
+		rep.StaleFound = r.StaleFound
+	}
+	if ops := r.Clients * r.Ops; ops > 0 {
+		rep.MessagesPer = float64(rep.Messages) / float64(ops)
+	}
+	return rep
+}
+
+// PrintCoherence writes a table comparing the results, one row per protocol, and
+// the messages of each kind under each.
+func PrintCoherence(w io.Writer, results []CoherenceResult) {
+	if len(results) == 0 {
+		return
+	}
+	r0 := results[0]
+	fmt.Fprintf(w, "clients=%d ops=%d keys=%d shared=%v reads=%.2f\n", r0.Clients, r0.Ops, r0.Keys, r0.Shared, r0.Reads)
+	fmt.Fprintf(w, "%-8s %10s %8s %10s %8s %6s\n", "protocol", "ops/sec", "hits", "messages", "msgs/op", "stale")
+	kinds := make(map[string]bool)
+	for _, r := range results {
+		rep := r.Report()
+		opsPerSec := 0.0
+		if s := r.Elapsed.Seconds(); s > 0 {
+			opsPerSec = float64(r.Clients*r.Ops) / s
+		}
+		fmt.Fprintf(w, "%-8s %10.0f %8d %10d %8.2f %6d\n", r.Protocol, opsPerSec, r.Hits, rep.Messages, rep.MessagesPer, r.Stale)
+		for k := range r.Messages {
+			kinds[k] = true
+		}
+	}
+	var names []string
+	for k := range kinds {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, r := range results {
+		fmt.Fprintf(w, "%-8s", r.Protocol)
+		for _, k := range names {
+			if c := r.Messages[k]; c > 0 {
+				fmt.Fprintf(w, " %s=%d", k, c)
+			}
+		}
+		fmt.Fprintln(w)
+	}
+	for _, r := range results {
+		if r.Protocol == ProtoRevalidate {
+			fmt.Fprintf(w, "reval: every %d ops, %d revalidations found %d stale copies; %d stale gets served\n",
+				r.RevalidateEvery, r.Revalidations, r.StaleFound, r.Stale)
+		}
+	}
+}
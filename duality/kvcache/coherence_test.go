@@ -0,0 +1,63 @@
+package kvcache
+
+import "testing"
+
+func TestParseProtocols(t *testing.T) {
+	if ps, err := ParseProtocols("all"); err != nil || len(ps) != len(Protocols) {
+		t.Errorf("all = %v, %v", ps, err)
+	}
+	if ps, err := ParseProtocols("msi, mesi"); err != nil || len(ps) != 2 || ps[1] != ProtoMESI {
+		t.Errorf("msi, mesi = %v, %v", ps, err)
+	}
+	if _, err := ParseProtocols("mosi"); err == nil {
+		t.Error("want an error for an unknown protocol")
+	}
+}
+
+// Every protocol but reval keeps the caches coherent, on shared keys too; reval
+// only bounds how stale a copy gets.
+func TestCoherenceProtocols(t *testing.T) {
+	for _, p := range Protocols {
+		res, err := SimulateCoherence(CoherenceConfig{Protocol: p, Clients: 3, Ops: 200, Keys: 4, Shared: true, Reads: 0.5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Gets != 600 || res.Puts == 0 || res.TotalMessages() == 0 {
+			t.Errorf("%s: gets=%d puts=%d messages=%d", p, res.Gets, res.Puts, res.TotalMessages())
+		}
+		if p != ProtoRevalidate && res.Stale != 0 {
+			t.Errorf("%s: %d stale gets", p, res.Stale)
+		}
+		if p == ProtoRevalidate && (res.Revalidations == 0 || res.StaleFound == 0) {
+			t.Errorf("reval: %d revalidations found %d stale", res.Revalidations, res.StaleFound)
+		}
+	}
+}
+
+// On private keys, MESI's exclusive state saves the upgrade message MSI sends
+// for a put after a get.
+func TestMESIBeatsMSIOnPrivateKeys(t *testing.T) {
+	msgs := map[Protocol]int{}
+	for _, p := range []Protocol{ProtoMSI, ProtoMESI} {
+		res, err := SimulateCoherence(CoherenceConfig{Protocol: p, Clients: 2, Ops: 200, Keys: 50, Reads: 0.2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs[p] = res.TotalMessages()
+	}
+	if msgs[ProtoMESI] >= msgs[ProtoMSI] {
+		t.Errorf("messages: mesi %d, msi %d; want mesi fewer", msgs[ProtoMESI], msgs[ProtoMSI])
+	}
+}
+
+func TestSimulateCoherenceRejectsBadConfig(t *testing.T) {
+	for _, cfg := range []CoherenceConfig{
+		{Protocol: ProtoMSI},
+		{Protocol: "all", Clients: 1, Ops: 1, Keys: 1},
+		{Protocol: ProtoMSI, Clients: 1, Ops: 1, Keys: 1, Reads: 2},
+	} {
+		if _, err := SimulateCoherence(cfg); err == nil {
+			t.Errorf("%+v: want an error", cfg)
+		}
+	}
+}
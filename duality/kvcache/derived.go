@@ -0,0 +1,367 @@
+package kvcache
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----- Derived keys -----
+
+// DerivedKeys is a set of compute functions for virtual keys, whose values the
+// store computes from other keys instead of the client reading them one key at a
+// time. A virtual key is a compute function's name and a key prefix: with
+// StoreConfig.Derived set, a read of "sum:acct/" is answered with the sum of every
+// key in the store starting with acct/ when the read arrives.
+//
+// The value is computed atomically: the store takes every key the prefix covers,
+// in key order, as a read would, waiting for each one that is owned, computes
+// once it has them all, and gives them back unchanged. A client that holds
+// several keys at once must take them in key order too, or it can deadlock with
+// a computation; and it must not read a virtual key over keys it holds. Any
+// number of computations can be under way at once, and other requests are served
+// while they wait. Under an ACL, a computation covers only the keys its reader
+// may get, as a scan lists only those.
+//
+// A read of a virtual key owns nothing. A write of one is acknowledged and
+// dropped, so a KVClient that puts back what it got works as with any key.
+
+// ComputeFunc computes a virtual key from the values of the keys it covers, in
+// key order.
+type ComputeFunc func(values []int) int
+
+// DerivedStats counts what the store computed.
+type DerivedStats struct {
+	Computed int `json:"computed"` // virtual keys read
+	KeysRead int `json:"keysRead"` // keys taken to compute them
+}
+
+// DerivedKeys is a set of compute functions.
+type DerivedKeys struct {
+	mu    sync.Mutex
+	funcs map[string]ComputeFunc
+	stats DerivedStats
+}
+
+// NewDerivedKeys returns a DerivedKeys with the functions sum, count, min, and
+// max registered; min and max of no keys are 0.
+func NewDerivedKeys() *DerivedKeys {
+	d := &DerivedKeys{funcs: make(map[string]ComputeFunc)}
+	d.Register("sum", func(vs []int) int {
+		s := 0
+		for _, v := range vs {
+			s += v
+		}
+		return s
+	})
+	d.Register("count", func(vs []int) int { return len(vs) })
+	d.Register("min", func(vs []int) int {
+		if len(vs) == 0 {
+			return 0
+		}
+		m := vs[0]
+		for _, v := range vs[1:] {
+			m = min(m, v)
+		}
+		return m
+	})
+	d.Register("max", func(vs []int) int {
+		if len(vs) == 0 {
+			return 0
+		}
+		m := vs[0]
+		for _, v := range vs[1:] {
+			m = max(m, v)
+		}
+		return m
+	})
+	return d
+}
+
+// Register makes name:prefix a virtual key computed by fn, for any prefix.
+func (d *DerivedKeys) Register(name string, fn ComputeFunc) {
+	d.mu.Lock()
+	d.funcs[name] = fn
+	d.mu.Unlock()
+}
+
+// virtual returns the function and prefix of key, if it is a virtual key. A nil
+// DerivedKeys has none.
+func (d *DerivedKeys) virtual(key string) (ComputeFunc, string, bool) {
+	if d == nil {
+		return nil, "", false
+	}
+	name, prefix, ok := strings.Cut(key, ":")
+	if !ok {
+		return nil, "", false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fn, ok := d.funcs[name]
+	return fn, prefix, ok
+}
+
+// Stats returns the counts so far.
+func (d *DerivedKeys) Stats() DerivedStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.stats
+}
+
+// derivedCalc is the computation of one read of a virtual key.
+type derivedCalc struct {
+	req    KVRequest
+	fn     ComputeFunc
+	keys   []string // the keys the prefix covered when the read arrived, in order
+	next   int      // keys[:next] are taken, or were removed before their turn
+	values []int    // of the keys taken, in order
+	held   []KeyID  // the keys taken and still held
+}
+
+// derivedCalcs are the computations under way in a store.
+type derivedCalcs struct {
+	waiting map[KeyID][]*derivedCalc // the computations waiting for each key, first come first
+	held    map[KeyID]*derivedCalc   // the computation owning each key
+}
+
+func newDerivedCalcs() *derivedCalcs {
+	return &derivedCalcs{waiting: make(map[KeyID][]*derivedCalc), held: make(map[KeyID]*derivedCalc)}
+}
+
+// newDerivedCalc returns the computation of req, a read of the virtual key of fn
+// and prefix, over the keys of store that acl lets its client get.
+func newDerivedCalc(req KVRequest, fn ComputeFunc, prefix string, store map[KeyID]int, keys *keyDict, acl *ACL) *derivedCalc {
+	c := &derivedCalc{req: req, fn: fn}
+	for k := range store {
+		if name := keys.name(k); strings.HasPrefix(name, prefix) && acl.Allowed(req.Client, ClientGet, name) {
+			c.keys = append(c.keys, name)
+		}
+	}
+	sort.Strings(c.keys)
+	return c
+}
+
+// advance takes c's keys in order, as far as it can, with take: a key removed
+// since the read arrived is skipped, and an owned one stops it, to wait for the
+// key's release. Keys are looked up by name as their turn comes, since the ID of
+// a key removed meanwhile may have gone to another. It reports whether c has
+// every key.
+func (cs *derivedCalcs) advance(c *derivedCalc, store map[KeyID]int, keys *keyDict, owned map[KeyID]bool, take func(KeyID)) bool {
+	for ; c.next < len(c.keys); c.next++ {
+		k, ok := keys.lookup(c.keys[c.next])
+		if !ok {
+			continue
+		}
+		v, ok := store[k]
+		if !ok {
+			continue
+		}
+		if owned[k] {
+			cs.waiting[k] = append(cs.waiting[k], c)
+			return false
+		}
+		take(k)
+		cs.held[k] = c
+		c.held = append(c.held, k)
+		c.values = append(c.values, v)
+	}
+	return true
+}
+
+// pop removes and returns the first computation waiting for key, or nil.
+func (cs *derivedCalcs) pop(key KeyID) *derivedCalc {
+	q := cs.waiting[key]
+	if len(q) == 0 {
+		return nil
+	}
+	if len(q) == 1 {
+		delete(cs.waiting, key)
+	} else {
+		cs.waiting[key] = q[1:]
+	}
+	return q[0]
+}
+
+// drop forgets key, which the store removed: its computation keeps the value it
+// took, and the computations waiting for it are returned, to go on.
+func (cs *derivedCalcs) drop(key KeyID) []*derivedCalc {
+	if c, ok := cs.held[key]; ok {
+		delete(cs.held, key)
+		c.held = slices.DeleteFunc(c.held, func(k KeyID) bool { return k == key })
+	}
+	waiting := cs.waiting[key]
+	delete(cs.waiting, key)
+	return waiting
+}
+
+// finish answers c's read and returns the keys c still owns, to be released.
+func (cs *derivedCalcs) finish(c *derivedCalc, d *DerivedKeys) []KeyID {
+	c.req.Reply <- KVReply{Value: c.fn(c.values), Ok: true}
+	d.mu.Lock()
+	d.stats.Computed++
+	d.stats.KeysRead += len(c.values)
+	d.mu.Unlock()
+	for _, k := range c.held {
+		delete(cs.held, k)
+	}
+	return c.held
+}
+
+// ----- Derived keys versus multi-get -----
+
+// DerivedConfig configures a comparison of a sum computed by the store with the
+// same sum computed by a client that reads every key itself. Writers move
+// units between their keys, each transfer holding both keys, so the sum never
+// changes; a reader reads it Reads times while they do. Latency delays each
+// request on its way to the store.
+type DerivedConfig struct {
+	Keys    int           `json:"keys"`    // keys summed; default 16
+	Writers int           `json:"writers"` // writers moving units between them; default 4
+	Reads   int           `json:"reads"`   // sums read; default 100
+	Latency time.Duration `json:"-"`       // per request, client to store
+}
+
+// DerivedRun is how one way of computing the sum did.
+type DerivedRun struct {
+	Mode      string        `json:"mode"`     // server (StoreConfig.Derived) or multiget
+	Reads     int           `json:"reads"`    // sums read
+	Requests  int           `json:"requests"` // requests the reader sent
+	Elapsed   time.Duration `json:"-"`
+	ElapsedMs float64       `json:"elapsedMs"`
+	MeanMs    float64       `json:"meanMs"`    // per sum
+	Torn      int           `json:"torn"`      // sums that were wrong, mid-transfer
+	Transfers int           `json:"transfers"` // by the writers, meanwhile
+}
+
+// DerivedResult compares the two ways.
+type DerivedResult struct {
+	DerivedConfig
+	LatencyMs float64      `json:"latencyMs"`
+	Total     int          `json:"total"` // what every sum should be
+	Runs      []DerivedRun `json:"runs"`
+}
+
+// DerivedDemo runs the comparison of cfg.
+func DerivedDemo(cfg DerivedConfig) (DerivedResult, error) {
+	if cfg.Keys <= 0 {
+		cfg.Keys = 16
+	}
+	if cfg.Writers <= 0 {
+		cfg.Writers = 4
+	}
+	if cfg.Reads <= 0 {
+		cfg.Reads = 100
+	}
+	if cfg.Keys < 2*cfg.Writers {
+		return DerivedResult{}, fmt.Errorf("need at least two keys per writer")
+	}
+	const start = 100
+	res := DerivedResult{DerivedConfig: cfg, LatencyMs: float64(cfg.Latency) / float64(time.Millisecond), Total: start * cfg.Keys}
+	for _, mode := range []string{"server", "multiget"} {
+		res.Runs = append(res.Runs, derivedRun(cfg, mode, start))
+	}
+	return res, nil
+}
+
+// derivedRun runs the writers and a reader of mode against a fresh store.
+func derivedRun(cfg DerivedConfig, mode string, start int) DerivedRun {
+	storeCh := make(chan KVRequest)
+	var storeWG sync.WaitGroup
+	storeWG.Add(1)
+	go KVStoreWith(storeCh, &storeWG, StoreConfig{Derived: NewDerivedKeys()}, nil)
+	front := storeCh
+	if cfg.Latency > 0 {
+		front = delayRequests(storeCh, cfg.Latency, &storeWG)
+	}
+
+	keys := make([]string, cfg.Keys)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("acct/%03d", i)
+		bulkSet(front, keys[i], start)
+	}
+
+	done := make(chan struct{})
+	var writers sync.WaitGroup
+	var mu sync.Mutex
+	run := DerivedRun{Mode: mode}
+	for w := range cfg.Writers {
+		var own []string // taken in key order, as the store takes them for a sum
+		for i := w; i < len(keys); i += cfg.Writers {
+			own = append(own, keys[i])
+		}
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			rng := rand.New(rand.NewSource(int64(w)))
+			n := 0
+			for {
+				select {
+				case <-done:
+					mu.Lock()
+					run.Transfers += n
+					mu.Unlock()
+					return
+				default:
+				}
+				i, j := rng.Intn(len(own)), rng.Intn(len(own)-1)
+				if j >= i {
+					j++
+				}
+				a, b := own[min(i, j)], own[max(i, j)]
+				va := bulkCall(front, KVRequest{Op: KVRead, Key: a}).Value
+				vb := bulkCall(front, KVRequest{Op: KVRead, Key: b}).Value
+				bulkCall(front, KVRequest{Op: KVWrite, Key: a, Value: va - 1})
+				bulkCall(front, KVRequest{Op: KVWrite, Key: b, Value: vb + 1})
+				n++
+			}
+		}()
+	}
+
+	t0 := time.Now()
+	for range cfg.Reads {
+		sum := 0
+		if mode == "server" {
+			sum = bulkCall(front, KVRequest{Op: KVRead, Key: "sum:acct/"}).Value
+			run.Requests++
+		} else {
+			values := make([]int, len(keys))
+			for i, k := range keys {
+				values[i] = bulkCall(front, KVRequest{Op: KVRead, Key: k}).Value
+				sum += values[i]
+			}
+			for i, k := range keys {
+				bulkCall(front, KVRequest{Op: KVWrite, Key: k, Value: values[i]})
+			}
+			run.Requests += 2 * len(keys)
+		}
+		run.Reads++
+		if sum != start*cfg.Keys {
+			run.Torn++
+		}
+	}
+	run.Elapsed = time.Since(t0)
+	close(done)
+	writers.Wait()
+	close(front)
+	storeWG.Wait()
+	run.ElapsedMs = float64(run.Elapsed) / float64(time.Millisecond)
+	run.MeanMs = run.ElapsedMs / float64(run.Reads)
+	return run
+}
+
+// PrintDerived writes a DerivedResult to w.
+func PrintDerived(w io.Writer, r DerivedResult) {
+	fmt.Fprintf(w, "keys=%d writers=%d reads=%d latency=%v, every sum should be %d\n",
+		r.Keys, r.Writers, r.Reads, r.Latency, r.Total)
+	fmt.Fprintf(w, "%-9s %9s %12s %10s %6s %10s\n", "mode", "requests", "elapsed", "mean", "torn", "transfers")
+	for _, run := range r.Runs {
+		fmt.Fprintf(w, "%-9s %9d %12v %10v %6d %10d\n", run.Mode, run.Requests,
+			run.Elapsed.Round(time.Microsecond), (run.Elapsed / time.Duration(max(run.Reads, 1))).Round(time.Microsecond),
+			run.Torn, run.Transfers)
+	}
+}
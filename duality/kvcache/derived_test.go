@@ -0,0 +1,114 @@
+package kvcache
+
+import (
+	"testing"
+	"time"
+)
+
+// startDerived starts a store computing the built-in virtual keys, with acct/a,
+// acct/b and acct/c set to 1, 2 and 3.
+func startDerived(t *testing.T, acl *ACL) (chan KVRequest, *DerivedKeys) {
+	d := NewDerivedKeys()
+	ch, shutdown := startStore(StoreConfig{Derived: d, ACL: acl})
+	t.Cleanup(func() { shutdown() })
+	for i, k := range []string{"acct/a", "acct/b", "acct/c"} {
+		bulkSet(ch, k, i+1)
+	}
+	bulkSet(ch, "other", 100)
+	return ch, d
+}
+
+func TestDerivedComputesInStore(t *testing.T) {
+	ch, d := startDerived(t, nil)
+	for key, want := range map[string]int{"sum:acct/": 6, "count:acct/": 3, "min:acct/": 1, "max:acct/": 3, "count:none/": 0} {
+		if rep := bulkCall(ch, KVRequest{Op: KVRead, Key: key}); !rep.Ok || rep.Value != want {
+			t.Errorf("%s = %+v, want %d", key, rep, want)
+		}
+	}
+	if rep := bulkCall(ch, KVRequest{Op: KVWrite, Key: "sum:acct/", Value: 99}); !rep.Ok {
+		t.Error("write of a virtual key was not acknowledged")
+	}
+	// Nothing is left owned, and nothing was created.
+	if rep := bulkCall(ch, KVRequest{Op: KVScan}); len(rep.Entries) != 4 {
+		t.Errorf("store holds %v after the computations", rep.Entries)
+	}
+	for _, k := range []string{"acct/a", "acct/b", "acct/c"} {
+		select {
+		case <-readAsync(ch, k):
+		case <-time.After(time.Second):
+			t.Fatalf("%s still owned after the computations", k)
+		}
+	}
+	if s := d.Stats(); s.Computed != 5 || s.KeysRead != 12 {
+		t.Errorf("stats = %+v, want 5 computed over 12 keys", s)
+	}
+}
+
+// A sum over a key a client owns waits for the client's write, and sees it; the
+// keys it took meanwhile are handed on when it is done.
+func TestDerivedWaitsForOwner(t *testing.T) {
+	ch, _ := startDerived(t, nil)
+	bulkCall(ch, KVRequest{Op: KVRead, Key: "acct/b"})
+	sum := readAsync(ch, "sum:acct/")
+	a := readAsync(ch, "acct/a") // held by the sum
+	if rep := bulkCall(ch, KVRequest{Op: KVRead, Key: "other"}); !rep.Ok {
+		t.Fatal("store stopped serving while the sum waits")
+	}
+	select {
+	case rep := <-sum:
+		t.Fatalf("sum answered with %d while acct/b is owned", rep.Value)
+	case <-a:
+		t.Fatal("acct/a granted while the sum holds it")
+	default:
+	}
+	bulkCall(ch, KVRequest{Op: KVWrite, Key: "acct/b", Value: 20})
+	if rep := <-sum; rep.Value != 24 {
+		t.Errorf("sum = %d, want 24", rep.Value)
+	}
+	if rep := <-a; rep.Value != 1 {
+		t.Errorf("acct/a = %d, want 1", rep.Value)
+	}
+}
+
+// A key deleted while a sum waits for it is left out of the sum, and one the
+// sum holds when it is deleted keeps its value in the sum.
+func TestDerivedSkipsDeletedKey(t *testing.T) {
+	ch, _ := startDerived(t, nil)
+	bulkCall(ch, KVRequest{Op: KVRead, Key: "acct/c"})
+	sum := readAsync(ch, "sum:acct/")
+	bulkCall(ch, KVRequest{Op: KVDelete, Key: "acct/a"})
+	bulkCall(ch, KVRequest{Op: KVDelete, Key: "acct/c"})
+	select {
+	case rep := <-sum:
+		if rep.Value != 3 {
+			t.Errorf("sum = %d, want 3", rep.Value)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("sum still waits for a deleted key")
+	}
+	if rep := bulkCall(ch, KVRequest{Op: KVRead, Key: "sum:acct/"}); rep.Value != 2 {
+		t.Errorf("sum after the deletes = %d, want 2", rep.Value)
+	}
+}
+
+// Under an ACL, a sum covers only the keys its reader may get.
+func TestDerivedHonoursACL(t *testing.T) {
+	acl := NewACL(ACLRule{Client: "", Prefix: "*", Ops: []ClientActionType{ClientGet, ClientPut}},
+		ACLRule{Client: "alice", Prefix: "acct/a", Ops: []ClientActionType{ClientGet}})
+	ch, _ := startDerived(t, acl)
+	if rep := bulkCall(ch, KVRequest{Op: KVRead, Key: "sum:acct/", Client: "alice"}); !rep.Ok || rep.Value != 1 {
+		t.Errorf("alice's sum = %+v, want 1, of acct/a alone", rep)
+	}
+}
+
+func TestDerivedDemoNeverTorn(t *testing.T) {
+	res, err := DerivedDemo(DerivedConfig{Keys: 8, Writers: 2, Reads: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, run := range res.Runs {
+		if run.Torn != 0 {
+			t.Errorf("%s: %d torn sums", run.Mode, run.Torn)
+		}
+	}
+}
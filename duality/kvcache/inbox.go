@@ -0,0 +1,57 @@
+package kvcache
+
+import "time"
+
+// ----- Store inbox -----
+
+// With StoreConfig.Inbox set, KVStoreWith takes in up to that many requests
+// ahead of serving them (see storeQueues) and measures the backpressure on its
+// senders: how full the inbox got, for how long it was full, and how long
+// senders waited for the store to take their requests. A sender waits while the
+// store is serving a request or its inbox is full; the store cannot see when a
+// sender started waiting, so it counts from the last time it looked for waiting
+// requests, and the block time is the time some sender was held up, not the sum
+// over every sender.
+
+// InboxStats measures the store's inbox over a run. Read them once the store has
+// exited.
+type InboxStats struct {
+	Depth     int           `json:"depth"`     // requests the inbox holds; 0 is no limit
+	HighWater int           `json:"highWater"` // most requests it held at once
+	Sends     int           `json:"sends"`     // requests put in it
+	Blocked   int           `json:"blocked"`   // of those, the ones whose sender was waiting for the store
+	BlockTime time.Duration `json:"-"`         // time some sender was waiting for the store
+	FullTime  time.Duration `json:"-"`         // time the inbox was full
+	BlockMs   float64       `json:"blockMs"`
+	FullMs    float64       `json:"fullMs"`
+}
+
+// took measures a request just put in the inbox at now. waited says whether its
+// sender was waiting for the store, since the store last looked.
+func (q *storeQueues) took(now time.Time, waited bool) {
+	ib := &q.inbox
+	ib.Sends++
+	ib.HighWater = max(ib.HighWater, q.queued)
+	if waited {
+		ib.Blocked++
+		ib.BlockTime += now.Sub(q.lastLook)
+	}
+	if q.depth > 0 && q.queued == q.depth {
+		q.fullSince = now
+	}
+	q.looked(now)
+}
+
+// left measures a request about to be taken out of the inbox at now.
+func (q *storeQueues) left(now time.Time) {
+	if q.depth > 0 && q.queued == q.depth {
+		q.inbox.FullTime += now.Sub(q.fullSince)
+	}
+}
+
+// looked notes that the store looked for waiting requests at now.
+func (q *storeQueues) looked(now time.Time) {
+	if q != nil {
+		q.lastLook = now
+	}
+}
@@ -0,0 +1,163 @@
+package kvcache
+
+import (
+	"sync"
+)
+
+// ----- Key IDs and interning -----
+
+// KVStoreWith and KVClientWith keep their per-key maps by KeyID, a small integer
+// each key is given, rather than by the key string: a store holds a key's value,
+// whether it is owned, by whom, who waits for it, when it was written and its
+// version, and with string keys each of those maps would hold its own header of
+// the key, and a client's cache its own copy of it. With IDs, the key's bytes are
+// held once, in a keyDict that maps keys to IDs and back, and the maps hold
+// four-byte IDs.
+//
+// A keyDict of its own numbers the keys a store or client holds now, and reuses
+// the ID of a key it lets go. Given a KeyTable (StoreConfig.Keys and
+// ClientConfig.Keys), the store and its clients number keys from the one table
+// instead, which also interns them: the keys clients build afresh for each
+// action are all replaced by the table's one copy, and a key has the same ID
+// everywhere. A KeyTable only grows, so it suits a bounded key space.
+
+// KeyID is the number of a key in a keyDict or KeyTable.
+type KeyID int32
+
+// KeyTableStats describes a KeyTable.
+type KeyTableStats struct {
+	Keys     int `json:"keys"`     // distinct keys
+	Lookups  int `json:"lookups"`  // keys looked up
+	KeyBytes int `json:"keyBytes"` // bytes of the distinct keys, which the table holds
+}
+
+// LiveSavedBytes returns the bytes of key strings a KeyTable kept out of the live
+// set, at most: the store's keys when it exited and the clients' cached keys at
+// their peak, each of which would otherwise hold its own copy, less the table's
+// one copy of every key it has seen. It is negative when the table keeps keys
+// the store has let go.
+func LiveSavedBytes(table KeyTableStats, store StoreStats) int {
+	return store.KeyBytes + store.PeakOwnedBytes - table.KeyBytes
+}
+
+// KeyTable is a table of interned keys, numbered in the order they were first
+// seen. It is safe to share between a store and its clients.
+type KeyTable struct {
+	mu    sync.Mutex
+	ids   map[string]KeyID
+	names []string
+	stats KeyTableStats
+}
+
+// NewKeyTable returns an empty table.
+func NewKeyTable() *KeyTable {
+	return &KeyTable{ids: make(map[string]KeyID)}
+}
+
+// ID returns the ID of key, giving it the next one if it has none.
+func (t *KeyTable) ID(key string) KeyID {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stats.Lookups++
+	if id, ok := t.ids[key]; ok {
+		return id
+	}
+	id := KeyID(len(t.names))
+	t.ids[key] = id
+	t.names = append(t.names, key)
+	t.stats.Keys++
+	t.stats.KeyBytes += len(key)
+	return id
+}
+
+// Lookup returns the ID of key, if it has one.
+func (t *KeyTable) Lookup(key string) (KeyID, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stats.Lookups++
+	id, ok := t.ids[key]
+	return id, ok
+}
+
+// Key returns the table's copy of the key numbered id.
+func (t *KeyTable) Key(id KeyID) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.names[id]
+}
+
+// Intern returns the table's copy of key, which is key itself the first time.
+func (t *KeyTable) Intern(key string) string {
+	return t.Key(t.ID(key))
+}
+
+// Stats returns the table's counts.
+func (t *KeyTable) Stats() KeyTableStats {
+	if t == nil {
+		return KeyTableStats{}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stats
+}
+
+// keyDict maps the keys of a store or a client to IDs and back, from table if
+// it is set, or else from maps of its own.
+type keyDict struct {
+	table *KeyTable
+	ids   map[string]KeyID
+	names []string
+	free  []KeyID // IDs forgotten, to give again
+}
+
+func newKeyDict(table *KeyTable) *keyDict {
+	return &keyDict{table: table, ids: make(map[string]KeyID)}
+}
+
+// id returns the ID of key, giving it one if it has none.
+func (d *keyDict) id(key string) KeyID {
+	if d.table != nil {
+		return d.table.ID(key)
+	}
+	if id, ok := d.ids[key]; ok {
+		return id
+	}
+	var id KeyID
+	if n := len(d.free); n > 0 {
+		id, d.free = d.free[n-1], d.free[:n-1]
+		d.names[id] = key
+	} else {
+		id = KeyID(len(d.names))
+		d.names = append(d.names, key)
+	}
+	d.ids[key] = id
+	return id
+}
+
+// lookup returns the ID of key, if it has one.
+func (d *keyDict) lookup(key string) (KeyID, bool) {
+	if d.table != nil {
+		return d.table.Lookup(key)
+	}
+	id, ok := d.ids[key]
+	return id, ok
+}
+
+// name returns the key numbered id.
+func (d *keyDict) name(id KeyID) string {
+	if d.table != nil {
+		return d.table.Key(id)
+	}
+	return d.names[id]
+}
+
+// forget lets go of the key numbered id, which nothing refers to any more. A
+// KeyTable never forgets.
+func (d *keyDict) forget(id KeyID) {
+	if d.table != nil {
+		return
+	}
+	delete(d.ids, d.names[id])
+	d.names[id] = ""
+	d.free = append(d.free, id)
+}
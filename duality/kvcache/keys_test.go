@@ -0,0 +1,103 @@
+package kvcache
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"unsafe"
+)
+
+func TestInternSharesOneCopy(t *testing.T) {
+	tab := NewKeyTable()
+	a := tab.Intern(strings.Repeat("k", 8))
+	b := tab.Intern(strings.Repeat("k", 8))
+	if unsafe.StringData(a) != unsafe.StringData(b) {
+		t.Error("the second Intern of a key did not return the first copy")
+	}
+	if id := tab.ID("other"); id != 1 || tab.Key(id) != "other" {
+		t.Errorf("the second key is %d, %q", id, tab.Key(id))
+	}
+	if s := tab.Stats(); s != (KeyTableStats{Keys: 2, Lookups: 3, KeyBytes: 13}) {
+		t.Errorf("stats = %+v", s)
+	}
+}
+
+// A keyDict of its own gives the ID of a key it forgot to the next new key; one
+// on a KeyTable forgets nothing.
+func TestKeyDictReusesIDs(t *testing.T) {
+	d := newKeyDict(nil)
+	a, b := d.id("a"), d.id("b")
+	d.forget(a)
+	if _, ok := d.lookup("a"); ok {
+		t.Error("a forgotten key still has an ID")
+	}
+	if c := d.id("c"); c != a || d.name(c) != "c" || d.name(b) != "b" {
+		t.Errorf("c = %d (%q), want %d; b = %q", c, d.name(c), a, d.name(b))
+	}
+
+	d = newKeyDict(NewKeyTable())
+	a = d.id("a")
+	d.forget(a)
+	if id, ok := d.lookup("a"); !ok || id != a {
+		t.Error("a keyDict on a table forgot a key")
+	}
+}
+
+// The live set is the store's keys when it exits and the keys clients owned at
+// the peak; a key owned and given back is counted once.
+func TestLiveSavedBytes(t *testing.T) {
+	ch, shutdown := startStore(StoreConfig{})
+	bulkSet(ch, "aaaa", 1)
+	bulkCall(ch, KVRequest{Op: KVRead, Key: "bb"})
+	bulkCall(ch, KVRequest{Op: KVRead, Key: "aaaa"})
+	bulkCall(ch, KVRequest{Op: KVWrite, Key: "aaaa", Value: 2})
+	bulkCall(ch, KVRequest{Op: KVWrite, Key: "bb", Value: 2})
+	bulkSet(ch, "gone", 3)
+	bulkCall(ch, KVRequest{Op: KVDelete, Key: "gone"})
+	st := shutdown()
+	if st.Keys != 2 || st.KeyBytes != 6 || st.PeakOwned != 2 || st.PeakOwnedBytes != 6 {
+		t.Fatalf("store stats = %+v, want 2 keys of 6 B, both owned at the peak", st)
+	}
+	if saved := LiveSavedBytes(KeyTableStats{Keys: 2, KeyBytes: 6}, st); saved != 6 {
+		t.Errorf("saved = %d B, want 6", saved)
+	}
+}
+
+// A store and a client numbering keys from one table agree on them through
+// gets, puts, and a delete that frees the key's ID in neither.
+func TestSharedKeyTable(t *testing.T) {
+	tab := NewKeyTable()
+	ch, shutdown := startStore(StoreConfig{Keys: tab})
+	defer shutdown()
+	actCh := make(chan ClientAction)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go KVClientWith("c", actCh, ch, &wg, ClientConfig{Keys: tab}, nil)
+	do := func(typ ClientActionType, key string, value int) ClientReply {
+		act := ClientAction{Type: typ, Key: key, Value: value, Reply: make(chan ClientReply)}
+		actCh <- act
+		return <-act.Reply
+	}
+
+	for i, key := range []string{"tenant/a", "tenant/b", "tenant/a"} {
+		if get := do(ClientGet, key, 0); !get.Ok {
+			t.Fatalf("get %d of %s failed", i, key)
+		}
+		if put := do(ClientPut, key, i+1); !put.Ok {
+			t.Fatalf("put %d of %s failed", i, key)
+		}
+	}
+	bulkCall(ch, KVRequest{Op: KVDelete, Key: "tenant/b"})
+	if get := do(ClientGet, "tenant/b", 0); !get.Ok || get.Value != 0 {
+		t.Fatalf("get of a deleted key = %+v, want 0", get)
+	}
+	do(ClientPut, "tenant/b", 9)
+	if rep := bulkCall(ch, KVRequest{Op: KVValidate, Key: "tenant/a"}); rep.Value != 3 {
+		t.Errorf("tenant/a = %d, want 3", rep.Value)
+	}
+	close(actCh)
+	wg.Wait()
+	if s := tab.Stats(); s.Keys != 2 || s.KeyBytes != 16 {
+		t.Errorf("table stats = %+v, want the 2 keys", s)
+	}
+}
@@ -5,6 +5,7 @@ package kvcache
 import (
 	"fmt"
 	"sync"
+	"time"
 )
 
 // ----- KV store request/response types -----
@@ -12,22 +13,49 @@ import (
 type KVOp string
 
 const (
-	KVRead  KVOp = "read"
-	KVWrite KVOp = "write"
+	KVRead   KVOp = "read"
+	KVWrite  KVOp = "write"
+	KVSweep  KVOp = "sweep"  // expire keys now (see StoreConfig); Value of the reply is how many
+	KVDelete KVOp = "delete" // remove a key, giving up its ownership as a write does
+	KVScan   KVOp = "scan"   // list up to Value keys of the scan Cursor names, with their values (see keyScans)
+	KVImport KVOp = "import" // set the keys in Entries that nobody owns; the rest come back in the reply
+
+	KVValidate KVOp = "validate" // the committed value and Version of a key, taking nothing; fails if it is missing
+
+	KVPutChunk KVOp = "putchunk" // stage Data at Offset of a blob of Value bytes, replacing it once complete (see blobStore)
+	KVGetChunk KVOp = "getchunk" // up to Value bytes of a blob from Offset on
 )
 
+// KVEntry is a key and its value, as KVScan and KVImport carry them.
+type KVEntry struct {
+	Key   string `json:"key"`
+	Value int    `json:"value"`
+}
+
 // KVRequest is a request to KVStore.
 type KVRequest struct {
-	Op    KVOp         // has an operation, which must be a KVOp (KVRead or KVWrite)
-	Key   string       // refers to a key in the key-value store
-	Value int          // only used for write
-	Reply chan KVReply // channel to send the result back
+	Op     KVOp         // has an operation, which must be a KVOp (KVRead or KVWrite)
+	Key    string       // refers to a key in the key-value store
+	Value  int          // only used for write
+	Reply  chan KVReply // channel to send the result back
+	Client string       // who asks, as StoreConfig.ACL names clients; "" if nobody in particular
+
+	Entries []KVEntry // only used for import
+	Cursor  int       // only used for scan: the scan to go on with, 0 to start one
+	Data    []byte    // only used for putchunk: the chunk
+	Offset  int       // only used for putchunk and getchunk: where in the blob the chunk starts
 }
 
 // KVReply is the store's reply.
 type KVReply struct {
 	Value int  // value for reads; for writes, returned value after update (if Ok)
 	Ok    bool // true on success; false on failure (e.g., write to missing key)
+
+	Entries []KVEntry // for scan, the keys listed; for import, the keys not set
+	Cursor  int       // for scan, the Cursor to pass next, 0 once the scan is over
+	Version int       // for read, write, and validate, the key's version (see keyVersions)
+	Err     string    // why it failed, if the store says (ErrForbidden)
+	Data    []byte    // for getchunk, the chunk
 }
 
 // ----- Client action/request types -----
@@ -53,36 +81,194 @@ type ClientReply struct {
 	Hit   bool
 	Ok    bool
 	Err   string // optional human-friendly error
+
+	Version int // the key's version in the store, if known (see ClientConfig)
 }
 
 // ----- Key-Value store goroutine -----
 
 // KVStore runs as a goroutine and services KVRequest messages until reqCh is closed.
 func KVStore(reqCh <-chan KVRequest, wg *sync.WaitGroup) {
+	KVStoreWith(reqCh, wg, StoreConfig{}, nil)
+}
+
+// KVStoreWith is KVStore configured by cfg (see StoreConfig). stats may be nil.
+func KVStoreWith(reqCh <-chan KVRequest, wg *sync.WaitGroup, cfg StoreConfig, stats *StoreStats) {
 	defer wg.Done()
-	store := make(map[string]int)
+	if stats == nil {
+		stats = &StoreStats{}
+	}
+	keys := newKeyDict(cfg.Keys) // the ID of each key in the store (see keys.go)
+	store := make(map[KeyID]int)
 	// keyholder_store := make(map[string]chan KVReply) // the string is the relevant key, the channel KVReply from the KVRequest sent
-	isKeyOwned_store := make(map[string]bool)
-	waitingclients_store := make(map[string]KVRequest)
+	isKeyOwned_store := make(map[KeyID]bool)
+	owner := make(map[KeyID]string) // the client each owned key was granted to, if cfg.ACL is set
+	waitingclients_store := make(map[KeyID]KVRequest)
+	times := newKeyTimes(cfg) // when each key was last written and used, for the sweep
+	versions := newKeyVersions()
+	scans := newKeyScans()
+	blobs := newBlobStore()
+	calcs := newDerivedCalcs() // reads of virtual keys taking their keys, if cfg.Derived is set
+
+	// hold counts n more keys owned by clients, which hold them in their caches.
+	owned, ownedBytes := 0, 0
+	hold := func(k KeyID, n int) {
+		owned += n
+		ownedBytes += n * len(keys.name(k))
+		stats.PeakOwned = max(stats.PeakOwned, owned)
+		stats.PeakOwnedBytes = max(stats.PeakOwnedBytes, ownedBytes)
+	}
+
+	// grant makes the client of req the owner of key k.
+	grant := func(k KeyID, req KVRequest) {
+		isKeyOwned_store[k] = true
+		if cfg.ACL != nil {
+			owner[k] = req.Client
+		}
+		hold(k, 1)
+	}
+
+	// take makes a computation of a virtual key the owner of key k. It has no
+	// client to own it for, so no client's write can give the key back.
+	take := func(k KeyID) {
+		isKeyOwned_store[k] = true
+		hold(k, 1)
+	}
+
+	// release gives up the ownership of key k: to the client waiting for it, or
+	// else to the first computation waiting for it, which may then finish and
+	// release its own keys.
+	var release func(k KeyID)
+	// settle takes c's keys as far as it can, and once it has them all,
+	// answers it and gives them back.
+	settle := func(c *derivedCalc) {
+		if calcs.advance(c, store, keys, isKeyOwned_store, take) {
+			for _, k := range calcs.finish(c, cfg.Derived) {
+				release(k)
+			}
+		}
+	}
+	release = func(k KeyID) {
+		isKeyOwned_store[k] = false
+		delete(owner, k)
+		hold(k, -1)
+
+		if waiting_guy, ok := waitingclients_store[k]; ok {
+			delete(waitingclients_store, k)
+			grant(k, waiting_guy)
+			val, ok := store[k] // retrieve
+			if !ok {
+				store[k] = 0
+				val = 0
+			}
+			waiting_guy.Reply <- KVReply{Value: val, Ok: true, Version: versions.of[k]}
+			return
+		}
+		if c := calcs.pop(k); c != nil {
+			settle(c)
+		}
+	}
+
+	var tick <-chan time.Time
+	if cfg.sweeps() {
+		ticker := time.NewTicker(cfg.sweepEvery())
+		defer ticker.Stop()
+		tick = ticker.C
+	}
 
-	// KVClient has no client ID
+	q := newStoreQueues(cfg) // nil unless cfg.Sched or cfg.Inbox is set
+	exit := func() {
+		stats.Keys = len(store)
+		for k := range store {
+			stats.KeyBytes += len(keys.name(k))
+		}
+		q.finish(stats)
+	}
 
-	for req := range reqCh { // blocks until a request arrives // THIS IS KVREQUESTS!
+	for {
+		// With queues, take in every request already waiting, as far as
+		// there is room, before serving the next.
+		if reqCh != nil && q.room() {
+			select {
+			case now := <-tick:
+				sweep(store, isKeyOwned_store, times, versions, keys, cfg, now, stats)
+				continue
+			case r, ok := <-reqCh:
+				if !ok {
+					reqCh = nil // serve what is queued, then exit
+					continue
+				}
+				q.add(r, time.Now(), true)
+				continue
+			default:
+				q.looked(time.Now())
+			}
+		}
+		var req KVRequest
+		if q.len() > 0 {
+			req = q.take(time.Now())
+		} else {
+			if reqCh == nil {
+				exit()
+				return
+			}
+			select {
+			case now := <-tick:
+				sweep(store, isKeyOwned_store, times, versions, keys, cfg, now, stats)
+				continue
+			case r, ok := <-reqCh: // blocks until a request arrives // THIS IS KVREQUESTS!
+				if !ok {
+					exit()
+					return
+				}
+				if q != nil {
+					q.add(r, time.Now(), false)
+					continue
+				}
+				req = r
+			}
+		}
+		// Reads of virtual keys are computed; writes of them are dropped.
+		if fn, prefix, ok := cfg.Derived.virtual(req.Key); ok && (req.Op == KVRead || req.Op == KVWrite) {
+			if req.Op == KVWrite {
+				req.Reply <- KVReply{Value: req.Value, Ok: true}
+			} else {
+				settle(newDerivedCalc(req, fn, prefix, store, keys, cfg.ACL))
+			}
+			continue
+		}
+		// k is the ID of the request's key; present says whether the key is in
+		// the store.
+		k, present := keys.lookup(req.Key)
+		if present {
+			_, present = store[k]
+		}
+		if !cfg.ACL.permits(req) {
+			// The owner of a key it may not write gives it back unchanged, or
+			// whoever waits for it would wait forever.
+			if req.Op == KVWrite && present && isKeyOwned_store[k] && calcs.held[k] == nil && owner[k] == req.Client {
+				release(k)
+			}
+			req.Reply <- KVReply{Ok: false, Err: ErrForbidden.Error()}
+			continue
+		}
 		switch req.Op {
 		// Grant ownership on reading on key K
 		case KVRead:
 			// If key missing, create with 0.
-			if !isKeyOwned_store[req.Key] {
-				isKeyOwned_store[req.Key] = true
-
-				val, ok := store[req.Key] // retrieve
-				if !ok {
-					store[req.Key] = 0
-					val = 0
-				}
-				req.Reply <- KVReply{Value: val, Ok: true}
+			if !present {
+				k = keys.id(req.Key)
+				store[k] = 0
+				versions.bump(k)
+				times.write(k, times.now())
 			} else {
-				waitingclients_store[req.Key] = req
+				times.use(k, times.now())
+			}
+			if !isKeyOwned_store[k] {
+				grant(k, req)
+				req.Reply <- KVReply{Value: store[k], Ok: true, Version: versions.of[k]}
+			} else {
+				waitingclients_store[k] = req
 			}
 			// If req.Reply is an unbuffered channel, this send will block
 			// until the client receives from it. store will pause here
@@ -92,26 +278,85 @@ func KVStore(reqCh <-chan KVRequest, wg *sync.WaitGroup) {
 		case KVWrite:
 
 			// Fail if key not in map.
-			if _, ok := store[req.Key]; !ok {
+			if !present {
 				req.Reply <- KVReply{Value: 0, Ok: false}
 			} else {
-				store[req.Key] = req.Value
-				req.Reply <- KVReply{Value: req.Value, Ok: true}
+				cfg.Audit.write(req.Client, req.Key, store[k], req.Value)
+				store[k] = req.Value
+				times.write(k, times.now())
+				cfg.Watchers.Notify(KeyEvent{Kind: KeyUpdated, Key: req.Key, Value: req.Value})
+				req.Reply <- KVReply{Value: req.Value, Ok: true, Version: versions.bump(k)}
+				if isKeyOwned_store[k] {
+					release(k)
+				}
+			}
 
-				isKeyOwned_store[req.Key] = false
+		case KVSweep:
+			req.Reply <- KVReply{Value: sweep(store, isKeyOwned_store, times, versions, keys, cfg, time.Now(), stats), Ok: true}
 
-				if waiting_guy, ok := waitingclients_store[req.Key]; ok {
-					isKeyOwned_store[waiting_guy.Key] = true
-					val, ok := store[waiting_guy.Key] // retrieve
-					if !ok {
-						store[waiting_guy.Key] = 0
-						val = 0
-					}
-					waiting_guy.Reply <- KVReply{Value: val, Ok: true}
-				}
-				delete(waitingclients_store, req.Key)
+		// Remove key K, which releases it as a write does: a waiting reader
+		// creates it again with 0.
+		case KVDelete:
+			if !present {
+				req.Reply <- KVReply{Value: 0, Ok: false}
+				break
+			}
+			val := store[k]
+			if isKeyOwned_store[k] {
+				hold(k, -1)
+			}
+			delete(store, k)
+			delete(isKeyOwned_store, k)
+			delete(owner, k)
+			times.drop(k)
+			versions.drop(k)
+			stalled := calcs.drop(k) // a computation holding it keeps the value it took
+			stats.Deleted++
+			cfg.Watchers.Notify(KeyEvent{Kind: KeyDeleted, Key: req.Key, Value: val})
+			req.Reply <- KVReply{Value: val, Ok: true}
+			if waiting_guy, ok := waitingclients_store[k]; ok {
+				delete(waitingclients_store, k)
+				store[k] = 0
+				times.write(k, times.now())
+				grant(k, waiting_guy)
+				waiting_guy.Reply <- KVReply{Value: 0, Ok: true, Version: versions.bump(k)}
+			} else {
+				keys.forget(k)
+			}
+			// Computations waiting for the key go on: past it, or back to
+			// waiting for it if a reader has created it again.
+			for _, c := range stalled {
+				settle(c)
+			}
 
+		// List committed values, owned keys included, without taking or
+		// creating any: a scan is not a read.
+		case KVScan:
+			entries, cursor, ok := scans.scan(store, keys, req.Cursor, req.Value)
+			entries = cfg.ACL.visible(req.Client, entries)
+			req.Reply <- KVReply{Value: len(entries), Ok: ok, Entries: entries, Cursor: cursor}
+
+		// Set what nobody owns; hand back the rest for the caller to wait for.
+		case KVImport:
+			set, held := importEntries(store, isKeyOwned_store, times, versions, keys, cfg, req.Client, req.Entries)
+			req.Reply <- KVReply{Value: set, Ok: true, Entries: held}
+
+		// Answer a conditional read: the committed value of key K and its
+		// version, which the caller compares with the one it holds. Nothing is
+		// taken or created.
+		case KVValidate:
+			if !present {
+				req.Reply <- KVReply{Ok: false}
+				break
 			}
+			req.Reply <- KVReply{Value: store[k], Ok: true, Version: versions.of[k]}
+
+		// Take or hand out a chunk of a large value, which lives apart from
+		// the int values: nothing is owned.
+		case KVPutChunk:
+			req.Reply <- blobs.putChunk(req)
+		case KVGetChunk:
+			req.Reply <- blobs.getChunk(req)
 
 		default:
 			// Unknown operation: respond with failure.
@@ -124,25 +369,63 @@ func KVStore(reqCh <-chan KVRequest, wg *sync.WaitGroup) {
 // ----- Client goroutine -----
 
 // KVClient runs as a client goroutine that listens on actionsCh for get/put requests.
-// It keeps a local cache (map[string]int). It talks to the KV store via kvReqCh.
+// It keeps a local cache (map[KeyID]int, see keys.go). It talks to the KV store via kvReqCh.
 func KVClient(name string, actionsCh <-chan ClientAction, kvReqCh chan<- KVRequest, wg *sync.WaitGroup) {
+	KVClientWith(name, actionsCh, kvReqCh, wg, ClientConfig{}, nil)
+}
+
+// KVClientWith is KVClient configured by cfg (see ClientConfig). stats may be nil.
+func KVClientWith(name string, actionsCh <-chan ClientAction, kvReqCh chan<- KVRequest, wg *sync.WaitGroup, cfg ClientConfig, stats *ClientStats) {
 	defer wg.Done()
-	cache := make(map[string]int)
+	if stats == nil {
+		stats = &ClientStats{}
+	}
+	keys := newKeyDict(cfg.Keys) // the ID of each key in cache or copies
+	cache := make(map[KeyID]int)
+	var copies *readCopies // keys put and kept to read, if cfg.Revalidate is set
+	// let forgets key k if neither cache nor copies has it any more.
+	let := func(k KeyID) {
+		if _, ok := cache[k]; !ok && !copies.holds(k) {
+			keys.forget(k)
+		}
+	}
+	copies = newReadCopies(name, keys, let)
+	actions := 0
+	// version is the version to reply with of a key the store answered for:
+	// only a client keeping copies tells its callers versions.
+	version := func(r KVReply) int {
+		if cfg.Revalidate > 0 {
+			return r.Version
+		}
+		return 0
+	}
 
 	for act := range actionsCh {
+		if actions++; cfg.Revalidate > 0 && actions%cfg.Revalidate == 0 {
+			copies.revalidate(kvReqCh, stats)
+		}
+		// k is the ID of the action's key, if the client holds it.
+		k, known := keys.lookup(act.Key)
 		switch act.Type {
 		case ClientGet:
 			// If in cache, reply immediately.
-			if v, ok := cache[act.Key]; ok {
+			if v, ok := cache[k]; known && ok {
 				act.Reply <- ClientReply{Value: v, Hit: true, Ok: true}
 				continue
 			}
+			// A read copy is served as it is, however stale.
+			if c, ok := copies.of[k]; known && ok {
+				stats.CopyHits++
+				act.Reply <- ClientReply{Value: c.value, Hit: true, Ok: true, Version: c.version}
+				continue
+			}
 			// Not in cache: send a read to the KV store.
 			kvReplyCh := make(chan KVReply) // new one
 			kvReq := KVRequest{             // new one
-				Op:    KVRead,
-				Key:   act.Key,
-				Reply: kvReplyCh, // new channel goes in here
+				Op:     KVRead,
+				Key:    act.Key,
+				Reply:  kvReplyCh, // new channel goes in here
+				Client: name,
 			}
 			kvReqCh <- kvReq      // send to store
 			kvResp := <-kvReplyCh // receive from store
@@ -150,28 +433,45 @@ func KVClient(name string, actionsCh <-chan ClientAction, kvReqCh chan<- KVReque
 
 			if kvResp.Ok {
 				// populate cache and reply with value
-				cache[act.Key] = kvResp.Value
-				act.Reply <- ClientReply{Value: kvResp.Value, Hit: false, Ok: true}
+				cache[keys.id(act.Key)] = kvResp.Value
+				act.Reply <- ClientReply{Value: kvResp.Value, Hit: false, Ok: true, Version: version(kvResp)}
+			} else if kvResp.Err != "" {
+				act.Reply <- ClientReply{Ok: false, Err: kvResp.Err}
 			} else {
 				act.Reply <- ClientReply{Ok: false, Err: "kv read failed"}
 			}
 
 		case ClientPut:
+			// A read copy is not owned: take the key first, as a get would.
+			if _, ok := copies.of[k]; known && ok {
+				if r := copies.take(k, kvReqCh); !r.Ok {
+					let(k)
+					err := r.Err
+					if err == "" {
+						err = "kv read failed"
+					}
+					act.Reply <- ClientReply{Ok: false, Err: err}
+					continue
+				}
+				cache[k] = 0
+			}
+
 			// Put only allowed if key present in local cache.
-			if _, ok := cache[act.Key]; !ok {
+			if _, ok := cache[k]; !known || !ok {
 				act.Reply <- ClientReply{Ok: false, Err: "key not in local cache"}
 				continue
 			}
 
-			cache[act.Key] = act.Value
+			cache[k] = act.Value
 
 			// Send write to KV store.
 			kvReplyCh := make(chan KVReply)
 			kvReq := KVRequest{
-				Op:    KVWrite,
-				Key:   act.Key,
-				Value: act.Value,
-				Reply: kvReplyCh,
+				Op:     KVWrite,
+				Key:    act.Key,
+				Value:  act.Value,
+				Reply:  kvReplyCh,
+				Client: name,
 			}
 			kvReqCh <- kvReq
 			kvResp := <-kvReplyCh
@@ -179,8 +479,17 @@ func KVClient(name string, actionsCh <-chan ClientAction, kvReqCh chan<- KVReque
 
 			if kvResp.Ok {
 				// Remove from cache after successful put, and reply success.
-				delete(cache, act.Key)
-				act.Reply <- ClientReply{Hit: true, Ok: true}
+				delete(cache, k)
+				if cfg.Revalidate > 0 {
+					copies.keep(k, act.Value, kvResp.Version)
+				}
+				let(k)
+				act.Reply <- ClientReply{Hit: true, Ok: true, Version: version(kvResp)}
+			} else if kvResp.Err != "" {
+				// The store gave the key back unchanged: it is ours no more.
+				delete(cache, k)
+				let(k)
+				act.Reply <- ClientReply{Ok: false, Err: kvResp.Err}
 			} else {
 				act.Reply <- ClientReply{Ok: false, Err: "kv write failed (key missing in store)"}
 			}
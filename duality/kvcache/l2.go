@@ -0,0 +1,214 @@
+package kvcache
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// ----- Shared L2 cache -----
+
+// L2Cache is a cache shared by a group of clients, between their private caches
+// and KVStore. It speaks KVRequest on both sides, so the clients are unchanged
+// KVClients that send to it instead of to the store.
+//
+// It takes part in ownership as one more level of it. To KVStore, L2Cache is a
+// client that owns every key it holds; among its own clients, it grants and
+// takes back ownership of those keys as KVStore would, queueing any number of
+// waiters per key. A put from one of its clients ends at L2Cache, so the next
+// get of the key by any of them is served without the store. A key nobody has
+// asked for in L2Config.HoldFor is written back to KVStore, which releases it to
+// clients outside the group; so does a key evicted to stay within Capacity.
+
+// L2Config configures an L2Cache.
+type L2Config struct {
+	Capacity int           // keys held at most, when they can be written back; default 1024
+	HoldFor  time.Duration // how long an idle key is held before it is written back; default 5ms
+	Watchers *Watchers     // if set, told of each key written back for being idle, as expired
+}
+
+// L2Stats counts what an L2Cache did. Read them once it has exited.
+type L2Stats struct {
+	Reads      int `json:"reads"`      // reads from its clients
+	Hits       int `json:"hits"`       // reads granted from a key it held, without the store
+	Misses     int `json:"misses"`     // reads from the store
+	Waits      int `json:"waits"`      // reads that waited for another of its clients, or for a read from the store
+	Writes     int `json:"writes"`     // writes from its clients
+	WriteBacks int `json:"writeBacks"` // keys written back to the store
+	Evictions  int `json:"evictions"`  // of those, the ones written back to stay within Capacity
+}
+
+// l2Entry is a key L2Cache owns in KVStore.
+type l2Entry struct {
+	value   int
+	owned   bool        // one of its clients owns the key
+	waiters []KVRequest // reads waiting for that client's write
+	idle    time.Time   // when the key was last released, if not owned
+}
+
+// l2Fetch is the reply to a read L2Cache sent to the store.
+type l2Fetch struct {
+	key   string
+	reply KVReply
+}
+
+// L2Cache runs as a goroutine that serves the KVRequests of its clients on
+// reqCh, sending to the store on storeCh what it cannot serve itself, until reqCh
+// is closed; then it writes back every key it holds. stats may be nil.
+func L2Cache(reqCh <-chan KVRequest, storeCh chan<- KVRequest, wg *sync.WaitGroup, cfg L2Config, stats *L2Stats) {
+	defer wg.Done()
+	if stats == nil {
+		stats = &L2Stats{}
+	}
+	if cfg.Capacity <= 0 {
+		cfg.Capacity = 1024
+	}
+	if cfg.HoldFor <= 0 {
+		cfg.HoldFor = 5 * time.Millisecond
+	}
+	entries := make(map[string]*l2Entry)
+	fetching := make(map[string][]KVRequest) // reads waiting for a read from the store
+	fetched := make(chan l2Fetch)
+	var passing sync.WaitGroup // writes to the store, passed through or written back
+
+	call := func(req KVRequest) KVReply {
+		req.Reply = make(chan KVReply)
+		storeCh <- req
+		resp := <-req.Reply
+		close(req.Reply)
+		return resp
+	}
+	// writeBack gives key back to the store without waiting for the reply. A read
+	// of key sent to the store after it waits there until the write arrives.
+	writeBack := func(key string, e *l2Entry) {
+		delete(entries, key)
+		stats.WriteBacks++
+		passing.Add(1)
+		go func() {
+			defer passing.Done()
+			call(KVRequest{Op: KVWrite, Key: key, Value: e.value})
+		}()
+	}
+	// grant gives the key of e to the first waiter, if any.
+	grant := func(e *l2Entry) {
+		if len(e.waiters) == 0 {
+			return
+		}
+		next := e.waiters[0]
+		e.waiters = e.waiters[1:]
+		e.owned = true
+		stats.Hits++
+		next.Reply <- KVReply{Value: e.value, Ok: true}
+	}
+	// evict writes back the keys idle longest until at most Capacity are held.
+	evict := func() {
+		if len(entries) <= cfg.Capacity {
+			return
+		}
+		var idle []string
+		for k, e := range entries {
+			if !e.owned && len(e.waiters) == 0 {
+				idle = append(idle, k)
+			}
+		}
+		sort.Slice(idle, func(i, j int) bool { return entries[idle[i]].idle.Before(entries[idle[j]].idle) })
+		for _, k := range idle {
+			if len(entries) <= cfg.Capacity {
+				break
+			}
+			writeBack(k, entries[k])
+			stats.Evictions++
+		}
+	}
+
+	read := func(req KVRequest) {
+		stats.Reads++
+		if e := entries[req.Key]; e != nil {
+			if e.owned {
+				stats.Waits++
+				e.waiters = append(e.waiters, req)
+				return
+			}
+			e.owned = true
+			stats.Hits++
+			req.Reply <- KVReply{Value: e.value, Ok: true}
+			return
+		}
+		if waiting, ok := fetching[req.Key]; ok {
+			stats.Waits++
+			fetching[req.Key] = append(waiting, req)
+			return
+		}
+		stats.Misses++
+		fetching[req.Key] = []KVRequest{req}
+		go func() {
+			fetched <- l2Fetch{key: req.Key, reply: call(KVRequest{Op: KVRead, Key: req.Key})}
+		}()
+	}
+	landed := func(f l2Fetch) {
+		waiting := fetching[f.key]
+		delete(fetching, f.key)
+		if !f.reply.Ok {
+			for _, r := range waiting {
+				r.Reply <- f.reply
+			}
+			return
+		}
+		e := &l2Entry{value: f.reply.Value, owned: true, waiters: waiting[1:]}
+		entries[f.key] = e
+		waiting[0].Reply <- KVReply{Value: e.value, Ok: true}
+		evict()
+	}
+	write := func(req KVRequest) {
+		stats.Writes++
+		e := entries[req.Key]
+		if e == nil {
+			// not a key it holds: the store decides
+			passing.Add(1)
+			go func() {
+				defer passing.Done()
+				req.Reply <- call(KVRequest{Op: KVWrite, Key: req.Key, Value: req.Value})
+			}()
+			return
+		}
+		e.value = req.Value
+		req.Reply <- KVReply{Value: req.Value, Ok: true}
+		e.owned = false
+		e.idle = time.Now()
+		grant(e)
+	}
+
+	ticker := time.NewTicker(max(cfg.HoldFor/2, 100*time.Microsecond))
+	defer ticker.Stop()
+	reqs := reqCh
+	for reqs != nil || len(fetching) > 0 {
+		select {
+		case req, ok := <-reqs:
+			if !ok {
+				reqs = nil
+				continue
+			}
+			switch req.Op {
+			case KVRead:
+				read(req)
+			case KVWrite:
+				write(req)
+			default:
+				req.Reply <- KVReply{Value: 0, Ok: false}
+			}
+		case f := <-fetched:
+			landed(f)
+		case now := <-ticker.C:
+			for k, e := range entries {
+				if !e.owned && len(e.waiters) == 0 && now.Sub(e.idle) >= cfg.HoldFor {
+					cfg.Watchers.Notify(KeyEvent{Kind: KeyExpired, Key: k, Value: e.value, At: now})
+					writeBack(k, e)
+				}
+			}
+		}
+	}
+	for k, e := range entries {
+		writeBack(k, e)
+	}
+	passing.Wait()
+}
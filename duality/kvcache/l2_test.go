@@ -0,0 +1,112 @@
+package kvcache
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// kvCall sends req on ch and waits for its reply.
+func kvCall(ch chan<- KVRequest, req KVRequest) KVReply {
+	req.Reply = make(chan KVReply, 1)
+	ch <- req
+	return <-req.Reply
+}
+
+// readAsync sends a read of key on ch and returns the channel its reply comes on.
+func readAsync(ch chan<- KVRequest, key string) chan KVReply {
+	reply := make(chan KVReply, 1)
+	ch <- KVRequest{Op: KVRead, Key: key, Reply: reply}
+	return reply
+}
+
+// startL2 runs an L2Cache with cfg in front of a KVStore, and returns the L2's
+// channel, the store's, and a function that shuts both down and returns the L2's
+// stats.
+func startL2(cfg L2Config) (chan KVRequest, chan KVRequest, func() L2Stats) {
+	storeCh := make(chan KVRequest)
+	var storeWg sync.WaitGroup
+	storeWg.Add(1)
+	go KVStore(storeCh, &storeWg)
+	l2Ch := make(chan KVRequest)
+	var wg sync.WaitGroup
+	var stats L2Stats
+	wg.Add(1)
+	go L2Cache(l2Ch, storeCh, &wg, cfg, &stats)
+	return l2Ch, storeCh, func() L2Stats {
+		close(l2Ch)
+		wg.Wait()
+		close(storeCh)
+		storeWg.Wait()
+		return stats
+	}
+}
+
+// A put ends at the L2, so the next get of the key is a hit, and reads queue
+// behind its owner, any number of them; the store gets the last value back when
+// the L2 shuts down.
+func TestL2HoldsAndQueues(t *testing.T) {
+	l2, _, shutdown := startL2(L2Config{HoldFor: time.Hour})
+	if rep := kvCall(l2, KVRequest{Op: KVRead, Key: "k"}); !rep.Ok || rep.Value != 0 {
+		t.Fatalf("first read = %+v", rep)
+	}
+	kvCall(l2, KVRequest{Op: KVWrite, Key: "k", Value: 5})
+	if rep := kvCall(l2, KVRequest{Op: KVRead, Key: "k"}); rep.Value != 5 {
+		t.Fatalf("second read = %+v, want 5", rep)
+	}
+	w1, w2 := readAsync(l2, "k"), readAsync(l2, "k")
+	kvCall(l2, KVRequest{Op: KVWrite, Key: "k", Value: 6})
+	if rep := <-w1; rep.Value != 6 {
+		t.Errorf("first waiter got %d, want 6", rep.Value)
+	}
+	kvCall(l2, KVRequest{Op: KVWrite, Key: "k", Value: 7})
+	if rep := <-w2; rep.Value != 7 {
+		t.Errorf("second waiter got %d, want 7", rep.Value)
+	}
+	kvCall(l2, KVRequest{Op: KVWrite, Key: "k", Value: 8})
+	if rep := kvCall(l2, KVRequest{Op: "bogus", Key: "k"}); rep.Ok {
+		t.Error("L2 accepted an op it does not serve")
+	}
+
+	st := shutdown()
+	if st.Reads != 4 || st.Misses != 1 || st.Hits != 3 || st.Waits != 2 || st.WriteBacks != 1 {
+		t.Errorf("stats %+v", st)
+	}
+}
+
+// A key idle for HoldFor goes back to the store, as expired, where clients
+// outside the group can read it.
+func TestL2WritesBackIdleKeys(t *testing.T) {
+	ws := NewWatchers()
+	events, stop := ws.Watch("", 4)
+	defer stop()
+	l2, store, shutdown := startL2(L2Config{HoldFor: 5 * time.Millisecond, Watchers: ws})
+	defer shutdown()
+	kvCall(l2, KVRequest{Op: KVRead, Key: "k"})
+	kvCall(l2, KVRequest{Op: KVWrite, Key: "k", Value: 3})
+
+	select {
+	case rep := <-readAsync(store, "k"):
+		if rep.Value != 3 {
+			t.Errorf("store read = %d, want 3", rep.Value)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the L2 never gave the idle key back")
+	}
+	if ev := <-events; ev.Kind != KeyExpired || ev.Key != "k" || ev.Value != 3 {
+		t.Errorf("event %+v, want k expired with 3", ev)
+	}
+	kvCall(store, KVRequest{Op: KVWrite, Key: "k", Value: 3})
+}
+
+// Past Capacity, the keys idle longest are written back.
+func TestL2EvictsPastCapacity(t *testing.T) {
+	l2, _, shutdown := startL2(L2Config{Capacity: 2, HoldFor: time.Hour})
+	for _, k := range []string{"a", "b", "c"} {
+		kvCall(l2, KVRequest{Op: KVRead, Key: k})
+		kvCall(l2, KVRequest{Op: KVWrite, Key: k, Value: 1})
+	}
+	if st := shutdown(); st.Evictions != 1 || st.WriteBacks != 3 {
+		t.Errorf("stats %+v, want 1 eviction of 3 write-backs", st)
+	}
+}
@@ -0,0 +1,115 @@
+package kvcache
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// ----- Goroutine leak detection -----
+
+// A correct KVStore leaves nothing behind: once main closes the channels and the
+// WaitGroup is done, every goroutine it or the clients started has exited. A waiter
+// that was never granted its key, a reply nobody receives, or a helper goroutine
+// ranging over a channel nobody closes shows up here instead of as a deadlock.
+
+// Leak is a goroutine started after a LeakSnapshot that is still there.
+type Leak struct {
+	State string // what it is blocked in, e.g. "chan send"
+	Top   string // the innermost function outside the standard library
+	Stack string
+}
+
+// LeakSnapshot records the goroutines that exist at some point, such as the start of main.
+type LeakSnapshot struct {
+	ids map[string]bool
+}
+
+// TakeLeakSnapshot records the goroutines that exist now.
+func TakeLeakSnapshot() LeakSnapshot {
+	s := LeakSnapshot{ids: make(map[string]bool)}
+	for _, g := range goroutineStacks() {
+		s.ids[goroutineID(g)] = true
+	}
+	return s
+}
+
+// Leaks returns the goroutines started since the snapshot that are still there
+// after up to grace. The goroutine calling Leaks is not included.
+func (s LeakSnapshot) Leaks(grace time.Duration) []Leak {
+	deadline := time.Now().Add(grace)
+	for {
+		var leaks []Leak
+		for _, g := range goroutineStacks()[1:] { // the first is the caller
+			if !s.ids[goroutineID(g)] {
+				leaks = append(leaks, parseLeak(g))
+			}
+		}
+		if len(leaks) == 0 || !time.Now().Before(deadline) {
+			return leaks
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// PrintLeaks writes one line for each leaked goroutine to w, then their stacks.
+func PrintLeaks(w io.Writer, leaks []Leak) {
+	fmt.Fprintf(w, "LEAK: %d goroutine(s) still running after the demo\n", len(leaks))
+	for _, l := range leaks {
+		fmt.Fprintf(w, "  [%s] in %s\n", l.State, l.Top)
+	}
+	for _, l := range leaks {
+		fmt.Fprintf(w, "\n%s\n", l.Stack)
+	}
+}
+
+// goroutineStacks returns the stack of every goroutine, the caller's first.
+func goroutineStacks() []string {
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return strings.Split(strings.TrimSpace(string(buf[:n])), "\n\n")
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// goroutineID returns the "goroutine N" that starts a stack.
+func goroutineID(stack string) string {
+	id, _, _ := strings.Cut(stack, " [")
+	return id
+}
+
+// parseLeak extracts the state and innermost non-library function of a stack:
+//
+//	goroutine 7 [chan send]:
+//	runtime.chansend1(...)
+//		/usr/local/go/src/runtime/chan.go:161 +0x1d
+//	courses.cs.duke.edu/go/kvcache.KVStore(...)
+//		/path/kvcache.go:98 +0x5e
+func parseLeak(stack string) Leak {
+	l := Leak{Stack: stack}
+	lines := strings.Split(stack, "\n")
+	_, state, _ := strings.Cut(lines[0], " [")
+	l.State, _, _ = strings.Cut(strings.TrimSuffix(state, "]:"), ",")
+	for _, line := range lines[1:] {
+		if strings.HasPrefix(line, "\t") || strings.HasPrefix(line, "created by ") {
+			continue
+		}
+		fn := line
+		if i := strings.LastIndex(fn, "("); i > 0 {
+			fn = fn[:i]
+		}
+		if l.Top == "" {
+			l.Top = fn
+		}
+		if first, _, ok := strings.Cut(fn, "/"); (ok && strings.Contains(first, ".")) || strings.HasPrefix(fn, "main.") {
+			l.Top = fn
+			break
+		}
+	}
+	return l
+}
@@ -0,0 +1,108 @@
+package kvcache
+
+import "sync"
+
+// ----- Message counts -----
+
+// MessageCounts counts the messages between the caches and KVStore, by kind.
+// There are no invalidations in KVStore's protocol: ownership passes only when
+// the owner writes, which hands the key to the client waiting for it, if any.
+type MessageCounts struct {
+	Reads     int `json:"reads"`     // read requests to the store
+	Writes    int `json:"writes"`    // write requests to the store
+	Grants    int `json:"grants"`    // replies to reads of keys nobody owned
+	Handoffs  int `json:"handoffs"`  // replies to reads that waited for the owner's write
+	WriteAcks int `json:"writeAcks"` // replies to writes that succeeded
+	Failures  int `json:"failures"`  // replies with Ok false
+}
+
+// Total returns the number of messages of every kind.
+func (m MessageCounts) Total() int {
+	return m.Reads + m.Writes + m.Grants + m.Handoffs + m.WriteAcks + m.Failures
+}
+
+// PerOp returns the messages per operation, for ops operations.
+func (m MessageCounts) PerOp(ops int) float64 {
+	if ops <= 0 {
+		return 0
+	}
+	return float64(m.Total()) / float64(ops)
+}
+
+// messageCounter is MessageCounts shared by the goroutines that count.
+type messageCounter struct {
+	mu sync.Mutex
+	MessageCounts
+}
+
+func (c *messageCounter) add(f func(*MessageCounts)) {
+	c.mu.Lock()
+	f(&c.MessageCounts)
+	c.mu.Unlock()
+}
+
+// countMessages returns a channel whose requests reach the store on out, counting
+// them and the store's replies into c. It tells grants from handoffs by following
+// ownership as KVStore does, so it must come after anything that reorders
+// requests (delayRequests), to see them in the store's order. It closes out once
+// the returned channel is closed and every reply has been passed on.
+func countMessages(out chan<- KVRequest, c *messageCounter, wg *sync.WaitGroup) chan KVRequest {
+	in := make(chan KVRequest)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		exists := make(map[string]bool)
+		owned := make(map[string]bool)
+		waiters := make(map[string]int)
+		var pending sync.WaitGroup
+		for req := range in {
+			handoff := false
+			switch req.Op {
+			case KVRead:
+				exists[req.Key] = true
+				if owned[req.Key] {
+					handoff = true
+					waiters[req.Key]++
+				}
+				owned[req.Key] = true
+			case KVWrite:
+				if exists[req.Key] && waiters[req.Key] > 0 {
+					waiters[req.Key]--
+				} else {
+					owned[req.Key] = false
+				}
+			}
+			c.add(func(m *MessageCounts) {
+				if req.Op == KVWrite {
+					m.Writes++
+				} else {
+					m.Reads++
+				}
+			})
+			reply := req.Reply
+			req.Reply = make(chan KVReply)
+			pending.Add(1)
+			go func() {
+				defer pending.Done()
+				rep := <-req.Reply
+				c.add(func(m *MessageCounts) {
+					switch {
+					case !rep.Ok:
+						m.Failures++
+					case req.Op == KVWrite:
+						m.WriteAcks++
+					case handoff:
+						m.Handoffs++
+					default:
+						m.Grants++
+					}
+				})
+				reply <- rep
+			}()
+			out <- req
+		}
+		pending.Wait()
+		close(out)
+	}()
+	return in
+}
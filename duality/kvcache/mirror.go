@@ -0,0 +1,245 @@
+package kvcache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----- Mirror to an external system -----
+
+// A Mirror copies every write KVStore commits to an external system, Redis or an
+// HTTP endpoint, without holding up the store: it watches the updated events of
+// a Watchers, puts them in a bounded outbox, and sends them from there on its own
+// goroutine, retrying a failed send with backoff. An event that finds the outbox
+// full is dropped and counted, as is one that fails every retry.
+//
+// This is write-through from the store's side: the external copy follows every
+// write, a little behind. The alternative, cache-aside, has each client fill the
+// external cache itself when it misses there, so only keys someone read are copied.
+
+// MirrorSink is where a Mirror sends writes.
+type MirrorSink interface {
+	Mirror(key string, value int) error
+	Close() error
+}
+
+// MirrorConfig configures a Mirror.
+type MirrorConfig struct {
+	Outbox  int           // writes waiting to be sent, at most; default 1024
+	Retries int           // sends after the first that failed; default 3
+	Backoff time.Duration // before the first retry, doubling after each; default 10ms
+}
+
+// MirrorStats counts what a Mirror did. Read them once it has stopped.
+type MirrorStats struct {
+	Mirrored  int `json:"mirrored"`  // writes sent
+	Retries   int `json:"retries"`   // sends retried
+	Failed    int `json:"failed"`    // writes given up on after every retry
+	Dropped   int `json:"dropped"`   // writes that found the outbox full
+	MaxOutbox int `json:"maxOutbox"` // most writes waiting at once
+}
+
+// Mirror is a running mirror; see StartMirror.
+type Mirror struct {
+	sink    MirrorSink
+	cfg     MirrorConfig
+	outbox  chan KeyEvent
+	stop    func()
+	stopped sync.WaitGroup
+
+	mu    sync.Mutex
+	stats MirrorStats
+}
+
+// StartMirror starts mirroring the updated events of ws to sink.
+func StartMirror(ws *Watchers, sink MirrorSink, cfg MirrorConfig) *Mirror {
+	if cfg.Outbox <= 0 {
+		cfg.Outbox = 1024
+	}
+	if cfg.Retries <= 0 {
+		cfg.Retries = 3
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = 10 * time.Millisecond
+	}
+	m := &Mirror{sink: sink, cfg: cfg, outbox: make(chan KeyEvent, cfg.Outbox)}
+	events, stop := ws.Watch("", 16)
+	m.stop = stop
+	m.stopped.Add(2)
+	go func() {
+		defer m.stopped.Done()
+		defer close(m.outbox)
+		for ev := range events {
+			if ev.Kind != KeyUpdated {
+				continue
+			}
+			select {
+			case m.outbox <- ev:
+				m.mu.Lock()
+				m.stats.MaxOutbox = max(m.stats.MaxOutbox, len(m.outbox))
+				m.mu.Unlock()
+			default:
+				m.mu.Lock()
+				m.stats.Dropped++
+				m.mu.Unlock()
+			}
+		}
+	}()
+	go func() {
+		defer m.stopped.Done()
+		for ev := range m.outbox {
+			m.send(ev)
+		}
+	}()
+	return m
+}
+
+// send sends ev to the sink, retrying as configured.
+func (m *Mirror) send(ev KeyEvent) {
+	backoff := m.cfg.Backoff
+	for try := 0; ; try++ {
+		err := m.sink.Mirror(ev.Key, ev.Value)
+		m.mu.Lock()
+		switch {
+		case err == nil:
+			m.stats.Mirrored++
+		case try == m.cfg.Retries:
+			m.stats.Failed++
+		default:
+			m.stats.Retries++
+		}
+		m.mu.Unlock()
+		if err == nil || try == m.cfg.Retries {
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Stop stops watching, sends what is left in the outbox, closes the sink, and
+// returns the counts.
+func (m *Mirror) Stop() MirrorStats {
+	m.stop()
+	m.stopped.Wait()
+	m.sink.Close()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stats
+}
+
+// NewMirrorSink returns the sink for target: redis://host:port for Redis, or an
+// http:// or https:// URL to POST to.
+func NewMirrorSink(target string) (MirrorSink, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "redis":
+		if u.Host == "" {
+			return nil, fmt.Errorf("bad mirror %q: want redis://host:port", target)
+		}
+		return &RedisSink{Addr: u.Host}, nil
+	case "http", "https":
+		return &HTTPSink{URL: target}, nil
+	}
+	return nil, fmt.Errorf("bad mirror %q: want redis://host:port or an http(s) URL", target)
+}
+
+// HTTPSink POSTs each write to URL as {"key": ..., "value": ...}; any status
+// other than 2xx is an error.
+type HTTPSink struct {
+	URL    string
+	Client *http.Client // nil means one with a 5s timeout
+}
+
+func (s *HTTPSink) Mirror(key string, value int) error {
+	if s.Client == nil {
+		s.Client = &http.Client{Timeout: 5 * time.Second}
+	}
+	body, err := json.Marshal(KVEntry{Key: key, Value: value})
+	if err != nil {
+		return err
+	}
+	resp, err := s.Client.Post(s.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("mirror %s: %s", s.URL, resp.Status)
+	}
+	return nil
+}
+
+func (s *HTTPSink) Close() error { return nil }
+
+// RedisSink sends each write to the Redis server at Addr as a SET, over one
+// connection, dialled again after an error.
+type RedisSink struct {
+	Addr    string
+	Timeout time.Duration // for dialling and for each SET; 0 means 5s
+
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (s *RedisSink) Mirror(key string, value int) error {
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	if s.conn == nil {
+		conn, err := net.DialTimeout("tcp", s.Addr, timeout)
+		if err != nil {
+			return err
+		}
+		s.conn, s.r = conn, bufio.NewReader(conn)
+	}
+	err := s.set(key, strconv.Itoa(value), timeout)
+	if err != nil {
+		s.Close()
+	}
+	return err
+}
+
+// set sends SET key value in the Redis protocol and reads the reply.
+func (s *RedisSink) set(key, value string, timeout time.Duration) error {
+	s.conn.SetDeadline(time.Now().Add(timeout))
+	var b strings.Builder
+	b.WriteString("*3\r\n$3\r\nSET\r\n")
+	for _, arg := range []string{key, value} {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := s.conn.Write([]byte(b.String())); err != nil {
+		return err
+	}
+	line, err := s.r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, "+") {
+		return fmt.Errorf("redis %s: %s", s.Addr, strings.TrimPrefix(line, "-"))
+	}
+	return nil
+}
+
+func (s *RedisSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn, s.r = nil, nil
+	return err
+}
@@ -0,0 +1,226 @@
+package kvcache
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// ----- Network front end -----
+
+// ServeKV and DialKV put a KVStore on the network: each connection carries one
+// client's KVRequests, one at a time, as lines of JSON. The first line a client
+// sends presents its token ({"token": ...}), and the server answers with the
+// identity it was given ({"client": ...}) or with an error ({"err": ...}) and
+// closes the connection. Every request after that is sent to the store with the
+// identity as its Client, whatever the client says, so StoreConfig.ACL is
+// checked against who authenticated. Both ends can run over TLS (see tls.go).
+//
+// A connection owns the keys its reads were granted until it writes them. If it
+// closes first, because the client went away or its token was revoked, the
+// server writes each back with the value it was read with, so that no other
+// client waits for it forever.
+
+// NetConfig configures ServeKV.
+type NetConfig struct {
+	Tokens *Tokens     // if set, who may connect; nil lets everyone in (see peerName)
+	TLS    *tls.Config // if set, serve over TLS
+}
+
+// DialConfig configures DialKV.
+type DialConfig struct {
+	Token string      // presented to the server
+	TLS   *tls.Config // if set, connect over TLS
+}
+
+// wireMsg is a line on a connection: a handshake, a request, or a reply.
+type wireMsg struct {
+	Token  string `json:"token,omitempty"`
+	Client string `json:"client,omitempty"`
+
+	Op      KVOp      `json:"op,omitempty"`
+	Key     string    `json:"key,omitempty"`
+	Value   int       `json:"value,omitempty"`
+	Entries []KVEntry `json:"entries,omitempty"`
+	Cursor  int       `json:"cursor,omitempty"`
+	Data    []byte    `json:"data,omitempty"`
+	Offset  int       `json:"offset,omitempty"`
+	Ok      bool      `json:"ok,omitempty"`
+	Version int       `json:"version,omitempty"`
+	Err     string    `json:"err,omitempty"`
+}
+
+// ServeKV accepts connections on ln and serves their requests from the store
+// kvReqCh leads to, until ln is closed. It then closes the connections still
+// open and returns once each has given back its keys, so the store can be closed
+// after it. If cfg.TLS is set, it wraps ln in TLS.
+func ServeKV(ln net.Listener, kvReqCh chan<- KVRequest, cfg NetConfig) error {
+	if cfg.TLS != nil {
+		ln = tls.NewListener(ln, cfg.TLS)
+	}
+	var mu sync.Mutex
+	conns := make(map[net.Conn]bool)
+	var wg sync.WaitGroup
+	defer func() {
+		mu.Lock()
+		for c := range conns {
+			c.Close()
+		}
+		mu.Unlock()
+		wg.Wait()
+	}()
+	for {
+		c, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		conns[c] = true
+		mu.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serveKVConn(c, kvReqCh, cfg.Tokens)
+			mu.Lock()
+			delete(conns, c)
+			mu.Unlock()
+		}()
+	}
+}
+
+// serveKVConn serves the requests of one connection.
+func serveKVConn(c net.Conn, kvReqCh chan<- KVRequest, tokens *Tokens) {
+	defer c.Close()
+	dec := json.NewDecoder(bufio.NewReader(c))
+	enc := json.NewEncoder(c)
+	var hello wireMsg
+	if dec.Decode(&hello) != nil {
+		return
+	}
+	s, err := tokens.accept(c, hello.Token)
+	if err != nil {
+		enc.Encode(wireMsg{Err: err.Error()})
+		return
+	}
+	if tokens == nil {
+		s.client = peerName(c)
+	}
+	defer tokens.leave(s)
+	if enc.Encode(wireMsg{Client: s.client}) != nil {
+		return
+	}
+
+	call := func(req KVRequest) KVReply {
+		req.Reply = make(chan KVReply)
+		req.Client = s.client
+		kvReqCh <- req
+		return <-req.Reply
+	}
+	held := make(map[string]int) // keys the connection owns, with the value each was read with
+	defer func() {
+		for k, v := range held {
+			call(KVRequest{Op: KVWrite, Key: k, Value: v})
+		}
+	}()
+	for {
+		var m wireMsg
+		if dec.Decode(&m) != nil {
+			return
+		}
+		r := call(KVRequest{Op: m.Op, Key: m.Key, Value: m.Value, Entries: m.Entries, Cursor: m.Cursor, Data: m.Data, Offset: m.Offset})
+		switch {
+		case m.Op == KVRead && r.Ok:
+			held[m.Key] = r.Value
+		case m.Op == KVWrite && (r.Ok || r.Err != ""), m.Op == KVDelete && r.Ok:
+			// written, deleted, or given back by the store as refused
+			delete(held, m.Key)
+		}
+		tokens.count(s, r)
+		if enc.Encode(wireMsg{Value: r.Value, Ok: r.Ok, Entries: r.Entries, Cursor: r.Cursor, Data: r.Data, Version: r.Version, Err: r.Err}) != nil {
+			return
+		}
+	}
+}
+
+// KVConn is a client's connection to a KV network server (see ServeKV).
+type KVConn struct {
+	conn   net.Conn
+	dec    *json.Decoder
+	enc    *json.Encoder
+	client string
+}
+
+// DialKV connects to the KV network server at addr, over TLS if cfg.TLS is
+// set, and authenticates with cfg.Token. Without a ServerName, cfg.TLS checks the
+// server's certificate against the host in addr.
+func DialKV(addr string, cfg DialConfig) (*KVConn, error) {
+	var c net.Conn
+	var err error
+	if cfg.TLS != nil {
+		c, err = tls.Dial("tcp", addr, cfg.TLS)
+	} else {
+		c, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return handshake(c, cfg)
+}
+
+// handshake presents cfg.Token on c and reads the identity the server gives.
+func handshake(c net.Conn, cfg DialConfig) (*KVConn, error) {
+	kc := &KVConn{conn: c, dec: json.NewDecoder(bufio.NewReader(c)), enc: json.NewEncoder(c)}
+	var m wireMsg
+	err := kc.enc.Encode(wireMsg{Token: cfg.Token})
+	if err == nil {
+		err = kc.dec.Decode(&m)
+	}
+	if err == nil && m.Err != "" {
+		err = errors.New(m.Err)
+	}
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("kv handshake: %w", err)
+	}
+	kc.client = m.Client
+	return kc, nil
+}
+
+// Client returns the identity the server gave the connection.
+func (kc *KVConn) Client() string {
+	return kc.client
+}
+
+// Forward runs as a goroutine that stands in for KVStore: it sends each request
+// on reqCh to the server and passes its reply on, until reqCh is closed. Once
+// the connection fails, every request is answered with the error.
+func (kc *KVConn) Forward(reqCh <-chan KVRequest, wg *sync.WaitGroup) {
+	defer wg.Done()
+	var broken error
+	for req := range reqCh {
+		var m wireMsg
+		if broken == nil {
+			broken = kc.enc.Encode(wireMsg{Op: req.Op, Key: req.Key, Value: req.Value, Entries: req.Entries, Cursor: req.Cursor, Data: req.Data, Offset: req.Offset})
+		}
+		if broken == nil {
+			broken = kc.dec.Decode(&m)
+		}
+		if broken != nil {
+			req.Reply <- KVReply{Ok: false, Err: fmt.Sprintf("kv connection: %v", broken)}
+			continue
+		}
+		req.Reply <- KVReply{Value: m.Value, Ok: m.Ok, Entries: m.Entries, Cursor: m.Cursor, Version: m.Version, Err: m.Err, Data: m.Data}
+	}
+}
+
+// Close closes the connection; the server gives back the keys it owned.
+func (kc *KVConn) Close() error {
+	return kc.conn.Close()
+}
@@ -0,0 +1,124 @@
+package kvcache
+
+import (
+	"net"
+	"sync"
+	"testing"
+)
+
+// startKVServer serves a store with acl on a local port, with tokens, and stops
+// both at the end of the test.
+func startKVServer(t *testing.T, acl *ACL, tokens *Tokens) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kvReqCh := make(chan KVRequest)
+	var storeWG sync.WaitGroup
+	storeWG.Add(1)
+	go KVStoreWith(kvReqCh, &storeWG, StoreConfig{ACL: acl}, nil)
+	served := make(chan error, 1)
+	go func() { served <- ServeKV(ln, kvReqCh, NetConfig{Tokens: tokens}) }()
+	t.Cleanup(func() {
+		ln.Close()
+		if err := <-served; err != nil {
+			t.Error(err)
+		}
+		close(kvReqCh)
+		storeWG.Wait()
+	})
+	return ln.Addr().String()
+}
+
+// dialClient connects with token and starts a KVClient on the connection; the
+// returned function does an action through it.
+func dialClient(t *testing.T, addr, token string) (*KVConn, func(ClientActionType, string, int) ClientReply) {
+	t.Helper()
+	conn, err := DialKV(addr, DialConfig{Token: token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kvReqCh := make(chan KVRequest)
+	actionsCh := make(chan ClientAction)
+	var fwdWG, clientWG sync.WaitGroup
+	fwdWG.Add(1)
+	clientWG.Add(1)
+	go conn.Forward(kvReqCh, &fwdWG)
+	go KVClient(conn.Client(), actionsCh, kvReqCh, &clientWG)
+	t.Cleanup(func() {
+		close(actionsCh)
+		clientWG.Wait()
+		close(kvReqCh)
+		fwdWG.Wait()
+		conn.Close()
+	})
+	return conn, func(op ClientActionType, key string, value int) ClientReply {
+		reply := make(chan ClientReply)
+		actionsCh <- ClientAction{Type: op, Key: key, Value: value, Reply: reply}
+		return <-reply
+	}
+}
+
+// The identity a token names is the Client the store's ACL sees, and its
+// requests are counted against it.
+func TestNetIdentityMeetsACL(t *testing.T) {
+	acl := NewACL(ACLRule{Client: "alice", Prefix: "alice/", Ops: []ClientActionType{ClientGet, ClientPut}})
+	tokens := NewTokens(map[string]string{"alice": "s1", "bob": "s2"})
+	addr := startKVServer(t, acl, tokens)
+
+	if _, err := DialKV(addr, DialConfig{Token: "guess"}); err == nil {
+		t.Fatal("a wrong token was let in")
+	}
+	alice, doAlice := dialClient(t, addr, "s1")
+	if alice.Client() != "alice" {
+		t.Fatalf("identity %q, want alice", alice.Client())
+	}
+	_, doBob := dialClient(t, addr, "s2")
+
+	doAlice(ClientGet, "alice/x", 0)
+	if r := doAlice(ClientPut, "alice/x", 4); !r.Ok {
+		t.Fatalf("alice's put: %+v", r)
+	}
+	if r := doBob(ClientGet, "alice/x", 0); !Forbidden(r) {
+		t.Fatalf("bob's get of alice/x: %+v, want forbidden", r)
+	}
+	if r := doAlice(ClientGet, "alice/x", 0); !r.Ok || r.Value != 4 {
+		t.Fatalf("alice's get: %+v, want 4", r)
+	}
+
+	st := tokens.Stats()
+	if len(st) != 2 || st[0].Requests != 3 || st[1].Requests != 1 || st[1].Denied != 1 {
+		t.Fatalf("stats %+v: want 3 requests for alice, 1 denied for bob", st)
+	}
+	if tokens.Refused() != 1 {
+		t.Fatalf("refused %d connections, want 1", tokens.Refused())
+	}
+}
+
+// Revoking a client closes its connection, which gives back the keys it owned.
+func TestNetRevokeReleasesKeys(t *testing.T) {
+	tokens := NewTokens(map[string]string{"alice": "s1", "bob": "s2"})
+	addr := startKVServer(t, nil, tokens)
+	_, doAlice := dialClient(t, addr, "s1")
+	_, doBob := dialClient(t, addr, "s2")
+
+	doAlice(ClientGet, "k", 0)
+	doAlice(ClientPut, "k", 7)
+	doAlice(ClientGet, "k", 0) // alice owns k again
+	got := make(chan ClientReply)
+	go func() { got <- doBob(ClientGet, "k", 0) }()
+
+	if n := tokens.Revoke("alice"); n != 1 {
+		t.Fatalf("revoked %d connections, want 1", n)
+	}
+	if r := <-got; !r.Ok || r.Value != 7 {
+		t.Fatalf("bob's get: %+v, want 7", r)
+	}
+	if r := doAlice(ClientGet, "j", 0); r.Ok {
+		t.Fatal("a revoked connection was still served")
+	}
+	if _, err := DialKV(addr, DialConfig{Token: "s1"}); err == nil {
+		t.Fatal("a revoked token was let in")
+	}
+}
@@ -0,0 +1,244 @@
+package kvcache
+
+import (
+	"strconv"
+	"sync"
+)
+
+// ----- Read-ahead client -----
+
+// ReadAheadClient is a KVClient that watches the keys its gets ask for and, once
+// they follow a pattern (key-0, key-1, key-2, or key-0, key-4, key-8), reads the
+// next keys of the pattern from KVStore in the background, so that the gets for
+// them are cache hits. A read grants ownership, so the keys read ahead are owned
+// by the client until a get uses them or the pattern breaks, when they are
+// written back unchanged. Read ahead only keys no other client uses: a prefetch
+// of a key another client owns waits in KVStore like any other read.
+
+// ReadAheadConfig configures a ReadAheadClient.
+type ReadAheadConfig struct {
+	Depth  int // how many keys of the pattern to keep read ahead
+	MinRun int // how many equal strides in a row make a pattern; default 2
+}
+
+// ReadAheadStats counts what a ReadAheadClient's detector and prefetches did.
+// Read them once the client has exited.
+type ReadAheadStats struct {
+	Detected   int // times a pattern was detected
+	Prefetched int // keys read ahead
+	Used       int // prefetched keys a get found in the cache
+	Late       int // gets that waited for a prefetch of their key still in flight
+	Wasted     int // prefetched keys written back unused
+}
+
+// Add adds the counts of o to s.
+func (s *ReadAheadStats) Add(o ReadAheadStats) {
+	s.Detected += o.Detected
+	s.Prefetched += o.Prefetched
+	s.Used += o.Used
+	s.Late += o.Late
+	s.Wasted += o.Wasted
+}
+
+// strideDetector finds a constant stride in the numeric suffixes of a stream of
+// keys with the same prefix.
+type strideDetector struct {
+	minRun int
+	prefix string
+	last   int
+	stride int
+	run    int // equal strides in a row, up to the last key
+	seen   bool
+}
+
+// splitKey splits key into the prefix before its trailing digits and their value.
+func splitKey(key string) (prefix string, n int, ok bool) {
+	i := len(key)
+	for i > 0 && key[i-1] >= '0' && key[i-1] <= '9' {
+		i--
+	}
+	if i == len(key) {
+		return key, 0, false
+	}
+	n, err := strconv.Atoi(key[i:])
+	return key[:i], n, err == nil
+}
+
+// observe records an access to key and reports whether the keys so far follow a
+// pattern, and whether key broke one that held before it.
+func (d *strideDetector) observe(key string) (pattern, broke bool) {
+	was := d.run >= d.minRun
+	prefix, n, ok := splitKey(key)
+	switch {
+	case !ok:
+		d.seen, d.run = false, 0
+	case d.seen && prefix == d.prefix && n-d.last == d.stride && d.stride != 0:
+		d.run++
+	case d.seen && prefix == d.prefix:
+		d.stride, d.run = n-d.last, 1
+	default:
+		d.stride, d.run = 0, 0
+	}
+	d.prefix, d.last, d.seen = prefix, n, ok
+	pattern = d.run >= d.minRun
+	return pattern, was && !pattern
+}
+
+// next returns the i'th key of the pattern after the last one seen, or false if
+// its number would be negative.
+func (d *strideDetector) next(i int) (string, bool) {
+	n := d.last + i*d.stride
+	if n < 0 {
+		return "", false
+	}
+	return d.prefix + strconv.Itoa(n), true
+}
+
+// prefetched is the reply to a read issued ahead of time.
+type prefetched struct {
+	key   string
+	reply KVReply
+}
+
+// ReadAheadClient runs as a client goroutine like KVClient, with read-ahead as
+// set by cfg, counting into stats (which may be nil).
+func ReadAheadClient(name string, actionsCh <-chan ClientAction, kvReqCh chan<- KVRequest, wg *sync.WaitGroup, cfg ReadAheadConfig, stats *ReadAheadStats) {
+	defer wg.Done()
+	if stats == nil {
+		stats = &ReadAheadStats{}
+	}
+	if cfg.MinRun <= 0 {
+		cfg.MinRun = 2
+	}
+	det := strideDetector{minRun: cfg.MinRun}
+	cache := make(map[string]int)     // keys owned through a get
+	ahead := make(map[string]int)     // keys owned through a prefetch, not yet got
+	inflight := make(map[string]bool) // prefetches not yet answered
+	fetched := make(chan prefetched)
+
+	call := func(req KVRequest) KVReply {
+		req.Reply = make(chan KVReply)
+		req.Client = name
+		kvReqCh <- req
+		resp := <-req.Reply
+		close(req.Reply)
+		return resp
+	}
+	land := func(f prefetched) {
+		delete(inflight, f.key)
+		if f.reply.Ok {
+			ahead[f.key] = f.reply.Value
+		}
+	}
+	// release writes back every key read ahead and not used, giving up ownership.
+	release := func() {
+		for k, v := range ahead {
+			call(KVRequest{Op: KVWrite, Key: k, Value: v})
+			delete(ahead, k)
+			stats.Wasted++
+		}
+	}
+	readAhead := func() {
+		for i := 1; i <= cfg.Depth; i++ {
+			k, ok := det.next(i)
+			if !ok {
+				break
+			}
+			if _, ok := cache[k]; ok || inflight[k] {
+				continue
+			}
+			if _, ok := ahead[k]; ok {
+				continue
+			}
+			inflight[k] = true
+			stats.Prefetched++
+			go func() {
+				fetched <- prefetched{key: k, reply: call(KVRequest{Op: KVRead, Key: k})}
+			}()
+		}
+	}
+
+	get := func(act ClientAction) {
+		if v, ok := cache[act.Key]; ok {
+			act.Reply <- ClientReply{Value: v, Hit: true, Ok: true}
+			return
+		}
+		hit := false
+		if inflight[act.Key] {
+			stats.Late++
+			for inflight[act.Key] {
+				land(<-fetched)
+			}
+		} else if _, ok := ahead[act.Key]; ok {
+			hit = true
+		}
+		if v, ok := ahead[act.Key]; ok {
+			delete(ahead, act.Key)
+			stats.Used++
+			cache[act.Key] = v
+			act.Reply <- ClientReply{Value: v, Hit: hit, Ok: true}
+			return
+		}
+		if resp := call(KVRequest{Op: KVRead, Key: act.Key}); resp.Ok {
+			cache[act.Key] = resp.Value
+			act.Reply <- ClientReply{Value: resp.Value, Ok: true}
+		} else if resp.Err != "" {
+			act.Reply <- ClientReply{Ok: false, Err: resp.Err}
+		} else {
+			act.Reply <- ClientReply{Ok: false, Err: "kv read failed"}
+		}
+	}
+
+	put := func(act ClientAction) {
+		if _, ok := cache[act.Key]; !ok {
+			act.Reply <- ClientReply{Ok: false, Err: "key not in local cache"}
+			return
+		}
+		cache[act.Key] = act.Value
+		if resp := call(KVRequest{Op: KVWrite, Key: act.Key, Value: act.Value}); resp.Ok {
+			delete(cache, act.Key)
+			act.Reply <- ClientReply{Hit: true, Ok: true}
+		} else if resp.Err != "" {
+			// the store gave the key back unchanged
+			delete(cache, act.Key)
+			act.Reply <- ClientReply{Ok: false, Err: resp.Err}
+		} else {
+			act.Reply <- ClientReply{Ok: false, Err: "kv write failed (key missing in store)"}
+		}
+	}
+
+	for {
+		select {
+		case f := <-fetched:
+			land(f)
+		case act, ok := <-actionsCh:
+			if !ok {
+				for len(inflight) > 0 {
+					land(<-fetched)
+				}
+				release()
+				return
+			}
+			switch act.Type {
+			case ClientGet:
+				pattern, broke := det.observe(act.Key)
+				if broke {
+					// the keys read ahead belong to the old pattern; let them go
+					// before they keep another client waiting
+					release()
+				}
+				get(act)
+				if pattern {
+					if det.run == cfg.MinRun {
+						stats.Detected++
+					}
+					readAhead()
+				}
+			case ClientPut:
+				put(act)
+			default:
+				act.Reply <- ClientReply{Ok: false, Err: "unknown action"}
+			}
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package kvcache
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ----- Regression suite -----
+
+// A regression suite is a set of benchmarks, each with the results it must
+// produce, kept in a JSON golden file (regression.json beside kvrun.go). Every
+// get and put must be answered, failures and stale gets stay within their
+// limits (normally none), and the messages between clients and store must be
+// exactly those of the golden file, which the protocol fixes whatever the
+// timing. With timing, throughput must also stay above a floor, set far below
+// what any machine manages, so that it only catches a store that has become
+// pathologically slow, such as one that sleeps or polls.
+
+// RegressionCase is one benchmark of a regression suite and its golden results.
+type RegressionCase struct {
+	Name         string  `json:"name"`
+	Clients      int     `json:"clients"`
+	Ops          int     `json:"ops"`
+	Keys         int     `json:"keys"`
+	Shared       bool    `json:"shared,omitempty"`
+	MinOpsPerSec float64 `json:"minOpsPerSec"`
+	MaxFailed    int     `json:"maxFailed"`
+	MaxStale     int     `json:"maxStale"`
+	Hits         int     `json:"hits"`
+	// Messages are the messages the run must exchange. With shared keys, whether
+	// a read is granted at once or handed off by the owner depends on timing, so
+	// only grants and handoffs together are checked.
+	Messages MessageCounts `json:"messages"`
+}
+
+// Config returns the benchmark the case runs.
+func (c RegressionCase) Config() BenchConfig {
+	return BenchConfig{Clients: c.Clients, Ops: c.Ops, Keys: c.Keys, Shared: c.Shared, Messages: true}
+}
+
+// Check returns the ways r fails the case; with timing, a throughput below the
+// floor is one of them.
+func (c RegressionCase) Check(r BenchResult, timing bool) []string {
+	var out []string
+	if want := c.Clients * c.Ops; r.Gets != want || r.Puts != want {
+		out = append(out, fmt.Sprintf("gets=%d puts=%d, want %d each", r.Gets, r.Puts, want))
+	}
+	if r.Failed > c.MaxFailed {
+		out = append(out, fmt.Sprintf("%d failed operations, want at most %d", r.Failed, c.MaxFailed))
+	}
+	if r.Stale > c.MaxStale {
+		out = append(out, fmt.Sprintf("%d stale gets, want at most %d", r.Stale, c.MaxStale))
+	}
+	if r.Hits != c.Hits {
+		out = append(out, fmt.Sprintf("%d hits, want %d", r.Hits, c.Hits))
+	}
+	got, want := r.MessageCounts, c.Messages
+	if c.Shared {
+		got.Grants, got.Handoffs = got.Grants+got.Handoffs, 0
+		want.Grants, want.Handoffs = want.Grants+want.Handoffs, 0
+	}
+	if got != want {
+		out = append(out, fmt.Sprintf("messages %+v, want %+v", r.MessageCounts, c.Messages))
+	}
+	if !timing {
+		return out
+	}
+	if ops := float64(r.Gets+r.Puts) / r.Elapsed.Seconds(); ops < c.MinOpsPerSec {
+		out = append(out, fmt.Sprintf("%.0f ops/sec, want at least %.0f", ops, c.MinOpsPerSec))
+	}
+	return out
+}
+
+// LoadRegression reads a golden file.
+func LoadRegression(path string) ([]RegressionCase, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cases []RegressionCase
+	if err := json.Unmarshal(data, &cases); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return cases, nil
+}
+
+// Regression runs cases and returns a line for each failure, prefixed with the
+// name of its case, with timing as in Check.
+func Regression(cases []RegressionCase, timing bool) []string {
+	var out []string
+	for _, c := range cases {
+		r, err := Bench(c.Config())
+		if err != nil {
+			out = append(out, fmt.Sprintf("%s: %v", c.Name, err))
+			continue
+		}
+		for _, f := range c.Check(r, timing) {
+			out = append(out, c.Name+": "+f)
+		}
+	}
+	return out
+}
+
+// TB is the part of testing.TB that CheckRegression uses.
+type TB interface {
+	Helper()
+	Errorf(format string, args ...any)
+}
+
+// CheckRegression runs the suite in the golden file at path and fails t if any
+// case fails, checking throughput too if timing is set:
+//
+//	func TestRegression(t *testing.T) { kvcache.CheckRegression(t, "../regression.json", false) }
+func CheckRegression(t TB, path string, timing bool) {
+	t.Helper()
+	cases, err := LoadRegression(path)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if failures := Regression(cases, timing); len(failures) > 0 {
+		t.Errorf("%s", strings.Join(failures, "\n"))
+	}
+}
@@ -0,0 +1,10 @@
+package kvcache
+
+import (
+	"flag"
+	"testing"
+)
+
+var regressTiming = flag.Bool("timing", false, "check the regression suite's throughput floors too")
+
+func TestRegression(t *testing.T) { CheckRegression(t, "../regression.json", *regressTiming) }
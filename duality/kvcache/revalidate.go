@@ -0,0 +1,118 @@
+package kvcache
+
+// ----- Revalidating clients -----
+
+// ClientConfig configures KVClientWith. Its zero value is KVClient's behaviour.
+//
+// Revalidate, if positive, makes the client keep a read copy of each key it
+// puts, with the version the store gave the write, and answer gets of the key
+// from it, with no message. Nobody tells the client when another client writes
+// the key, so a copy can go stale; instead, every Revalidate of its actions, the
+// client revalidates one of its copies, in turn, with a KVValidate, a conditional
+// read: the copy is kept if the store's version is still its own, refreshed if
+// not, and dropped if the key is gone. Revalidations are bounded by the client's
+// own rate, however many copies it holds, so its copies stay fresh without TTLs
+// at a cost the caller picks. A put of a key held as a copy takes the key first,
+// with a read, as a get would. Replies carry the key's version, so a caller can
+// tell a stale get from a fresh one.
+//
+// Keys, if set, is the table the client numbers its keys from, shared with the
+// store (see keys.go).
+type ClientConfig struct {
+	Revalidate int       // actions between revalidations; 0 keeps no copies
+	Keys       *KeyTable // if set, where key IDs come from
+}
+
+// ClientStats counts what KVClientWith did. Read them once it has exited.
+type ClientStats struct {
+	CopyHits      int `json:"copyHits"`      // gets answered from a read copy
+	Revalidations int `json:"revalidations"` // KVValidates sent
+	StaleFound    int `json:"staleFound"`    // of those, the ones that found the copy out of date
+	Gone          int `json:"gone"`          // of those, the ones that found the key removed
+}
+
+// Add adds the counts of o to s.
+func (s *ClientStats) Add(o ClientStats) {
+	s.CopyHits += o.CopyHits
+	s.Revalidations += o.Revalidations
+	s.StaleFound += o.StaleFound
+	s.Gone += o.Gone
+}
+
+// readCopy is a client's copy of a key it does not own.
+type readCopy struct {
+	value, version int
+}
+
+// readCopies are the read copies of a client, and the order they are
+// revalidated in.
+type readCopies struct {
+	client string      // whose copies, to name in requests to the store
+	keys   *keyDict    // the client's
+	let    func(KeyID) // called with each key that leaves both of and ring
+	of     map[KeyID]readCopy
+	ring   []KeyID        // the keys to revalidate, in turn
+	queued map[KeyID]bool // the keys in ring
+}
+
+func newReadCopies(client string, keys *keyDict, let func(KeyID)) *readCopies {
+	return &readCopies{client: client, keys: keys, let: let, of: make(map[KeyID]readCopy), queued: make(map[KeyID]bool)}
+}
+
+// holds reports whether key has a copy or is in the ring.
+func (c *readCopies) holds(key KeyID) bool {
+	_, ok := c.of[key]
+	return ok || c.queued[key]
+}
+
+// keep keeps a copy of key, at the end of the ring if it is not in it already.
+func (c *readCopies) keep(key KeyID, value, version int) {
+	c.of[key] = readCopy{value: value, version: version}
+	if !c.queued[key] {
+		c.queued[key] = true
+		c.ring = append(c.ring, key)
+	}
+}
+
+// take reads key from the store, which makes the client its owner, and drops
+// the copy. It returns the store's reply.
+func (c *readCopies) take(key KeyID, kvReqCh chan<- KVRequest) KVReply {
+	delete(c.of, key)
+	reply := make(chan KVReply)
+	kvReqCh <- KVRequest{Op: KVRead, Key: c.keys.name(key), Reply: reply, Client: c.client}
+	resp := <-reply
+	close(reply)
+	return resp
+}
+
+// revalidate sends a KVValidate for the next copy in the ring, if any, and
+// keeps, refreshes, or drops the copy by the reply. Keys in the ring whose copy
+// was taken since are skipped.
+func (c *readCopies) revalidate(kvReqCh chan<- KVRequest, stats *ClientStats) {
+	for len(c.ring) > 0 {
+		key := c.ring[0]
+		c.ring = c.ring[1:]
+		delete(c.queued, key)
+		cp, ok := c.of[key]
+		if !ok {
+			c.let(key)
+			continue
+		}
+		reply := make(chan KVReply)
+		kvReqCh <- KVRequest{Op: KVValidate, Key: c.keys.name(key), Reply: reply, Client: c.client}
+		resp := <-reply
+		close(reply)
+		stats.Revalidations++
+		switch {
+		case !resp.Ok:
+			stats.Gone++
+			delete(c.of, key)
+			c.let(key)
+			return
+		case resp.Version != cp.version:
+			stats.StaleFound++
+		}
+		c.keep(key, resp.Value, resp.Version)
+		return
+	}
+}
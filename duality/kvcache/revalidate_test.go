@@ -0,0 +1,82 @@
+package kvcache
+
+import (
+	"sync"
+	"testing"
+)
+
+// A client keeping copies answers a get of a key it put from its copy, and
+// finds the copy stale only when it revalidates it, after another client wrote
+// the key; a copy whose key was deleted is dropped.
+func TestClientRevalidatesCopies(t *testing.T) {
+	ch, shutdown := startStore(StoreConfig{})
+	defer shutdown()
+	actCh := make(chan ClientAction)
+	var wg sync.WaitGroup
+	var stats ClientStats
+	wg.Add(1)
+	go KVClientWith("c", actCh, ch, &wg, ClientConfig{Revalidate: 4}, &stats)
+	do := func(typ ClientActionType, key string, value int) ClientReply {
+		act := ClientAction{Type: typ, Key: key, Value: value, Reply: make(chan ClientReply)}
+		actCh <- act
+		return <-act.Reply
+	}
+
+	do(ClientGet, "k", 0)
+	put := do(ClientPut, "k", 5)
+	if !put.Ok || put.Version == 0 {
+		t.Fatalf("put = %+v, want ok with a version", put)
+	}
+	bulkSet(ch, "k", 6) // behind the client's back
+	if get := do(ClientGet, "k", 0); get.Value != 5 || get.Version != put.Version {
+		t.Fatalf("get before revalidating = %+v, want the copy, 5", get)
+	}
+	// The 4th action revalidates the copy before it is served.
+	if get := do(ClientGet, "k", 0); get.Value != 6 || get.Version <= put.Version {
+		t.Fatalf("get after revalidating = %+v, want 6 at a newer version", get)
+	}
+	if put := do(ClientPut, "k", 7); !put.Ok {
+		t.Fatal("put of a key held as a copy failed")
+	}
+	if rep := bulkCall(ch, KVRequest{Op: KVValidate, Key: "k"}); !rep.Ok || rep.Value != 7 {
+		t.Fatalf("store has %+v, want 7", rep)
+	}
+	bulkCall(ch, KVRequest{Op: KVDelete, Key: "k"})
+	do(ClientGet, "k", 0)
+	do(ClientGet, "k", 0)
+	// The 8th finds the key gone, and reads it from the store, created again.
+	if get := do(ClientGet, "k", 0); get.Value != 0 || get.Hit {
+		t.Fatalf("get after the key was deleted = %+v, want a miss of 0", get)
+	}
+	do(ClientPut, "k", 0)
+	close(actCh)
+	wg.Wait()
+	if stats.StaleFound != 1 || stats.Gone != 1 || stats.Revalidations != 2 || stats.CopyHits != 4 {
+		t.Errorf("stats %+v, want 2 revalidations finding 1 stale and 1 gone, 4 copy hits", stats)
+	}
+}
+
+// Without Revalidate, replies carry no versions and no copies are kept.
+func TestClientKeepsNoCopies(t *testing.T) {
+	ch, shutdown := startStore(StoreConfig{})
+	defer shutdown()
+	actCh := make(chan ClientAction)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go KVClient("c", actCh, ch, &wg)
+	act := ClientAction{Type: ClientGet, Key: "k", Reply: make(chan ClientReply)}
+	actCh <- act
+	<-act.Reply
+	act = ClientAction{Type: ClientPut, Key: "k", Value: 1, Reply: make(chan ClientReply)}
+	actCh <- act
+	if rep := <-act.Reply; rep.Version != 0 {
+		t.Errorf("put = %+v, want no version", rep)
+	}
+	act = ClientAction{Type: ClientPut, Key: "k", Value: 2, Reply: make(chan ClientReply)}
+	actCh <- act
+	if rep := <-act.Reply; rep.Ok {
+		t.Error("put of a key given back succeeded")
+	}
+	close(actCh)
+	wg.Wait()
+}
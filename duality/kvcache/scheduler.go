@@ -0,0 +1,227 @@
+package kvcache
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ----- Store request scheduler -----
+
+// KVStore takes its requests from one channel, first come first served, so a
+// client that sends many at once (a ReadAheadClient, say) gets ahead of the rest.
+// With StoreConfig.Sched set, KVStoreWith keeps a queue per client instead: it
+// takes in every request waiting on its channel, as far as StoreConfig.Inbox
+// leaves room, and picks the next one to serve by policy:
+//
+//	fifo  first come, first served, as the store's channel alone would
+//	rr    round-robin over the clients with requests queued
+//	fair  the queued client that has been served least so far
+//
+// Clients are told apart by KVRequest.Client. The queues only order requests;
+// the store still decides ownership.
+
+// SchedPolicy is how the store picks the next request from its queues.
+type SchedPolicy string
+
+const (
+	SchedFIFO SchedPolicy = "fifo"
+	SchedRR   SchedPolicy = "rr"
+	SchedFair SchedPolicy = "fair"
+)
+
+// ParseSchedPolicy returns the policy named s.
+func ParseSchedPolicy(s string) (SchedPolicy, error) {
+	switch p := SchedPolicy(s); p {
+	case SchedFIFO, SchedRR, SchedFair:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown scheduling policy %q: want fifo, rr, or fair", s)
+}
+
+// ClientServiceStats is the service one client got from the store's queues.
+type ClientServiceStats struct {
+	Client    string        `json:"client"`
+	Requests  int           `json:"requests"`  // served
+	MaxQueued int           `json:"maxQueued"` // most requests queued at once
+	Waited    time.Duration `json:"-"`         // in the queue, over all requests
+	MaxWait   time.Duration `json:"-"`
+	WaitedMs  float64       `json:"waitedMs"`
+	MaxWaitMs float64       `json:"maxWaitMs"`
+}
+
+// MeanWait returns the mean time a request of the client was queued.
+func (s ClientServiceStats) MeanWait() time.Duration {
+	if s.Requests == 0 {
+		return 0
+	}
+	return s.Waited / time.Duration(s.Requests)
+}
+
+// queuedRequest is a request in the store's queues.
+type queuedRequest struct {
+	req KVRequest
+	at  time.Time
+	seq int // order of arrival, over all clients
+}
+
+// storeQueues are the requests KVStoreWith has taken from its channel and not
+// yet served, a queue per client in the order the clients first sent, with the
+// service each client got and the measure of the inbox (see inbox.go). A nil
+// *storeQueues is no queues at all: the store serves each request as it takes it.
+type storeQueues struct {
+	policy SchedPolicy
+	depth  int // most requests queued at once; 0 is no limit
+
+	clients map[string]int // index of each client in queues and served
+	queues  [][]queuedRequest
+	served  []ClientServiceStats
+	queued  int
+	seq     int
+	next    int // for rr, the client to look at first
+
+	inbox     InboxStats
+	lastLook  time.Time // when the store last looked for waiting requests
+	fullSince time.Time // when the queues last filled up
+}
+
+// newStoreQueues returns the queues cfg asks for: with Sched set, or with an
+// Inbox, which is then served first come, first served. Otherwise it returns nil.
+func newStoreQueues(cfg StoreConfig) *storeQueues {
+	if cfg.Sched == "" && cfg.Inbox <= 0 {
+		return nil
+	}
+	policy := cfg.Sched
+	if policy == "" {
+		policy = SchedFIFO
+	}
+	return &storeQueues{
+		policy:   policy,
+		depth:    max(cfg.Inbox, 0),
+		clients:  make(map[string]int),
+		inbox:    InboxStats{Depth: max(cfg.Inbox, 0)},
+		lastLook: time.Now(),
+	}
+}
+
+// len returns the number of requests queued.
+func (q *storeQueues) len() int {
+	if q == nil {
+		return 0
+	}
+	return q.queued
+}
+
+// room reports whether the queues can take another request.
+func (q *storeQueues) room() bool {
+	return q != nil && (q.depth == 0 || q.queued < q.depth)
+}
+
+// add queues req, which came on the channel at now. waited says whether its
+// sender was waiting for the store to take it.
+func (q *storeQueues) add(req KVRequest, now time.Time, waited bool) {
+	i, ok := q.clients[req.Client]
+	if !ok {
+		i = len(q.queues)
+		q.clients[req.Client] = i
+		q.queues = append(q.queues, nil)
+		q.served = append(q.served, ClientServiceStats{Client: req.Client})
+	}
+	q.seq++
+	q.queues[i] = append(q.queues[i], queuedRequest{req: req, at: now, seq: q.seq})
+	q.queued++
+	q.served[i].MaxQueued = max(q.served[i].MaxQueued, len(q.queues[i]))
+	q.took(now, waited)
+}
+
+// pick returns the client whose request is to be served next.
+func (q *storeQueues) pick() int {
+	n := len(q.queues)
+	best := -1
+	for k := range n {
+		i := k
+		if q.policy == SchedRR {
+			i = (q.next + k) % n
+		}
+		if len(q.queues[i]) == 0 {
+			continue
+		}
+		switch {
+		case best < 0:
+			best = i
+		case q.policy == SchedFIFO && q.queues[i][0].seq < q.queues[best][0].seq:
+			best = i
+		case q.policy == SchedFair && q.served[i].Requests < q.served[best].Requests:
+			best = i
+		}
+		if q.policy == SchedRR {
+			break
+		}
+	}
+	return best
+}
+
+// take removes the next request to serve, by policy, and counts its service.
+// There must be one queued.
+func (q *storeQueues) take(now time.Time) KVRequest {
+	from := q.pick()
+	head := q.queues[from][0]
+	q.queues[from] = q.queues[from][1:]
+	q.left(now)
+	q.queued--
+	q.next = (from + 1) % len(q.queues)
+	wait := now.Sub(head.at)
+	s := &q.served[from]
+	s.Requests++
+	s.Waited += wait
+	s.MaxWait = max(s.MaxWait, wait)
+	return head.req
+}
+
+// finish completes the measures once the store is done, and puts them in stats.
+func (q *storeQueues) finish(stats *StoreStats) {
+	if q == nil {
+		return
+	}
+	for i := range q.served {
+		q.served[i].WaitedMs = float64(q.served[i].Waited) / float64(time.Millisecond)
+		q.served[i].MaxWaitMs = float64(q.served[i].MaxWait) / float64(time.Millisecond)
+	}
+	q.inbox.BlockMs = float64(q.inbox.BlockTime) / float64(time.Millisecond)
+	q.inbox.FullMs = float64(q.inbox.FullTime) / float64(time.Millisecond)
+	stats.Service = q.served
+	stats.Inbox = q.inbox
+}
+
+// FairnessIndex returns Jain's fairness index of the requests served to each
+// client: 1 when they were served equally, down to 1/n when one got them all.
+func FairnessIndex(stats []ClientServiceStats) float64 {
+	var sum, sq float64
+	for _, s := range stats {
+		x := float64(s.Requests)
+		sum += x
+		sq += x * x
+	}
+	if sq == 0 {
+		return 1
+	}
+	return sum * sum / (float64(len(stats)) * sq)
+}
+
+// formatServiceStats describes the service of each client, one line each.
+func formatServiceStats(stats []ClientServiceStats) string {
+	total := 0
+	for _, s := range stats {
+		total += s.Requests
+	}
+	var b strings.Builder
+	for _, s := range stats {
+		share := 0.0
+		if total > 0 {
+			share = float64(s.Requests) / float64(total)
+		}
+		fmt.Fprintf(&b, "  %s: requests=%d (%.1f%%) wait mean=%v max=%v max-queued=%d\n",
+			s.Client, s.Requests, 100*share, s.MeanWait().Round(time.Microsecond), s.MaxWait.Round(time.Microsecond), s.MaxQueued)
+	}
+	return b.String()
+}
@@ -0,0 +1,114 @@
+package kvcache
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Each policy serves the queued requests of two clients in its own order: while
+// the store was busy with a read for client c, client a sent a1..a3 before
+// client b sent b1 and b2.
+func TestStoreSchedulerOrder(t *testing.T) {
+	for _, tc := range []struct {
+		policy SchedPolicy
+		want   string
+	}{
+		{SchedFIFO, "a1 a2 a3 b1 b2"},
+		{SchedRR, "a1 b1 a2 b2 a3"},
+		{SchedFair, "a1 b1 a2 b2 a3"},
+	} {
+		reqCh := make(chan KVRequest, 8)
+		var wg sync.WaitGroup
+		var stats StoreStats
+		wg.Add(1)
+		go KVStoreWith(reqCh, &wg, StoreConfig{Sched: tc.policy}, &stats)
+		names := []string{"a1", "a2", "a3", "b1", "b2"}
+		var entries []KVEntry
+		for i, k := range names {
+			entries = append(entries, KVEntry{Key: k, Value: i + 1})
+		}
+		imported := make(chan KVReply)
+		reqCh <- KVRequest{Op: KVImport, Entries: entries, Reply: imported, Client: "c"}
+		<-imported
+
+		busy := make(chan KVReply)
+		reqCh <- KVRequest{Op: KVRead, Key: "busy", Reply: busy, Client: "c"}
+		replies := make(chan KVReply, len(names))
+		for _, k := range names {
+			reqCh <- KVRequest{Op: KVRead, Key: k, Reply: replies, Client: k[:1]}
+		}
+		<-busy
+
+		var got []string
+		for range names {
+			got = append(got, names[(<-replies).Value-1])
+		}
+		close(reqCh)
+		wg.Wait()
+		if s := strings.Join(got, " "); s != tc.want {
+			t.Errorf("%s: served %s, want %s", tc.policy, s, tc.want)
+		}
+		if len(stats.Service) != 3 || stats.Service[1].Client != "a" || stats.Service[1].Requests != 3 || stats.Service[2].Requests != 2 {
+			t.Errorf("%s: service %+v", tc.policy, stats.Service)
+		}
+	}
+}
+
+// The store measures its inbox: senders wait while it is busy, and it holds no
+// more than Inbox requests at once.
+func TestStoreInbox(t *testing.T) {
+	reqCh := make(chan KVRequest)
+	var wg sync.WaitGroup
+	var stats StoreStats
+	wg.Add(1)
+	go KVStoreWith(reqCh, &wg, StoreConfig{Inbox: 2}, &stats)
+	busy := make(chan KVReply)
+	reqCh <- KVRequest{Op: KVRead, Key: "busy", Reply: busy}
+	replies := make(chan KVReply, 3)
+	var senders sync.WaitGroup
+	for i := range 3 {
+		senders.Add(1)
+		go func() {
+			defer senders.Done()
+			reqCh <- KVRequest{Op: KVRead, Key: fmt.Sprintf("k%d", i), Reply: replies}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond) // the senders wait for the busy store
+	<-busy
+	senders.Wait()
+	for range 3 {
+		<-replies
+	}
+	close(reqCh)
+	wg.Wait()
+
+	ib := stats.Inbox
+	if ib.Depth != 2 || ib.Sends != 4 || ib.HighWater != 2 || ib.Blocked < 1 || ib.BlockTime < 20*time.Millisecond {
+		t.Errorf("inbox %+v, want depth 2, 4 sends, high water 2, and the senders held up 20ms or more", ib)
+	}
+	if len(stats.Service) != 1 || stats.Service[0].Requests != 4 {
+		t.Errorf("service %+v, want the 4 requests of one client", stats.Service)
+	}
+}
+
+func TestFairnessIndex(t *testing.T) {
+	for _, tc := range []struct {
+		reqs []int
+		want float64
+	}{
+		{[]int{5, 5}, 1},
+		{[]int{10, 0}, 0.5},
+		{[]int{0, 0, 0}, 1},
+	} {
+		stats := make([]ClientServiceStats, len(tc.reqs))
+		for i, n := range tc.reqs {
+			stats[i].Requests = n
+		}
+		if got := FairnessIndex(stats); got != tc.want {
+			t.Errorf("FairnessIndex(%v) = %v, want %v", tc.reqs, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package kvcache
+
+import (
+	"sort"
+	"time"
+)
+
+// ----- Store configuration -----
+
+// StoreConfig configures KVStoreWith. Its zero value is KVStore's behaviour.
+//
+// TTL, if positive, is how long a value lives: a key expires TTL after it was
+// created or last written, however often it is read, and the sweep removes it
+// and reports it to Watchers as expired. The sweep runs inside the store
+// goroutine, between requests, on every tick of SweepEvery, and on a KVSweep
+// request. A key that is owned, or that a client waits for, is never removed by
+// it: its owner's write must find it, and renews its TTL.
+//
+// IdleAfter, if positive, makes the sweep also evict keys that nobody has read
+// or written for that long, and report them to Watchers as deleted. Every read
+// of a missing key creates it, so a load test that reads random keys fills the
+// store with keys nobody will touch again; the sweep removes them.
+//
+// Watchers, if set, is told of every write the store accepts, as updated, and of
+// every key it removes: as expired by the sweep, or as deleted by a KVDelete,
+// which removes a key at once, whoever owns it.
+//
+// ACL, if set, is checked against the Client of each request (see ACL).
+//
+// Audit, if set, records every write and import the store accepts (see
+// AuditLog).
+//
+// Derived, if set, makes reads of virtual keys computed by the store (see
+// DerivedKeys).
+//
+// Keys, if set, is the table the store numbers its keys from, shared with its
+// clients (see keys.go).
+type StoreConfig struct {
+	TTL        time.Duration // expire keys this long after their last write; 0 never
+	IdleAfter  time.Duration // evict keys idle this long; 0 never
+	SweepEvery time.Duration // how often to look for them; default half the shorter
+	Watchers   *Watchers     // if set, told of each write and each key removed
+	ACL        *ACL          // if set, what each client may do
+	Audit      *AuditLog     // if set, where writes are recorded
+	Derived    *DerivedKeys  // if set, the functions of the virtual keys the store computes
+	Keys       *KeyTable     // if set, where key IDs come from
+	Sched      SchedPolicy   // if set, queue each client's requests and pick by this policy (see scheduler.go)
+	Inbox      int           // if positive, most requests queued ahead of serving them (see inbox.go)
+}
+
+// StoreStats counts what KVStoreWith did. Read them once it has exited.
+type StoreStats struct {
+	Sweeps  int `json:"sweeps"`  // sweeps for expired and idle keys
+	Expired int `json:"expired"` // keys they removed for outliving their TTL
+	Evicted int `json:"evicted"` // keys they removed for being idle
+	Deleted int `json:"deleted"` // keys removed by KVDelete
+
+	Keys           int `json:"keys"`           // keys held when it exited
+	KeyBytes       int `json:"keyBytes"`       // their bytes
+	PeakOwned      int `json:"peakOwned"`      // most keys clients owned at once, each in its owner's cache too
+	PeakOwnedBytes int `json:"peakOwnedBytes"` // most bytes of them
+
+	Service []ClientServiceStats `json:"-"` // with Sched or Inbox, the service each client got
+	Inbox   InboxStats           `json:"-"` // with Sched or Inbox, the measure of the inbox
+}
+
+// sweepEvery returns the sweep period.
+func (cfg StoreConfig) sweepEvery() time.Duration {
+	if cfg.SweepEvery > 0 {
+		return cfg.SweepEvery
+	}
+	d := cfg.TTL
+	if d <= 0 || cfg.IdleAfter > 0 && cfg.IdleAfter < d {
+		d = cfg.IdleAfter
+	}
+	return max(d/2, time.Millisecond)
+}
+
+// sweeps reports whether the store sweeps at all.
+func (cfg StoreConfig) sweeps() bool {
+	return cfg.TTL > 0 || cfg.IdleAfter > 0
+}
+
+// keyTimes are when each key of a store was last written, if cfg.TTL is set,
+// and last used, read or written, if cfg.IdleAfter is set.
+type keyTimes struct {
+	cfg     StoreConfig
+	written map[KeyID]time.Time
+	used    map[KeyID]time.Time
+}
+
+func newKeyTimes(cfg StoreConfig) *keyTimes {
+	return &keyTimes{cfg: cfg, written: make(map[KeyID]time.Time), used: make(map[KeyID]time.Time)}
+}
+
+// write records that key was created or written now.
+func (t *keyTimes) write(key KeyID, now time.Time) {
+	if t.cfg.TTL > 0 {
+		t.written[key] = now
+	}
+	t.use(key, now)
+}
+
+// use records that key was read now.
+func (t *keyTimes) use(key KeyID, now time.Time) {
+	if t.cfg.IdleAfter > 0 {
+		t.used[key] = now
+	}
+}
+
+// drop forgets key, which the store removed.
+func (t *keyTimes) drop(key KeyID) {
+	delete(t.written, key)
+	delete(t.used, key)
+}
+
+// now returns the time to record, or the zero time if nothing is recorded.
+func (t *keyTimes) now() time.Time {
+	if !t.cfg.sweeps() {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// sweep removes from store the keys that are not owned and, at now, have
+// outlived cfg.TTL or been idle for cfg.IdleAfter, and returns how many it
+// removed. A key has a waiter only while it is owned, so one check covers both.
+func sweep(store map[KeyID]int, owned map[KeyID]bool, times *keyTimes, versions *keyVersions, keys *keyDict, cfg StoreConfig, now time.Time, stats *StoreStats) int {
+	if !cfg.sweeps() {
+		return 0
+	}
+	stats.Sweeps++
+	n := 0
+	for k, v := range store {
+		if owned[k] {
+			continue
+		}
+		var kind KeyEventKind
+		switch {
+		case cfg.TTL > 0 && now.Sub(times.written[k]) >= cfg.TTL:
+			kind = KeyExpired
+			stats.Expired++
+		case cfg.IdleAfter > 0 && now.Sub(times.used[k]) >= cfg.IdleAfter:
+			kind = KeyDeleted
+			stats.Evicted++
+		default:
+			continue
+		}
+		delete(store, k)
+		delete(owned, k)
+		times.drop(k)
+		versions.drop(k)
+		cfg.Watchers.Notify(KeyEvent{Kind: kind, Key: keys.name(k), Value: v, At: now})
+		keys.forget(k)
+		n++
+	}
+	return n
+}
+
+// ----- Versions -----
+
+// keyVersions numbers the changes to the keys of a store: creating a key, and
+// each write or import of it, gives it the next version of the store's, so a
+// version is never reused, even by a key removed and created again. A client
+// holding a copy of a key checks it with a KVValidate: if the version the store
+// replies with is the copy's, nobody has written the key since.
+type keyVersions struct {
+	last int           // the last version given
+	of   map[KeyID]int // the version of each key in the store
+}
+
+func newKeyVersions() *keyVersions {
+	return &keyVersions{of: make(map[KeyID]int)}
+}
+
+// bump gives key the next version and returns it.
+func (v *keyVersions) bump(key KeyID) int {
+	v.last++
+	v.of[key] = v.last
+	return v.last
+}
+
+// drop forgets key, which the store removed.
+func (v *keyVersions) drop(key KeyID) {
+	delete(v.of, key)
+}
+
+// ----- Scan and import -----
+
+// ScanLimit is the number of keys a KVScan lists when its Value is 0.
+const ScanLimit = 256
+
+// maxScans is the number of scans a store keeps open. Starting one more ends the
+// oldest, whose next KVScan fails.
+const maxScans = 16
+
+// keyScans are the scans open in a store. A KVScan with Cursor 0 starts one: it
+// sorts the keys of the store once, and each KVScan after it, with the Cursor the
+// last reply gave, lists the next up to Value of them (ScanLimit if 0) with their
+// values then. A negative Value ends the scan early. So a client walks the whole
+// store a chunk at a time in time linear in its size, but the walk is not a
+// snapshot: keys created after it started are not listed, keys removed since are
+// skipped, and values are those of when each chunk is listed.
+type keyScans struct {
+	next int              // the cursor of the next scan started
+	open map[int][]string // the keys each open scan has still to list, in order
+}
+
+func newKeyScans() *keyScans {
+	return &keyScans{next: 1, open: make(map[int][]string)}
+}
+
+// scan serves a KVScan of store. It returns the entries listed, the cursor to
+// pass next (0 once the scan is over), and false if cursor is not an open scan.
+func (s *keyScans) scan(store map[KeyID]int, keys *keyDict, cursor, limit int) ([]KVEntry, int, bool) {
+	if cursor == 0 {
+		cursor = s.start(store, keys)
+	}
+	names, ok := s.open[cursor]
+	if !ok {
+		return nil, 0, false
+	}
+	if limit < 0 {
+		delete(s.open, cursor)
+		return nil, 0, true
+	}
+	if limit == 0 {
+		limit = ScanLimit
+	}
+	var out []KVEntry
+	for len(names) > 0 && len(out) < limit {
+		if id, ok := keys.lookup(names[0]); ok {
+			if v, ok := store[id]; ok {
+				out = append(out, KVEntry{Key: names[0], Value: v})
+			}
+		}
+		names = names[1:]
+	}
+	if len(names) == 0 {
+		delete(s.open, cursor)
+		return out, 0, true
+	}
+	s.open[cursor] = names
+	return out, cursor, true
+}
+
+// start opens a scan of the keys now in store and returns its cursor.
+func (s *keyScans) start(store map[KeyID]int, keys *keyDict) int {
+	if len(s.open) >= maxScans {
+		oldest := s.next
+		for c := range s.open {
+			oldest = min(oldest, c)
+		}
+		delete(s.open, oldest)
+	}
+	names := make([]string, 0, len(store))
+	for k := range store {
+		names = append(names, keys.name(k))
+	}
+	sort.Strings(names)
+	c := s.next
+	s.next++
+	s.open[c] = names
+	return c
+}
+
+// importEntries sets each key of entries that nobody owns to its value, creating
+// it if missing, and returns how many it set and the entries it left because
+// their key is owned: their owner's write is still to come, and would undo the
+// import. A key that comes more than once takes its last value. client is who
+// imports, for cfg.Audit.
+func importEntries(store map[KeyID]int, owned map[KeyID]bool, times *keyTimes, versions *keyVersions, keys *keyDict, cfg StoreConfig, client string, entries []KVEntry) (int, []KVEntry) {
+	now := time.Now()
+	n := 0
+	var held []KVEntry
+	for _, e := range entries {
+		k := keys.id(e.Key)
+		if owned[k] {
+			held = append(held, e)
+			continue
+		}
+		cfg.Audit.write(client, e.Key, store[k], e.Value)
+		store[k] = e.Value
+		versions.bump(k)
+		times.write(k, now)
+		cfg.Watchers.Notify(KeyEvent{Kind: KeyUpdated, Key: e.Key, Value: e.Value, At: now})
+		n++
+	}
+	return n, held
+}
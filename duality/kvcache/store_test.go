@@ -0,0 +1,216 @@
+package kvcache
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startStore runs KVStoreWith with cfg and returns its channel and a function
+// that shuts it down and returns its stats.
+func startStore(cfg StoreConfig) (chan KVRequest, func() StoreStats) {
+	ch := make(chan KVRequest)
+	var wg sync.WaitGroup
+	var stats StoreStats
+	wg.Add(1)
+	go KVStoreWith(ch, &wg, cfg, &stats)
+	return ch, func() StoreStats {
+		close(ch)
+		wg.Wait()
+		return stats
+	}
+}
+
+// A scan lists the keys the store held when it started, a chunk at a time,
+// with their values when each chunk is listed: a key created since is left out,
+// and one written since comes with its new value.
+func TestScanSortsOnce(t *testing.T) {
+	ch, shutdown := startStore(StoreConfig{})
+	defer shutdown()
+	for i := range 6 {
+		bulkSet(ch, fmt.Sprintf("k%d", i), i)
+	}
+	rep := bulkCall(ch, KVRequest{Op: KVScan, Value: 2})
+	if !rep.Ok || rep.Cursor == 0 || fmt.Sprint(rep.Entries) != "[{k0 0} {k1 1}]" {
+		t.Fatalf("first chunk = %+v", rep)
+	}
+	bulkSet(ch, "k4", 40)
+	bulkSet(ch, "k2a", 1)
+	cursor := rep.Cursor
+	var got []KVEntry
+	for cursor != 0 {
+		rep := bulkCall(ch, KVRequest{Op: KVScan, Cursor: cursor, Value: 2})
+		if !rep.Ok {
+			t.Fatalf("scan %d failed", cursor)
+		}
+		got = append(got, rep.Entries...)
+		cursor = rep.Cursor
+	}
+	if want := "[{k2 2} {k3 3} {k4 40} {k5 5}]"; fmt.Sprint(got) != want {
+		t.Errorf("rest of the scan = %v, want %v", got, want)
+	}
+}
+
+// A scan ended early, or one ended by too many newer scans, fails when asked
+// for more.
+func TestScanEnds(t *testing.T) {
+	ch, shutdown := startStore(StoreConfig{})
+	defer shutdown()
+	for i := range 3 {
+		bulkSet(ch, fmt.Sprintf("k%d", i), i)
+	}
+	first := bulkCall(ch, KVRequest{Op: KVScan, Value: 1}).Cursor
+	ended := bulkCall(ch, KVRequest{Op: KVScan, Value: 1}).Cursor
+	if rep := bulkCall(ch, KVRequest{Op: KVScan, Cursor: ended, Value: -1}); !rep.Ok || rep.Cursor != 0 {
+		t.Fatalf("ending a scan: %+v", rep)
+	}
+	if rep := bulkCall(ch, KVRequest{Op: KVScan, Cursor: ended}); rep.Ok {
+		t.Error("scan went on after it was ended")
+	}
+	for range maxScans {
+		bulkCall(ch, KVRequest{Op: KVScan, Value: 1})
+	}
+	if rep := bulkCall(ch, KVRequest{Op: KVScan, Cursor: first}); rep.Ok {
+		t.Errorf("oldest scan still open after %d newer ones", maxScans)
+	}
+}
+
+// A key expires TTL after its last write, however often it is read, and is
+// reported expired; an owned one is kept, so that its owner's write finds it.
+func TestStoreExpiresKeysAfterTTL(t *testing.T) {
+	ws := NewWatchers()
+	events, stop := ws.Watch("", 8)
+	defer stop()
+	ch, shutdown := startStore(StoreConfig{TTL: 20 * time.Millisecond, SweepEvery: time.Hour, Watchers: ws})
+
+	bulkSet(ch, "k", 3)
+	<-events // updated
+	for range 3 {
+		time.Sleep(10 * time.Millisecond)
+		rep := bulkCall(ch, KVRequest{Op: KVRead, Key: "k"})
+		bulkCall(ch, KVRequest{Op: KVWrite, Key: "k", Value: rep.Value}) // a write renews it
+		<-events
+	}
+	if n := bulkCall(ch, KVRequest{Op: KVSweep}).Value; n != 0 {
+		t.Fatalf("swept %d keys written within their TTL", n)
+	}
+	bulkCall(ch, KVRequest{Op: KVRead, Key: "owned"})
+	time.Sleep(25 * time.Millisecond)
+	if n := bulkCall(ch, KVRequest{Op: KVSweep}).Value; n != 1 {
+		t.Fatalf("swept %d keys, want 1", n)
+	}
+	if ev := <-events; ev.Kind != KeyExpired || ev.Key != "k" || ev.Value != 3 {
+		t.Fatalf("event %+v, want k expired with 3", ev)
+	}
+	if rep := bulkCall(ch, KVRequest{Op: KVWrite, Key: "owned", Value: 1}); !rep.Ok {
+		t.Fatal("the owner's write of a key held past its TTL failed")
+	}
+	if st := shutdown(); st.Expired != 1 || st.Sweeps != 2 {
+		t.Fatalf("stats %+v, want two sweeps expiring one key", st)
+	}
+}
+
+// The sweep also runs by itself, on the store's tick.
+func TestStoreSweepsOnTick(t *testing.T) {
+	ch, shutdown := startStore(StoreConfig{TTL: time.Millisecond})
+	for _, k := range []string{"a", "b", "c"} {
+		bulkSet(ch, k, 1)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if st := shutdown(); st.Expired != 3 {
+		t.Fatalf("expired %d keys, want 3", st.Expired)
+	}
+}
+
+// An idle key is evicted and reported deleted; a key read since is kept, as is
+// an owned one, however long it has been owned.
+func TestStoreEvictsIdleKeys(t *testing.T) {
+	ws := NewWatchers()
+	events, stop := ws.Watch("", 8)
+	defer stop()
+	ch, shutdown := startStore(StoreConfig{IdleAfter: 20 * time.Millisecond, SweepEvery: time.Hour, Watchers: ws})
+
+	bulkSet(ch, "idle", 7)
+	bulkSet(ch, "busy", 1)
+	bulkCall(ch, KVRequest{Op: KVRead, Key: "owned"})
+	for range 2 {
+		<-events // the sets
+	}
+	time.Sleep(30 * time.Millisecond)
+	bulkCall(ch, KVRequest{Op: KVRead, Key: "busy"})
+	bulkCall(ch, KVRequest{Op: KVWrite, Key: "busy", Value: 1})
+	<-events
+	if n := bulkCall(ch, KVRequest{Op: KVSweep}).Value; n != 1 {
+		t.Fatalf("swept %d keys, want 1", n)
+	}
+	if ev := <-events; ev.Kind != KeyDeleted || ev.Key != "idle" || ev.Value != 7 {
+		t.Fatalf("event %+v, want idle deleted with 7", ev)
+	}
+	if rep := bulkCall(ch, KVRequest{Op: KVWrite, Key: "owned", Value: 1}); !rep.Ok {
+		t.Fatal("the owner's write of a key held past IdleAfter failed")
+	}
+	if rep := bulkCall(ch, KVRequest{Op: KVRead, Key: "idle"}); rep.Value != 0 {
+		t.Fatalf("read of an evicted key = %d, want it created again with 0", rep.Value)
+	}
+	if st := shutdown(); st.Evicted != 1 || st.Expired != 0 || st.Sweeps != 1 {
+		t.Fatalf("stats %+v, want one sweep evicting one key", st)
+	}
+}
+
+// A delete removes the key and hands it to a waiting reader, created again.
+func TestStoreDelete(t *testing.T) {
+	ws := NewWatchers()
+	events, stop := ws.Watch("", 8)
+	defer stop()
+	ch, shutdown := startStore(StoreConfig{Watchers: ws})
+
+	bulkSet(ch, "k", 5)
+	<-events                                      // updated
+	bulkCall(ch, KVRequest{Op: KVRead, Key: "k"}) // owned by us
+	waiter := make(chan KVReply, 1)
+	ch <- KVRequest{Op: KVRead, Key: "k", Reply: waiter}
+	if rep := bulkCall(ch, KVRequest{Op: KVDelete, Key: "k"}); !rep.Ok || rep.Value != 5 {
+		t.Fatalf("delete = %+v, want ok with the last value", rep)
+	}
+	if rep := <-waiter; !rep.Ok || rep.Value != 0 {
+		t.Fatalf("waiting read = %+v, want the key created again with 0", rep)
+	}
+	if ev := <-events; ev.Kind != KeyDeleted || ev.Key != "k" || ev.Value != 5 {
+		t.Fatalf("event %+v, want k deleted with 5", ev)
+	}
+	if rep := bulkCall(ch, KVRequest{Op: KVDelete, Key: "missing"}); rep.Ok {
+		t.Fatal("delete of a missing key succeeded")
+	}
+	if st := shutdown(); st.Deleted != 1 {
+		t.Fatalf("stats %+v, want one key deleted", st)
+	}
+}
+
+// Writes and imports are reported as updated to the watchers of their prefix
+// only, and a full watcher drops events rather than holding up the store.
+func TestStoreNotifiesUpdates(t *testing.T) {
+	ws := NewWatchers()
+	events, stop := ws.Watch("a/", 8)
+	defer stop()
+	full, stopFull := ws.Watch("", 1)
+	defer stopFull()
+	ch, shutdown := startStore(StoreConfig{Watchers: ws})
+	defer shutdown()
+
+	bulkSet(ch, "a/x", 1)
+	bulkSet(ch, "b/y", 2)
+	bulkCall(ch, KVRequest{Op: KVImport, Entries: []KVEntry{{"a/z", 3}, {"b/w", 4}}})
+	for _, want := range []KeyEvent{{Kind: KeyUpdated, Key: "a/x", Value: 1}, {Kind: KeyUpdated, Key: "a/z", Value: 3}} {
+		ev := <-events
+		if ev.Kind != want.Kind || ev.Key != want.Key || ev.Value != want.Value || ev.At.IsZero() {
+			t.Fatalf("event %+v, want %+v", ev, want)
+		}
+	}
+	if len(events) != 0 {
+		t.Errorf("%d more events for a/", len(events))
+	}
+	if len(full) != 1 || ws.Dropped() != 3 {
+		t.Errorf("full watcher holds %d events, %d dropped; want 1 and 3", len(full), ws.Dropped())
+	}
+}
@@ -0,0 +1,313 @@
+package kvcache
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----- Ownership timeline -----
+
+// A Timeline is who owned each key when, and who waited for it, as KVStore saw
+// it: a read of a free key starts an ownership span, a read of an owned key
+// starts a wait span, and the owner's write ends its span and hands the key to
+// the waiter, whose wait span ends and whose ownership span starts. KVRequest
+// carries no client, so the clients are told apart by the reply channels of
+// their requests; behind an L2Cache, the store only sees the L2.
+
+// TimelineSpan is an interval during which a client owned a key, or waited for it.
+type TimelineSpan struct {
+	Key     string
+	Client  string
+	Wait    bool          // waiting for the key, not owning it
+	Start   time.Duration // from the start of the run
+	End     time.Duration
+	Open    bool // not over when the run ended; End is the end of the run
+	Handoff bool // ownership passed on by the previous owner's write
+}
+
+// Timeline is the spans of a run, in the order they started.
+type Timeline struct {
+	Spans  []TimelineSpan
+	Length time.Duration
+}
+
+// Keys returns the keys of t, sorted.
+func (t Timeline) Keys() []string {
+	seen := make(map[string]bool)
+	var keys []string
+	for _, s := range t.Spans {
+		if !seen[s.Key] {
+			seen[s.Key] = true
+			keys = append(keys, s.Key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Clients returns the clients of t, in the order they first appear.
+func (t Timeline) Clients() []string {
+	seen := make(map[string]bool)
+	var clients []string
+	for _, s := range t.Spans {
+		if !seen[s.Client] {
+			seen[s.Client] = true
+			clients = append(clients, s.Client)
+		}
+	}
+	return clients
+}
+
+// timelineRecorder builds a Timeline from the requests on their way to KVStore.
+type timelineRecorder struct {
+	start   time.Time
+	unknown string   // the client of requests not sent through client
+	who     sync.Map // reply channel -> client name
+	tl      Timeline
+}
+
+func newTimelineRecorder(unknown string) *timelineRecorder {
+	return &timelineRecorder{start: time.Now(), unknown: unknown}
+}
+
+// client returns a channel for the requests of the named client, which reach
+// out. out is shared by the clients, so it is left open: close it once every
+// client's channel is closed and wg is done.
+func (r *timelineRecorder) client(name string, out chan<- KVRequest, wg *sync.WaitGroup) chan KVRequest {
+	in := make(chan KVRequest)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for req := range in {
+			r.who.Store(req.Reply, name)
+			out <- req
+		}
+	}()
+	return in
+}
+
+// record returns a channel whose requests reach the store on out, recording the
+// spans they start and end. Like countMessages, it must come after anything that
+// reorders requests (delayRequests), so that it sees them in the store's order.
+// It closes out once the returned channel is closed; the timeline is then complete.
+func (r *timelineRecorder) record(out chan<- KVRequest, wg *sync.WaitGroup) chan KVRequest {
+	in := make(chan KVRequest)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		exists := make(map[string]bool)
+		owner := make(map[string]int)     // key -> its open ownership span
+		waiting := make(map[string][]int) // key -> its open wait spans, first first
+		open := func(s TimelineSpan) int {
+			r.tl.Spans = append(r.tl.Spans, s)
+			return len(r.tl.Spans) - 1
+		}
+		for req := range in {
+			client := r.unknown
+			if name, ok := r.who.LoadAndDelete(req.Reply); ok {
+				client = name.(string)
+			}
+			out <- req
+			now := time.Since(r.start)
+			switch req.Op {
+			case KVRead:
+				exists[req.Key] = true
+				if _, ok := owner[req.Key]; ok {
+					waiting[req.Key] = append(waiting[req.Key], open(TimelineSpan{Key: req.Key, Client: client, Wait: true, Start: now}))
+				} else {
+					owner[req.Key] = open(TimelineSpan{Key: req.Key, Client: client, Start: now})
+				}
+			case KVWrite:
+				if !exists[req.Key] {
+					continue // fails in the store
+				}
+				if i, ok := owner[req.Key]; ok {
+					r.tl.Spans[i].End = now
+					delete(owner, req.Key)
+				}
+				if w := waiting[req.Key]; len(w) > 0 {
+					r.tl.Spans[w[0]].End = now
+					waiting[req.Key] = w[1:]
+					owner[req.Key] = open(TimelineSpan{Key: req.Key, Client: r.tl.Spans[w[0]].Client, Start: now, Handoff: true})
+				}
+			}
+		}
+		r.tl.Length = time.Since(r.start)
+		for i := range r.tl.Spans {
+			if s := &r.tl.Spans[i]; s.End == 0 {
+				s.End, s.Open = r.tl.Length, true
+			}
+		}
+		close(out)
+	}()
+	return in
+}
+
+// TimelineReport is the machine-readable form of a Timeline. Times are in
+// milliseconds.
+type TimelineReport struct {
+	LengthMs float64              `json:"lengthMs"`
+	Clients  []string             `json:"clients"`
+	Spans    []TimelineSpanReport `json:"spans"`
+}
+
+// TimelineSpanReport is the machine-readable form of a TimelineSpan.
+type TimelineSpanReport struct {
+	Key     string  `json:"key"`
+	Client  string  `json:"client"`
+	Kind    string  `json:"kind"` // own or wait
+	StartMs float64 `json:"startMs"`
+	EndMs   float64 `json:"endMs"`
+	Open    bool    `json:"open,omitempty"`
+	Handoff bool    `json:"handoff,omitempty"`
+}
+
+// Report returns t in machine-readable form.
+func (t Timeline) Report() TimelineReport {
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	rep := TimelineReport{LengthMs: ms(t.Length), Clients: t.Clients(), Spans: []TimelineSpanReport{}}
+	for _, s := range t.Spans {
+		kind := "own"
+		if s.Wait {
+			kind = "wait"
+		}
+		rep.Spans = append(rep.Spans, TimelineSpanReport{Key: s.Key, Client: s.Client, Kind: kind,
+			StartMs: ms(s.Start), EndMs: ms(s.End), Open: s.Open, Handoff: s.Handoff})
+	}
+	return rep
+}
+
+// timelineSymbols mark the clients in PrintTimeline: upper case for owning, lower
+// case for waiting.
+const timelineSymbols = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// PrintTimeline writes t to w as a chart width columns wide: a row per key
+// showing which client owned it during each column's interval, or '.' for none,
+// and below it, if anyone waited for the key, a row of who waited.
+func PrintTimeline(w io.Writer, t Timeline, width int) {
+	if width <= 0 {
+		width = 80
+	}
+	clients := t.Clients()
+	symbol := make(map[string]int)
+	for i, c := range clients {
+		symbol[c] = i % len(timelineSymbols)
+	}
+	keys := t.Keys()
+	keyWidth := len("waits")
+	for _, k := range keys {
+		keyWidth = max(keyWidth, len(k))
+	}
+	col := t.Length / time.Duration(width)
+	if col <= 0 {
+		col = 1
+	}
+	fmt.Fprintf(w, "%-*s |%s| %v, %v per column\n", keyWidth, "key", strings.Repeat("-", width), t.Length.Round(time.Microsecond), col)
+	for _, k := range keys {
+		own := []byte(strings.Repeat(".", width))
+		wait := []byte(strings.Repeat(" ", width))
+		waited := false
+		for _, s := range t.Spans {
+			if s.Key != k {
+				continue
+			}
+			// a span marks every column it overlaps, so short ones still show
+			first := min(int(s.Start/col), width-1)
+			last := min(int((s.End-1)/col), width-1)
+			for c := first; c <= max(first, last); c++ {
+				if s.Wait {
+					wait[c] = strings.ToLower(timelineSymbols)[symbol[s.Client]]
+					waited = true
+				} else {
+					own[c] = timelineSymbols[symbol[s.Client]]
+				}
+			}
+		}
+		fmt.Fprintf(w, "%-*s |%s|\n", keyWidth, k, own)
+		if waited {
+			fmt.Fprintf(w, "%-*s |%s|\n", keyWidth, "waits", wait)
+		}
+	}
+	var legend []string
+	for _, c := range clients {
+		legend = append(legend, fmt.Sprintf("%c=%s", timelineSymbols[symbol[c]], c))
+	}
+	fmt.Fprintf(w, "owners: %s (lower case: waiting)\n", strings.Join(legend, " "))
+}
+
+// timelineColors are the fills of the clients' bars in WriteTimelineSVG.
+var timelineColors = []string{"#4e79a7", "#f28e2b", "#59a14f", "#e15759", "#76b7b2", "#edc948", "#b07aa1", "#ff9da7", "#9c755f", "#bab0ac"}
+
+// WriteTimelineSVG writes t to w as an SVG Gantt chart: a row per key, with a bar
+// for each span of ownership in the color of its client, and a thin bar beneath
+// it for each wait. Hovering over a bar shows its client and times.
+func WriteTimelineSVG(w io.Writer, t Timeline) error {
+	const (
+		labelW = 120
+		plotW  = 800
+		rowH   = 28
+		barH   = 16
+		waitH  = 5
+		top    = 30
+	)
+	keys := t.Keys()
+	clients := t.Clients()
+	color := make(map[string]string)
+	for i, c := range clients {
+		color[c] = timelineColors[i%len(timelineColors)]
+	}
+	row := make(map[string]int)
+	for i, k := range keys {
+		row[k] = i
+	}
+	length := max(t.Length, 1)
+	x := func(d time.Duration) float64 { return labelW + plotW*float64(d)/float64(length) }
+	height := top + rowH*len(keys) + 40
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="sans-serif" font-size="12">`+"\n", labelW+plotW+20, height)
+	fmt.Fprintf(&b, `<text x="%d" y="18">key ownership over %v</text>`+"\n", labelW, t.Length.Round(time.Microsecond))
+	for i, k := range keys {
+		y := top + rowH*i
+		fmt.Fprintf(&b, `<text x="4" y="%d">%s</text>`+"\n", y+barH-3, html.EscapeString(k))
+		fmt.Fprintf(&b, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#ddd"/>`+"\n", labelW, y+rowH-2, labelW+plotW, y+rowH-2)
+	}
+	for _, s := range t.Spans {
+		y := top + rowH*row[s.Key]
+		h := barH
+		opacity := "1"
+		if s.Wait {
+			y += barH + 2
+			h = waitH
+			opacity = "0.5"
+		}
+		what := "owned"
+		if s.Wait {
+			what = "waited"
+		} else if s.Handoff {
+			what = "owned (handed off)"
+		}
+		fmt.Fprintf(&b, `<rect x="%.2f" y="%d" width="%.2f" height="%d" fill="%s" fill-opacity="%s"><title>%s %s %s %v-%v</title></rect>`+"\n",
+			x(s.Start), y, max(x(s.End)-x(s.Start), 0.5), h, color[s.Client], opacity,
+			html.EscapeString(s.Client), what, html.EscapeString(s.Key), s.Start.Round(time.Microsecond), s.End.Round(time.Microsecond))
+	}
+	axis := top + rowH*len(keys) + 4
+	for i := 0; i <= 4; i++ {
+		d := length * time.Duration(i) / 4
+		fmt.Fprintf(&b, `<text x="%.0f" y="%d" text-anchor="middle">%v</text>`+"\n", x(d), axis+12, d.Round(time.Microsecond))
+	}
+	lx := labelW
+	for _, c := range clients {
+		fmt.Fprintf(&b, `<rect x="%d" y="%d" width="10" height="10" fill="%s"/><text x="%d" y="%d">%s</text>`+"\n",
+			lx, axis+20, color[c], lx+14, axis+29, html.EscapeString(c))
+		lx += 20 + 7*len(c)
+	}
+	b.WriteString("</svg>\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
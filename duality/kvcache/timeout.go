@@ -0,0 +1,193 @@
+package kvcache
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ----- Client with timeouts -----
+
+// TimeoutClient is a KVClient that gives up on the store after a timeout. A get
+// or put the store has not answered in time is answered with ErrActionTimeout,
+// or, for a get with ServeStale, with the last value the client saw for the key,
+// marked ErrServedStale: Ok, but not owned, so a put of it fails.
+//
+// The request it gave up on is still on its way, so its reply channel has room
+// for the late reply, which KVStore would otherwise block on. A late grant makes
+// the client the owner of a key its caller was told it did not get; it writes
+// the key back unchanged, releasing it. Until then, a get of the key times out at
+// once: KVStore keeps one waiter per key, and a second read would replace the
+// first. A late write lands as if it were on time.
+
+// ErrActionTimeout is the error of an action the store did not answer in time.
+var ErrActionTimeout = errors.New("kv action timed out")
+
+// ErrServedStale marks a get answered, after a timeout, with a value the client
+// saw before. The reply is Ok, but the client does not own the key.
+var ErrServedStale = errors.New("kv read timed out; served a stale value")
+
+// TimedOut reports whether r is the reply to an action that timed out,
+// including one served stale.
+func TimedOut(r ClientReply) bool {
+	return r.Err == ErrActionTimeout.Error() || r.Err == ErrServedStale.Error()
+}
+
+// ServedStale reports whether r is a stale value served after a timeout.
+func ServedStale(r ClientReply) bool {
+	return r.Err == ErrServedStale.Error()
+}
+
+// TimeoutConfig configures a TimeoutClient.
+type TimeoutConfig struct {
+	Timeout    time.Duration // how long to wait for the store, sending and replying; 0 is forever
+	ServeStale bool          // answer a get that timed out with the last value seen, if any
+}
+
+// TimeoutStats counts what a TimeoutClient gave up on. Read them once the client
+// has exited.
+type TimeoutStats struct {
+	GetTimeouts int `json:"getTimeouts"`
+	PutTimeouts int `json:"putTimeouts"`
+	StaleServes int `json:"staleServes"` // of the get timeouts, the ones served stale
+	Released    int `json:"released"`    // keys granted after their get timed out, written back
+}
+
+// Add adds the counts of o to s.
+func (s *TimeoutStats) Add(o TimeoutStats) {
+	s.GetTimeouts += o.GetTimeouts
+	s.PutTimeouts += o.PutTimeouts
+	s.StaleServes += o.StaleServes
+	s.Released += o.Released
+}
+
+// TimeoutClient runs as a client goroutine like KVClient, with the timeouts of
+// cfg, counting into stats (which may be nil). It exits once actionsCh is closed
+// and every key granted late has been written back.
+func TimeoutClient(name string, actionsCh <-chan ClientAction, kvReqCh chan<- KVRequest, wg *sync.WaitGroup, cfg TimeoutConfig, stats *TimeoutStats) {
+	defer wg.Done()
+	if stats == nil {
+		stats = &TimeoutStats{}
+	}
+	cache := make(map[string]int)    // keys owned
+	seen := make(map[string]int)     // the last value seen for each key, owned or not
+	var late sync.WaitGroup          // writes still to send, and keys granted late
+	var mu sync.Mutex                // for pending and stats.Released, shared with those
+	pending := make(map[string]bool) // keys of reads given up on and not yet released
+
+	// call sends req and waits for the reply, up to the timeout. On a timeout, it
+	// returns false, and a write not yet sent is sent anyway, since it releases
+	// the key; a read sent in time is released once it is granted.
+	call := func(req KVRequest) (KVReply, bool) {
+		req.Reply = make(chan KVReply, 1)
+		req.Client = name
+		var expired <-chan time.Time
+		if cfg.Timeout > 0 {
+			timer := time.NewTimer(cfg.Timeout)
+			defer timer.Stop()
+			expired = timer.C
+		}
+		select {
+		case kvReqCh <- req:
+		case <-expired:
+			if req.Op == KVWrite {
+				late.Add(1)
+				go func() {
+					defer late.Done()
+					kvReqCh <- req
+					<-req.Reply
+				}()
+			}
+			return KVReply{}, false
+		}
+		select {
+		case resp := <-req.Reply:
+			return resp, true
+		case <-expired:
+		}
+		if req.Op == KVRead {
+			mu.Lock()
+			pending[req.Key] = true
+			mu.Unlock()
+			late.Add(1)
+			go func() {
+				defer late.Done()
+				resp := <-req.Reply
+				released := false
+				if resp.Ok {
+					wb := KVRequest{Op: KVWrite, Key: req.Key, Value: resp.Value, Reply: make(chan KVReply, 1), Client: name}
+					kvReqCh <- wb
+					<-wb.Reply
+					released = true
+				}
+				mu.Lock()
+				delete(pending, req.Key)
+				if released {
+					stats.Released++
+				}
+				mu.Unlock()
+			}()
+		}
+		return KVReply{}, false
+	}
+
+	for act := range actionsCh {
+		switch act.Type {
+		case ClientGet:
+			if v, ok := cache[act.Key]; ok {
+				act.Reply <- ClientReply{Value: v, Hit: true, Ok: true}
+				continue
+			}
+			mu.Lock()
+			waiting := pending[act.Key]
+			mu.Unlock()
+			resp, ok := KVReply{}, false
+			if !waiting {
+				resp, ok = call(KVRequest{Op: KVRead, Key: act.Key})
+			}
+			switch {
+			case !ok:
+				stats.GetTimeouts++
+				if v, known := seen[act.Key]; known && cfg.ServeStale {
+					stats.StaleServes++
+					act.Reply <- ClientReply{Value: v, Ok: true, Err: ErrServedStale.Error()}
+				} else {
+					act.Reply <- ClientReply{Ok: false, Err: ErrActionTimeout.Error()}
+				}
+			case resp.Ok:
+				cache[act.Key] = resp.Value
+				seen[act.Key] = resp.Value
+				act.Reply <- ClientReply{Value: resp.Value, Ok: true}
+			case resp.Err != "":
+				act.Reply <- ClientReply{Ok: false, Err: resp.Err}
+			default:
+				act.Reply <- ClientReply{Ok: false, Err: "kv read failed"}
+			}
+
+		case ClientPut:
+			if _, ok := cache[act.Key]; !ok {
+				act.Reply <- ClientReply{Ok: false, Err: "key not in local cache"}
+				continue
+			}
+			// the write gives up ownership whether or not its reply comes in time
+			delete(cache, act.Key)
+			seen[act.Key] = act.Value
+			resp, ok := call(KVRequest{Op: KVWrite, Key: act.Key, Value: act.Value})
+			switch {
+			case !ok:
+				stats.PutTimeouts++
+				act.Reply <- ClientReply{Ok: false, Err: ErrActionTimeout.Error()}
+			case resp.Ok:
+				act.Reply <- ClientReply{Hit: true, Ok: true}
+			case resp.Err != "":
+				act.Reply <- ClientReply{Ok: false, Err: resp.Err}
+			default:
+				act.Reply <- ClientReply{Ok: false, Err: "kv write failed (key missing in store)"}
+			}
+
+		default:
+			act.Reply <- ClientReply{Ok: false, Err: "unknown action"}
+		}
+	}
+	late.Wait()
+}
@@ -0,0 +1,67 @@
+package kvcache
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// A get of a key someone else owns times out; the key, granted late, is written
+// back unchanged; and with ServeStale, a later timeout serves the value last seen,
+// which may not be put.
+func TestTimeoutClient(t *testing.T) {
+	store := make(chan KVRequest)
+	var storeWg sync.WaitGroup
+	storeWg.Add(1)
+	go KVStore(store, &storeWg)
+	defer func() {
+		close(store)
+		storeWg.Wait()
+	}()
+	actCh := make(chan ClientAction)
+	var wg sync.WaitGroup
+	var stats TimeoutStats
+	wg.Add(1)
+	go TimeoutClient("c", actCh, store, &wg, TimeoutConfig{Timeout: 20 * time.Millisecond, ServeStale: true}, &stats)
+	do := func(typ ClientActionType, key string, value int) ClientReply {
+		act := ClientAction{Type: typ, Key: key, Value: value, Reply: make(chan ClientReply)}
+		actCh <- act
+		return <-act.Reply
+	}
+
+	kvCall(store, KVRequest{Op: KVRead, Key: "k"}) // owned elsewhere
+	if rep := do(ClientGet, "k", 0); rep.Ok || !TimedOut(rep) || ServedStale(rep) {
+		t.Fatalf("get of an owned key = %+v, want a timeout", rep)
+	}
+	kvCall(store, KVRequest{Op: KVWrite, Key: "k", Value: 7}) // granted to the late read
+	var rep ClientReply
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		// a get times out at once until the late grant is written back
+		if rep = do(ClientGet, "k", 0); rep.Ok || time.Now().After(deadline) {
+			break
+		}
+	}
+	if !rep.Ok || rep.Value != 7 {
+		t.Fatalf("get after the release = %+v, want 7", rep)
+	}
+	if rep := do(ClientPut, "k", 8); !rep.Ok {
+		t.Fatalf("put = %+v", rep)
+	}
+
+	kvCall(store, KVRequest{Op: KVRead, Key: "k"}) // owned elsewhere again
+	if rep := do(ClientGet, "k", 0); !rep.Ok || !ServedStale(rep) || rep.Value != 8 {
+		t.Fatalf("get of an owned key = %+v, want 8 served stale", rep)
+	}
+	if rep := do(ClientPut, "k", 9); rep.Ok {
+		t.Error("put of a value served stale succeeded")
+	}
+	kvCall(store, KVRequest{Op: KVWrite, Key: "k", Value: 8})
+	close(actCh)
+	wg.Wait()
+	if stats.Released != 2 || stats.StaleServes != 1 || stats.GetTimeouts < 2 || stats.PutTimeouts != 0 {
+		t.Errorf("stats %+v", stats)
+	}
+	if rep := kvCall(store, KVRequest{Op: KVRead, Key: "k"}); rep.Value != 8 {
+		t.Errorf("store has %d, want 8", rep.Value)
+	}
+}
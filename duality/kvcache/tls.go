@@ -0,0 +1,88 @@
+package kvcache
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+)
+
+// ----- TLS -----
+
+// The network front end runs over TLS when the server has a certificate: set
+// NetConfig.TLS to ServerTLS(...), and dial with DialConfig.TLS from ClientTLS.
+// Given a CA, the server also requires each client to present a certificate it
+// signed (mutual TLS). A server with no Tokens then takes the common name of the
+// client's certificate as its identity, which the store's ACL is checked
+// against.
+
+// ServerTLS returns the TLS configuration of a server with the certificate and
+// key in the PEM files certFile and keyFile. If clientCA is not empty, clients
+// must present a certificate signed by a CA in that PEM file.
+func ServerTLS(certFile, keyFile, clientCA string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if clientCA != "" {
+		pool, err := loadCAPool(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// ClientTLS returns the TLS configuration of a client: it trusts the CAs in the
+// PEM file ca, or the system's if ca is empty, and presents the certificate and
+// key in certFile and keyFile, if given, to a server that asks for one.
+func ClientTLS(ca, certFile, keyFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if ca != "" {
+		pool, err := loadCAPool(ca)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+func loadCAPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no PEM certificates", path)
+	}
+	return pool, nil
+}
+
+// peerName returns the common name of the certificate the client on c
+// presented, if c is a TLS connection and it presented one.
+func peerName(c net.Conn) string {
+	tc, ok := c.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	if tc.Handshake() != nil {
+		return ""
+	}
+	if certs := tc.ConnectionState().PeerCertificates; len(certs) > 0 {
+		return certs[0].Subject.CommonName
+	}
+	return ""
+}
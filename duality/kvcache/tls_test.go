@@ -0,0 +1,111 @@
+package kvcache
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// selfSigned returns a certificate for 127.0.0.1 named name that is its own CA.
+func selfSigned(t *testing.T, name string) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+// Under mutual TLS with no tokens, a client is who its certificate names, and
+// the store's ACL is checked against that; a client without a trusted
+// certificate, or that does not trust the server's, gets nowhere.
+func TestNetMutualTLS(t *testing.T) {
+	serverCert, serverPool := selfSigned(t, "kv server")
+	clientCert, clientPool := selfSigned(t, "alice")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kvReqCh := make(chan KVRequest)
+	var storeWG sync.WaitGroup
+	storeWG.Add(1)
+	acl := NewACL(ACLRule{Client: "alice", Prefix: "*", Ops: []ClientActionType{ClientGet}})
+	go KVStoreWith(kvReqCh, &storeWG, StoreConfig{ACL: acl}, nil)
+	served := make(chan error, 1)
+	go func() {
+		served <- ServeKV(ln, kvReqCh, NetConfig{TLS: &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientCAs:    clientPool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		}})
+	}()
+	defer func() {
+		ln.Close()
+		if err := <-served; err != nil {
+			t.Error(err)
+		}
+		close(kvReqCh)
+		storeWG.Wait()
+	}()
+	addr := ln.Addr().String()
+
+	conn, err := DialKV(addr, DialConfig{TLS: &tls.Config{RootCAs: serverPool, Certificates: []tls.Certificate{clientCert}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.Client() != "alice" {
+		t.Fatalf("identity %q, want alice from the certificate", conn.Client())
+	}
+	reqCh := make(chan KVRequest)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go conn.Forward(reqCh, &wg)
+	reply := make(chan KVReply)
+	reqCh <- KVRequest{Op: KVRead, Key: "k", Reply: reply}
+	if r := <-reply; !r.Ok {
+		t.Fatalf("alice's read: %+v", r)
+	}
+	reqCh <- KVRequest{Op: KVWrite, Key: "k", Value: 1, Reply: reply}
+	if r := <-reply; r.Err != ErrForbidden.Error() {
+		t.Fatalf("alice's write: %+v, want forbidden", r)
+	}
+	close(reqCh)
+	wg.Wait()
+	conn.Close()
+
+	if _, err := DialKV(addr, DialConfig{TLS: &tls.Config{RootCAs: serverPool}}); err == nil {
+		t.Error("a client without a certificate was let in")
+	}
+	if _, err := DialKV(addr, DialConfig{TLS: &tls.Config{RootCAs: x509.NewCertPool(), Certificates: []tls.Certificate{clientCert}}}); err == nil {
+		t.Error("connected to a server with an untrusted certificate")
+	}
+}
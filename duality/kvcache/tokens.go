@@ -0,0 +1,255 @@
+package kvcache
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ----- Token authentication -----
+
+// Tokens is the table of clients a KV network server lets in: each has a name,
+// its identity, and a secret token. A client presents its token in the first
+// message on a connection; the server answers with the identity it belongs to
+// and names that identity as the Client of every request the connection makes,
+// so StoreConfig.ACL applies to it, or answers ErrUnauthorized and closes the
+// connection. Requests are counted per identity (see Stats).
+//
+// The table can change while the server runs: Revoke drops a client, closing its
+// open connections, and Reload rereads the table from its file, revoking every
+// client whose token was removed or changed.
+type Tokens struct {
+	mu      sync.Mutex
+	tokens  map[string]string // identity -> token
+	live    map[string]map[*tokenSession]bool
+	stats   map[string]*AuthStats
+	refused int
+}
+
+// ErrUnauthorized is the answer to a connection whose token is not in the table.
+var ErrUnauthorized = errors.New("unauthorized: unknown or missing token")
+
+// AuthStats counts the traffic of one identity.
+type AuthStats struct {
+	Client   string `json:"client"`
+	Conns    int    `json:"conns"`    // connections accepted
+	Open     int    `json:"open"`     // of those, still open
+	Requests int    `json:"requests"` // requests served
+	Denied   int    `json:"denied"`   // of those, refused by the store's ACL
+	Revoked  int    `json:"revoked"`  // connections closed by a revocation
+}
+
+// tokenSession is one authenticated connection.
+type tokenSession struct {
+	client string
+	conn   net.Conn
+}
+
+// NewTokens returns a table of the given tokens, by identity.
+func NewTokens(tokens map[string]string) *Tokens {
+	t := &Tokens{
+		tokens: make(map[string]string),
+		live:   make(map[string]map[*tokenSession]bool),
+		stats:  make(map[string]*AuthStats),
+	}
+	for name, tok := range tokens {
+		t.tokens[name] = tok
+	}
+	return t
+}
+
+// LoadTokens reads a table of tokens from a file (see ParseTokens).
+func LoadTokens(path string) (*Tokens, error) {
+	tokens, err := readTokensFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewTokens(tokens), nil
+}
+
+func readTokensFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseTokens(f)
+}
+
+// ParseTokens reads tokens, a client per line: its identity and its token, with #
+// starting a comment:
+//
+//	client1  3f9c2e...   # the identity client1- keys are granted to
+//	client2  81d0aa...
+func ParseTokens(r io.Reader) (map[string]string, error) {
+	tokens := make(map[string]string)
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		if len(f) != 2 {
+			return nil, fmt.Errorf("line %d: want <client> <token>", n)
+		}
+		if _, dup := tokens[f[0]]; dup {
+			return nil, fmt.Errorf("line %d: client %q listed twice", n, f[0])
+		}
+		tokens[f[0]] = f[1]
+	}
+	return tokens, sc.Err()
+}
+
+// identify returns the identity whose token is tok. It compares against every
+// token in constant time, so that timing does not tell how much of a guess matched.
+func (t *Tokens) identify(tok string) (string, bool) {
+	found := ""
+	for name, want := range t.tokens {
+		if subtle.ConstantTimeCompare([]byte(tok), []byte(want)) == 1 {
+			found = name
+		}
+	}
+	return found, found != ""
+}
+
+// accept authenticates conn by the token it presented and returns its session.
+// A nil *Tokens lets everyone in, with no identity.
+func (t *Tokens) accept(conn net.Conn, tok string) (*tokenSession, error) {
+	if t == nil {
+		return &tokenSession{conn: conn}, nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	name, ok := t.identify(tok)
+	if !ok {
+		t.refused++
+		return nil, ErrUnauthorized
+	}
+	s := &tokenSession{client: name, conn: conn}
+	if t.live[name] == nil {
+		t.live[name] = make(map[*tokenSession]bool)
+	}
+	t.live[name][s] = true
+	st := t.statsLocked(name)
+	st.Conns++
+	st.Open++
+	return s, nil
+}
+
+func (t *Tokens) statsLocked(name string) *AuthStats {
+	st := t.stats[name]
+	if st == nil {
+		st = &AuthStats{Client: name}
+		t.stats[name] = st
+	}
+	return st
+}
+
+// leave forgets s once its connection is finished with.
+func (t *Tokens) leave(s *tokenSession) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.live[s.client][s] {
+		delete(t.live[s.client], s)
+		t.stats[s.client].Open--
+	}
+}
+
+// count counts a request of s the store answered with r.
+func (t *Tokens) count(s *tokenSession, r KVReply) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	st := t.statsLocked(s.client)
+	st.Requests++
+	if r.Err == ErrForbidden.Error() {
+		st.Denied++
+	}
+	t.mu.Unlock()
+}
+
+// Revoke removes client from the table and closes its open connections, which
+// give back the keys they own. It returns the number closed.
+func (t *Tokens) Revoke(client string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.revokeLocked(client)
+}
+
+func (t *Tokens) revokeLocked(client string) int {
+	delete(t.tokens, client)
+	n := 0
+	for s := range t.live[client] {
+		s.conn.Close()
+		delete(t.live[client], s)
+		n++
+	}
+	if n > 0 {
+		st := t.stats[client]
+		st.Open -= n
+		st.Revoked += n
+	}
+	return n
+}
+
+// Reload replaces the table with the one in the file at path, revoking the
+// clients whose token was removed or changed, which it returns. On an error the
+// table is left as it was.
+func (t *Tokens) Reload(path string) ([]string, error) {
+	tokens, err := readTokensFile(path)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var revoked []string
+	for name, tok := range t.tokens {
+		if tokens[name] != tok {
+			t.revokeLocked(name)
+			revoked = append(revoked, name)
+		}
+	}
+	t.tokens = tokens
+	sort.Strings(revoked)
+	return revoked, nil
+}
+
+// Stats returns the counts of each identity that has connected, by name.
+func (t *Tokens) Stats() []AuthStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]AuthStats, 0, len(t.stats))
+	for _, st := range t.stats {
+		out = append(out, *st)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Client < out[j].Client })
+	return out
+}
+
+// Refused returns the number of connections turned away for a bad token.
+func (t *Tokens) Refused() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.refused
+}
+
+// PrintAuthStats writes the per-client counts of t, one line each.
+func PrintAuthStats(w io.Writer, t *Tokens) {
+	for _, st := range t.Stats() {
+		fmt.Fprintf(w, "  %-16s conns=%d open=%d requests=%d denied=%d revoked=%d\n",
+			st.Client, st.Conns, st.Open, st.Requests, st.Denied, st.Revoked)
+	}
+	fmt.Fprintf(w, "  refused connections: %d\n", t.Refused())
+}
@@ -0,0 +1,110 @@
+package kvcache
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----- Key watchers -----
+
+// Watchers passes events about keys to whoever watches them, so that a cache can
+// tell why a key it holds went out of date. The kinds are:
+//
+//	updated  a write to the key reached KVStore, or a KVImport set it
+//	expired  the key's value outlived its time: the store removed the key, its
+//	         StoreConfig.TTL after its last write, or an L2Cache gave its copy
+//	         back to the store, idle for its HoldFor (the key stays in the store)
+//	deleted  the store removed the key, by a KVDelete, or as idle for its
+//	         StoreConfig.IdleAfter
+//
+// A cache holding the key drops it on any of them; only an updated event carries
+// a value to refresh it with.
+
+// KeyEventKind is why a key changed.
+type KeyEventKind string
+
+const (
+	KeyUpdated KeyEventKind = "updated"
+	KeyExpired KeyEventKind = "expired"
+	KeyDeleted KeyEventKind = "deleted"
+)
+
+// KeyEvent is a change to a key.
+type KeyEvent struct {
+	Kind  KeyEventKind
+	Key   string
+	Value int // the new value, for updated; the last one, for expired and deleted
+	At    time.Time
+}
+
+// watcher is one Watch.
+type watcher struct {
+	prefix string
+	ch     chan KeyEvent
+}
+
+// Watchers is a set of watchers of keys. Its zero value is not usable; see
+// NewWatchers. A nil *Watchers drops every event.
+type Watchers struct {
+	mu      sync.Mutex
+	next    int
+	subs    map[int]*watcher
+	dropped int
+}
+
+// NewWatchers returns an empty set of watchers.
+func NewWatchers() *Watchers {
+	return &Watchers{subs: make(map[int]*watcher)}
+}
+
+// Watch returns a channel of the events of the keys starting with prefix ("" for
+// every key), holding up to buffer events, and a function that stops the watch
+// and closes the channel. Notify never waits for a watcher: an event that finds
+// the channel full is dropped, and counted (see Dropped).
+func (w *Watchers) Watch(prefix string, buffer int) (<-chan KeyEvent, func()) {
+	ch := make(chan KeyEvent, max(buffer, 0))
+	w.mu.Lock()
+	id := w.next
+	w.next++
+	w.subs[id] = &watcher{prefix: prefix, ch: ch}
+	w.mu.Unlock()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			w.mu.Lock()
+			delete(w.subs, id)
+			w.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// Notify passes ev to the watchers of its key; At is set if zero.
+func (w *Watchers) Notify(ev KeyEvent) {
+	if w == nil {
+		return
+	}
+	if ev.At.IsZero() {
+		ev.At = time.Now()
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, s := range w.subs {
+		if !strings.HasPrefix(ev.Key, s.prefix) {
+			continue
+		}
+		select {
+		case s.ch <- ev:
+		default:
+			w.dropped++
+		}
+	}
+}
+
+// Dropped returns how many events were dropped for watchers that were full.
+func (w *Watchers) Dropped() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.dropped
+}
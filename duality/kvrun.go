@@ -1,10 +1,18 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	. "courses.cs.duke.edu/go/kvcache"
@@ -13,28 +21,148 @@ import (
 // ----- Example usage (main) -----
 
 func main() {
+	dispatch(commands(), os.Args[1:])
+}
+
+// ----- Subcommands -----
 
+// The subcommands of kvrun are one table, which both picks the subcommand to run
+// and writes the usage message. serveload.go, in the server module, has the same
+// table for its own. They cannot be one program: the server and duality modules
+// are handed out on their own and are both named courses.cs.duke.edu/go, so no
+// main package can import goose and kvcache at once.
+
+// command is a subcommand: its name, the arguments shown for it in the usage
+// message, one line each, and what runs it.
+type command struct {
+	name  string
+	usage []string
+	run   func(args []string)
+}
+
+// commands returns the subcommands of kvrun, the default first.
+func commands() []command {
+	return []command{
+		{"demo", []string{
+			"[-format json] <val1> <val2>",
+			"[-format json] -config <file.json> [<val1> <val2>]",
+		}, runDemo},
+		{"bench", []string{"[-clients N] [-ops N] [-keys N] [-shared] [-readahead K] [-latency d] [-l2] [-messages] [-sched fifo|rr|fair] [-inbox N] [-backpressure] [-timeout d [-servestale]] [-watch] [-ttl d] [-idle d] [-mirror target] [-revalidate N] [-acl file] [-keyprefix s] [-intern] [-audit file [-auditsize N] [-auditage d] [-auditkeep N]] [-format json]"}, runBench},
+		{"coherence", []string{"[-protocols own,msi,mesi,update,reval] [-revalidate N] [-clients N] [-ops N] [-keys N] [-shared] [-reads F] [-format json]"}, runCoherence},
+		{"timeline", []string{"[-clients N] [-ops N] [-keys N] [-shared=false] [-latency d] [-l2] [-width N] [-svg file] [-format json]"}, runTimeline},
+		{"bulk", []string{"-in <file.csv|file.json> [-out <file.csv|file.json>] [-format csv|json]"}, runBulk},
+		{"blob", []string{"-in <file> [-out <file>] [-chunk N] [-window N]"}, runBlob},
+		{"audit", []string{"-log <file> -key <key> [-n N] [-format json]"}, runAudit},
+		{"derived", []string{"[-keys N] [-writers N] [-reads N] [-latency d] [-format json]"}, runDerived},
+		{"regress", []string{"[-golden file] [-format json]"}, runRegress},
+		{"serve", []string{"[-addr host:port] [-tokens file] [-acl file] [-audit file] [-tlscert pem -tlskey pem [-tlsca pem]]"}, runServe},
+		{"connect", []string{"[-addr host:port] [-token T] [-tls] [-tlsca pem] [-tlscert pem -tlskey pem] < actions"}, runConnect},
+	}
+}
+
+// dispatch runs the command of cmds that args[0] names on the rest of args, or
+// else the default, the first of cmds, on all of args. "help [command]" runs the
+// command, the default if none, with -h.
+func dispatch(cmds []command, args []string) {
+	if len(args) > 0 && args[0] == "help" {
+		name := cmds[0].name
+		if len(args) > 1 {
+			name = args[1]
+		}
+		args = []string{name, "-h"}
+	}
+	if len(args) > 0 {
+		for _, c := range cmds {
+			if c.name == args[0] {
+				c.run(args[1:])
+				return
+			}
+		}
+	}
+	cmds[0].run(args)
+}
+
+// printUsage prints the usage lines of cmds, the default's name in brackets.
+func printUsage(cmds []command) {
+	prefix := "Usage:"
+	for i, c := range cmds {
+		name := c.name
+		if i == 0 {
+			name = "[" + name + "]"
+		}
+		for _, u := range c.usage {
+			fmt.Printf("%s go run kvrun.go %s %s\n", prefix, name, u)
+			prefix = "      "
+		}
+	}
+	fmt.Printf("%s go run kvrun.go help [command]\n", prefix)
+}
+
+// runDemo runs the demo subcommand, the default: two clients share the keys of a
+// KVStore, with the values val1 and val2.
+func runDemo(args []string) {
 	// --- NEW: Read Values from Command Line Arguments ---
-	if len(os.Args) < 3 {
-		fmt.Println("Usage: go run kvrun.go <val1> <val2>")
+	configPath := flag.String("config", "", "read val1 and val2 from this JSON file, e.g. {\"val1\": 42, \"val2\": 7}")
+	jsonOut := formatFlags(flag.CommandLine)
+	flag.Usage = usage
+	flag.CommandLine.Parse(args)
+	args = flag.Args()
+
+	// Values from the config file, if any; arguments on the command line override them.
+	var cfg struct {
+		Val1 *int `json:"val1"`
+		Val2 *int `json:"val2"`
+	}
+	if *configPath != "" {
+		data, err := os.ReadFile(*configPath)
+		if err == nil {
+			err = json.Unmarshal(data, &cfg)
+		}
+		if err != nil {
+			fmt.Printf("Error reading config: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if len(args) < 2 && (cfg.Val1 == nil || cfg.Val2 == nil) {
+		usage()
 		os.Exit(1)
 	}
 
 	// Parse first argument as integer (val1)
-	val1, err := strconv.Atoi(os.Args[1])
+	val1, err := argOr(args, 0, cfg.Val1)
 	if err != nil {
 		fmt.Printf("Error parsing val1: %v\n", err)
 		os.Exit(1)
 	}
 
 	// Parse second argument as integer (val2)
-	val2, err := strconv.Atoi(os.Args[2])
+	val2, err := argOr(args, 1, cfg.Val2)
 	if err != nil {
 		fmt.Printf("Error parsing val2: %v\n", err)
 		os.Exit(1)
 	}
 	// ----------------------------------------------------
 
+	// An interrupt, as when the demo hangs, shows where every goroutine started
+	// since the snapshot below is stuck, rather than just killing the demo.
+	stop := interrupts()
+	snapCh := make(chan LeakSnapshot, 1)
+	go func() {
+		<-stop
+		snap := <-snapCh
+		out := os.Stdout
+		if *jsonOut {
+			out = os.Stderr // stdout is for the JSON document, which there will not be
+		}
+		fmt.Fprintln(out, "=== Demo interrupted ===")
+		PrintLeaks(out, snap.Leaks(0))
+		os.Exit(130)
+	}()
+
+	// Any goroutine started from here on should be gone by the end of the demo.
+	snap := TakeLeakSnapshot()
+	snapCh <- snap
+
 	// Channel to send requests to KV store.
 	kvReqCh := make(chan KVRequest)
 
@@ -65,41 +193,53 @@ func main() {
 		clientCh <- act
 	}
 
+	// Each step of the demo is printed as it happens, or kept for the JSON document.
+	var steps []demoStep
+	say := func(s demoStep) {
+		if *jsonOut {
+			steps = append(steps, s)
+		} else {
+			fmt.Println(s)
+		}
+	}
+
 	// Demonstration trace:
 
-	fmt.Println("=== Demo start ===")
+	if !*jsonOut {
+		fmt.Println("=== Demo start ===")
+	}
 
 	// client1: get "alpha" (not in cache, will cause store to create alpha=0 and return 0)
 	resp := do(client1Ch, ClientAction{Type: ClientGet, Key: "alpha"})
-	fmt.Printf("[client1] get alpha -> value=%d ok=%v err=%q\n", resp.Value, resp.Ok, resp.Err)
+	say(demoStep{Client: "client1", Op: "get", Key: "alpha", Value: resp.Value, Ok: resp.Ok, Err: resp.Err})
 
 	// client1: put "alpha" -> val1 (read from CLI args)
 	resp = do(client1Ch, ClientAction{Type: ClientPut, Key: "alpha", Value: val1})
-	fmt.Printf("[client1] put alpha=%d -> ok=%v err=%q\n", val1, resp.Ok, resp.Err)
+	say(demoStep{Client: "client1", Op: "put", Key: "alpha", Value: val1, Ok: resp.Ok, Err: resp.Err})
 
 	// client2: get "alpha" (not in cache, should read and return val1 )
 	resp = do(client2Ch, ClientAction{Type: ClientGet, Key: "alpha"})
-	fmt.Printf("[client2] get alpha -> value=%d ok=%v err=%q\n", resp.Value, resp.Ok, resp.Err)
+	say(demoStep{Client: "client2", Op: "get", Key: "alpha", Value: resp.Value, Ok: resp.Ok, Err: resp.Err})
 
 	// client1: get "alpha" (owned by client2: use async)
 	pending := ClientAction{Type: ClientGet, Key: "alpha", Reply: make(chan ClientReply, 2)}
 	async(client1Ch, pending)
-	fmt.Printf("[client1] get alpha (pending)\n")
+	say(demoStep{Client: "client1", Op: "get-pending", Key: "alpha"})
 
 	time.Sleep(10 * time.Millisecond)
 
 	// client2: get "alpha" (cache hit, returns val1 )
 	resp = do(client2Ch, ClientAction{Type: ClientGet, Key: "alpha"})
-	fmt.Printf("[client2] get alpha -> value=%d ok=%v err=%q\n", resp.Value, resp.Ok, resp.Err)
+	say(demoStep{Client: "client2", Op: "get", Key: "alpha", Value: resp.Value, Ok: resp.Ok, Err: resp.Err})
 
 	// client2: put "alpha" -> val2 (read from CLI args)
 	resp = do(client2Ch, ClientAction{Type: ClientPut, Key: "alpha", Value: val2})
-	fmt.Printf("[client2] put alpha=%d -> ok=%v err=%q\n", val2, resp.Ok, resp.Err)
+	say(demoStep{Client: "client2", Op: "put", Key: "alpha", Value: val2, Ok: resp.Ok, Err: resp.Err})
 
 	// harvest get response from client1; gets val1 if inconsistent, val2 if consistent. Client1 owns alpha now.
 	resp = <-pending.Reply
 	close(pending.Reply)
-	fmt.Printf("[client1] pending get alpha reply -> value=%d ok=%v err=%q\n", resp.Value, resp.Ok, resp.Err)
+	say(demoStep{Client: "client1", Op: "pending-reply", Key: "alpha", Value: resp.Value, Ok: resp.Ok, Err: resp.Err})
 
 	// Wait a short moment to let goroutines finish their prints (not strictly needed).
 	time.Sleep(100 * time.Millisecond)
@@ -114,5 +254,716 @@ func main() {
 	// Wait for goroutines to finish.
 	wg.Wait()
 
-	fmt.Println("=== Demo end ===")
+	leaks := snap.Leaks(200 * time.Millisecond)
+	if *jsonOut {
+		writeJSON(struct {
+			Steps []demoStep `json:"steps"`
+			Leaks int        `json:"leaks"`
+		}{steps, len(leaks)})
+	} else {
+		fmt.Println("=== Demo end ===")
+		if len(leaks) > 0 {
+			PrintLeaks(os.Stdout, leaks)
+		}
+	}
+	if len(leaks) > 0 {
+		os.Exit(1)
+	}
+}
+
+// demoStep is one client action of the demo and its outcome.
+type demoStep struct {
+	Client string `json:"client"`
+	Op     string `json:"op"` // get, put, get-pending (sent, reply not yet taken), or pending-reply
+	Key    string `json:"key"`
+	Value  int    `json:"value"` // the value read, or for a put the value written
+	Ok     bool   `json:"ok"`
+	Err    string `json:"err"`
+}
+
+// String returns the line the demo prints for s.
+func (s demoStep) String() string {
+	switch s.Op {
+	case "put":
+		return fmt.Sprintf("[%s] put %s=%d -> ok=%v err=%q", s.Client, s.Key, s.Value, s.Ok, s.Err)
+	case "get-pending":
+		return fmt.Sprintf("[%s] get %s (pending)", s.Client, s.Key)
+	case "pending-reply":
+		return fmt.Sprintf("[%s] pending get %s reply -> value=%d ok=%v err=%q", s.Client, s.Key, s.Value, s.Ok, s.Err)
+	default:
+		return fmt.Sprintf("[%s] get %s -> value=%d ok=%v err=%q", s.Client, s.Key, s.Value, s.Ok, s.Err)
+	}
+}
+
+// formatFlags adds -format and -quiet to fs. Once fs is parsed, the bool returned
+// says whether the output is to be one JSON document instead of text.
+func formatFlags(fs *flag.FlagSet) *bool {
+	jsonOut := new(bool)
+	fs.Func("format", "output format: text (default), or json for one JSON document on stdout and nothing else", func(v string) error {
+		switch v {
+		case "text":
+			*jsonOut = false
+		case "json":
+			*jsonOut = true
+		default:
+			return fmt.Errorf("format %q is not text or json", v)
+		}
+		return nil
+	})
+	fs.BoolFunc("quiet", "the same as -format json", func(v string) error {
+		q, err := strconv.ParseBool(v)
+		*jsonOut = *jsonOut || q
+		return err
+	})
+	return jsonOut
+}
+
+// writeJSON writes v to stdout as one indented JSON document.
+func writeJSON(v any) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		fmt.Fprintln(os.Stderr, "kvrun:", err)
+		os.Exit(1)
+	}
+}
+
+// argOr parses args[i] as an integer if it was given, and otherwise returns the
+// config file's value.
+func argOr(args []string, i int, fromConfig *int) (int, error) {
+	if i < len(args) {
+		return strconv.Atoi(args[i])
+	}
+	return *fromConfig, nil
+}
+
+func usage() {
+	printUsage(commands())
+}
+
+// runBench runs the bench subcommand: it drives KVStore with concurrent clients
+// and reports throughput, get latency, and stale reads.
+func runBench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	clients := fs.Int("clients", 4, "number of client goroutines")
+	ops := fs.Int("ops", 10000, "get/put pairs per client")
+	keys := fs.Int("keys", 16, "keys per client")
+	shared := fs.Bool("shared", false, "have the clients contend for the same keys (needs -clients 2)")
+	readAhead := fs.Int("readahead", 0, "once a client's gets follow a pattern of keys, read this many of the next ones ahead")
+	latency := fs.Duration("latency", 0, "delay each request to KVStore by this long, as a network would (e.g. 100us)")
+	l2 := fs.Bool("l2", false, "put a cache shared by all the clients between them and KVStore")
+	l2Hold := fs.Duration("l2hold", 0, "with -l2, write back keys idle this long (default 5ms)")
+	messages := fs.Bool("messages", false, "count the messages to and from KVStore, by kind")
+	inbox := fs.Int("inbox", 0, "requests KVStore takes in ahead of serving them (0 is none, or no limit with -sched)")
+	backpressure := fs.Bool("backpressure", false, "report how full KVStore's inbox gets and how long senders wait for it (needs -inbox or -sched)")
+	timeout := fs.Duration("timeout", 0, "give up on KVStore after this long and reply with a timeout error")
+	serveStale := fs.Bool("servestale", false, "with -timeout, answer a get that timed out with the last value the client saw")
+	watch := fs.Bool("watch", false, "count the key events a watcher of every key sees: updated and, with -l2 or -ttl, expired, and with -idle deleted")
+	ttl := fs.Duration("ttl", 0, "make the store expire keys this long after they were last written")
+	idle := fs.Duration("idle", 0, "make the store evict keys nobody has read or written for this long")
+	revalidate := fs.Int("revalidate", 0, "keep read copies of the keys put, and revalidate one every N actions of each client")
+	mirror := fs.String("mirror", "", "copy every committed write to redis://host:port or to an http(s) URL, in the background")
+	aclPath := fs.String("acl", "", "allow only the actions this ACL file allows (lines of: client prefix get,put)")
+	keyPrefix := fs.String("keyprefix", "", "put this in front of every key, to model long, repetitive keys")
+	intern := fs.Bool("intern", false, "number the keys of KVStore and its clients from one shared table, which keeps one copy of each")
+	auditPath := fs.String("audit", "", "record every write KVStore accepts (who, key, old and new value, when) in this file, rotating it")
+	auditSize := fs.Int64("auditsize", 0, "with -audit, rotate the file once it reaches this many bytes (default 1MB)")
+	auditAge := fs.Duration("auditage", 0, "with -audit, rotate the file once it is this old (default: no limit)")
+	auditKeep := fs.Int("auditkeep", 0, "with -audit, rotated files to keep (default 5)")
+	sched := fs.String("sched", "", "queue each client's requests at KVStore and schedule them: fifo, rr, or fair")
+	jsonOut := formatFlags(fs)
+	fs.Usage = func() {
+		fmt.Println("Usage: go run kvrun.go bench [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	var policy SchedPolicy
+	if *sched != "" {
+		var err error
+		if policy, err = ParseSchedPolicy(*sched); err != nil {
+			fmt.Printf("Invalid bench: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	var acl *ACL
+	if *aclPath != "" {
+		var err error
+		if acl, err = LoadACL(*aclPath); err != nil {
+			fmt.Printf("Invalid bench: %s: %v\n", *aclPath, err)
+			os.Exit(1)
+		}
+	}
+	var audit *AuditLog
+	if *auditPath != "" {
+		unknown := ""
+		if *l2 {
+			unknown = "l2" // the L2 cache writes back for its clients
+		}
+		var err error
+		audit, err = OpenAuditLog(AuditConfig{Path: *auditPath, MaxSize: *auditSize, MaxAge: *auditAge, Keep: *auditKeep, Unknown: unknown})
+		if err != nil {
+			fmt.Printf("Invalid bench: %v\n", err)
+			os.Exit(1)
+		}
+		defer audit.Close()
+	}
+	res, err := Bench(BenchConfig{Clients: *clients, Ops: *ops, Keys: *keys, Shared: *shared, Stop: interrupts(),
+		ReadAhead: *readAhead, Latency: *latency, L2: *l2, L2Hold: *l2Hold, Messages: *messages, Sched: policy,
+		Inbox: *inbox, Backpressure: *backpressure, Timeout: *timeout, ServeStale: *serveStale,
+		Watch: *watch, TTL: *ttl, IdleAfter: *idle, Mirror: *mirror, Revalidate: *revalidate, ACL: acl,
+		KeyPrefix: *keyPrefix, Intern: *intern, Audit: audit})
+	if err != nil {
+		fmt.Printf("Invalid bench: %v\n", err)
+		os.Exit(1)
+	}
+	if *jsonOut {
+		writeJSON(res.Report())
+		return
+	}
+	PrintBench(os.Stdout, res)
+}
+
+// interrupts returns a channel that is closed on the first SIGINT or SIGTERM; a
+// second signal exits at once.
+func interrupts() <-chan struct{} {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	stop := make(chan struct{})
+	go func() {
+		sig := <-sigs
+		fmt.Fprintf(os.Stderr, "\n%v: stopping (again to quit now)\n", sig)
+		close(stop)
+		<-sigs
+		os.Exit(130)
+	}()
+	return stop
+}
+
+// runCoherence runs the coherence subcommand: the same workload simulated under
+// each of the protocols, compared by messages sent.
+func runCoherence(args []string) {
+	fs := flag.NewFlagSet("coherence", flag.ExitOnError)
+	protocols := fs.String("protocols", "all", "comma-separated coherence protocols to simulate and compare: own, msi, mesi, update, reval, or all")
+	clients := fs.Int("clients", 4, "number of clients")
+	ops := fs.Int("ops", 10000, "operations per client")
+	keys := fs.Int("keys", 16, "keys per client, or in all with -shared")
+	shared := fs.Bool("shared", false, "have the clients use the same keys")
+	reads := fs.Float64("reads", 0.5, "fraction of operations that only get; the rest get and put")
+	seed := fs.Int64("seed", 1, "seed of the clients' choices of key and operation")
+	revalidate := fs.Int("revalidate", 1, "under reval, operations each client does between revalidations of its cached keys")
+	jsonOut := formatFlags(fs)
+	fs.Usage = func() {
+		fmt.Println("Usage: go run kvrun.go coherence [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	protos, err := ParseProtocols(*protocols)
+	if err != nil {
+		fmt.Printf("Invalid coherence: %v\n", err)
+		os.Exit(1)
+	}
+	var results []CoherenceResult
+	for _, p := range protos {
+		res, err := SimulateCoherence(CoherenceConfig{Protocol: p, Clients: *clients, Ops: *ops, Keys: *keys,
+			Shared: *shared, Reads: *reads, Seed: *seed, RevalidateEvery: *revalidate})
+		if err != nil {
+			fmt.Printf("Invalid coherence: %v\n", err)
+			os.Exit(1)
+		}
+		results = append(results, res)
+	}
+	if *jsonOut {
+		reports := []CoherenceReport{}
+		for _, r := range results {
+			reports = append(reports, r.Report())
+		}
+		writeJSON(reports)
+		return
+	}
+	PrintCoherence(os.Stdout, results)
+}
+
+// runTimeline runs the timeline subcommand: a short bench that records who owned
+// each key when, shown as a chart, written as SVG, or as JSON.
+func runTimeline(args []string) {
+	fs := flag.NewFlagSet("timeline", flag.ExitOnError)
+	clients := fs.Int("clients", 2, "number of client goroutines")
+	ops := fs.Int("ops", 20, "get/put pairs per client")
+	keys := fs.Int("keys", 2, "keys per client, or in all with -shared")
+	shared := fs.Bool("shared", true, "have the clients contend for the same keys (needs -clients 2, or -l2)")
+	latency := fs.Duration("latency", 200*time.Microsecond, "delay each request to KVStore by this long, so that spans are wide enough to see")
+	l2 := fs.Bool("l2", false, "put a cache shared by all the clients between them and KVStore; the timeline is then its own")
+	width := fs.Int("width", 80, "columns of the chart")
+	svgPath := fs.String("svg", "", "also write the timeline as an SVG Gantt chart to this file")
+	jsonOut := formatFlags(fs)
+	fs.Usage = func() {
+		fmt.Println("Usage: go run kvrun.go timeline [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	res, err := Bench(BenchConfig{Clients: *clients, Ops: *ops, Keys: *keys, Shared: *shared, Stop: interrupts(),
+		Latency: *latency, L2: *l2, Timeline: true})
+	if err != nil {
+		fmt.Printf("Invalid timeline: %v\n", err)
+		os.Exit(1)
+	}
+	if *svgPath != "" {
+		f, err := os.Create(*svgPath)
+		if err == nil {
+			err = WriteTimelineSVG(f, res.Timeline)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err != nil {
+			fmt.Printf("Cannot write %s: %v\n", *svgPath, err)
+			os.Exit(1)
+		}
+	}
+	if *jsonOut {
+		writeJSON(res.Timeline.Report())
+		return
+	}
+	PrintTimeline(os.Stdout, res.Timeline, *width)
+}
+
+// runBulk runs the bulk subcommand: it imports a file into a fresh KVStore and
+// exports the whole store, in key order, to another file or to stdout.
+func runBulk(args []string) {
+	fs := flag.NewFlagSet("bulk", flag.ExitOnError)
+	in := fs.String("in", "", "CSV or JSON file of keys and values to import")
+	out := fs.String("out", "", "file to export the imported keys to (default stdout)")
+	format := fs.String("format", "", "format of both files: csv or json (default: from each file's extension, csv for stdout)")
+	fs.Usage = func() {
+		fmt.Println("Usage: go run kvrun.go bulk [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 || *in == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+	fail := func(err error) {
+		fmt.Fprintf(os.Stderr, "bulk: %v\n", err)
+		os.Exit(1)
+	}
+	formatOf := func(path string) BulkFormat {
+		name := *format
+		if name == "" {
+			name = strings.TrimPrefix(filepath.Ext(path), ".")
+		}
+		if name == "" && path == "" {
+			name = string(BulkCSV)
+		}
+		f, err := ParseBulkFormat(name)
+		if err != nil {
+			fail(fmt.Errorf("%s: %v", path, err))
+		}
+		return f
+	}
+	inFormat, outFormat := formatOf(*in), formatOf(*out)
+
+	kvReqCh := make(chan KVRequest)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go KVStore(kvReqCh, &wg)
+	defer func() {
+		close(kvReqCh)
+		wg.Wait()
+	}()
+
+	r, err := os.Open(*in)
+	if err != nil {
+		fail(err)
+	}
+	start := time.Now()
+	keys, err := ImportFrom(r, inFormat, kvReqCh)
+	r.Close()
+	if err != nil {
+		fail(fmt.Errorf("%s: %v", *in, err))
+	}
+	fmt.Fprintf(os.Stderr, "imported %d keys from %s in %v\n", len(keys), *in, time.Since(start).Round(time.Microsecond))
+
+	w := os.Stdout
+	if *out != "" {
+		if w, err = os.Create(*out); err != nil {
+			fail(err)
+		}
+	}
+	start = time.Now()
+	n, err := ExportTo(w, outFormat, kvReqCh)
+	if *out != "" {
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		fail(err)
+	}
+	fmt.Fprintf(os.Stderr, "exported %d keys in %v\n", n, time.Since(start).Round(time.Microsecond))
+}
+
+// runBlob runs the blob subcommand: it streams a file into a fresh KVStore as a
+// blob, a chunk at a time, and streams it back out to another file or to stdout.
+func runBlob(args []string) {
+	fs := flag.NewFlagSet("blob", flag.ExitOnError)
+	in := fs.String("in", "", "file to put in the store")
+	out := fs.String("out", "", "file to get it back out to (default stdout)")
+	chunk := fs.Int("chunk", BlobChunk, "bytes a chunk, at most the default")
+	window := fs.Int("window", 4, "chunks in flight at most")
+	fs.Usage = func() {
+		fmt.Println("Usage: go run kvrun.go blob [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 || *in == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+	fail := func(err error) {
+		fmt.Fprintf(os.Stderr, "blob: %v\n", err)
+		os.Exit(1)
+	}
+	cfg := StreamConfig{Chunk: *chunk, Window: *window}
+
+	kvReqCh := make(chan KVRequest)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go KVStore(kvReqCh, &wg)
+	defer func() {
+		close(kvReqCh)
+		wg.Wait()
+	}()
+
+	r, err := os.Open(*in)
+	if err != nil {
+		fail(err)
+	}
+	info, err := r.Stat()
+	if err != nil {
+		fail(err)
+	}
+	start := time.Now()
+	_, err = PutStream(kvReqCh, *in, r, int(info.Size()), cfg)
+	r.Close()
+	if err != nil {
+		fail(err)
+	}
+	fmt.Fprintf(os.Stderr, "put %d bytes from %s in %v\n", info.Size(), *in, time.Since(start).Round(time.Microsecond))
+
+	w := os.Stdout
+	if *out != "" {
+		if w, err = os.Create(*out); err != nil {
+			fail(err)
+		}
+	}
+	start = time.Now()
+	n, _, err := GetStream(kvReqCh, *in, w, cfg)
+	if *out != "" {
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		fail(err)
+	}
+	fmt.Fprintf(os.Stderr, "got %d bytes in %v\n", n, time.Since(start).Round(time.Microsecond))
+}
+
+// runAudit runs the audit subcommand: it prints the recorded writes of a key from
+// an audit log written by bench or serve -audit, its rotated files included.
+func runAudit(args []string) {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	path := fs.String("log", "", "the audit log, as given to bench or serve -audit")
+	key := fs.String("key", "", "the key whose writes to print")
+	n := fs.Int("n", 20, "print the last n writes (0 for all)")
+	jsonOut := formatFlags(fs)
+	fs.Usage = func() {
+		fmt.Println("Usage: go run kvrun.go audit [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 || *path == "" || *key == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+	recs, err := ReadAudit(*path, *key, *n)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "audit: %v\n", err)
+		os.Exit(1)
+	}
+	if *jsonOut {
+		writeJSON(recs)
+		return
+	}
+	if len(recs) == 0 {
+		fmt.Printf("no writes of %q recorded\n", *key)
+		return
+	}
+	for _, r := range recs {
+		fmt.Printf("%s  %-10s %s: %d -> %d\n", r.Time.Format("2006-01-02 15:04:05.000000"), r.Client, r.Key, r.Old, r.New)
+	}
+}
+
+// runDerived runs the derived subcommand: a sum of keys computed at the store, as
+// a virtual key, against the same sum read key by key by the client.
+func runDerived(args []string) {
+	fs := flag.NewFlagSet("derived", flag.ExitOnError)
+	keys := fs.Int("keys", 16, "keys summed")
+	writers := fs.Int("writers", 4, "writers moving units between the keys meanwhile")
+	reads := fs.Int("reads", 100, "sums read")
+	latency := fs.Duration("latency", 100*time.Microsecond, "delay each request from a client to the store by this long")
+	jsonOut := formatFlags(fs)
+	fs.Usage = func() {
+		fmt.Println("Usage: go run kvrun.go derived [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	res, err := DerivedDemo(DerivedConfig{Keys: *keys, Writers: *writers, Reads: *reads, Latency: *latency})
+	if err != nil {
+		fmt.Printf("Invalid derived: %v\n", err)
+		os.Exit(1)
+	}
+	if *jsonOut {
+		writeJSON(res)
+		return
+	}
+	PrintDerived(os.Stdout, res)
+}
+
+// runRegress runs the regress subcommand: the benchmark regression suite, which
+// exits with status 1 if any case fails.
+func runRegress(args []string) {
+	fs := flag.NewFlagSet("regress", flag.ExitOnError)
+	golden := fs.String("golden", "regression.json", "golden file of cases and expected results")
+	timing := fs.Bool("timing", false, "check each case's throughput floor too")
+	jsonOut := formatFlags(fs)
+	fs.Usage = func() {
+		fmt.Println("Usage: go run kvrun.go regress [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	cases, err := LoadRegression(*golden)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "regress: %v\n", err)
+		os.Exit(1)
+	}
+	failures := Regression(cases, *timing)
+	if *jsonOut {
+		writeJSON(struct {
+			Cases    int      `json:"cases"`
+			Failures []string `json:"failures"`
+		}{len(cases), append([]string{}, failures...)})
+		if len(failures) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	for _, f := range failures {
+		fmt.Println("FAIL", f)
+	}
+	if len(failures) > 0 {
+		os.Exit(1)
+	}
+	fmt.Printf("PASS %d cases\n", len(cases))
+}
+
+// runServe runs the serve subcommand: a KVStore served on the network (see
+// ServeKV), with the clients in a token file and an ACL, until interrupted.
+// SIGHUP rereads the token file, revoking the clients whose token changed.
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:7070", "address to listen on")
+	tokensPath := fs.String("tokens", "", "let in only the clients in this token file (lines of: client token)")
+	aclPath := fs.String("acl", "", "allow only the actions this ACL file allows (lines of: client prefix get,put)")
+	auditPath := fs.String("audit", "", "record every write the store accepts in this file, rotating it at 1MB")
+	tlsCert := fs.String("tlscert", "", "PEM certificate of the server (enables TLS)")
+	tlsKey := fs.String("tlskey", "", "PEM private key of -tlscert")
+	tlsCA := fs.String("tlsca", "", "PEM CA certificates: require client certificates they signed (mutual TLS)")
+	fs.Usage = func() {
+		fmt.Println("Usage: go run kvrun.go serve [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	fail := func(err error) {
+		fmt.Fprintf(os.Stderr, "serve: %v\n", err)
+		os.Exit(1)
+	}
+	var cfg NetConfig
+	var acl *ACL
+	var err error
+	if *tokensPath != "" {
+		if cfg.Tokens, err = LoadTokens(*tokensPath); err != nil {
+			fail(fmt.Errorf("%s: %v", *tokensPath, err))
+		}
+	}
+	if *aclPath != "" {
+		if acl, err = LoadACL(*aclPath); err != nil {
+			fail(fmt.Errorf("%s: %v", *aclPath, err))
+		}
+	}
+	if *tlsCert != "" {
+		if cfg.TLS, err = ServerTLS(*tlsCert, *tlsKey, *tlsCA); err != nil {
+			fail(fmt.Errorf("TLS: %v", err))
+		}
+	} else if *tlsCA != "" {
+		fail(fmt.Errorf("-tlsca needs the server's -tlscert and -tlskey"))
+	}
+	var audit *AuditLog
+	if *auditPath != "" {
+		if audit, err = OpenAuditLog(AuditConfig{Path: *auditPath}); err != nil {
+			fail(err)
+		}
+	}
+
+	kvReqCh := make(chan KVRequest)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go KVStoreWith(kvReqCh, &wg, StoreConfig{ACL: acl, Audit: audit}, nil)
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		fail(err)
+	}
+	fmt.Fprintf(os.Stderr, "serving on %s\n", ln.Addr())
+
+	if cfg.Tokens != nil {
+		hups := make(chan os.Signal, 1)
+		signal.Notify(hups, syscall.SIGHUP)
+		go func() {
+			for range hups {
+				revoked, err := cfg.Tokens.Reload(*tokensPath)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "serve: reload %s: %v\n", *tokensPath, err)
+					continue
+				}
+				fmt.Fprintf(os.Stderr, "reloaded %s, revoked %v\n", *tokensPath, revoked)
+			}
+		}()
+	}
+	stop := interrupts()
+	go func() {
+		<-stop
+		ln.Close()
+	}()
+	if err := ServeKV(ln, kvReqCh, cfg); err != nil {
+		fail(err)
+	}
+	close(kvReqCh)
+	wg.Wait()
+	if audit != nil {
+		if err := audit.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "serve: audit log: %v\n", err)
+		}
+		fmt.Printf("audit: %d writes recorded\n", audit.Records())
+	}
+	if cfg.Tokens != nil {
+		fmt.Println("clients:")
+		PrintAuthStats(os.Stdout, cfg.Tokens)
+	}
+	if acl != nil {
+		fmt.Printf("acl: denied %v\n", acl.Denied())
+	}
+}
+
+// runConnect runs the connect subcommand: a KVClient whose store is a KV
+// network server, doing the actions read from stdin, one per line (get <key>,
+// put <key> <value>), and printing each reply.
+func runConnect(args []string) {
+	fs := flag.NewFlagSet("connect", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:7070", "address of the server")
+	token := fs.String("token", "", "token to present to the server")
+	useTLS := fs.Bool("tls", false, "connect over TLS, trusting the system CAs unless -tlsca is given")
+	tlsCA := fs.String("tlsca", "", "PEM CA certificates to trust for the server's (implies -tls)")
+	tlsCert := fs.String("tlscert", "", "PEM certificate of the client, for mutual TLS (implies -tls)")
+	tlsKey := fs.String("tlskey", "", "PEM private key of -tlscert")
+	fs.Usage = func() {
+		fmt.Println("Usage: go run kvrun.go connect [flags] < actions")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	dial := DialConfig{Token: *token}
+	var err error
+	if *useTLS || *tlsCA != "" || *tlsCert != "" {
+		if dial.TLS, err = ClientTLS(*tlsCA, *tlsCert, *tlsKey); err != nil {
+			fmt.Fprintf(os.Stderr, "connect: TLS: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	conn, err := DialKV(*addr, dial)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "connect: %v\n", err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+	fmt.Fprintf(os.Stderr, "connected to %s as %q\n", *addr, conn.Client())
+
+	kvReqCh := make(chan KVRequest)
+	actionsCh := make(chan ClientAction)
+	var fwdWG, clientWG sync.WaitGroup
+	fwdWG.Add(1)
+	clientWG.Add(1)
+	go conn.Forward(kvReqCh, &fwdWG)
+	go KVClient(conn.Client(), actionsCh, kvReqCh, &clientWG)
+
+	sc := bufio.NewScanner(os.Stdin)
+	for sc.Scan() {
+		f := strings.Fields(sc.Text())
+		var act ClientAction
+		switch {
+		case len(f) == 2 && f[0] == "get":
+			act = ClientAction{Type: ClientGet, Key: f[1]}
+		case len(f) == 3 && f[0] == "put":
+			v, err := strconv.Atoi(f[2])
+			if err != nil {
+				fmt.Printf("%s: bad value: %v\n", sc.Text(), err)
+				continue
+			}
+			act = ClientAction{Type: ClientPut, Key: f[1], Value: v}
+		case len(f) == 0:
+			continue
+		default:
+			fmt.Printf("%s: want get <key> or put <key> <value>\n", sc.Text())
+			continue
+		}
+		act.Reply = make(chan ClientReply)
+		actionsCh <- act
+		r := <-act.Reply
+		if r.Ok {
+			fmt.Printf("%s: ok value=%d\n", sc.Text(), r.Value)
+		} else {
+			fmt.Printf("%s: failed: %s\n", sc.Text(), r.Err)
+		}
+	}
+	close(actionsCh)
+	clientWG.Wait() // the client is done with the store
+	close(kvReqCh)
+	fwdWG.Wait()
 }
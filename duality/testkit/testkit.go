@@ -0,0 +1,250 @@
+// Package testkit helps write short integration tests against kvcache. A Cluster
+// is a KVStore with its clients wired up as in kvrun; Run plays a scripted
+// scenario against it and checks each reply, along with the invariants every
+// correct store keeps: every operation succeeds, a get sees the last value put,
+// and shutting down leaves no goroutine behind. For the load-testing server,
+// the server module has a testkit package of its own.
+//
+//	func TestHandoff(t *testing.T) {
+//		c := testkit.NewCluster()
+//		defer c.Close(t)
+//		testkit.Run(t, c, []testkit.Step{
+//			{Client: "client1", Op: kvcache.ClientGet, Key: "k", Want: testkit.Value(0)},
+//			{Client: "client1", Op: kvcache.ClientPut, Key: "k", Value: 1},
+//			{Client: "client2", Op: kvcache.ClientGet, Key: "k", Want: testkit.Value(1)},
+//		})
+//	}
+package testkit
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"courses.cs.duke.edu/go/kvcache"
+)
+
+// ----- Clusters -----
+
+// TB is the part of testing.TB that testkit uses.
+type TB interface {
+	Helper()
+	Errorf(format string, args ...any)
+	Fatalf(format string, args ...any)
+}
+
+// StepTimeout is how long Run waits for a reply before it fails the step.
+var StepTimeout = time.Second
+
+// Cluster is a KVStore and its named KVClients.
+type Cluster struct {
+	kvReqCh chan kvcache.KVRequest
+	clients map[string]chan kvcache.ClientAction
+	names   []string
+	wg      sync.WaitGroup
+	snap    kvcache.LeakSnapshot
+	closed  bool
+}
+
+// NewCluster starts a KVStore and a KVClient for each name; with no names, the
+// clients are client1 and client2, as in the demo.
+func NewCluster(clients ...string) *Cluster {
+	return NewClusterWithACL(nil, clients...)
+}
+
+// NewClusterWithACL is NewCluster with acl the store's, so that a scenario can
+// check the actions it refuses (see Step.Forbidden). A nil acl allows
+// everything.
+func NewClusterWithACL(acl *kvcache.ACL, clients ...string) *Cluster {
+	if len(clients) == 0 {
+		clients = []string{"client1", "client2"}
+	}
+	c := &Cluster{
+		kvReqCh: make(chan kvcache.KVRequest),
+		clients: make(map[string]chan kvcache.ClientAction),
+		names:   clients,
+		snap:    kvcache.TakeLeakSnapshot(),
+	}
+	c.wg.Add(1 + len(clients))
+	go kvcache.KVStoreWith(c.kvReqCh, &c.wg, kvcache.StoreConfig{ACL: acl}, nil)
+	for _, name := range clients {
+		ch := make(chan kvcache.ClientAction)
+		c.clients[name] = ch
+		go kvcache.KVClient(name, ch, c.kvReqCh, &c.wg)
+	}
+	return c
+}
+
+// Start sends act to the named client and returns the channel its reply will
+// come on, without waiting for it.
+func (c *Cluster) Start(client string, act kvcache.ClientAction) (<-chan kvcache.ClientReply, error) {
+	ch, ok := c.clients[client]
+	if !ok {
+		return nil, fmt.Errorf("no client %q", client)
+	}
+	act.Reply = make(chan kvcache.ClientReply, 1)
+	ch <- act
+	return act.Reply, nil
+}
+
+// Do sends act to the named client and waits up to StepTimeout for the reply.
+func (c *Cluster) Do(client string, act kvcache.ClientAction) (kvcache.ClientReply, error) {
+	reply, err := c.Start(client, act)
+	if err != nil {
+		return kvcache.ClientReply{}, err
+	}
+	return await(reply)
+}
+
+// Get is Do for a get of key.
+func (c *Cluster) Get(client, key string) (kvcache.ClientReply, error) {
+	return c.Do(client, kvcache.ClientAction{Type: kvcache.ClientGet, Key: key})
+}
+
+// Put is Do for a put of value to key.
+func (c *Cluster) Put(client, key string, value int) (kvcache.ClientReply, error) {
+	return c.Do(client, kvcache.ClientAction{Type: kvcache.ClientPut, Key: key, Value: value})
+}
+
+func await(reply <-chan kvcache.ClientReply) (kvcache.ClientReply, error) {
+	select {
+	case r := <-reply:
+		return r, nil
+	case <-time.After(StepTimeout):
+		return kvcache.ClientReply{}, fmt.Errorf("no reply in %v (a get of a key another client holds waits for its put: use Start)", StepTimeout)
+	}
+}
+
+// Close shuts the clients and the store down and fails t if any goroutine
+// started since NewCluster is still running.
+func (c *Cluster) Close(t TB) {
+	t.Helper()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	for _, name := range c.names {
+		close(c.clients[name])
+	}
+	close(c.kvReqCh)
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(StepTimeout):
+		t.Errorf("cluster did not shut down in %v", StepTimeout)
+	}
+	for _, l := range c.snap.Leaks(200 * time.Millisecond) {
+		t.Errorf("leaked goroutine in %s (%s)", l.Top, l.State)
+	}
+}
+
+// ----- Scenarios -----
+
+// Step is one action of a scenario.
+type Step struct {
+	Client string
+	Op     kvcache.ClientActionType
+	Key    string
+	Value  int // the value to put
+
+	// Want, if set, is the value the step's get must return. Without it, a get
+	// must return the last value put to the key in the scenario, if any.
+	Want *int
+	// Fail, if set, means the step is expected to fail (Ok false).
+	Fail bool
+	// Forbidden, if set, means the step is expected to be refused by the
+	// cluster's ACL (Ok false, with kvcache.ErrForbidden).
+	Forbidden bool
+
+	// Pending, if set, names the step and starts it without waiting for its
+	// reply, as for a get of a key another client holds. A later step with
+	// Await set to the same name waits for that reply and checks it instead of
+	// doing anything itself.
+	Pending string
+	Await   string
+}
+
+// Value returns a pointer to v, for Step.Want.
+func Value(v int) *int { return &v }
+
+// String describes s for failure messages.
+func (s Step) String() string {
+	if s.Await != "" {
+		return "await " + s.Await
+	}
+	if s.Op == kvcache.ClientPut {
+		return fmt.Sprintf("%s put %s=%d", s.Client, s.Key, s.Value)
+	}
+	return fmt.Sprintf("%s %s %s", s.Client, s.Op, s.Key)
+}
+
+// Run plays steps against c in order and fails t for every reply that does not
+// match its step. A step that cannot run (an unknown client, no reply in time)
+// ends the scenario.
+func Run(t TB, c *Cluster, steps []Step) {
+	t.Helper()
+	last := make(map[string]int) // the last value put to each key
+	pending := make(map[string]<-chan kvcache.ClientReply)
+	started := make(map[string]Step)
+	for i, s := range steps {
+		var (
+			r   kvcache.ClientReply
+			err error
+		)
+		switch {
+		case s.Await != "":
+			reply, ok := pending[s.Await]
+			if !ok {
+				t.Fatalf("step %d (%v): nothing pending as %q", i, s, s.Await)
+				return
+			}
+			delete(pending, s.Await)
+			r, err = await(reply)
+			s.Op, s.Key = started[s.Await].Op, started[s.Await].Key
+		case s.Pending != "":
+			reply, err := c.Start(s.Client, kvcache.ClientAction{Type: s.Op, Key: s.Key, Value: s.Value})
+			if err != nil {
+				t.Fatalf("step %d (%v): %v", i, s, err)
+				return
+			}
+			pending[s.Pending], started[s.Pending] = reply, s
+			continue
+		default:
+			r, err = c.Do(s.Client, kvcache.ClientAction{Type: s.Op, Key: s.Key, Value: s.Value})
+		}
+		if err != nil {
+			t.Fatalf("step %d (%v): %v", i, s, err)
+			return
+		}
+		if s.Forbidden != kvcache.Forbidden(r) {
+			t.Errorf("step %d (%v): ok=%v err=%q, want forbidden=%v", i, s, r.Ok, r.Err, s.Forbidden)
+			continue
+		}
+		if r.Ok == (s.Fail || s.Forbidden) {
+			t.Errorf("step %d (%v): ok=%v err=%q, want ok=%v", i, s, r.Ok, r.Err, !(s.Fail || s.Forbidden))
+			continue
+		}
+		if !r.Ok {
+			continue
+		}
+		if s.Op == kvcache.ClientPut {
+			last[s.Key] = s.Value
+			continue
+		}
+		if want, ok := last[s.Key]; s.Want != nil || ok {
+			if s.Want != nil {
+				want = *s.Want
+			}
+			if r.Value != want {
+				t.Errorf("step %d (%v): value=%d, want %d", i, s, r.Value, want)
+			}
+		}
+	}
+	for name := range pending {
+		t.Errorf("step %q was started and never awaited", name)
+	}
+}
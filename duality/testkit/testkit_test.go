@@ -0,0 +1,36 @@
+package testkit_test
+
+import (
+	"testing"
+
+	"courses.cs.duke.edu/go/kvcache"
+	"courses.cs.duke.edu/go/testkit"
+)
+
+func TestHandoff(t *testing.T) {
+	c := testkit.NewCluster()
+	defer c.Close(t)
+	testkit.Run(t, c, []testkit.Step{
+		{Client: "client1", Op: kvcache.ClientGet, Key: "k", Want: testkit.Value(0)},
+		{Client: "client2", Op: kvcache.ClientGet, Key: "k", Pending: "wait"},
+		{Client: "client1", Op: kvcache.ClientPut, Key: "k", Value: 1},
+		{Await: "wait", Want: testkit.Value(1)},
+		{Client: "client2", Op: kvcache.ClientPut, Key: "k", Value: 2},
+		{Client: "client1", Op: kvcache.ClientGet, Key: "k"},
+	})
+}
+
+// A put the ACL refuses releases the key it was got with, unchanged, so the
+// other client's get does not wait forever.
+func TestRefusedPutReleasesKey(t *testing.T) {
+	acl := kvcache.NewACL(kvcache.ACLRule{Client: "*", Prefix: "shared/", Ops: []kvcache.ClientActionType{kvcache.ClientGet}})
+	c := testkit.NewClusterWithACL(acl)
+	defer c.Close(t)
+	testkit.Run(t, c, []testkit.Step{
+		{Client: "client1", Op: kvcache.ClientGet, Key: "shared/x", Want: testkit.Value(0)},
+		{Client: "client1", Op: kvcache.ClientPut, Key: "shared/x", Value: 5, Forbidden: true},
+		{Client: "client2", Op: kvcache.ClientGet, Key: "shared/x", Want: testkit.Value(0)},
+		{Client: "client2", Op: kvcache.ClientPut, Key: "shared/x", Value: 6, Forbidden: true},
+		{Client: "client1", Op: kvcache.ClientGet, Key: "shared/x", Want: testkit.Value(0)},
+	})
+}
@@ -0,0 +1,166 @@
+package goose
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// -------------------- A/B comparison --------------------
+
+// Two runs with the same seed still see different workloads once their servers
+// differ: skips, timeouts, and feedback change what the generator does next. RunAB
+// pins the workload instead. Both server configurations are offered the same
+// trace, arrival for arrival and demand for demand, so the differences in the
+// report come from the servers alone. The runs are back to back rather than
+// concurrent because the stats they are measured with belong to the package.
+
+// ABVariant is one of the two server configurations RunAB compares.
+type ABVariant struct {
+	Name      string
+	Configure func(e *Experiment) // changes the server side of the experiment; nil leaves it as it is
+}
+
+// ABResult holds the two runs of an A/B comparison.
+type ABResult struct {
+	NameA, NameB string
+	A, B         Result
+	Trace        []TraceEntry // the arrivals both runs were offered
+}
+
+// RunAB runs the experiment base against variant a and then variant b, offering
+// both the same arrivals. If base.Load.Trace is set, that trace is replayed to
+// both; otherwise the arrivals a was offered are recorded and replayed to b.
+func RunAB(base Experiment, a, b ABVariant) (ABResult, error) {
+	if base.Load.Clients > 0 {
+		return ABResult{}, fmt.Errorf("a/b: closed-loop arrivals depend on the server and cannot be replayed")
+	}
+	out := ABResult{NameA: a.Name, NameB: b.Name}
+	ea, eb := base, base
+	if a.Configure != nil {
+		a.Configure(&ea)
+	}
+	if b.Configure != nil {
+		b.Configure(&eb)
+	}
+	if len(base.Load.Trace) == 0 {
+		recorder := &TraceRecorder{}
+		ea.Load.Record = recorder
+		out.A = RunExperiment(ea)
+		out.Trace = recorder.Entries()
+		if len(out.Trace) == 0 {
+			return out, fmt.Errorf("a/b: run %s offered no arrivals", a.Name)
+		}
+		eb.Load.TraceSpeed = 1 // the recording is already at the speed a saw
+	} else {
+		out.Trace = base.Load.Trace
+		out.A = RunExperiment(ea)
+	}
+	eb.N = len(out.Trace)
+	eb.Load.Trace, eb.Load.Record = out.Trace, nil
+	select {
+	case <-base.Load.Stop:
+		return out, nil // B would be cut short by the same stop; leave it out
+	default:
+	}
+	out.B = RunExperiment(eb)
+	return out, nil
+}
+
+// ParseABVariant parses a variant name:key=value,... whose keys are conc (the
+// concurrency limit), mode, queue (admission queue length), policy, sched, and
+// shed (true or false), procs (GOMAXPROCS), and cpus (CPU workers, see
+// SetCPUWorkers). The keys left out keep the base experiment's settings.
+func ParseABVariant(spec string) (ABVariant, error) {
+	name, opts, _ := strings.Cut(strings.TrimSpace(spec), ":")
+	if name == "" {
+		return ABVariant{}, fmt.Errorf("bad variant %q: want name:key=value,...", spec)
+	}
+	var set []func(*Experiment)
+	for _, o := range strings.Split(opts, ",") {
+		if o = strings.TrimSpace(o); o == "" {
+			continue
+		}
+		key, val, ok := strings.Cut(o, "=")
+		if !ok {
+			return ABVariant{}, fmt.Errorf("variant %s: bad option %q: want key=value", name, o)
+		}
+		switch key {
+		case "conc":
+			c, err := strconv.Atoi(val)
+			if err != nil || c <= 0 {
+				return ABVariant{}, fmt.Errorf("variant %s: bad conc %q", name, val)
+			}
+			set = append(set, func(e *Experiment) { e.MaxConcurrent = c })
+		case "mode":
+			m := ServerMode(val)
+			if m != ModeSemaphore && m != ModePool {
+				return ABVariant{}, fmt.Errorf("variant %s: mode %q is not semaphore or pool", name, val)
+			}
+			set = append(set, func(e *Experiment) { e.Mode = m })
+		case "queue":
+			l, err := strconv.Atoi(val)
+			if err != nil || l < 0 {
+				return ABVariant{}, fmt.Errorf("variant %s: bad queue %q", name, val)
+			}
+			set = append(set, func(e *Experiment) { e.Queue.Len = l })
+		case "policy":
+			p := QueuePolicy(val)
+			if !ValidPolicy(p) {
+				return ABVariant{}, fmt.Errorf("variant %s: unknown policy %q", name, val)
+			}
+			set = append(set, func(e *Experiment) { e.Queue.Policy = p })
+		case "sched":
+			d := Discipline(val)
+			if !ValidDiscipline(d) {
+				return ABVariant{}, fmt.Errorf("variant %s: unknown sched %q", name, val)
+			}
+			set = append(set, func(e *Experiment) { e.Queue.Discipline = d })
+		case "procs", "cpus":
+			c, err := strconv.Atoi(val)
+			if err != nil || c <= 0 {
+				return ABVariant{}, fmt.Errorf("variant %s: bad %s %q", name, key, val)
+			}
+			if key == "procs" {
+				set = append(set, func(e *Experiment) { e.Procs = c })
+			} else {
+				set = append(set, func(e *Experiment) { e.CPUWorkers = c })
+			}
+		case "shed":
+			s, err := strconv.ParseBool(val)
+			if err != nil {
+				return ABVariant{}, fmt.Errorf("variant %s: bad shed %q", name, val)
+			}
+			set = append(set, func(e *Experiment) { e.ShedExpired = s })
+		default:
+			return ABVariant{}, fmt.Errorf("variant %s: unknown key %q", name, key)
+		}
+	}
+	return ABVariant{Name: name, Configure: func(e *Experiment) {
+		for _, f := range set {
+			f(e)
+		}
+		if e.Queue.Enabled() {
+			if e.Queue.Policy == "" {
+				e.Queue.Policy = PolicyBlock
+			}
+			if e.Queue.Discipline == "" {
+				e.Queue.Discipline = DisciplineFIFO
+			}
+		}
+	}}, nil
+}
+
+// PrintAB prints the two runs of r side by side, as PrintComparison does, after a
+// line naming the variants and the trace they shared.
+func PrintAB(r ABResult, bins int) {
+	fmt.Printf("a/b: A=%s B=%s on the same %d arrivals\n", r.NameA, r.NameB, len(r.Trace))
+	if r.B.Attempts == 0 {
+		fmt.Printf("a/b: %s did not run\n", r.NameB)
+		return
+	}
+	PrintComparison(r.A, r.B, bins)
+	if a, b := r.A.Dropped+r.A.Rejected, r.B.Dropped+r.B.Rejected; a != b {
+		fmt.Printf("dropped+rejected: A=%d B=%d\n", a, b)
+	}
+}
@@ -0,0 +1,151 @@
+package goose
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// -------------------- arrival processes --------------------
+
+// ArrivalModel selects the process by which Loadgen generates arrival times.
+// Every model keeps the mean inter-arrival time Loadgen is given, so that bursty
+// traffic can be compared with Poisson traffic at the same average load.
+type ArrivalModel string
+
+const (
+	ArrivalPoisson ArrivalModel = "poisson" // exponential inter-arrival times (the default)
+	ArrivalBatch   ArrivalModel = "batch"   // Poisson batches of geometrically distributed size
+	ArrivalMMPP    ArrivalModel = "mmpp"    // two-state Markov-modulated Poisson process: bursts and calm
+)
+
+// ArrivalConfig describes the arrival process.
+type ArrivalConfig struct {
+	Model ArrivalModel
+
+	// BatchMean is the mean batch size for ArrivalBatch; default 4.
+	BatchMean float64
+
+	// For ArrivalMMPP: the arrival rate in the burst state is BurstFactor times the
+	// rate in the calm state (default 10), and the process stays in the burst and
+	// calm states for exponentially distributed times with means BurstMs and CalmMs
+	// (defaults 100 and 900).
+	BurstFactor float64
+	BurstMs     float64
+	CalmMs      float64
+}
+
+// ParseArrivals parses an arrival model such as "poisson", "batch:8", or
+// "mmpp:10:100:900" (model[:batchMean] or mmpp[:burstFactor[:burstMs:calmMs]]).
+func ParseArrivals(spec string) (ArrivalConfig, error) {
+	parts := strings.Split(spec, ":")
+	cfg := ArrivalConfig{Model: ArrivalModel(parts[0])}
+	nums := make([]float64, len(parts)-1)
+	for i, p := range parts[1:] {
+		v, err := strconv.ParseFloat(p, 64)
+		if err != nil || v <= 0 {
+			return cfg, fmt.Errorf("arrival model %s: bad parameter %q", cfg.Model, p)
+		}
+		nums[i] = v
+	}
+	switch cfg.Model {
+	case ArrivalPoisson:
+		if len(nums) > 0 {
+			return cfg, fmt.Errorf("arrival model poisson takes no parameters")
+		}
+	case ArrivalBatch:
+		if len(nums) > 1 {
+			return cfg, fmt.Errorf("want batch[:batchMean]")
+		}
+		if len(nums) == 1 {
+			cfg.BatchMean = nums[0]
+		}
+	case ArrivalMMPP:
+		if len(nums) == 2 || len(nums) > 3 {
+			return cfg, fmt.Errorf("want mmpp[:burstFactor[:burstMs:calmMs]]")
+		}
+		if len(nums) >= 1 {
+			cfg.BurstFactor = nums[0]
+		}
+		if len(nums) == 3 {
+			cfg.BurstMs, cfg.CalmMs = nums[1], nums[2]
+		}
+	default:
+		return cfg, fmt.Errorf("unknown arrival model %q: want poisson, batch, or mmpp", cfg.Model)
+	}
+	return cfg, nil
+}
+
+// newArrivals returns a generator of successive inter-arrival times with mean
+// iatMeanMs, drawing from r.
+func newArrivals(cfg ArrivalConfig, iatMeanMs float64, r *rand.Rand) func() time.Duration {
+	exp := func(mean float64) time.Duration {
+		return time.Duration(r.ExpFloat64() * mean * float64(time.Millisecond))
+	}
+	switch cfg.Model {
+	case ArrivalBatch:
+		m := cfg.BatchMean
+		if m <= 0 {
+			m = 4
+		}
+		remaining := 0 // arrivals left in the current batch
+		return func() time.Duration {
+			if remaining > 0 {
+				remaining--
+				return 0
+			}
+			// geometric batch size on 1, 2, ... with mean m
+			size := 1
+			if m > 1 {
+				size += int(math.Log(1-r.Float64()) / math.Log(1-1/m))
+			}
+			remaining = size - 1
+			return exp(iatMeanMs * m)
+		}
+
+	case ArrivalMMPP:
+		k, burstMs, calmMs := cfg.BurstFactor, cfg.BurstMs, cfg.CalmMs
+		if k <= 0 {
+			k = 10
+		}
+		if burstMs <= 0 || calmMs <= 0 {
+			burstMs, calmMs = 100, 900
+		}
+		// choose the calm mean so that the long-run mean stays iatMeanMs
+		pBurst := burstMs / (burstMs + calmMs)
+		calmIat := iatMeanMs * (pBurst*k + (1 - pBurst))
+		burstIat := calmIat / k
+
+		inBurst := r.Float64() < pBurst
+		left := exp(calmMs)
+		if inBurst {
+			left = exp(burstMs)
+		}
+		return func() time.Duration {
+			var t time.Duration
+			for {
+				mean := calmIat
+				if inBurst {
+					mean = burstIat
+				}
+				// memoryless: if the state changes before the next arrival,
+				// start afresh in the new state at the change
+				if x := exp(mean); x < left {
+					left -= x
+					return t + x
+				}
+				t += left
+				inBurst = !inBurst
+				if inBurst {
+					left = exp(burstMs)
+				} else {
+					left = exp(calmMs)
+				}
+			}
+		}
+	}
+	return func() time.Duration { return exp(iatMeanMs) }
+}
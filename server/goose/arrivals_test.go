@@ -0,0 +1,60 @@
+package goose
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// Every model keeps the mean inter-arrival time; batches and bursts make the
+// times more variable than Poisson's, whose coefficient of variation is 1.
+func TestArrivalModels(t *testing.T) {
+	const n, mean = 200000, 2.0
+	for _, tc := range []struct {
+		cfg          ArrivalConfig
+		minCV, maxCV float64
+		zeros        float64 // fraction of arrivals in the same instant as the last
+	}{
+		{ArrivalConfig{Model: ArrivalPoisson}, 0.95, 1.05, 0},
+		{ArrivalConfig{Model: ArrivalBatch, BatchMean: 4}, 1.5, 10, 0.75},
+		{ArrivalConfig{Model: ArrivalMMPP}, 1.5, 10, 0},
+	} {
+		next := newArrivals(tc.cfg, mean, rand.New(rand.NewSource(1)))
+		var sum, sumSq float64
+		zeros := 0
+		for range n {
+			ms := float64(next().Nanoseconds()) / 1e6
+			sum += ms
+			sumSq += ms * ms
+			if ms == 0 {
+				zeros++
+			}
+		}
+		m := sum / n
+		cv := math.Sqrt(sumSq/n-m*m) / m
+		if math.Abs(m-mean)/mean > 0.05 {
+			t.Errorf("%s: mean %.3fms, want %.3fms", tc.cfg.Model, m, mean)
+		}
+		if cv < tc.minCV || cv > tc.maxCV {
+			t.Errorf("%s: coefficient of variation %.2f, want %.2f to %.2f", tc.cfg.Model, cv, tc.minCV, tc.maxCV)
+		}
+		if z := float64(zeros) / n; math.Abs(z-tc.zeros) > 0.02 {
+			t.Errorf("%s: %.3f of arrivals at once, want %.2f", tc.cfg.Model, z, tc.zeros)
+		}
+	}
+}
+
+func TestParseArrivals(t *testing.T) {
+	cfg, err := ParseArrivals("mmpp:5:50:450")
+	if err != nil || cfg != (ArrivalConfig{Model: ArrivalMMPP, BurstFactor: 5, BurstMs: 50, CalmMs: 450}) {
+		t.Errorf("ParseArrivals(mmpp:5:50:450) = %+v, %v", cfg, err)
+	}
+	if cfg, err := ParseArrivals("batch:8"); err != nil || cfg.BatchMean != 8 {
+		t.Errorf("ParseArrivals(batch:8) = %+v, %v", cfg, err)
+	}
+	for _, bad := range []string{"poisson:2", "batch:0", "mmpp:5:50", "burst"} {
+		if _, err := ParseArrivals(bad); err == nil {
+			t.Errorf("ParseArrivals(%q) accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package goose
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// -------------------- backpressure --------------------
+
+// Pressure is a server's report of its load, published on ServerConfig.Pressure.
+type Pressure struct {
+	At          time.Time
+	InFlight    int // requests in service
+	Queued      int // requests in the admission queue
+	Backlog     int // requests buffered in reqCh, not yet taken
+	Limit       int // concurrency limit
+	Utilization float64
+}
+
+// pressure returns the server's current load. Utilization is the number of
+// requests it holds, in service or waiting, over its concurrency limit, so it
+// passes 1 when requests start to wait.
+func (s *Server) pressure() Pressure {
+	st := s.Stats()
+	p := Pressure{At: clockNow(), InFlight: st.InFlight, Queued: st.Queued, Backlog: len(s.reqCh), Limit: st.Limit}
+	if p.Limit > 0 {
+		p.Utilization = float64(p.InFlight+p.Queued+p.Backlog) / float64(p.Limit)
+	}
+	return p
+}
+
+// publishPressure sends the server's Pressure on cfg.Pressure every
+// cfg.PressureEvery until the server stops taking requests. A report the
+// channel has no room for is skipped; the next one is more current anyway.
+func (s *Server) publishPressure() {
+	every := s.cfg.PressureEvery
+	if every <= 0 {
+		every = 10 * time.Millisecond
+	}
+	for clockSleep(every, s.stop) {
+		select {
+		case s.cfg.Pressure <- s.pressure():
+		default:
+		}
+	}
+}
+
+// BackpressureConfig makes Loadgen cooperate with a server that reports its load
+// (see ServerConfig.Pressure): while the reported utilization exceeds Threshold,
+// each report cuts the arrival rate by the factor Backoff (default 0.5), down to
+// MinRate of the configured rate (default 1/16); each report at or under the
+// threshold restores Recover of the configured rate (default 0.1). It does not
+// apply to closed-loop clients, which wait for their replies anyway.
+type BackpressureConfig struct {
+	Signal    <-chan Pressure // RunExperiment connects it to its server if nil
+	Threshold float64         // 0 turns backpressure off
+	Backoff   float64
+	Recover   float64
+	MinRate   float64
+}
+
+// throttle is Loadgen's side of backpressure: a multiplier of the arrival rate.
+type throttle struct {
+	cfg  BackpressureConfig
+	rate float64   // in (0, 1]
+	dial *RateDial // the operator's setting, applied on top
+
+	signals int
+	over    int
+	minSeen float64
+	since   time.Time     // when the rate last dropped below 1
+	slowFor time.Duration // total time spent below 1
+}
+
+func newThrottle(cfg BackpressureConfig) *throttle {
+	if cfg.Backoff <= 0 || cfg.Backoff >= 1 {
+		cfg.Backoff = 0.5
+	}
+	if cfg.Recover <= 0 {
+		cfg.Recover = 0.1
+	}
+	if cfg.MinRate <= 0 || cfg.MinRate > 1 {
+		cfg.MinRate = 1.0 / 16
+	}
+	return &throttle{cfg: cfg, rate: 1, minSeen: 1}
+}
+
+// observe adjusts the rate to the server's report p.
+func (t *throttle) observe(p Pressure) {
+	t.signals++
+	was := t.rate
+	if p.Utilization > t.cfg.Threshold {
+		t.over++
+		t.rate = max(t.rate*t.cfg.Backoff, t.cfg.MinRate)
+	} else {
+		t.rate = min(t.rate+t.cfg.Recover, 1)
+	}
+	t.minSeen = min(t.minSeen, t.rate)
+	switch {
+	case was == 1 && t.rate < 1:
+		t.since = p.At
+	case was < 1 && t.rate == 1:
+		t.slowFor += p.At.Sub(t.since)
+	}
+}
+
+// stretch returns the inter-arrival time iat at the current rate.
+func (t *throttle) stretch(iat time.Duration) time.Duration {
+	return time.Duration(float64(iat) / (t.rate * t.dial.Scale()))
+}
+
+// report prints to w how much the arrival rate was throttled during a run of the given length.
+func (t *throttle) report(w io.Writer, run time.Duration) {
+	slow := t.slowFor
+	if t.rate < 1 {
+		slow += time.Since(t.since)
+	}
+	frac := 0.0
+	if run > 0 {
+		frac = min(1, float64(slow)/float64(run))
+	}
+	fmt.Fprintf(w, "backpressure: threshold=%g signals=%d over=%d throttled=%.1f%% of the time minRate=%.0f%%\n",
+		t.cfg.Threshold, t.signals, t.over, 100*frac, 100*t.minSeen)
+}
@@ -0,0 +1,252 @@
+package goose
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// -------------------- load balancing over heterogeneous backends --------------------
+
+// BalancePolicy selects how a Balancer picks the backend for a request.
+type BalancePolicy string
+
+const (
+	BalanceRoundRobin BalancePolicy = "rr"     // each backend in turn
+	BalanceLeast      BalancePolicy = "least"  // the backend with the fewest outstanding requests
+	BalanceRandom     BalancePolicy = "random" // a backend chosen uniformly at random
+	BalanceP2C        BalancePolicy = "p2c"    // the less loaded of two random backends
+)
+
+// BalancePolicies lists the known policies, in the order serveload compares them.
+var BalancePolicies = []BalancePolicy{BalanceRoundRobin, BalanceRandom, BalanceLeast, BalanceP2C}
+
+// ValidBalancePolicy reports whether p is one of the known balancing policies.
+func ValidBalancePolicy(p BalancePolicy) bool {
+	for _, q := range BalancePolicies {
+		if p == q {
+			return true
+		}
+	}
+	return false
+}
+
+// Backend describes one server instance behind a Balancer.
+type Backend struct {
+	Name          string
+	Speed         float64 // service-time multiplier: 2 means twice as slow; default 1
+	MaxConcurrent int     // requests the instance serves at once; default 1
+}
+
+// BackendStats summarizes the requests one backend has served.
+type BackendStats struct {
+	Name        string
+	Speed       float64
+	Served      int
+	Outstanding int     // requests assigned to it right now
+	MeanMs      float64 // time from assignment to reply, including its queue
+}
+
+// Balancer is a Handler that spreads requests over several backend instances, each
+// with its own speed and concurrency limit, according to a BalancePolicy. Requests
+// wait at the backend they were sent to, so a poor choice shows up as queueing at
+// a slow or busy instance while others sit idle.
+type Balancer struct {
+	policy   BalancePolicy
+	h        Handler
+	backends []*backend
+	rr       atomic.Uint64
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+type backend struct {
+	Backend
+	perms       chan Permission
+	outstanding atomic.Int64
+	served      atomic.Int64
+	nanos       atomic.Int64
+}
+
+// NewBalancer returns a Balancer over the given backends, each serving requests
+// with h (nil means DemandHandler) scaled by its speed.
+func NewBalancer(policy BalancePolicy, h Handler, backends ...Backend) *Balancer {
+	if h == nil {
+		h = DemandHandler
+	}
+	if policy == "" {
+		policy = BalanceRoundRobin
+	}
+	lb := &Balancer{policy: policy, h: h, rng: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	for i, b := range backends {
+		if b.Speed <= 0 {
+			b.Speed = 1
+		}
+		if b.MaxConcurrent <= 0 {
+			b.MaxConcurrent = 1
+		}
+		if b.Name == "" {
+			b.Name = fmt.Sprintf("b%d", i)
+		}
+		lb.backends = append(lb.backends, &backend{Backend: b, perms: make(chan Permission, b.MaxConcurrent)})
+	}
+	return lb
+}
+
+// Serve sends r to the backend chosen by the policy and waits for its reply.
+func (lb *Balancer) Serve(r Request) Request {
+	if len(lb.backends) == 0 {
+		return lb.h.Serve(r)
+	}
+	b := lb.pick()
+	b.outstanding.Add(1)
+	defer b.outstanding.Add(-1)
+	start := time.Now()
+
+	select {
+	case b.perms <- Permission{}:
+	case <-r.Cancel:
+		r.Status = StatusCancelled
+		return r
+	}
+	sub := r
+	sub.WorkDemand = int(float64(r.WorkDemand) * b.Speed)
+	sub.WaitDemand = int(float64(r.WaitDemand) * b.Speed)
+	sub.ReplyCost = int(float64(r.ReplyCost) * b.Speed)
+	rep := safeServe(lb.h, sub)
+	byebye(b.perms)
+
+	b.served.Add(1)
+	b.nanos.Add(int64(time.Since(start)))
+	rep.WorkDemand, rep.WaitDemand, rep.ReplyCost = r.WorkDemand, r.WaitDemand, r.ReplyCost
+	return rep
+}
+
+// pick chooses a backend according to the policy.
+func (lb *Balancer) pick() *backend {
+	n := len(lb.backends)
+	switch lb.policy {
+	case BalanceRandom:
+		return lb.backends[lb.intn(n)]
+	case BalanceLeast:
+		// start the scan at a random point so ties do not all go to the first backend
+		off := lb.intn(n)
+		best := lb.backends[off]
+		for i := 1; i < n; i++ {
+			b := lb.backends[(off+i)%n]
+			if b.outstanding.Load() < best.outstanding.Load() {
+				best = b
+			}
+		}
+		return best
+	case BalanceP2C:
+		if n == 1 {
+			return lb.backends[0]
+		}
+		i := lb.intn(n)
+		j := lb.intn(n - 1)
+		if j >= i {
+			j++
+		}
+		a, b := lb.backends[i], lb.backends[j]
+		if b.outstanding.Load() < a.outstanding.Load() {
+			return b
+		}
+		return a
+	}
+	return lb.backends[(lb.rr.Add(1)-1)%uint64(n)]
+}
+
+func (lb *Balancer) intn(n int) int {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.rng.Intn(n)
+}
+
+// Stats returns per-backend statistics, in backend order.
+func (lb *Balancer) Stats() []BackendStats {
+	out := make([]BackendStats, len(lb.backends))
+	for i, b := range lb.backends {
+		st := BackendStats{
+			Name:        b.Name,
+			Speed:       b.Speed,
+			Served:      int(b.served.Load()),
+			Outstanding: int(b.outstanding.Load()),
+		}
+		if st.Served > 0 {
+			st.MeanMs = float64(b.nanos.Load()) / float64(st.Served) / 1e6
+		}
+		out[i] = st
+	}
+	return out
+}
+
+// ParseBackends parses a list of speed multipliers such as "1,1,2,4", giving
+// each backend maxConcurrent slots.
+func ParseBackends(spec string, maxConcurrent int) ([]Backend, error) {
+	var out []Backend
+	for i, f := range strings.Split(spec, ",") {
+		speed, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil || speed <= 0 {
+			return nil, fmt.Errorf("backend %d: bad speed %q", i, f)
+		}
+		out = append(out, Backend{Name: fmt.Sprintf("b%d", i), Speed: speed, MaxConcurrent: maxConcurrent})
+	}
+	return out, nil
+}
+
+// BalanceResult is the outcome of one experiment run behind a Balancer.
+type BalanceResult struct {
+	Policy   BalancePolicy
+	Result   Result
+	Backends []BackendStats
+}
+
+// CompareBalancers runs the experiment base once per policy, each time behind a fresh
+// Balancer over the given backends, and returns the results in order. base.Handler,
+// if set, is the application each backend runs.
+func CompareBalancers(base Experiment, backends []Backend, policies []BalancePolicy) []BalanceResult {
+	var out []BalanceResult
+	for _, p := range policies {
+		lb := NewBalancer(p, base.Handler, backends...)
+		e := base
+		e.Handler = lb
+		res := RunExperiment(e)
+		out = append(out, BalanceResult{Policy: p, Result: res, Backends: lb.Stats()})
+	}
+	return out
+}
+
+// PrintBalanceTable prints one line per policy: its overall performance and the
+// share of requests each backend served.
+func PrintBalanceTable(results []BalanceResult) {
+	if len(results) == 0 {
+		return
+	}
+	fmt.Printf("%-8s %10s %10s %10s", "policy", "tput/s", "mean(ms)", "p99(ms)")
+	for _, b := range results[0].Backends {
+		fmt.Printf(" %12s", fmt.Sprintf("%s(x%g)", b.Name, b.Speed))
+	}
+	fmt.Println()
+	for _, br := range results {
+		r := br.Result
+		fmt.Printf("%-8s %10.1f %10.3f %10.3f", br.Policy, r.Throughput, r.MeanRT, r.P99)
+		total := 0
+		for _, b := range br.Backends {
+			total += b.Served
+		}
+		for _, b := range br.Backends {
+			share := 0.0
+			if total > 0 {
+				share = 100 * float64(b.Served) / float64(total)
+			}
+			fmt.Printf(" %11.1f%%", share)
+		}
+		fmt.Println()
+	}
+}
@@ -0,0 +1,59 @@
+package goose
+
+import (
+	"sync"
+	"testing"
+)
+
+// Round robin takes each backend in turn; every backend scales the demands by
+// its speed, and the reply carries the demands as requested.
+func TestBalancerRoundRobinScales(t *testing.T) {
+	var mu sync.Mutex
+	seen := map[int]int{} // scaled WaitDemand -> requests
+	h := HandlerFunc(func(r Request) Request {
+		mu.Lock()
+		seen[r.WaitDemand]++
+		mu.Unlock()
+		return r
+	})
+	lb := NewBalancer(BalanceRoundRobin, h, Backend{Speed: 1}, Backend{Speed: 2}, Backend{Speed: 3})
+	for range 6 {
+		if rep := lb.Serve(Request{WaitDemand: 10}); rep.WaitDemand != 10 {
+			t.Fatalf("reply has WaitDemand %d, want 10", rep.WaitDemand)
+		}
+	}
+	if seen[10] != 2 || seen[20] != 2 || seen[30] != 2 {
+		t.Errorf("scaled demands served %v, want 2 each of 10, 20, and 30", seen)
+	}
+	for _, st := range lb.Stats() {
+		if st.Served != 2 || st.Outstanding != 0 {
+			t.Errorf("backend %s: %+v, want 2 served", st.Name, st)
+		}
+	}
+}
+
+// Least-outstanding and power-of-two-choices (of two backends, both always
+// drawn) pick the idle backend over the busy one.
+func TestBalancerAvoidsBusyBackend(t *testing.T) {
+	for _, p := range []BalancePolicy{BalanceLeast, BalanceP2C} {
+		lb := NewBalancer(p, nil, Backend{Name: "busy"}, Backend{Name: "idle"})
+		lb.backends[0].outstanding.Store(3)
+		for range 20 {
+			if b := lb.pick(); b.Name != "idle" {
+				t.Fatalf("%s picked %s", p, b.Name)
+			}
+		}
+	}
+}
+
+func TestParseBackends(t *testing.T) {
+	bs, err := ParseBackends("1, 2.5", 3)
+	if err != nil || len(bs) != 2 || bs[1].Speed != 2.5 || bs[1].MaxConcurrent != 3 || bs[1].Name != "b1" {
+		t.Errorf("ParseBackends = %+v, %v", bs, err)
+	}
+	for _, bad := range []string{"", "1,x", "0"} {
+		if _, err := ParseBackends(bad, 1); err == nil {
+			t.Errorf("ParseBackends(%q) accepted", bad)
+		}
+	}
+}
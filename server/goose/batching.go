@@ -0,0 +1,82 @@
+package goose
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// -------------------- batched replies and catch-up arrivals --------------------
+
+// At high rates Loadgen's arrival loop spends most of its time going around its
+// select, once per reply and once per arrival. LoadOptions.BatchReplies makes it
+// take every reply that is already waiting each time it takes one, and
+// LoadOptions.CatchUpMs makes it send every arrival already due at once when it
+// has fallen behind its schedule, rather than one per timer firing.
+
+// batchState is the part of a Collector kept here.
+type batchState struct {
+	replyBatches    atomic.Int64 // reply receptions that found more replies waiting
+	batchedReplies  atomic.Int64 // replies taken in those batches, beyond the first
+	catchUpBursts   atomic.Int64 // timer firings that sent more than one arrival to catch up
+	catchUpArrivals atomic.Int64 // arrivals sent in those bursts, beyond the first
+}
+
+// resetBatchStats clears the batching counters; ResetStats calls it.
+func (c *Collector) resetBatchStats() {
+	c.replyBatches.Store(0)
+	c.batchedReplies.Store(0)
+	c.catchUpBursts.Store(0)
+	c.catchUpArrivals.Store(0)
+}
+
+// BatchStats are the batching counters since the last ResetStats.
+type BatchStats struct {
+	ReplyBatches    int
+	BatchedReplies  int
+	CatchUpBursts   int
+	CatchUpArrivals int
+}
+
+// GetBatchStats returns the batching counters.
+func GetBatchStats() BatchStats { return defaultCollector.GetBatchStats() }
+
+// GetBatchStats is the package function GetBatchStats for c.
+func (c *Collector) GetBatchStats() BatchStats {
+	return BatchStats{
+		ReplyBatches:    int(c.replyBatches.Load()),
+		BatchedReplies:  int(c.batchedReplies.Load()),
+		CatchUpBursts:   int(c.catchUpBursts.Load()),
+		CatchUpArrivals: int(c.catchUpArrivals.Load()),
+	}
+}
+
+// PrintBatchStats prints the batching counters on one line.
+func PrintBatchStats() {
+	b := GetBatchStats()
+	fmt.Printf("batching: c.replyBatches=%d extraReplies=%d c.catchUpBursts=%d extraArrivals=%d\n",
+		b.ReplyBatches, b.BatchedReplies, b.CatchUpBursts, b.CatchUpArrivals)
+}
+
+// drainReplies takes the replies already waiting on replies, without blocking,
+// and returns the channel to keep reading: nil once it is closed.
+func (c *Collector) drainReplies(replies chan Request) chan Request {
+	extra := 0
+	defer func() {
+		if extra > 0 {
+			c.replyBatches.Add(1)
+			c.batchedReplies.Add(int64(extra))
+		}
+	}()
+	for {
+		select {
+		case rep, ok := <-replies:
+			if !ok {
+				return nil
+			}
+			c.ReceiveUpcall(rep)
+			extra++
+		default:
+			return replies
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package goose
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// -------------------- circuit breaker middleware --------------------
+
+// BreakerState is the state of a CircuitBreaker.
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"    // requests pass; outcomes are watched
+	BreakerOpen     BreakerState = "open"      // requests are rejected at once
+	BreakerHalfOpen BreakerState = "half-open" // a few probe requests pass to test the backend
+)
+
+// BreakerConfig configures a CircuitBreaker. Zero fields take the defaults noted.
+type BreakerConfig struct {
+	Window      int           // number of recent outcomes considered; default 20
+	FailureRate float64       // fraction of failures in the window that opens the breaker; default 0.5
+	SlowMs      float64       // if positive, replies slower than this count as failures
+	OpenFor     time.Duration // how long to stay open before probing; default 1s
+	Probes      int           // successful probes needed to close again; default 3
+}
+
+// BreakerTransition records one change of state of a CircuitBreaker.
+type BreakerTransition struct {
+	At    time.Duration // since the breaker was created
+	State BreakerState
+}
+
+// BreakerStats counts what a CircuitBreaker did with the requests it saw.
+type BreakerStats struct {
+	Passed   int // passed on to the inner Handler (including probes)
+	Failed   int // passed on and failed
+	Rejected int // rejected without calling the inner Handler
+	Opens    int // times the breaker opened
+}
+
+// CircuitBreaker is a Handler middleware that stops calling a failing inner Handler.
+// While closed it watches the last Window outcomes, where a failure is a reply with a
+// status other than StatusOK (or a slow one, with SlowMs). When the failure rate reaches
+// FailureRate it opens and rejects every request with StatusRejected for OpenFor. Then
+// it half-opens and lets one probe at a time through: Probes successes in a row close it,
+// and a failure opens it again.
+type CircuitBreaker struct {
+	h   Handler
+	cfg BreakerConfig
+
+	mu          sync.Mutex
+	state       BreakerState
+	window      []bool // recent outcomes, true for failure (ring buffer)
+	next        int    // next slot in window
+	filled      int    // slots of window in use
+	failures    int    // failures in window
+	openedAt    time.Time
+	probing     bool // a probe is in progress
+	probeWins   int  // consecutive successful probes
+	created     time.Time
+	transitions []BreakerTransition
+	stats       BreakerStats
+}
+
+// NewCircuitBreaker wraps h (nil means DemandHandler) in a closed CircuitBreaker.
+func NewCircuitBreaker(h Handler, cfg BreakerConfig) *CircuitBreaker {
+	if h == nil {
+		h = DemandHandler
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = 20
+	}
+	if cfg.FailureRate <= 0 || cfg.FailureRate > 1 {
+		cfg.FailureRate = 0.5
+	}
+	if cfg.OpenFor <= 0 {
+		cfg.OpenFor = time.Second
+	}
+	if cfg.Probes <= 0 {
+		cfg.Probes = 3
+	}
+	return &CircuitBreaker{
+		h:       h,
+		cfg:     cfg,
+		state:   BreakerClosed,
+		window:  make([]bool, cfg.Window),
+		created: clockNow(),
+	}
+}
+
+// Serve passes r to the inner Handler unless the breaker is open (or is half-open
+// with a probe already in progress), in which case it replies with StatusRejected.
+func (cb *CircuitBreaker) Serve(r Request) Request {
+	probe, ok := cb.admit(clockNow())
+	if !ok {
+		r.Status = StatusRejected
+		return r
+	}
+	start := clockNow()
+	// A panic in the inner Handler is a failure like any other: it must be
+	// recorded, or a panicking probe would leave the breaker half-open for good.
+	rep := safeServe(cb.h, r)
+	failed := rep.Status != StatusOK
+	if cb.cfg.SlowMs > 0 && float64(clockSince(start).Microseconds())/1000.0 > cb.cfg.SlowMs {
+		failed = true
+	}
+	cb.record(probe, failed, clockNow())
+	return rep
+}
+
+// admit decides whether a request arriving at now may pass, and whether it is a probe.
+func (cb *CircuitBreaker) admit(now time.Time) (probe, ok bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state == BreakerOpen && now.Sub(cb.openedAt) >= cb.cfg.OpenFor {
+		cb.setStateLocked(BreakerHalfOpen, now)
+		cb.probeWins = 0
+	}
+	switch cb.state {
+	case BreakerOpen:
+		cb.stats.Rejected++
+		return false, false
+	case BreakerHalfOpen:
+		if cb.probing {
+			cb.stats.Rejected++
+			return false, false
+		}
+		cb.probing = true
+		cb.stats.Passed++
+		return true, true
+	}
+	cb.stats.Passed++
+	return false, true
+}
+
+// record notes the outcome of a request that was passed on.
+func (cb *CircuitBreaker) record(probe, failed bool, now time.Time) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if failed {
+		cb.stats.Failed++
+	}
+	if probe {
+		cb.probing = false
+		if failed {
+			cb.openLocked(now)
+			return
+		}
+		cb.probeWins++
+		if cb.probeWins >= cb.cfg.Probes {
+			cb.resetWindowLocked()
+			cb.setStateLocked(BreakerClosed, now)
+		}
+		return
+	}
+	if cb.state != BreakerClosed {
+		return // a straggler admitted before the breaker opened
+	}
+	if cb.filled == len(cb.window) {
+		if cb.window[cb.next] {
+			cb.failures--
+		}
+	} else {
+		cb.filled++
+	}
+	cb.window[cb.next] = failed
+	if failed {
+		cb.failures++
+	}
+	cb.next = (cb.next + 1) % len(cb.window)
+	if cb.filled == len(cb.window) && float64(cb.failures) >= cb.cfg.FailureRate*float64(cb.filled) {
+		cb.openLocked(now)
+	}
+}
+
+func (cb *CircuitBreaker) openLocked(now time.Time) {
+	cb.openedAt = now
+	cb.stats.Opens++
+	cb.setStateLocked(BreakerOpen, now)
+}
+
+func (cb *CircuitBreaker) resetWindowLocked() {
+	for i := range cb.window {
+		cb.window[i] = false
+	}
+	cb.next, cb.filled, cb.failures = 0, 0, 0
+}
+
+func (cb *CircuitBreaker) setStateLocked(s BreakerState, now time.Time) {
+	cb.state = s
+	cb.transitions = append(cb.transitions, BreakerTransition{At: now.Sub(cb.created), State: s})
+}
+
+// State returns the current state.
+func (cb *CircuitBreaker) State() BreakerState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+// Stats returns the counts so far.
+func (cb *CircuitBreaker) Stats() BreakerStats {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.stats
+}
+
+// Transitions returns a copy of the state changes so far.
+func (cb *CircuitBreaker) Transitions() []BreakerTransition {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	out := make([]BreakerTransition, len(cb.transitions))
+	copy(out, cb.transitions)
+	return out
+}
+
+// PrintBreaker prints a CircuitBreaker's counts and its state changes.
+func PrintBreaker(cb *CircuitBreaker) {
+	st := cb.Stats()
+	fmt.Printf("breaker passed=%d failed=%d rejected=%d opens=%d state=%s\n",
+		st.Passed, st.Failed, st.Rejected, st.Opens, cb.State())
+	for _, t := range cb.Transitions() {
+		fmt.Printf("%8.3fs %s\n", t.At.Seconds(), t.State)
+	}
+}
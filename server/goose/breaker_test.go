@@ -0,0 +1,69 @@
+package goose
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A panicking inner Handler must count as a failure: the breaker opens, a probe
+// that panics opens it again, and once the backend recovers it closes.
+func TestBreakerPanicOpensAndRecovers(t *testing.T) {
+	var healthy atomic.Bool
+	backend := HandlerFunc(func(r Request) Request {
+		if !healthy.Load() {
+			panic("backend down")
+		}
+		return r
+	})
+	cb := NewCircuitBreaker(NewFaultInjector(backend, FaultConfig{}), BreakerConfig{Window: 4, OpenFor: 10 * time.Millisecond, Probes: 2})
+
+	for range 4 {
+		if rep := cb.Serve(Request{}); rep.Status != StatusFailed {
+			t.Fatalf("panicking request: status %v, want failed", rep.Status)
+		}
+	}
+	if st := cb.State(); st != BreakerOpen {
+		t.Fatalf("after 4 panics: state %s, want open", st)
+	}
+	if rep := cb.Serve(Request{}); rep.Status != StatusRejected {
+		t.Fatalf("while open: status %v, want rejected", rep.Status)
+	}
+
+	// a probe that panics opens the breaker again instead of wedging it half-open
+	time.Sleep(15 * time.Millisecond)
+	if rep := cb.Serve(Request{}); rep.Status != StatusFailed {
+		t.Fatalf("panicking probe: status %v, want failed", rep.Status)
+	}
+	if st := cb.State(); st != BreakerOpen {
+		t.Fatalf("after a panicking probe: state %s, want open", st)
+	}
+
+	healthy.Store(true)
+	time.Sleep(15 * time.Millisecond)
+	for i := range 2 {
+		if rep := cb.Serve(Request{}); rep.Status != StatusOK {
+			t.Fatalf("probe %d after recovery: status %v, want ok", i, rep.Status)
+		}
+	}
+	if st := cb.State(); st != BreakerClosed {
+		t.Fatalf("after recovery: state %s, want closed", st)
+	}
+	st := cb.Stats()
+	if st.Failed != 5 || st.Opens != 2 {
+		t.Fatalf("stats %+v: want 5 failed and 2 opens", st)
+	}
+}
+
+// With every request injected to panic, the breaker opens.
+func TestBreakerOpensOnInjectedPanics(t *testing.T) {
+	cb := NewCircuitBreaker(NewFaultInjector(HandlerFunc(func(r Request) Request { return r }), FaultConfig{PanicProb: 1}),
+		BreakerConfig{Window: 10, OpenFor: time.Hour})
+	for range 20 {
+		cb.Serve(Request{})
+	}
+	st := cb.Stats()
+	if st.Failed != 10 || st.Opens != 1 || st.Rejected != 10 {
+		t.Fatalf("stats %+v: want 10 failed, 1 open, 10 rejected", st)
+	}
+}
@@ -0,0 +1,56 @@
+package goose
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// -------------------- CPU calibration --------------------
+
+// burnCPU used to spin until the clock said ms had passed, so a request that lost
+// the CPU to others for half its burn did only half its work, and the contention
+// disappeared from the response times. Now a millisecond of WorkDemand is a fixed
+// number of loop iterations: as many as this host runs in a millisecond with the
+// CPU to itself, measured once, before the first burn.
+
+// burnChunk is how many iterations burnCPUOrCancel runs between checks of cancel.
+const burnChunk = 1 << 14
+
+var (
+	calibrateOnce sync.Once
+	itersPerMs    int64
+	burnSink      atomic.Uint64 // where the burns leave their result, so they are not optimized away
+)
+
+// burnIters runs n iterations of the burn loop from x.
+func burnIters(n int64, x uint64) uint64 {
+	for ; n > 0; n-- {
+		x = x*1664525 + 1013904223
+	}
+	return x
+}
+
+// CalibrateCPU returns the number of iterations of the burn loop that make a
+// millisecond of CPU work on this host. The first call measures it, which takes
+// about 50ms; Server.Start calls it so that the measurement does not land on the
+// first request. The best of several rounds is kept, as the one least disturbed
+// by other work.
+func CalibrateCPU() int64 {
+	calibrateOnce.Do(func() {
+		best := 0.0
+		x := uint64(1)
+		for range 5 {
+			start := time.Now()
+			n := int64(0)
+			for time.Since(start) < 10*time.Millisecond {
+				x = burnIters(burnChunk, x)
+				n += burnChunk
+			}
+			best = max(best, float64(n)/durationMs(time.Since(start)))
+		}
+		burnSink.Store(x)
+		itersPerMs = max(int64(best), 1)
+	})
+	return itersPerMs
+}
@@ -0,0 +1,55 @@
+package goose
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCalibrateCPU(t *testing.T) {
+	n := CalibrateCPU()
+	if n <= 0 || CalibrateCPU() != n {
+		t.Fatalf("CalibrateCPU() = %d, then %d; want the same positive count", n, CalibrateCPU())
+	}
+	start := time.Now()
+	burnCPU(10)
+	if elapsed := time.Since(start); elapsed < 5*time.Millisecond {
+		t.Errorf("burnCPU(10) took %v, want about 10ms", elapsed)
+	}
+}
+
+// Two burns sharing one CPU each do their full work, so together they take
+// about twice as long as one.
+func TestBurnCPUUnderContention(t *testing.T) {
+	CalibrateCPU()
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+	start := time.Now()
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			burnCPU(10)
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 15*time.Millisecond {
+		t.Errorf("two 10ms burns on one CPU took %v, want about 20ms", elapsed)
+	}
+}
+
+func TestBurnCPUOrCancel(t *testing.T) {
+	cancel := make(chan struct{})
+	close(cancel)
+	start := time.Now()
+	if burnCPUOrCancel(1000, cancel) {
+		t.Error("burn with cancel closed completed")
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("cancelled burn took %v, want it to stop at once", elapsed)
+	}
+	if !burnCPUOrCancel(1, make(chan struct{})) {
+		t.Error("burn without cancel was cancelled")
+	}
+}
@@ -0,0 +1,76 @@
+package goose
+
+import "fmt"
+
+// -------------------- utilization and capacity --------------------
+
+// A server with c permits and a mean service time of S can complete at most c/S
+// requests per second, however they arrive. Comparing the offered load with that
+// capacity, and the time the permits were busy with the length of the run, shows
+// how close to saturation a run was: response times climb steeply as the
+// utilization approaches 1.
+
+// Capacity describes how heavily a run loaded its server.
+type Capacity struct {
+	Permits     int     // concurrency limit (pool size in pool mode)
+	Utilization float64 // busy time per permit over the run's wall time; 0 if unknown
+	ServiceMs   float64 // measured mean service time; 0 if unknown
+	Nominal     float64 // capacity in requests per second from the configured demandMean
+	Measured    float64 // capacity from the measured service time; 0 if unknown
+	Offered     float64 // the configured arrival rate, per second
+	Load        float64 // Offered over the capacity (Measured if known, else Nominal)
+}
+
+// EstimateCapacity computes the Capacity of the run of res. Busy time and service
+// times are only known for in-process servers; for other targets only the nominal
+// figures are set.
+func EstimateCapacity(res Result) Capacity {
+	c := Capacity{Permits: res.MaxConcurrent}
+	if res.Server.Limit > 0 {
+		c.Permits = res.Server.Limit
+	}
+	if res.DemandMean > 0 {
+		c.Nominal = float64(c.Permits) * 1000 / res.DemandMean
+	}
+	if res.IatMean > 0 && res.Load.Clients == 0 {
+		c.Offered = 1000 / res.IatMean
+	}
+	if secs := res.Elapsed.Seconds(); secs > 0 && c.Permits > 0 && res.Server.Served > 0 {
+		c.Utilization = res.Server.BusyTime.Seconds() / (secs * float64(c.Permits))
+		c.ServiceMs = durationMs(res.Server.BusyTime) / float64(res.Server.Served)
+		if c.ServiceMs > 0 {
+			c.Measured = float64(c.Permits) * 1000 / c.ServiceMs
+		}
+	}
+	if capacity := c.PerSec(); capacity > 0 {
+		c.Load = c.Offered / capacity
+	}
+	return c
+}
+
+// PerSec returns the best estimate of the capacity: Measured if known, else Nominal.
+func (c Capacity) PerSec() float64 {
+	if c.Measured > 0 {
+		return c.Measured
+	}
+	return c.Nominal
+}
+
+// Saturated reports whether the offered load reached the capacity.
+func (c Capacity) Saturated() bool { return c.Load >= 1 }
+
+// PrintCapacity prints the utilization and capacity of the run of res on one line.
+func PrintCapacity(res Result) {
+	c := EstimateCapacity(res)
+	line := fmt.Sprintf("capacity: permits=%d nominal=%.1f/s", c.Permits, c.Nominal)
+	if c.Measured > 0 {
+		line += fmt.Sprintf(" measured=%.1f/s (service %.3fms) util=%.1f%%", c.Measured, c.ServiceMs, 100*c.Utilization)
+	}
+	if c.Offered > 0 {
+		line += fmt.Sprintf(" offered=%.1f/s load=%.2f", c.Offered, c.Load)
+		if c.Saturated() {
+			line += " SATURATED"
+		}
+	}
+	fmt.Println(line)
+}
@@ -0,0 +1,324 @@
+package goose
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// -------------------- chaos scenarios --------------------
+
+// A chaos scenario is a script of timed changes to a running experiment: the
+// arrival rate, the concurrency limit, and the rates of injected faults. It is
+// written one event per line, with # starting a comment:
+//
+//	at 5s   rate x2        # twice the arrival rate (rate 1 puts it back)
+//	at 10s  conc x0.5      # halve the concurrency limit (conc 8 sets it)
+//	at 12s  fail 20%       # fail a fifth of the requests
+//	at 15s  drop 20%       # serve a fifth of the requests and lose the replies
+//	at 18s  stall 10% 300ms
+//	at 25s  heal           # put everything back as it was at the start
+//
+// StartChaos plays a scenario against the dials of a run, prints each event as it
+// happens, and records it in the package stats, so that the latency series (see
+// SetLatencySeries) shows which bucket each event fell in. Experiment.Chaos plays
+// one from the start of an experiment's run.
+
+// ChaosEvent is one event of a chaos scenario.
+type ChaosEvent struct {
+	At     time.Duration // from the start of the scenario
+	Action string        // rate, conc, fail, drop, stall, or heal
+	Value  float64       // the new setting: a rate scale, a limit, or a probability
+	Factor bool          // Value multiplies the current setting (rate xF, conc xF)
+	Ms     float64       // for stall, how long; 0 means the FaultInjector's default
+	Line   string        // as written
+}
+
+// ChaosScenario is a list of events, in the order they happen.
+type ChaosScenario []ChaosEvent
+
+// LoadChaos reads a chaos scenario from a file (see ParseChaos).
+func LoadChaos(path string) (ChaosScenario, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseChaos(f)
+}
+
+// ParseChaos reads a chaos scenario, one event per line; see ParseChaosEvent.
+// Blank lines and comments are skipped. The events are sorted by time.
+func ParseChaos(r io.Reader) (ChaosScenario, error) {
+	var s ChaosScenario
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		ev, err := ParseChaosEvent(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		s = append(s, ev)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(s, func(i, j int) bool { return s[i].At < s[j].At })
+	return s, nil
+}
+
+// ParseChaosEvent parses one event, such as "at 10s conc x0.5":
+//
+//	at T rate S|xF      scale the arrival rate to S, or by F
+//	at T conc N|xF      set the concurrency limit to N, or multiply it by F
+//	at T fail P%        fail requests with probability P
+//	at T drop P%        lose the replies of requests with probability P
+//	at T stall P% [D]   stall requests for D (default 200ms) with probability P
+//	at T heal           put every setting back as it was at the start
+func ParseChaosEvent(line string) (ChaosEvent, error) {
+	f := strings.Fields(line)
+	ev := ChaosEvent{Line: strings.Join(f, " ")}
+	if len(f) < 3 || f[0] != "at" {
+		return ev, fmt.Errorf("bad event %q: want at <time> <action> ...", ev.Line)
+	}
+	var err error
+	if ev.At, err = time.ParseDuration(f[1]); err != nil || ev.At < 0 {
+		return ev, fmt.Errorf("bad time %q in %q", f[1], ev.Line)
+	}
+	ev.Action = f[2]
+	args := f[3:]
+	switch ev.Action {
+	case "heal":
+		if len(args) != 0 {
+			return ev, fmt.Errorf("heal takes no arguments: %q", ev.Line)
+		}
+		return ev, nil
+	case "rate", "conc":
+		if len(args) != 1 {
+			return ev, fmt.Errorf("want %s N or %s xF: %q", ev.Action, ev.Action, ev.Line)
+		}
+		v, factor := strings.CutPrefix(args[0], "x")
+		ev.Factor = factor
+		if ev.Value, err = strconv.ParseFloat(v, 64); err != nil || ev.Value <= 0 {
+			return ev, fmt.Errorf("bad %s %q: want a positive number", ev.Action, args[0])
+		}
+		if ev.Action == "conc" && !factor && ev.Value != math.Trunc(ev.Value) {
+			return ev, fmt.Errorf("bad conc %q: want a whole number", args[0])
+		}
+		return ev, nil
+	case "fail", "drop", "stall":
+		if len(args) < 1 || len(args) > 2 || (len(args) == 2 && ev.Action != "stall") {
+			return ev, fmt.Errorf("want %s P%%: %q", ev.Action, ev.Line)
+		}
+		p, ok := strings.CutSuffix(args[0], "%")
+		if ev.Value, err = strconv.ParseFloat(p, 64); !ok || err != nil || ev.Value < 0 || ev.Value > 100 {
+			return ev, fmt.Errorf("bad %s %q: want a percentage", ev.Action, args[0])
+		}
+		ev.Value /= 100
+		if len(args) == 2 {
+			d, err := time.ParseDuration(args[1])
+			if err != nil || d <= 0 {
+				return ev, fmt.Errorf("bad stall duration %q", args[1])
+			}
+			ev.Ms = durationMs(d)
+		}
+		return ev, nil
+	}
+	return ev, fmt.Errorf("unknown action %q in %q", ev.Action, ev.Line)
+}
+
+// Uses reports whether any event of s has the given action.
+func (s ChaosScenario) Uses(action string) bool {
+	for _, ev := range s {
+		if ev.Action == action {
+			return true
+		}
+	}
+	return false
+}
+
+// ChaosTargets are the dials a chaos scenario turns. An event whose dial is nil
+// is an error (see StartChaos).
+type ChaosTargets struct {
+	Dial    *RateDial      // for rate
+	Limiter *Limiter       // for conc
+	Faults  *FaultInjector // for fail, drop, and stall
+}
+
+// Check returns an error if s has an event for a dial t lacks.
+func (t ChaosTargets) Check(s ChaosScenario) error {
+	for _, ev := range s {
+		switch {
+		case ev.Action == "rate" && t.Dial == nil:
+			return fmt.Errorf("%q: no rate dial", ev.Line)
+		case ev.Action == "conc" && t.Limiter == nil:
+			return fmt.Errorf("%q: no concurrency limiter (conc needs semaphore mode)", ev.Line)
+		case (ev.Action == "fail" || ev.Action == "drop" || ev.Action == "stall") && t.Faults == nil:
+			return fmt.Errorf("%q: no fault injector", ev.Line)
+		}
+	}
+	return nil
+}
+
+// chaosMark is an event as it happened, for the latency series.
+type chaosMark struct {
+	at   time.Time
+	what string
+}
+
+// chaosSettings are the settings of the dials, as heal puts them back.
+type chaosSettings struct {
+	scale  float64
+	limit  int
+	faults FaultConfig
+}
+
+func (t ChaosTargets) settings() chaosSettings {
+	var cs chaosSettings
+	cs.scale = t.Dial.Scale()
+	if t.Limiter != nil {
+		cs.limit = t.Limiter.Limit()
+	}
+	if t.Faults != nil {
+		cs.faults = t.Faults.Config()
+	}
+	return cs
+}
+
+// apply makes the change of ev and describes it, with the setting before and after.
+func (t ChaosTargets) apply(ev ChaosEvent, initial chaosSettings) string {
+	pct := func(p float64) string { return strconv.FormatFloat(100*p, 'f', -1, 64) + "%" }
+	switch ev.Action {
+	case "rate":
+		old := t.Dial.Scale()
+		scale := ev.Value
+		if ev.Factor {
+			scale *= old
+		}
+		t.Dial.Set(scale)
+		return fmt.Sprintf("rate x%g -> x%g", old, scale)
+	case "conc":
+		old := t.Limiter.Limit()
+		limit := int(ev.Value)
+		if ev.Factor {
+			limit = int(math.Round(float64(old) * ev.Value))
+		}
+		t.Limiter.SetLimit(limit)
+		return fmt.Sprintf("conc %d -> %d", old, t.Limiter.Limit())
+	case "fail", "drop", "stall":
+		cfg := t.Faults.Config()
+		p := &cfg.ErrorProb
+		switch ev.Action {
+		case "drop":
+			p = &cfg.DropProb
+		case "stall":
+			p = &cfg.StallProb
+			if ev.Ms > 0 {
+				cfg.StallMs = ev.Ms
+			}
+		}
+		old := *p
+		*p = ev.Value
+		t.Faults.SetConfig(cfg)
+		return fmt.Sprintf("%s %s -> %s", ev.Action, pct(old), pct(ev.Value))
+	case "heal":
+		if t.Dial != nil {
+			t.Dial.Set(initial.scale)
+		}
+		if t.Limiter != nil {
+			t.Limiter.SetLimit(initial.limit)
+		}
+		if t.Faults != nil {
+			t.Faults.SetConfig(initial.faults)
+		}
+		return "heal"
+	}
+	return ev.Line
+}
+
+// StartChaos plays s against the dials of t, each event at its time from now, and
+// prints a line to w as each one happens. It returns an error, starting nothing,
+// if an event needs a dial t lacks. Call the returned function to stop it before
+// the scenario is over; it leaves the dials as the events played so far set them.
+func StartChaos(w io.Writer, s ChaosScenario, t ChaosTargets) (stop func(), err error) {
+	return defaultCollector.StartChaos(w, s, t)
+}
+
+// StartChaos is the package function StartChaos, marking the events in c's
+// latency series.
+func (c *Collector) StartChaos(w io.Writer, s ChaosScenario, t ChaosTargets) (stop func(), err error) {
+	if err := t.Check(s); err != nil {
+		return nil, err
+	}
+	initial := t.settings()
+	start := time.Now()
+	c.mu.Lock()
+	c.chaosMarks = nil
+	c.mu.Unlock()
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		for _, ev := range s {
+			if wait := time.Until(start.Add(ev.At)); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-done:
+					timer.Stop()
+					return
+				case <-timer.C:
+				}
+			}
+			what := t.apply(ev, initial)
+			now := time.Now()
+			c.mu.Lock()
+			c.chaosMarks = append(c.chaosMarks, chaosMark{at: now, what: what})
+			c.mu.Unlock()
+			fmt.Fprintf(w, "[chaos] t=%.1fs %s\n", now.Sub(start).Seconds(), what)
+		}
+	}()
+	return func() {
+		select {
+		case <-done:
+		default:
+			close(done)
+		}
+		<-finished
+	}, nil
+}
+
+// Chaos is a chaos scenario, the dials it turns, and where its events are printed
+// (nil means os.Stderr), for Experiment.Chaos.
+type Chaos struct {
+	Scenario ChaosScenario
+	Targets  ChaosTargets
+	Log      io.Writer
+}
+
+// start starts playing c, if set, marking its events in stats, and returns the
+// function that stops it.
+func (c *Chaos) start(stats *Collector) (stop func()) {
+	if c == nil || len(c.Scenario) == 0 {
+		return func() {}
+	}
+	w := c.Log
+	if w == nil {
+		w = os.Stderr
+	}
+	stop, err := stats.StartChaos(w, c.Scenario, c.Targets)
+	if err != nil {
+		fmt.Fprintf(w, "[chaos] not played: %v\n", err)
+		return func() {}
+	}
+	return stop
+}
@@ -0,0 +1,179 @@
+package goose
+
+import (
+	"container/heap"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// -------------------- clocks --------------------
+
+// Everything the server times or waits for goes through a Clock rather than
+// straight to the time package: the demands of a request, CPU work included, the
+// simulated disk and network, deadlines, and the breaker, controller, limiter and
+// pressure reports that measure them. The real clock sleeps. A VirtualClock
+// sleeps in virtual time, which moves only when its driver advances it, so a
+// simulation can run the server's own Handler code instead of a model of it, and
+// skip the idle time in between. Under a virtual clock CPU work takes its demand
+// in virtual time instead of burning the CPU.
+
+// A Clock is the time the server's waits are measured in.
+type Clock interface {
+	Now() time.Time
+	// Sleep waits for d unless cancel is closed first, and reports whether it
+	// waited for all of d. A nil cancel is never closed.
+	Sleep(d time.Duration, cancel <-chan struct{}) bool
+}
+
+// clockRef boxes a Clock for atomic.Pointer.
+type clockRef struct{ Clock }
+
+var serveClock atomic.Pointer[clockRef]
+
+func init() {
+	SetClock(nil)
+}
+
+// SetClock makes the server's waits use c; nil means the real clock. Set it
+// before an experiment starts.
+func SetClock(c Clock) {
+	if c == nil {
+		c = RealClock{}
+	}
+	serveClock.Store(&clockRef{c})
+}
+
+// clockSleep sleeps for d on the clock set by SetClock.
+func clockSleep(d time.Duration, cancel <-chan struct{}) bool {
+	return serveClock.Load().Sleep(d, cancel)
+}
+
+// clockNow returns the time on the clock set by SetClock.
+func clockNow() time.Time {
+	return serveClock.Load().Now()
+}
+
+// clockSince returns the time elapsed since t on the clock set by SetClock.
+func clockSince(t time.Time) time.Duration {
+	return clockNow().Sub(t)
+}
+
+// clockAfterFunc calls f in its own goroutine after d has passed on the clock
+// set by SetClock.
+func clockAfterFunc(d time.Duration, f func()) {
+	go func() {
+		clockSleep(d, nil)
+		f()
+	}()
+}
+
+// clockVirtual reports whether the clock set by SetClock is not the real one.
+func clockVirtual() bool {
+	_, real := serveClock.Load().Clock.(RealClock)
+	return !real
+}
+
+// RealClock is the wall clock.
+type RealClock struct{}
+
+// Now returns time.Now().
+func (RealClock) Now() time.Time { return time.Now() }
+
+// Sleep sleeps for d unless cancel is closed first.
+func (RealClock) Sleep(d time.Duration, cancel <-chan struct{}) bool {
+	if cancel == nil {
+		time.Sleep(d)
+		return true
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-cancel:
+		return false
+	}
+}
+
+// VirtualClock is a Clock whose time moves only when Advance or Next is called.
+// A discrete-event driver calls Next whenever every goroutine it runs is blocked,
+// which jumps the clock to the earliest wake-up.
+type VirtualClock struct {
+	mu       sync.Mutex
+	now      time.Time
+	sleepers wakeHeap
+}
+
+// NewVirtualClock returns a VirtualClock that starts at start.
+func NewVirtualClock(start time.Time) *VirtualClock {
+	return &VirtualClock{now: start}
+}
+
+// Now returns the virtual time.
+func (c *VirtualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Sleep waits until the virtual time has advanced by d, unless cancel is closed first.
+func (c *VirtualClock) Sleep(d time.Duration, cancel <-chan struct{}) bool {
+	if d <= 0 {
+		return true
+	}
+	ch := make(chan struct{}, 1)
+	c.mu.Lock()
+	heap.Push(&c.sleepers, wakeup{at: c.now.Add(d), ch: ch})
+	c.mu.Unlock()
+	select {
+	case <-ch:
+		return true
+	case <-cancel:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for i, w := range c.sleepers {
+			if w.ch == ch {
+				heap.Remove(&c.sleepers, i)
+				return false
+			}
+		}
+		return true // woken as cancel was closed; the wait was over
+	}
+}
+
+// Sleepers returns the number of goroutines sleeping on c.
+func (c *VirtualClock) Sleepers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.sleepers)
+}
+
+// Advance moves the virtual time forward by d and wakes every sleeper that is due.
+func (c *VirtualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(max(d, 0))
+	c.wakeLocked()
+}
+
+// Next moves the virtual time to the earliest wake-up and wakes the sleepers due
+// then. It reports false, leaving the time as it is, if nobody is sleeping.
+func (c *VirtualClock) Next() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.sleepers) == 0 {
+		return false
+	}
+	if at := c.sleepers[0].at; at.After(c.now) {
+		c.now = at
+	}
+	c.wakeLocked()
+	return true
+}
+
+func (c *VirtualClock) wakeLocked() {
+	for len(c.sleepers) > 0 && !c.sleepers[0].at.After(c.now) {
+		heap.Pop(&c.sleepers).(wakeup).ch <- struct{}{}
+	}
+}
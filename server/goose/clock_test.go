@@ -0,0 +1,153 @@
+package goose
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// sleepAsync starts a sleep on c and returns a channel that yields its result.
+func sleepAsync(c Clock, d time.Duration, cancel <-chan struct{}) <-chan bool {
+	done := make(chan bool, 1)
+	go func() { done <- c.Sleep(d, cancel) }()
+	return done
+}
+
+// waitSleepers waits until n goroutines are sleeping on c.
+func waitSleepers(t *testing.T, c *VirtualClock, n int) {
+	t.Helper()
+	waitFor(t, "the sleepers", func() bool { return c.Sleepers() == n })
+}
+
+func TestVirtualClock(t *testing.T) {
+	t0 := time.Unix(1000, 0)
+	c := NewVirtualClock(t0)
+	short := sleepAsync(c, 10*time.Millisecond, nil)
+	long := sleepAsync(c, 30*time.Millisecond, nil)
+	waitSleepers(t, c, 2)
+
+	c.Advance(5 * time.Millisecond)
+	if c.Sleepers() != 2 {
+		t.Fatalf("%d sleepers after 5ms, want both still asleep", c.Sleepers())
+	}
+	if !c.Next() || !<-short || c.Now() != t0.Add(10*time.Millisecond) {
+		t.Fatalf("Next: time %v, want the short sleeper woken at 10ms", c.Now().Sub(t0))
+	}
+	c.Advance(time.Hour)
+	if !<-long || c.Now() != t0.Add(time.Hour+10*time.Millisecond) {
+		t.Fatalf("Advance: time %v, want the long sleeper woken", c.Now().Sub(t0))
+	}
+	if c.Next() {
+		t.Error("Next with nobody asleep reported true")
+	}
+	if !c.Sleep(0, nil) {
+		t.Error("a zero sleep did not complete")
+	}
+}
+
+func TestVirtualClockCancel(t *testing.T) {
+	c := NewVirtualClock(time.Unix(0, 0))
+	cancel := make(chan struct{})
+	done := sleepAsync(c, time.Second, cancel)
+	waitSleepers(t, c, 1)
+	close(cancel)
+	if <-done {
+		t.Error("cancelled sleep reported complete")
+	}
+	if c.Sleepers() != 0 {
+		t.Errorf("%d sleepers after the cancel, want 0", c.Sleepers())
+	}
+}
+
+// The server's waits run in virtual time: a long WaitDemand finishes as soon as
+// the clock is advanced, with no real wait.
+func TestServeDemandOnVirtualClock(t *testing.T) {
+	c := NewVirtualClock(time.Unix(0, 0))
+	SetClock(c)
+	defer SetClock(nil)
+	done := make(chan bool, 1)
+	go func() { done <- sleepOrCancel(60_000, nil) }()
+	waitSleepers(t, c, 1)
+	start := time.Now()
+	c.Next()
+	if !<-done {
+		t.Error("sleep did not complete")
+	}
+	if real := time.Since(start); real > time.Second {
+		t.Errorf("a virtual minute took %v of real time", real)
+	}
+	if got := clockNow(); got != time.Unix(60, 0) {
+		t.Errorf("clock at %v, want a minute in", got)
+	}
+}
+
+// A request runs through the whole server in virtual time: the CPU pool, the
+// breaker, the limiter and its controller, the network delay, deadlines, and the
+// pressure reports all read the VirtualClock, so each step of the run lands on
+// the virtual instant it should.
+func TestServerOnVirtualClock(t *testing.T) {
+	t0 := time.Unix(0, 0)
+	c := NewVirtualClock(t0)
+	SetClock(c)
+	defer SetClock(nil)
+	SetCPUWorkers(1)
+	defer SetCPUWorkers(0)
+
+	lim := NewLimiter(4)
+	ctl := StartController(lim, ControllerConfig{Interval: time.Second, TargetMs: 1000})
+	breaker := NewCircuitBreaker(DemandHandler, BreakerConfig{SlowMs: 400})
+	pressure := make(chan Pressure, 1)
+	reqCh, repCh := make(chan Request), make(chan Request, 1)
+	s := StartServer(reqCh, repCh, ServerConfig{
+		Limiter:       lim,
+		Handler:       breaker,
+		ShedExpired:   true,
+		Pressure:      pressure,
+		PressureEvery: time.Second,
+		NetDelay:      NetDelay{FixedMs: 100},
+	})
+	waitSleepers(t, c, 2) // the controller and the pressure reports
+
+	// Each Next wakes one step of the request, which then sleeps for the next:
+	// 200ms of CPU on the pool's worker, a 300ms wait, a 50ms CPU reply cost,
+	// and 100ms on the network.
+	reqCh <- Request{WorkDemand: 200, WaitDemand: 300, ReplyCost: 50, ReplyCPU: true,
+		Deadline: t0.Add(time.Second), ReplyCh: repCh}
+	for range 4 {
+		waitSleepers(t, c, 3)
+		c.Next()
+	}
+	rep := <-repCh
+	if rep.Status != StatusOK || c.Now() != t0.Add(650*time.Millisecond) {
+		t.Fatalf("reply %v at %v, want StatusOK at 650ms", rep.Status, c.Now().Sub(t0))
+	}
+
+	// Past its deadline in virtual time, a request is shed unserved.
+	reqCh <- Request{WorkDemand: 200, Deadline: t0.Add(600 * time.Millisecond), ReplyCh: repCh}
+	waitFor(t, "the shed request", func() bool { return s.Stats().Shed == 1 })
+
+	waitSleepers(t, c, 2)
+	c.Next()
+	if p := <-pressure; p.At != t0.Add(time.Second) {
+		t.Errorf("pressure report at %v, want 1s", p.At.Sub(t0))
+	}
+	waitFor(t, "the controller", func() bool { return len(ctl.Decisions()) == 1 })
+	if d := ctl.Decisions()[0]; d.At != time.Second || d.P99 != 550 || d.Limit != 5 {
+		t.Errorf("decision %+v, want at 1s with a 550ms p99 hold, raising the limit to 5", d)
+	}
+
+	if b := breaker.Stats(); b.Passed != 1 || b.Failed != 1 {
+		t.Errorf("breaker %+v, want the one request passed and counted slow", b)
+	}
+	if st := s.Stats(); st.Served != 1 || st.Late != 0 || st.BusyTime != 550*time.Millisecond ||
+		st.NetDelay != 100*time.Millisecond {
+		t.Errorf("server %+v, want one served on time, busy 550ms, 100ms on the network", st)
+	}
+	if cpu := GetCPUStats(); cpu.Burns != 2 || cpu.Wait != 0 {
+		t.Errorf("CPU pool %+v, want both burns on the worker, with no wait", cpu)
+	}
+	ctl.Stop()
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+}
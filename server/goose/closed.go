@@ -0,0 +1,156 @@
+package goose
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// -------------------- closed-loop clients --------------------
+
+// ThinkDist selects the distribution of a virtual client's think time.
+type ThinkDist string
+
+const (
+	ThinkExp       ThinkDist = "exp"       // exponential (the default)
+	ThinkLognormal ThinkDist = "lognormal" // lognormal: most think times short, a few long
+)
+
+// ThinkConfig describes the time a virtual client spends between receiving a reply
+// and issuing its next request.
+type ThinkConfig struct {
+	Dist   ThinkDist
+	MeanMs float64
+	Sigma  float64 // ThinkLognormal shape (standard deviation of the log); default 1
+}
+
+// ParseThink parses a think-time distribution such as "exp:100" or "lognormal:100:1.5"
+// (dist:meanMs[:sigma]).
+func ParseThink(spec string) (ThinkConfig, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return ThinkConfig{}, fmt.Errorf("want dist:meanMs[:sigma]")
+	}
+	cfg := ThinkConfig{Dist: ThinkDist(parts[0])}
+	if cfg.Dist != ThinkExp && cfg.Dist != ThinkLognormal {
+		return cfg, fmt.Errorf("unknown think-time distribution %q: want exp or lognormal", cfg.Dist)
+	}
+	var err error
+	if cfg.MeanMs, err = strconv.ParseFloat(parts[1], 64); err != nil || cfg.MeanMs < 0 {
+		return cfg, fmt.Errorf("bad think-time mean %q", parts[1])
+	}
+	if len(parts) == 3 {
+		if cfg.Dist != ThinkLognormal {
+			return cfg, fmt.Errorf("only lognormal think times take a sigma")
+		}
+		if cfg.Sigma, err = strconv.ParseFloat(parts[2], 64); err != nil || cfg.Sigma <= 0 {
+			return cfg, fmt.Errorf("bad sigma %q", parts[2])
+		}
+	}
+	return cfg, nil
+}
+
+// draw returns a think time drawn from r.
+func (c ThinkConfig) draw(r *rand.Rand) time.Duration {
+	if c.MeanMs <= 0 {
+		return 0
+	}
+	ms := r.ExpFloat64() * c.MeanMs
+	if c.Dist == ThinkLognormal {
+		sigma := c.Sigma
+		if sigma <= 0 {
+			sigma = 1
+		}
+		// choose mu so that the mean is MeanMs
+		mu := math.Log(c.MeanMs) - sigma*sigma/2
+		ms = math.Exp(mu + sigma*r.NormFloat64())
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+// closedLoadgen is LoadgenWith for opts.Clients virtual clients in a closed loop:
+// each thinks, issues a request, waits until it is settled (replied to or dropped),
+// and thinks again, until n requests have been issued in all. The offered load is
+// set by the number of clients and their think time rather than an arrival rate,
+// so a slow server slows its clients down instead of building a queue.
+func closedLoadgen(reqCh chan<- Request, repCh chan Request, n int, waitMeanMs float64, opts LoadOptions) {
+	var issued atomic.Int64
+	startup := time.Now()
+
+	// replies are processed here; each client learns that its request is
+	// settled from the channel SendUpcallWatched gave it
+	stats := opts.stats()
+	replies, replyCh, fan := startReplies(repCh, opts)
+	stop := make(chan struct{})
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		for {
+			select {
+			case rep, ok := <-replies:
+				if !ok {
+					return
+				}
+				stats.ReceiveUpcall(rep)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	// the clients sleep through their think times in one scheduler rather than
+	// on a timer each
+	sched := newThinkScheduler(opts.Clients)
+	defer sched.close()
+
+	var wg sync.WaitGroup
+	for c := 0; c < opts.Clients; c++ {
+		wg.Add(1)
+		go func(c int, seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			nextObject := newObjects(opts.Objects, r)
+			wake := make(chan struct{}, 1)
+			for {
+				// thinking first staggers the clients' first requests
+				if !sched.sleep(wake, opts.Think.draw(r), opts.Stop) {
+					return
+				}
+				id := issued.Add(1) - 1
+				if id >= int64(n) {
+					return
+				}
+				req := Request{
+					ClientID:   int(id),
+					ObjectID:   nextObject(time.Since(startup)),
+					WaitDemand: int(r.ExpFloat64() * waitMeanMs),
+					ReplyCh:    replyCh(c),
+				}
+				done := stats.SendUpcallWatched(req)
+				reqCh <- req // a closed-loop client waits for the server to take it
+				<-done
+			}
+		}(c, opts.seed()+int64(c))
+	}
+	wg.Wait()
+	elapsed := time.Since(startup)
+	close(stop)
+	<-drained
+	fan.close(false)
+
+	fmt.Fprintf(opts.log(), "sent=%d clients=%d think=%s:%.0fms elapsed=%dms\n",
+		min(int(issued.Load()), n), opts.Clients, opts.thinkName(), opts.Think.MeanMs, elapsed.Milliseconds())
+}
+
+// thinkName returns the think-time distribution, with the default spelled out.
+func (o LoadOptions) thinkName() string {
+	if o.Think.Dist == "" {
+		return string(ThinkExp)
+	}
+	return string(o.Think.Dist)
+}
@@ -0,0 +1,67 @@
+package goose
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A closed loop never has more requests outstanding than it has clients.
+func TestClosedLoopBoundsOutstanding(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, peak := 0, 0
+	res := RunExperiment(Experiment{
+		N:             30,
+		MaxConcurrent: 16,
+		Handler: HandlerFunc(func(r Request) Request {
+			mu.Lock()
+			inFlight++
+			peak = max(peak, inFlight)
+			mu.Unlock()
+			time.Sleep(2 * time.Millisecond)
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+			return r
+		}),
+		Load: LoadOptions{Clients: 3, Think: ThinkConfig{Dist: ThinkExp, MeanMs: 1}},
+	})
+	if res.Received != 30 {
+		t.Fatalf("received %d of 30", res.Received)
+	}
+	if peak > 3 {
+		t.Errorf("%d requests in service at once, want at most the 3 clients", peak)
+	}
+}
+
+func TestThinkTimes(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, c := range []ThinkConfig{
+		{Dist: ThinkExp, MeanMs: 10},
+		{Dist: ThinkLognormal, MeanMs: 10, Sigma: 0.5},
+	} {
+		const draws = 100000
+		var sum time.Duration
+		for i := 0; i < draws; i++ {
+			sum += c.draw(r)
+		}
+		if mean := float64(sum/draws) / float64(time.Millisecond); mean < 9.5 || mean > 10.5 {
+			t.Errorf("%s: mean think time %.2fms, want about 10ms", c.Dist, mean)
+		}
+	}
+	if d := (ThinkConfig{Dist: ThinkExp}).draw(r); d != 0 {
+		t.Errorf("zero mean: think time %v, want 0", d)
+	}
+}
+
+func TestParseThink(t *testing.T) {
+	if c, err := ParseThink("lognormal:100:1.5"); err != nil || c != (ThinkConfig{ThinkLognormal, 100, 1.5}) {
+		t.Errorf("ParseThink(lognormal:100:1.5) = %+v, %v", c, err)
+	}
+	for _, spec := range []string{"exp", "exp:100:1", "pareto:100", "lognormal:100:0"} {
+		if _, err := ParseThink(spec); err == nil {
+			t.Errorf("ParseThink(%q) succeeded, want an error", spec)
+		}
+	}
+}
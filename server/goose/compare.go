@@ -0,0 +1,95 @@
+package goose
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// -------------------- comparing two results --------------------
+
+// Delta is the change in one metric from a result A to a result B.
+type Delta struct {
+	Metric string
+	A, B   float64
+	Diff   float64 // B - A
+	Pct    float64 // Diff as a percentage of A; NaN if A is 0
+}
+
+// CompareResults returns the changes from a to b in the main summary metrics.
+func CompareResults(a, b Result) []Delta {
+	metric := func(name string, x, y float64) Delta {
+		d := Delta{Metric: name, A: x, B: y, Diff: y - x, Pct: math.NaN()}
+		if x != 0 {
+			d.Pct = 100 * d.Diff / x
+		}
+		return d
+	}
+	skipRate := func(r Result) float64 {
+		if r.Attempts == 0 {
+			return 0
+		}
+		return float64(r.Skipped) / float64(r.Attempts)
+	}
+	return []Delta{
+		metric("tput/s", a.Throughput, b.Throughput),
+		metric("mean(ms)", a.MeanRT, b.MeanRT),
+		metric("p50(ms)", percentileOf(a.Samples, 50), percentileOf(b.Samples, 50)),
+		metric("p99(ms)", a.P99, b.P99),
+		metric("skiprate", skipRate(a), skipRate(b)),
+		metric("received", float64(a.Received), float64(b.Received)),
+	}
+}
+
+// PrintComparison prints the changes from a to b as a table, followed by their
+// response-time histograms overlaid: bins linear bins up to the larger p99.
+func PrintComparison(a, b Result, bins int) {
+	fmt.Printf("A: %s\nB: %s\n", a.describe(), b.describe())
+	fmt.Printf("%-10s %12s %12s %12s %9s\n", "metric", "A", "B", "delta", "change")
+	for _, d := range CompareResults(a, b) {
+		pct := "-"
+		if !math.IsNaN(d.Pct) {
+			pct = fmt.Sprintf("%+.1f%%", d.Pct)
+		}
+		fmt.Printf("%-10s %12.3f %12.3f %+12.3f %9s\n", d.Metric, d.A, d.B, d.Diff, pct)
+	}
+
+	if bins <= 0 {
+		return
+	}
+	maxMs := math.Ceil(math.Max(a.P99, b.P99))
+	if maxMs <= 0 {
+		return
+	}
+	ca, labels := histogramOf(append(a.Samples[:0:0], a.Samples...), bins, maxMs)
+	cb, _ := histogramOf(append(b.Samples[:0:0], b.Samples...), bins, maxMs)
+	// compare shapes, not counts: the runs may have received different numbers of replies
+	frac := func(counts []int, i int) float64 {
+		total := 0
+		for _, c := range counts {
+			total += c
+		}
+		if total == 0 {
+			return 0
+		}
+		return float64(counts[i]) / float64(total)
+	}
+	maxf := 0.0
+	for i := range ca {
+		maxf = math.Max(maxf, math.Max(frac(ca, i), frac(cb, i)))
+	}
+	if maxf == 0 {
+		return
+	}
+	const width = 50
+	for i := range labels {
+		fa, fb := frac(ca, i), frac(cb, i)
+		fmt.Printf("%12s A|%s %.1f%%\n", labels[i], strings.Repeat("█", int(width*fa/maxf)), 100*fa)
+		fmt.Printf("%12s B|%s %.1f%%\n", "", strings.Repeat("░", int(width*fb/maxf)), 100*fb)
+	}
+}
+
+// describe returns the experiment parameters in one line.
+func (e Experiment) describe() string {
+	return fmt.Sprintf("mode=%s iat=%gms demand=%gms conc=%d n=%d", e.modeName(), e.IatMean, e.DemandMean, e.MaxConcurrent, e.N)
+}
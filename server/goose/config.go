@@ -0,0 +1,143 @@
+package goose
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// -------------------- experiment config files --------------------
+
+// An experiment config file is a JSON object of sections, each an object of
+// settings named like the command-line flags they stand for:
+//
+//	{
+//	  "load":       {"iatMean": 2, "demandMean": 1, "n": 5000, "arrivals": "mmpp:4"},
+//	  "server":     {"maxConcurrent": 4, "mode": "pool"},
+//	  "scheduling": {"queue": 16, "policy": "drop-tail", "sched": "sjf"},
+//	  "output":     {"cdf": 20, "runtime": true}
+//	}
+//
+// The sections only group the settings for the reader; any setting may go in any
+// of them. The positional arguments (iatMean, demandMean, maxConcurrent) are
+// settings too. A list, such as a sweep's iatMean, may be a JSON array.
+
+// ConfigSections are the sections a config file may have.
+var ConfigSections = []string{"load", "server", "scheduling", "output"}
+
+// Config is a loaded config file: the value of each setting, as the text its flag
+// would be given on the command line, and the section it came from.
+type Config struct {
+	Path     string
+	Values   map[string]string
+	Sections map[string]string
+}
+
+// LoadConfig reads the config file at path.
+func LoadConfig(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	var sections map[string]map[string]json.RawMessage
+	if err := json.Unmarshal(data, &sections); err != nil {
+		return Config{}, fmt.Errorf("%s: %v", path, err)
+	}
+	c := Config{Path: path, Values: make(map[string]string), Sections: make(map[string]string)}
+	for section, settings := range sections {
+		known := false
+		for _, s := range ConfigSections {
+			known = known || s == section
+		}
+		if !known {
+			return Config{}, fmt.Errorf("%s: unknown section %q (want one of %s)", path, section, strings.Join(ConfigSections, ", "))
+		}
+		for name, raw := range settings {
+			if prev, ok := c.Sections[name]; ok {
+				return Config{}, fmt.Errorf("%s: %s is set in both %s and %s", path, name, prev, section)
+			}
+			v, err := configValue(raw)
+			if err != nil {
+				return Config{}, fmt.Errorf("%s: %s.%s: %v", path, section, name, err)
+			}
+			c.Values[name], c.Sections[name] = v, section
+		}
+	}
+	return c, nil
+}
+
+// configValue returns a JSON setting as flag text. Numbers keep the form they
+// were written in, so that an int flag accepts 4 but rejects 4.5; arrays become
+// comma-separated lists.
+func configValue(raw json.RawMessage) (string, error) {
+	var v any
+	d := json.NewDecoder(strings.NewReader(string(raw)))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return "", err
+	}
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case []any:
+		parts := make([]string, len(v))
+		for i, e := range v {
+			b, err := json.Marshal(e)
+			if err != nil {
+				return "", err
+			}
+			if parts[i], err = configValue(b); err != nil {
+				return "", err
+			}
+		}
+		return strings.Join(parts, ","), nil
+	}
+	return "", fmt.Errorf("want a string, number, boolean, or list, not %s", raw)
+}
+
+// Apply sets the flags of fs from the config, except those given on the command
+// line, which override the file. It returns the positional arguments: args if
+// any were given on the command line, or else the values of those settings named
+// by positional that the config has, in order.
+func (c Config) Apply(fs *flag.FlagSet, positional []string, args []string) ([]string, error) {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	isPositional := make(map[string]bool)
+	for _, p := range positional {
+		isPositional[p] = true
+	}
+	names := make([]string, 0, len(c.Values))
+	for name := range c.Values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		switch {
+		case isPositional[name], explicit[name]:
+		case fs.Lookup(name) == nil:
+			return nil, fmt.Errorf("%s: unknown setting %s.%s", c.Path, c.Sections[name], name)
+		default:
+			if err := fs.Set(name, c.Values[name]); err != nil {
+				return nil, fmt.Errorf("%s: %s.%s: %v", c.Path, c.Sections[name], name, err)
+			}
+		}
+	}
+	if len(args) > 0 {
+		return args, nil
+	}
+	var out []string
+	for _, p := range positional {
+		if v, ok := c.Values[p]; ok {
+			out = append(out, v)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,172 @@
+package goose
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// -------------------- adaptive concurrency control --------------------
+
+// ControlAlgorithm selects how a Controller adjusts the concurrency limit.
+type ControlAlgorithm string
+
+const (
+	// ControlAIMD adds one to the limit each interval while the interval's p99
+	// service time meets the target, and multiplies it by Backoff when it does not.
+	ControlAIMD ControlAlgorithm = "aimd"
+	// ControlGradient scales the limit by the ratio of the long-term to the current
+	// median service time (as in Netflix's gradient2 limiter), plus a small
+	// headroom of sqrt(limit), smoothed over intervals.
+	ControlGradient ControlAlgorithm = "gradient"
+)
+
+// ControllerConfig configures a Controller. Zero fields take the defaults noted.
+type ControllerConfig struct {
+	Algorithm ControlAlgorithm
+	Interval  time.Duration // time between adjustments; default 500ms
+	MinLimit  int           // default 1
+	MaxLimit  int           // default 256
+	TargetMs  float64       // AIMD: p99 service-time target in milliseconds; default 50
+	Backoff   float64       // AIMD: multiplicative decrease factor; default 0.9
+	Smoothing float64       // gradient: weight of each new estimate; default 0.2
+}
+
+// LimitDecision records one adjustment made by a Controller and what it observed.
+type LimitDecision struct {
+	At         time.Duration // since the controller started
+	Limit      int           // limit after the decision
+	P50        float64       // service time in milliseconds, over the interval
+	P99        float64       // service time in milliseconds, over the interval
+	Throughput float64       // replies per second over the interval
+}
+
+// Controller adjusts a Limiter's limit based on the service times of the requests
+// served under it. It measures service time (from permit to reply) rather than the
+// client's response time, because queueing in front of the limiter grows when the
+// limit shrinks and would otherwise drive the limit further down.
+type Controller struct {
+	lim       *Limiter
+	cfg       ControllerConfig
+	mu        sync.Mutex
+	decisions []LimitDecision
+	done      chan struct{}
+	finished  chan struct{}
+}
+
+// StartController starts adjusting lim according to cfg in the background.
+// Call Stop to end it.
+func StartController(lim *Limiter, cfg ControllerConfig) *Controller {
+	if cfg.Algorithm == "" {
+		cfg.Algorithm = ControlAIMD
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 500 * time.Millisecond
+	}
+	if cfg.MinLimit <= 0 {
+		cfg.MinLimit = 1
+	}
+	if cfg.MaxLimit <= 0 {
+		cfg.MaxLimit = 256
+	}
+	if cfg.MaxLimit < cfg.MinLimit {
+		cfg.MaxLimit = cfg.MinLimit
+	}
+	if cfg.TargetMs <= 0 {
+		cfg.TargetMs = 50
+	}
+	if cfg.Backoff <= 0 || cfg.Backoff >= 1 {
+		cfg.Backoff = 0.9
+	}
+	if cfg.Smoothing <= 0 || cfg.Smoothing > 1 {
+		cfg.Smoothing = 0.2
+	}
+	c := &Controller{
+		lim:      lim,
+		cfg:      cfg,
+		done:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+func (c *Controller) run() {
+	defer close(c.finished)
+	start := clockNow()
+	sampler := newIntervalSamplerAt(defaultCollector, start)
+	limit := float64(c.lim.Limit())
+	longP50 := 0.0 // gradient: long-term median service time (EWMA)
+
+	for clockSleep(c.cfg.Interval, c.done) {
+		now := clockNow()
+		st := sampler.sample(now)
+		holds := c.lim.takeHolds()
+		if len(holds) == 0 {
+			continue // nothing served this interval: nothing to learn from
+		}
+		p50 := percentileOf(holds, 50)
+		p99 := percentileOf(holds, 99)
+		if p50 <= 0 {
+			p50 = 0.001
+		}
+
+		switch c.cfg.Algorithm {
+		case ControlGradient:
+			if longP50 == 0 {
+				longP50 = p50
+			}
+			longP50 = 0.95*longP50 + 0.05*p50
+			gradient := math.Max(0.5, math.Min(1.0, longP50/p50))
+			estimate := limit*gradient + math.Sqrt(limit)
+			limit = (1-c.cfg.Smoothing)*limit + c.cfg.Smoothing*estimate
+		default: // ControlAIMD
+			if p99 > c.cfg.TargetMs {
+				limit = math.Floor(limit * c.cfg.Backoff)
+			} else {
+				limit++
+			}
+		}
+		limit = math.Max(float64(c.cfg.MinLimit), math.Min(float64(c.cfg.MaxLimit), limit))
+
+		newLimit := int(math.Round(limit))
+		if newLimit != c.lim.Limit() {
+			c.lim.SetLimit(newLimit)
+		}
+
+		c.mu.Lock()
+		c.decisions = append(c.decisions, LimitDecision{
+			At:         now.Sub(start),
+			Limit:      newLimit,
+			P50:        p50,
+			P99:        p99,
+			Throughput: st.Throughput,
+		})
+		c.mu.Unlock()
+	}
+}
+
+// Stop ends the controller and returns all of its decisions.
+func (c *Controller) Stop() []LimitDecision {
+	close(c.done)
+	<-c.finished
+	return c.Decisions()
+}
+
+// Decisions returns a copy of the decisions made so far.
+func (c *Controller) Decisions() []LimitDecision {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]LimitDecision, len(c.decisions))
+	copy(out, c.decisions)
+	return out
+}
+
+// PrintDecisions prints one line per controller decision.
+func PrintDecisions(decisions []LimitDecision) {
+	fmt.Printf("%8s %6s %10s %10s %10s\n", "t(s)", "limit", "svc50(ms)", "svc99(ms)", "tput/s")
+	for _, d := range decisions {
+		fmt.Printf("%8.1f %6d %10.3f %10.3f %10.1f\n", d.At.Seconds(), d.Limit, d.P50, d.P99, d.Throughput)
+	}
+}
@@ -0,0 +1,76 @@
+package goose
+
+import (
+	"testing"
+	"time"
+)
+
+// waitFor polls cond for up to a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// decide records ten service times of d under lim at once, and returns the
+// decision c makes on them.
+func decide(t *testing.T, c *Controller, lim *Limiter, d time.Duration) LimitDecision {
+	t.Helper()
+	n := len(c.Decisions())
+	lim.holdMu.Lock()
+	for range 10 {
+		lim.holds = append(lim.holds, d)
+	}
+	lim.holdMu.Unlock()
+	waitFor(t, "a decision", func() bool { return len(c.Decisions()) > n })
+	return c.Decisions()[n]
+}
+
+// AIMD backs off by Backoff when p99 misses the target, and otherwise adds one,
+// up to MaxLimit.
+func TestControllerAIMD(t *testing.T) {
+	lim := NewLimiter(4)
+	defer lim.Close()
+	c := StartController(lim, ControllerConfig{Algorithm: ControlAIMD, Interval: 5 * time.Millisecond, TargetMs: 50, MaxLimit: 5})
+	defer c.Stop()
+
+	for _, step := range []struct {
+		hold  time.Duration
+		limit int
+	}{
+		{100 * time.Millisecond, 3},
+		{time.Millisecond, 4},
+		{time.Millisecond, 5},
+		{time.Millisecond, 5},
+		{100 * time.Millisecond, 4},
+	} {
+		d := decide(t, c, lim, step.hold)
+		if d.Limit != step.limit || lim.Limit() != step.limit {
+			t.Fatalf("after holds of %v: decided %d, limiter at %d, want %d", step.hold, d.Limit, lim.Limit(), step.limit)
+		}
+		if d.P99 != float64(step.hold.Milliseconds()) {
+			t.Errorf("decision saw p99 %.3fms, want %v", d.P99, step.hold)
+		}
+	}
+}
+
+// The gradient limit creeps up while service times hold steady, and falls when
+// they grow.
+func TestControllerGradient(t *testing.T) {
+	lim := NewLimiter(8)
+	defer lim.Close()
+	c := StartController(lim, ControllerConfig{Algorithm: ControlGradient, Interval: 5 * time.Millisecond})
+	steady := decide(t, c, lim, 10*time.Millisecond).Limit
+	if steady <= 8 {
+		t.Errorf("steady service: limit %d, want above 8", steady)
+	}
+	if slow := decide(t, c, lim, 100*time.Millisecond).Limit; slow >= steady {
+		t.Errorf("slower service: limit %d, want below %d", slow, steady)
+	}
+	if n := len(c.Stop()); n != 2 {
+		t.Errorf("%d decisions, want one per interval with service times", n)
+	}
+}
@@ -0,0 +1,168 @@
+package goose
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// -------------------- CPU parallelism --------------------
+
+// A concurrency limit of 64 does not buy 64 CPUs. Normally every serving goroutine
+// burns its own WorkDemand, and the Go scheduler spreads them over GOMAXPROCS
+// threads, so the two limits blur together in the results. Experiment.Procs sets
+// GOMAXPROCS for a run, and Experiment.CPUWorkers hands all CPU work to a fixed
+// pool of worker goroutines, each locked to its own OS thread: a request holds a
+// concurrency slot while it waits for a CPU worker, so the wait shows up as the
+// CPU queue it is, separate from the admission queue.
+
+// cpuJob is one burn handed to a CPU worker.
+type cpuJob struct {
+	ms     int
+	cancel <-chan struct{}
+	done   chan cpuDone
+}
+
+// cpuDone is a CPU worker's answer to a cpuJob.
+type cpuDone struct {
+	completed bool
+	burned    time.Duration
+}
+
+// cpuWorkerPool is a pool of CPU workers and its counters.
+type cpuWorkerPool struct {
+	workers int
+	jobs    chan cpuJob
+	wg      sync.WaitGroup
+
+	burns     atomic.Int64
+	waitNanos atomic.Int64 // time burns spent waiting for a worker
+}
+
+// cpuPool is the pool in use; nil means every goroutine burns its own CPU.
+var cpuPool atomic.Pointer[cpuWorkerPool]
+
+// SetCPUWorkers makes n goroutines, each locked to an OS thread, do all the CPU
+// work of serving requests; 0 (the default) lets every serving goroutine do its
+// own. Set it before an experiment starts.
+func SetCPUWorkers(n int) {
+	var p *cpuWorkerPool
+	if n > 0 {
+		p = &cpuWorkerPool{workers: n, jobs: make(chan cpuJob)}
+		for range n {
+			p.wg.Add(1)
+			go p.work()
+		}
+	}
+	if old := cpuPool.Swap(p); old != nil {
+		close(old.jobs)
+		old.wg.Wait()
+	}
+}
+
+func (p *cpuWorkerPool) work() {
+	defer p.wg.Done()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	for j := range p.jobs {
+		start := clockNow()
+		ok := burnCPUOrCancel(j.ms, j.cancel)
+		j.done <- cpuDone{completed: ok, burned: clockSince(start)}
+	}
+}
+
+// burnCPUPooled is burnCPUOrCancel, on a CPU worker if there is a pool. It reports
+// whether the full burn completed and how long the burn itself took, leaving out
+// any wait for a worker.
+func burnCPUPooled(ms int, cancel <-chan struct{}) (bool, time.Duration) {
+	p := cpuPool.Load()
+	if p == nil {
+		start := clockNow()
+		ok := burnCPUOrCancel(ms, cancel)
+		return ok, clockSince(start)
+	}
+	j := cpuJob{ms: ms, cancel: cancel, done: make(chan cpuDone, 1)}
+	queued := clockNow()
+	select {
+	case p.jobs <- j:
+	case <-cancel:
+		return false, 0
+	}
+	p.waitNanos.Add(int64(clockSince(queued)))
+	p.burns.Add(1)
+	d := <-j.done
+	return d.completed, d.burned
+}
+
+// CPUStats describe the CPUs a run had and, with a CPU pool, how it was used.
+type CPUStats struct {
+	Procs   int // GOMAXPROCS during the run
+	Workers int // CPU workers; 0 if every serving goroutine burned its own CPU
+	Burns   int
+	Wait    time.Duration // time burns spent waiting for a worker, summed
+}
+
+// Parallelism returns the number of CPU burns that could run at once.
+func (c CPUStats) Parallelism() int {
+	if c.Workers > 0 {
+		return min(c.Workers, c.Procs)
+	}
+	return c.Procs
+}
+
+// GetCPUStats returns GOMAXPROCS and the CPU pool's counters.
+func GetCPUStats() CPUStats { return defaultCollector.GetCPUStats() }
+
+// GetCPUStats is the package function GetCPUStats for c, counting since its last
+// ResetStats (or since the pool was replaced, if it was).
+func (c *Collector) GetCPUStats() CPUStats {
+	c.mu.Lock()
+	base := c.resourceBase
+	c.mu.Unlock()
+	s := CPUStats{Procs: runtime.GOMAXPROCS(0)}
+	if p := cpuPool.Load(); p != nil {
+		if p != base.basePool {
+			base.baseBurns, base.basePoolWait = 0, 0
+		}
+		s.Workers = p.workers
+		s.Burns = int(p.burns.Load() - base.baseBurns)
+		s.Wait = time.Duration(p.waitNanos.Load() - base.basePoolWait)
+	}
+	return s
+}
+
+// applyCPU sets GOMAXPROCS and the CPU pool for the run as the experiment asks,
+// and returns the function that puts back what was there before.
+func (e Experiment) applyCPU() (restore func()) {
+	var undo []func()
+	if e.Procs > 0 {
+		old := runtime.GOMAXPROCS(e.Procs)
+		undo = append(undo, func() { runtime.GOMAXPROCS(old) })
+	}
+	if e.CPUWorkers > 0 {
+		old := 0
+		if p := cpuPool.Load(); p != nil {
+			old = p.workers
+		}
+		SetCPUWorkers(e.CPUWorkers)
+		undo = append(undo, func() { SetCPUWorkers(old) })
+	}
+	return func() {
+		for _, f := range undo {
+			f()
+		}
+	}
+}
+
+// PrintCPU prints the CPUs of a run and, with a CPU pool, how long burns waited
+// for a worker.
+func PrintCPU(c CPUStats) {
+	if c.Workers == 0 {
+		fmt.Printf("cpu: procs=%d workers=none\n", c.Procs)
+		return
+	}
+	fmt.Printf("cpu: procs=%d workers=%d parallelism=%d burns=%d meanWait=%.2fms\n",
+		c.Procs, c.Workers, c.Parallelism(), c.Burns, durationMs(c.Wait)/float64(max(c.Burns, 1)))
+}
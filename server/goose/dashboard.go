@@ -0,0 +1,83 @@
+package goose
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// -------------------- live HTTP dashboard --------------------
+
+//go:embed dashboard.html
+var dashboardPage []byte
+
+// dashboardHistory is how many one-second samples the dashboard keeps.
+const dashboardHistory = 300
+
+// dashboard samples the package stats once a second and serves them to browsers.
+type dashboard struct {
+	mu      sync.Mutex
+	history []IntervalStats
+}
+
+// StartDashboard serves a small web page at addr (e.g. ":8080") with live charts of
+// throughput, latency percentiles, in-flight requests, and skip rate, backed by a
+// JSON endpoint at /stats.json; Prometheus metrics are served at /metrics.
+// It returns once the listener is open; the server and its sampler run in the
+// background for the life of the process.
+func StartDashboard(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	d := &dashboard{}
+	go d.sampleLoop()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", d.servePage)
+	mux.HandleFunc("/stats.json", d.serveStats)
+	mux.Handle("/metrics", MetricsHandler())
+
+	go http.Serve(ln, mux)
+	return nil
+}
+
+func (d *dashboard) sampleLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	sampler := newIntervalSampler(defaultCollector)
+	for now := range ticker.C {
+		st := sampler.sample(now)
+		d.mu.Lock()
+		d.history = append(d.history, st)
+		if len(d.history) > dashboardHistory {
+			d.history = d.history[len(d.history)-dashboardHistory:]
+		}
+		d.mu.Unlock()
+	}
+}
+
+func (d *dashboard) servePage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardPage)
+}
+
+func (d *dashboard) serveStats(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	history := make([]IntervalStats, len(d.history))
+	copy(history, d.history)
+	d.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		History []IntervalStats `json:"history"`
+	}{history})
+}
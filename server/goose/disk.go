@@ -0,0 +1,207 @@
+package goose
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// -------------------- simulated disk --------------------
+
+// DiskConfig describes the simulated disk that serves IODemand: it performs at
+// most Parallelism operations at once, and each takes an exponentially
+// distributed seek time plus a transfer time proportional to its size.
+type DiskConfig struct {
+	Parallelism int     // concurrent operations; default 1
+	SeekMeanMs  float64 // default 4; negative means no seek time
+	KBPerMs     float64 // transfer rate; default 100 (about 100MB/s)
+}
+
+// simDisk is a DiskConfig in use: its operation slots and its counters.
+type simDisk struct {
+	cfg   DiskConfig
+	slots chan struct{}
+
+	ops       atomic.Int64
+	busyNanos atomic.Int64 // time spent in operations, summed over slots
+	waitNanos atomic.Int64 // time operations spent waiting for a slot
+}
+
+var disk atomic.Pointer[simDisk]
+
+// cpuWorkNanos sums the CPU work (WorkDemand) done by serveDemand, for PrintBottleneck.
+var cpuWorkNanos atomic.Int64
+
+func init() {
+	SetDisk(DiskConfig{})
+}
+
+// SetDisk replaces the simulated disk. Set it before an experiment starts.
+func SetDisk(cfg DiskConfig) {
+	if cfg.Parallelism <= 0 {
+		cfg.Parallelism = 1
+	}
+	if cfg.SeekMeanMs < 0 {
+		cfg.SeekMeanMs = 0
+	} else if cfg.SeekMeanMs == 0 {
+		cfg.SeekMeanMs = 4
+	}
+	if cfg.KBPerMs <= 0 {
+		cfg.KBPerMs = 100
+	}
+	disk.Store(&simDisk{cfg: cfg, slots: make(chan struct{}, cfg.Parallelism)})
+}
+
+// resourceBase is the part of a Collector kept for the simulated disk and the CPU
+// pool. They belong to the whole process rather than to a run, so their counters
+// are never cleared: a Collector notes where they stood at its last ResetStats and
+// reports how far they have moved since. Runs that overlap share the disk and the
+// CPUs, and each one's figures include the other's work.
+type resourceBase struct {
+	baseDisk     *simDisk
+	baseOps      int64
+	baseBusy     int64
+	baseWait     int64
+	baseCPUWork  int64
+	basePool     *cpuWorkerPool
+	baseBurns    int64
+	basePoolWait int64
+}
+
+// resetResourcesLocked notes the disk and CPU counters; ResetStats calls it.
+func (c *Collector) resetResourcesLocked() {
+	c.resourceBase = resourceBase{baseCPUWork: cpuWorkNanos.Load()}
+	if d := disk.Load(); d != nil {
+		c.baseDisk = d
+		c.baseOps, c.baseBusy, c.baseWait = d.ops.Load(), d.busyNanos.Load(), d.waitNanos.Load()
+	}
+	if p := cpuPool.Load(); p != nil {
+		c.basePool = p
+		c.baseBurns, c.basePoolWait = p.burns.Load(), p.waitNanos.Load()
+	}
+}
+
+// diskIOOrCancel reads kb kilobytes from the simulated disk, waiting for a free
+// slot first, unless cancel is closed first. It reports whether the read completed.
+func diskIOOrCancel(kb int, cancel <-chan struct{}) bool {
+	d := disk.Load()
+	queued := clockNow()
+	select {
+	case d.slots <- struct{}{}:
+	case <-cancel:
+		return false
+	}
+	defer func() { <-d.slots }()
+	start := clockNow()
+	d.waitNanos.Add(int64(start.Sub(queued)))
+	svc := rand.ExpFloat64()*d.cfg.SeekMeanMs + float64(kb)/d.cfg.KBPerMs
+	if !clockSleep(time.Duration(svc*float64(time.Millisecond)), cancel) {
+		d.busyNanos.Add(int64(clockNow().Sub(start)))
+		return false
+	}
+	d.ops.Add(1)
+	d.busyNanos.Add(int64(clockNow().Sub(start)))
+	return true
+}
+
+// DiskStats are the simulated disk's counters since the last ResetStats.
+type DiskStats struct {
+	DiskConfig
+	Ops      int
+	Busy     time.Duration // time spent in operations, summed over slots
+	Wait     time.Duration // time operations spent waiting for a slot
+	CPUWork  time.Duration // CPU work done for WorkDemand, for comparison
+	MeanOpMs float64
+}
+
+// GetDiskStats returns the simulated disk's counters.
+func GetDiskStats() DiskStats { return defaultCollector.GetDiskStats() }
+
+// GetDiskStats is the package function GetDiskStats for c. If the disk was
+// replaced since c's last ResetStats, it counts from the new disk's start.
+func (c *Collector) GetDiskStats() DiskStats {
+	c.mu.Lock()
+	base := c.resourceBase
+	c.mu.Unlock()
+	d := disk.Load()
+	if d != base.baseDisk {
+		base.baseOps, base.baseBusy, base.baseWait = 0, 0, 0
+	}
+	s := DiskStats{
+		DiskConfig: d.cfg,
+		Ops:        int(d.ops.Load() - base.baseOps),
+		Busy:       time.Duration(d.busyNanos.Load() - base.baseBusy),
+		Wait:       time.Duration(d.waitNanos.Load() - base.baseWait),
+		CPUWork:    time.Duration(cpuWorkNanos.Load() - base.baseCPUWork),
+	}
+	if s.Ops > 0 {
+		s.MeanOpMs = durationMs(s.Busy) / float64(s.Ops)
+	}
+	return s
+}
+
+// PrintBottleneck prints the utilization of each resource the requests of res
+// demanded: the CPUs (GOMAXPROCS of them), the simulated disk, and the server's
+// concurrency slots, and names the busiest as the bottleneck. The slots are held
+// for the whole of a request's service, so they are only the bottleneck if
+// neither CPU nor disk is nearly as busy.
+func PrintBottleneck(res Result) {
+	secs := res.Elapsed.Seconds()
+	if secs <= 0 {
+		return
+	}
+	d := res.Disk
+	cpus := res.CPU.Parallelism() // the CPUs the run had, which a CPU pool may limit
+	if cpus <= 0 {
+		cpus = runtime.GOMAXPROCS(0)
+	}
+	cpu := d.CPUWork.Seconds() / (secs * float64(cpus))
+	dsk := d.Busy.Seconds() / (secs * float64(d.Parallelism))
+	fmt.Printf("disk: ops=%d meanOp=%.2fms meanWait=%.2fms parallelism=%d util=%.1f%%\n",
+		d.Ops, d.MeanOpMs, durationMs(d.Wait)/float64(max(d.Ops, 1)), d.Parallelism, 100*dsk)
+	name, util := "cpu", cpu
+	if dsk > util {
+		name, util = "disk", dsk
+	}
+	line := fmt.Sprintf("utilization: cpu=%.1f%% (%d) disk=%.1f%%", 100*cpu, cpus, 100*dsk)
+	if limit := res.Server.Limit; limit > 0 {
+		slots := res.Server.BusyTime.Seconds() / (secs * float64(limit))
+		line += fmt.Sprintf(" slots=%.1f%% (%d)", 100*slots, limit)
+		if slots > util+0.1 {
+			name, util = "slots", slots
+		}
+	}
+	fmt.Printf("%s bottleneck=%s\n", line, name)
+}
+
+// ParseDisk parses a disk description such as "2:4:100" (parallelism:seekMs:kbPerMs);
+// trailing fields may be left out for their defaults.
+func ParseDisk(spec string) (DiskConfig, error) {
+	var cfg DiskConfig
+	parts := strings.Split(spec, ":")
+	if len(parts) > 3 {
+		return cfg, fmt.Errorf("want parallelism[:seekMs[:kbPerMs]]")
+	}
+	var err error
+	if cfg.Parallelism, err = strconv.Atoi(parts[0]); err != nil || cfg.Parallelism <= 0 {
+		return cfg, fmt.Errorf("bad parallelism %q", parts[0])
+	}
+	if len(parts) > 1 {
+		if cfg.SeekMeanMs, err = strconv.ParseFloat(parts[1], 64); err != nil || cfg.SeekMeanMs < 0 {
+			return cfg, fmt.Errorf("bad seek time %q", parts[1])
+		}
+		if cfg.SeekMeanMs == 0 {
+			cfg.SeekMeanMs = -1 // no seeks, rather than the default
+		}
+	}
+	if len(parts) > 2 {
+		if cfg.KBPerMs, err = strconv.ParseFloat(parts[2], 64); err != nil || cfg.KBPerMs <= 0 {
+			return cfg, fmt.Errorf("bad transfer rate %q", parts[2])
+		}
+	}
+	return cfg, nil
+}
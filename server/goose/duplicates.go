@@ -0,0 +1,66 @@
+package goose
+
+import "container/list"
+
+// -------------------- duplicate replies --------------------
+
+// A reply to a request that is already settled must not be recorded again: with
+// hedging, retries, or a transport that redelivers, it would add a second sample
+// for one request, or close a request that is not outstanding. ReceiveUpcall
+// already ignores replies with no outstanding request; to tell the duplicates
+// among them from replies that were never expected, the stats remember the most
+// recently settled ClientIDs, in a bounded LRU so that long runs stay small.
+
+// completedLimit is the number of settled ClientIDs remembered.
+const completedLimit = 1 << 16
+
+// duplicateState is the part of a Collector kept here.
+type duplicateState struct {
+	completedIDs  map[int]*list.Element // ClientID -> its element of completedLRU
+	completedLRU  *list.List            // settled ClientIDs, most recently used first
+	duplicateReps int                   // replies to requests already settled
+}
+
+// resetDuplicatesLocked forgets the settled requests; ResetStats calls it.
+func (c *Collector) resetDuplicatesLocked() {
+	c.completedIDs = make(map[int]*list.Element)
+	c.completedLRU = list.New()
+	c.duplicateReps = 0
+}
+
+// completeLocked remembers that the request with the given ClientID is settled.
+func (c *Collector) completeLocked(clientID int) {
+	if e, ok := c.completedIDs[clientID]; ok {
+		c.completedLRU.MoveToFront(e)
+		return
+	}
+	c.completedIDs[clientID] = c.completedLRU.PushFront(clientID)
+	if c.completedLRU.Len() > completedLimit {
+		oldest := c.completedLRU.Back()
+		c.completedLRU.Remove(oldest)
+		delete(c.completedIDs, oldest.Value.(int))
+	}
+}
+
+// duplicateLocked reports whether rep, a reply with no outstanding request, answers
+// a request settled recently, and counts it if so.
+func (c *Collector) duplicateLocked(rep Request) bool {
+	e, ok := c.completedIDs[rep.ClientID]
+	if !ok {
+		return false
+	}
+	c.completedLRU.MoveToFront(e)
+	c.duplicateReps++
+	return true
+}
+
+// GetDuplicates returns the number of replies since the last ResetStats that
+// answered a request already settled and were ignored.
+func GetDuplicates() int { return defaultCollector.GetDuplicates() }
+
+// GetDuplicates is the package function GetDuplicates for c.
+func (c *Collector) GetDuplicates() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.duplicateReps
+}
@@ -0,0 +1,37 @@
+package goose
+
+import "testing"
+
+func TestDuplicateReplies(t *testing.T) {
+	ResetStats()
+	SendUpcall(Request{ClientID: 1}, false)
+	ReceiveUpcall(Request{ClientID: 1})
+	ReceiveUpcall(Request{ClientID: 1})  // a duplicate
+	ReceiveUpcall(Request{ClientID: 99}) // never sent
+	if d := GetDuplicates(); d != 1 {
+		t.Errorf("%d duplicates, want 1", d)
+	}
+	if _, _, _, received, _ := GetStats(); received != 1 {
+		t.Errorf("%d replies recorded, want only the first", received)
+	}
+}
+
+// Only the most recently settled requests are remembered.
+func TestDuplicatesBounded(t *testing.T) {
+	c := defaultCollector
+	ResetStats()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id := 0; id <= completedLimit; id++ {
+		c.completeLocked(id)
+	}
+	if c.completedLRU.Len() != completedLimit || len(c.completedIDs) != completedLimit {
+		t.Errorf("%d settled requests remembered, want %d", c.completedLRU.Len(), completedLimit)
+	}
+	if c.duplicateLocked(Request{ClientID: 0}) {
+		t.Error("the oldest request is still remembered")
+	}
+	if !c.duplicateLocked(Request{ClientID: completedLimit}) {
+		t.Error("the newest request is forgotten")
+	}
+}
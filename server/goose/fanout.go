@@ -0,0 +1,139 @@
+package goose
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// -------------------- scatter-gather --------------------
+
+// ScatterGather is a Handler that splits each request into K subrequests, serves them
+// concurrently with Leaf, and replies when all K are done. Each subrequest draws its
+// own exponentially distributed wait demand, so the response time is the maximum of
+// K service times, which shows how a rare slow leaf comes to dominate the tail as K
+// grows ("the tail at scale").
+//
+// With HedgeAfterMs set, a leaf that has not finished by then gets a duplicate with a
+// fresh demand; whichever copy finishes first is used and the other is cancelled.
+type ScatterGather struct {
+	K                int
+	LeafDemandMeanMs float64 // mean wait demand of each subrequest
+	HedgeAfterMs     float64 // if positive, hedge leaves slower than this
+	Leaf             Handler // nil means DemandHandler
+
+	leaves    atomic.Int64
+	hedges    atomic.Int64
+	hedgeWins atomic.Int64
+}
+
+// FanoutStats counts the subrequests served by a ScatterGather.
+type FanoutStats struct {
+	Leaves    int // subrequests (not counting hedges)
+	Hedges    int // duplicate subrequests sent
+	HedgeWins int // hedges that finished before the original
+}
+
+// Stats returns the counts so far.
+func (sg *ScatterGather) Stats() FanoutStats {
+	return FanoutStats{
+		Leaves:    int(sg.leaves.Load()),
+		Hedges:    int(sg.hedges.Load()),
+		HedgeWins: int(sg.hedgeWins.Load()),
+	}
+}
+
+// Serve scatters r to K leaves, gathers their replies, and then pays r's reply cost.
+// If any leaf is cancelled, so is the reply.
+func (sg *ScatterGather) Serve(r Request) Request {
+	k := sg.K
+	if k <= 0 {
+		k = 1
+	}
+	results := make(chan Request, k)
+	for i := 0; i < k; i++ {
+		go func() { results <- sg.leaf(r) }()
+	}
+	rep := r
+	for i := 0; i < k; i++ {
+		if lr := <-results; lr.Status != StatusOK && rep.Status == StatusOK {
+			rep.Status = lr.Status
+		}
+	}
+	if rep.Status == StatusOK && r.ReplyCost > 0 {
+		tail := r
+		tail.WorkDemand, tail.WaitDemand = 0, 0
+		rep.Status = serveDemand(tail).Status
+	}
+	return rep
+}
+
+// leafCopy is the reply of one copy of a subrequest.
+type leafCopy struct {
+	rep   Request
+	hedge bool
+}
+
+// leaf serves one subrequest of r, hedging it if it is slow.
+func (sg *ScatterGather) leaf(r Request) Request {
+	h := sg.Leaf
+	if h == nil {
+		h = DemandHandler
+	}
+	sg.leaves.Add(1)
+
+	// stop cancels whatever copies are still running: the loser of a hedge,
+	// or all of them when the client gives up.
+	stop := make(chan struct{})
+	var once sync.Once
+	cancel := func() { once.Do(func() { close(stop) }) }
+	defer cancel()
+	if r.Cancel != nil {
+		go func() {
+			select {
+			case <-r.Cancel:
+				cancel()
+			case <-stop:
+			}
+		}()
+	}
+
+	copies := make(chan leafCopy, 2)
+	send := func(hedge bool) {
+		sub := r
+		sub.WorkDemand, sub.ReplyCost = 0, 0
+		sub.WaitDemand = int(rand.ExpFloat64() * sg.LeafDemandMeanMs)
+		sub.Cancel = stop
+		go func() { copies <- leafCopy{rep: safeServe(h, sub), hedge: hedge} }()
+	}
+	send(false)
+
+	var hedgeC <-chan time.Time
+	if sg.HedgeAfterMs > 0 {
+		t := time.NewTimer(time.Duration(sg.HedgeAfterMs * float64(time.Millisecond)))
+		defer t.Stop()
+		hedgeC = t.C
+	}
+	for {
+		select {
+		case <-hedgeC:
+			hedgeC = nil
+			sg.hedges.Add(1)
+			send(true)
+		case c := <-copies:
+			if c.hedge {
+				sg.hedgeWins.Add(1)
+			}
+			return c.rep
+		}
+	}
+}
+
+// PrintFanoutStats prints the counts of a ScatterGather on one line.
+func PrintFanoutStats(sg *ScatterGather) {
+	st := sg.Stats()
+	fmt.Printf("fanout=%d hedge=%.0fms leaves=%d hedges=%d hedgeWins=%d\n",
+		sg.K, sg.HedgeAfterMs, st.Leaves, st.Hedges, st.HedgeWins)
+}
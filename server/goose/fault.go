@@ -0,0 +1,151 @@
+package goose
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// -------------------- failure injection --------------------
+
+// Fault tags set in Request.Fault on replies affected by an injected failure.
+const (
+	FaultError = "error" // the application replied with StatusFailed
+	FaultPanic = "panic" // the application panicked; the server recovered and replied with StatusFailed
+	FaultStall = "stall" // the request stalled (like a long GC pause) before being served normally
+)
+
+// FaultConfig gives the probability of each kind of injected failure per request.
+// At most one fault is injected into any request.
+type FaultConfig struct {
+	ErrorProb float64 // reply with StatusFailed instead of serving
+	PanicProb float64 // panic in the application
+	StallProb float64 // stall for StallMs before serving
+	StallMs   float64 // default 200
+	DropProb  float64 // serve, then discard the reply (the server counts it as shed)
+}
+
+// FaultInjector is a Handler middleware that makes an inner Handler fail now and then,
+// so that error rates, their effect on latency, and the middleware that copes with
+// them (such as CircuitBreaker) can be studied. Every affected reply carries a Fault
+// tag, which ReceiveUpcall tallies; see GetFaultStats.
+type FaultInjector struct {
+	h Handler
+
+	mu  sync.Mutex
+	cfg FaultConfig
+	rng *rand.Rand
+}
+
+// NewFaultInjector wraps h (nil means DemandHandler) in a FaultInjector.
+func NewFaultInjector(h Handler, cfg FaultConfig) *FaultInjector {
+	if h == nil {
+		h = DemandHandler
+	}
+	fi := &FaultInjector{h: h, rng: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	fi.SetConfig(cfg)
+	return fi
+}
+
+// SetConfig changes the probabilities of the faults, for requests served from now on.
+func (fi *FaultInjector) SetConfig(cfg FaultConfig) {
+	if cfg.StallMs <= 0 {
+		cfg.StallMs = 200
+	}
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.cfg = cfg
+}
+
+// Config returns the current probabilities of the faults.
+func (fi *FaultInjector) Config() FaultConfig {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	return fi.cfg
+}
+
+// Serve serves r with the inner Handler, unless a fault is drawn for it.
+func (fi *FaultInjector) Serve(r Request) Request {
+	fi.mu.Lock()
+	x := fi.rng.Float64()
+	cfg := fi.cfg
+	fi.mu.Unlock()
+
+	switch {
+	case x < cfg.ErrorProb:
+		r.Status = StatusFailed
+		r.Fault = FaultError
+		return r
+	case x < cfg.ErrorProb+cfg.PanicProb:
+		panic(fmt.Sprintf("goose: injected panic serving request %d", r.ClientID))
+	case x < cfg.ErrorProb+cfg.PanicProb+cfg.StallProb:
+		if !sleepOrCancel(int(cfg.StallMs), r.Cancel) {
+			r.Status = StatusCancelled
+			r.Fault = FaultStall
+			return r
+		}
+		rep := fi.h.Serve(r)
+		rep.Fault = FaultStall
+		return rep
+	case x < cfg.ErrorProb+cfg.PanicProb+cfg.StallProb+cfg.DropProb:
+		rep := fi.h.Serve(r)
+		if rep.Status == StatusOK {
+			rep.Status = StatusDropped // the work was done; the reply is lost
+		}
+		return rep
+	}
+	return fi.h.Serve(r)
+}
+
+// FaultStats summarizes the replies that carried one fault tag.
+type FaultStats struct {
+	Fault  string
+	Count  int
+	MeanRT float64 // milliseconds
+	P99    float64 // milliseconds
+}
+
+// GetFaultStats returns the replies received per fault tag since the last
+// ResetStats, with their response times, sorted by tag.
+func GetFaultStats() []FaultStats { return defaultCollector.GetFaultStats() }
+
+// GetFaultStats is the package function GetFaultStats for c.
+func (c *Collector) GetFaultStats() []FaultStats {
+	c.mu.Lock()
+	byFault := make(map[string][]time.Duration, len(c.faultSamples))
+	counts := make(map[string]int, len(c.faultCounts))
+	for f, samps := range c.faultSamples {
+		byFault[f] = append([]time.Duration(nil), samps...)
+		counts[f] = c.faultCounts[f]
+	}
+	c.mu.Unlock()
+
+	var out []FaultStats
+	for f, samps := range byFault {
+		var sum time.Duration
+		for _, d := range samps {
+			sum += d
+		}
+		out = append(out, FaultStats{
+			Fault:  f,
+			Count:  counts[f],
+			MeanRT: float64(sum.Microseconds()) / 1000.0 / float64(len(samps)),
+			P99:    percentileOf(samps, 99),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Fault < out[j].Fault })
+	return out
+}
+
+// PrintFaultStats prints one line per fault tag seen, with the error rate over sent requests.
+func PrintFaultStats(sentN int) {
+	for _, f := range GetFaultStats() {
+		rate := 0.0
+		if sentN > 0 {
+			rate = float64(f.Count) / float64(sentN)
+		}
+		fmt.Printf("fault=%s count=%d rate=%.3f meanRT=%.3fms p99RT=%.3fms\n", f.Fault, f.Count, rate, f.MeanRT, f.P99)
+	}
+}
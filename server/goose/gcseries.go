@@ -0,0 +1,247 @@
+package goose
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/metrics"
+	"sort"
+	"strings"
+	"time"
+)
+
+// -------------------- GC pauses and the latency time series --------------------
+
+// GCPause is one stop-the-world pause of the garbage collector.
+type GCPause struct {
+	End      time.Time
+	Duration time.Duration
+}
+
+// seriesBucket accumulates the OK replies completed in one interval of the series.
+type seriesBucket struct {
+	count int
+	sum   time.Duration
+	max   time.Duration
+}
+
+// seriesState is the part of a Collector kept here.
+type seriesState struct {
+	seriesEvery time.Duration   // bucket width of the latency series; 0 turns it off. Kept across ResetStats
+	seriesStart time.Time       // when the series began (the last ResetStats)
+	series      []seriesBucket  // OK replies by completion time
+	gcPauses    []GCPause       // pauses reported by the GC watch since the last ResetStats, in order
+	gcSpanning  []time.Duration // response times of OK replies during which a GC pause ended
+	gcSpanSeen  int             // replies offered to gcSpanning
+}
+
+// SetLatencySeries makes the package stats keep a time series of the OK replies'
+// response times, in buckets of the given width by completion time; 0 (the default)
+// turns it off. Set it before an experiment starts.
+func SetLatencySeries(every time.Duration) { defaultCollector.SetLatencySeries(every) }
+
+// SetLatencySeries is the package function SetLatencySeries for c.
+func (c *Collector) SetLatencySeries(every time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seriesEvery = max(every, 0)
+}
+
+// resetSeriesLocked clears the series and the GC pauses.
+func (c *Collector) resetSeriesLocked() {
+	c.seriesStart = time.Now()
+	c.series = nil
+	c.gcPauses = nil
+	c.gcSpanning = nil
+	c.gcSpanSeen = 0
+}
+
+// recordSeriesLocked records an OK reply sent at start that took rt.
+func (c *Collector) recordSeriesLocked(start time.Time, rt time.Duration) {
+	if c.seriesEvery <= 0 {
+		return
+	}
+	end := start.Add(rt)
+	i := int(end.Sub(c.seriesStart) / c.seriesEvery)
+	if i < 0 {
+		return
+	}
+	for len(c.series) <= i {
+		c.series = append(c.series, seriesBucket{})
+	}
+	b := &c.series[i]
+	b.count++
+	b.sum += rt
+	b.max = max(b.max, rt)
+
+	// Did a GC pause end while the request was out? The pause list lags the
+	// runtime by up to the GC watch's polling interval.
+	for j := len(c.gcPauses) - 1; j >= 0 && c.gcPauses[j].End.After(start); j-- {
+		if !c.gcPauses[j].End.After(end) {
+			c.gcSpanSeen++
+			c.gcSpanning = c.reservoirAdd(c.gcSpanning, c.gcSpanSeen, rt)
+			break
+		}
+	}
+}
+
+// StartGCWatch polls the runtime for completed GC cycles every millisecond and
+// records their pauses in the package stats (see GetGCPauses), until the returned
+// stop function is called.
+func StartGCWatch() (stop func()) { return defaultCollector.StartGCWatch() }
+
+// StartGCWatch is the package function StartGCWatch, recording in c.
+func (c *Collector) StartGCWatch() (stop func()) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		cycles := []metrics.Sample{{Name: "/gc/cycles/total:gc-cycles"}}
+		metrics.Read(cycles)
+		last := uint32(cycles[0].Value.Uint64())
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+		var ms runtime.MemStats
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			metrics.Read(cycles)
+			if uint32(cycles[0].Value.Uint64()) == last {
+				continue
+			}
+			runtime.ReadMemStats(&ms)
+			// MemStats keeps the last 256 pauses in a circular buffer
+			first := max(last, ms.NumGC-min(ms.NumGC, uint32(len(ms.PauseNs))))
+			var pauses []GCPause
+			for k := first; k < ms.NumGC; k++ {
+				i := k % uint32(len(ms.PauseNs))
+				pauses = append(pauses, GCPause{
+					End:      time.Unix(0, int64(ms.PauseEnd[i])),
+					Duration: time.Duration(ms.PauseNs[i]),
+				})
+			}
+			last = ms.NumGC
+			c.mu.Lock()
+			for _, p := range pauses {
+				if p.End.After(c.seriesStart) {
+					c.gcPauses = append(c.gcPauses, p)
+				}
+			}
+			c.mu.Unlock()
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+// GetGCPauses returns the GC pauses seen by the GC watch since the last ResetStats.
+func GetGCPauses() []GCPause { return defaultCollector.GetGCPauses() }
+
+// GetGCPauses is the package function GetGCPauses for c.
+func (c *Collector) GetGCPauses() []GCPause {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]GCPause(nil), c.gcPauses...)
+}
+
+// SeriesPoint is one bucket of the latency time series, annotated with the GC
+// pauses that ended in it.
+type SeriesPoint struct {
+	Offset    time.Duration // start of the bucket, from the start of the run
+	Count     int           // OK replies completed in the bucket
+	MeanMs    float64
+	MaxMs     float64
+	GCPauses  int
+	GCPauseMs float64 // total pause time
+
+	Events []string // chaos events played in the bucket (see StartChaos)
+}
+
+// GetLatencySeries returns the latency time series since the last ResetStats (see
+// SetLatencySeries), with the GC pauses recorded by StartGCWatch and the events
+// played by StartChaos.
+func GetLatencySeries() []SeriesPoint { return defaultCollector.GetLatencySeries() }
+
+// GetLatencySeries is the package function GetLatencySeries for c.
+func (c *Collector) GetLatencySeries() []SeriesPoint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.seriesEvery <= 0 {
+		return nil
+	}
+	points := make([]SeriesPoint, len(c.series))
+	for i, b := range c.series {
+		points[i] = SeriesPoint{Offset: time.Duration(i) * c.seriesEvery, Count: b.count, MaxMs: durationMs(b.max)}
+		if b.count > 0 {
+			points[i].MeanMs = durationMs(b.sum) / float64(b.count)
+		}
+	}
+	for _, p := range c.gcPauses {
+		i := int(p.End.Sub(c.seriesStart) / c.seriesEvery)
+		if i < 0 || i >= len(points) {
+			continue
+		}
+		points[i].GCPauses++
+		points[i].GCPauseMs += durationMs(p.Duration)
+	}
+	for _, m := range c.chaosMarks {
+		i := int(m.at.Sub(c.seriesStart) / c.seriesEvery)
+		if i < 0 || i >= len(points) {
+			continue
+		}
+		points[i].Events = append(points[i].Events, m.what)
+	}
+	return points
+}
+
+func durationMs(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+
+// PrintLatencySeries prints one line per bucket, marking the buckets in which the
+// garbage collector paused the program or a chaos event was played.
+func PrintLatencySeries(points []SeriesPoint) {
+	fmt.Printf("%10s %8s %10s %10s\n", "t", "replies", "mean(ms)", "max(ms)")
+	for _, p := range points {
+		fmt.Printf("%10s %8d %10.3f %10.3f", p.Offset, p.Count, p.MeanMs, p.MaxMs)
+		if p.GCPauses > 0 {
+			fmt.Printf("  <- GC: %d pause(s), %.3fms", p.GCPauses, p.GCPauseMs)
+		}
+		if len(p.Events) > 0 {
+			fmt.Printf("  <- chaos: %s", strings.Join(p.Events, "; "))
+		}
+		fmt.Println()
+	}
+}
+
+// PrintGCImpact compares the response times of the replies that were outstanding
+// when a GC pause ended with those of all replies, and estimates how much of the
+// tail beyond the 99th percentile such replies account for. If they make up most
+// of it, the tail is the runtime's doing rather than the server's.
+func PrintGCImpact() {
+	c := defaultCollector
+	c.mu.Lock()
+	pauses, spanning, spanSeen := len(c.gcPauses), append([]time.Duration(nil), c.gcSpanning...), c.gcSpanSeen
+	all, total := append([]time.Duration(nil), c.samples...), c.received
+	c.mu.Unlock()
+	if total == 0 {
+		return
+	}
+	p99 := percentileOf(all, 99)
+	fmt.Printf("gc: pauses=%d replies spanning a pause=%d (%.1f%%)", pauses, spanSeen, 100*float64(spanSeen)/float64(total))
+	if len(spanning) == 0 {
+		fmt.Println()
+		return
+	}
+	sort.Slice(spanning, func(i, j int) bool { return spanning[i] < spanning[j] })
+	above := len(spanning) - sort.Search(len(spanning), func(i int) bool {
+		return durationMs(spanning[i]) > p99
+	})
+	// scale up from the reservoir, if sampling, to the number of such replies
+	tail := float64(above) / float64(len(spanning)) * float64(spanSeen)
+	tailAll := max(1, float64(total)/100)
+	fmt.Printf(" p50=%.3fms p99=%.3fms (all: p50=%.3fms p99=%.3fms) share of tail beyond p99=%.0f%%\n",
+		percentileOf(spanning, 50), percentileOf(spanning, 99), percentileOf(all, 50), p99, min(100, 100*tail/tailAll))
+}
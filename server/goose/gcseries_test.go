@@ -0,0 +1,69 @@
+package goose
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestLatencySeries(t *testing.T) {
+	c := defaultCollector
+	SetLatencySeries(10 * time.Millisecond)
+	defer SetLatencySeries(0)
+	ResetStats()
+	c.mu.Lock()
+	t0 := c.seriesStart
+	// a GC pause 25ms in, during the second request only
+	c.gcPauses = append(c.gcPauses, GCPause{End: t0.Add(25 * time.Millisecond), Duration: 2 * time.Millisecond})
+	c.recordSeriesLocked(t0, 5*time.Millisecond)
+	c.recordSeriesLocked(t0.Add(20*time.Millisecond), 9*time.Millisecond)
+	c.recordSeriesLocked(t0.Add(21*time.Millisecond), 3*time.Millisecond)
+	c.mu.Unlock()
+
+	points := GetLatencySeries()
+	if len(points) != 3 {
+		t.Fatalf("%d buckets, want 3", len(points))
+	}
+	if p := points[0]; p.Count != 1 || p.MeanMs != 5 || p.GCPauses != 0 {
+		t.Errorf("bucket 0: %+v, want one 5ms reply and no pause", p)
+	}
+	if p := points[1]; p.Count != 0 {
+		t.Errorf("bucket 1: %+v, want it empty", p)
+	}
+	if p := points[2]; p.Offset != 20*time.Millisecond || p.Count != 2 || p.MeanMs != 6 || p.MaxMs != 9 ||
+		p.GCPauses != 1 || p.GCPauseMs != 2 {
+		t.Errorf("bucket 2: %+v, want two replies (mean 6ms, max 9ms) and one 2ms pause", p)
+	}
+	c.mu.Lock()
+	spanning := append([]time.Duration(nil), c.gcSpanning...)
+	c.mu.Unlock()
+	if len(spanning) != 1 || spanning[0] != 9*time.Millisecond {
+		t.Errorf("replies spanning a pause: %v, want the 9ms one", spanning)
+	}
+}
+
+func TestLatencySeriesOff(t *testing.T) {
+	c := defaultCollector
+	SetLatencySeries(0)
+	ResetStats()
+	c.mu.Lock()
+	c.recordSeriesLocked(time.Now(), time.Millisecond)
+	c.mu.Unlock()
+	if points := GetLatencySeries(); points != nil {
+		t.Errorf("series %v with it off, want nil", points)
+	}
+}
+
+func TestGCWatch(t *testing.T) {
+	c := defaultCollector
+	ResetStats()
+	stop := StartGCWatch()
+	runtime.GC()
+	waitFor(t, "the GC watch to see the pause", func() bool { return len(GetGCPauses()) > 0 })
+	stop()
+	for _, p := range GetGCPauses() {
+		if p.End.Before(c.seriesStart) || p.Duration < 0 {
+			t.Errorf("pause %+v, want one ending after the reset", p)
+		}
+	}
+}
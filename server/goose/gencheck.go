@@ -0,0 +1,253 @@
+package goose
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// -------------------- checking the generated workload --------------------
+
+// GenUpcall records the values Loadgen generated for an arrival: the actual time
+// since the previous arrival (timer delays included), how long after its intended
+// time the arrival happened, and r's demand.
+func GenUpcall(iat, slip time.Duration, r Request) { defaultCollector.GenUpcall(iat, slip, r) }
+
+// GenUpcall is the package function GenUpcall for c.
+func (c *Collector) GenUpcall(iat, slip time.Duration, r Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	demand := time.Duration(r.WorkDemand+r.WaitDemand) * time.Millisecond
+	c.genCount++
+	c.genIatSum += iat
+	c.genDemandSum += demand
+	c.genIats = c.reservoirAdd(c.genIats, c.genCount, iat)
+	c.genDemands = c.reservoirAdd(c.genDemands, c.genCount, demand)
+	c.genSlips = c.reservoirAdd(c.genSlips, c.genCount, slip)
+	c.genSlipSum += slip
+	if slip > c.genSlipMax {
+		c.genSlipMax = slip
+	}
+}
+
+// Slippage summarizes how far behind its intended schedule Loadgen sent arrivals.
+type Slippage struct {
+	N      int
+	MeanMs float64
+	P99Ms  float64
+	MaxMs  float64
+}
+
+// GetSlippage returns the schedule slippage of the arrivals since the last ResetStats.
+func GetSlippage() Slippage { return defaultCollector.GetSlippage() }
+
+// GetSlippage is the package function GetSlippage for c.
+func (c *Collector) GetSlippage() Slippage {
+	c.mu.Lock()
+	sl := Slippage{N: c.genCount, MaxMs: float64(c.genSlipMax.Microseconds()) / 1000.0}
+	if c.genCount > 0 {
+		sl.MeanMs = float64(c.genSlipSum.Microseconds()) / 1000.0 / float64(c.genCount)
+	}
+	slips := append([]time.Duration(nil), c.genSlips...)
+	c.mu.Unlock()
+	sl.P99Ms = percentileOf(slips, 99)
+	return sl
+}
+
+// PrintSlippage prints the schedule slippage on one line.
+func PrintSlippage() {
+	sl := GetSlippage()
+	fmt.Printf("slippage: n=%d mean=%.3fms p99=%.3fms max=%.3fms\n", sl.N, sl.MeanMs, sl.P99Ms, sl.MaxMs)
+}
+
+// DistCheck compares the empirical distribution of one generated quantity with the
+// distribution it was configured to have, using the Kolmogorov-Smirnov distance:
+// the largest gap between the empirical and the expected CDF.
+type DistCheck struct {
+	Name         string
+	N            int     // values recorded
+	Mean         float64 // milliseconds
+	ExpectedMean float64 // milliseconds
+	KS           float64 // Kolmogorov-Smirnov distance D
+	Critical     float64 // D above this rejects the configured distribution at the 5% level
+}
+
+// floored is the distribution of a demand rounded down to whole milliseconds:
+// cdf(k) is the probability of at most k, and mean the mean.
+type floored struct {
+	cdf  func(k float64) float64
+	mean float64
+}
+
+// flooredDemand returns the floored distribution of demands drawn as Class.draw
+// draws them, with the given mean.
+func flooredDemand(dist DemandDist, mean, sigma float64) floored {
+	if mean <= 0 {
+		return floored{cdf: func(float64) float64 { return 1 }}
+	}
+	switch dist {
+	case DemandConst:
+		m := math.Floor(mean)
+		return floored{cdf: func(k float64) float64 {
+			if k >= m {
+				return 1
+			}
+			return 0
+		}, mean: m}
+	case DemandLognormal:
+		if sigma <= 0 {
+			sigma = 1
+		}
+		mu := math.Log(mean) - sigma*sigma/2
+		below := func(x float64) float64 { // P(X < x)
+			if x <= 0 {
+				return 0
+			}
+			return 0.5 * math.Erfc(-(math.Log(x)-mu)/(sigma*math.Sqrt2))
+		}
+		// the mean of floor(X) is the sum over k >= 1 of P(X >= k)
+		m := 0.0
+		for k := 1.0; k < 1e6; k++ {
+			tail := 1 - below(k)
+			if tail < 1e-9 {
+				break
+			}
+			m += tail
+		}
+		return floored{cdf: func(k float64) float64 { return below(k + 1) }, mean: m}
+	}
+	return floored{cdf: func(k float64) float64 { return 1 - math.Exp(-(k+1)/mean) }, mean: 1 / math.Expm1(1/mean)}
+}
+
+// Fits reports whether the values are consistent with the configured distribution.
+func (c DistCheck) Fits() bool { return c.KS <= c.Critical }
+
+// CheckGenerator compares the inter-arrival times and demands recorded since the
+// last ResetStats with the distributions Loadgen was configured with: exponential
+// for iatMeanMs and demandMeanMs as passed to it, and for classes as in LoadOptions
+// their own. Demands are whole milliseconds (the drawn value rounded down), so they
+// are compared with the rounded-down distribution, whose mean is a little lower.
+// With a sample limit (see SetSampleLimit) the distances are over a sample.
+func CheckGenerator(iatMeanMs, demandMeanMs float64, classes []Class) []DistCheck {
+	return defaultCollector.CheckGenerator(iatMeanMs, demandMeanMs, classes)
+}
+
+// CheckGenerator is the package function CheckGenerator for c.
+func (c *Collector) CheckGenerator(iatMeanMs, demandMeanMs float64, classes []Class) []DistCheck {
+	c.mu.Lock()
+	n := c.genCount
+	iats := append([]time.Duration(nil), c.genIats...)
+	demands := append([]time.Duration(nil), c.genDemands...)
+	iatSum, demandSum := c.genIatSum, c.genDemandSum
+	c.mu.Unlock()
+
+	if n == 0 {
+		return nil
+	}
+
+	// the demand mix: one floored distribution per class, weighted
+	type part struct {
+		weight float64
+		floored
+	}
+	mix := []part{{1, flooredDemand(DemandExp, demandMeanMs, 0)}}
+	if len(classes) > 0 {
+		mix = mix[:0]
+		for i := range classes {
+			c := &classes[i]
+			mean := c.DemandMeanMs
+			if mean <= 0 {
+				mean = demandMeanMs
+			}
+			mix = append(mix, part{classWeight(c), flooredDemand(c.Dist, mean, c.Sigma)})
+		}
+	}
+	total := 0.0
+	for _, p := range mix {
+		total += p.weight
+	}
+	flooredCDF := func(k float64) float64 {
+		f := 0.0
+		for _, p := range mix {
+			f += p.weight * p.cdf(k)
+		}
+		return f / total
+	}
+	flooredMean := 0.0
+	for _, p := range mix {
+		flooredMean += p.weight * p.mean
+	}
+	flooredMean /= total
+
+	iat := DistCheck{
+		Name:         "iat",
+		N:            n,
+		Mean:         float64(iatSum.Microseconds()) / 1000.0 / float64(n),
+		ExpectedMean: iatMeanMs,
+		KS: ksContinuous(iats, func(x float64) float64 {
+			if iatMeanMs <= 0 {
+				return 1
+			}
+			return 1 - math.Exp(-x/iatMeanMs)
+		}),
+		Critical: ksCritical(len(iats)),
+	}
+	demand := DistCheck{
+		Name:         "demand",
+		N:            n,
+		Mean:         float64(demandSum.Microseconds()) / 1000.0 / float64(n),
+		ExpectedMean: flooredMean,
+		KS:           ksDiscrete(demands, flooredCDF),
+		Critical:     ksCritical(len(demands)),
+	}
+	return []DistCheck{iat, demand}
+}
+
+// ksContinuous returns the Kolmogorov-Smirnov distance between the samples and the
+// continuous CDF cdf of milliseconds. It sorts samps in place.
+func ksContinuous(samps []time.Duration, cdf func(ms float64) float64) float64 {
+	sort.Slice(samps, func(i, j int) bool { return samps[i] < samps[j] })
+	n := float64(len(samps))
+	d := 0.0
+	for i, s := range samps {
+		f := cdf(float64(s.Microseconds()) / 1000.0)
+		d = math.Max(d, math.Max(float64(i+1)/n-f, f-float64(i)/n))
+	}
+	return d
+}
+
+// ksDiscrete is ksContinuous for samples that are whole milliseconds, against the
+// CDF of a distribution over whole milliseconds: both step only at the integers.
+func ksDiscrete(samps []time.Duration, cdf func(ms float64) float64) float64 {
+	sort.Slice(samps, func(i, j int) bool { return samps[i] < samps[j] })
+	n := float64(len(samps))
+	d := 0.0
+	for i, s := range samps {
+		if i+1 < len(samps) && samps[i+1] == s {
+			continue // compare at the last sample of each value
+		}
+		d = math.Max(d, math.Abs(float64(i+1)/n-cdf(float64(s/time.Millisecond))))
+	}
+	return d
+}
+
+// ksCritical returns the Kolmogorov-Smirnov critical value at the 5% level for n samples.
+func ksCritical(n int) float64 {
+	if n == 0 {
+		return 0
+	}
+	return 1.36 / math.Sqrt(float64(n))
+}
+
+// PrintGeneratorCheck prints one line per check.
+func PrintGeneratorCheck(checks []DistCheck) {
+	for _, c := range checks {
+		verdict := "ok"
+		if !c.Fits() {
+			verdict = "MISMATCH"
+		}
+		fmt.Printf("%s: n=%d mean=%.3fms expected=%.3fms KS=%.4f critical=%.4f %s\n",
+			c.Name, c.N, c.Mean, c.ExpectedMean, c.KS, c.Critical, verdict)
+	}
+}
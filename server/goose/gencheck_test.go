@@ -0,0 +1,31 @@
+package goose
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSlippage(t *testing.T) {
+	ResetStats()
+	for _, ms := range []int{0, 1, 2, 5} {
+		GenUpcall(time.Millisecond, time.Duration(ms)*time.Millisecond, Request{})
+	}
+	if sl := GetSlippage(); sl.N != 4 || sl.MeanMs != 2 || sl.MaxMs != 5 || sl.P99Ms != 5 {
+		t.Errorf("slippage %+v, want 4 arrivals, mean 2ms, max 5ms", sl)
+	}
+}
+
+// At a rate faster than the timer fires, batched arrivals keep to the schedule
+// in bursts, and every arrival's slippage is recorded.
+func TestBatchArrivalsKeepRate(t *testing.T) {
+	res := RunExperiment(Experiment{N: 200, IatMean: 0.1, MaxConcurrent: 64, Load: LoadOptions{BatchArrivals: true}})
+	if res.Sent+res.Skipped != 200 || res.Received != res.Sent {
+		t.Fatalf("sent %d, skipped %d, received %d of 200", res.Sent, res.Skipped, res.Received)
+	}
+	if res.Elapsed > 200*time.Millisecond {
+		t.Errorf("200 arrivals 0.1ms apart took %v", res.Elapsed)
+	}
+	if sl := GetSlippage(); sl.N != 200 {
+		t.Errorf("slippage of %d arrivals, want 200", sl.N)
+	}
+}
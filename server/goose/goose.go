@@ -4,21 +4,110 @@ package goose
 
 import (
 	//	"sync"
+	"runtime"
+	"sync/atomic"
 	"time"
 )
 
 type Request struct {
-	ClientID   int
-	ObjectID   int
-	WorkDemand int // milliseconds (CPU work)
-	WaitDemand int // milliseconds (sleep)
-	ReplyCh    chan<- Request
+	ClientID    int
+	ObjectID    int
+	WorkDemand  int  // milliseconds (CPU work)
+	WaitDemand  int  // milliseconds (sleep)
+	IODemand    int  // kilobytes read from the simulated disk (see SetDisk)
+	AllocDemand int  // kilobytes of memory allocated, touched, and held for the service
+	ReplyCost   int  // milliseconds to produce the reply after the demands (e.g. a large read)
+	ReplyCPU    bool // whether ReplyCost burns CPU rather than sleeping
+	ReplyCh     chan<- Request
+	Cancel      <-chan struct{} // optional: closed when the client gives up on the request
+	Deadline    time.Time       // optional: when the reply stops being useful (zero means none)
+	Status      ReplyStatus     // set by the server on the reply
+	Hedge       bool            // a duplicate sent by Loadgen's hedging
+	Fault       string          // set on the reply when the server injected a failure
+	Code        int             // HTTP status code of the reply, for HTTP targets
+	Tag         string          // optional workload class, for per-tag statistics
+	Priority    int             // higher is served first under DisciplinePriority
+	TenantID    int             // optional tenant, numbered from 1, for DisciplineFair and per-tenant statistics
 }
 
+// ReplyStatus tells the client how the server disposed of a request.
+type ReplyStatus int
+
+const (
+	StatusOK        ReplyStatus = iota // served normally
+	StatusRejected                     // refused at admission and not served
+	StatusDropped                      // discarded by the server without a reply (stats only)
+	StatusTimedOut                     // the client gave up waiting (stats only)
+	StatusCancelled                    // the server abandoned the work after the client gave up
+	StatusFailed                       // the application failed and replied with an error
+)
+
+func (s ReplyStatus) String() string {
+	switch s {
+	case StatusOK:
+		return "ok"
+	case StatusRejected:
+		return "rejected"
+	case StatusDropped:
+		return "dropped"
+	case StatusTimedOut:
+		return "timed-out"
+	case StatusCancelled:
+		return "cancelled"
+	case StatusFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// Cancelled reports whether the client has given up on r.
+func (r Request) Cancelled() bool {
+	select {
+	case <-r.Cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+// Handler is a server application plugged into ReqHandler: it serves one request
+// and returns the reply. ReqHandler takes care of concurrency and of delivering
+// the reply on the request's ReplyCh.
+type Handler interface {
+	Serve(r Request) Request
+}
+
+// HandlerFunc adapts an ordinary function to the Handler interface.
+type HandlerFunc func(r Request) Request
+
+func (f HandlerFunc) Serve(r Request) Request {
+	return f(r)
+}
+
+// DemandHandler is the default application: it expends the demanded resources
+// and replies with a copy of the request.
+var DemandHandler Handler = HandlerFunc(serveDemand)
+
 type Permission struct{}
 
+// inFlight counts requests currently inside serve.
+var inFlight atomic.Int64
+
+// InFlight returns the number of requests currently being served.
+func InFlight() int {
+	return int(inFlight.Load())
+}
+
 // OK!
 func ReqHandler(reqCh <-chan Request, maxConcurrent int) {
+	ReqHandlerWith(reqCh, maxConcurrent, DemandHandler)
+}
+
+// ReqHandlerWith is ReqHandler with a pluggable application h.
+func ReqHandlerWith(reqCh <-chan Request, maxConcurrent int, h Handler) {
+	if h == nil {
+		h = DemandHandler
+	}
 	if maxConcurrent <= 0 {
 		maxConcurrent = 1
 	}
@@ -31,7 +120,7 @@ func ReqHandler(reqCh <-chan Request, maxConcurrent int) {
 		perm := Permission{}
 		permissions <- perm
 
-		go serve(req, permissions)
+		go serve(req, h, permissions)
 	}
 }
 
@@ -47,35 +136,156 @@ func byebye(permissions <-chan Permission) {
 // CPU continues immediately
 // data := <-ch    // blocks goroutine
 
-// Serve one request.  Sleep or burnCPU as requested.
+// Serve one request while holding a permit.
 // fire goroutine for each request,
-func serve(r Request, permissions <-chan Permission) {
+func serve(r Request, h Handler, permissions <-chan Permission) {
 
 	// Deferred calls run in LIFO order (stack behavior)
 	defer byebye(permissions)
 
+	handle(r, h)
+}
+
+// handle serves one request with the application h and sends its reply.
+func handle(r Request, h Handler) {
+	handleWith(r, h, sendReply, CancelledUpcall)
+}
+
+// handleWith is handle with custom ways to deliver the reply, and to dispose of
+// it if the client has given up on the request.
+func handleWith(r Request, h Handler, deliver func(r, rep Request), cancelled func(rep Request)) {
+	inFlight.Add(1)
+	defer inFlight.Add(-1)
+
+	rep := safeServe(h, r)
+
+	if r.Cancelled() {
+		// Nobody is waiting for this reply any more.
+		cancelled(rep)
+		return
+	}
+	deliver(r, rep)
+}
+
+// safeServe calls h.Serve(r), turning a panic in the application into a
+// StatusFailed reply so that one bad request cannot bring the server down.
+func safeServe(h Handler, r Request) (rep Request) {
+	defer func() {
+		if p := recover(); p != nil {
+			rep = r
+			rep.Status = StatusFailed
+			if rep.Fault == "" {
+				rep.Fault = FaultPanic
+			}
+		}
+	}()
+	return h.Serve(r)
+}
+
+// sendReply delivers rep on the ReplyCh of the request r.
+func sendReply(r, rep Request) {
+	if r.ReplyCh != nil {
+		r.ReplyCh <- rep
+	}
+}
+
+// Serve one request.  Hold the memory demanded while we burnCPU, read from the disk,
+// and sleep as requested, then pay the reply cost. If the client cancels the
+// request, abandon the remaining work.
+func serveDemand(r Request) Request {
+	if r.AllocDemand > 0 {
+		buf := allocTouch(r.AllocDemand)
+		defer runtime.KeepAlive(buf)
+	}
+	// burnCPU spins, prevents other work in the same goroutine; sleep is a blocking operation
 	if r.WorkDemand > 0 {
-		burnCPU(r.WorkDemand) // spins, prevents other work in the same goroutine
+		done, burned := burnCPUPooled(r.WorkDemand, r.Cancel)
+		cpuWorkNanos.Add(int64(burned))
+		if !done {
+			r.Status = StatusCancelled
+			return r
+		}
+	}
+	if r.IODemand > 0 && !diskIOOrCancel(r.IODemand, r.Cancel) {
+		r.Status = StatusCancelled
+		return r
+	}
+	if r.WaitDemand > 0 && !sleepOrCancel(r.WaitDemand, r.Cancel) {
+		r.Status = StatusCancelled
+		return r
 	}
-	if r.WaitDemand > 0 {
-		time.Sleep(time.Duration(r.WaitDemand) * time.Millisecond) // blocking operation
+	if r.ReplyCost > 0 {
+		done := false
+		if r.ReplyCPU {
+			done, _ = burnCPUPooled(r.ReplyCost, r.Cancel)
+		} else {
+			done = sleepOrCancel(r.ReplyCost, r.Cancel)
+		}
+		if !done {
+			r.Status = StatusCancelled
+		}
 	}
+	return r
+}
 
-	if r.ReplyCh != nil {
-		r.ReplyCh <- r
+// stopped reports whether stop has been closed; a nil stop never is.
+func stopped(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
 	}
 }
 
-// OK!
-func burnCPU(ms int) {
-	deadline := time.Now().Add(time.Duration(ms) * time.Millisecond)
+// sleepOrCancel sleeps for ms milliseconds on the server's clock (see SetClock)
+// unless cancel is closed first. It reports whether the full sleep completed.
+func sleepOrCancel(ms int, cancel <-chan struct{}) bool {
+	return clockSleep(time.Duration(ms)*time.Millisecond, cancel)
+}
 
-	var x uint64 = 1
+// burnCPUOrCancel is burnCPU that checks cancel every so often.
+// It reports whether the full burn completed.
+func burnCPUOrCancel(ms int, cancel <-chan struct{}) bool {
+	if clockVirtual() {
+		return sleepOrCancel(ms, cancel)
+	}
+	if cancel == nil {
+		burnCPU(ms)
+		return true
+	}
+	x := uint64(1)
+	for n := int64(ms) * CalibrateCPU(); n > 0; n -= burnChunk {
+		x = burnIters(min(n, burnChunk), x)
+		select {
+		case <-cancel:
+			burnSink.Store(x)
+			return false
+		default:
+		}
+	}
+	burnSink.Store(x)
+	return true
+}
 
-	for time.Now().Before(deadline) {
-		x = x*1664525 + 1013904223
+// burnCPU does ms milliseconds of CPU work, as measured by CalibrateCPU: under
+// contention for the CPU, it takes longer than ms. Under a virtual clock (see
+// SetClock) it sleeps for ms of virtual time instead.
+func burnCPU(ms int) {
+	if clockVirtual() {
+		sleepOrCancel(ms, nil)
+		return
 	}
+	// Use it or lose it: store x so compiler cannot optimize it all away
+	burnSink.Store(burnIters(int64(ms)*CalibrateCPU(), 1))
+}
 
-	// Use it or lose it: touch x so compiler cannot optimize it all away
-	_ = x
+// allocTouch allocates kb kilobytes and writes to every page of them, so that the
+// memory is really in use and the garbage collector has to deal with it.
+func allocTouch(kb int) []byte {
+	buf := make([]byte, kb<<10)
+	for i := 0; i < len(buf); i += 4096 {
+		buf[i] = byte(i)
+	}
+	return buf
 }
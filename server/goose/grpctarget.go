@@ -0,0 +1,264 @@
+package goose
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -------------------- gRPC target --------------------
+
+// GRPCTargetConfig describes the unary gRPC calls a GRPCTarget issues. There is no
+// protobuf compiler here: the request message is built by hand as a single bytes
+// field (Field, default 1) holding PayloadSize bytes, which any method whose
+// request message has a bytes field of that number accepts. The response message
+// is read and discarded.
+type GRPCTargetConfig struct {
+	Addr        string      // host:port of the server
+	Method      string      // full method name, e.g. /grpc.testing.BenchmarkService/UnaryCall
+	PayloadSize int         // bytes in the request's payload field
+	Field       int         // number of the payload field; default 1
+	TLS         *tls.Config // nil for plaintext HTTP/2 (h2c)
+	Client      *http.Client
+}
+
+// gRPC status codes, by number, as in google.golang.org/grpc/codes.
+var grpcCodeNames = []string{
+	"OK", "CANCELLED", "UNKNOWN", "INVALID_ARGUMENT", "DEADLINE_EXCEEDED",
+	"NOT_FOUND", "ALREADY_EXISTS", "PERMISSION_DENIED", "RESOURCE_EXHAUSTED",
+	"FAILED_PRECONDITION", "ABORTED", "OUT_OF_RANGE", "UNIMPLEMENTED",
+	"INTERNAL", "UNAVAILABLE", "DATA_LOSS", "UNAUTHENTICATED",
+}
+
+const (
+	grpcOK               = 0
+	grpcCancelled        = 1
+	grpcUnknown          = 2
+	grpcDeadlineExceeded = 4
+	grpcPermissionDenied = 7
+	grpcUnimplemented    = 12
+	grpcInternal         = 13
+	grpcUnavailable      = 14
+	grpcUnauthenticated  = 16
+)
+
+// GRPCCodeName returns the name of gRPC status code c, e.g. UNAVAILABLE.
+func GRPCCodeName(c int) string {
+	if c >= 0 && c < len(grpcCodeNames) {
+		return grpcCodeNames[c]
+	}
+	return "CODE_" + strconv.Itoa(c)
+}
+
+// GRPCTarget turns goose requests into unary gRPC calls over HTTP/2, so that
+// Loadgen's arrival process can drive a gRPC server. Like HTTPTarget, each call is
+// issued on its own goroutine as soon as it arrives. A call that ends with
+// grpc-status 0 is a StatusOK reply and any other ending is StatusFailed; the
+// target counts the calls per gRPC status code (see Codes). A transport error
+// counts as UNAVAILABLE, and an HTTP error status as the code gRPC maps it to.
+type GRPCTarget struct {
+	*asyncTarget
+	cfg GRPCTargetConfig
+	url string
+	msg []byte // the framed request message, the same for every call
+
+	mu    sync.Mutex
+	codes map[int]int
+}
+
+// NewGRPCTarget checks cfg and starts a target.
+func NewGRPCTarget(cfg GRPCTargetConfig) (*GRPCTarget, error) {
+	if cfg.Addr == "" {
+		return nil, fmt.Errorf("no gRPC server address")
+	}
+	if !strings.HasPrefix(cfg.Method, "/") || strings.Count(cfg.Method, "/") != 2 {
+		return nil, fmt.Errorf("gRPC method %q is not of the form /package.Service/Method", cfg.Method)
+	}
+	if cfg.PayloadSize < 0 {
+		return nil, fmt.Errorf("negative gRPC payload size")
+	}
+	if cfg.Field == 0 {
+		cfg.Field = 1
+	}
+	if cfg.Field < 1 || cfg.Field > 1<<29-1 {
+		return nil, fmt.Errorf("gRPC payload field %d out of range", cfg.Field)
+	}
+	if cfg.Client == nil {
+		tr := &http.Transport{TLSClientConfig: cfg.TLS, Protocols: new(http.Protocols)}
+		if cfg.TLS != nil {
+			tr.Protocols.SetHTTP2(true)
+		} else {
+			tr.Protocols.SetUnencryptedHTTP2(true)
+		}
+		cfg.Client = &http.Client{Transport: tr}
+	}
+	scheme := "http"
+	if cfg.TLS != nil {
+		scheme = "https"
+	}
+	t := &GRPCTarget{
+		cfg:   cfg,
+		url:   scheme + "://" + cfg.Addr + cfg.Method,
+		msg:   grpcFrame(grpcBytesField(cfg.Field, cfg.PayloadSize)),
+		codes: make(map[int]int),
+	}
+	t.asyncTarget = startAsyncTarget(t.do)
+	return t, nil
+}
+
+// grpcBytesField returns the protobuf encoding of a message whose only field,
+// number field, is n zero bytes.
+func grpcBytesField(field, n int) []byte {
+	b := binary.AppendUvarint(nil, uint64(field)<<3|2) // wire type 2: length-delimited
+	b = binary.AppendUvarint(b, uint64(n))
+	return append(b, make([]byte, n)...)
+}
+
+// grpcFrame prefixes msg with the gRPC message header: uncompressed, and its length.
+func grpcFrame(msg []byte) []byte {
+	b := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(b[1:], uint32(len(msg)))
+	return append(b, msg...)
+}
+
+// grpcTimeout formats d as a grpc-timeout header value.
+func grpcTimeout(d time.Duration) string {
+	return strconv.FormatInt(max(d.Milliseconds(), 1), 10) + "m"
+}
+
+// grpcCodeOfHTTP returns the gRPC code of an HTTP error status, as gRPC clients
+// map it when the server did not send one.
+func grpcCodeOfHTTP(status int) int {
+	switch status {
+	case http.StatusBadRequest:
+		return grpcInternal
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusNotFound:
+		return grpcUnimplemented
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return grpcUnavailable
+	}
+	return grpcUnknown
+}
+
+// do issues the call for r and returns the reply.
+func (t *GRPCTarget) do(r Request) Request {
+	rep := r
+	rep.Status = StatusFailed
+	code := t.call(r)
+	if code == grpcOK {
+		rep.Status = StatusOK
+	} else if code == grpcCancelled && r.Cancelled() {
+		rep.Status = StatusCancelled
+	}
+	t.mu.Lock()
+	t.codes[code]++
+	t.mu.Unlock()
+	return rep
+}
+
+// call makes the call for r and returns its gRPC status code.
+func (t *GRPCTarget) call(r Request) int {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if r.Cancel != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-r.Cancel:
+				cancel()
+			case <-stop:
+			}
+		}()
+	}
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(t.msg))
+	if err != nil {
+		return grpcInternal
+	}
+	hreq.Header.Set("Content-Type", "application/grpc")
+	hreq.Header.Set("TE", "trailers")
+	if !r.Deadline.IsZero() {
+		hreq.Header.Set("Grpc-Timeout", grpcTimeout(time.Until(r.Deadline)))
+	}
+	resp, err := t.cfg.Client.Do(hreq)
+	if err != nil {
+		if r.Cancelled() {
+			return grpcCancelled
+		}
+		return grpcUnavailable
+	}
+	defer resp.Body.Close()
+	// The status is in the trailers, which arrive after the whole body; a
+	// trailers-only response puts it in the headers instead.
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		if r.Cancelled() {
+			return grpcCancelled
+		}
+		return grpcUnavailable
+	}
+	if resp.StatusCode != http.StatusOK {
+		return grpcCodeOfHTTP(resp.StatusCode)
+	}
+	s := resp.Trailer.Get("Grpc-Status")
+	if s == "" {
+		s = resp.Header.Get("Grpc-Status")
+	}
+	if s == "" {
+		return grpcInternal // a response must end with a status
+	}
+	code, err := strconv.Atoi(s)
+	if err != nil {
+		return grpcUnknown
+	}
+	return code
+}
+
+// Codes returns the number of calls that ended with each gRPC status code.
+func (t *GRPCTarget) Codes() map[int]int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make(map[int]int, len(t.codes))
+	for c, n := range t.codes {
+		out[c] = n
+	}
+	return out
+}
+
+// RunGRPCExperiment drives the gRPC server described by cfg with Loadgen as
+// described by e (whose server fields are ignored) and returns the summary and
+// the number of calls per gRPC status code.
+func RunGRPCExperiment(cfg GRPCTargetConfig, e Experiment) (Result, map[int]int, error) {
+	t, err := NewGRPCTarget(cfg)
+	if err != nil {
+		return Result{}, nil, err
+	}
+	res := RunTargetExperiment(t, e)
+	return res, t.Codes(), nil
+}
+
+// PrintGRPCCodes prints the number of calls per gRPC status code on one line.
+func PrintGRPCCodes(codes map[int]int) {
+	keys := make([]int, 0, len(codes))
+	for c := range codes {
+		keys = append(keys, c)
+	}
+	sort.Ints(keys)
+	var parts []string
+	for _, c := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%d", GRPCCodeName(c), codes[c]))
+	}
+	fmt.Printf("grpc status: %s\n", strings.Join(parts, " "))
+}
@@ -0,0 +1,78 @@
+package goose
+
+import (
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// A plaintext HTTP/2 server standing in for a gRPC one: it checks the framed
+// request and ends every other call with UNAVAILABLE, half of those trailers-only.
+func TestGRPCTargetCodes(t *testing.T) {
+	const payload = 300
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.Header.Get("Content-Type") != "application/grpc" {
+			http.Error(w, "not gRPC", http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		msg := grpcBytesField(1, payload)
+		if len(body) != 5+len(msg) || int(binary.BigEndian.Uint32(body[1:5])) != len(msg) {
+			http.Error(w, "bad frame", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/Fail"):
+			w.Header().Set("Grpc-Status", "14") // trailers-only
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.Header().Set("Trailer", "Grpc-Status")
+			w.Write(grpcFrame(nil))
+			w.Header().Set("Grpc-Status", "0")
+		}
+	}))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	for _, tc := range []struct {
+		method string
+		code   int
+		status ReplyStatus
+	}{
+		{"/bench.Service/Call", grpcOK, StatusOK},
+		{"/bench.Service/Fail", grpcUnavailable, StatusFailed},
+	} {
+		target, err := NewGRPCTarget(GRPCTargetConfig{Addr: addr, Method: tc.method, PayloadSize: payload})
+		if err != nil {
+			t.Fatal(err)
+		}
+		const n = 10
+		go func() {
+			for i := range n {
+				target.Requests() <- Request{ClientID: i}
+			}
+		}()
+		for range n {
+			if rep := <-target.Replies(); rep.Status != tc.status {
+				t.Errorf("%s: status %v, want %v", tc.method, rep.Status, tc.status)
+			}
+		}
+		target.Close()
+		if codes := target.Codes(); codes[tc.code] != n || len(codes) != 1 {
+			t.Errorf("%s: codes %v, want %d of %s", tc.method, codes, n, GRPCCodeName(tc.code))
+		}
+	}
+}
+
+func TestGRPCTargetRejectsBadMethod(t *testing.T) {
+	if _, err := NewGRPCTarget(GRPCTargetConfig{Addr: "localhost:1", Method: "Call"}); err == nil {
+		t.Fatal("want an error for a method without a service")
+	}
+}
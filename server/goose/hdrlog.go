@@ -0,0 +1,198 @@
+package goose
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"time"
+)
+
+// -------------------- HDR histogram interval logs --------------------
+
+// HdrHistogram's interval log is what wrk2, hdr-plot, and the HdrHistogram
+// libraries read and write: one line per interval with its start, length, and
+// maximum, and the interval's histogram in HdrHistogram's compressed V2 encoding,
+// in base64. GetHDRLog keeps such a histogram of the OK response times, in
+// microseconds with three significant digits, for each interval of completion
+// time, and HDRLog.Write produces the log.
+
+// The layout of the histograms: values from 1us to an hour, three significant digits.
+const (
+	hdrSigDigits   = 3
+	hdrLowest      = 1
+	hdrHighest     = int64(time.Hour / time.Microsecond)
+	hdrSubMag      = 11 // log2 of the sub-bucket count, the smallest power of 2 >= 2*10^hdrSigDigits
+	hdrSubHalfMag  = hdrSubMag - 1
+	hdrSubHalf     = 1 << hdrSubHalfMag
+	hdrSubMask     = int64(1<<hdrSubMag - 1)
+	hdrLeadingZero = 64 - hdrSubHalfMag - 1
+)
+
+// hdrIndex returns the index in the counts array of the value v.
+func hdrIndex(v int64) int {
+	bucket := hdrLeadingZero - bits.LeadingZeros64(uint64(v|hdrSubMask))
+	sub := int(v >> bucket)
+	return (bucket+1)<<hdrSubHalfMag + sub - hdrSubHalf
+}
+
+// hdrHistogram is one interval's histogram, kept sparse: most indices stay empty.
+type hdrHistogram struct {
+	counts map[int]int64
+	max    int64
+}
+
+func (h *hdrHistogram) record(us int64) {
+	us = min(max(us, hdrLowest), hdrHighest)
+	h.counts[hdrIndex(us)]++
+	h.max = max(h.max, us)
+}
+
+// hdrState is the part of a Collector kept here.
+type hdrState struct {
+	hdrEvery time.Duration // interval width; 0 turns the log off. Kept across ResetStats
+	hdrStart time.Time
+	hdrHists []*hdrHistogram
+}
+
+// SetHDRLog makes the package stats keep an HDR histogram of the OK response
+// times per interval of the given width; 0 (the default) turns it off. Set it
+// before an experiment starts.
+func SetHDRLog(every time.Duration) { defaultCollector.SetHDRLog(every) }
+
+// SetHDRLog is the package function SetHDRLog for c.
+func (c *Collector) SetHDRLog(every time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hdrEvery = max(every, 0)
+}
+
+// resetHDRLocked clears the histograms; ResetStats calls it.
+func (c *Collector) resetHDRLocked() {
+	c.hdrStart = time.Now()
+	c.hdrHists = nil
+}
+
+// recordHDRLocked records an OK reply sent at start that took rt.
+func (c *Collector) recordHDRLocked(start time.Time, rt time.Duration) {
+	if c.hdrEvery <= 0 {
+		return
+	}
+	i := int(start.Add(rt).Sub(c.hdrStart) / c.hdrEvery)
+	if i < 0 {
+		return
+	}
+	for len(c.hdrHists) <= i {
+		c.hdrHists = append(c.hdrHists, &hdrHistogram{counts: make(map[int]int64)})
+	}
+	c.hdrHists[i].record(rt.Microseconds())
+}
+
+// HDRLog is a series of HDR histograms of response times, one per interval.
+type HDRLog struct {
+	Start     time.Time
+	Every     time.Duration
+	Intervals []HDRInterval
+}
+
+// HDRInterval is the histogram of one interval of an HDRLog.
+type HDRInterval struct {
+	Count   int64
+	MaxUs   int64
+	Encoded []byte // the histogram in HdrHistogram's compressed V2 encoding
+}
+
+// GetHDRLog returns the histograms recorded since the last ResetStats.
+func GetHDRLog() HDRLog { return defaultCollector.GetHDRLog() }
+
+// GetHDRLog is the package function GetHDRLog for c.
+func (c *Collector) GetHDRLog() HDRLog {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l := HDRLog{Start: c.hdrStart, Every: c.hdrEvery}
+	for _, h := range c.hdrHists {
+		iv := HDRInterval{MaxUs: h.max, Encoded: h.encode()}
+		for _, n := range h.counts {
+			iv.Count += n
+		}
+		l.Intervals = append(l.Intervals, iv)
+	}
+	return l
+}
+
+// HdrHistogram's cookies for the V2 encoding with 8-byte words, plain and compressed.
+const (
+	hdrCookieV2           = 0x1c849303 | 0x10
+	hdrCompressedCookieV2 = 0x1c849304 | 0x10
+)
+
+// encode returns h in HdrHistogram's compressed V2 encoding: a header, then the
+// zlib-compressed plain encoding, whose counts are ZigZag LEB128 varints with
+// runs of zeros written as their negated length.
+func (h *hdrHistogram) encode() []byte {
+	limit := 0
+	if len(h.counts) > 0 {
+		limit = hdrIndex(max(h.max, hdrLowest)) + 1
+	}
+	var payload []byte
+	for i := 0; i < limit; {
+		c := h.counts[i]
+		i++
+		if c == 0 {
+			zeros := int64(1)
+			for i < limit && h.counts[i] == 0 {
+				zeros++
+				i++
+			}
+			if zeros > 1 {
+				c = -zeros
+			}
+		}
+		payload = binary.AppendVarint(payload, c)
+	}
+
+	var plain bytes.Buffer
+	for _, v := range []any{
+		int32(hdrCookieV2), int32(len(payload)), int32(0), int32(hdrSigDigits),
+		int64(hdrLowest), hdrHighest, math.Float64bits(1),
+	} {
+		binary.Write(&plain, binary.BigEndian, v)
+	}
+	plain.Write(payload)
+
+	var deflated bytes.Buffer
+	zw := zlib.NewWriter(&deflated)
+	zw.Write(plain.Bytes())
+	zw.Close()
+	out := binary.BigEndian.AppendUint32(nil, hdrCompressedCookieV2)
+	out = binary.BigEndian.AppendUint32(out, uint32(deflated.Len()))
+	return append(out, deflated.Bytes()...)
+}
+
+// Write writes l as a version 1.3 HdrHistogram interval log. Timestamps are in
+// seconds from the start of the run, and the interval maximums in milliseconds.
+func (l HDRLog) Write(w io.Writer) error {
+	start := float64(l.Start.UnixMilli()) / 1000
+	if _, err := fmt.Fprintf(w, "#[Histogram log format version 1.3]\n#[StartTime: %.3f (seconds since epoch), %s]\n#[BaseTime: %.3f (seconds since epoch)]\n",
+		start, l.Start.Format(time.UnixDate), start); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(w, `"StartTimestamp","Interval_Length","Interval_Max","Interval_Compressed_Histogram"`); err != nil {
+		return err
+	}
+	for i, iv := range l.Intervals {
+		if iv.Count == 0 {
+			continue
+		}
+		_, err := fmt.Fprintf(w, "%.3f,%.3f,%.3f,%s\n", (time.Duration(i) * l.Every).Seconds(), l.Every.Seconds(),
+			float64(iv.MaxUs)/1000, base64.StdEncoding.EncodeToString(iv.Encoded))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package goose
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHDRIndex(t *testing.T) {
+	// exact below 2048us, then two, then four values to a bucket
+	for _, tc := range []struct {
+		v    int64
+		want int
+	}{{1, 1}, {2047, 2047}, {2048, 2048}, {2049, 2048}, {2050, 2049}, {4096, 3072}, {4099, 3072}} {
+		if got := hdrIndex(tc.v); got != tc.want {
+			t.Errorf("hdrIndex(%d) = %d, want %d", tc.v, got, tc.want)
+		}
+	}
+}
+
+// decodeHDR undoes encode, returning the counts by index.
+func decodeHDR(t *testing.T, enc []byte) map[int]int64 {
+	t.Helper()
+	if binary.BigEndian.Uint32(enc) != hdrCompressedCookieV2 || int(binary.BigEndian.Uint32(enc[4:])) != len(enc)-8 {
+		t.Fatalf("bad compressed header % x", enc[:8])
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(enc[8:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binary.BigEndian.Uint32(plain) != hdrCookieV2 || int(binary.BigEndian.Uint32(plain[4:])) != len(plain)-40 {
+		t.Fatalf("bad header % x", plain[:8])
+	}
+	counts := map[int]int64{}
+	payload := plain[40:]
+	for i := 0; len(payload) > 0; {
+		c, n := binary.Varint(payload)
+		payload = payload[n:]
+		if c < 0 {
+			i += int(-c)
+			continue
+		}
+		if c > 0 {
+			counts[i] = c
+		}
+		i++
+	}
+	return counts
+}
+
+func TestHDRLog(t *testing.T) {
+	c := defaultCollector
+	SetHDRLog(10 * time.Millisecond)
+	defer SetHDRLog(0)
+	ResetStats()
+	c.mu.Lock()
+	t0 := c.hdrStart
+	c.recordHDRLocked(t0, 500*time.Microsecond)
+	c.recordHDRLocked(t0, 500*time.Microsecond)
+	c.recordHDRLocked(t0, 3*time.Millisecond)
+	c.recordHDRLocked(t0.Add(20*time.Millisecond), 2*time.Millisecond)
+	c.mu.Unlock()
+
+	l := GetHDRLog()
+	if len(l.Intervals) != 3 || l.Intervals[0].Count != 3 || l.Intervals[0].MaxUs != 3000 ||
+		l.Intervals[1].Count != 0 || l.Intervals[2].Count != 1 {
+		t.Fatalf("intervals %+v, want 3 replies, none, then 1", l.Intervals)
+	}
+	counts := decodeHDR(t, l.Intervals[0].Encoded)
+	want := map[int]int64{500: 2, hdrIndex(3000): 1}
+	if len(counts) != len(want) || counts[500] != 2 || counts[hdrIndex(3000)] != 1 {
+		t.Errorf("decoded counts %v, want %v", counts, want)
+	}
+
+	var buf bytes.Buffer
+	if err := l.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 6 || !strings.HasPrefix(lines[0], "#[Histogram log format version 1.3]") {
+		t.Fatalf("log:\n%s\nwant 4 header lines and the 2 nonempty intervals", buf.String())
+	}
+	fields := strings.Split(lines[5], ",")
+	if fields[0] != "0.020" || fields[1] != "0.010" || fields[2] != "2.000" {
+		t.Errorf("interval line %q, want start 0.020, length 0.010, max 2.000", lines[5])
+	}
+	if enc, err := base64.StdEncoding.DecodeString(fields[3]); err != nil || !bytes.Equal(enc, l.Intervals[2].Encoded) {
+		t.Errorf("histogram field does not decode to the interval's encoding: %v", err)
+	}
+}
@@ -0,0 +1,174 @@
+package goose
+
+import (
+	"encoding/csv"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+// -------------------- latency heatmap --------------------
+
+// A mean or a percentile per interval hides how the shape of the latency
+// distribution changes: during a ramp or an overload a second mode appears and
+// drifts upwards long before the p99 moves. A heatmap keeps the whole
+// distribution per interval, as production monitoring does: one column per
+// interval of completion time, one row per latency bucket, and the number of OK
+// replies in each cell.
+
+// heatmapBoundsMs are the upper bounds of the latency buckets, in a 1-2-5
+// sequence; a last bucket holds everything slower.
+var heatmapBoundsMs = []float64{0.1, 0.2, 0.5, 1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000, 10000}
+
+// heatmapState is the part of a Collector kept here.
+type heatmapState struct {
+	heatEvery time.Duration // interval width; 0 turns the heatmap off. Kept across ResetStats
+	heatStart time.Time
+	heatCols  [][]int // per interval, OK replies per latency bucket
+}
+
+// SetHeatmap makes the package stats keep a latency heatmap with intervals of the
+// given width; 0 (the default) turns it off. Set it before an experiment starts.
+func SetHeatmap(every time.Duration) { defaultCollector.SetHeatmap(every) }
+
+// SetHeatmap is the package function SetHeatmap for c.
+func (c *Collector) SetHeatmap(every time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.heatEvery = max(every, 0)
+}
+
+// resetHeatmapLocked clears the heatmap; ResetStats calls it.
+func (c *Collector) resetHeatmapLocked() {
+	c.heatStart = time.Now()
+	c.heatCols = nil
+}
+
+// recordHeatmapLocked records an OK reply sent at start that took rt.
+func (c *Collector) recordHeatmapLocked(start time.Time, rt time.Duration) {
+	if c.heatEvery <= 0 {
+		return
+	}
+	i := int(start.Add(rt).Sub(c.heatStart) / c.heatEvery)
+	if i < 0 {
+		return
+	}
+	for len(c.heatCols) <= i {
+		c.heatCols = append(c.heatCols, make([]int, len(heatmapBoundsMs)+1))
+	}
+	ms := durationMs(rt)
+	b := len(heatmapBoundsMs)
+	for j, bound := range heatmapBoundsMs {
+		if ms <= bound {
+			b = j
+			break
+		}
+	}
+	c.heatCols[i][b]++
+}
+
+// Heatmap is a latency heatmap: Counts[i][j] is the number of OK replies that
+// completed in interval i and took at most BoundsMs[j] (and more than the bound
+// before it); the last bucket of each interval counts those slower than every bound.
+type Heatmap struct {
+	Every    time.Duration
+	BoundsMs []float64
+	Counts   [][]int
+}
+
+// GetHeatmap returns the heatmap recorded since the last ResetStats.
+func GetHeatmap() Heatmap { return defaultCollector.GetHeatmap() }
+
+// GetHeatmap is the package function GetHeatmap for c.
+func (c *Collector) GetHeatmap() Heatmap {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h := Heatmap{Every: c.heatEvery, BoundsMs: heatmapBoundsMs, Counts: make([][]int, len(c.heatCols))}
+	for i, col := range c.heatCols {
+		h.Counts[i] = append([]int(nil), col...)
+	}
+	return h
+}
+
+// bucketLabel names latency bucket j of h.
+func (h Heatmap) bucketLabel(j int) string {
+	if j == len(h.BoundsMs) {
+		return fmt.Sprintf(">%gms", h.BoundsMs[j-1])
+	}
+	return fmt.Sprintf("<=%gms", h.BoundsMs[j])
+}
+
+// WriteCSV writes h with one row per interval, starting with the interval's
+// start in milliseconds, and one column per latency bucket.
+func (h Heatmap) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	header := []string{"t_ms"}
+	for j := 0; j <= len(h.BoundsMs); j++ {
+		header = append(header, h.bucketLabel(j))
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for i, col := range h.Counts {
+		row := []string{strconv.FormatInt(int64(i)*h.Every.Milliseconds(), 10)}
+		for _, c := range col {
+			row = append(row, strconv.Itoa(c))
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// heatmapCell is the size in pixels of a cell of the PNG heatmap.
+const heatmapCell = 8
+
+// WritePNG draws h as an image, time to the right and latency upwards, with
+// each cell's color on a logarithmic scale from white (no replies) through blue
+// to red (the most replies in any cell).
+func (h Heatmap) WritePNG(w io.Writer) error {
+	rows := len(h.BoundsMs) + 1
+	img := image.NewRGBA(image.Rect(0, 0, max(len(h.Counts), 1)*heatmapCell, rows*heatmapCell))
+	peak := 0
+	for _, col := range h.Counts {
+		for _, c := range col {
+			peak = max(peak, c)
+		}
+	}
+	for i, col := range h.Counts {
+		for j, c := range col {
+			shade := heatColor(0)
+			if peak > 0 {
+				shade = heatColor(math.Log1p(float64(c)) / math.Log1p(float64(peak)))
+			}
+			y0 := (rows - 1 - j) * heatmapCell
+			for y := y0; y < y0+heatmapCell; y++ {
+				for x := i * heatmapCell; x < (i+1)*heatmapCell; x++ {
+					img.Set(x, y, shade)
+				}
+			}
+		}
+	}
+	return png.Encode(w, img)
+}
+
+// heatColor maps f in [0, 1] to white at 0, blue at 1/2, and red at 1.
+func heatColor(f float64) color.RGBA {
+	lerp := func(a, b uint8, t float64) uint8 { return uint8(float64(a) + (float64(b)-float64(a))*t) }
+	if f <= 0 {
+		return color.RGBA{255, 255, 255, 255}
+	}
+	if f < 0.5 {
+		t := f / 0.5
+		return color.RGBA{lerp(230, 30, t), lerp(240, 80, t), lerp(255, 220, t), 255}
+	}
+	t := (f - 0.5) / 0.5
+	return color.RGBA{lerp(30, 220, t), lerp(80, 30, t), lerp(220, 30, t), 255}
+}
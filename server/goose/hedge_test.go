@@ -0,0 +1,41 @@
+package goose
+
+import (
+	"testing"
+	"time"
+)
+
+// When the originals are slow and their duplicates fast, each hedge wins, and
+// the response times are those of the duplicates.
+func TestHedgingTakesFirstReply(t *testing.T) {
+	res := RunExperiment(Experiment{
+		N:             20,
+		IatMean:       1,
+		DemandMean:    1,
+		MaxConcurrent: 64,
+		Handler: HandlerFunc(func(r Request) Request {
+			if !r.Hedge {
+				time.Sleep(50 * time.Millisecond)
+			}
+			return r
+		}),
+		Load: LoadOptions{HedgeAfterMs: 2},
+	})
+	if res.Received != 20 {
+		t.Fatalf("received %d of 20", res.Received)
+	}
+	if res.Hedges < 10 || res.HedgeWins != res.Hedges {
+		t.Errorf("%d hedges, %d wins; want most requests hedged, every hedge winning", res.Hedges, res.HedgeWins)
+	}
+	if res.Hedges == 20 && res.P99 >= 50 {
+		t.Errorf("p99 %.1fms with every request hedged, want below the originals' 50ms", res.P99)
+	}
+}
+
+// Without a reply before the delay, nothing is hedged.
+func TestHedgingSparesFastReplies(t *testing.T) {
+	res := RunExperiment(Experiment{N: 20, IatMean: 1, MaxConcurrent: 4, Load: LoadOptions{HedgeAfterMs: 200}})
+	if res.Received != 20 || res.Hedges != 0 || res.WastedMs != 0 {
+		t.Errorf("received %d, %d hedges, %dms wasted; want 20, 0, 0", res.Received, res.Hedges, res.WastedMs)
+	}
+}
@@ -0,0 +1,241 @@
+package goose
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// -------------------- HTTP target --------------------
+
+// HTTPTargetConfig describes the HTTP requests an HTTPTarget issues. URL and Body are
+// text/template templates executed with the goose Request, so they may refer to
+// {{.ClientID}}, {{.ObjectID}}, {{.WaitDemand}} and the other Request fields.
+type HTTPTargetConfig struct {
+	URL         string
+	Method      string // default GET
+	Body        string // empty means no body
+	ContentType string // default application/json when there is a body
+	Client      *http.Client
+
+	// WriteRatio, if positive, makes that fraction of the requests writes, which
+	// use WriteMethod (default PUT) and WriteBody instead of Method and Body. With
+	// a URL that names a key by {{.ObjectID}} the target then drives a key-value
+	// store with a mix of reads and writes; LoadOptions.Objects sets the key skew.
+	WriteRatio  float64
+	WriteMethod string
+	WriteBody   string
+}
+
+// HTTPTarget turns goose requests into real HTTP requests, so that Loadgen's arrival
+// process can drive any HTTP server. Loadgen sends on Requests() and reads from
+// Replies() as with an in-process server. Each request is issued on its own
+// goroutine as soon as it arrives (an open system); a 2xx response is a StatusOK
+// reply, any other response or a transport error is StatusFailed, and the HTTP
+// status code is carried in the reply's Code.
+type HTTPTarget struct {
+	*asyncTarget
+	cfg  HTTPTargetConfig
+	url  *template.Template
+	body *template.Template
+
+	writeBody *template.Template // if cfg.WriteBody is set
+}
+
+// asyncTarget is the plumbing of a Target that issues each request on its own
+// goroutine as soon as it arrives and replies with what do returns.
+type asyncTarget struct {
+	do    func(Request) Request
+	reqCh chan Request
+	repCh chan Request
+	done  chan struct{} // closed by Close
+	ran   chan struct{} // closed when run has returned, so wg gets no more Adds
+	wg    sync.WaitGroup
+
+	collectorRef
+}
+
+// startAsyncTarget starts a target whose requests are issued with do.
+func startAsyncTarget(do func(Request) Request) *asyncTarget {
+	t := &asyncTarget{
+		do:    do,
+		reqCh: make(chan Request, 16),
+		repCh: make(chan Request, 16),
+		done:  make(chan struct{}),
+		ran:   make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// NewHTTPTarget checks cfg and starts a target.
+func NewHTTPTarget(cfg HTTPTargetConfig) (*HTTPTarget, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("no target URL")
+	}
+	if cfg.Method == "" {
+		cfg.Method = http.MethodGet
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{}
+	}
+	if cfg.WriteRatio > 0 && cfg.WriteMethod == "" {
+		cfg.WriteMethod = http.MethodPut
+	}
+	if (cfg.Body != "" || cfg.WriteBody != "") && cfg.ContentType == "" {
+		cfg.ContentType = "application/json"
+	}
+	t := &HTTPTarget{cfg: cfg}
+	var err error
+	if t.url, err = template.New("url").Parse(cfg.URL); err != nil {
+		return nil, fmt.Errorf("url template: %w", err)
+	}
+	if cfg.Body != "" {
+		if t.body, err = template.New("body").Parse(cfg.Body); err != nil {
+			return nil, fmt.Errorf("body template: %w", err)
+		}
+	}
+	if cfg.WriteBody != "" {
+		if t.writeBody, err = template.New("writebody").Parse(cfg.WriteBody); err != nil {
+			return nil, fmt.Errorf("write body template: %w", err)
+		}
+	}
+	t.asyncTarget = startAsyncTarget(t.do)
+	return t, nil
+}
+
+// Requests returns the channel on which to send requests to the target.
+func (t *asyncTarget) Requests() chan<- Request { return t.reqCh }
+
+// Replies returns the channel on which replies arrive.
+func (t *asyncTarget) Replies() chan Request { return t.repCh }
+
+// Close stops taking requests and waits for those in progress.
+func (t *asyncTarget) Close() error {
+	close(t.reqCh)
+	<-t.ran
+	close(t.done)
+	t.wg.Wait()
+	return nil
+}
+
+func (t *asyncTarget) run() {
+	defer close(t.ran)
+	for r := range t.reqCh {
+		t.wg.Add(1)
+		go func(r Request) {
+			defer t.wg.Done()
+			rep := t.do(r)
+			if r.Cancelled() {
+				t.stats().CancelledUpcall(rep)
+				return
+			}
+			select {
+			case t.repCh <- rep:
+			case <-t.done:
+			}
+		}(r)
+	}
+}
+
+// isWrite reports whether r is one of the WriteRatio of requests that are writes.
+// The choice depends only on the ClientID, so a replayed run makes the same one.
+func (t *HTTPTarget) isWrite(r Request) bool {
+	if t.cfg.WriteRatio <= 0 {
+		return false
+	}
+	// splitmix64 spreads consecutive IDs over [0, 1)
+	x := uint64(r.ClientID) + 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	x ^= x >> 31
+	return float64(x>>11)/(1<<53) < t.cfg.WriteRatio
+}
+
+// do issues the HTTP request for r and returns the reply.
+func (t *HTTPTarget) do(r Request) Request {
+	rep := r
+	rep.Status = StatusFailed
+	var url, body bytes.Buffer
+	if err := t.url.Execute(&url, r); err != nil {
+		return rep
+	}
+	method, bodyTmpl := t.cfg.Method, t.body
+	if t.isWrite(r) {
+		method, bodyTmpl = t.cfg.WriteMethod, t.writeBody
+	}
+	var rd io.Reader
+	if bodyTmpl != nil {
+		if err := bodyTmpl.Execute(&body, r); err != nil {
+			return rep
+		}
+		rd = &body
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if r.Cancel != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-r.Cancel:
+				cancel()
+			case <-stop:
+			}
+		}()
+	}
+	hreq, err := http.NewRequestWithContext(ctx, method, strings.TrimSpace(url.String()), rd)
+	if err != nil {
+		return rep
+	}
+	if rd != nil {
+		hreq.Header.Set("Content-Type", t.cfg.ContentType)
+	}
+	resp, err := t.cfg.Client.Do(hreq)
+	if err != nil {
+		if r.Cancelled() {
+			rep.Status = StatusCancelled
+		}
+		return rep
+	}
+	// Read the whole body: the response is not complete until it has arrived.
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	rep.Code = resp.StatusCode
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		rep.Status = StatusOK
+	}
+	return rep
+}
+
+// RunHTTPExperiment drives the HTTP target described by cfg with Loadgen as described
+// by e (whose server fields are ignored) and returns the summary.
+func RunHTTPExperiment(cfg HTTPTargetConfig, e Experiment) (Result, error) {
+	t, err := NewHTTPTarget(cfg)
+	if err != nil {
+		return Result{}, err
+	}
+	return RunTargetExperiment(t, e), nil
+}
+
+// PrintStatusCodes prints the number of responses per HTTP status code on one line.
+func PrintStatusCodes() {
+	codes := GetStatusCodes()
+	keys := make([]int, 0, len(codes))
+	for c := range codes {
+		keys = append(keys, c)
+	}
+	sort.Ints(keys)
+	var parts []string
+	for _, c := range keys {
+		parts = append(parts, fmt.Sprintf("%d=%d", c, codes[c]))
+	}
+	fmt.Printf("status codes: %s\n", strings.Join(parts, " "))
+}
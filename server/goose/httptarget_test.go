@@ -0,0 +1,42 @@
+package goose
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Every request gets a reply carrying the status code, and Close returns once
+// they are all in.
+func TestHTTPTargetReplies(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	target, err := NewHTTPTarget(HTTPTargetConfig{URL: srv.URL + `/{{if eq .ObjectID 1}}missing{{else}}ok{{end}}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 20
+	go func() {
+		for i := range n {
+			target.Requests() <- Request{ClientID: i, ObjectID: i % 2}
+		}
+	}()
+	codes := make(map[int]int)
+	for range n {
+		rep := <-target.Replies()
+		codes[rep.Code]++
+		if want := rep.ObjectID == 0; (rep.Status == StatusOK) != want {
+			t.Errorf("object %d: status %v", rep.ObjectID, rep.Status)
+		}
+	}
+	if err := target.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if codes[200] != n/2 || codes[404] != n/2 {
+		t.Fatalf("codes %v: want %d of 200 and of 404", codes, n/2)
+	}
+}
@@ -0,0 +1,215 @@
+package goose
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// -------------------- goroutine leak detection --------------------
+
+// A goroutine that outlives the experiment that started it is almost always a bug:
+// a serve goroutine stuck delivering a reply nobody reads, a loop ranging over a
+// channel nobody closes, a waiter for a signal that never comes. It also holds on to
+// whatever it references, and in the next experiment of a sweep it is still there.
+
+// Goroutine is one goroutine as described by its stack trace.
+type Goroutine struct {
+	ID        int
+	State     string // e.g. "chan send", "select", "sleep"
+	Top       string // the innermost function outside the standard library
+	CreatedBy string // the function that started it
+	Stack     string
+}
+
+// Leak is a goroutine that was started after a LeakSnapshot and is still there.
+type Leak struct {
+	Goroutine
+	Reason string // what it is probably stuck on
+}
+
+// LeakSnapshot records the goroutines that exist at some point, such as the start
+// of an experiment, so that new ones can be found afterwards.
+type LeakSnapshot struct {
+	ids map[int]bool
+}
+
+// TakeLeakSnapshot records the goroutines that exist now.
+func TakeLeakSnapshot() LeakSnapshot {
+	s := LeakSnapshot{ids: make(map[int]bool)}
+	for _, g := range Goroutines() {
+		s.ids[g.ID] = true
+	}
+	return s
+}
+
+// Leaks returns the goroutines started since the snapshot that still exist after
+// up to grace, allowing the stragglers of a run that just ended time to exit.
+// The goroutine calling Leaks is not included.
+func (s LeakSnapshot) Leaks(grace time.Duration) []Leak {
+	deadline := time.Now().Add(grace)
+	for {
+		var leaks []Leak
+		gs := Goroutines()
+		for _, g := range gs[1:] { // the first is the caller
+			if !s.ids[g.ID] {
+				leaks = append(leaks, Leak{Goroutine: g, Reason: leakReason(g)})
+			}
+		}
+		if len(leaks) == 0 || !time.Now().Before(deadline) {
+			return leaks
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Goroutines returns every goroutine of the program, the calling one first.
+func Goroutines() []Goroutine {
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	var out []Goroutine
+	for _, block := range strings.Split(strings.TrimSpace(string(buf)), "\n\n") {
+		if g, ok := parseGoroutine(block); ok {
+			out = append(out, g)
+		}
+	}
+	return out
+}
+
+// parseGoroutine parses one goroutine of a runtime.Stack dump:
+//
+//	goroutine 7 [chan send, 2 minutes]:
+//	pkg.fn(...)
+//		/path/file.go:12 +0x1d
+//	created by pkg.starter in goroutine 1
+//		/path/file.go:30 +0x5e
+func parseGoroutine(block string) (Goroutine, bool) {
+	lines := strings.Split(block, "\n")
+	header, ok := strings.CutPrefix(lines[0], "goroutine ")
+	if !ok {
+		return Goroutine{}, false
+	}
+	id, rest, _ := strings.Cut(header, " ")
+	g := Goroutine{Stack: block}
+	var err error
+	if g.ID, err = strconv.Atoi(id); err != nil {
+		return Goroutine{}, false
+	}
+	state := strings.TrimSuffix(strings.TrimPrefix(rest, "["), "]:")
+	g.State, _, _ = strings.Cut(state, ",")
+	for _, l := range lines[1:] {
+		if strings.HasPrefix(l, "\t") {
+			continue // a file:line
+		}
+		if created, ok := strings.CutPrefix(l, "created by "); ok {
+			g.CreatedBy, _, _ = strings.Cut(created, " in goroutine")
+		} else if fn := funcName(l); g.Top == "" && !stdlibFunc(fn) {
+			g.Top = fn
+		}
+	}
+	if g.Top == "" && len(lines) > 1 {
+		g.Top = funcName(lines[1])
+	}
+	return g, true
+}
+
+// stdlibFunc reports whether fn is in a standard-library package, which is only
+// where a goroutine is blocked, not why. Standard-library import paths are the
+// ones without a dot in their first element.
+func stdlibFunc(fn string) bool {
+	if first, _, ok := strings.Cut(fn, "/"); ok {
+		return !strings.Contains(first, ".")
+	}
+	pkg, _, _ := strings.Cut(fn, ".")
+	return pkg != "main"
+}
+
+// funcName strips the arguments from a function line of a stack trace.
+func funcName(line string) string {
+	if i := strings.LastIndex(line, "("); i > 0 {
+		return line[:i]
+	}
+	return line
+}
+
+// leakReason guesses from its state what a leaked goroutine is stuck on.
+func leakReason(g Goroutine) string {
+	switch {
+	case strings.HasPrefix(g.State, "chan send"):
+		return "blocked sending on a channel: a reply or request nobody will receive"
+	case strings.HasPrefix(g.State, "chan receive"):
+		return "blocked receiving from a channel: nothing will be sent, or it is never closed"
+	case strings.HasPrefix(g.State, "select"):
+		return "blocked in a select none of whose cases will be ready"
+	case strings.HasPrefix(g.State, "sync.WaitGroup.Wait"), strings.HasPrefix(g.State, "sync.Mutex.Lock"),
+		strings.HasPrefix(g.State, "sync.RWMutex"), strings.HasPrefix(g.State, "semacquire"):
+		return "waiting on a lock or WaitGroup that is never released"
+	case strings.HasPrefix(g.State, "sleep"):
+		return "sleeping: may still exit on its own"
+	}
+	return g.State
+}
+
+// PrintLeaks writes a report of leaks to w: one line per group of goroutines stuck
+// in the same place, and the stack of one of each group.
+func PrintLeaks(w io.Writer, leaks []Leak) {
+	if len(leaks) == 0 {
+		fmt.Fprintln(w, "leaks: none")
+		return
+	}
+	type group struct {
+		Leak
+		n int
+	}
+	groups := map[string]*group{}
+	var keys []string
+	for _, l := range leaks {
+		key := l.State + "|" + l.Top + "|" + l.CreatedBy
+		if g := groups[key]; g != nil {
+			g.n++
+			continue
+		}
+		groups[key] = &group{Leak: l, n: 1}
+		keys = append(keys, key)
+	}
+	sort.SliceStable(keys, func(i, j int) bool { return groups[keys[i]].n > groups[keys[j]].n })
+	fmt.Fprintf(w, "leaks: %d goroutine(s) outlived the run\n", len(leaks))
+	for _, k := range keys {
+		g := groups[k]
+		fmt.Fprintf(w, "  %d x [%s] in %s, started by %s: %s\n", g.n, g.State, g.Top, g.CreatedBy, g.Reason)
+	}
+	for _, k := range keys {
+		fmt.Fprintf(w, "\n%s\n", groups[k].Stack)
+	}
+}
+
+// TB is the part of testing.TB that CheckLeaks uses.
+type TB interface {
+	Helper()
+	Errorf(format string, args ...any)
+}
+
+// CheckLeaks fails t if goroutines started since the snapshot are still there
+// after up to grace, listing them. Use it at the end of a test:
+//
+//	snap := goose.TakeLeakSnapshot()
+//	defer goose.CheckLeaks(t, snap, time.Second)
+func CheckLeaks(t TB, snap LeakSnapshot, grace time.Duration) {
+	t.Helper()
+	if leaks := snap.Leaks(grace); len(leaks) > 0 {
+		var sb strings.Builder
+		PrintLeaks(&sb, leaks)
+		t.Errorf("%s", sb.String())
+	}
+}
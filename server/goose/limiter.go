@@ -0,0 +1,169 @@
+package goose
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// -------------------- resizable concurrency limit --------------------
+
+// Limiter is a counting semaphore whose limit can be changed while it is in use.
+// Like the channel semaphore in ReqHandler it is built from message passing:
+// a goroutine owns the count and the limit, hands out permits on a channel while
+// the count is below the limit, and takes them back on another channel.
+// Lowering the limit never revokes permits already granted; it only holds back
+// new ones until enough holders release.
+type Limiter struct {
+	grants   chan Permission
+	releases chan Permission
+	setCh    chan int
+	tryCh    chan chan bool
+	done     chan struct{}
+
+	limit atomic.Int64 // published copies for Limit and InUse
+	inUse atomic.Int64
+
+	holdMu sync.Mutex
+	holds  []time.Duration // service times of requests served under this limiter, not yet taken
+}
+
+// NewLimiter returns a running Limiter that allows n concurrent holders (at least 1).
+// Call Close when it is no longer needed.
+func NewLimiter(n int) *Limiter {
+	if n <= 0 {
+		n = 1
+	}
+	l := &Limiter{
+		grants:   make(chan Permission),
+		releases: make(chan Permission),
+		setCh:    make(chan int),
+		tryCh:    make(chan chan bool),
+		done:     make(chan struct{}),
+	}
+	l.limit.Store(int64(n))
+	go l.run(n)
+	return l
+}
+
+func (l *Limiter) run(limit int) {
+	inUse := 0
+	for {
+		// Only offer a permit while below the limit.
+		var grants chan<- Permission
+		if inUse < limit {
+			grants = l.grants
+		}
+		select {
+		case grants <- Permission{}:
+			inUse++
+		case <-l.releases:
+			inUse--
+		case limit = <-l.setCh:
+		case reply := <-l.tryCh:
+			ok := inUse < limit
+			if ok {
+				inUse++
+			}
+			reply <- ok
+		case <-l.done:
+			return
+		}
+		l.inUse.Store(int64(inUse))
+		l.limit.Store(int64(limit))
+	}
+}
+
+// Acquire blocks until a permit is available and takes it.
+func (l *Limiter) Acquire() {
+	<-l.grants
+}
+
+// TryAcquire takes a permit if one is available right now and reports whether it did.
+func (l *Limiter) TryAcquire() bool {
+	reply := make(chan bool, 1)
+	l.tryCh <- reply
+	return <-reply
+}
+
+// Grants returns the channel on which permits are offered, for use in a select.
+// Receiving from it is equivalent to Acquire.
+func (l *Limiter) Grants() <-chan Permission {
+	return l.grants
+}
+
+// Release returns a permit taken with Acquire or from Grants.
+func (l *Limiter) Release() {
+	l.releases <- Permission{}
+}
+
+// SetLimit changes the number of concurrent holders allowed (at least 1).
+// After Close it does nothing, so a controller stopping after the Limiter
+// does not block.
+func (l *Limiter) SetLimit(n int) {
+	if n <= 0 {
+		n = 1
+	}
+	select {
+	case l.setCh <- n:
+		l.limit.Store(int64(n))
+	case <-l.done:
+	}
+}
+
+// Limit returns the current limit.
+func (l *Limiter) Limit() int {
+	return int(l.limit.Load())
+}
+
+// InUse returns the number of permits currently held.
+func (l *Limiter) InUse() int {
+	return int(l.inUse.Load())
+}
+
+// Close stops the Limiter's goroutine. Permits must not be acquired or released
+// afterwards; SetLimit may still be called and does nothing.
+func (l *Limiter) Close() {
+	close(l.done)
+}
+
+// maxHolds bounds the number of unread service times a Limiter keeps.
+const maxHolds = 1 << 16
+
+// recordHold notes the service time of one request served under l.
+func (l *Limiter) recordHold(d time.Duration) {
+	l.holdMu.Lock()
+	if len(l.holds) < maxHolds {
+		l.holds = append(l.holds, d)
+	}
+	l.holdMu.Unlock()
+}
+
+// takeHolds returns and clears the service times recorded since the last call.
+func (l *Limiter) takeHolds() []time.Duration {
+	l.holdMu.Lock()
+	defer l.holdMu.Unlock()
+	out := l.holds
+	l.holds = nil
+	return out
+}
+
+// LimitedHandler is ReqHandlerWith with a Limiter in place of the fixed channel
+// semaphore, so the concurrency limit can be changed with lim.SetLimit while it runs.
+func LimitedHandler(reqCh <-chan Request, lim *Limiter, h Handler) {
+	if h == nil {
+		h = DemandHandler
+	}
+	for req := range reqCh {
+		lim.Acquire()
+		go serveLimited(req, h, lim, sendReply, CancelledUpcall)
+	}
+}
+
+// serveLimited serves one request while holding a permit from lim.
+func serveLimited(r Request, h Handler, lim *Limiter, deliver func(r, rep Request), cancelled func(rep Request)) {
+	defer lim.Release()
+	start := clockNow()
+	handleWith(r, h, deliver, cancelled)
+	lim.recordHold(clockSince(start))
+}
@@ -0,0 +1,103 @@
+package goose
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiterLimitsHolders(t *testing.T) {
+	l := NewLimiter(2)
+	defer l.Close()
+	l.Acquire()
+	if !l.TryAcquire() {
+		t.Fatal("second permit refused under a limit of 2")
+	}
+	if l.TryAcquire() {
+		t.Fatal("third permit granted under a limit of 2")
+	}
+	if n := l.InUse(); n != 2 {
+		t.Errorf("InUse = %d, want 2", n)
+	}
+
+	got := make(chan struct{})
+	go func() {
+		l.Acquire()
+		close(got)
+	}()
+	select {
+	case <-got:
+		t.Fatal("Acquire returned while every permit is held")
+	case <-time.After(20 * time.Millisecond):
+	}
+	l.Release()
+	select {
+	case <-got:
+	case <-time.After(time.Second):
+		t.Fatal("Acquire still blocked after a Release")
+	}
+}
+
+// Lowering the limit revokes nothing but holds back new permits until enough
+// holders release; raising it grants more at once.
+func TestLimiterSetLimit(t *testing.T) {
+	l := NewLimiter(3)
+	defer l.Close()
+	for range 3 {
+		l.Acquire()
+	}
+	l.SetLimit(1)
+	if l.Limit() != 1 {
+		t.Errorf("Limit = %d, want 1", l.Limit())
+	}
+	l.Release()
+	l.Release()
+	if l.TryAcquire() {
+		t.Fatal("permit granted with 1 held under a limit of 1")
+	}
+	l.Release()
+	if !l.TryAcquire() {
+		t.Fatal("permit refused with none held under a limit of 1")
+	}
+	l.SetLimit(3)
+	if !l.TryAcquire() || !l.TryAcquire() {
+		t.Fatal("permits refused after raising the limit to 3")
+	}
+	l.SetLimit(0)
+	if l.Limit() != 1 {
+		t.Errorf("SetLimit(0): Limit = %d, want 1", l.Limit())
+	}
+}
+
+// SetLimit after Close returns at once and leaves the limit as it was.
+func TestLimiterSetLimitAfterClose(t *testing.T) {
+	l := NewLimiter(2)
+	l.Close()
+	done := make(chan struct{})
+	go func() {
+		l.SetLimit(5)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("SetLimit blocked after Close")
+	}
+	if l.Limit() != 2 {
+		t.Errorf("Limit = %d after SetLimit on a closed limiter, want 2", l.Limit())
+	}
+}
+
+func TestLimiterGrantsInSelect(t *testing.T) {
+	l := NewLimiter(1)
+	defer l.Close()
+	select {
+	case <-l.Grants():
+	case <-time.After(time.Second):
+		t.Fatal("no permit offered by a free limiter")
+	}
+	select {
+	case <-l.Grants():
+		t.Fatal("permit offered past the limit")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
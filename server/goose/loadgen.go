@@ -2,7 +2,10 @@ package goose
 
 import (
 	"fmt"
+	"io"
 	"math/rand"
+	"os"
+	"sync"
 	"time"
 )
 
@@ -23,14 +26,179 @@ import (
 // - Loadgen processes replies as they arrive and calls ReceiveUpcall for each.
 
 func Loadgen(reqCh chan<- Request, repCh chan Request, n int, iatMeanMs, waitMeanMs float64) {
+	LoadgenWith(reqCh, repCh, n, iatMeanMs, waitMeanMs, LoadOptions{})
+}
+
+// LoadOptions holds optional knobs for LoadgenWith. The zero value gives plain Loadgen.
+type LoadOptions struct {
+	// DeadlineMeanMs, if positive, gives each request a Deadline this many milliseconds
+	// (exponentially distributed) after its arrival.
+	DeadlineMeanMs float64
+
+	// ReplyCostMeanMs, if positive, gives each request an exponentially distributed
+	// ReplyCost with this mean; ReplyCPU selects CPU rather than sleep for it.
+	ReplyCostMeanMs float64
+	ReplyCPU        bool
+
+	// TimeoutMs, if positive, makes Loadgen give up on a request that has not been
+	// answered this many milliseconds after it was sent: it closes the request's
+	// Cancel channel, so the server can abandon the work, and counts it as timed out.
+	TimeoutMs float64
+
+	// HedgePercentile, if positive, makes Loadgen hedge: when a request has not been
+	// answered within this percentile of the response times seen so far, it sends a
+	// duplicate (with a fresh wait demand, as if to another replica) and takes
+	// whichever reply comes first. HedgeAfterMs, if positive, is
+	// the delay used until there are enough samples (or always, without a percentile).
+	HedgePercentile float64
+	HedgeAfterMs    float64
+
+	// ReplyDrainers, if positive, moves reply processing out of the arrival loop
+	// into this many goroutines, so that a burst of replies cannot delay arrivals.
+	ReplyDrainers int
+
+	// ReplyChannels, if positive, makes Loadgen create this many reply channels of
+	// its own, with ReplyBuffer slots each (default 1), instead of having every
+	// request reply on repCh: the requests of client i reply on channel i mod
+	// ReplyChannels, and a fan-in goroutine merges the channels for reply processing.
+	ReplyChannels int
+	ReplyBuffer   int
+
+	// IOMeanKB, if positive, gives each request an exponentially distributed
+	// IODemand with this mean, read from the simulated disk (see SetDisk).
+	IOMeanKB float64
+
+	// AllocMeanKB, if positive, gives each request an exponentially distributed
+	// AllocDemand with this mean, so that the server's heap grows with the load.
+	AllocMeanKB float64
+
+	// Clients, if positive, replaces the open arrival process with this many virtual
+	// clients in a closed loop, each issuing its next request Think after the reply
+	// to its last; iatMeanMs is then ignored. Only Objects and the reply channel
+	// options apply to them.
+	Clients int
+	Think   ThinkConfig
+
+	// Objects selects how ObjectIDs are chosen; the zero value is uniform over 1024.
+	Objects ObjectConfig
+
+	// Arrivals selects the arrival process; the zero value is Poisson.
+	Arrivals ArrivalConfig
+
+	// Trace, if set, replaces the generated arrivals: Loadgen replays the trace's
+	// arrival times (divided by TraceSpeed, if positive) and demands, and sends
+	// len(Trace) requests regardless of n.
+	Trace      []TraceEntry
+	TraceSpeed float64
+
+	// Record, if set, receives every arrival Loadgen generates, sent or skipped.
+	Record *TraceRecorder
+
+	// BatchArrivals, if set, sends every arrival that is already due whenever the
+	// arrival timer fires, rather than one per firing. Timers cannot fire more often
+	// than the operating system allows (often every millisecond or so), so at shorter
+	// inter-arrival times this keeps the intended rate, in bursts.
+	BatchArrivals bool
+
+	// CatchUpMs, if positive, sends every arrival already due, as BatchArrivals
+	// does, but only when the schedule has fallen more than this far behind.
+	CatchUpMs float64
+
+	// BatchReplies, if set, takes every reply already waiting whenever the loop
+	// takes one, instead of going around the select for each (see GetBatchStats).
+	BatchReplies bool
+
+	// Backpressure, if its Threshold is positive, slows the arrivals down while the
+	// server reports that it is overloaded.
+	Backpressure BackpressureConfig
+
+	// Seed, if nonzero, seeds the random arrivals and demands, so that runs with the
+	// same seed offer the same workload.
+	Seed int64
+
+	// RateDial, if set, scales the arrival rate by its current setting, which may
+	// change during the run (see StartTUI). It does not apply to closed-loop clients.
+	RateDial *RateDial
+
+	// SkipWarn, if positive, warns when more than this fraction of arrivals are
+	// skipped, and reports the offered load against the intended load.
+	// SendTimeoutMs and AutoBuffer reduce the skips (see skipfeedback.go).
+	SkipWarn      float64
+	SendTimeoutMs float64
+	AutoBuffer    int
+
+	// Stop, if set, ends the run early when it is closed: Loadgen generates no more
+	// arrivals and returns once the requests already sent are settled, leaving the
+	// stats of the partial run. Sweep and Repeat start no more experiments.
+	Stop <-chan struct{}
+
+	// Validate, if set, checks every reply against its request (see validate.go).
+	Validate Validator
+
+	// Classes, if set, makes the workload a mix: each arrival belongs to one class,
+	// chosen by weight, which sets its Tag and the distribution of its demand.
+	Classes []Class
+
+	// Tenants, if set, splits the arrivals among tenants by their shares and sets
+	// each request's TenantID (see Tenant). Closed-loop clients ignore it.
+	Tenants []Tenant
+
+	// Log, if set, receives the lines Loadgen prints at the end of a run (the
+	// offered load and any warnings); nil means standard output.
+	Log io.Writer
+
+	// Collector, if set, receives the run's stats instead of the package stats, so
+	// that runs can overlap (see Run).
+	Collector *Collector
+}
+
+// stats returns the Collector the run records in.
+func (opts LoadOptions) stats() *Collector {
+	if opts.Collector != nil {
+		return opts.Collector
+	}
+	return defaultCollector
+}
+
+// log returns the writer for Loadgen's report lines.
+func (opts LoadOptions) log() io.Writer {
+	if opts.Log != nil {
+		return opts.Log
+	}
+	return os.Stdout
+}
+
+// seed returns the RNG seed to use: Seed, or the time if it is not set.
+func (opts LoadOptions) seed() int64 {
+	if opts.Seed != 0 {
+		return opts.Seed
+	}
+	return time.Now().UnixNano()
+}
+
+// hedgeMinSamples is the number of replies Loadgen waits for before trusting
+// the percentile of their response times as a hedging delay.
+const hedgeMinSamples = 20
+
+// LoadgenWith is Loadgen with extra options.
+func LoadgenWith(reqCh chan<- Request, repCh chan Request, n int, iatMeanMs, waitMeanMs float64, opts LoadOptions) {
+	if len(opts.Trace) > 0 {
+		n = len(opts.Trace)
+	}
 	if n <= 0 {
 		return
 	}
 	// ensure stats cleared
-	ResetStats()
+	stats := opts.stats()
+	stats.ResetStats()
+	stats.setValidator(opts.Validate)
+	if opts.Clients > 0 {
+		closedLoadgen(reqCh, repCh, n, waitMeanMs, opts)
+		return
+	}
 
 	// RNG
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	r := rand.New(rand.NewSource(opts.seed()))
 	expMs := func(mean float64) time.Duration {
 		return time.Duration(r.ExpFloat64() * mean * float64(time.Millisecond))
 	}
@@ -42,9 +210,104 @@ func Loadgen(reqCh chan<- Request, repCh chan Request, n int, iatMeanMs, waitMea
 	var timer *time.Timer
 	var timerC <-chan time.Time
 	// schedule first arrival
-	timer = time.NewTimer(expMs(iatMeanMs))
+	// intended is when the next arrival is due; latency measured from it rather than
+	// from the actual send is free of coordinated omission (see SendUpcallAt)
+	nextIat := newArrivals(opts.Arrivals, iatMeanMs, r)
+	if len(opts.Trace) > 0 {
+		nextIat = traceArrivals(opts.Trace, opts.TraceSpeed)
+	}
+	nextObject := newObjects(opts.Objects, r)
+
+	// backpressure: the arrival rate follows the server's load reports
+	pace := newThrottle(opts.Backpressure)
+	pace.dial = opts.RateDial
+	var pressure <-chan Pressure
+	if opts.Backpressure.Threshold > 0 {
+		pressure = opts.Backpressure.Signal
+	}
+	stopC := opts.Stop
+
+	firstIat := nextIat()
+	traceStart := time.Now()
+	intended := traceStart.Add(firstIat)
+	if opts.Record != nil {
+		opts.Record.reset()
+	}
+	timer = time.NewTimer(firstIat)
 	timerC = timer.C
+	lastArrival := time.Now() // for recording the actual inter-arrival times
 	
+	// request timeouts: with a fixed timeout, expiries come due in send order
+	type pendingTimeout struct {
+		req    Request
+		at     time.Time
+		cancel chan struct{}
+	}
+	var timeouts []pendingTimeout
+	var toTimer *time.Timer
+	var toC <-chan time.Time
+	timeout := time.Duration(opts.TimeoutMs * float64(time.Millisecond))
+	catchUp := time.Duration(opts.CatchUpMs * float64(time.Millisecond))
+	feedback := newSkipFeedback(opts)
+
+	// hedging: the delay depends on the samples at send time, so expiries are
+	// not in send order; there are few enough outstanding to scan them all
+	type pendingHedge struct {
+		req Request
+		at  time.Time
+	}
+	var hedges []pendingHedge
+	var hedgeTimer *time.Timer
+	var hedgeC <-chan time.Time
+	hedging := opts.HedgePercentile > 0 || opts.HedgeAfterMs > 0
+	hedgeDelay := time.Duration(opts.HedgeAfterMs * float64(time.Millisecond))
+	armHedge := func() {
+		if hedgeTimer != nil {
+			hedgeTimer.Stop()
+		}
+		hedgeC = nil
+		if len(hedges) == 0 {
+			return
+		}
+		first := hedges[0].at
+		for _, h := range hedges[1:] {
+			if h.at.Before(first) {
+				first = h.at
+			}
+		}
+		hedgeTimer = time.NewTimer(time.Until(first))
+		hedgeC = hedgeTimer.C
+	}
+
+	// replies, repCh unless the requests have reply channels of their own
+	merged, replyCh, fan := startReplies(repCh, opts)
+
+	// reply drainers: with them, the loop below leaves the replies alone and learns
+	// of the end of the run from the settled signal
+	stopDrain := make(chan struct{})
+	var drainers sync.WaitGroup
+	for i := 0; i < opts.ReplyDrainers; i++ {
+		drainers.Add(1)
+		go func(repCh <-chan Request) {
+			defer drainers.Done()
+			for {
+				select {
+				case rep, ok := <-repCh:
+					if !ok {
+						return
+					}
+					stats.ReceiveUpcall(rep)
+				case <-stopDrain:
+					return
+				}
+			}
+		}(merged)
+	}
+	replies := merged // what the loop below reads
+	if opts.ReplyDrainers > 0 {
+		replies = nil
+	}
+
 	startup := time.Now()
 	elapsed := time.Since(startup)
 
@@ -52,9 +315,9 @@ func Loadgen(reqCh chan<- Request, repCh chan Request, n int, iatMeanMs, waitMea
 	for {
 		// termination condition:
 		// attempts >= n and no outstanding sendTimes entries (i.e., all replies received for sends)
-		statsMu.Lock()
-		outstanding := len(sendTimes)
-		statsMu.Unlock()
+		stats.mu.Lock()
+		outstanding := len(stats.sendTimes)
+		stats.mu.Unlock()
 		if sentAttempts >= n && outstanding == 0 {
 			// stop timer if active
 			if timer != nil {
@@ -65,36 +328,135 @@ func Loadgen(reqCh chan<- Request, repCh chan Request, n int, iatMeanMs, waitMea
 					}
 				}
 			}
+			if toTimer != nil {
+				toTimer.Stop()
+			}
+			if hedgeTimer != nil {
+				hedgeTimer.Stop()
+			}
 			break
 		}
 
+		overflowC, overflowHead := feedback.head(reqCh)
 		select {
+		case overflowC <- overflowHead:
+			feedback.pop()
+
 		case <-timerC:
-			// arrival scheduled
-			sentAttempts++
-			waitDur := expMs(waitMeanMs)
-			req := Request{
-				ClientID:   nextClientID,
-				ObjectID:   r.Intn(1024),
-				WorkDemand: 0,
-				WaitDemand: int(waitDur / time.Millisecond),
-				ReplyCh:    repCh,
+			// arrival scheduled; with BatchArrivals, every arrival already due goes out now,
+			// and with CatchUpMs, so does every arrival due when the schedule is far behind
+			burst := 0
+			for {
+				arrival := time.Now()
+				sentAttempts++
+				waitDur := expMs(waitMeanMs)
+				req := Request{
+					ClientID:   nextClientID,
+					ObjectID:   nextObject(arrival.Sub(traceStart)),
+					WorkDemand: 0,
+					WaitDemand: int(waitDur / time.Millisecond),
+					ReplyCh:    replyCh(nextClientID),
+				}
+				if len(opts.Trace) > 0 {
+					e := opts.Trace[sentAttempts-1]
+					req.ObjectID, req.WorkDemand, req.WaitDemand = e.ObjectID, e.WorkMs, e.WaitMs
+				} else if len(opts.Classes) > 0 {
+					c := pickClass(opts.Classes, r.Float64())
+					req.Tag, req.Priority = c.Tag, c.Priority
+					c.draw(&req, waitMeanMs, r)
+				}
+				if len(opts.Tenants) > 0 {
+					req.TenantID = pickTenant(opts.Tenants, r.Float64())
+				}
+				if opts.IOMeanKB > 0 && len(opts.Trace) == 0 {
+					req.IODemand = int(r.ExpFloat64() * opts.IOMeanKB)
+				}
+				if opts.AllocMeanKB > 0 {
+					req.AllocDemand = int(r.ExpFloat64() * opts.AllocMeanKB)
+				}
+				if opts.DeadlineMeanMs > 0 {
+					req.Deadline = time.Now().Add(expMs(opts.DeadlineMeanMs))
+				}
+				if opts.ReplyCostMeanMs > 0 {
+					req.ReplyCost = int(expMs(opts.ReplyCostMeanMs) / time.Millisecond)
+					req.ReplyCPU = opts.ReplyCPU
+				}
+				var cancel chan struct{}
+				if timeout > 0 {
+					cancel = make(chan struct{})
+					req.Cancel = cancel
+				}
+				nextClientID++
+				stats.GenUpcall(arrival.Sub(lastArrival), arrival.Sub(intended), req)
+				lastArrival = arrival
+
+				// non-blocking send attempt, unless skip feedback says otherwise
+				sentOK := feedback.trySend(reqCh, req)
+				feedback.attempt(!sentOK)
+				if sentOK {
+					stats.SendUpcallAt(req, false, intended)
+					if hedging {
+						// refresh the percentile every so often rather than on every send
+						if opts.HedgePercentile > 0 && sentAttempts%64 == 1 {
+							if samps := stats.GetSamples(); len(samps) >= hedgeMinSamples {
+								hedgeDelay = time.Duration(percentileOf(samps, opts.HedgePercentile) * float64(time.Millisecond))
+							}
+						}
+						if hedgeDelay > 0 {
+							hedges = append(hedges, pendingHedge{req: req, at: time.Now().Add(hedgeDelay)})
+							if len(hedges) == 1 {
+								armHedge()
+							}
+						}
+					}
+					if timeout > 0 {
+						timeouts = append(timeouts, pendingTimeout{req: req, at: time.Now().Add(timeout), cancel: cancel})
+						if toC == nil {
+							toTimer = time.NewTimer(timeout)
+							toC = toTimer.C
+						}
+					}
+				} else {
+					// skipped
+					stats.SendUpcallAt(req, true, intended)
+				}
+				if opts.Record != nil {
+					opts.Record.add(TraceEntry{
+						OffsetMs: float64(intended.Sub(traceStart)) / float64(time.Millisecond),
+						WorkMs:   req.WorkDemand,
+						WaitMs:   req.WaitDemand,
+						ObjectID: req.ObjectID,
+						Skipped:  !sentOK,
+					})
+				}
+
+				if sentAttempts >= n {
+					break
+				}
+				// schedule from the intended time, not from now, so that time spent
+				// in this loop does not stretch the arrival process
+				intended = intended.Add(pace.stretch(nextIat()))
+				now := time.Now()
+				if intended.After(now) {
+					break
+				}
+				if !opts.BatchArrivals {
+					if catchUp <= 0 || now.Sub(intended) <= catchUp && burst == 0 {
+						break
+					}
+					burst++
+				}
 			}
-			nextClientID++
-
-			// non-blocking send attempt
-			select {
-			case reqCh <- req:
-				SendUpcall(req, false)
-			default:
-				// skipped
-				SendUpcall(req, true)
+			if burst > 0 {
+				stats.catchUpBursts.Add(1)
+				stats.catchUpArrivals.Add(int64(burst))
 			}
 
 			// schedule next if needed
 			if sentAttempts < n {
+				iat := time.Until(intended)
 				if timer == nil {
-					timer = time.NewTimer(expMs(iatMeanMs))
+					timer = time.NewTimer(iat)
 				} else {
 					if !timer.Stop() {
 						select {
@@ -102,7 +464,7 @@ func Loadgen(reqCh chan<- Request, repCh chan Request, n int, iatMeanMs, waitMea
 						default:
 						}
 					}
-					timer.Reset(expMs(iatMeanMs))
+					timer.Reset(iat)
 				}
 				timerC = timer.C
 			} else {
@@ -121,23 +483,97 @@ func Loadgen(reqCh chan<- Request, repCh chan Request, n int, iatMeanMs, waitMea
 				timerC = nil
 			}
 
-		case rep, ok := <-repCh:
+		case now := <-toC:
+			// give up on requests whose timeout has expired
+			for len(timeouts) > 0 && !timeouts[0].at.After(now) {
+				t := timeouts[0]
+				timeouts = timeouts[1:]
+				if stats.TimeoutUpcall(t.req) {
+					close(t.cancel)
+				}
+			}
+			toC = nil
+			if len(timeouts) > 0 {
+				toTimer = time.NewTimer(time.Until(timeouts[0].at))
+				toC = toTimer.C
+			}
+
+		case now := <-hedgeC:
+			// send a duplicate of each request still unanswered past its hedge delay
+			due := hedges[:0]
+			var later []pendingHedge
+			for _, h := range hedges {
+				if h.at.After(now) {
+					later = append(later, h)
+				} else {
+					due = append(due, h)
+				}
+			}
+			for _, h := range due {
+				// The duplicate stands for a copy sent to another replica, whose
+				// service time is independent of the original's.
+				dup := h.req
+				dup.Hedge = true
+				if c := findClass(opts.Classes, dup.Tag); c != nil {
+					c.draw(&dup, waitMeanMs, r)
+				} else {
+					dup.WaitDemand = int(expMs(waitMeanMs) / time.Millisecond)
+				}
+				if !stats.isOutstanding(dup.ClientID) {
+					continue // already answered or given up on
+				}
+				select {
+				case reqCh <- dup:
+					stats.HedgeUpcall(dup)
+				default:
+					// no room: do without the hedge
+				}
+			}
+			hedges = later
+			armHedge()
+
+		case p := <-pressure:
+			pace.observe(p)
+
+		case <-stopC:
+			// no more arrivals: the run ends once the outstanding requests are settled
+			stopC = nil
+			n = sentAttempts
+			timerC = nil
+			elapsed = time.Since(startup)
+
+		case <-stats.settled:
+			// nothing outstanding: see whether the run is over
+
+		case rep, ok := <-replies:
 			if !ok {
 				// reply channel closed: no further replies
-				// set repCh nil so we don't read again
-				repCh = nil
+				// set replies nil so we don't read again
+				replies = nil
 				// continue loop; termination depends on attempts/outstanding
 				continue
 			}
 			// inform stats
-			ReceiveUpcall(rep)
+			stats.ReceiveUpcall(rep)
+			if opts.BatchReplies {
+				replies = stats.drainReplies(replies)
+			}
 
 		}
 	}
 
-	// Loadgen done. leave stats in package globals for caller to inspect/plot.
+	close(stopDrain)
+	drainers.Wait()
+	fan.close(timeout > 0 || hedging)
+
+	// Loadgen done. leave stats in the Collector for caller to inspect/plot.
 	seconds := elapsed.Seconds()
 	lambda := float64(n) / seconds
 	cleartime := time.Since(startup) - elapsed
-	fmt.Printf("sent=%d offered load lambda=%.2f/sec, clear time=%dms\n", n, lambda, cleartime.Milliseconds())
+	fmt.Fprintf(opts.log(), "sent=%d offered load lambda=%.2f/sec, clear time=%dms\n", n, lambda, cleartime.Milliseconds())
+	if pressure != nil {
+		pace.report(opts.log(), elapsed)
+	}
+	_, _, skippedNow, _, _ := stats.GetStats()
+	feedback.report(opts.log(), n, skippedNow, 1000/iatMeanMs, elapsed)
 }
@@ -0,0 +1,110 @@
+package goose
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// -------------------- run metadata --------------------
+
+// RunMetadata describes how and where results were produced, so that a results
+// file can be understood, reproduced, and compared with one from another machine.
+type RunMetadata struct {
+	Command    []string  `json:"command"` // the program and its arguments
+	Params     []string  `json:"params"`  // the flags set, as name=value
+	GoVersion  string    `json:"goVersion"`
+	GOOS       string    `json:"goos"`
+	GOARCH     string    `json:"goarch"`
+	GOMAXPROCS int       `json:"gomaxprocs"`
+	NumCPU     int       `json:"numCPU"`
+	CPUIters   int64     `json:"cpuItersPerMs"` // burn loop iterations per millisecond of CPU work (see CalibrateCPU)
+	Hostname   string    `json:"hostname"`
+	GitCommit  string    `json:"gitCommit,omitempty"` // "" if unknown; ends in "-dirty" if there were uncommitted changes
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+}
+
+// CaptureMetadata describes the current process and machine. params are the
+// settings to record, such as the flags given; Start is now, and the caller sets
+// End when the run is over.
+func CaptureMetadata(params []string) RunMetadata {
+	m := RunMetadata{
+		Command:    os.Args,
+		Params:     params,
+		GoVersion:  runtime.Version(),
+		GOOS:       runtime.GOOS,
+		GOARCH:     runtime.GOARCH,
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+		NumCPU:     runtime.NumCPU(),
+		CPUIters:   CalibrateCPU(),
+		GitCommit:  gitCommit(),
+		Start:      time.Now(),
+	}
+	m.Hostname, _ = os.Hostname()
+	return m
+}
+
+// gitCommit returns the commit the program was built from: from the build info
+// when the go command recorded it, or else from git in the working directory,
+// as with go run.
+func gitCommit() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		rev, dirty := "", false
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				rev = s.Value
+			case "vcs.modified":
+				dirty = s.Value == "true"
+			}
+		}
+		if rev != "" {
+			if dirty {
+				rev += "-dirty"
+			}
+			return rev
+		}
+	}
+	out, err := exec.Command("git", "rev-parse", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+	rev := strings.TrimSpace(string(out))
+	if st, err := exec.Command("git", "status", "--porcelain", "--untracked-files=no").Output(); err == nil && len(st) > 0 {
+		rev += "-dirty"
+	}
+	return rev
+}
+
+// WriteMetadata writes m as comment lines ("# key: value"), which can head a CSV
+// results file: PlotCSV skips them, as do most CSV readers given the comment
+// character (pandas.read_csv(path, comment="#")). The end time is left out if
+// it is not set yet, as at the top of a file written while the run goes on.
+func WriteMetadata(w io.Writer, m RunMetadata) error {
+	lines := [][2]string{
+		{"command", strings.Join(m.Command, " ")},
+		{"params", strings.Join(m.Params, " ")},
+		{"go", fmt.Sprintf("%s %s/%s", m.GoVersion, m.GOOS, m.GOARCH)},
+		{"gomaxprocs", fmt.Sprint(m.GOMAXPROCS)},
+		{"numcpu", fmt.Sprint(m.NumCPU)},
+		{"cpu iters/ms", fmt.Sprint(m.CPUIters)},
+		{"host", m.Hostname},
+		{"commit", m.GitCommit},
+		{"start", m.Start.Format(time.RFC3339Nano)},
+	}
+	if !m.End.IsZero() {
+		lines = append(lines, [2]string{"end", m.End.Format(time.RFC3339Nano)})
+	}
+	for _, l := range lines {
+		if _, err := fmt.Fprintf(w, "# %s: %s\n", l[0], l[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package goose
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+)
+
+// -------------------- Prometheus metrics endpoint --------------------
+
+// latencyBuckets are the upper bounds (seconds) of the response-time histogram buckets.
+var latencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// MetricsHandler returns an http.Handler that serves the package stats in the
+// Prometheus text exposition format. Counters restart from zero on ResetStats,
+// which Prometheus treats as a counter reset.
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteMetrics(w)
+	})
+}
+
+// StartMetrics serves MetricsHandler at /metrics on addr in the background.
+func StartMetrics(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", MetricsHandler())
+	go http.Serve(ln, mux)
+	return nil
+}
+
+// WriteMetrics writes the current stats to w in the Prometheus text format.
+func WriteMetrics(w io.Writer) {
+	c := defaultCollector
+	c.mu.Lock()
+	attemptsNow, sentNow, skippedNow, receivedNow := c.attempts, c.sent, c.skipped, c.received
+	outstanding := len(c.sendTimes)
+	counts := append([]int(nil), c.latencyCounts...)
+	sum := c.sampleSum.Seconds()
+	c.mu.Unlock()
+
+	counter := func(name, help string, v int) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+	}
+	gauge := func(name, help string, v int) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, v)
+	}
+
+	counter("goose_requests_attempted_total", "Arrivals generated by Loadgen, including skipped ones.", attemptsNow)
+	counter("goose_requests_sent_total", "Requests delivered to the request channel.", sentNow)
+	counter("goose_requests_skipped_total", "Arrivals skipped because the request channel was full.", skippedNow)
+	counter("goose_replies_received_total", "Replies received and matched to a request.", receivedNow)
+	gauge("goose_requests_outstanding", "Requests sent but not yet replied to.", outstanding)
+	gauge("goose_requests_in_flight", "Requests currently inside serve.", InFlight())
+	counter("goose_ratelimit_admitted_total", "Requests a rate limiter passed on without delay.", int(rateAdmitted.Load()))
+	counter("goose_ratelimit_delayed_total", "Requests a rate limiter passed on after a delay.", int(rateDelayed.Load()))
+	counter("goose_ratelimit_rejected_total", "Requests a rate limiter refused.", int(rateRejected.Load()))
+
+	const name = "goose_response_time_seconds"
+	fmt.Fprintf(w, "# HELP %s Response time of received replies.\n# TYPE %s histogram\n", name, name)
+	for i, le := range latencyBuckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, le, counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, receivedNow)
+	fmt.Fprintf(w, "%s_sum %g\n", name, sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, receivedNow)
+}
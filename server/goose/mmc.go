@@ -0,0 +1,115 @@
+package goose
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// -------------------- M/M/c model --------------------
+
+// An experiment with exponential inter-arrival times and exponential demands
+// against MaxConcurrent servers is, to a first approximation, an M/M/c queue,
+// and queueing theory predicts its utilization and waiting time exactly.
+// Comparing the prediction with the measurement shows both how good the model
+// is and where the experiment departs from it: Loadgen skips arrivals when the
+// request channel is full (so the queue is finite, M/M/c/K), demands are rounded
+// to whole milliseconds, and the server has overheads of its own.
+
+// MMCModel is the steady state of an M/M/c queue.
+type MMCModel struct {
+	Lambda float64 // arrivals per second
+	Mu     float64 // services per second, per server
+	C      int
+	Rho    float64 // utilization of each server, Lambda/(C*Mu)
+	Stable bool    // Rho < 1; otherwise the queue grows without bound
+	PWait  float64 // probability that an arrival waits (Erlang C)
+	Lq     float64 // mean number waiting
+	WqMs   float64 // mean wait in queue
+	WMs    float64 // mean response time, wait plus service
+}
+
+// MMC returns the M/M/c model of arrivals every iatMeanMs and services of
+// serviceMeanMs on average, with c servers.
+func MMC(iatMeanMs, serviceMeanMs float64, c int) MMCModel {
+	m := MMCModel{Lambda: 1000 / iatMeanMs, Mu: 1000 / serviceMeanMs, C: c}
+	a := m.Lambda / m.Mu // offered load in Erlangs
+	m.Rho = a / float64(c)
+	m.Stable = m.Rho < 1
+	if !m.Stable {
+		m.PWait, m.Lq, m.WqMs, m.WMs = 1, math.Inf(1), math.Inf(1), math.Inf(1)
+		return m
+	}
+	// sum_{k<c} a^k/k!, and a^c/c!, computed term by term
+	sum, term := 0.0, 1.0
+	for k := 0; k < c; k++ {
+		sum += term
+		term *= a / float64(k+1)
+	}
+	top := term / (1 - m.Rho)
+	m.PWait = top / (sum + top)
+	m.Lq = m.PWait * m.Rho / (1 - m.Rho)
+	m.WqMs = 1000 * m.Lq / m.Lambda
+	m.WMs = m.WqMs + serviceMeanMs
+	return m
+}
+
+// modelTolerance is the relative difference between model and measurement
+// beyond which PrintModelComparison flags a divergence.
+const modelTolerance = 0.25
+
+// PrintModelComparison prints the M/M/c prediction for the experiment of res next
+// to what it measured, and flags the measurements that diverge from the model.
+func PrintModelComparison(res Result) {
+	m := MMC(res.IatMean, res.DemandMean, res.MaxConcurrent)
+	if !m.Stable {
+		fmt.Printf("model M/M/%d: lambda=%.1f/sec mu=%.1f/sec rho=%.3f: unstable, the queue grows without bound\n",
+			m.C, m.Lambda, m.Mu, m.Rho)
+	} else {
+		fmt.Printf("model M/M/%d: lambda=%.1f/sec mu=%.1f/sec rho=%.3f P(wait)=%.3f Wq=%.3fms W=%.3fms\n",
+			m.C, m.Lambda, m.Mu, m.Rho, m.PWait, m.WqMs, m.WMs)
+	}
+	secs := res.Elapsed.Seconds()
+	st := res.Server
+	if secs <= 0 || st.Served == 0 {
+		return
+	}
+	util := st.BusyTime.Seconds() / (secs * float64(res.MaxConcurrent))
+	svcMs := durationMs(st.BusyTime) / float64(st.Served)
+	waitMs := max(res.MeanRT-svcMs, 0)
+	fmt.Printf("measured:   throughput=%.1f/sec util=%.3f service=%.3fms Wq=%.3fms W=%.3fms\n",
+		res.Throughput, util, svcMs, waitMs, res.MeanRT)
+
+	var notes []string
+	diverges := func(name string, model, measured float64) {
+		if model > 0 && math.Abs(measured-model) > modelTolerance*model {
+			notes = append(notes, fmt.Sprintf("%s %+.0f%%", name, 100*(measured-model)/model))
+		}
+	}
+	if m.Stable {
+		diverges("util", min(m.Rho, 1), util)
+		diverges("W", m.WMs, res.MeanRT)
+		// Small waits are dominated by overheads; compare them only when the model
+		// expects waiting to matter.
+		if m.WqMs > 0.1*res.DemandMean {
+			diverges("Wq", m.WqMs, waitMs)
+		}
+	} else {
+		notes = append(notes, "the model is unstable")
+	}
+	if len(notes) == 0 {
+		fmt.Printf("model agrees within %.0f%%\n", 100*modelTolerance)
+		return
+	}
+	fmt.Printf("DIVERGES from the model: %s", strings.Join(notes, ", "))
+	if res.Attempts > 0 && res.Skipped > 0 {
+		fmt.Printf("; %.1f%% of arrivals were skipped, so the queue was finite (M/M/c/K)", 100*float64(res.Skipped)/float64(res.Attempts))
+	}
+	if math.Abs(svcMs-res.DemandMean) > 0.05*res.DemandMean {
+		fmt.Printf("; mean service was %.3fms, not %.3fms", svcMs, res.DemandMean)
+		if adj := MMC(res.IatMean, svcMs, res.MaxConcurrent); adj.Stable {
+			fmt.Printf(", for which the model gives rho=%.3f Wq=%.3fms W=%.3fms", adj.Rho, adj.WqMs, adj.WMs)
+		}
+	}
+	fmt.Println()
+}
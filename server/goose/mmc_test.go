@@ -0,0 +1,29 @@
+package goose
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMMC(t *testing.T) {
+	near := func(got, want float64) bool { return math.Abs(got-want) < 1e-9 }
+	for _, tc := range []struct {
+		name              string
+		iat, svc          float64
+		c                 int
+		rho, pWait, wq, w float64
+	}{
+		// M/M/1: P(wait) = rho, W = 1/(mu-lambda)
+		{"M/M/1", 2, 1, 1, 0.5, 0.5, 1, 2},
+		// M/M/2 with one Erlang offered: Erlang C gives 1/3
+		{"M/M/2", 1, 1, 2, 0.5, 1.0 / 3, 1.0 / 3, 4.0 / 3},
+	} {
+		m := MMC(tc.iat, tc.svc, tc.c)
+		if !m.Stable || !near(m.Rho, tc.rho) || !near(m.PWait, tc.pWait) || !near(m.WqMs, tc.wq) || !near(m.WMs, tc.w) {
+			t.Errorf("%s: %+v, want rho %g P(wait) %g Wq %gms W %gms", tc.name, m, tc.rho, tc.pWait, tc.wq, tc.w)
+		}
+	}
+	if m := MMC(1, 2, 2); m.Stable || !math.IsInf(m.WMs, 1) {
+		t.Errorf("rho 1: %+v, want it unstable with an infinite wait", m)
+	}
+}
@@ -0,0 +1,381 @@
+package goose
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// -------------------- network transport --------------------
+
+// wireMsg is a request, reply, or cancellation on the wire, one JSON object per line.
+// ID numbers the requests of one connection; the client maps it back to the Request.
+type wireMsg struct {
+	ID         uint64      `json:"id"`
+	Cancel     bool        `json:"cancel,omitempty"` // client to server: give up on request ID
+	ObjectID   int         `json:"objectId,omitempty"`
+	WorkDemand int         `json:"work,omitempty"`
+	WaitDemand int         `json:"wait,omitempty"`
+	IODemand   int         `json:"io,omitempty"`
+	Alloc      int         `json:"alloc,omitempty"`
+	ReplyCost  int         `json:"replyCost,omitempty"`
+	ReplyCPU   bool        `json:"replyCpu,omitempty"`
+	Deadline   int64       `json:"deadline,omitempty"` // Unix nanoseconds; 0 means none
+	Status     ReplyStatus `json:"status,omitempty"`
+	Fault      string      `json:"fault,omitempty"`
+	Tag        string      `json:"tag,omitempty"`
+	Priority   int         `json:"priority,omitempty"`
+	TenantID   int         `json:"tenant,omitempty"`
+}
+
+func toWire(id uint64, r Request) wireMsg {
+	m := wireMsg{
+		ID:         id,
+		ObjectID:   r.ObjectID,
+		WorkDemand: r.WorkDemand,
+		WaitDemand: r.WaitDemand,
+		IODemand:   r.IODemand,
+		Alloc:      r.AllocDemand,
+		ReplyCost:  r.ReplyCost,
+		ReplyCPU:   r.ReplyCPU,
+		Status:     r.Status,
+		Fault:      r.Fault,
+		Tag:        r.Tag,
+		Priority:   r.Priority,
+		TenantID:   r.TenantID,
+	}
+	if !r.Deadline.IsZero() {
+		m.Deadline = r.Deadline.UnixNano()
+	}
+	return m
+}
+
+func (m wireMsg) request() Request {
+	r := Request{
+		ObjectID:    m.ObjectID,
+		WorkDemand:  m.WorkDemand,
+		WaitDemand:  m.WaitDemand,
+		IODemand:    m.IODemand,
+		AllocDemand: m.Alloc,
+		ReplyCost:   m.ReplyCost,
+		ReplyCPU:    m.ReplyCPU,
+		Status:      m.Status,
+		Fault:       m.Fault,
+		Tag:         m.Tag,
+		Priority:    m.Priority,
+		TenantID:    m.TenantID,
+	}
+	if m.Deadline != 0 {
+		r.Deadline = time.Unix(0, m.Deadline)
+	}
+	return r
+}
+
+// Serve listens for remote Loadgens on the TCP address addr and serves their requests
+// with h, at most runtime.NumCPU() at a time. It returns only on a listener error.
+func Serve(addr string, h Handler) error {
+	return ServeConfig(addr, ServerConfig{Handler: h, MaxConcurrent: runtime.NumCPU()})
+}
+
+// ServeConfig is Serve with a full server configuration: all connections feed one
+// Server, so its concurrency limit, queue, and mode apply across clients.
+func ServeConfig(addr string, cfg ServerConfig) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return ServeListener(ln, cfg)
+}
+
+// ServeListener is ServeConfig on an existing listener, which it wraps in TLS if
+// cfg.TLS is set. It closes ln on return.
+func ServeListener(ln net.Listener, cfg ServerConfig) error {
+	defer ln.Close()
+	if cfg.TLS != nil {
+		ln = tls.NewListener(ln, cfg.TLS)
+	}
+	// Every request gets exactly one message back to its connection, so that the
+	// connection knows when it is finished with: a dropped request is reported to
+	// the client (whose Loadgen then stops waiting), and so is the outcome of a
+	// cancelled one, which the client's Loadgen counts as abandoned or late.
+	cfg.Drop = func(r Request) {
+		rep := r
+		rep.Status = StatusDropped
+		sendReply(r, rep)
+	}
+	cfg.Cancelled = func(rep Request) {
+		sendReply(rep, rep)
+	}
+	reqCh := make(chan Request, 16)
+	srv := NewServer(WithConfig(cfg))
+	srv.Start(reqCh, make(chan Request))
+	defer srv.Stop()
+
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go serveConn(c, reqCh)
+	}
+}
+
+// serveConn passes the requests arriving on c to the server through reqCh and writes
+// their replies back. When the client goes away, its requests are cancelled, and the
+// connection lingers until the server has finished with all of them.
+func serveConn(c net.Conn, reqCh chan<- Request) {
+	replies := make(chan Request, 64)
+	var pending sync.WaitGroup // requests handed to the server and not yet replied to
+
+	var mu sync.Mutex
+	cancels := make(map[uint64]chan struct{})
+
+	done := make(chan struct{})
+	go func() {
+		// writer: runs until the client is gone and every reply is in
+		defer c.Close()
+		w := bufio.NewWriter(c)
+		enc := json.NewEncoder(w)
+		dead := false
+		for {
+			select {
+			case rep := <-replies:
+				id := uint64(rep.ClientID)
+				mu.Lock()
+				delete(cancels, id)
+				mu.Unlock()
+				if !dead {
+					if err := enc.Encode(toWire(id, rep)); err != nil {
+						dead = true
+					} else if len(replies) == 0 {
+						dead = w.Flush() != nil
+					}
+				}
+				pending.Done()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	dec := json.NewDecoder(bufio.NewReader(c))
+	for {
+		var m wireMsg
+		if err := dec.Decode(&m); err != nil {
+			break
+		}
+		mu.Lock()
+		if m.Cancel {
+			if cancel, ok := cancels[m.ID]; ok {
+				close(cancel)
+				delete(cancels, m.ID)
+			}
+			mu.Unlock()
+			continue
+		}
+		cancel := make(chan struct{})
+		cancels[m.ID] = cancel
+		mu.Unlock()
+
+		r := m.request()
+		r.ClientID = int(m.ID) // the server side only needs the connection's numbering
+		r.ReplyCh = replies
+		r.Cancel = cancel
+		pending.Add(1)
+		reqCh <- r
+	}
+
+	// The client is gone: nobody wants the outstanding replies.
+	mu.Lock()
+	for id, cancel := range cancels {
+		close(cancel)
+		delete(cancels, id)
+	}
+	mu.Unlock()
+	pending.Wait()
+	close(done)
+}
+
+// RemoteClient connects a Loadgen to a goose server in another process. Loadgen sends
+// requests on Requests() and reads replies from Replies() exactly as it would with an
+// in-process server, so measured response times include the network round trip.
+type RemoteClient struct {
+	conn    net.Conn
+	done    chan struct{} // closed by Close
+	reqCh   chan Request
+	repCh   chan Request
+	writeMu sync.Mutex
+	enc     *json.Encoder
+	w       *bufio.Writer
+
+	mu      sync.Mutex
+	pending map[uint64]remotePending
+	seq     uint64
+	closed  bool
+	sent    chan struct{} // closed when the sending loop has exited
+
+	collectorRef
+}
+
+type remotePending struct {
+	req     Request
+	replied chan struct{}
+}
+
+// Dial connects to a goose server listening on addr.
+func Dial(addr string) (*RemoteClient, error) {
+	return DialTLS(addr, nil)
+}
+
+// DialTLS is Dial over TLS with tlsCfg, or over plain TCP if tlsCfg is nil.
+// Without a ServerName, tlsCfg checks the server's certificate against the host
+// in addr.
+func DialTLS(addr string, tlsCfg *tls.Config) (*RemoteClient, error) {
+	var c net.Conn
+	var err error
+	if tlsCfg != nil {
+		c, err = tls.Dial("tcp", addr, tlsCfg)
+	} else {
+		c, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(c)
+	rc := &RemoteClient{
+		conn:    c,
+		done:    make(chan struct{}),
+		reqCh:   make(chan Request, 16),
+		repCh:   make(chan Request, 16),
+		enc:     json.NewEncoder(w),
+		w:       w,
+		pending: make(map[uint64]remotePending),
+		sent:    make(chan struct{}),
+	}
+	go rc.sendLoop()
+	go rc.recvLoop()
+	return rc, nil
+}
+
+// Requests returns the channel on which to send requests to the server.
+func (rc *RemoteClient) Requests() chan<- Request { return rc.reqCh }
+
+// Replies returns the channel on which the server's replies arrive.
+// Requests the server dropped are reported with DropUpcall instead.
+func (rc *RemoteClient) Replies() chan Request { return rc.repCh }
+
+// Close closes the request channel and the connection.
+func (rc *RemoteClient) Close() error {
+	close(rc.reqCh)
+	<-rc.sent
+	close(rc.done)
+	return rc.conn.Close()
+}
+
+func (rc *RemoteClient) write(m wireMsg) error {
+	rc.writeMu.Lock()
+	defer rc.writeMu.Unlock()
+	if err := rc.enc.Encode(m); err != nil {
+		return err
+	}
+	return rc.w.Flush()
+}
+
+func (rc *RemoteClient) sendLoop() {
+	defer close(rc.sent)
+	for r := range rc.reqCh {
+		rc.mu.Lock()
+		if rc.closed {
+			rc.mu.Unlock()
+			rc.stats().DropUpcall(r)
+			continue
+		}
+		rc.seq++
+		id := rc.seq
+		p := remotePending{req: r, replied: make(chan struct{})}
+		rc.pending[id] = p
+		rc.mu.Unlock()
+
+		if err := rc.write(toWire(id, r)); err != nil {
+			rc.fail()
+			continue
+		}
+		if r.Cancel != nil {
+			go func() {
+				select {
+				case <-r.Cancel:
+					rc.write(wireMsg{ID: id, Cancel: true})
+				case <-p.replied:
+				}
+			}()
+		}
+	}
+}
+
+func (rc *RemoteClient) recvLoop() {
+	dec := json.NewDecoder(bufio.NewReader(rc.conn))
+	for {
+		var m wireMsg
+		if err := dec.Decode(&m); err != nil {
+			break
+		}
+		rc.mu.Lock()
+		p, ok := rc.pending[m.ID]
+		delete(rc.pending, m.ID)
+		rc.mu.Unlock()
+		if !ok {
+			rc.stats().unmatchedReply(m.request(), fmt.Errorf("reply with id %d matches no outstanding request", m.ID))
+			continue
+		}
+		close(p.replied)
+		rep := p.req
+		rep.Status = m.Status
+		rep.Fault = m.Fault
+		rep.ObjectID = m.ObjectID // as the server echoed them, for validation
+		rep.Tag = m.Tag
+		if rep.Status == StatusDropped {
+			rc.stats().DropUpcall(rep)
+			continue
+		}
+		select {
+		case rc.repCh <- rep:
+		case <-rc.done:
+			return // nobody is reading replies any more
+		}
+	}
+	rc.fail()
+}
+
+// fail gives up on the connection: every outstanding request is reported as dropped.
+func (rc *RemoteClient) fail() {
+	rc.mu.Lock()
+	rc.closed = true
+	lost := rc.pending
+	rc.pending = make(map[uint64]remotePending)
+	rc.mu.Unlock()
+	for _, p := range lost {
+		close(p.replied)
+		rc.stats().DropUpcall(p.req)
+	}
+}
+
+// RemoteConfig is how RunRemoteExperiment connects to its server.
+type RemoteConfig struct {
+	TLS *tls.Config // nil for plain TCP
+}
+
+// RunRemoteExperiment drives the server at addr with Loadgen as described by e (whose
+// server fields are ignored; the remote server has its own configuration) and returns
+// the summary. It connects as e.Remote says. Server-side counters are not available.
+func RunRemoteExperiment(addr string, e Experiment) (Result, error) {
+	rc, err := DialTLS(addr, e.Remote.TLS)
+	if err != nil {
+		return Result{}, fmt.Errorf("dial %s: %w", addr, err)
+	}
+	return RunTargetExperiment(rc, e), nil
+}
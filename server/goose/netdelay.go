@@ -0,0 +1,116 @@
+package goose
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// -------------------- simulated network delay --------------------
+
+// Loadgen and an in-process server talk over channels, so the response times it
+// measures are queueing and service alone. A real client also waits for the
+// network, which adds a floor and some variance of its own. With a NetDelay in
+// its configuration, a server holds each reply for a drawn delay after service
+// before delivering it. The delay does not occupy the request's concurrency
+// slot, as a reply on the wire does not, and replies may overtake each other
+// on the way.
+
+// NetDelayDist is the distribution of the variable part of a NetDelay.
+type NetDelayDist string
+
+const (
+	NetDelayUniform NetDelayDist = "uniform" // uniform on [0, JitterMs]
+	NetDelayExp     NetDelayDist = "exp"     // exponential with mean JitterMs
+)
+
+// NetDelay is the simulated network delay of a reply: FixedMs plus a jitter drawn
+// from Dist (default uniform).
+type NetDelay struct {
+	FixedMs  float64
+	JitterMs float64
+	Dist     NetDelayDist
+}
+
+// Enabled reports whether d delays replies at all.
+func (d NetDelay) Enabled() bool { return d.FixedMs > 0 || d.JitterMs > 0 }
+
+// draw returns the delay of one reply, drawn from r.
+func (d NetDelay) draw(r *rand.Rand) time.Duration {
+	ms := d.FixedMs
+	switch d.Dist {
+	case NetDelayExp:
+		ms += r.ExpFloat64() * d.JitterMs
+	default:
+		ms += r.Float64() * d.JitterMs
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+// MeanMs returns the mean delay of a reply.
+func (d NetDelay) MeanMs() float64 {
+	if d.Dist == NetDelayExp {
+		return d.FixedMs + d.JitterMs
+	}
+	return d.FixedMs + d.JitterMs/2
+}
+
+// String returns d in the form ParseNetDelay reads.
+func (d NetDelay) String() string {
+	dist := d.Dist
+	if dist == "" {
+		dist = NetDelayUniform
+	}
+	return fmt.Sprintf("%g:%g:%s", d.FixedMs, d.JitterMs, dist)
+}
+
+// ParseNetDelay parses fixedMs[:jitterMs[:uniform|exp]], such as "0.5:2" or "1:1:exp".
+func ParseNetDelay(spec string) (NetDelay, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) > 3 {
+		return NetDelay{}, fmt.Errorf("want fixedMs[:jitterMs[:uniform|exp]]")
+	}
+	var d NetDelay
+	var err error
+	if d.FixedMs, err = strconv.ParseFloat(parts[0], 64); err != nil || d.FixedMs < 0 {
+		return NetDelay{}, fmt.Errorf("bad fixed delay %q", parts[0])
+	}
+	if len(parts) > 1 {
+		if d.JitterMs, err = strconv.ParseFloat(parts[1], 64); err != nil || d.JitterMs < 0 {
+			return NetDelay{}, fmt.Errorf("bad jitter %q", parts[1])
+		}
+	}
+	if len(parts) > 2 {
+		d.Dist = NetDelayDist(parts[2])
+		if d.Dist != NetDelayUniform && d.Dist != NetDelayExp {
+			return NetDelay{}, fmt.Errorf("unknown jitter distribution %q: want uniform or exp", parts[2])
+		}
+	}
+	return d, nil
+}
+
+// deliverLater delivers rep to the client after a delay drawn from the server's
+// NetDelay, counting the delivery as in service so that Shutdown waits for it.
+func (s *Server) deliverLater(r, rep Request) {
+	s.netMu.Lock()
+	d := s.cfg.NetDelay.draw(s.netRng)
+	s.netMu.Unlock()
+	s.netDelayed.Add(1)
+	s.netNanos.Add(int64(d))
+	s.inSvc.Add(1)
+	clockAfterFunc(d, func() {
+		defer s.inSvc.Done()
+		s.send(r, rep)
+	})
+}
+
+// PrintNetDelay prints the simulated network delay the server added to its replies.
+func PrintNetDelay(d NetDelay, st ServerStats) {
+	if st.NetDelayed == 0 {
+		return
+	}
+	fmt.Printf("network: delay=%s replies=%d meanDelay=%.3fms\n",
+		d, st.NetDelayed, durationMs(st.NetDelay)/float64(st.NetDelayed))
+}
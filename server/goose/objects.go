@@ -0,0 +1,182 @@
+package goose
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// -------------------- object popularity --------------------
+
+// ObjectDist selects how Loadgen chooses the ObjectID of each request.
+type ObjectDist string
+
+const (
+	ObjectsUniform ObjectDist = "uniform" // every object equally likely (the default)
+	ObjectsZipf    ObjectDist = "zipf"    // object k with probability proportional to 1/(k+1)^s
+	ObjectsHotspot ObjectDist = "hotspot" // a small hot set gets most of the requests
+	ObjectsShift   ObjectDist = "shift"   // uniform over a working set that moves on over time
+)
+
+// ObjectConfig describes the object-popularity distribution.
+type ObjectConfig struct {
+	Dist ObjectDist
+	N    int // number of objects, 0 to N-1; default 1024
+
+	ZipfS float64 // ObjectsZipf exponent, > 1; default 1.1
+
+	HotFraction float64 // ObjectsHotspot: fraction of objects that are hot; default 0.2
+	HotShare    float64 // ObjectsHotspot: fraction of requests to hot objects; default 0.8
+
+	WorkingSet int     // ObjectsShift: objects in the working set; default N/8
+	ShiftMs    float64 // ObjectsShift: the working set moves to the next objects this often; default 1000
+}
+
+// ParseObjects parses an object distribution such as "uniform", "zipf:1.2",
+// "hotspot:0.1:0.9" (hotFraction:hotShare), or "shift:64:500" (workingSet:shiftMs).
+func ParseObjects(spec string) (ObjectConfig, error) {
+	parts := strings.Split(spec, ":")
+	cfg := ObjectConfig{Dist: ObjectDist(parts[0])}
+	nums := make([]float64, len(parts)-1)
+	for i, p := range parts[1:] {
+		v, err := strconv.ParseFloat(p, 64)
+		if err != nil || v <= 0 {
+			return cfg, fmt.Errorf("objects %s: bad parameter %q", cfg.Dist, p)
+		}
+		nums[i] = v
+	}
+	switch cfg.Dist {
+	case ObjectsUniform:
+		if len(nums) > 0 {
+			return cfg, fmt.Errorf("objects uniform takes no parameters")
+		}
+	case ObjectsZipf:
+		if len(nums) > 1 || (len(nums) == 1 && nums[0] <= 1) {
+			return cfg, fmt.Errorf("want zipf[:s] with s > 1")
+		}
+		if len(nums) == 1 {
+			cfg.ZipfS = nums[0]
+		}
+	case ObjectsHotspot:
+		if len(nums) != 0 && (len(nums) != 2 || nums[0] >= 1 || nums[1] > 1) {
+			return cfg, fmt.Errorf("want hotspot[:hotFraction:hotShare] with fractions below 1")
+		}
+		if len(nums) == 2 {
+			cfg.HotFraction, cfg.HotShare = nums[0], nums[1]
+		}
+	case ObjectsShift:
+		if len(nums) != 0 && len(nums) != 2 {
+			return cfg, fmt.Errorf("want shift[:workingSet:shiftMs]")
+		}
+		if len(nums) == 2 {
+			cfg.WorkingSet, cfg.ShiftMs = int(nums[0]), nums[1]
+		}
+	default:
+		return cfg, fmt.Errorf("unknown object distribution %q: want uniform, zipf, hotspot, or shift", cfg.Dist)
+	}
+	return cfg, nil
+}
+
+// newObjects returns a generator of ObjectIDs, drawing from r. Its argument is the
+// time since the start of the run.
+func newObjects(cfg ObjectConfig, r *rand.Rand) func(since time.Duration) int {
+	n := cfg.N
+	if n <= 0 {
+		n = 1024
+	}
+	switch cfg.Dist {
+	case ObjectsZipf:
+		s := cfg.ZipfS
+		if s <= 1 {
+			s = 1.1
+		}
+		z := rand.NewZipf(r, s, 1, uint64(n-1))
+		return func(time.Duration) int { return int(z.Uint64()) }
+
+	case ObjectsHotspot:
+		frac, share := cfg.HotFraction, cfg.HotShare
+		if frac <= 0 || frac >= 1 {
+			frac = 0.2
+		}
+		if share <= 0 || share > 1 {
+			share = 0.8
+		}
+		hot := max(1, int(frac*float64(n)))
+		return func(time.Duration) int {
+			if r.Float64() < share || hot == n {
+				return r.Intn(hot)
+			}
+			return hot + r.Intn(n-hot)
+		}
+
+	case ObjectsShift:
+		set := cfg.WorkingSet
+		if set <= 0 || set > n {
+			set = max(1, n/8)
+		}
+		every := time.Duration(cfg.ShiftMs * float64(time.Millisecond))
+		if every <= 0 {
+			every = time.Second
+		}
+		return func(since time.Duration) int {
+			base := int(since/every) * set
+			return (base + r.Intn(set)) % n
+		}
+	}
+	return func(time.Duration) int { return r.Intn(n) }
+}
+
+// ObjectCount is the number of requests sent for one object.
+type ObjectCount struct {
+	ObjectID int
+	Count    int
+}
+
+// GetObjectCounts returns the number of requests sent per object since the last
+// ResetStats, most requested first.
+func GetObjectCounts() []ObjectCount { return defaultCollector.GetObjectCounts() }
+
+// GetObjectCounts is the package function GetObjectCounts for c.
+func (c *Collector) GetObjectCounts() []ObjectCount {
+	c.mu.Lock()
+	out := make([]ObjectCount, 0, len(c.objectCounts))
+	for id, n := range c.objectCounts {
+		out = append(out, ObjectCount{ObjectID: id, Count: n})
+	}
+	c.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].ObjectID < out[j].ObjectID
+	})
+	return out
+}
+
+// PrintObjectStats prints how many distinct objects were requested, the share of
+// requests that went to the most popular tenth of them, and the top objects.
+func PrintObjectStats(top int) {
+	counts := GetObjectCounts()
+	total := 0
+	for _, c := range counts {
+		total += c.Count
+	}
+	if total == 0 {
+		return
+	}
+	tenth, hot := max(1, len(counts)/10), 0
+	for _, c := range counts[:tenth] {
+		hot += c.Count
+	}
+	fmt.Printf("objects: distinct=%d top10%%share=%.1f%%", len(counts), 100*float64(hot)/float64(total))
+	for i, c := range counts {
+		if i == top {
+			break
+		}
+		fmt.Printf(" %d=%d", c.ObjectID, c.Count)
+	}
+	fmt.Println()
+}
@@ -0,0 +1,78 @@
+package goose
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// countObjects draws n ObjectIDs at the given offset into the run.
+func countObjects(cfg ObjectConfig, n int, since time.Duration) map[int]int {
+	next := newObjects(cfg, rand.New(rand.NewSource(1)))
+	counts := map[int]int{}
+	for i := 0; i < n; i++ {
+		counts[next(since)]++
+	}
+	return counts
+}
+
+func TestObjectDistributions(t *testing.T) {
+	const draws = 100000
+
+	uniform := countObjects(ObjectConfig{Dist: ObjectsUniform, N: 10}, draws, 0)
+	for id := 0; id < 10; id++ {
+		if c := uniform[id]; c < draws/10*9/10 || c > draws/10*11/10 {
+			t.Errorf("uniform: object %d drawn %d times, want about %d", id, c, draws/10)
+		}
+	}
+
+	zipf := countObjects(ObjectConfig{Dist: ObjectsZipf, N: 100, ZipfS: 1.5}, draws, 0)
+	if zipf[0] <= zipf[1] || zipf[1] <= zipf[10] {
+		t.Errorf("zipf: counts %d, %d, %d not decreasing", zipf[0], zipf[1], zipf[10])
+	}
+
+	hot := countObjects(ObjectConfig{Dist: ObjectsHotspot, N: 100, HotFraction: 0.1, HotShare: 0.9}, draws, 0)
+	inHot := 0
+	for id, c := range hot {
+		if id < 10 {
+			inHot += c
+		}
+	}
+	if share := float64(inHot) / draws; share < 0.88 || share > 0.92 {
+		t.Errorf("hotspot: hot share %.3f, want about 0.9", share)
+	}
+
+	shift := ObjectConfig{Dist: ObjectsShift, N: 100, WorkingSet: 10, ShiftMs: 100}
+	for _, tc := range []struct {
+		since time.Duration
+		lo    int
+	}{{0, 0}, {150 * time.Millisecond, 10}, {950 * time.Millisecond, 90}, {time.Second, 0}} {
+		for id := range countObjects(shift, 1000, tc.since) {
+			if id < tc.lo || id >= tc.lo+10 {
+				t.Errorf("shift at %v: object %d outside working set [%d,%d)", tc.since, id, tc.lo, tc.lo+10)
+			}
+		}
+	}
+}
+
+func TestParseObjects(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		want ObjectConfig
+	}{
+		{"uniform", ObjectConfig{Dist: ObjectsUniform}},
+		{"zipf:1.2", ObjectConfig{Dist: ObjectsZipf, ZipfS: 1.2}},
+		{"hotspot:0.1:0.9", ObjectConfig{Dist: ObjectsHotspot, HotFraction: 0.1, HotShare: 0.9}},
+		{"shift:64:500", ObjectConfig{Dist: ObjectsShift, WorkingSet: 64, ShiftMs: 500}},
+	} {
+		got, err := ParseObjects(tc.spec)
+		if err != nil || got != tc.want {
+			t.Errorf("ParseObjects(%q) = %+v, %v; want %+v", tc.spec, got, err, tc.want)
+		}
+	}
+	for _, spec := range []string{"zipf:1", "hotspot:0.1", "shift:64", "uniform:2", "pareto"} {
+		if _, err := ParseObjects(spec); err == nil {
+			t.Errorf("ParseObjects(%q) succeeded, want an error", spec)
+		}
+	}
+}
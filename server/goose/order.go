@@ -0,0 +1,141 @@
+package goose
+
+import (
+	"fmt"
+	"sort"
+)
+
+// -------------------- reply ordering --------------------
+
+// Loadgen numbers its requests in arrival order (ClientID), so the order of the
+// replies shows what the server does to that order. A single worker, or a FIFO
+// queue in front of equal demands, answers in order; concurrent service, SJF or
+// priority scheduling, and requests overtaking each other inside the handler do
+// not. The depth of a reply is the number of requests sent after it that were
+// answered before it: 0 for a reply in order. Per object, a reply is out of order
+// if a later request for the same object was answered first, which a server that
+// serializes the requests of each object never allows.
+
+// orderState is the part of a Collector kept here.
+type orderState struct {
+	orderOn      bool        // set by SetReplyOrder; kept across ResetStats
+	orderSeen    []int       // Fenwick tree over ClientIDs of the replies seen
+	orderReplies int         // replies recorded
+	orderDepths  map[int]int // reorder depth -> replies with it
+	orderLast    map[int]int // ObjectID -> highest ClientID answered so far
+	orderObject  int         // replies overtaken by a later request for the same object
+}
+
+// SetReplyOrder makes the package stats track the order in which replies come back
+// (see GetReplyOrder). Set it before an experiment starts.
+func SetReplyOrder(on bool) { defaultCollector.SetReplyOrder(on) }
+
+// SetReplyOrder is the package function SetReplyOrder for c.
+func (c *Collector) SetReplyOrder(on bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.orderOn = on
+}
+
+// resetOrderLocked clears the ordering statistics; ResetStats calls it.
+func (c *Collector) resetOrderLocked() {
+	c.orderSeen = nil
+	c.orderReplies = 0
+	c.orderDepths = make(map[int]int)
+	c.orderLast = make(map[int]int)
+	c.orderObject = 0
+}
+
+// recordOrderLocked records the first reply to request r.
+func (c *Collector) recordOrderLocked(r Request) {
+	if !c.orderOn || r.ClientID < 0 {
+		return
+	}
+	if r.ClientID >= len(c.orderSeen) {
+		c.orderGrowLocked(r.ClientID + 1)
+	}
+	// replies seen so far with a higher ClientID overtook this one
+	depth := c.orderReplies - c.orderCountLocked(r.ClientID)
+	c.orderDepths[depth]++
+	c.orderReplies++
+	for i := r.ClientID + 1; i <= len(c.orderSeen); i += i & -i {
+		c.orderSeen[i-1]++
+	}
+	if last, ok := c.orderLast[r.ObjectID]; ok && last > r.ClientID {
+		c.orderObject++
+	} else {
+		c.orderLast[r.ObjectID] = r.ClientID
+	}
+}
+
+// orderCountLocked returns the number of replies seen with a ClientID of at most id.
+func (c *Collector) orderCountLocked(id int) int {
+	n := 0
+	for i := min(id+1, len(c.orderSeen)); i > 0; i -= i & -i {
+		n += c.orderSeen[i-1]
+	}
+	return n
+}
+
+// orderGrowLocked makes the tree cover at least size ClientIDs, rebuilding it.
+func (c *Collector) orderGrowLocked(size int) {
+	counts := make([]int, len(c.orderSeen))
+	for id := range counts {
+		counts[id] = c.orderCountLocked(id) - c.orderCountLocked(id-1)
+	}
+	c.orderSeen = make([]int, max(size, 2*len(c.orderSeen), 1024))
+	for id, n := range counts {
+		for i := id + 1; n > 0 && i <= len(c.orderSeen); i += i & -i {
+			c.orderSeen[i-1] += n
+		}
+	}
+}
+
+// ReplyOrder summarizes the order in which replies came back.
+type ReplyOrder struct {
+	Replies          int
+	InOrder          int     // replies that no later request overtook
+	MeanDepth        float64 // over all replies
+	P99Depth         int
+	MaxDepth         int
+	ObjectOutOfOrder int // replies overtaken by a later request for the same object
+}
+
+// GetReplyOrder returns the ordering statistics since the last ResetStats.
+func GetReplyOrder() ReplyOrder { return defaultCollector.GetReplyOrder() }
+
+// GetReplyOrder is the package function GetReplyOrder for c.
+func (c *Collector) GetReplyOrder() ReplyOrder {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	o := ReplyOrder{Replies: c.orderReplies, InOrder: c.orderDepths[0], ObjectOutOfOrder: c.orderObject}
+	if c.orderReplies == 0 {
+		return o
+	}
+	depths := make([]int, 0, len(c.orderDepths))
+	sum := 0
+	for d, n := range c.orderDepths {
+		depths = append(depths, d)
+		sum += d * n
+	}
+	sort.Ints(depths)
+	o.MeanDepth = float64(sum) / float64(c.orderReplies)
+	o.MaxDepth = depths[len(depths)-1]
+	target, seen := (99*c.orderReplies+99)/100, 0
+	for _, d := range depths {
+		if seen += c.orderDepths[d]; seen >= target {
+			o.P99Depth = d
+			break
+		}
+	}
+	return o
+}
+
+// PrintReplyOrder prints the ordering statistics on one line.
+func PrintReplyOrder(o ReplyOrder) {
+	if o.Replies == 0 {
+		return
+	}
+	fmt.Printf("reply order: replies=%d inOrder=%.1f%% reordered=%d depth mean=%.2f p99=%d max=%d objectOutOfOrder=%d\n",
+		o.Replies, 100*float64(o.InOrder)/float64(o.Replies), o.Replies-o.InOrder, o.MeanDepth, o.P99Depth, o.MaxDepth, o.ObjectOutOfOrder)
+}
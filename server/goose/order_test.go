@@ -0,0 +1,41 @@
+package goose
+
+import "testing"
+
+func TestReplyOrder(t *testing.T) {
+	c := defaultCollector
+	SetReplyOrder(true)
+	defer SetReplyOrder(false)
+	ResetStats()
+	c.mu.Lock()
+	for _, r := range []Request{
+		{ClientID: 0, ObjectID: 1},
+		{ClientID: 3, ObjectID: 5},
+		{ClientID: 1, ObjectID: 5}, // overtaken by 3, for the same object
+		{ClientID: 2, ObjectID: 2}, // overtaken by 3
+		{ClientID: 2000, ObjectID: 3},
+		{ClientID: 1500, ObjectID: 4}, // overtaken by 2000, past the first tree
+		{ClientID: 4, ObjectID: 6},    // overtaken by 1500 and 2000
+	} {
+		c.recordOrderLocked(r)
+	}
+	c.mu.Unlock()
+
+	o := GetReplyOrder()
+	want := ReplyOrder{Replies: 7, InOrder: 3, MeanDepth: 5.0 / 7, P99Depth: 2, MaxDepth: 2, ObjectOutOfOrder: 1}
+	if o != want {
+		t.Errorf("reply order %+v, want %+v", o, want)
+	}
+
+	ResetStats()
+	if o := GetReplyOrder(); o.Replies != 0 {
+		t.Errorf("%d replies after reset, want 0", o.Replies)
+	}
+	SetReplyOrder(false)
+	c.mu.Lock()
+	c.recordOrderLocked(Request{ClientID: 0})
+	c.mu.Unlock()
+	if o := GetReplyOrder(); o.Replies != 0 {
+		t.Errorf("%d replies recorded with tracking off, want 0", o.Replies)
+	}
+}
@@ -0,0 +1,227 @@
+package goose
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// -------------------- OTLP export --------------------
+
+// Span is the client-side record of one request, from send to settlement.
+type Span struct {
+	ClientID int
+	Tag      string
+	Start    time.Time
+	End      time.Time
+	Status   ReplyStatus
+}
+
+// SetSpanCapture makes the package stats keep a Span for each of the first n requests
+// settled in a run, for ExportOTLP; n <= 0 (the default) keeps none.
+// Set it before an experiment starts.
+func SetSpanCapture(n int) { defaultCollector.SetSpanCapture(n) }
+
+// SetSpanCapture is the package function SetSpanCapture for c.
+func (c *Collector) SetSpanCapture(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.spanLimit = max(n, 0)
+}
+
+// recordSpanLocked records the span of r, which is being settled with status st.
+func (c *Collector) recordSpanLocked(r Request, st ReplyStatus) {
+	if len(c.spans) >= c.spanLimit {
+		return
+	}
+	start, ok := c.sendTimes[r.ClientID]
+	if !ok {
+		return
+	}
+	c.spans = append(c.spans, Span{ClientID: r.ClientID, Tag: r.Tag, Start: start, End: time.Now(), Status: st})
+}
+
+// GetSpans returns a copy of the spans captured since the last ResetStats.
+func GetSpans() []Span { return defaultCollector.GetSpans() }
+
+// GetSpans is the package function GetSpans for c.
+func (c *Collector) GetSpans() []Span {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Span(nil), c.spans...)
+}
+
+// The OTLP/HTTP JSON encoding, as much of it as the export needs.
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"` // int64 as a decimal string
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+func strAttr(k, v string) otlpAttr { return otlpAttr{Key: k, Value: otlpValue{StringValue: &v}} }
+
+func intAttr(k string, v int) otlpAttr {
+	s := strconv.Itoa(v)
+	return otlpAttr{Key: k, Value: otlpValue{IntValue: &s}}
+}
+
+func floatAttr(k string, v float64) otlpAttr {
+	return otlpAttr{Key: k, Value: otlpValue{DoubleValue: &v}}
+}
+
+type otlpResource struct {
+	Attributes []otlpAttr `json:"attributes"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpPoint struct {
+	TimeUnixNano string     `json:"timeUnixNano"`
+	AsDouble     float64    `json:"asDouble"`
+	Attributes   []otlpAttr `json:"attributes,omitempty"`
+}
+
+type otlpMetric struct {
+	Name  string `json:"name"`
+	Unit  string `json:"unit,omitempty"`
+	Gauge struct {
+		DataPoints []otlpPoint `json:"dataPoints"`
+	} `json:"gauge"`
+}
+
+type otlpStatus struct {
+	Code int `json:"code"` // 1 ok, 2 error
+}
+
+type otlpSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"` // 3: client
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr `json:"attributes,omitempty"`
+	Status            otlpStatus `json:"status"`
+}
+
+// ExportOTLP pushes the summary of res as OTLP gauges to the collector at endpoint
+// (such as http://localhost:4318), using OTLP/HTTP with JSON encoding. If spans
+// were captured (see SetSpanCapture), they are exported too, one trace per request.
+func ExportOTLP(endpoint string, res Result) error {
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+	resource := otlpResource{Attributes: []otlpAttr{strAttr("service.name", "goose")}}
+	params := []otlpAttr{
+		strAttr("goose.mode", res.modeName()),
+		floatAttr("goose.iat_mean_ms", res.IatMean),
+		floatAttr("goose.demand_mean_ms", res.DemandMean),
+		intAttr("goose.max_concurrent", res.MaxConcurrent),
+	}
+
+	var metrics []otlpMetric
+	gauge := func(name, unit string, v float64) {
+		m := otlpMetric{Name: name, Unit: unit}
+		m.Gauge.DataPoints = []otlpPoint{{TimeUnixNano: now, AsDouble: v, Attributes: params}}
+		metrics = append(metrics, m)
+	}
+	gauge("goose.requests.sent", "{request}", float64(res.Sent))
+	gauge("goose.requests.skipped", "{request}", float64(res.Skipped))
+	gauge("goose.replies.received", "{reply}", float64(res.Received))
+	gauge("goose.requests.dropped", "{request}", float64(res.Dropped))
+	gauge("goose.requests.rejected", "{request}", float64(res.Rejected))
+	gauge("goose.requests.failed", "{request}", float64(res.Failed))
+	gauge("goose.requests.timed_out", "{request}", float64(res.TimedOut))
+	gauge("goose.throughput", "{reply}/s", res.Throughput)
+	gauge("goose.response_time.mean", "ms", res.MeanRT)
+	gauge("goose.response_time.p99", "ms", res.P99)
+	if res.SLO.Total() > 0 {
+		gauge("goose.slo.met", "1", res.SLO.Met)
+		gauge("goose.slo.apdex", "1", res.SLO.Apdex)
+	}
+
+	body := map[string]any{
+		"resourceMetrics": []any{map[string]any{
+			"resource": resource,
+			"scopeMetrics": []any{map[string]any{
+				"scope":   otlpScope{Name: "goose"},
+				"metrics": metrics,
+			}},
+		}},
+	}
+	if err := postOTLP(endpoint+"/v1/metrics", body); err != nil {
+		return err
+	}
+
+	captured := GetSpans()
+	if len(captured) == 0 {
+		return nil
+	}
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	hexID := func(bytes int) string {
+		var sb strings.Builder
+		for i := 0; i < bytes; i++ {
+			fmt.Fprintf(&sb, "%02x", rng.Intn(256))
+		}
+		return sb.String()
+	}
+	out := make([]otlpSpan, 0, len(captured))
+	for _, sp := range captured {
+		attrs := []otlpAttr{intAttr("goose.client_id", sp.ClientID), strAttr("goose.status", sp.Status.String())}
+		if sp.Tag != "" {
+			attrs = append(attrs, strAttr("goose.tag", sp.Tag))
+		}
+		code := 1
+		if sp.Status != StatusOK {
+			code = 2
+		}
+		out = append(out, otlpSpan{
+			TraceID:           hexID(16),
+			SpanID:            hexID(8),
+			Name:              "goose.request",
+			Kind:              3,
+			StartTimeUnixNano: strconv.FormatInt(sp.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(sp.End.UnixNano(), 10),
+			Attributes:        attrs,
+			Status:            otlpStatus{Code: code},
+		})
+	}
+	body = map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": resource,
+			"scopeSpans": []any{map[string]any{
+				"scope": otlpScope{Name: "goose"},
+				"spans": out,
+			}},
+		}},
+	}
+	return postOTLP(endpoint+"/v1/traces", body)
+}
+
+func postOTLP(url string, body any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package goose
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// otlpCollector records the bodies posted to each OTLP path.
+type otlpCollector struct {
+	mu     sync.Mutex
+	bodies map[string]map[string]any
+}
+
+func (c *otlpCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "bad body", http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	c.bodies[r.URL.Path] = body
+	c.mu.Unlock()
+}
+
+// dig follows keys and list indexes through a decoded JSON value.
+func dig(v any, path ...any) any {
+	for _, p := range path {
+		switch k := p.(type) {
+		case string:
+			m, _ := v.(map[string]any)
+			v = m[k]
+		case int:
+			l, _ := v.([]any)
+			if k >= len(l) {
+				return nil
+			}
+			v = l[k]
+		}
+	}
+	return v
+}
+
+func TestExportOTLP(t *testing.T) {
+	SetSpanCapture(2)
+	defer SetSpanCapture(0)
+	res := RunExperiment(Experiment{N: 5, IatMean: 1, MaxConcurrent: 4})
+	if res.Received != 5 {
+		t.Fatalf("received %d of 5", res.Received)
+	}
+
+	c := &otlpCollector{bodies: map[string]map[string]any{}}
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+	if err := ExportOTLP(srv.URL+"/", res); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := dig(c.bodies["/v1/metrics"], "resourceMetrics", 0, "scopeMetrics", 0, "metrics")
+	var received any
+	for _, m := range metrics.([]any) {
+		if dig(m, "name") == "goose.replies.received" {
+			received = dig(m, "gauge", "dataPoints", 0, "asDouble")
+		}
+	}
+	if received != 5.0 {
+		t.Errorf("goose.replies.received = %v, want 5", received)
+	}
+
+	spans, _ := dig(c.bodies["/v1/traces"], "resourceSpans", 0, "scopeSpans", 0, "spans").([]any)
+	if len(spans) != 2 {
+		t.Fatalf("%d spans exported, want the 2 captured", len(spans))
+	}
+	for _, sp := range spans {
+		if id, _ := dig(sp, "traceId").(string); len(id) != 32 {
+			t.Errorf("trace id %q, want 32 hex digits", id)
+		}
+		if code := dig(sp, "status", "code"); code != 1.0 {
+			t.Errorf("span status %v, want 1 (ok)", code)
+		}
+	}
+}
+
+// Without captured spans only the metrics are exported, and a failing collector is an error.
+func TestExportOTLPMetricsOnly(t *testing.T) {
+	ResetStats()
+	c := &otlpCollector{bodies: map[string]map[string]any{}}
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+	if err := ExportOTLP(srv.URL, Result{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.bodies["/v1/traces"]; ok || len(c.bodies) != 1 {
+		t.Errorf("posted to %v, want only /v1/metrics", c.bodies)
+	}
+
+	bad := httptest.NewServer(http.NotFoundHandler())
+	defer bad.Close()
+	if err := ExportOTLP(bad.URL, Result{}); err == nil {
+		t.Error("export to a failing collector succeeded, want an error")
+	}
+}
@@ -0,0 +1,191 @@
+package goose
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// -------------------- multi-stage pipeline --------------------
+
+// Stage describes one step of a Pipeline.
+type Stage struct {
+	Name          string
+	MaxConcurrent int // requests this stage serves at once
+	// DemandMeanMs, if positive, replaces the request's demands in this stage with an
+	// exponentially distributed wait demand of this mean. If zero, the stage serves
+	// the request's own demands, so they are paid again in every such stage.
+	DemandMeanMs float64
+	Handler      Handler // nil means DemandHandler
+}
+
+// StageStats summarizes the requests that have passed through one stage.
+type StageStats struct {
+	Name          string
+	Served        int
+	MeanWaitMs    float64 // time waiting for the stage's semaphore
+	MeanServiceMs float64 // time in the stage's handler
+}
+
+// Pipeline is a Handler that passes each request through a chain of stages
+// connected by channels. Each stage runs like ReqHandler, with its own counting
+// semaphore and its own demand, so queueing builds up in front of the slowest
+// stage just as it would in a real multi-tier server. A request that is cancelled
+// in one stage skips the rest. Call Close when the pipeline is no longer needed.
+type Pipeline struct {
+	stages []*pipeStage
+}
+
+type pipeStage struct {
+	Stage
+	in   chan pipeItem
+	next chan pipeItem // nil for the last stage
+
+	served       atomic.Int64
+	waitNanos    atomic.Int64
+	serviceNanos atomic.Int64
+}
+
+// pipeItem is a request travelling through the pipeline.
+type pipeItem struct {
+	req     Request
+	arrived time.Time      // when it entered the current stage
+	done    chan<- Request // where the last stage leaves the reply
+}
+
+// NewPipeline starts a pipeline with the given stages, in order.
+func NewPipeline(stages ...Stage) *Pipeline {
+	p := &Pipeline{}
+	for _, st := range stages {
+		if st.Handler == nil {
+			st.Handler = DemandHandler
+		}
+		if st.MaxConcurrent <= 0 {
+			st.MaxConcurrent = 1
+		}
+		p.stages = append(p.stages, &pipeStage{Stage: st, in: make(chan pipeItem)})
+	}
+	for i := 0; i+1 < len(p.stages); i++ {
+		p.stages[i].next = p.stages[i+1].in
+	}
+	for _, s := range p.stages {
+		go s.run()
+	}
+	return p
+}
+
+// Serve sends r through every stage and returns the reply of the last one.
+func (p *Pipeline) Serve(r Request) Request {
+	if len(p.stages) == 0 {
+		return r
+	}
+	done := make(chan Request, 1)
+	p.stages[0].in <- pipeItem{req: r, arrived: time.Now(), done: done}
+	return <-done
+}
+
+// Close shuts the stages down once the requests already in the pipeline are through.
+// Serve must not be called afterwards.
+func (p *Pipeline) Close() {
+	if len(p.stages) > 0 {
+		close(p.stages[0].in)
+	}
+}
+
+// Stats returns per-stage statistics, in stage order.
+func (p *Pipeline) Stats() []StageStats {
+	out := make([]StageStats, len(p.stages))
+	for i, s := range p.stages {
+		st := StageStats{Name: s.Name, Served: int(s.served.Load())}
+		if st.Served > 0 {
+			st.MeanWaitMs = float64(s.waitNanos.Load()) / float64(st.Served) / 1e6
+			st.MeanServiceMs = float64(s.serviceNanos.Load()) / float64(st.Served) / 1e6
+		}
+		out[i] = st
+	}
+	return out
+}
+
+// run admits items under the stage's semaphore, as ReqHandler does, and closes
+// the next stage's channel after the last of them has moved on.
+func (s *pipeStage) run() {
+	permissions := make(chan Permission, s.MaxConcurrent)
+	var wg sync.WaitGroup
+	for it := range s.in {
+		permissions <- Permission{}
+		wg.Add(1)
+		go func(it pipeItem) {
+			defer wg.Done()
+			defer byebye(permissions)
+			s.serve(it)
+		}(it)
+	}
+	wg.Wait()
+	if s.next != nil {
+		close(s.next)
+	}
+}
+
+func (s *pipeStage) serve(it pipeItem) {
+	start := time.Now()
+	r := it.req
+	if s.DemandMeanMs > 0 {
+		r.WorkDemand = 0
+		r.WaitDemand = int(rand.ExpFloat64() * s.DemandMeanMs)
+		if s.next != nil {
+			r.ReplyCost = 0 // the reply is produced by the last stage
+		}
+	}
+	rep := safeServe(s.Handler, r)
+	end := time.Now()
+
+	s.served.Add(1)
+	s.waitNanos.Add(int64(start.Sub(it.arrived)))
+	s.serviceNanos.Add(int64(end.Sub(start)))
+
+	// Hand the original demands on, not the ones this stage drew.
+	rep.WorkDemand, rep.WaitDemand, rep.ReplyCost = it.req.WorkDemand, it.req.WaitDemand, it.req.ReplyCost
+	if s.next == nil || rep.Status != StatusOK {
+		it.done <- rep
+		return
+	}
+	s.next <- pipeItem{req: rep, arrived: end, done: it.done}
+}
+
+// ParseStages parses a pipeline description of the form "name:conc:demandMs,...",
+// e.g. "parse:2:3,compute:4:10,store:1:2". A missing demand means the stage
+// serves the request's own demands.
+func ParseStages(spec string) ([]Stage, error) {
+	var stages []Stage
+	for _, part := range strings.Split(spec, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ":")
+		if len(fields) < 2 || len(fields) > 3 || fields[0] == "" {
+			return nil, fmt.Errorf("stage %q: want name:conc[:demandMs]", part)
+		}
+		conc, err := strconv.Atoi(fields[1])
+		if err != nil || conc <= 0 {
+			return nil, fmt.Errorf("stage %q: bad concurrency %q", part, fields[1])
+		}
+		st := Stage{Name: fields[0], MaxConcurrent: conc}
+		if len(fields) == 3 {
+			st.DemandMeanMs, err = strconv.ParseFloat(fields[2], 64)
+			if err != nil || st.DemandMeanMs < 0 {
+				return nil, fmt.Errorf("stage %q: bad demand %q", part, fields[2])
+			}
+		}
+		stages = append(stages, st)
+	}
+	return stages, nil
+}
+
+// PrintStageStats prints one line per pipeline stage.
+func PrintStageStats(stats []StageStats) {
+	fmt.Printf("%-12s %8s %10s %10s\n", "stage", "served", "wait(ms)", "svc(ms)")
+	for _, s := range stats {
+		fmt.Printf("%-12s %8d %10.3f %10.3f\n", s.Name, s.Served, s.MeanWaitMs, s.MeanServiceMs)
+	}
+}
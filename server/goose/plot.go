@@ -0,0 +1,74 @@
+package goose
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// -------------------- plotting results --------------------
+
+// PlotCSV reads results in the form WriteResultsCSV writes them, after any
+// metadata lines, and prints column y of each row as an ASCII bar of at most width
+// characters. Each bar is labeled with column x and with every other parameter
+// column whose value varies, so that the rows of a multi-dimensional sweep stay apart.
+func PlotCSV(r io.Reader, x, y string, width int) error {
+	cr := csv.NewReader(r)
+	cr.Comment = '#' // metadata (see WriteMetadata)
+	rows, err := cr.ReadAll()
+	if err != nil {
+		return err
+	}
+	if len(rows) < 2 {
+		return fmt.Errorf("no results")
+	}
+	header := rows[0]
+	xi, yi := slices.Index(header, x), slices.Index(header, y)
+	if xi < 0 || yi < 0 {
+		return fmt.Errorf("want columns %q and %q, have %s", x, y, strings.Join(header, ","))
+	}
+	// The parameter columns that vary also label the bars.
+	labelCols := []int{xi}
+	for _, name := range []string{"mode", "iat_mean_ms", "demand_mean_ms", "max_concurrent"} {
+		i := slices.Index(header, name)
+		if i < 0 || i == xi {
+			continue
+		}
+		for _, row := range rows[2:] {
+			if row[i] != rows[1][i] {
+				labelCols = append(labelCols, i)
+				break
+			}
+		}
+	}
+	labels := make([]string, len(rows)-1)
+	values := make([]float64, len(rows)-1)
+	maxv, labelw := 0.0, 0
+	for i, row := range rows[1:] {
+		if values[i], err = strconv.ParseFloat(row[yi], 64); err != nil {
+			return fmt.Errorf("row %d: bad %s %q", i+2, y, row[yi])
+		}
+		maxv = max(maxv, values[i])
+		var parts []string
+		for _, c := range labelCols {
+			parts = append(parts, header[c]+"="+row[c])
+		}
+		labels[i] = strings.Join(parts, " ")
+		labelw = max(labelw, len(labels[i]))
+	}
+	if width <= 0 {
+		width = 50
+	}
+	fmt.Printf("%s by %s\n", y, x)
+	for i, v := range values {
+		bar := 0
+		if maxv > 0 {
+			bar = int(float64(width) * v / maxv)
+		}
+		fmt.Printf("%*s |%s %g\n", labelw, labels[i], strings.Repeat("█", bar), v)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package goose
+
+import "sync"
+
+// -------------------- fixed worker-pool server --------------------
+
+// ServerMode selects how the server maps requests onto goroutines.
+type ServerMode string
+
+const (
+	// ModeSemaphore fires a goroutine per request and uses a counting semaphore
+	// to keep at most maxConcurrent of them in service (ReqHandler).
+	ModeSemaphore ServerMode = "semaphore"
+	// ModePool starts a fixed crew of workers that pull requests from reqCh (WorkerPool).
+	ModePool ServerMode = "pool"
+)
+
+// WorkerPool serves requests from reqCh with a fixed crew of workers goroutines,
+// each of which receives a request, serves it with h, and goes back for the next one.
+// Requests that arrive while all workers are busy wait in reqCh.
+// WorkerPool returns after reqCh is closed and every worker has finished.
+func WorkerPool(reqCh <-chan Request, workers int, h Handler) {
+	if h == nil {
+		h = DemandHandler
+	}
+	if workers <= 0 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for req := range reqCh {
+				handle(req, h)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,74 @@
+package goose
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// -------------------- live progress reporting --------------------
+
+// IntervalStats summarizes one sampling interval of a running experiment.
+// Counters are cumulative since the last ResetStats; rates and percentiles
+// cover only the interval.
+type IntervalStats struct {
+	At          time.Time `json:"at"`
+	Attempts    int       `json:"attempts"`
+	Sent        int       `json:"sent"`
+	Skipped     int       `json:"skipped"`
+	Received    int       `json:"received"`
+	Outstanding int       `json:"outstanding"`
+	InFlight    int       `json:"inFlight"`
+	Throughput  float64   `json:"throughput"` // replies per second over the interval
+	SkipRate    float64   `json:"skipRate"`   // fraction of attempts skipped over the interval
+	P50         float64   `json:"p50"`        // milliseconds, replies in the interval
+	P90         float64   `json:"p90"`
+	P99         float64   `json:"p99"`
+}
+
+// intervalSampler remembers the snapshot at the previous sample so that
+// the next sample can report per-interval rates.
+type intervalSampler struct {
+	stats *Collector
+	prev  StatsSnapshot
+}
+
+func newIntervalSampler(stats *Collector) *intervalSampler {
+	return newIntervalSamplerAt(stats, time.Now())
+}
+
+// newIntervalSamplerAt is newIntervalSampler with its first sample taken at now.
+func newIntervalSamplerAt(stats *Collector, now time.Time) *intervalSampler {
+	return &intervalSampler{stats: stats, prev: stats.snapshotAt(now)}
+}
+
+// sample reads the stats and returns the interval since the previous sample.
+func (s *intervalSampler) sample(now time.Time) IntervalStats {
+	d := s.stats.deltaStatsAt(s.prev, now)
+	s.prev = d.End
+	return IntervalStats{
+		At:          now,
+		Attempts:    d.End.Attempts,
+		Sent:        d.End.Sent,
+		Skipped:     d.End.Skipped,
+		Received:    d.End.Received,
+		Outstanding: d.End.Outstanding,
+		InFlight:    InFlight(),
+		Throughput:  d.Throughput,
+		SkipRate:    d.SkipRate,
+		P50:         d.P50,
+		P90:         d.P90,
+		P99:         d.P99,
+	}
+}
+
+// StartProgress prints a one-line progress report to w every interval while an
+// experiment is running: sent/received counts, the throughput over the last interval,
+// and the p99 response time of the replies received in the last interval.
+// Call the returned stop function to end the reports.
+func StartProgress(w io.Writer, interval time.Duration) (stop func()) {
+	return observe(defaultCollector, ObserverFunc(func(st IntervalStats) {
+		fmt.Fprintf(w, "[progress] sent=%d skipped=%d received=%d outstanding=%d throughput=%.0f/sec p99=%.3fms\n",
+			st.Sent, st.Skipped, st.Received, st.Outstanding, st.Throughput, st.P99)
+	}), interval)
+}
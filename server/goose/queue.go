@@ -0,0 +1,348 @@
+package goose
+
+import (
+	"container/heap"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// -------------------- bounded admission queue --------------------
+
+// QueuePolicy selects what QueuedHandler does with an arrival when its queue is full.
+type QueuePolicy string
+
+const (
+	PolicyBlock    QueuePolicy = "block"     // stop receiving from reqCh until there is room
+	PolicyDropTail QueuePolicy = "drop-tail" // discard the arriving request
+	PolicyDropHead QueuePolicy = "drop-head" // discard the oldest queued request to make room
+	PolicyReject   QueuePolicy = "reject"    // reply to the arriving request with StatusRejected
+)
+
+// ValidPolicy reports whether p is one of the known queue policies.
+func ValidPolicy(p QueuePolicy) bool {
+	switch p {
+	case PolicyBlock, PolicyDropTail, PolicyDropHead, PolicyReject:
+		return true
+	}
+	return false
+}
+
+// Discipline selects the order in which QueuedHandler serves queued requests.
+type Discipline string
+
+const (
+	DisciplineFIFO Discipline = "fifo" // first come, first served
+	DisciplineSJF  Discipline = "sjf"  // shortest job first, by WorkDemand+WaitDemand+ReplyCost
+	DisciplineEDF  Discipline = "edf"  // earliest Deadline first; requests without one go last
+
+	DisciplinePriority Discipline = "priority" // highest Priority first, FIFO among equals
+	DisciplineFair     Discipline = "fair"     // deficit round robin over TenantIDs, by demand and weight
+)
+
+// ValidDiscipline reports whether d is one of the known scheduling disciplines.
+func ValidDiscipline(d Discipline) bool {
+	switch d {
+	case DisciplineFIFO, DisciplineSJF, DisciplineEDF, DisciplinePriority, DisciplineFair:
+		return true
+	}
+	return false
+}
+
+// QueueConfig configures the admission queue of QueuedHandler.
+type QueueConfig struct {
+	Len        int         // maximum number of queued requests
+	Policy     QueuePolicy // what to do with arrivals when full; "" means PolicyBlock
+	Discipline Discipline  // service order; "" means DisciplineFIFO
+	Weights    []float64   // DisciplineFair: the weight of tenant i+1; default 1
+}
+
+// Enabled reports whether the configuration asks for an admission queue at all.
+func (c QueueConfig) Enabled() bool {
+	return c.Policy != "" || c.Discipline != ""
+}
+
+// reqQueue is a bounded queue of waiting requests.
+type reqQueue interface {
+	len() int
+	full() bool
+	push(r Request)
+	pop() Request       // next request to serve
+	popOldest() Request // earliest arrival still queued
+}
+
+func newQueue(capacity int, qc QueueConfig) reqQueue {
+	switch qc.Discipline {
+	case DisciplineSJF:
+		return newPrioQueue(capacity, func(a, b Request) bool {
+			return a.WorkDemand+a.WaitDemand+a.ReplyCost < b.WorkDemand+b.WaitDemand+b.ReplyCost
+		})
+	case DisciplineEDF:
+		return newPrioQueue(capacity, func(a, b Request) bool {
+			return deadlineBefore(a.Deadline, b.Deadline)
+		})
+	case DisciplinePriority:
+		return newPrioQueue(capacity, func(a, b Request) bool {
+			return a.Priority > b.Priority
+		})
+	case DisciplineFair:
+		return newFairQueue(capacity, qc.Weights)
+	}
+	return newFifo(capacity)
+}
+
+// deadlineBefore orders deadlines, treating the zero time as "no deadline" (latest).
+func deadlineBefore(a, b time.Time) bool {
+	if a.IsZero() {
+		return false
+	}
+	if b.IsZero() {
+		return true
+	}
+	return a.Before(b)
+}
+
+// fifo is a ring buffer of requests with a fixed capacity.
+type fifo struct {
+	buf  []Request
+	head int
+	n    int
+}
+
+func newFifo(capacity int) *fifo {
+	return &fifo{buf: make([]Request, capacity)}
+}
+
+func (q *fifo) len() int   { return q.n }
+func (q *fifo) full() bool { return q.n == len(q.buf) }
+
+func (q *fifo) push(r Request) {
+	q.buf[(q.head+q.n)%len(q.buf)] = r
+	q.n++
+}
+
+func (q *fifo) pop() Request {
+	r := q.buf[q.head]
+	q.buf[q.head] = Request{}
+	q.head = (q.head + 1) % len(q.buf)
+	q.n--
+	return r
+}
+
+func (q *fifo) popOldest() Request { return q.pop() }
+
+// prioQueue is a bounded priority queue of requests ordered by less; ties are
+// broken by arrival order.
+type prioQueue struct {
+	items    []prioItem
+	capacity int
+	seq      uint64
+	less     func(a, b Request) bool
+}
+
+type prioItem struct {
+	req Request
+	seq uint64
+}
+
+func newPrioQueue(capacity int, less func(a, b Request) bool) *prioQueue {
+	return &prioQueue{capacity: capacity, less: less}
+}
+
+func (q *prioQueue) len() int   { return len(q.items) }
+func (q *prioQueue) full() bool { return len(q.items) >= q.capacity }
+
+func (q *prioQueue) push(r Request) {
+	heap.Push((*prioHeap)(q), prioItem{req: r, seq: q.seq})
+	q.seq++
+}
+
+func (q *prioQueue) pop() Request {
+	return heap.Pop((*prioHeap)(q)).(prioItem).req
+}
+
+func (q *prioQueue) popOldest() Request {
+	oldest := 0
+	for i, it := range q.items {
+		if it.seq < q.items[oldest].seq {
+			oldest = i
+		}
+	}
+	return heap.Remove((*prioHeap)(q), oldest).(prioItem).req
+}
+
+// prioHeap implements heap.Interface for prioQueue.
+type prioHeap prioQueue
+
+func (h *prioHeap) Len() int { return len(h.items) }
+func (h *prioHeap) Less(i, j int) bool {
+	a, b := h.items[i], h.items[j]
+	if h.less(a.req, b.req) {
+		return true
+	}
+	if h.less(b.req, a.req) {
+		return false
+	}
+	return a.seq < b.seq
+}
+func (h *prioHeap) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *prioHeap) Push(x any)    { h.items = append(h.items, x.(prioItem)) }
+func (h *prioHeap) Pop() any {
+	it := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return it
+}
+
+// QueuedHandler is ReqHandlerWith with an explicit admission queue of at most qc.Len
+// requests in front of the semaphore. An arrival is served at once if a permit is free,
+// otherwise it waits in the queue, which is served in the order of qc.Discipline.
+// When the queue is full, qc.Policy decides the fate of the arrival. Dropped requests
+// are reported with DropUpcall; rejected ones get a StatusRejected reply.
+func QueuedHandler(reqCh <-chan Request, maxConcurrent int, qc QueueConfig, h Handler) {
+	lim := NewLimiter(maxConcurrent)
+	defer lim.Close()
+	QueuedHandlerLimited(reqCh, lim, qc, h)
+}
+
+// QueuedHandlerLimited is QueuedHandler with a Limiter in place of the fixed
+// semaphore, so the concurrency limit can be changed while it runs.
+// It returns after reqCh is closed and every admitted request has been served.
+func QueuedHandlerLimited(reqCh <-chan Request, lim *Limiter, qc QueueConfig, h Handler) {
+	d := newDispatcher(lim, qc, h, sendReply)
+	d.run(reqCh, nil)
+	d.wg.Wait()
+}
+
+// dispatcher admits requests under a Limiter, holding back the overflow in a
+// bounded queue managed according to a QueueConfig.
+type dispatcher struct {
+	lim       *Limiter
+	queue     reqQueue
+	policy    QueuePolicy
+	h         Handler
+	deliver   func(r, rep Request)
+	drop      func(r Request)
+	cancelled func(rep Request)
+	wg        sync.WaitGroup // admitted requests still in service
+	queued    atomic.Int64   // current queue length, for observers
+}
+
+func newDispatcher(lim *Limiter, qc QueueConfig, h Handler, deliver func(r, rep Request)) *dispatcher {
+	if h == nil {
+		h = DemandHandler
+	}
+	queueLen := qc.Len
+	if queueLen < 0 {
+		queueLen = 0
+	}
+	policy := qc.Policy
+	if policy == "" {
+		policy = PolicyBlock
+	}
+	return &dispatcher{
+		lim:       lim,
+		queue:     newQueue(queueLen, qc),
+		policy:    policy,
+		h:         h,
+		deliver:   deliver,
+		drop:      DropUpcall,
+		cancelled: CancelledUpcall,
+	}
+}
+
+// start serves r on a permit already taken from d.lim.
+func (d *dispatcher) start(r Request) {
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		serveLimited(r, d.h, d.lim, d.deliver, d.cancelled)
+	}()
+}
+
+// reject replies to r without serving it.
+func (d *dispatcher) reject(r Request) {
+	rep := r
+	rep.Status = StatusRejected
+	d.deliver(r, rep)
+}
+
+// run dispatches requests from reqCh until reqCh is closed and the queue is empty,
+// or until stop is closed. It returns the requests still waiting when stopped.
+// It does not wait for requests in service; use d.wg for that.
+func (d *dispatcher) run(reqCh <-chan Request, stop <-chan struct{}) []Request {
+	queue := d.queue
+	in := reqCh
+	for in != nil || queue.len() > 0 {
+		d.queued.Store(int64(queue.len()))
+
+		// Only take a permit when something is waiting for it.
+		var grant <-chan Permission
+		if queue.len() > 0 {
+			grant = d.lim.Grants()
+		}
+		// Under the block policy, a full queue pushes back on reqCh.
+		recv := in
+		if d.policy == PolicyBlock && queue.full() && queue.len() > 0 {
+			recv = nil
+		}
+
+		select {
+		case <-stop:
+			return d.drain()
+
+		case <-grant:
+			d.start(queue.pop())
+
+		case req, ok := <-recv:
+			if !ok {
+				in = nil
+				continue
+			}
+			if queue.len() == 0 && d.lim.TryAcquire() {
+				d.start(req)
+				continue
+			}
+			if !queue.full() {
+				queue.push(req)
+				continue
+			}
+			switch d.policy {
+			case PolicyBlock:
+				// zero-length queue: wait for a permit like ReqHandler
+				select {
+				case <-d.lim.Grants():
+					d.start(req)
+				case <-stop:
+					return append(d.drain(), req)
+				}
+			case PolicyDropHead:
+				if queue.len() > 0 {
+					d.drop(queue.popOldest())
+					queue.push(req)
+				} else {
+					d.drop(req)
+				}
+			case PolicyReject:
+				d.wg.Add(1)
+				go func() {
+					defer d.wg.Done()
+					d.reject(req)
+				}()
+			default: // PolicyDropTail
+				d.drop(req)
+			}
+		}
+	}
+	d.queued.Store(0)
+	return nil
+}
+
+// drain empties the queue, returning its contents in service order.
+func (d *dispatcher) drain() []Request {
+	var out []Request
+	for d.queue.len() > 0 {
+		out = append(out, d.queue.pop())
+	}
+	d.queued.Store(0)
+	return out
+}
@@ -0,0 +1,156 @@
+package goose
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fillQueue runs QueuedHandler with one permit and a queue of one under policy,
+// and sends it three requests while the first is in service. It waits for
+// replies replies, and returns them and the ClientIDs served, in order.
+func fillQueue(policy QueuePolicy, replies int) (served []int, reps []Request) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	h := HandlerFunc(func(r Request) Request {
+		<-release
+		mu.Lock()
+		served = append(served, r.ClientID)
+		mu.Unlock()
+		return r
+	})
+	reqCh := make(chan Request)
+	repCh := make(chan Request, 3)
+	go QueuedHandler(reqCh, 1, QueueConfig{Len: 1, Policy: policy}, h)
+	for i := range 3 {
+		reqCh <- Request{ClientID: i, ReplyCh: repCh}
+	}
+	close(reqCh)
+	close(release)
+	for range replies {
+		reps = append(reps, <-repCh)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return served, reps
+}
+
+// With the one permit held and the queue full, the third request is the one
+// each policy decides about.
+func TestQueuePolicies(t *testing.T) {
+	for _, tc := range []struct {
+		policy   QueuePolicy
+		served   []int
+		rejected bool
+	}{
+		{PolicyDropTail, []int{0, 1}, false},
+		{PolicyDropHead, []int{0, 2}, false},
+		{PolicyReject, []int{0, 1}, true},
+	} {
+		replies := len(tc.served)
+		if tc.rejected {
+			replies++
+		}
+		served, reps := fillQueue(tc.policy, replies)
+		if !equalIDs(served, tc.served) {
+			t.Errorf("%s: served %v, want %v", tc.policy, served, tc.served)
+		}
+		rejected := false
+		for _, rep := range reps {
+			if rep.Status == StatusRejected {
+				rejected = rep.ClientID == 2
+			}
+		}
+		if rejected != tc.rejected {
+			t.Errorf("%s: replies %+v, want request 2 rejected: %v", tc.policy, reps, tc.rejected)
+		}
+	}
+}
+
+// drain pops every request of q and returns their ClientIDs in order.
+func drain(q reqQueue) []int {
+	var ids []int
+	for q.len() > 0 {
+		ids = append(ids, q.pop().ClientID)
+	}
+	return ids
+}
+
+// Each discipline serves in its own order, and breaks ties by arrival.
+func TestQueueDisciplines(t *testing.T) {
+	now := time.Now()
+	reqs := []Request{
+		{ClientID: 1, WorkDemand: 30, Priority: 1, Deadline: now.Add(3 * time.Second)},
+		{ClientID: 2, WorkDemand: 10, Priority: 5},
+		{ClientID: 3, WorkDemand: 20, Priority: 5, Deadline: now.Add(time.Second)},
+		{ClientID: 4, WorkDemand: 10, Priority: 0, Deadline: now.Add(2 * time.Second)},
+	}
+	for _, tc := range []struct {
+		d    Discipline
+		want []int
+	}{
+		{DisciplineFIFO, []int{1, 2, 3, 4}},
+		{DisciplineSJF, []int{2, 4, 3, 1}},
+		{DisciplineEDF, []int{3, 4, 1, 2}}, // no deadline goes last
+		{DisciplinePriority, []int{2, 3, 1, 4}},
+	} {
+		q := newQueue(len(reqs), QueueConfig{Discipline: tc.d})
+		for _, r := range reqs {
+			q.push(r)
+		}
+		if !q.full() {
+			t.Errorf("%s: not full with %d of %d", tc.d, q.len(), len(reqs))
+		}
+		if got := drain(q); !equalIDs(got, tc.want) {
+			t.Errorf("%s: served %v, want %v", tc.d, got, tc.want)
+		}
+	}
+}
+
+// popOldest takes the earliest arrival whatever the discipline.
+func TestQueuePopOldest(t *testing.T) {
+	for _, d := range []Discipline{DisciplineFIFO, DisciplineSJF, DisciplineEDF, DisciplinePriority} {
+		q := newQueue(3, QueueConfig{Discipline: d})
+		q.push(Request{ClientID: 1, WorkDemand: 50})
+		q.push(Request{ClientID: 2, WorkDemand: 5, Priority: 9})
+		q.push(Request{ClientID: 3, WorkDemand: 1})
+		if r := q.popOldest(); r.ClientID != 1 {
+			t.Errorf("%s: popOldest took %d, want 1", d, r.ClientID)
+		}
+		if q.len() != 2 {
+			t.Errorf("%s: %d left, want 2", d, q.len())
+		}
+	}
+}
+
+// With equal demands, a tenant of weight 2 is served twice as often as one of
+// weight 1, and making room costs the tenant with the most queued.
+func TestFairQueue(t *testing.T) {
+	q := newQueue(12, QueueConfig{Discipline: DisciplineFair, Weights: []float64{1, 2}})
+	for i := range 6 {
+		q.push(Request{ClientID: 100 + i, TenantID: 1, WorkDemand: 10})
+		q.push(Request{ClientID: 200 + i, TenantID: 2, WorkDemand: 10})
+	}
+	served := map[int]int{}
+	for range 6 {
+		served[q.pop().TenantID]++
+	}
+	if served[1] != 2 || served[2] != 4 {
+		t.Errorf("first 6 served by tenant: %v, want 2 and 4", served)
+	}
+	if r := q.popOldest(); r.TenantID != 1 || r.ClientID != 102 {
+		t.Errorf("popOldest took %d of tenant %d, want 102 of tenant 1", r.ClientID, r.TenantID)
+	}
+}
+
+func equalIDs(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
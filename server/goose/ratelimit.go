@@ -0,0 +1,179 @@
+package goose
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// -------------------- rate limiting middleware --------------------
+
+// RateAlgorithm selects how a RateLimiter meters requests.
+type RateAlgorithm string
+
+const (
+	// RateTokenBucket lets requests through as long as tokens are left; tokens refill
+	// at Rate per second up to Burst, so bursts of up to Burst pass at once.
+	RateTokenBucket RateAlgorithm = "token"
+	// RateLeakyBucket lets requests out at a steady Rate per second, one every 1/Rate,
+	// with room for Burst of them to wait their turn.
+	RateLeakyBucket RateAlgorithm = "leaky"
+)
+
+// RateExcess selects what a RateLimiter does with a request over the rate.
+type RateExcess string
+
+const (
+	ExcessReject RateExcess = "reject" // reply at once with StatusRejected
+	ExcessDelay  RateExcess = "delay"  // hold the request until the rate allows it
+)
+
+// RateConfig configures a RateLimiter. Zero fields take the defaults noted.
+type RateConfig struct {
+	Algorithm RateAlgorithm // default RateTokenBucket
+	Rate      float64       // requests per second
+	Burst     int           // default 1
+	Excess    RateExcess    // default ExcessReject
+	// MaxDelayMs, with ExcessDelay, rejects requests that would wait longer than
+	// this many milliseconds; zero means no limit beyond Burst for the leaky bucket.
+	MaxDelayMs float64
+}
+
+// RateStats counts what a RateLimiter did with the requests it saw.
+type RateStats struct {
+	Admitted int           // passed on without delay
+	Delayed  int           // passed on after a delay
+	Rejected int           // refused
+	Delay    time.Duration // total delay imposed
+}
+
+// RateLimiter is a Handler middleware that passes requests to an inner Handler at no
+// more than a configured rate. It composes with the rest of the server: the Server
+// (or ReqHandler) still applies its concurrency limit, and the inner Handler can be
+// any application, a Pipeline, or a ScatterGather.
+type RateLimiter struct {
+	h   Handler
+	cfg RateConfig
+
+	mu     sync.Mutex
+	tokens float64   // token bucket: tokens available (negative when delayed requests owe them)
+	last   time.Time // token bucket: when tokens were last refilled
+	next   time.Time // leaky bucket: earliest time the next request may leave
+
+	admitted   atomic.Int64
+	delayed    atomic.Int64
+	rejected   atomic.Int64
+	delayNanos atomic.Int64
+}
+
+// Package-wide totals over all RateLimiters, for WriteMetrics.
+var rateAdmitted, rateDelayed, rateRejected atomic.Int64
+
+// NewRateLimiter wraps h (nil means DemandHandler) in a RateLimiter.
+func NewRateLimiter(h Handler, cfg RateConfig) *RateLimiter {
+	if h == nil {
+		h = DemandHandler
+	}
+	if cfg.Algorithm == "" {
+		cfg.Algorithm = RateTokenBucket
+	}
+	if cfg.Burst <= 0 {
+		cfg.Burst = 1
+	}
+	if cfg.Excess == "" {
+		cfg.Excess = ExcessReject
+	}
+	if cfg.Rate <= 0 {
+		cfg.Rate = math.Inf(1)
+	}
+	now := time.Now()
+	return &RateLimiter{h: h, cfg: cfg, tokens: float64(cfg.Burst), last: now, next: now}
+}
+
+// Serve passes r to the inner Handler if the rate allows, after a delay if so
+// configured, and otherwise replies with StatusRejected.
+func (rl *RateLimiter) Serve(r Request) Request {
+	wait, ok := rl.reserve(time.Now())
+	if !ok {
+		rl.rejected.Add(1)
+		rateRejected.Add(1)
+		r.Status = StatusRejected
+		return r
+	}
+	if wait > 0 {
+		rl.delayed.Add(1)
+		rateDelayed.Add(1)
+		rl.delayNanos.Add(int64(wait))
+		if !sleepOrCancel(int(wait/time.Millisecond), r.Cancel) {
+			r.Status = StatusCancelled
+			return r
+		}
+	} else {
+		rl.admitted.Add(1)
+		rateAdmitted.Add(1)
+	}
+	return rl.h.Serve(r)
+}
+
+// reserve decides the fate of a request arriving at now: how long it must wait,
+// or false if it is refused.
+func (rl *RateLimiter) reserve(now time.Time) (time.Duration, bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	interval := time.Duration(float64(time.Second) / rl.cfg.Rate)
+	maxDelay := time.Duration(rl.cfg.MaxDelayMs * float64(time.Millisecond))
+
+	if rl.cfg.Algorithm == RateLeakyBucket {
+		if rl.next.Before(now) {
+			rl.next = now
+		}
+		wait := rl.next.Sub(now)
+		// The bucket holds the requests waiting to leak out.
+		if wait > 0 && (rl.cfg.Excess == ExcessReject || wait >= time.Duration(rl.cfg.Burst)*interval ||
+			(maxDelay > 0 && wait > maxDelay)) {
+			return 0, false
+		}
+		rl.next = rl.next.Add(interval)
+		return wait, true
+	}
+
+	// token bucket
+	rl.tokens = math.Min(float64(rl.cfg.Burst), rl.tokens+now.Sub(rl.last).Seconds()*rl.cfg.Rate)
+	rl.last = now
+	if rl.tokens >= 1 {
+		rl.tokens--
+		return 0, true
+	}
+	if rl.cfg.Excess == ExcessReject {
+		return 0, false
+	}
+	wait := time.Duration((1 - rl.tokens) / rl.cfg.Rate * float64(time.Second))
+	if maxDelay > 0 && wait > maxDelay {
+		return 0, false
+	}
+	rl.tokens-- // borrowed from the future; the wait pays it back
+	return wait, true
+}
+
+// Stats returns the counts so far.
+func (rl *RateLimiter) Stats() RateStats {
+	return RateStats{
+		Admitted: int(rl.admitted.Load()),
+		Delayed:  int(rl.delayed.Load()),
+		Rejected: int(rl.rejected.Load()),
+		Delay:    time.Duration(rl.delayNanos.Load()),
+	}
+}
+
+// PrintRateStats prints the counts of a RateLimiter on one line.
+func PrintRateStats(rl *RateLimiter) {
+	st := rl.Stats()
+	meanDelay := 0.0
+	if st.Delayed > 0 {
+		meanDelay = float64(st.Delay.Microseconds()) / 1000.0 / float64(st.Delayed)
+	}
+	fmt.Printf("ratelimit=%s/%.0f/sec burst=%d excess=%s admitted=%d delayed=%d rejected=%d meanDelay=%.3fms\n",
+		rl.cfg.Algorithm, rl.cfg.Rate, rl.cfg.Burst, rl.cfg.Excess, st.Admitted, st.Delayed, st.Rejected, meanDelay)
+}
@@ -0,0 +1,70 @@
+package goose
+
+import (
+	"testing"
+	"time"
+)
+
+// reserveAt reports the wait reserve grants a request arriving offset after t0,
+// or -1 if it refuses it.
+func reserveAt(rl *RateLimiter, t0 time.Time, offset time.Duration) time.Duration {
+	wait, ok := rl.reserve(t0.Add(offset))
+	if !ok {
+		return -1
+	}
+	return wait
+}
+
+func TestRateLimiterBuckets(t *testing.T) {
+	ms := time.Millisecond
+	for _, tc := range []struct {
+		name    string
+		cfg     RateConfig
+		offsets []time.Duration
+		want    []time.Duration
+	}{
+		{"token reject", RateConfig{Rate: 10, Burst: 3},
+			[]time.Duration{0, 0, 0, 0, 100 * ms, 100 * ms},
+			[]time.Duration{0, 0, 0, -1, 0, -1}},
+		{"token delay", RateConfig{Rate: 10, Burst: 2, Excess: ExcessDelay},
+			[]time.Duration{0, 0, 0, 0},
+			[]time.Duration{0, 0, 100 * ms, 200 * ms}},
+		{"token delay bounded", RateConfig{Rate: 10, Burst: 1, Excess: ExcessDelay, MaxDelayMs: 150},
+			[]time.Duration{0, 0, 0},
+			[]time.Duration{0, 100 * ms, -1}},
+		{"leaky reject", RateConfig{Algorithm: RateLeakyBucket, Rate: 10, Burst: 5},
+			[]time.Duration{0, 0, 100 * ms, 150 * ms},
+			[]time.Duration{0, -1, 0, -1}},
+		{"leaky delay", RateConfig{Algorithm: RateLeakyBucket, Rate: 10, Burst: 2, Excess: ExcessDelay},
+			[]time.Duration{0, 0, 0, 100 * ms},
+			[]time.Duration{0, 100 * ms, -1, 100 * ms}},
+	} {
+		rl := NewRateLimiter(nil, tc.cfg)
+		t0 := time.Now()
+		for i, off := range tc.offsets {
+			if got := reserveAt(rl, t0, off); got != tc.want[i] {
+				t.Errorf("%s: request %d at +%v waits %v, want %v (-1 is refused)", tc.name, i, off, got, tc.want[i])
+			}
+		}
+	}
+}
+
+// A refused request is answered with StatusRejected without reaching the inner
+// Handler, and counted.
+func TestRateLimiterServe(t *testing.T) {
+	served := 0
+	rl := NewRateLimiter(HandlerFunc(func(r Request) Request {
+		served++
+		return r
+	}), RateConfig{Rate: 1, Burst: 2})
+	var statuses []ReplyStatus
+	for range 3 {
+		statuses = append(statuses, rl.Serve(Request{}).Status)
+	}
+	if served != 2 || statuses[2] != StatusRejected {
+		t.Errorf("served %d, statuses %v; want 2 served and the third rejected", served, statuses)
+	}
+	if st := rl.Stats(); st.Admitted != 2 || st.Rejected != 1 || st.Delayed != 0 {
+		t.Errorf("stats %+v", st)
+	}
+}
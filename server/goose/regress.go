@@ -0,0 +1,210 @@
+package goose
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"strings"
+)
+
+// -------------------- regression suite --------------------
+
+// A regression suite is a set of fixed-seed experiments, each with the results it
+// is expected to produce, kept in a JSON golden file. A seed fixes the workload,
+// so each case always checks what repeats exactly: the digest of the requests
+// Loadgen generated, that it made N attempts, and that every request sent was
+// answered. Response times are never exactly repeatable and depend on the
+// machine, so throughput, latency, and skips are checked, against a tolerance,
+// only when the timing checks are asked for.
+
+// Golden is an expected value with a relative tolerance: a measured value passes
+// if it is within Tol*Want of Want.
+type Golden struct {
+	Want float64 `json:"want"`
+	Tol  float64 `json:"tol"`
+}
+
+// check reports how v misses g, or "" if it does not.
+func (g Golden) check(name string, v float64) string {
+	if g.Want == 0 && g.Tol == 0 {
+		return "" // not checked
+	}
+	if d := v - g.Want; d > g.Tol*g.Want || -d > g.Tol*g.Want {
+		return fmt.Sprintf("%s=%.3f, want %.3f±%.0f%%", name, v, g.Want, 100*g.Tol)
+	}
+	return ""
+}
+
+// RegressionCase is one experiment of a regression suite and its golden results.
+type RegressionCase struct {
+	Name          string     `json:"name"`
+	N             int        `json:"n"`
+	IatMean       float64    `json:"iatMean"`
+	DemandMean    float64    `json:"demandMean"`
+	MaxConcurrent int        `json:"maxConcurrent"`
+	Mode          ServerMode `json:"mode,omitempty"`
+	Seed          int64      `json:"seed"`
+	Workload      string     `json:"workload"` // see WorkloadDigest
+	Throughput    Golden     `json:"throughput"`
+	MeanRT        Golden     `json:"meanRT"`
+	P99           Golden     `json:"p99"`
+	MaxSkipped    int        `json:"maxSkipped"`
+}
+
+// Experiment returns the experiment the case runs.
+func (c RegressionCase) Experiment() Experiment {
+	return Experiment{N: c.N, IatMean: c.IatMean, DemandMean: c.DemandMean, MaxConcurrent: c.MaxConcurrent,
+		Mode: c.Mode, Load: LoadOptions{Seed: c.Seed}}
+}
+
+// WorkloadDigest returns a digest of the requests in a recorded trace: their
+// intended arrival times and demands, whether or not they were sent. Runs with
+// the same seed generate the same workload, and so the same digest.
+func WorkloadDigest(entries []TraceEntry) string {
+	h := fnv.New64a()
+	for _, e := range entries {
+		fmt.Fprintf(h, "%d %d %d %d\n", int64(math.Round(e.OffsetMs*1e6)), e.WorkMs, e.WaitMs, e.ObjectID)
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// Check returns the ways res, whose generated workload had the given digest,
+// departs from the case's golden results. With timing, it checks throughput,
+// latency, and skips too.
+func (c RegressionCase) Check(res Result, workload string, timing bool) []string {
+	var out []string
+	if res.Attempts != c.N {
+		out = append(out, fmt.Sprintf("attempts=%d, want %d", res.Attempts, c.N))
+	}
+	if c.Workload != "" && workload != c.Workload {
+		out = append(out, fmt.Sprintf("workload %s, want %s", workload, c.Workload))
+	}
+	if res.Attempts != res.Sent+res.Skipped {
+		out = append(out, fmt.Sprintf("attempts=%d but sent+skipped=%d", res.Attempts, res.Sent+res.Skipped))
+	}
+	if unanswered := res.Sent - (res.Received + res.Dropped + res.Rejected + res.Failed + res.TimedOut); unanswered != 0 {
+		out = append(out, fmt.Sprintf("%d sent requests without replies", unanswered))
+	}
+	if !timing {
+		return out
+	}
+	if res.Skipped > c.MaxSkipped {
+		out = append(out, fmt.Sprintf("skipped=%d, want at most %d", res.Skipped, c.MaxSkipped))
+	}
+	for _, s := range []string{
+		c.Throughput.check("throughput", res.Throughput),
+		c.MeanRT.check("meanRT", res.MeanRT),
+		c.P99.check("p99", res.P99),
+	} {
+		if s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// RegressionOutcome is the result of running one RegressionCase.
+type RegressionOutcome struct {
+	Case     RegressionCase
+	Result   Result
+	Workload string // digest of the workload generated
+	Failures []string
+}
+
+// LoadRegression reads a golden file.
+func LoadRegression(path string) ([]RegressionCase, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cases []RegressionCase
+	if err := json.Unmarshal(data, &cases); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return cases, nil
+}
+
+// SaveRegression writes a golden file.
+func SaveRegression(path string, cases []RegressionCase) error {
+	data, err := json.MarshalIndent(cases, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// RunRegression runs every case and checks its results, with timing as in Check.
+func RunRegression(cases []RegressionCase, timing bool) []RegressionOutcome {
+	out := make([]RegressionOutcome, len(cases))
+	for i, c := range cases {
+		e := c.Experiment()
+		rec := &TraceRecorder{}
+		e.Load.Record = rec
+		res := RunExperiment(e)
+		workload := WorkloadDigest(rec.Entries())
+		out[i] = RegressionOutcome{Case: c, Result: res, Workload: workload, Failures: c.Check(res, workload, timing)}
+	}
+	return out
+}
+
+// Regolden returns the cases with their golden values replaced by the measured
+// results of outcomes, keeping each tolerance (10% where there was none). The
+// skip limit is set a fifth above the skips measured.
+func Regolden(outcomes []RegressionOutcome) []RegressionCase {
+	cases := make([]RegressionCase, len(outcomes))
+	for i, o := range outcomes {
+		c := o.Case
+		c.Workload = o.Workload
+		set := func(g *Golden, v float64) {
+			g.Want = math.Round(v*1000) / 1000
+			if g.Tol == 0 {
+				g.Tol = 0.1
+			}
+		}
+		set(&c.Throughput, o.Result.Throughput)
+		set(&c.MeanRT, o.Result.MeanRT)
+		set(&c.P99, o.Result.P99)
+		c.MaxSkipped = o.Result.Skipped + o.Result.Skipped/5
+		cases[i] = c
+	}
+	return cases
+}
+
+// PrintRegression prints one line per case and the failures of those that failed,
+// and reports whether all passed.
+func PrintRegression(outcomes []RegressionOutcome) bool {
+	ok := true
+	for _, o := range outcomes {
+		status := "PASS"
+		if len(o.Failures) > 0 {
+			status, ok = "FAIL", false
+		}
+		fmt.Printf("%s %-20s workload=%s throughput=%.0f/sec meanRT=%.3fms p99=%.3fms skipped=%d\n",
+			status, o.Case.Name, o.Workload, o.Result.Throughput, o.Result.MeanRT, o.Result.P99, o.Result.Skipped)
+		for _, f := range o.Failures {
+			fmt.Printf("     %s\n", f)
+		}
+	}
+	return ok
+}
+
+// CheckRegression runs the suite in the golden file at path and fails t for each
+// case that departs from it, checking timing too if timing is set. Use it from a
+// test:
+//
+//	func TestRegression(t *testing.T) { goose.CheckRegression(t, "regression.json", false) }
+func CheckRegression(t TB, path string, timing bool) {
+	t.Helper()
+	cases, err := LoadRegression(path)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	for _, o := range RunRegression(cases, timing) {
+		if len(o.Failures) > 0 {
+			t.Errorf("%s: %s", o.Case.Name, strings.Join(o.Failures, "; "))
+		}
+	}
+}
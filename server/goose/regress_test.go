@@ -0,0 +1,15 @@
+package goose
+
+import (
+	"flag"
+	"testing"
+)
+
+var regressTiming = flag.Bool("timing", false, "check the regression suite's throughput, latency, and skips too")
+
+func TestRegression(t *testing.T) {
+	if testing.Short() {
+		t.Skip("the regression suite takes seconds per case")
+	}
+	CheckRegression(t, "../regression.json", *regressTiming)
+}
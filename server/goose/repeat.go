@@ -0,0 +1,124 @@
+package goose
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// -------------------- repeated runs and confidence intervals --------------------
+
+// One run of an experiment is one sample of a random process: run it again with
+// another seed and the throughput and, above all, the tail latencies come out
+// different. Repeat runs an experiment several times so that the variation can be
+// seen, and Summarize reports each metric as a mean with a 95% confidence interval.
+
+// Repeat runs e runs times, each with its own seed: e.Load.Seed+i if e sets a seed,
+// so that the set of runs can itself be repeated, or else a fresh one each time.
+func Repeat(e Experiment, runs int) []Result {
+	out := make([]Result, 0, runs)
+	for i := range runs {
+		if stopped(e.Load.Stop) {
+			break
+		}
+		ei := e
+		if e.Load.Seed != 0 {
+			ei.Load.Seed = e.Load.Seed + int64(i)
+		}
+		out = append(out, RunExperiment(ei))
+	}
+	return out
+}
+
+// Estimate is the mean of a metric over repeated runs with the half-width of its
+// 95% confidence interval: the true mean is in Mean±CI95 with 95% confidence.
+type Estimate struct {
+	Name   string
+	Mean   float64
+	CI95   float64
+	StdDev float64
+	Min    float64
+	Max    float64
+}
+
+// estimate computes the Estimate of vals, using Student's t distribution since
+// the number of runs is usually small.
+func estimate(name string, vals []float64) Estimate {
+	e := Estimate{Name: name, Min: math.Inf(1), Max: math.Inf(-1)}
+	n := len(vals)
+	if n == 0 {
+		return Estimate{Name: name}
+	}
+	for _, v := range vals {
+		e.Mean += v
+		e.Min, e.Max = min(e.Min, v), max(e.Max, v)
+	}
+	e.Mean /= float64(n)
+	if n < 2 {
+		return e
+	}
+	ss := 0.0
+	for _, v := range vals {
+		ss += (v - e.Mean) * (v - e.Mean)
+	}
+	e.StdDev = math.Sqrt(ss / float64(n-1))
+	e.CI95 = tCritical95(n-1) * e.StdDev / math.Sqrt(float64(n))
+	return e
+}
+
+// t95 are the two-sided 95% critical values of Student's t distribution for 1 to
+// 30 degrees of freedom.
+var t95 = []float64{12.706, 4.303, 3.182, 2.776, 2.571, 2.447, 2.365, 2.306, 2.262, 2.228,
+	2.201, 2.179, 2.160, 2.145, 2.131, 2.120, 2.110, 2.101, 2.093, 2.086,
+	2.080, 2.074, 2.069, 2.064, 2.060, 2.056, 2.052, 2.048, 2.045, 2.042}
+
+// tCritical95 returns the t critical value for df degrees of freedom, using the
+// normal value beyond the table.
+func tCritical95(df int) float64 {
+	if df >= 1 && df <= len(t95) {
+		return t95[df-1]
+	}
+	return 1.96
+}
+
+// Summarize returns estimates of the main metrics over results.
+func Summarize(results []Result) []Estimate {
+	metric := func(f func(Result) float64) []float64 {
+		out := make([]float64, len(results))
+		for i, r := range results {
+			out[i] = f(r)
+		}
+		return out
+	}
+	pct := func(p float64) func(Result) float64 {
+		return func(r Result) float64 {
+			return percentileOf(append([]time.Duration(nil), r.Samples...), p)
+		}
+	}
+	return []Estimate{
+		estimate("throughput/s", metric(func(r Result) float64 { return r.Throughput })),
+		estimate("meanRT ms", metric(func(r Result) float64 { return r.MeanRT })),
+		estimate("p50 ms", metric(pct(50))),
+		estimate("p90 ms", metric(pct(90))),
+		estimate("p99 ms", metric(pct(99))),
+		estimate("skipped %", metric(func(r Result) float64 {
+			if r.Attempts == 0 {
+				return 0
+			}
+			return 100 * float64(r.Skipped) / float64(r.Attempts)
+		})),
+	}
+}
+
+// PrintEstimates prints one line per estimate, with its relative precision.
+func PrintEstimates(runs int, ests []Estimate) {
+	fmt.Printf("%d runs, mean ± 95%% confidence interval:\n", runs)
+	fmt.Printf("%-14s %12s %10s %8s %10s %10s %10s\n", "metric", "mean", "±95%", "rel", "stddev", "min", "max")
+	for _, e := range ests {
+		rel := "-"
+		if e.Mean != 0 {
+			rel = fmt.Sprintf("%.1f%%", 100*e.CI95/math.Abs(e.Mean))
+		}
+		fmt.Printf("%-14s %12.3f %10.3f %8s %10.3f %10.3f %10.3f\n", e.Name, e.Mean, e.CI95, rel, e.StdDev, e.Min, e.Max)
+	}
+}
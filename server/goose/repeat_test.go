@@ -0,0 +1,50 @@
+package goose
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestEstimate(t *testing.T) {
+	e := estimate("x", []float64{1, 2, 3, 4, 5})
+	sd := math.Sqrt(2.5)
+	if e.Mean != 3 || e.Min != 1 || e.Max != 5 || math.Abs(e.StdDev-sd) > 1e-12 ||
+		math.Abs(e.CI95-2.776*sd/math.Sqrt(5)) > 1e-12 {
+		t.Errorf("estimate of 1..5 = %+v, want mean 3, sd %.4f, CI %.4f", e, sd, 2.776*sd/math.Sqrt(5))
+	}
+	if e := estimate("x", []float64{7}); e.Mean != 7 || e.CI95 != 0 {
+		t.Errorf("one run: %+v, want mean 7 and no interval", e)
+	}
+	if e := estimate("x", nil); e != (Estimate{Name: "x"}) {
+		t.Errorf("no runs: %+v, want zero", e)
+	}
+	if tCritical95(1) != 12.706 || tCritical95(30) != 2.042 || tCritical95(100) != 1.96 {
+		t.Error("t critical values do not match the table")
+	}
+}
+
+// Repeat gives each run the next seed; Summarize averages over them.
+func TestRepeat(t *testing.T) {
+	results := Repeat(Experiment{N: 10, IatMean: 1, MaxConcurrent: 4, Load: LoadOptions{Seed: 7}}, 3)
+	if len(results) != 3 {
+		t.Fatalf("%d results, want 3", len(results))
+	}
+	for i, r := range results {
+		if r.Load.Seed != 7+int64(i) || r.Received != 10 {
+			t.Errorf("run %d: seed %d, received %d; want seed %d, 10 received", i, r.Load.Seed, r.Received, 7+i)
+		}
+	}
+
+	fixed := []Result{
+		{Throughput: 100, Samples: []time.Duration{time.Millisecond}},
+		{Throughput: 200, Samples: []time.Duration{3 * time.Millisecond}},
+	}
+	ests := Summarize(fixed)
+	if ests[0].Name != "throughput/s" || ests[0].Mean != 150 {
+		t.Errorf("%s mean %g, want throughput/s 150", ests[0].Name, ests[0].Mean)
+	}
+	if ests[2].Name != "p50 ms" || ests[2].Mean != 2 {
+		t.Errorf("%s mean %g, want p50 ms 2", ests[2].Name, ests[2].Mean)
+	}
+}
@@ -0,0 +1,104 @@
+package goose
+
+import (
+	"reflect"
+)
+
+// -------------------- per-client reply channels --------------------
+
+// By default every reply comes back on the one repCh Loadgen was given, so a server
+// goroutine with a reply to deliver waits behind every reply ahead of it, whoever it
+// is for. With LoadOptions.ReplyChannels, Loadgen instead creates reply channels of
+// its own and gives each request the channel of its client, and a fan-in goroutine
+// merges them for reply processing. Comparing the two shows how much of the response
+// time is head-of-line blocking on the shared channel.
+
+// replyFanIn is a set of per-client reply channels and the goroutine merging them.
+type replyFanIn struct {
+	chans []chan Request
+	stop  chan struct{}
+	done  chan struct{}
+	late  bool       // set before stop is closed: keep absorbing late replies
+	stats *Collector // where the replies are recorded
+	gen   int        // statsGen of the experiment the replies belong to
+}
+
+// startReplyFanIn creates k reply channels with the given buffer each and starts
+// forwarding their replies to out. Late replies are recorded in stats.
+func startReplyFanIn(k, buffer int, out chan<- Request, stats *Collector) *replyFanIn {
+	f := &replyFanIn{
+		chans: make([]chan Request, k),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+		stats: stats,
+		gen:   stats.currentStatsGen(),
+	}
+	cases := make([]reflect.SelectCase, k+1)
+	for i := range f.chans {
+		f.chans[i] = make(chan Request, buffer)
+		cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(f.chans[i])}
+	}
+	cases[k] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(f.stop)}
+	go func() {
+		defer close(f.done)
+		stopped := false
+		for {
+			i, v, _ := reflect.Select(cases)
+			if i == k {
+				if !f.late {
+					return
+				}
+				// Loadgen is done, but replies to timed-out or hedged requests
+				// may still come; the server cannot finish until they are taken.
+				stopped = true
+				cases[k].Chan = reflect.ValueOf(nil) // never ready again
+				continue
+			}
+			rep := v.Interface().(Request)
+			if stopped {
+				// Once the stats are reset for the next experiment, a late reply
+				// is only taken off the server's hands, not recorded.
+				f.stats.receiveStaleUpcall(rep, f.gen)
+				continue
+			}
+			select {
+			case out <- rep:
+			case <-f.stop:
+				f.stats.receiveStaleUpcall(rep, f.gen)
+			}
+		}
+	}()
+	return f
+}
+
+// channel returns the reply channel of the given client.
+func (f *replyFanIn) channel(clientID int) chan Request {
+	return f.chans[clientID%len(f.chans)]
+}
+
+// close stops forwarding; a nil fan-in has nothing to stop. If late replies are
+// possible, the fan-in goroutine keeps taking them for as long as the process
+// lives rather than leave the server unable to deliver them, but records them only
+// until the stats are reset: the next experiment's ClientIDs start again from 0.
+func (f *replyFanIn) close(late bool) {
+	if f == nil {
+		return
+	}
+	f.late = late
+	close(f.stop)
+	if !late {
+		<-f.done
+	}
+}
+
+// startReplies sets up the reply channels opts asks for. It returns the channel to
+// read replies from, the reply channel to give each client's requests, and the
+// fan-in, which is nil when every request is to reply on repCh.
+func startReplies(repCh chan Request, opts LoadOptions) (replies chan Request, replyCh func(clientID int) chan Request, fan *replyFanIn) {
+	if opts.ReplyChannels <= 0 {
+		return repCh, func(int) chan Request { return repCh }, nil
+	}
+	replies = make(chan Request, opts.ReplyChannels)
+	fan = startReplyFanIn(opts.ReplyChannels, max(opts.ReplyBuffer, 1), replies, opts.stats())
+	return replies, fan.channel, fan
+}
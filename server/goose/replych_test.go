@@ -0,0 +1,32 @@
+package goose
+
+import (
+	"testing"
+	"time"
+)
+
+// A late reply the fan-in takes after the stats were reset belongs to the previous
+// experiment, and must not be matched to the new one's request of the same ClientID.
+func TestReplyFanInIgnoresStaleReplies(t *testing.T) {
+	ResetStats()
+	out := make(chan Request)
+	f := startReplyFanIn(1, 1, out, defaultCollector)
+	f.close(true)
+
+	ResetStats()
+	SendUpcall(Request{ClientID: 0}, false)
+	f.channel(0) <- Request{ClientID: 0, Status: StatusOK}
+	// The fan-in takes it; give it the time to (wrongly) record it.
+	deadline := time.Now().Add(50 * time.Millisecond)
+	for time.Now().Before(deadline) && len(f.chans[0]) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	if _, _, _, received, _ := GetStats(); received != 0 {
+		t.Fatalf("received %d, want the stale reply ignored", received)
+	}
+	if s := SnapshotStats(); s.Outstanding != 1 {
+		t.Fatalf("outstanding %d, want the new request still waiting", s.Outstanding)
+	}
+}
@@ -0,0 +1,117 @@
+package goose
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// -------------------- machine-readable reports --------------------
+
+// The printed summaries are for people; scripts that scrape them break whenever a
+// line changes. A Report holds the same results as one JSON document, written
+// once at the end, so that serveload -format json can be consumed as is.
+
+// RunReport is the machine-readable summary of one run. Times are in milliseconds.
+type RunReport struct {
+	Mode          string  `json:"mode"`
+	IatMean       float64 `json:"iatMean"`
+	DemandMean    float64 `json:"demandMean"`
+	MaxConcurrent int     `json:"maxConcurrent"`
+	N             int     `json:"n"`
+	Seed          int64   `json:"seed"`
+	ElapsedMs     float64 `json:"elapsedMs"`
+
+	Attempts   int `json:"attempts"`
+	Sent       int `json:"sent"`
+	Skipped    int `json:"skipped"`
+	Received   int `json:"received"`
+	Rejected   int `json:"rejected"`
+	Failed     int `json:"failed"`
+	Dropped    int `json:"dropped"`
+	TimedOut   int `json:"timedOut"`
+	Duplicates int `json:"duplicates"`
+
+	Throughput float64 `json:"throughput"` // replies per second
+	MeanRT     float64 `json:"meanRT"`
+	P50        float64 `json:"p50"`
+	P90        float64 `json:"p90"`
+	P99        float64 `json:"p99"`
+	P999       float64 `json:"p999"`
+	MaxRT      float64 `json:"maxRT"`
+
+	Utilization    float64 `json:"utilization,omitempty"`
+	CapacityPerSec float64 `json:"capacityPerSec,omitempty"`
+	Load           float64 `json:"load,omitempty"`
+
+	Validation *ValidationReport `json:"validation,omitempty"`
+}
+
+// ValidationReport is the machine-readable form of ValidationStats.
+type ValidationReport struct {
+	Checked   int `json:"checked"`
+	Invalid   int `json:"invalid"`
+	Unmatched int `json:"unmatched"`
+}
+
+// NewRunReport summarizes res.
+func NewRunReport(res Result) RunReport {
+	samps := append([]time.Duration(nil), res.Samples...)
+	c := EstimateCapacity(res)
+	r := RunReport{
+		Mode:           res.modeName(),
+		IatMean:        res.IatMean,
+		DemandMean:     res.DemandMean,
+		MaxConcurrent:  res.MaxConcurrent,
+		N:              res.N,
+		Seed:           res.Load.Seed,
+		ElapsedMs:      durationMs(res.Elapsed),
+		Attempts:       res.Attempts,
+		Sent:           res.Sent,
+		Skipped:        res.Skipped,
+		Received:       res.Received,
+		Rejected:       res.Rejected,
+		Failed:         res.Failed,
+		Dropped:        res.Dropped,
+		TimedOut:       res.TimedOut,
+		Duplicates:     res.Duplicates,
+		Throughput:     res.Throughput,
+		MeanRT:         res.MeanRT,
+		P50:            percentileOf(samps, 50),
+		P90:            percentileOf(samps, 90),
+		P99:            res.P99,
+		P999:           percentileOf(samps, 99.9),
+		MaxRT:          percentileOf(samps, 100),
+		Utilization:    c.Utilization,
+		CapacityPerSec: c.PerSec(),
+		Load:           c.Load,
+	}
+	if v := res.Validation; v.Enabled {
+		r.Validation = &ValidationReport{Checked: v.Validated, Invalid: v.Invalid, Unmatched: v.Unmatched}
+	}
+	return r
+}
+
+// Report is the machine-readable document of everything one invocation ran.
+type Report struct {
+	Metadata    RunMetadata `json:"metadata"`
+	Runs        []RunReport `json:"runs"`
+	Interrupted bool        `json:"interrupted,omitempty"`
+}
+
+// Add appends a summary of each of results to r.
+func (r *Report) Add(results ...Result) {
+	for _, res := range results {
+		r.Runs = append(r.Runs, NewRunReport(res))
+	}
+}
+
+// WriteJSON writes r as one indented JSON document.
+func (r Report) WriteJSON(w io.Writer) error {
+	if r.Runs == nil {
+		r.Runs = []RunReport{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
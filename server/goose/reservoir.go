@@ -0,0 +1,116 @@
+package goose
+
+import (
+	"math/rand"
+	"time"
+)
+
+// -------------------- bounded-memory statistics --------------------
+
+// By default every response time is kept, which is what exact percentiles need but
+// grows without bound in a long soak test. With a sample limit, the percentile and
+// histogram samples are a uniform reservoir sample (Algorithm R) of fixed size, so
+// their quantiles are estimates, while counts, means and the Prometheus histogram
+// buckets stay exact. Progress reports read a separate bounded window of the
+// latest samples.
+
+// recentMax bounds the window of latest samples kept for progress reports in
+// bounded mode; a report interval with more replies than this sees only the latest.
+const recentMax = 1 << 16
+
+// samplingState is the part of a Collector kept here.
+type samplingState struct {
+	sampleLimit   int             // 0 keeps every sample; otherwise the reservoir size
+	sampleRng     *rand.Rand      // reservoir replacement choices
+	sampleSum     time.Duration   // sum of all OK response times, sampled or not
+	latencyCounts []int           // replies per latencyBuckets bucket (cumulative)
+	recentSamples []time.Duration // bounded mode: the latest samples
+	recentBase    int             // received count before recentSamples[0]
+	correctedSeen int             // corrected response times offered to the reservoir
+	synthSeen     int             // synthesized response times offered to the reservoir
+	faultCounts   map[string]int  // replies per Fault tag
+}
+
+// SetSampleLimit bounds the number of response-time samples kept for percentiles and
+// histograms to n, using reservoir sampling; n <= 0 keeps every sample (the default).
+// Set it before an experiment starts.
+func SetSampleLimit(n int) { defaultCollector.SetSampleLimit(n) }
+
+// SetSampleLimit is the package function SetSampleLimit for c.
+func (c *Collector) SetSampleLimit(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sampleLimit = max(n, 0)
+}
+
+// SampleLimit returns the limit set by SetSampleLimit (0 if unbounded).
+func SampleLimit() int { return defaultCollector.SampleLimit() }
+
+// SampleLimit is the package function SampleLimit for c.
+func (c *Collector) SampleLimit() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sampleLimit
+}
+
+// resetSamplingLocked clears the bounded-memory state.
+func (c *Collector) resetSamplingLocked() {
+	c.sampleRng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	c.sampleSum = 0
+	c.latencyCounts = make([]int, len(latencyBuckets))
+	c.recentSamples = nil
+	c.recentBase = 0
+	c.correctedSeen = 0
+	c.synthSeen = 0
+	c.faultCounts = make(map[string]int)
+}
+
+// reservoirAdd offers d, the seen-th value of its stream, to the sample buf. Without a
+// sample limit it is simply appended; otherwise buf keeps a uniform random sample of
+// at most sampleLimit of the values seen.
+func (c *Collector) reservoirAdd(buf []time.Duration, seen int, d time.Duration) []time.Duration {
+	if c.sampleLimit <= 0 || len(buf) < c.sampleLimit {
+		return append(buf, d)
+	}
+	if i := c.sampleRng.Intn(seen); i < c.sampleLimit {
+		buf[i] = d
+	}
+	return buf
+}
+
+// recordSampleLocked records the response time of the received-th OK reply.
+func (c *Collector) recordSampleLocked(d time.Duration) {
+	c.sampleSum += d
+	secs := d.Seconds()
+	for i, le := range latencyBuckets {
+		if secs <= le {
+			c.latencyCounts[i]++
+		}
+	}
+	c.samples = c.reservoirAdd(c.samples, c.received, d)
+	if c.sampleLimit > 0 {
+		if len(c.recentSamples) == recentMax {
+			n := copy(c.recentSamples, c.recentSamples[recentMax/2:])
+			c.recentSamples = c.recentSamples[:n]
+			c.recentBase += recentMax / 2
+		}
+		c.recentSamples = append(c.recentSamples, d)
+	}
+}
+
+// samplesSinceLocked returns a copy of the response times of the replies after the
+// first n, as far as they are still kept.
+func (c *Collector) samplesSinceLocked(n int) []time.Duration {
+	buf, base := c.samples, 0
+	if c.sampleLimit > 0 {
+		buf, base = c.recentSamples, c.recentBase
+	}
+	i := n - base
+	if i < 0 {
+		i = 0
+	}
+	if i > len(buf) {
+		i = len(buf)
+	}
+	return append([]time.Duration(nil), buf[i:]...)
+}
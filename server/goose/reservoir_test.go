@@ -0,0 +1,62 @@
+package goose
+
+import (
+	"testing"
+	"time"
+)
+
+// recordN records response times of 1ms, 2ms, ... nms as OK replies.
+func recordN(n int) {
+	c := defaultCollector
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := 1; i <= n; i++ {
+		c.received++
+		c.recordSampleLocked(time.Duration(i) * time.Millisecond)
+	}
+}
+
+// With a sample limit, the samples are a reservoir of that size drawn from the
+// whole run, while the mean and the window of latest samples stay exact.
+func TestSampleLimitBoundsMemory(t *testing.T) {
+	c := defaultCollector
+	SetSampleLimit(10)
+	defer SetSampleLimit(0)
+	ResetStats()
+	recordN(1000)
+
+	samps := GetSamples()
+	if len(samps) != 10 {
+		t.Fatalf("kept %d samples, want 10", len(samps))
+	}
+	late := 0
+	for _, d := range samps {
+		if d < time.Millisecond || d > time.Second {
+			t.Errorf("sample %v was never recorded", d)
+		}
+		if d > 10*time.Millisecond {
+			late++
+		}
+	}
+	if late == 0 {
+		t.Error("the reservoir kept only the first samples")
+	}
+	if _, _, _, received, mean := GetStats(); received != 1000 || mean != 500.5 {
+		t.Errorf("received %d with mean %.2fms, want 1000 with 500.50ms", received, mean)
+	}
+	c.mu.Lock()
+	recent := c.samplesSinceLocked(995)
+	c.mu.Unlock()
+	if len(recent) != 5 || recent[0] != 996*time.Millisecond {
+		t.Errorf("latest samples %v, want 996ms to 1000ms", recent)
+	}
+}
+
+// Without a limit, every sample is kept in order.
+func TestNoSampleLimitKeepsAll(t *testing.T) {
+	ResetStats()
+	recordN(100)
+	if samps := GetSamples(); len(samps) != 100 || samps[99] != 100*time.Millisecond {
+		t.Errorf("kept %d samples, want all 100", len(samps))
+	}
+}
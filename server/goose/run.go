@@ -0,0 +1,153 @@
+package goose
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// -------------------- embedding goose --------------------
+
+// Run is the entry point for programs that use goose as a library rather than
+// through serveload. It takes everything it needs in Options, reports through
+// the returned Result and the optional Observer, and prints nothing unless given
+// a Log. Each run records its measurements in a Collector of its own rather than
+// the package stats, so runs in one process may overlap. What they still share is
+// what the process has one of: the simulated disk, the CPU pool, and GOMAXPROCS.
+
+// A Transport opens the Target a run sends its load to.
+type Transport interface {
+	Open() (Target, error)
+}
+
+// TransportFunc adapts a function to a Transport.
+type TransportFunc func() (Target, error)
+
+// Open calls f.
+func (f TransportFunc) Open() (Target, error) { return f() }
+
+// TCPTransport reaches a server started with Serve at addr (see Dial).
+func TCPTransport(addr string) Transport {
+	return TransportFunc(func() (Target, error) {
+		rc, err := Dial(addr)
+		if err != nil {
+			return nil, fmt.Errorf("dial %s: %w", addr, err)
+		}
+		return rc, nil
+	})
+}
+
+// HTTPTransport sends the load as the HTTP requests cfg describes (see HTTPTarget).
+func HTTPTransport(cfg HTTPTargetConfig) Transport {
+	return TransportFunc(func() (Target, error) { return NewHTTPTarget(cfg) })
+}
+
+// An Observer is told how a run is going while it runs.
+type Observer interface {
+	Observe(IntervalStats)
+}
+
+// ObserverFunc adapts a function to an Observer.
+type ObserverFunc func(IntervalStats)
+
+// Observe calls f.
+func (f ObserverFunc) Observe(st IntervalStats) { f(st) }
+
+// Options describes a Run.
+type Options struct {
+	Experiment // the workload, and the in-process server unless Transport is set
+
+	// Transport, if set, opens the target to send the load to instead of an
+	// in-process server; the Experiment's server fields are then ignored.
+	Transport Transport
+
+	// Observer, if set, receives the stats of every Interval (default one second)
+	// while the run goes on.
+	Observer Observer
+	Interval time.Duration
+
+	// Log, if set, receives the lines serveload would print during the run.
+	Log io.Writer
+}
+
+// Run runs the experiment opts describes and returns its results. If ctx is done
+// before the run ends, no more arrivals are generated, and Run returns the results
+// of the partial run with ctx's error once the requests already sent are settled.
+func Run(ctx context.Context, opts Options) (Result, error) {
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
+
+	e := opts.Experiment
+	if e.Load.Collector == nil {
+		e.Load.Collector = NewCollector()
+	}
+	e.Load.Log = opts.Log
+	if e.Load.Log == nil {
+		e.Load.Log = io.Discard
+	}
+	// the run stops when ctx is done or, as usual, when Load.Stop is closed
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	go func(outer <-chan struct{}) {
+		select {
+		case <-ctx.Done():
+			close(stop)
+		case <-outer:
+			close(stop)
+		case <-done:
+		}
+	}(e.Load.Stop)
+	e.Load.Stop = stop
+
+	var target Target
+	if opts.Transport != nil {
+		t, err := opts.Transport.Open()
+		if err != nil {
+			return Result{}, err
+		}
+		target = t
+	}
+	if opts.Observer != nil {
+		defer observe(e.Load.Collector, opts.Observer, opts.Interval)()
+	}
+
+	var res Result
+	if target != nil {
+		res = RunTargetExperiment(target, e)
+	} else {
+		res = RunExperiment(e)
+	}
+	res.Load.Stop, res.Load.Log = opts.Load.Stop, opts.Log
+	return res, ctx.Err()
+}
+
+// observe passes the stats in c of every interval to o until the returned
+// function is called.
+func observe(c *Collector, o Observer, interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		sampler := newIntervalSampler(c)
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				o.Observe(sampler.sample(now))
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
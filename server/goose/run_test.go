@@ -0,0 +1,61 @@
+package goose
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Runs that overlap each count their own requests and response times, and leave
+// the package stats alone.
+func TestRunsOverlap(t *testing.T) {
+	ResetStats()
+	delays := []time.Duration{20 * time.Millisecond, 0}
+	ns := []int{30, 50}
+	results := make([]Result, 2)
+	started, both := make(chan struct{}, 2), make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, err := Run(context.Background(), Options{Experiment: Experiment{
+				N:             ns[i],
+				IatMean:       1,
+				MaxConcurrent: 64,
+				Handler: HandlerFunc(func(r Request) Request {
+					if r.ClientID == 0 {
+						// neither run can finish before the other has begun
+						started <- struct{}{}
+						<-both
+					}
+					time.Sleep(delays[i])
+					return r
+				}),
+			}})
+			if err != nil {
+				t.Errorf("run %d: %v", i, err)
+			}
+			results[i] = res
+		}(i)
+	}
+	<-started
+	<-started
+	close(both)
+	wg.Wait()
+
+	for i, res := range results {
+		if res.Attempts != ns[i] || res.Sent == 0 || res.Received != res.Sent {
+			t.Errorf("run %d: %d attempts, %d sent, %d received; want %d attempts, every send answered",
+				i, res.Attempts, res.Sent, res.Received, ns[i])
+		}
+	}
+	if results[0].MeanRT < 20 || results[1].MeanRT >= 20 {
+		t.Errorf("mean response times %.1fms and %.1fms, want the slow run's alone at 20ms or more",
+			results[0].MeanRT, results[1].MeanRT)
+	}
+	if attempts, _, _, _, _ := GetStats(); attempts != 0 {
+		t.Errorf("%d attempts in the package stats, want the runs to keep their own", attempts)
+	}
+}
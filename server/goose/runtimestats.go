@@ -0,0 +1,195 @@
+package goose
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/metrics"
+	"runtime/pprof"
+	"sync"
+	"time"
+)
+
+// -------------------- runtime metrics and profiles --------------------
+
+// RuntimeStats summarizes what the Go runtime did during a run, so that a slow run
+// can be told apart from a slow server: time lost to the garbage collector and the
+// scheduler shows up here, queueing in the server does not. Times are in milliseconds.
+type RuntimeStats struct {
+	GCCycles       uint64
+	GCPauseP50     float64 // stop-the-world pauses for GC
+	GCPauseP99     float64
+	GCPauseMax     float64
+	GCCPUFraction  float64 // share of the process's CPU time spent on GC
+	SchedP50       float64 // time goroutines spent runnable before running
+	SchedP99       float64
+	MeanGoroutines float64
+	MaxGoroutines  int
+}
+
+// Runtime metrics read at the start and end of a capture.
+var runtimeMetricNames = []string{
+	"/gc/cycles/total:gc-cycles",
+	"/sched/pauses/total/gc:seconds",
+	"/sched/latencies:seconds",
+	"/cpu/classes/gc/total:cpu-seconds",
+	"/cpu/classes/total:cpu-seconds",
+}
+
+// RuntimeCapture samples the Go runtime between StartRuntimeCapture and Stop.
+type RuntimeCapture struct {
+	start []metrics.Sample
+	done  chan struct{}
+	wg    sync.WaitGroup
+
+	// goroutine counts, sampled every interval
+	sum     float64
+	samples int
+	peak    int
+}
+
+// StartRuntimeCapture starts capturing runtime metrics, sampling the number of
+// goroutines every interval (default 10ms).
+func StartRuntimeCapture(interval time.Duration) *RuntimeCapture {
+	if interval <= 0 {
+		interval = 10 * time.Millisecond
+	}
+	c := &RuntimeCapture{start: readRuntimeMetrics(), done: make(chan struct{})}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			c.sampleGoroutines()
+			select {
+			case <-c.done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return c
+}
+
+func (c *RuntimeCapture) sampleGoroutines() {
+	g := runtime.NumGoroutine()
+	c.sum += float64(g)
+	c.samples++
+	c.peak = max(c.peak, g)
+}
+
+// Stop ends the capture and returns the summary. A nil capture returns zero stats.
+func (c *RuntimeCapture) Stop() RuntimeStats {
+	if c == nil {
+		return RuntimeStats{}
+	}
+	close(c.done)
+	c.wg.Wait()
+	end := readRuntimeMetrics()
+
+	var s RuntimeStats
+	s.GCCycles = end[0].Value.Uint64() - c.start[0].Value.Uint64()
+	pauses := histogramDelta(c.start[1].Value.Float64Histogram(), end[1].Value.Float64Histogram())
+	s.GCPauseP50 = pauses.percentile(50)
+	s.GCPauseP99 = pauses.percentile(99)
+	s.GCPauseMax = pauses.percentile(100)
+	sched := histogramDelta(c.start[2].Value.Float64Histogram(), end[2].Value.Float64Histogram())
+	s.SchedP50 = sched.percentile(50)
+	s.SchedP99 = sched.percentile(99)
+	if total := end[4].Value.Float64() - c.start[4].Value.Float64(); total > 0 {
+		s.GCCPUFraction = (end[3].Value.Float64() - c.start[3].Value.Float64()) / total
+	}
+	if c.samples > 0 {
+		s.MeanGoroutines = c.sum / float64(c.samples)
+	}
+	s.MaxGoroutines = c.peak
+	return s
+}
+
+func readRuntimeMetrics() []metrics.Sample {
+	samples := make([]metrics.Sample, len(runtimeMetricNames))
+	for i, name := range runtimeMetricNames {
+		samples[i].Name = name
+	}
+	metrics.Read(samples)
+	return samples
+}
+
+// runtimeHistogram is the difference of two readings of a runtime histogram in seconds.
+type runtimeHistogram struct {
+	counts  []uint64
+	buckets []float64 // len(counts)+1 boundaries
+}
+
+func histogramDelta(before, after *metrics.Float64Histogram) runtimeHistogram {
+	h := runtimeHistogram{counts: make([]uint64, len(after.Counts)), buckets: after.Buckets}
+	for i := range after.Counts {
+		h.counts[i] = after.Counts[i] - before.Counts[i]
+	}
+	return h
+}
+
+// percentile returns the p-th percentile in milliseconds, as the upper boundary of
+// the bucket it falls in (the lower one for the unbounded last bucket).
+func (h runtimeHistogram) percentile(p float64) float64 {
+	var total uint64
+	for _, c := range h.counts {
+		total += c
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(p / 100 * float64(total)))
+	var seen uint64
+	for i, c := range h.counts {
+		seen += c
+		if c > 0 && seen >= rank {
+			upper := h.buckets[i+1]
+			if math.IsInf(upper, 1) {
+				upper = h.buckets[i]
+			}
+			return upper * 1000
+		}
+	}
+	return 0
+}
+
+// PrintRuntimeStats prints the runtime summary on one line.
+func PrintRuntimeStats(s RuntimeStats) {
+	fmt.Printf("runtime: gc=%d pauseP50=%.3fms pauseP99=%.3fms pauseMax=%.3fms gcCPU=%.1f%% schedP50=%.3fms schedP99=%.3fms goroutines=%.0f(max %d)\n",
+		s.GCCycles, s.GCPauseP50, s.GCPauseP99, s.GCPauseMax, 100*s.GCCPUFraction, s.SchedP50, s.SchedP99, s.MeanGoroutines, s.MaxGoroutines)
+}
+
+// StartProfiles starts a CPU profile, written to cpu.pprof in dir. The returned stop
+// function ends it and writes the goroutines still alive to goroutine.pprof, which
+// after a run shows any that leaked.
+func StartProfiles(dir string) (stop func() error, err error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	cpu, err := os.Create(filepath.Join(dir, "cpu.pprof"))
+	if err != nil {
+		return nil, err
+	}
+	if err := pprof.StartCPUProfile(cpu); err != nil {
+		cpu.Close()
+		return nil, err
+	}
+	return func() error {
+		g, err := os.Create(filepath.Join(dir, "goroutine.pprof"))
+		if err == nil {
+			err = pprof.Lookup("goroutine").WriteTo(g, 0)
+			if cerr := g.Close(); err == nil {
+				err = cerr
+			}
+		}
+		pprof.StopCPUProfile()
+		if cerr := cpu.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	}, nil
+}
@@ -0,0 +1,49 @@
+package goose
+
+import (
+	"math"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestRuntimeHistogramPercentile(t *testing.T) {
+	h := runtimeHistogram{
+		counts:  []uint64{0, 90, 9, 1},
+		buckets: []float64{0, 0.001, 0.002, 0.010, math.Inf(1)},
+	}
+	for _, tc := range []struct{ p, want float64 }{{50, 2}, {90, 2}, {99, 10}, {100, 10}} {
+		if got := h.percentile(tc.p); got != tc.want {
+			t.Errorf("p%g = %gms, want %gms", tc.p, got, tc.want)
+		}
+	}
+	if got := (runtimeHistogram{counts: []uint64{0}, buckets: []float64{0, 1}}).percentile(99); got != 0 {
+		t.Errorf("empty histogram: p99 = %g, want 0", got)
+	}
+}
+
+func TestRuntimeCapture(t *testing.T) {
+	c := StartRuntimeCapture(time.Millisecond)
+	block := make(chan struct{})
+	for i := 0; i < 50; i++ {
+		go func() { <-block }()
+	}
+	runtime.GC()
+	runtime.GC()
+	time.Sleep(5 * time.Millisecond)
+	close(block)
+	s := c.Stop()
+	if s.GCCycles < 2 {
+		t.Errorf("%d GC cycles, want at least the 2 forced", s.GCCycles)
+	}
+	if s.MaxGoroutines < 50 || s.MeanGoroutines <= 0 {
+		t.Errorf("goroutines: mean %.1f, max %d; want a peak of at least 50", s.MeanGoroutines, s.MaxGoroutines)
+	}
+	if s.GCCPUFraction < 0 || s.GCCPUFraction > 1 {
+		t.Errorf("GC CPU fraction %g, want a fraction", s.GCCPUFraction)
+	}
+	var nilCapture *RuntimeCapture
+	if s := nilCapture.Stop(); s != (RuntimeStats{}) {
+		t.Errorf("nil capture: %+v, want zero stats", s)
+	}
+}
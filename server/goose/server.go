@@ -0,0 +1,476 @@
+package goose
+
+import (
+	"context"
+	"crypto/tls"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// -------------------- server lifecycle --------------------
+
+// ServerConfig describes a server: how it uses goroutines, its concurrency limit,
+// its admission queue, and the application it runs.
+type ServerConfig struct {
+	Mode          ServerMode  // "" means ModeSemaphore
+	MaxConcurrent int         // concurrency limit, or number of workers in pool mode
+	Limiter       *Limiter    // semaphore mode: if set, used instead of MaxConcurrent
+	Queue         QueueConfig // semaphore mode: admission queue in front of the limiter
+	Handler       Handler     // nil means DemandHandler
+	// Drop, if set, is called for each request discarded without a reply, in place
+	// of DropUpcall (e.g. to tell a remote client).
+	Drop func(r Request)
+	// Cancelled, if set, is called with the reply to each request the client gave
+	// up on, which is not delivered, in place of CancelledUpcall.
+	Cancelled func(rep Request)
+	// ShedExpired makes the server discard, without serving it, a request whose
+	// Deadline has passed by the time it would start service, as Drop does.
+	ShedExpired bool
+	// Pressure, if set, receives a report of the server's load every PressureEvery
+	// (default 10ms) while it is taking requests, for clients that back off.
+	Pressure      chan<- Pressure
+	PressureEvery time.Duration
+	// NetDelay, if enabled, holds each reply for a simulated network delay after
+	// service, without its concurrency slot (see netdelay.go).
+	NetDelay NetDelay
+	// NetDelaySeed, if nonzero, seeds the network delays drawn, so that runs
+	// with the same seed delay their replies alike; zero means the time.
+	NetDelaySeed int64
+	// TLS, if set, makes ServeListener accept connections over TLS (see tls.go).
+	TLS *tls.Config
+	// Collector, if set, is where DropUpcall and CancelledUpcall report, in place
+	// of the package stats.
+	Collector *Collector
+}
+
+// ServerOption sets one field of a server's configuration in NewServer.
+type ServerOption func(*ServerConfig)
+
+// WithConfig replaces the whole configuration.
+func WithConfig(cfg ServerConfig) ServerOption {
+	return func(c *ServerConfig) { *c = cfg }
+}
+
+// WithMode selects semaphore or pool mode.
+func WithMode(m ServerMode) ServerOption {
+	return func(c *ServerConfig) { c.Mode = m }
+}
+
+// WithMaxConcurrent sets the concurrency limit (or pool size).
+func WithMaxConcurrent(n int) ServerOption {
+	return func(c *ServerConfig) { c.MaxConcurrent = n }
+}
+
+// WithLimiter uses lim as the concurrency limit, so it can be changed at runtime.
+func WithLimiter(lim *Limiter) ServerOption {
+	return func(c *ServerConfig) { c.Limiter = lim }
+}
+
+// WithQueue puts an admission queue in front of the limiter.
+func WithQueue(q QueueConfig) ServerOption {
+	return func(c *ServerConfig) { c.Queue = q }
+}
+
+// WithHandler sets the application.
+func WithHandler(h Handler) ServerOption {
+	return func(c *ServerConfig) { c.Handler = h }
+}
+
+// ServerStats are the counters of one Server.
+type ServerStats struct {
+	Served    int           // requests whose service ran to completion
+	Cancelled int           // requests abandoned part way because the client gave up
+	Failed    int           // requests the application failed (error reply or panic)
+	Rejected  int           // rejection replies sent (queue policy or shutdown)
+	Dropped   int           // requests discarded without a reply
+	Shed      int           // requests discarded unserved because their deadline had passed
+	Late      int           // requests served to completion after their deadline
+	InFlight  int           // requests in service right now
+	Queued    int           // requests in the admission queue right now
+	Limit     int           // current concurrency limit (pool size in pool mode)
+	BusyTime  time.Duration // total time spent serving requests
+	Workers   []WorkerStats // per worker, in pool mode
+
+	NetDelayed int           // replies held for a simulated network delay
+	NetDelay   time.Duration // total simulated network delay
+}
+
+// Server is a server with its own configuration, limiter, queue, and counters,
+// so that several can run side by side in one process. Create it with NewServer
+// (or StartServer), run it with Start, and stop it with Shutdown or Stop.
+// Unlike the ReqHandler family of functions, it can be shut down while requests
+// are still arriving.
+type Server struct {
+	cfg   ServerConfig
+	reqCh <-chan Request
+	repCh chan<- Request
+	disp  *dispatcher // semaphore mode
+
+	stop    chan struct{}  // closed by Shutdown: stop taking requests
+	abort   chan struct{}  // closed when Shutdown gives up waiting: stop delivering replies
+	stopped chan struct{}  // closed when the receiving loop has exited
+	waiting []Request      // requests still queued when the loop stopped
+	inSvc   sync.WaitGroup // admitted requests not yet finished
+
+	replyMu sync.RWMutex // held for reading while delivering, for writing to close repCh
+	closed  bool         // repCh has been closed
+
+	served    atomic.Int64
+	cancelled atomic.Int64
+	failed    atomic.Int64
+	rejected  atomic.Int64
+	dropped   atomic.Int64
+	shed      atomic.Int64
+	late      atomic.Int64
+	inFlight  atomic.Int64
+	busyNanos atomic.Int64
+	workers   []workerCounters // pool mode
+
+	netDelayed atomic.Int64
+	netNanos   atomic.Int64
+	netMu      sync.Mutex
+	netRng     *rand.Rand // network delays, under netMu
+
+	ownLimiter bool
+	started    bool
+	shutdown   sync.Once
+	err        error
+}
+
+// NewServer returns a server configured by opts. It does nothing until Start.
+func NewServer(opts ...ServerOption) *Server {
+	var cfg ServerConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.Handler == nil {
+		cfg.Handler = DemandHandler
+	}
+	if cfg.MaxConcurrent <= 0 {
+		cfg.MaxConcurrent = 1
+	}
+	s := &Server{
+		cfg:     cfg,
+		stop:    make(chan struct{}),
+		abort:   make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if cfg.NetDelay.Enabled() {
+		seed := cfg.NetDelaySeed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		s.netRng = rand.New(rand.NewSource(seed))
+	}
+	return s
+}
+
+// StartServer is NewServer(WithConfig(cfg)) followed by Start(reqCh, repCh).
+func StartServer(reqCh <-chan Request, repCh chan<- Request, cfg ServerConfig) *Server {
+	s := NewServer(WithConfig(cfg))
+	s.Start(reqCh, repCh)
+	return s
+}
+
+// Start makes the server receive requests from reqCh and deliver replies on each
+// request's ReplyCh, which is expected to be repCh. Call Shutdown or Stop to stop
+// it; either closes repCh. Start must be called at most once.
+func (s *Server) Start(reqCh <-chan Request, repCh chan<- Request) {
+	if s.started {
+		panic("goose: Server started twice")
+	}
+	s.started = true
+	s.reqCh = reqCh
+	s.repCh = repCh
+	CalibrateCPU() // before the first request rather than during it
+	if s.cfg.Pressure != nil {
+		go s.publishPressure()
+	}
+
+	if s.cfg.Mode == ModePool {
+		s.workers = make([]workerCounters, s.cfg.MaxConcurrent)
+		go s.runPool()
+		return
+	}
+	if s.cfg.Limiter == nil {
+		s.cfg.Limiter = NewLimiter(s.cfg.MaxConcurrent)
+		s.ownLimiter = true
+	}
+	s.disp = newDispatcher(s.cfg.Limiter, s.cfg.Queue, HandlerFunc(s.serve), s.deliver)
+	s.disp.drop = s.drop
+	s.disp.cancelled = s.abandoned
+	go s.runDispatcher()
+}
+
+// Stop is Shutdown without a deadline.
+func (s *Server) Stop() {
+	s.Shutdown(context.Background())
+}
+
+// Stats returns a snapshot of the server's counters.
+func (s *Server) Stats() ServerStats {
+	st := ServerStats{
+		Served:    int(s.served.Load()),
+		Cancelled: int(s.cancelled.Load()),
+		Failed:    int(s.failed.Load()),
+		Rejected:  int(s.rejected.Load()),
+		Dropped:   int(s.dropped.Load()),
+		Shed:      int(s.shed.Load()),
+		Late:      int(s.late.Load()),
+		InFlight:  int(s.inFlight.Load()),
+		BusyTime:  time.Duration(s.busyNanos.Load()),
+		Limit:     s.cfg.MaxConcurrent,
+
+		NetDelayed: int(s.netDelayed.Load()),
+		NetDelay:   time.Duration(s.netNanos.Load()),
+	}
+	if s.cfg.Limiter != nil && s.cfg.Mode != ModePool {
+		st.Limit = s.cfg.Limiter.Limit()
+	}
+	if s.disp != nil {
+		st.Queued = int(s.disp.queued.Load())
+	}
+	for i := range s.workers {
+		st.Workers = append(st.Workers, s.workers[i].stats())
+	}
+	return st
+}
+
+// serve runs the application on r and counts the outcome.
+func (s *Server) serve(r Request) Request {
+	if s.cfg.ShedExpired && !r.Deadline.IsZero() && clockNow().After(r.Deadline) {
+		// The reply would be useless: spend the capacity on a request that
+		// can still make it. deliver discards r.
+		rep := r
+		rep.Status = StatusDropped
+		return rep
+	}
+	s.inFlight.Add(1)
+	start := clockNow()
+	rep := safeServe(s.cfg.Handler, r)
+	s.busyNanos.Add(int64(clockSince(start)))
+	s.inFlight.Add(-1)
+	switch rep.Status {
+	case StatusCancelled:
+		s.cancelled.Add(1)
+	case StatusFailed:
+		s.failed.Add(1)
+	default:
+		s.served.Add(1)
+		if !r.Deadline.IsZero() && clockNow().After(r.Deadline) {
+			s.late.Add(1)
+		}
+	}
+	return rep
+}
+
+func (s *Server) runDispatcher() {
+	defer close(s.stopped)
+	d := s.disp
+	// The dispatcher tracks its requests in service with its own WaitGroup;
+	// fold them into ours before anyone can wait on it.
+	s.inSvc.Add(1)
+	go func() {
+		<-s.stopped
+		d.wg.Wait()
+		s.inSvc.Done()
+	}()
+	s.waiting = d.run(s.reqCh, s.stop)
+}
+
+func (s *Server) runPool() {
+	var workers sync.WaitGroup
+	workers.Add(s.cfg.MaxConcurrent)
+	s.inSvc.Add(s.cfg.MaxConcurrent)
+	for i := 0; i < s.cfg.MaxConcurrent; i++ {
+		h := s.workers[i].wrap(s.serve)
+		go func() {
+			defer workers.Done()
+			defer s.inSvc.Done()
+			for {
+				select {
+				case <-s.stop:
+					return
+				default:
+				}
+				select {
+				case <-s.stop:
+					return
+				case req, ok := <-s.reqCh:
+					if !ok {
+						return
+					}
+					handleWith(req, h, s.deliver, s.abandoned)
+				}
+			}
+		}()
+	}
+	workers.Wait()
+	close(s.stopped)
+}
+
+// deliver sends rep to the client unless the server has given up on delivery,
+// in which case the request is recorded as dropped.
+func (s *Server) deliver(r, rep Request) {
+	s.replyMu.RLock()
+	defer s.replyMu.RUnlock()
+	if r.ReplyCh == nil {
+		return
+	}
+	if rep.Status == StatusDropped {
+		s.shed.Add(1)
+		s.discard(r)
+		return
+	}
+	if s.closed {
+		s.drop(r)
+		return
+	}
+	if s.cfg.NetDelay.Enabled() {
+		s.deliverLater(r, rep)
+		return
+	}
+	s.sendLocked(r, rep)
+}
+
+// send delivers rep to the client, as deliver does, once it has been held.
+func (s *Server) send(r, rep Request) {
+	s.replyMu.RLock()
+	defer s.replyMu.RUnlock()
+	if s.closed {
+		s.drop(r)
+		return
+	}
+	s.sendLocked(r, rep)
+}
+
+// sendLocked sends rep on the client's reply channel; replyMu must be held for reading.
+func (s *Server) sendLocked(r, rep Request) {
+	select {
+	case r.ReplyCh <- rep:
+		if rep.Status == StatusRejected {
+			s.rejected.Add(1)
+		}
+	case <-s.abort:
+		s.drop(r)
+	}
+}
+
+// abandoned disposes of the reply to a request the client has given up on.
+func (s *Server) abandoned(rep Request) {
+	if s.cfg.Cancelled != nil {
+		s.cfg.Cancelled(rep)
+		return
+	}
+	s.stats().CancelledUpcall(rep)
+}
+
+// drop discards r without a reply.
+func (s *Server) drop(r Request) {
+	s.dropped.Add(1)
+	s.discard(r)
+}
+
+// discard tells the client, or the stats, that r will get no reply.
+func (s *Server) discard(r Request) {
+	if s.cfg.Drop != nil {
+		s.cfg.Drop(r)
+		return
+	}
+	s.stats().DropUpcall(r)
+}
+
+// stats returns the Collector the server reports to.
+func (s *Server) stats() *Collector {
+	if s.cfg.Collector != nil {
+		return s.cfg.Collector
+	}
+	return defaultCollector
+}
+
+// Shutdown stops the server from taking new requests, rejects requests that are
+// still waiting (in its admission queue or buffered in reqCh), waits for requests
+// in service to finish, and then closes repCh. If ctx ends before service finishes,
+// Shutdown stops waiting, records the unfinished requests as dropped when they
+// complete, closes repCh, and returns ctx.Err(). Later calls return the first result.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.shutdown.Do(func() {
+		if !s.started {
+			return
+		}
+		giveUp := func() {
+			if s.err == nil {
+				s.err = ctx.Err()
+				close(s.abort)
+			}
+		}
+
+		// Stop taking requests. The receiving loop may itself be stuck delivering
+		// a reply (pool mode), so the deadline applies here too.
+		close(s.stop)
+		select {
+		case <-s.stopped:
+		case <-ctx.Done():
+			giveUp()
+			<-s.stopped
+		}
+
+		// Reject whatever is still waiting, including arrivals buffered in reqCh.
+		// The client may not be reading, so reject in the background like service.
+		for _, r := range s.waiting {
+			s.rejectLater(r)
+		}
+		s.waiting = nil
+	drain:
+		for {
+			select {
+			case r, ok := <-s.reqCh:
+				if !ok {
+					break drain
+				}
+				s.rejectLater(r)
+			default:
+				break drain
+			}
+		}
+
+		done := make(chan struct{})
+		go func() {
+			s.inSvc.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			giveUp()
+		}
+
+		s.replyMu.Lock()
+		s.closed = true
+		close(s.repCh)
+		s.replyMu.Unlock()
+
+		if s.ownLimiter {
+			// Requests abandoned above may still release permits; keep the
+			// limiter running until they have.
+			go func() {
+				<-done
+				s.cfg.Limiter.Close()
+			}()
+		}
+	})
+	return s.err
+}
+
+// rejectLater replies to r with StatusRejected from a new goroutine counted as in service.
+func (s *Server) rejectLater(r Request) {
+	s.inSvc.Add(1)
+	go func() {
+		defer s.inSvc.Done()
+		rep := r
+		rep.Status = StatusRejected
+		s.deliver(r, rep)
+	}()
+}
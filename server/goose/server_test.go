@@ -0,0 +1,120 @@
+package goose
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// blockingServer starts a server of one slot and a FIFO queue whose handler
+// signals started and then waits for release, and a reader that collects its
+// replies until repCh closes. reqCh is unbuffered, so a request sent has been
+// taken in service or queued.
+func blockingServer(started chan<- int, release <-chan struct{}) (*Server, chan<- Request, chan Request, <-chan []Request) {
+	cfg := ServerConfig{
+		MaxConcurrent: 1,
+		Queue:         QueueConfig{Len: 4, Discipline: DisciplineFIFO},
+		Handler: HandlerFunc(func(r Request) Request {
+			started <- r.ClientID
+			<-release
+			return r
+		}),
+	}
+	reqCh := make(chan Request)
+	repCh := make(chan Request)
+	s := StartServer(reqCh, repCh, cfg)
+	replies := make(chan []Request, 1)
+	go func() {
+		var reps []Request
+		for rep := range repCh {
+			reps = append(reps, rep)
+		}
+		replies <- reps
+	}()
+	return s, reqCh, repCh, replies
+}
+
+// Shutdown rejects the queued requests, waits for the one in service, and then
+// closes repCh; a second call returns the same result.
+func TestServerShutdownDrains(t *testing.T) {
+	started, release := make(chan int, 3), make(chan struct{})
+	s, reqCh, repCh, replies := blockingServer(started, release)
+	for i := range 3 {
+		reqCh <- Request{ClientID: i, ReplyCh: repCh}
+	}
+	<-started
+
+	done := make(chan error)
+	go func() { done <- s.Shutdown(context.Background()) }()
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned %v with a request in service", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	statuses := map[ReplyStatus]int{}
+	for _, rep := range <-replies {
+		statuses[rep.Status]++
+	}
+	if statuses[StatusOK] != 1 || statuses[StatusRejected] != 2 {
+		t.Errorf("replies by status %v, want 1 ok and 2 rejected", statuses)
+	}
+	if len(started) != 0 {
+		t.Errorf("%d queued requests were served after Shutdown", len(started))
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Errorf("second Shutdown: %v", err)
+	}
+}
+
+// When ctx ends first, Shutdown closes repCh anyway and returns ctx's error,
+// and the request it gave up on is dropped when it finishes.
+func TestServerShutdownDeadline(t *testing.T) {
+	ResetStats()
+	started, release := make(chan int, 1), make(chan struct{})
+	s, reqCh, repCh, replies := blockingServer(started, release)
+	req := Request{ReplyCh: repCh}
+	SendUpcall(req, false)
+	reqCh <- req
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Shutdown: %v, want deadline exceeded", err)
+	}
+	if reps := <-replies; len(reps) != 0 {
+		t.Errorf("got %d replies, want none", len(reps))
+	}
+	close(release)
+	waitFor(t, "the abandoned request to be dropped", func() bool { return GetOutcomes()[StatusDropped] == 1 })
+}
+
+// Servers given the same NetDelaySeed hold their replies for the same delays.
+func TestServerNetDelaySeeded(t *testing.T) {
+	delays := func() time.Duration {
+		reqCh, repCh := make(chan Request), make(chan Request, 8)
+		s := StartServer(reqCh, repCh, ServerConfig{
+			MaxConcurrent: 4,
+			Handler:       HandlerFunc(func(r Request) Request { return r }),
+			NetDelay:      NetDelay{JitterMs: 1, Dist: NetDelayExp},
+			NetDelaySeed:  7,
+		})
+		for i := range 8 {
+			reqCh <- Request{ClientID: i, ReplyCh: repCh}
+		}
+		for range 8 {
+			<-repCh
+		}
+		s.Stop()
+		return s.Stats().NetDelay
+	}
+	if a, b := delays(), delays(); a != b || a == 0 {
+		t.Errorf("total delays %v and %v, want the same nonzero delay", a, b)
+	}
+}
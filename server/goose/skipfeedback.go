@@ -0,0 +1,147 @@
+package goose
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// -------------------- skip-rate feedback --------------------
+
+// An arrival that finds the request channel full is skipped, which keeps Loadgen
+// on schedule but means the server saw less load than intended: a run with many
+// skips measures a throttled workload. With LoadOptions.SkipWarn, Loadgen watches
+// the skip rate over every skipWindow attempts. The first window over the
+// threshold gets a warning on stderr, and the end of the run a report of offered
+// against intended load. Two options reduce the skips instead:
+//
+//   - SendTimeoutMs waits that long for room in the channel before skipping;
+//     while it waits, Loadgen processes nothing else.
+//   - AutoBuffer queues arrivals that find the channel full in Loadgen, in
+//     front of the channel, and doubles that queue (up to AutoBuffer) each time a
+//     window's skip rate is over the threshold. Queued arrivals count as sent;
+//     their response times include the time they spend queued.
+
+// skipWindow is the number of attempts over which Loadgen measures the skip rate.
+const skipWindow = 100
+
+// skipFeedback tracks the skip rate of a run and sizes Loadgen's overflow queue.
+type skipFeedback struct {
+	threshold float64
+	maxExtra  int
+	timeout   time.Duration
+
+	extra    int // current overflow capacity
+	window   int // attempts in the current window
+	skips    int // skips in the current window
+	warned   bool
+	grown    int // times the overflow capacity was raised
+	waited   int // sends that had to wait for room
+	queued   int // arrivals that went to the overflow queue
+	maxQueue int
+
+	overflow []Request // arrivals waiting for room in the request channel
+}
+
+func newSkipFeedback(opts LoadOptions) *skipFeedback {
+	return &skipFeedback{
+		threshold: opts.SkipWarn,
+		maxExtra:  opts.AutoBuffer,
+		timeout:   time.Duration(opts.SendTimeoutMs * float64(time.Millisecond)),
+	}
+}
+
+// attempt records one attempt, and at the end of each window checks its skip rate.
+func (f *skipFeedback) attempt(skipped bool) {
+	if f.threshold <= 0 {
+		return
+	}
+	f.window++
+	if skipped {
+		f.skips++
+	}
+	if f.window < skipWindow {
+		return
+	}
+	rate := float64(f.skips) / float64(f.window)
+	f.window, f.skips = 0, 0
+	if rate <= f.threshold {
+		return
+	}
+	if !f.warned {
+		f.warned = true
+		fmt.Fprintf(os.Stderr, "loadgen: WARNING: %.0f%% of recent arrivals skipped (the request channel is full); the server sees less load than configured\n", 100*rate)
+	}
+	if f.maxExtra > 0 && f.extra < f.maxExtra {
+		f.extra = min(max(2*f.extra, 16), f.maxExtra)
+		f.grown++
+	}
+}
+
+// report prints to w the offered against the intended load of a run of n attempts.
+func (f *skipFeedback) report(w io.Writer, n, skipped int, intendedRate float64, elapsed time.Duration) {
+	if f.threshold <= 0 || n == 0 {
+		return
+	}
+	frac := float64(skipped) / float64(n)
+	if frac <= f.threshold && f.grown == 0 && f.waited == 0 {
+		return
+	}
+	offered := float64(n-skipped) / elapsed.Seconds()
+	if frac > f.threshold {
+		fmt.Fprintf(w, "WARNING: skipped %.1f%% of arrivals: offered load %.1f/sec, intended %.1f/sec\n", 100*frac, offered, intendedRate)
+	}
+	if f.timeout > 0 {
+		fmt.Fprintf(w, "send timeout %v: %d sends waited for room\n", f.timeout, f.waited)
+	}
+	if f.maxExtra > 0 {
+		fmt.Fprintf(w, "auto buffer: grew %d times to %d (max %d), %d arrivals queued in loadgen, at most %d at once\n",
+			f.grown, f.extra, f.maxExtra, f.queued, f.maxQueue)
+	}
+}
+
+// trySend sends req on reqCh if there is room, waiting up to the send timeout
+// for it, or else queues it in the overflow queue if that has room. Requests
+// already queued go first, so req only goes straight to reqCh if none are.
+// It reports whether req was sent or queued.
+func (f *skipFeedback) trySend(reqCh chan<- Request, req Request) bool {
+	if len(f.overflow) == 0 {
+		select {
+		case reqCh <- req:
+			return true
+		default:
+		}
+		if f.timeout > 0 {
+			t := time.NewTimer(f.timeout)
+			defer t.Stop()
+			select {
+			case reqCh <- req:
+				f.waited++
+				return true
+			case <-t.C:
+			}
+		}
+	}
+	if len(f.overflow) < f.extra {
+		f.overflow = append(f.overflow, req)
+		f.queued++
+		f.maxQueue = max(f.maxQueue, len(f.overflow))
+		return true
+	}
+	return false
+}
+
+// head returns reqCh and the first queued request, for Loadgen's select, or a
+// nil channel if none is queued.
+func (f *skipFeedback) head(reqCh chan<- Request) (chan<- Request, Request) {
+	if len(f.overflow) == 0 {
+		return nil, Request{}
+	}
+	return reqCh, f.overflow[0]
+}
+
+// pop removes the first queued request, once it has been sent.
+func (f *skipFeedback) pop() {
+	f.overflow = f.overflow[1:]
+}
@@ -0,0 +1,114 @@
+package goose
+
+import (
+	"fmt"
+	"time"
+)
+
+// -------------------- SLO tracking and Apdex --------------------
+
+// SLO is a response-time objective: at least Target of the sent requests are
+// answered successfully within ThresholdMs.
+type SLO struct {
+	ThresholdMs float64
+	Target      float64 // fraction, e.g. 0.99; default 0.99
+}
+
+// SetSLO makes the package stats classify every reply against the threshold of slo
+// (see GetSLOStats); a zero threshold turns the classification off. Set it before
+// an experiment starts.
+func SetSLO(slo SLO) { defaultCollector.SetSLO(slo) }
+
+// SetSLO is the package function SetSLO for c.
+func (c *Collector) SetSLO(slo SLO) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if slo.Target <= 0 || slo.Target > 1 {
+		slo.Target = 0.99
+	}
+	c.currentSLO = slo
+}
+
+// SLOStats classifies the requests of a run against an SLO threshold T in the
+// manner of Apdex: satisfied replies took at most T, tolerating ones at most 4T,
+// and frustrated ones longer. Requests that were rejected, failed, dropped, or
+// timed out count as frustrated.
+type SLOStats struct {
+	SLO
+	Satisfied  int
+	Tolerating int
+	Frustrated int
+	Met        float64 // fraction of requests satisfied
+	Apdex      float64 // (satisfied + tolerating/2) / total
+}
+
+// OK reports whether the SLO was met.
+func (s SLOStats) OK() bool { return s.Total() > 0 && s.Met >= s.Target }
+
+// Total returns the number of requests classified.
+func (s SLOStats) Total() int { return s.Satisfied + s.Tolerating + s.Frustrated }
+
+// recordSLOLocked classifies a successful reply with response time rt.
+func (c *Collector) recordSLOLocked(rt time.Duration) {
+	if c.currentSLO.ThresholdMs <= 0 {
+		return
+	}
+	t := time.Duration(c.currentSLO.ThresholdMs * float64(time.Millisecond))
+	switch {
+	case rt <= t:
+		c.sloSatisfied++
+	case rt <= 4*t:
+		c.sloTolerated++
+	default:
+		c.sloExceeded++
+	}
+}
+
+// GetSLOStats returns the requests since the last ResetStats classified against
+// the SLO set by SetSLO.
+func GetSLOStats() SLOStats { return defaultCollector.GetSLOStats() }
+
+// GetSLOStats is the package function GetSLOStats for c.
+func (c *Collector) GetSLOStats() SLOStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := SLOStats{SLO: c.currentSLO, Satisfied: c.sloSatisfied, Tolerating: c.sloTolerated, Frustrated: c.sloExceeded}
+	s.Frustrated += c.outcomes[StatusRejected] + c.outcomes[StatusFailed] + c.outcomes[StatusDropped] + c.outcomes[StatusTimedOut]
+	if total := s.Total(); total > 0 {
+		s.Met = float64(s.Satisfied) / float64(total)
+		s.Apdex = (float64(s.Satisfied) + float64(s.Tolerating)/2) / float64(total)
+	}
+	return s
+}
+
+// PrintSLOStats prints the SLO classification on one line.
+func PrintSLOStats(s SLOStats) {
+	verdict := "met"
+	if !s.OK() {
+		verdict = "MISSED"
+	}
+	fmt.Printf("slo=%gms target=%.1f%% met=%.2f%% apdex=%.3f satisfied=%d tolerating=%d frustrated=%d %s\n",
+		s.ThresholdMs, 100*s.Target, 100*s.Met, s.Apdex, s.Satisfied, s.Tolerating, s.Frustrated, verdict)
+}
+
+// SLORamp runs base at each of the given inter-arrival means in turn, which should
+// go from light load to heavy, and stops after the first run that misses slo. It
+// returns the results so far and the index of the run with the highest throughput
+// that met the SLO (-1 if none did): the maximum sustainable throughput.
+func SLORamp(base Experiment, iatMeans []float64, slo SLO) (results []Result, best int) {
+	SetSLO(slo)
+	best = -1
+	for _, iat := range iatMeans {
+		e := base
+		e.IatMean = iat
+		res := RunExperiment(e)
+		results = append(results, res)
+		if !res.SLO.OK() {
+			break
+		}
+		if best < 0 || res.Throughput > results[best].Throughput {
+			best = len(results) - 1
+		}
+	}
+	return results, best
+}
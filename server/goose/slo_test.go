@@ -0,0 +1,53 @@
+package goose
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSLOClassification(t *testing.T) {
+	c := defaultCollector
+	SetSLO(SLO{ThresholdMs: 10})
+	defer SetSLO(SLO{})
+	ResetStats()
+	c.mu.Lock()
+	for _, ms := range []int{1, 5, 10, 10, 11, 40, 41, 500} {
+		c.recordSLOLocked(time.Duration(ms) * time.Millisecond)
+	}
+	c.outcomes[StatusRejected]++
+	c.outcomes[StatusTimedOut]++
+	c.mu.Unlock()
+
+	s := GetSLOStats()
+	if s.Target != 0.99 {
+		t.Errorf("target %g, want the 0.99 default", s.Target)
+	}
+	if s.Satisfied != 4 || s.Tolerating != 2 || s.Frustrated != 4 {
+		t.Errorf("satisfied/tolerating/frustrated = %d/%d/%d, want 4/2/4", s.Satisfied, s.Tolerating, s.Frustrated)
+	}
+	if s.Met != 0.4 || s.Apdex != 0.5 || s.OK() {
+		t.Errorf("met %g, apdex %g, ok %v; want 0.4, 0.5, false", s.Met, s.Apdex, s.OK())
+	}
+}
+
+// The SLO outlives ResetStats, but its counts do not; without one nothing is classified.
+func TestSLOReset(t *testing.T) {
+	c := defaultCollector
+	SetSLO(SLO{ThresholdMs: 10, Target: 0.5})
+	ResetStats()
+	c.mu.Lock()
+	c.recordSLOLocked(time.Millisecond)
+	c.mu.Unlock()
+	ResetStats()
+	if s := GetSLOStats(); s.ThresholdMs != 10 || s.Target != 0.5 || s.Total() != 0 || s.OK() {
+		t.Errorf("after reset: %+v, want the SLO kept and no requests", s)
+	}
+
+	SetSLO(SLO{})
+	c.mu.Lock()
+	c.recordSLOLocked(time.Millisecond)
+	c.mu.Unlock()
+	if s := GetSLOStats(); s.Total() != 0 {
+		t.Errorf("%d requests classified with no SLO, want 0", s.Total())
+	}
+}
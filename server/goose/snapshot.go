@@ -0,0 +1,132 @@
+package goose
+
+import (
+	"time"
+)
+
+// -------------------- snapshots and interval deltas --------------------
+
+// StatsSnapshot is a copy of the counters of the package stats, or of a Collector,
+// at one moment. Taking snapshots does not disturb the running experiment, so a
+// reporter can take one periodically and use DeltaStats to see what happened in
+// between.
+type StatsSnapshot struct {
+	At          time.Time
+	Attempts    int
+	Sent        int
+	Skipped     int
+	Received    int
+	Outstanding int
+	TotalRT     time.Duration // sum of the response times of the received replies
+
+	outcomes map[ReplyStatus]int // unexported so that the snapshot cannot change
+	gen      int                 // statsGen when taken
+}
+
+// Outcome returns the number of sent requests that had ended with status st
+// (other than StatusOK) when the snapshot was taken.
+func (s StatsSnapshot) Outcome(st ReplyStatus) int {
+	return s.outcomes[st]
+}
+
+// SnapshotStats returns the current package counters.
+func SnapshotStats() StatsSnapshot { return defaultCollector.SnapshotStats() }
+
+// SnapshotStats is the package function SnapshotStats for c.
+func (c *Collector) SnapshotStats() StatsSnapshot {
+	return c.snapshotAt(time.Now())
+}
+
+func (c *Collector) snapshotAt(now time.Time) StatsSnapshot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.snapshotLocked(now)
+}
+
+func (c *Collector) snapshotLocked(now time.Time) StatsSnapshot {
+	s := StatsSnapshot{
+		At:          now,
+		Attempts:    c.attempts,
+		Sent:        c.sent,
+		Skipped:     c.skipped,
+		Received:    c.received,
+		Outstanding: len(c.sendTimes),
+		TotalRT:     c.sampleSum,
+		outcomes:    make(map[ReplyStatus]int, len(c.outcomes)),
+		gen:         c.statsGen,
+	}
+	for st, n := range c.outcomes {
+		s.outcomes[st] = n
+	}
+	return s
+}
+
+// StatsDelta describes the interval between two snapshots. Counters are the
+// increases over the interval; rates and response times cover only the interval.
+type StatsDelta struct {
+	Start, End StatsSnapshot
+	Elapsed    time.Duration
+	Attempts   int
+	Sent       int
+	Skipped    int
+	Received   int
+	Outcomes   map[ReplyStatus]int
+	Throughput float64 // replies per second
+	SkipRate   float64 // fraction of attempts skipped
+	MeanRT     float64 // milliseconds
+	P50        float64 // milliseconds
+	P90        float64 // milliseconds
+	P99        float64 // milliseconds
+}
+
+// DeltaStats takes a new snapshot and returns what changed since prev. If the stats
+// were reset after prev was taken, the interval starts at the reset. Pass End as
+// prev to the next call to report consecutive intervals.
+// Percentiles are over the replies of the interval (with a sample limit, the latest
+// of them; see SetSampleLimit).
+func DeltaStats(prev StatsSnapshot) StatsDelta { return defaultCollector.DeltaStats(prev) }
+
+// DeltaStats is the package function DeltaStats for c.
+func (c *Collector) DeltaStats(prev StatsSnapshot) StatsDelta {
+	return c.deltaStatsAt(prev, time.Now())
+}
+
+func (c *Collector) deltaStatsAt(prev StatsSnapshot, now time.Time) StatsDelta {
+	c.mu.Lock()
+	cur := c.snapshotLocked(now)
+	if prev.gen != cur.gen {
+		// stats were reset for a new experiment
+		prev = StatsSnapshot{At: prev.At, gen: cur.gen}
+	}
+	recent := c.samplesSinceLocked(prev.Received)
+	c.mu.Unlock()
+
+	d := StatsDelta{
+		Start:    prev,
+		End:      cur,
+		Elapsed:  cur.At.Sub(prev.At),
+		Attempts: cur.Attempts - prev.Attempts,
+		Sent:     cur.Sent - prev.Sent,
+		Skipped:  cur.Skipped - prev.Skipped,
+		Received: cur.Received - prev.Received,
+		Outcomes: make(map[ReplyStatus]int),
+	}
+	for st, v := range cur.outcomes {
+		if n := v - prev.outcomes[st]; n != 0 {
+			d.Outcomes[st] = n
+		}
+	}
+	if secs := d.Elapsed.Seconds(); secs > 0 {
+		d.Throughput = float64(d.Received) / secs
+	}
+	if d.Attempts > 0 {
+		d.SkipRate = float64(d.Skipped) / float64(d.Attempts)
+	}
+	if d.Received > 0 {
+		d.MeanRT = float64((cur.TotalRT - prev.TotalRT).Microseconds()) / 1000.0 / float64(d.Received)
+	}
+	d.P50 = percentileOf(recent, 50)
+	d.P90 = percentileOf(recent, 90)
+	d.P99 = percentileOf(recent, 99)
+	return d
+}
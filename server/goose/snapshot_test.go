@@ -0,0 +1,49 @@
+package goose
+
+import (
+	"testing"
+	"time"
+)
+
+// sendN records n sends with ClientIDs from first on.
+func sendN(first, n int) {
+	for i := first; i < first+n; i++ {
+		SendUpcall(Request{ClientID: i}, false)
+	}
+}
+
+// A delta counts only what happened after its snapshot, which stays as it was.
+func TestDeltaStats(t *testing.T) {
+	ResetStats()
+	SendUpcall(Request{ClientID: 100}, true)
+	sendN(0, 3)
+	ReceiveUpcall(Request{ClientID: 0})
+	prev := SnapshotStats()
+
+	sendN(3, 2)
+	ReceiveUpcall(Request{ClientID: 1})
+	ReceiveUpcall(Request{ClientID: 3})
+	DropUpcall(Request{ClientID: 2})
+	d := defaultCollector.deltaStatsAt(prev, prev.At.Add(2*time.Second))
+	if d.Attempts != 2 || d.Sent != 2 || d.Skipped != 0 || d.Received != 2 || d.Outcomes[StatusDropped] != 1 {
+		t.Errorf("delta %+v, want 2 sent, 2 received, and 1 dropped", d)
+	}
+	if d.Throughput != 1 || d.End.Outstanding != 1 {
+		t.Errorf("throughput %.2f/s with %d outstanding, want 1/s with 1", d.Throughput, d.End.Outstanding)
+	}
+	if prev.Received != 1 || prev.Outcome(StatusDropped) != 0 || prev.Skipped != 1 {
+		t.Errorf("snapshot changed to %+v", prev)
+	}
+}
+
+// After a reset, the interval starts at the reset.
+func TestDeltaStatsAcrossReset(t *testing.T) {
+	ResetStats()
+	sendN(0, 5)
+	prev := SnapshotStats()
+	ResetStats()
+	sendN(0, 2)
+	if d := DeltaStats(prev); d.Sent != 2 || d.Attempts != 2 {
+		t.Errorf("delta across a reset counts %d sent of %d attempts, want 2 of 2", d.Sent, d.Attempts)
+	}
+}
@@ -0,0 +1,146 @@
+package goose
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// -------------------- soak tests --------------------
+
+// A handler that leaks a goroutine or a few kilobytes per request looks fine in a
+// run of a few seconds and falls over after a night. RunSoak keeps one server up
+// and drives it in consecutive windows: each window is a Loadgen run of its own,
+// which starts with fresh stats, so memory stays bounded however long the soak
+// goes, and each ends with a summary of the window and of the process (heap and
+// goroutines) written as a CSV row. A trend in the last columns over many windows
+// is a leak.
+
+// SoakConfig configures RunSoak.
+type SoakConfig struct {
+	Window     time.Duration   // the length of a window; default one minute
+	Duration   time.Duration   // stop after this long; zero runs until Stop
+	Stop       <-chan struct{} // optional: closing it ends the soak after the current window
+	MaxSamples int             // response-time samples kept per window; default 10000 (see SetSampleLimit)
+}
+
+// SoakWindow summarizes one window of a soak.
+type SoakWindow struct {
+	Index       int
+	Result      // the window's results, without samples
+	P50         float64
+	HeapAllocKB uint64 // live heap at the end of the window, after a GC
+	HeapObjects uint64
+	Goroutines  int
+	NumGC       uint32 // GC cycles since the process started
+}
+
+// soakArrivals is the number of arrivals Loadgen needs to run for about d at a
+// mean inter-arrival time of iatMeanMs.
+func soakArrivals(d time.Duration, iatMeanMs float64) int {
+	return max(int(math.Ceil(float64(d)/float64(time.Millisecond)/iatMeanMs)), 1)
+}
+
+// RunSoak starts the server of e and drives it in windows until cfg.Duration has
+// passed or cfg.Stop is closed, writing a CSV header and then a row per window to
+// out and passing each window to each, if set. e.N is ignored: a window has as many
+// arrivals as its length takes at e.IatMean, so with many skips or timeouts it
+// runs somewhat longer. It returns the number of windows run.
+func RunSoak(e Experiment, cfg SoakConfig, out io.Writer, each func(SoakWindow)) (int, error) {
+	if len(e.Load.Trace) > 0 || e.Load.Record != nil {
+		return 0, fmt.Errorf("soak: traces cannot be replayed or recorded")
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = time.Minute
+	}
+	if cfg.MaxSamples <= 0 {
+		cfg.MaxSamples = 10000
+	}
+	stats := e.Load.stats()
+	if stats.SampleLimit() == 0 || stats.SampleLimit() > cfg.MaxSamples {
+		stats.SetSampleLimit(cfg.MaxSamples)
+	}
+	cw := csv.NewWriter(out)
+	if err := cw.Write(soakHeader); err != nil {
+		return 0, err
+	}
+	cw.Flush()
+
+	srv, reqCh, repCh := e.startServer()
+	defer stopServer(srv, reqCh, repCh, stats)
+	e.fixSeed()
+	seed := e.Load.Seed
+	n := soakArrivals(cfg.Window, e.IatMean)
+	began := time.Now()
+	for i := 0; ; i++ {
+		select {
+		case <-cfg.Stop:
+			return i, nil
+		default:
+		}
+		if cfg.Duration > 0 && time.Since(began) >= cfg.Duration {
+			return i, nil
+		}
+		we := e
+		we.N = n
+		we.Load.Seed = seed + int64(i) // a fresh workload each window, reproducible from the first
+		started := time.Now()
+		LoadgenWith(reqCh, repCh, n, we.IatMean, we.DemandMean, we.Load)
+		w := SoakWindow{Index: i, Result: collectResult(stats, we, started, time.Since(started))}
+		w.Result.Server = srv.Stats()
+		w.P50 = percentileOf(w.Samples, 50)
+		w.Samples = nil
+		var ms runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&ms)
+		w.HeapAllocKB, w.HeapObjects, w.NumGC = ms.HeapAlloc/1024, ms.HeapObjects, ms.NumGC
+		w.Goroutines = runtime.NumGoroutine()
+		if err := cw.Write(w.row()); err != nil {
+			return i, err
+		}
+		cw.Flush() // each row is on disk as soon as its window ends
+		if err := cw.Error(); err != nil {
+			return i, err
+		}
+		if each != nil {
+			each(w)
+		}
+	}
+}
+
+var soakHeader = []string{"window", "start", "end", "sent", "skipped", "received", "dropped", "rejected", "failed", "timed_out",
+	"throughput_per_sec", "mean_rt_ms", "p50_rt_ms", "p99_rt_ms", "heap_alloc_kb", "heap_objects", "goroutines", "num_gc"}
+
+// row returns the CSV row of w, in the order of soakHeader.
+func (w SoakWindow) row() []string {
+	return []string{
+		strconv.Itoa(w.Index),
+		w.Started.Format(time.RFC3339),
+		w.Started.Add(w.Elapsed).Format(time.RFC3339),
+		strconv.Itoa(w.Sent),
+		strconv.Itoa(w.Skipped),
+		strconv.Itoa(w.Received),
+		strconv.Itoa(w.Dropped),
+		strconv.Itoa(w.Rejected),
+		strconv.Itoa(w.Failed),
+		strconv.Itoa(w.TimedOut),
+		strconv.FormatFloat(w.Throughput, 'f', 2, 64),
+		strconv.FormatFloat(w.MeanRT, 'f', 3, 64),
+		strconv.FormatFloat(w.P50, 'f', 3, 64),
+		strconv.FormatFloat(w.P99, 'f', 3, 64),
+		strconv.FormatUint(w.HeapAllocKB, 10),
+		strconv.FormatUint(w.HeapObjects, 10),
+		strconv.Itoa(w.Goroutines),
+		strconv.FormatUint(uint64(w.NumGC), 10),
+	}
+}
+
+// PrintSoakWindow prints a one-line summary of w.
+func PrintSoakWindow(w SoakWindow) {
+	fmt.Printf("window %d %s: sent=%d skipped=%d tput=%.1f/s mean=%.3fms p99=%.3fms heap=%dKB goroutines=%d\n",
+		w.Index, w.Started.Format("15:04:05"), w.Sent, w.Skipped, w.Throughput, w.MeanRT, w.P99, w.HeapAllocKB, w.Goroutines)
+}
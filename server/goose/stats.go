@@ -3,110 +3,615 @@ package goose
 
 import (
 	"fmt"
+	"math"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 )
 
-// -------------------- package-global statistics --------------------
-
-var (
-	statsMu     sync.Mutex
-	sendTimes   map[int]time.Time // map[ClientID] -> send time for matching replies
-	samples     []time.Duration   // recorded response times (for histogram & quantiles)
-	attempts    int               // number of send attempts (including skipped)
-	sent        int               // number of successful sends
-	skipped     int               // attempts skipped because reqCh would block
-	received    int               // number of replies processed
-	initialized bool              // whether ResetStats has been called
-)
+// -------------------- statistics collectors --------------------
 
-// ResetStats initializes or clears the package statistics. Call before a new experiment.
-func ResetStats() {
-	statsMu.Lock()
-	defer statsMu.Unlock()
-	sendTimes = make(map[int]time.Time)
-	samples = make([]time.Duration, 0, 1024)
-	attempts = 0
-	sent = 0
-	skipped = 0
-	received = 0
-	initialized = true
+// A Collector holds the statistics of one run. Loadgen records each arrival, send,
+// and reply in it through the upcalls, and the server and the targets report to it
+// the requests they drop or abandon. The package functions (ResetStats, SendUpcall,
+// GetStats, and the rest) use a default Collector, as serveload does; Run gives
+// each run a Collector of its own, so that runs in one process can overlap. Every
+// package function that reads or records stats is also a method of Collector.
+type Collector struct {
+	mu           sync.Mutex
+	sendTimes    map[int]time.Time          // map[ClientID] -> send time for matching replies
+	samples      []time.Duration            // recorded response times (for histogram & quantiles); see SetSampleLimit
+	attempts     int                        // number of send attempts (including skipped)
+	sent         int                        // number of successful sends
+	skipped      int                        // attempts skipped because reqCh would block
+	received     int                        // number of replies processed with StatusOK
+	outcomes     map[ReplyStatus]int        // requests disposed of other than by a normal reply
+	timedOut     map[int]bool               // ClientIDs that Loadgen gave up on
+	lateDone     int                        // timed-out requests whose service completed anyway
+	hedged       map[int]bool               // ClientIDs with a duplicate whose reply is still to come
+	hedgeCount   int                        // duplicates sent by hedging
+	hedgeWins    int                        // requests answered first by their duplicate
+	wastedMs     int                        // demand served for the losing copies of hedged requests
+	faultSamples map[string][]time.Duration // response times of replies with each Fault tag
+	statusCodes  map[int]int                // replies per HTTP status code
+	intendedAt   map[int]time.Time          // ClientID -> when the request was due to be sent
+	corrected    []time.Duration            // response times measured from the intended send time
+	skippedAt    []time.Time                // intended times of skipped arrivals not yet attributed
+	stranded     map[int][]time.Time        // ClientID -> skipped arrivals waiting on its reply
+	synthesized  []time.Duration            // response times synthesized for skipped arrivals
+	tagStats     map[string]*tagStat        // statistics of tagged requests, per Tag
+	tenantStats  map[int]*tagStat           // statistics of the requests of each TenantID
+	genCount     int                        // arrivals whose generated values were recorded
+	genIats      []time.Duration            // actual times between successive arrivals
+	genDemands   []time.Duration            // generated demands (WorkDemand+WaitDemand)
+	genIatSum    time.Duration              // sum of all inter-arrival times, for an exact mean
+	genDemandSum time.Duration              // sum of all demands, for an exact mean
+	genSlips     []time.Duration            // how late each arrival was sent
+	genSlipSum   time.Duration              // sum of all slippage, for an exact mean
+	genSlipMax   time.Duration              // the latest any arrival was sent
+	objectCounts map[int]int                // requests sent per ObjectID
+	watchers     map[int]chan struct{}      // ClientID -> closed when the request is settled
+	currentSLO   SLO                        // set by SetSLO; kept across ResetStats
+	sloSatisfied int                        // OK replies within the SLO threshold
+	sloTolerated int                        // OK replies within four times the threshold
+	sloExceeded  int                        // OK replies slower than that
+	spans        []Span                     // captured requests, for ExportOTLP
+	spanLimit    int                        // set by SetSpanCapture; kept across ResetStats
+	chaosMarks   []chaosMark                // events played by StartChaos, kept across ResetStats
+	statsGen     int                        // incremented by ResetStats, to tell experiments apart
+
+	// settled is signalled whenever the last outstanding request is settled, so
+	// that Loadgen notices the end of a run however its last request ended.
+	settled chan struct{}
+
+	samplingState
+	seriesState
+	hdrState
+	heatmapState
+	orderState
+	duplicateState
+	validationState
+	watchdogState
+	batchState
+	resourceBase
 }
 
-// internal ensure initialization
-func ensureInitLocked() {
-	if !initialized {
-		sendTimes = make(map[int]time.Time)
-		samples = make([]time.Duration, 0, 1024)
-		initialized = true
+// defaultCollector is the Collector of the package functions.
+var defaultCollector = newCollector(nil)
+
+// NewCollector returns an empty Collector with the settings made so far through
+// the package functions (SetSampleLimit, SetSLO, SetLatencySeries, SetHeatmap,
+// SetHDRLog, SetReplyOrder, and SetSpanCapture), which its methods of the same
+// names change for it alone.
+func NewCollector() *Collector { return newCollector(defaultCollector) }
+
+// newCollector returns an empty Collector with the settings of d, if not nil.
+func newCollector(d *Collector) *Collector {
+	c := &Collector{settled: make(chan struct{}, 1)}
+	if d != nil {
+		d.mu.Lock()
+		c.sampleLimit, c.currentSLO, c.spanLimit = d.sampleLimit, d.currentSLO, d.spanLimit
+		c.seriesEvery, c.heatEvery, c.hdrEvery, c.orderOn = d.seriesEvery, d.heatEvery, d.hdrEvery, d.orderOn
+		d.mu.Unlock()
 	}
+	c.resetLocked()
+	return c
+}
+
+// ResetStats initializes or clears the package statistics. Call before a new experiment.
+func ResetStats() { defaultCollector.ResetStats() }
+
+// ResetStats clears c's statistics, keeping its settings.
+func (c *Collector) ResetStats() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.resetLocked()
+	c.statsGen++
+}
+
+func (c *Collector) resetLocked() {
+	c.sendTimes = make(map[int]time.Time)
+	c.samples = make([]time.Duration, 0, 1024)
+	c.attempts = 0
+	c.sent = 0
+	c.skipped = 0
+	c.received = 0
+	c.outcomes = make(map[ReplyStatus]int)
+	c.timedOut = make(map[int]bool)
+	c.lateDone = 0
+	c.hedged = make(map[int]bool)
+	c.hedgeCount = 0
+	c.hedgeWins = 0
+	c.wastedMs = 0
+	c.faultSamples = make(map[string][]time.Duration)
+	c.statusCodes = make(map[int]int)
+	c.intendedAt = make(map[int]time.Time)
+	c.corrected = nil
+	c.skippedAt = nil
+	c.stranded = make(map[int][]time.Time)
+	c.synthesized = nil
+	c.tagStats = make(map[string]*tagStat)
+	c.tenantStats = make(map[int]*tagStat)
+	c.objectCounts = make(map[int]int)
+	c.watchers = make(map[int]chan struct{})
+	c.sloSatisfied, c.sloTolerated, c.sloExceeded = 0, 0, 0
+	c.spans = nil
+	c.genCount = 0
+	c.genIats = nil
+	c.genDemands = nil
+	c.genIatSum = 0
+	c.genDemandSum = 0
+	c.genSlips = nil
+	c.genSlipSum = 0
+	c.genSlipMax = 0
+	c.resetSamplingLocked()
+	c.resetSeriesLocked()
+	c.resetResourcesLocked()
+	c.resetBatchStats()
+	c.resetValidationLocked()
+	c.resetHeatmapLocked()
+	c.resetHDRLocked()
+	c.resetOrderLocked()
+	c.resetDuplicatesLocked()
+	c.resetWatchdogLocked()
 }
 
 // SendUpcall records an attempted send. If skipped==true, the attempt failed and is counted as skipped.
 // If skipped==false, we record the send timestamp so a later ReceiveUpcall can compute response time.
-func SendUpcall(r Request, skippedFlag bool) {
-	statsMu.Lock()
-	defer statsMu.Unlock()
-	ensureInitLocked()
-	attempts++
+func SendUpcall(r Request, skippedFlag bool) { defaultCollector.SendUpcall(r, skippedFlag) }
+
+// SendUpcall is the package function SendUpcall, recording in c.
+func (c *Collector) SendUpcall(r Request, skippedFlag bool) {
+	c.SendUpcallAt(r, skippedFlag, time.Now())
+}
+
+// SendUpcallAt is SendUpcall for a request that was due to be sent at intended.
+// Measuring from the intended time corrects for coordinated omission: when the
+// generator falls behind or the server pushes back, the delay before the send
+// is part of what a real client would see. A skipped arrival is charged to the next
+// request that does get through, as if it had waited to be sent with it.
+func SendUpcallAt(r Request, skippedFlag bool, intended time.Time) {
+	defaultCollector.SendUpcallAt(r, skippedFlag, intended)
+}
+
+// SendUpcallAt is the package function SendUpcallAt, recording in c.
+func (c *Collector) SendUpcallAt(r Request, skippedFlag bool, intended time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.attempts++
 	if skippedFlag {
-		skipped++
+		c.skipped++
+		c.skippedAt = append(c.skippedAt, intended)
+		if r.Tag != "" {
+			c.tagLocked(r.Tag).skipped++
+		}
+		if t := c.tenantLocked(r); t != nil {
+			t.skipped++
+		}
 		return
 	}
 	// record send
-	sent++
-	sendTimes[r.ClientID] = time.Now()
+	c.sent++
+	c.objectCounts[r.ObjectID]++
+	if r.Tag != "" {
+		c.tagLocked(r.Tag).sent++
+	}
+	if t := c.tenantLocked(r); t != nil {
+		t.sent++
+	}
+	c.sendTimes[r.ClientID] = time.Now()
+	c.intendedAt[r.ClientID] = intended
+	c.rememberLocked(r)
+	c.watchSentLocked(r)
+	if len(c.skippedAt) > 0 {
+		c.stranded[r.ClientID] = c.skippedAt
+		c.skippedAt = nil
+	}
+}
+
+// settleLocked records that the request with the given ClientID is no longer outstanding.
+func (c *Collector) settleLocked(clientID int) {
+	delete(c.sendTimes, clientID)
+	c.completeLocked(clientID)
+	c.watchSettledLocked(clientID)
+	delete(c.validateReqs, clientID)
+	if w, ok := c.watchers[clientID]; ok {
+		close(w)
+		delete(c.watchers, clientID)
+	}
+	if len(c.sendTimes) == 0 {
+		select {
+		case c.settled <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// SendUpcallWatched is SendUpcall for a request about to be sent, returning a
+// channel that is closed once the request is settled: replied to, dropped, or
+// timed out.
+func SendUpcallWatched(r Request) <-chan struct{} { return defaultCollector.SendUpcallWatched(r) }
+
+// SendUpcallWatched is the package function SendUpcallWatched, recording in c.
+func (c *Collector) SendUpcallWatched(r Request) <-chan struct{} {
+	c.SendUpcall(r, false)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w := make(chan struct{})
+	if _, ok := c.sendTimes[r.ClientID]; ok {
+		c.watchers[r.ClientID] = w
+	} else {
+		close(w) // settled already
+	}
+	return w
+}
+
+// forgetLocked discards the omission-correction state of a request that will not
+// produce a sample.
+func (c *Collector) forgetLocked(clientID int) {
+	delete(c.intendedAt, clientID)
+	delete(c.stranded, clientID)
 }
 
 // ReceiveUpcall processes an arrived reply: it matches to a send time and records the response duration.
 // If no matching send exists (e.g., we skipped that request), the reply is ignored.
-func ReceiveUpcall(r Request) {
-	statsMu.Lock()
-	defer statsMu.Unlock()
-	ensureInitLocked()
-	start, ok := sendTimes[r.ClientID]
+// Replies with a status other than StatusOK are counted by status and not sampled.
+func ReceiveUpcall(r Request) { defaultCollector.ReceiveUpcall(r) }
+
+// ReceiveUpcall is the package function ReceiveUpcall, recording in c.
+func (c *Collector) ReceiveUpcall(r Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.receiveLocked(r)
+}
+
+// receiveStaleUpcall is ReceiveUpcall for a reply that may outlive its experiment:
+// it is recorded only if the stats have not been reset since generation gen, as
+// ClientIDs start again from 0 after a reset and it would match another request.
+func (c *Collector) receiveStaleUpcall(r Request, gen int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.statsGen == gen {
+		c.receiveLocked(r)
+	}
+}
+
+// currentStatsGen returns the generation of the stats, which ResetStats advances.
+func (c *Collector) currentStatsGen() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.statsGen
+}
+
+func (c *Collector) receiveLocked(r Request) {
+	start, ok := c.sendTimes[r.ClientID]
 	if !ok {
-		// reply for unknown clientID -> ignore
+		// reply for unknown clientID -> ignore, but note late replies to timed-out requests
+		// and the losing copies of hedged ones
+		if c.timedOut[r.ClientID] {
+			c.countLateLocked(r)
+		} else if c.hedged[r.ClientID] {
+			c.countWastedLocked(r)
+		} else if c.duplicateLocked(r) {
+			c.unmatchedLocked(r, fmt.Errorf("duplicate reply to client %d", r.ClientID))
+		} else {
+			c.unmatchedLocked(r, fmt.Errorf("reply to client %d matches no outstanding request", r.ClientID))
+		}
 		return
 	}
-	rt := time.Since(start)
-	samples = append(samples, rt)
-	received++
-	delete(sendTimes, r.ClientID)
+	c.validateLocked(r)
+	c.recordOrderLocked(r)
+	if c.hedged[r.ClientID] && r.Hedge {
+		c.hedgeWins++
+	}
+	if r.Code != 0 {
+		c.statusCodes[r.Code]++
+	}
+	if r.Fault != "" {
+		c.faultCounts[r.Fault]++
+		c.faultSamples[r.Fault] = c.reservoirAdd(c.faultSamples[r.Fault], c.faultCounts[r.Fault], time.Since(start))
+	}
+	if r.Status != StatusOK {
+		c.outcomes[r.Status]++
+		c.countTagLocked(r, r.Status)
+		c.recordSpanLocked(r, r.Status)
+		c.settleLocked(r.ClientID)
+		c.forgetLocked(r.ClientID)
+		return
+	}
+	now := time.Now()
+	rt := now.Sub(start)
+	c.received++
+	c.recordSampleLocked(rt)
+	c.recordSLOLocked(rt)
+	c.recordSeriesLocked(start, rt)
+	c.recordHeatmapLocked(start, rt)
+	c.recordHDRLocked(start, rt)
+	c.recordSpanLocked(r, StatusOK)
+	if r.Tag != "" {
+		t := c.tagLocked(r.Tag)
+		t.received++
+		t.sum += rt
+		t.samples = c.reservoirAdd(t.samples, t.received, rt)
+	}
+	if t := c.tenantLocked(r); t != nil {
+		t.received++
+		t.sum += rt
+		t.samples = c.reservoirAdd(t.samples, t.received, rt)
+	}
+	c.settleLocked(r.ClientID)
+	if at, ok := c.intendedAt[r.ClientID]; ok {
+		c.correctedSeen++
+		c.corrected = c.reservoirAdd(c.corrected, c.correctedSeen, now.Sub(at))
+	}
+	for _, at := range c.stranded[r.ClientID] {
+		c.synthSeen++
+		c.synthesized = c.reservoirAdd(c.synthesized, c.synthSeen, now.Sub(at))
+	}
+	c.forgetLocked(r.ClientID)
+}
+
+// countTagLocked counts a sent request with a tag or tenant that ended with status st.
+func (c *Collector) countTagLocked(r Request, st ReplyStatus) {
+	if r.Tag != "" {
+		c.tagLocked(r.Tag).outcomes[st]++
+	}
+	if t := c.tenantLocked(r); t != nil {
+		t.outcomes[st]++
+	}
+}
+
+// DropUpcall records that the server discarded a sent request without replying,
+// so that Loadgen stops waiting for it.
+func DropUpcall(r Request) { defaultCollector.DropUpcall(r) }
+
+// DropUpcall is the package function DropUpcall, recording in c.
+func (c *Collector) DropUpcall(r Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.sendTimes[r.ClientID]; !ok {
+		return
+	}
+	c.outcomes[StatusDropped]++
+	c.countTagLocked(r, StatusDropped)
+	c.recordSpanLocked(r, StatusDropped)
+	c.settleLocked(r.ClientID)
+	c.forgetLocked(r.ClientID)
+}
+
+// TimeoutUpcall records that Loadgen gave up waiting for r. It reports whether r
+// was still outstanding (false if its reply already arrived).
+func TimeoutUpcall(r Request) bool { return defaultCollector.TimeoutUpcall(r) }
+
+// TimeoutUpcall is the package function TimeoutUpcall, recording in c.
+func (c *Collector) TimeoutUpcall(r Request) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.sendTimes[r.ClientID]; !ok {
+		return false
+	}
+	c.outcomes[StatusTimedOut]++
+	c.countTagLocked(r, StatusTimedOut)
+	c.recordSpanLocked(r, StatusTimedOut)
+	c.timedOut[r.ClientID] = true
+	c.settleLocked(r.ClientID)
+	c.forgetLocked(r.ClientID)
+	return true
+}
+
+// CancelledUpcall records how the server finished a request that the client had
+// already given up on: abandoned part way (StatusCancelled) or completed anyway.
+func CancelledUpcall(r Request) { defaultCollector.CancelledUpcall(r) }
+
+// CancelledUpcall is the package function CancelledUpcall, recording in c.
+func (c *Collector) CancelledUpcall(r Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.timedOut[r.ClientID] && c.hedged[r.ClientID] {
+		// the other copy of a hedged request has already been counted
+		delete(c.hedged, r.ClientID)
+		return
+	}
+	c.countLateLocked(r)
+}
+
+// HedgeUpcall records that Loadgen sent r as a duplicate of an unanswered request.
+func HedgeUpcall(r Request) { defaultCollector.HedgeUpcall(r) }
+
+// HedgeUpcall is the package function HedgeUpcall, recording in c.
+func (c *Collector) HedgeUpcall(r Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hedged[r.ClientID] = true
+	c.hedgeCount++
+}
+
+// countWastedLocked records the reply to the losing copy of a hedged request.
+func (c *Collector) countWastedLocked(r Request) {
+	delete(c.hedged, r.ClientID)
+	if r.Status == StatusOK {
+		c.wastedMs += r.WorkDemand + r.WaitDemand + r.ReplyCost
+	}
+}
+
+// isOutstanding reports whether a request with the given ClientID was sent
+// and is still awaiting its reply.
+func (c *Collector) isOutstanding(clientID int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.sendTimes[clientID]
+	return ok
+}
+
+func (c *Collector) countLateLocked(r Request) {
+	delete(c.timedOut, r.ClientID)
+	if r.Status == StatusCancelled {
+		c.outcomes[StatusCancelled]++
+	} else {
+		c.lateDone++
+	}
+}
+
+// GetCancelStats returns the number of requests Loadgen timed out, and of those,
+// how many the server abandoned part way and how many it completed anyway.
+func GetCancelStats() (timedOutOut, abandoned, completedLate int) {
+	return defaultCollector.GetCancelStats()
+}
+
+// GetCancelStats is the package function GetCancelStats for c.
+func (c *Collector) GetCancelStats() (timedOutOut, abandoned, completedLate int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.outcomes[StatusTimedOut], c.outcomes[StatusCancelled], c.lateDone
+}
+
+// GetHedgeStats returns the number of duplicates Loadgen sent by hedging, how many
+// of them answered before the original, and the demand in milliseconds the server
+// spent on losing copies whose replies arrived.
+func GetHedgeStats() (hedges, wins, wastedMsOut int) { return defaultCollector.GetHedgeStats() }
+
+// GetHedgeStats is the package function GetHedgeStats for c.
+func (c *Collector) GetHedgeStats() (hedges, wins, wastedMsOut int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hedgeCount, c.hedgeWins, c.wastedMs
+}
+
+// CorrectedStats summarizes response times measured from the intended send times.
+type CorrectedStats struct {
+	N           int     // samples, including synthesized ones if requested
+	Synthesized int     // samples synthesized for skipped arrivals
+	MeanRT      float64 // milliseconds
+	P50         float64 // milliseconds
+	P99         float64 // milliseconds
+}
+
+// GetCorrectedStats returns the response times corrected for coordinated omission
+// (see SendUpcallAt). With synthesize, skipped arrivals are included too, each with
+// the time from its intended send to the reply of the next request that got through.
+func GetCorrectedStats(synthesize bool) CorrectedStats {
+	return defaultCollector.GetCorrectedStats(synthesize)
+}
+
+// GetCorrectedStats is the package function GetCorrectedStats for c.
+func (c *Collector) GetCorrectedStats(synthesize bool) CorrectedStats {
+	c.mu.Lock()
+	samps := append([]time.Duration(nil), c.corrected...)
+	if synthesize {
+		samps = append(samps, c.synthesized...)
+	}
+	n, nSynth := c.correctedSeen, c.synthSeen
+	c.mu.Unlock()
+
+	cs := CorrectedStats{N: n}
+	if synthesize {
+		cs.N += nSynth
+		cs.Synthesized = nSynth
+	}
+	if len(samps) == 0 {
+		return cs
+	}
+	var sum time.Duration
+	for _, d := range samps {
+		sum += d
+	}
+	cs.MeanRT = float64(sum.Microseconds()) / 1000.0 / float64(len(samps))
+	cs.P50 = percentileOf(samps, 50)
+	cs.P99 = percentileOf(samps, 99)
+	return cs
+}
+
+// GetStatusCodes returns the number of replies received per HTTP status code.
+func GetStatusCodes() map[int]int { return defaultCollector.GetStatusCodes() }
+
+// GetStatusCodes is the package function GetStatusCodes for c.
+func (c *Collector) GetStatusCodes() map[int]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make(map[int]int, len(c.statusCodes))
+	for code, n := range c.statusCodes {
+		out[code] = n
+	}
+	return out
+}
+
+// GetOutcomes returns the number of sent requests that ended with each status other
+// than StatusOK (rejected replies, server-side drops, ...).
+func GetOutcomes() map[ReplyStatus]int { return defaultCollector.GetOutcomes() }
+
+// GetOutcomes is the package function GetOutcomes for c.
+func (c *Collector) GetOutcomes() map[ReplyStatus]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make(map[ReplyStatus]int, len(c.outcomes))
+	for st, n := range c.outcomes {
+		out[st] = n
+	}
+	return out
 }
 
 // GetStats returns summary counters and mean response time in milliseconds.
 func GetStats() (attemptsOut, sentOut, skippedOut, receivedOut int, meanRTms float64) {
-	statsMu.Lock()
-	defer statsMu.Unlock()
-	ensureInitLocked()
-	attemptsOut = attempts
-	sentOut = sent
-	skippedOut = skipped
-	receivedOut = received
-	if len(samples) == 0 {
+	return defaultCollector.GetStats()
+}
+
+// GetStats is the package function GetStats for c.
+func (c *Collector) GetStats() (attemptsOut, sentOut, skippedOut, receivedOut int, meanRTms float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	attemptsOut = c.attempts
+	sentOut = c.sent
+	skippedOut = c.skipped
+	receivedOut = c.received
+	if c.received == 0 {
 		meanRTms = 0
 	} else {
-		var sum time.Duration
-		for _, d := range samples {
-			sum += d
-		}
-		meanRTms = float64(sum.Milliseconds()) / float64(len(samples))
+		meanRTms = float64(c.sampleSum.Milliseconds()) / float64(c.received)
 	}
 	return
 }
 
 // GetSamples returns a copy of recorded response-time samples (durations).
-func GetSamples() []time.Duration {
-	statsMu.Lock()
-	defer statsMu.Unlock()
-	ensureInitLocked()
-	out := make([]time.Duration, len(samples))
-	copy(out, samples)
+// With a sample limit (see SetSampleLimit) these are a uniform sample of them.
+func GetSamples() []time.Duration { return defaultCollector.GetSamples() }
+
+// GetSamples is the package function GetSamples for c.
+func (c *Collector) GetSamples() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]time.Duration, len(c.samples))
+	copy(out, c.samples)
 	return out
 }
 
+// Percentile returns the p-th percentile (0..100) of recorded response times in milliseconds,
+// using the nearest-rank method. It returns 0 if there are no samples.
+func Percentile(p float64) float64 {
+	samps := GetSamples()
+	return percentileOf(samps, p)
+}
+
+// percentileOf computes the nearest-rank p-th percentile of samps in milliseconds.
+// It sorts samps in place.
+func percentileOf(samps []time.Duration, p float64) float64 {
+	if len(samps) == 0 {
+		return 0
+	}
+	sort.Slice(samps, func(i, j int) bool { return samps[i] < samps[j] })
+	if p <= 0 {
+		return float64(samps[0].Microseconds()) / 1000.0
+	}
+	rank := int(math.Ceil(p / 100.0 * float64(len(samps))))
+	if rank > len(samps) {
+		rank = len(samps)
+	}
+	if rank < 1 {
+		rank = 1
+	}
+	return float64(samps[rank-1].Microseconds()) / 1000.0
+}
+
 // -------------------- histogram helpers --------------------
 
 // HistogramLinear computes counts for linear bins over [0, maxMs).
@@ -117,11 +622,14 @@ func HistogramLinear(bins int, maxMs float64) (counts []int, labels []string) {
 	if bins <= 0 {
 		bins = 10
 	}
-	statsMu.Lock()
-	samps := make([]time.Duration, len(samples))
-	copy(samps, samples)
-	statsMu.Unlock()
+	return histogramOf(GetSamples(), bins, maxMs)
+}
 
+// histogramOf is HistogramLinear over the given samples.
+func histogramOf(samps []time.Duration, bins int, maxMs float64) (counts []int, labels []string) {
+	if bins <= 0 {
+		bins = 10
+	}
 	counts = make([]int, bins+1)
 	labels = make([]string, bins+1)
 	// prepare labels
@@ -184,3 +692,53 @@ func PrintHistogramASCII(counts []int, labels []string, width int) {
 	}
 	fmt.Printf("total: %d\n", total)
 }
+
+// PrintCDFASCII prints the cumulative distribution of the recorded response times as
+// an ASCII chart: points rows at evenly spaced percentiles from p0 (the minimum) to
+// p100 (the maximum), each with a bar as long as the response time at that percentile.
+func PrintCDFASCII(points int) {
+	printCDF(points, false)
+}
+
+// PrintCDFASCIILog is PrintCDFASCII with the percentiles spaced evenly on a log
+// scale of the tail fraction (p0, p90, p99, p99.9, ... in the limit), so that the
+// tail gets as many rows as the body.
+func PrintCDFASCIILog(points int) {
+	printCDF(points, true)
+}
+
+func printCDF(points int, logScale bool) {
+	if points < 2 {
+		points = 2
+	}
+	samps := GetSamples()
+	if len(samps) == 0 {
+		fmt.Println("No samples to plot")
+		return
+	}
+	sort.Slice(samps, func(i, j int) bool { return samps[i] < samps[j] })
+	// rows: percentile levels, from 0 to 100
+	levels := make([]float64, points)
+	for i := range levels {
+		frac := float64(i) / float64(points-1)
+		if logScale {
+			// tail fraction from 1 down to 1/n, evenly in log scale
+			levels[i] = 100 * (1 - math.Pow(float64(len(samps)), -frac))
+		} else {
+			levels[i] = 100 * frac
+		}
+	}
+	levels[points-1] = 100
+
+	const width = 60
+	maxMs := float64(samps[len(samps)-1].Microseconds()) / 1000.0
+	for _, p := range levels {
+		ms := percentileOf(samps, p)
+		barLen := 0
+		if maxMs > 0 {
+			barLen = int(float64(width) * ms / maxMs)
+		}
+		fmt.Printf("%12s |%s %.3fms\n", fmt.Sprintf("p%.4g", p), strings.Repeat("█", barLen), ms)
+	}
+	fmt.Printf("total: %d\n", len(samps))
+}
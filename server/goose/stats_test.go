@@ -0,0 +1,31 @@
+package goose
+
+import (
+	"testing"
+	"time"
+)
+
+// A request sent late is measured from when it was due, and an arrival skipped
+// before it is charged with the wait until that request's reply.
+func TestCorrectedResponseTimes(t *testing.T) {
+	ResetStats()
+	now := time.Now()
+	SendUpcallAt(Request{ClientID: 0}, true, now.Add(-80*time.Millisecond))
+	SendUpcallAt(Request{ClientID: 1}, false, now.Add(-50*time.Millisecond))
+	SendUpcallAt(Request{ClientID: 2}, false, time.Now())
+	ReceiveUpcall(Request{ClientID: 1})
+	ReceiveUpcall(Request{ClientID: 2})
+
+	_, _, skipped, received, meanRT := GetStats()
+	if skipped != 1 || received != 2 || meanRT >= 50 {
+		t.Fatalf("skipped %d, received %d, raw mean %.1fms; want 1, 2, and well under 50ms", skipped, received, meanRT)
+	}
+	cs := GetCorrectedStats(false)
+	if cs.N != 2 || cs.Synthesized != 0 || cs.P99 < 50 {
+		t.Errorf("corrected %+v, want 2 samples with the late one at 50ms or more", cs)
+	}
+	cs = GetCorrectedStats(true)
+	if cs.N != 3 || cs.Synthesized != 1 || cs.P99 < 80 {
+		t.Errorf("with synthesized %+v, want 3 samples, one synthesized at 80ms or more", cs)
+	}
+}
@@ -0,0 +1,308 @@
+package goose
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// -------------------- experiments and parameter sweeps --------------------
+
+// Experiment describes one load experiment: n requests with exponential inter-arrival
+// times and wait demands around the given means (milliseconds), against a server
+// that admits at most MaxConcurrent requests at a time (semaphore mode) or runs
+// MaxConcurrent workers (pool mode).
+type Experiment struct {
+	N             int
+	IatMean       float64
+	DemandMean    float64
+	MaxConcurrent int
+	Handler       Handler     // server application; nil means DemandHandler
+	Mode          ServerMode  // how the server uses goroutines; "" means ModeSemaphore
+	Queue         QueueConfig // if enabled, semaphore mode uses QueuedHandler
+	Load          LoadOptions // extra Loadgen options
+	Limiter       *Limiter    // if set, semaphore mode uses it instead of MaxConcurrent
+	Runtime       bool        // capture Go runtime metrics during the run (see RuntimeStats)
+	ShedExpired   bool        // discard requests whose deadline passed before service
+	NetDelay      NetDelay    // simulated network delay of the replies
+
+	// Procs, if positive, is GOMAXPROCS for the run, and CPUWorkers, if positive,
+	// the size of the pool of CPU workers that burns the requests' CPU work (see
+	// SetCPUWorkers). Both are put back as they were when the run ends.
+	Procs      int
+	CPUWorkers int
+
+	// Chaos, if set, is played from the start of the run (see StartChaos).
+	Chaos *Chaos
+
+	// Remote is how RunRemoteExperiment connects to the server it drives.
+	Remote RemoteConfig
+}
+
+// Result holds the summary statistics of one finished experiment.
+type Result struct {
+	Experiment
+	Attempts   int
+	Sent       int
+	Skipped    int
+	Received   int
+	Rejected   int // replies with StatusRejected
+	Failed     int // replies with StatusFailed
+	Dropped    int // sent requests the server discarded
+	TimedOut   int // sent requests Loadgen gave up on
+	Abandoned  int // timed-out requests whose service the server cut short
+	Hedges     int // duplicates sent by Loadgen's hedging
+	HedgeWins  int // hedged requests answered first by the duplicate
+	WastedMs   int // demand served for the losing copies of hedged requests
+	Elapsed    time.Duration
+	Started    time.Time       // when Loadgen started
+	Throughput float64         // replies per second
+	MeanRT     float64         // milliseconds
+	P99        float64         // milliseconds
+	Server     ServerStats     // the server's own counters at shutdown
+	Samples    []time.Duration // response-time samples, as from GetSamples
+	SLO        SLOStats        // against the SLO set by SetSLO, if any
+	Runtime    RuntimeStats    // if Experiment.Runtime is set
+	Disk       DiskStats       // the simulated disk's counters
+	Validation ValidationStats // if Load.Validate is set
+	Duplicates int             // replies to requests already settled, ignored
+	CPU        CPUStats        // the CPUs the run had
+}
+
+// RunExperiment starts a server in the experiment's mode, drives it with Loadgen,
+// shuts the server down, and returns the summary.
+// The package stats are reset at the start of the run and left in place afterwards,
+// so the caller may still inspect samples or build a histogram.
+func RunExperiment(e Experiment) Result {
+	defer e.applyCPU()()
+	stats := e.Load.stats()
+	srv, reqCh, repCh := e.startServer()
+
+	e.fixSeed()
+	capture := e.startRuntimeCapture()
+	stopChaos := e.Chaos.start(stats)
+	startup := time.Now()
+	LoadgenWith(reqCh, repCh, e.N, e.IatMean, e.DemandMean, e.Load)
+	elapsed := time.Since(startup)
+	stopChaos()
+	rt := capture.Stop()
+	stopServer(srv, reqCh, repCh, stats)
+
+	res := collectResult(stats, e, startup, elapsed)
+	res.Server = srv.Stats()
+	res.Runtime = rt
+	return res
+}
+
+// startServer starts the in-process server the experiment describes, with the
+// channels Loadgen reaches it on.
+func (e *Experiment) startServer() (srv *Server, reqCh, repCh chan Request) {
+	reqCh = make(chan Request, 16)
+	repCh = make(chan Request, 16)
+
+	cfg := ServerConfig{
+		Mode:          e.Mode,
+		MaxConcurrent: e.MaxConcurrent,
+		Limiter:       e.Limiter,
+		Queue:         e.Queue,
+		Handler:       e.Handler,
+		ShedExpired:   e.ShedExpired,
+		NetDelay:      e.NetDelay,
+		NetDelaySeed:  e.Load.Seed,
+		Collector:     e.Load.Collector,
+	}
+	if e.Load.Backpressure.Threshold > 0 && e.Load.Backpressure.Signal == nil {
+		signal := make(chan Pressure, 1)
+		cfg.Pressure = signal
+		e.Load.Backpressure.Signal = signal
+	}
+	return StartServer(reqCh, repCh, cfg), reqCh, repCh
+}
+
+// stopServer shuts down a server started by startServer once Loadgen is done,
+// recording any late replies in stats.
+func stopServer(srv *Server, reqCh, repCh chan Request, stats *Collector) {
+	// Every reply has arrived, so this only waits for the server's goroutines,
+	// except that losing copies of hedged requests may still answer.
+	late := make(chan struct{})
+	go func() {
+		defer close(late)
+		for rep := range repCh {
+			stats.ReceiveUpcall(rep)
+		}
+	}()
+	srv.Shutdown(context.Background())
+	<-late
+	close(reqCh)
+}
+
+// Target is a system under test other than an in-process server: Loadgen sends it
+// requests on Requests() and reads replies from Replies(), as it would with a server
+// started by RunExperiment. RemoteClient and HTTPTarget are Targets; a client for
+// another protocol (such as a gRPC service) only needs to translate requests and
+// replies to fit in.
+type Target interface {
+	Requests() chan<- Request
+	Replies() chan Request
+	Close() error
+}
+
+// collectorRef is the Collector a target reports the requests it drops or
+// abandons to: the package's, unless RunTargetExperiment gives it the run's.
+type collectorRef struct {
+	p atomic.Pointer[Collector]
+}
+
+func (r *collectorRef) useCollector(c *Collector) { r.p.Store(c) }
+
+func (r *collectorRef) stats() *Collector {
+	if c := r.p.Load(); c != nil {
+		return c
+	}
+	return defaultCollector
+}
+
+// RunTargetExperiment drives t with Loadgen as described by e (whose server fields
+// are ignored), closes t, and returns the summary.
+func RunTargetExperiment(t Target, e Experiment) Result {
+	stats := e.Load.stats()
+	if u, ok := t.(interface{ useCollector(*Collector) }); ok {
+		u.useCollector(stats)
+	}
+	e.fixSeed()
+	capture := e.startRuntimeCapture()
+	startup := time.Now()
+	LoadgenWith(t.Requests(), t.Replies(), e.N, e.IatMean, e.DemandMean, e.Load)
+	elapsed := time.Since(startup)
+	rt := capture.Stop()
+	t.Close()
+	res := collectResult(stats, e, startup, elapsed)
+	res.Runtime = rt
+	return res
+}
+
+// startRuntimeCapture starts a RuntimeCapture if the experiment asks for one;
+// otherwise it returns nil, whose Stop returns zero stats.
+func (e Experiment) startRuntimeCapture() *RuntimeCapture {
+	if !e.Runtime {
+		return nil
+	}
+	return StartRuntimeCapture(0)
+}
+
+// fixSeed chooses a seed for the run if none was set, so that the Result records
+// the seed that reproduces its workload.
+func (e *Experiment) fixSeed() {
+	if e.Load.Seed == 0 {
+		e.Load.Seed = time.Now().UnixNano()
+	}
+}
+
+// collectResult reads the stats of a finished run into a Result.
+func collectResult(stats *Collector, e Experiment, started time.Time, elapsed time.Duration) Result {
+	res := Result{Experiment: e, Started: started, Elapsed: elapsed}
+	res.Attempts, res.Sent, res.Skipped, res.Received, res.MeanRT = stats.GetStats()
+	outcomes := stats.GetOutcomes()
+	res.Rejected = outcomes[StatusRejected]
+	res.Failed = outcomes[StatusFailed]
+	res.Dropped = outcomes[StatusDropped]
+	res.TimedOut = outcomes[StatusTimedOut]
+	res.Abandoned = outcomes[StatusCancelled]
+	res.Hedges, res.HedgeWins, res.WastedMs = stats.GetHedgeStats()
+	if s := elapsed.Seconds(); s > 0 {
+		res.Throughput = float64(res.Received) / s
+	}
+	res.Samples = stats.GetSamples()
+	res.SLO = stats.GetSLOStats()
+	res.Disk = stats.GetDiskStats()
+	res.Validation = stats.GetValidationStats()
+	res.Duplicates = stats.GetDuplicates()
+	res.CPU = stats.GetCPUStats()
+	res.P99 = percentileOf(append([]time.Duration(nil), res.Samples...), 99)
+	return res
+}
+
+// Sweep runs one experiment for every combination of the given inter-arrival means,
+// demand means, and concurrency limits, and returns the results in order. The other
+// parameters (N, Mode, ...) are taken from base.
+// Stats are reset between experiments.
+func Sweep(base Experiment, iatMeans, demandMeans []float64, maxConcurrents []int) []Result {
+	results := make([]Result, 0, len(iatMeans)*len(demandMeans)*len(maxConcurrents))
+	for _, iat := range iatMeans {
+		for _, demand := range demandMeans {
+			for _, mc := range maxConcurrents {
+				if stopped(base.Load.Stop) {
+					return results
+				}
+				e := base
+				e.IatMean, e.DemandMean, e.MaxConcurrent = iat, demand, mc
+				results = append(results, RunExperiment(e))
+			}
+		}
+	}
+	return results
+}
+
+// PrintResultsTable prints one line per result in a fixed-width table.
+func PrintResultsTable(results []Result) {
+	fmt.Printf("%-10s %8s %8s %6s %6s %8s %6s %6s %10s %10s %10s %6s %6s\n",
+		"mode", "iat(ms)", "dem(ms)", "conc", "sent", "skipped", "drop", "rej", "tput/s", "mean(ms)", "p99(ms)", "util", "load")
+	for _, r := range results {
+		c := EstimateCapacity(r)
+		fmt.Printf("%-10s %8.2f %8.2f %6d %6d %8d %6d %6d %10.1f %10.3f %10.3f %6.2f %6.2f\n",
+			r.modeName(), r.IatMean, r.DemandMean, r.MaxConcurrent, r.Sent, r.Skipped, r.Dropped, r.Rejected,
+			r.Throughput, r.MeanRT, r.P99, c.Utilization, c.Load)
+	}
+}
+
+// WriteResultsCSV writes the results as CSV with a header row.
+func WriteResultsCSV(w io.Writer, results []Result) error {
+	cw := csv.NewWriter(w)
+	header := []string{"mode", "iat_mean_ms", "demand_mean_ms", "max_concurrent", "n",
+		"sent", "skipped", "received", "dropped", "rejected", "throughput_per_sec", "mean_rt_ms", "p99_rt_ms",
+		"seed", "start", "end", "utilization", "capacity_per_sec", "load"}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, r := range results {
+		c := EstimateCapacity(r)
+		row := []string{
+			r.modeName(),
+			strconv.FormatFloat(r.IatMean, 'f', -1, 64),
+			strconv.FormatFloat(r.DemandMean, 'f', -1, 64),
+			strconv.Itoa(r.MaxConcurrent),
+			strconv.Itoa(r.N),
+			strconv.Itoa(r.Sent),
+			strconv.Itoa(r.Skipped),
+			strconv.Itoa(r.Received),
+			strconv.Itoa(r.Dropped),
+			strconv.Itoa(r.Rejected),
+			strconv.FormatFloat(r.Throughput, 'f', 2, 64),
+			strconv.FormatFloat(r.MeanRT, 'f', 3, 64),
+			strconv.FormatFloat(r.P99, 'f', 3, 64),
+			strconv.FormatInt(r.Load.Seed, 10),
+			r.Started.Format(time.RFC3339Nano),
+			r.Started.Add(r.Elapsed).Format(time.RFC3339Nano),
+			strconv.FormatFloat(c.Utilization, 'f', 3, 64),
+			strconv.FormatFloat(c.PerSec(), 'f', 1, 64),
+			strconv.FormatFloat(c.Load, 'f', 3, 64),
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// modeName returns the server mode, with the default spelled out.
+func (e Experiment) modeName() string {
+	if e.Mode == "" {
+		return string(ModeSemaphore)
+	}
+	return string(e.Mode)
+}
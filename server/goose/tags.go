@@ -0,0 +1,273 @@
+package goose
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// -------------------- workload classes and per-tag statistics --------------------
+
+// Class is one kind of request in a mixed workload. Loadgen picks the class of each
+// arrival at random in proportion to the weights and sets the request's Tag to the
+// class's; the package stats then keep separate counters and response times per tag.
+type Class struct {
+	Tag          string
+	Weight       float64 // relative frequency; default 1
+	DemandMeanMs float64 // mean demand in milliseconds; 0 means Loadgen's waitMeanMs
+	CPU          bool    // whether the demand is CPU work (WorkDemand) rather than sleep
+	IO           bool    // whether the demand is a disk read (IODemand), its mean in kilobytes
+
+	Dist     DemandDist // distribution of the demand; "" means DemandExp
+	Sigma    float64    // DemandLognormal shape (standard deviation of the log); default 1
+	Priority int        // the requests' Priority, for DisciplinePriority
+}
+
+// DemandDist selects the distribution of a class's demands.
+type DemandDist string
+
+const (
+	DemandExp       DemandDist = "exp"       // exponential (the default)
+	DemandConst     DemandDist = "const"     // always the mean
+	DemandLognormal DemandDist = "lognormal" // lognormal with the same mean: a heavier tail
+)
+
+// pickClass returns the class whose share of the total weight contains x in [0, 1).
+func pickClass(classes []Class, x float64) *Class {
+	total := 0.0
+	for i := range classes {
+		total += classWeight(&classes[i])
+	}
+	x *= total
+	for i := range classes {
+		if x -= classWeight(&classes[i]); x < 0 {
+			return &classes[i]
+		}
+	}
+	return &classes[len(classes)-1]
+}
+
+func classWeight(c *Class) float64 {
+	if c.Weight <= 0 {
+		return 1
+	}
+	return c.Weight
+}
+
+// findClass returns the class with the given tag, or nil.
+func findClass(classes []Class, tag string) *Class {
+	if tag == "" {
+		return nil
+	}
+	for i := range classes {
+		if classes[i].Tag == tag {
+			return &classes[i]
+		}
+	}
+	return nil
+}
+
+// draw gives r a fresh demand of class c, drawn from rng.
+func (c *Class) draw(r *Request, waitMeanMs float64, rng *rand.Rand) {
+	mean := c.DemandMeanMs
+	if mean <= 0 {
+		mean = waitMeanMs
+	}
+	var d int
+	switch c.Dist {
+	case DemandConst:
+		d = int(mean)
+	case DemandLognormal:
+		sigma := c.Sigma
+		if sigma <= 0 {
+			sigma = 1
+		}
+		// choose mu so that the mean is mean
+		mu := math.Log(mean) - sigma*sigma/2
+		d = int(math.Exp(mu + sigma*rng.NormFloat64()))
+	default:
+		d = int(rng.ExpFloat64() * mean)
+	}
+	r.WorkDemand, r.WaitDemand, r.IODemand = 0, 0, 0
+	switch {
+	case c.CPU:
+		r.WorkDemand = d
+	case c.IO:
+		r.IODemand = d
+	default:
+		r.WaitDemand = d
+	}
+}
+
+// ParseClasses parses a workload mix such as "cpu:1:5:cpu,io:3:20", a comma-separated
+// list of tag:weight[:demandMs[:kind]][:option...], where kind is sleep (the default),
+// cpu, or io, and the demand of an io class is in kilobytes. The options are
+// dist=exp|const|lognormal, sigma=S (for lognormal), and prio=P.
+func ParseClasses(spec string) ([]Class, error) {
+	var out []Class
+	for _, f := range strings.Split(spec, ",") {
+		var parts, options []string
+		for _, p := range strings.Split(strings.TrimSpace(f), ":") {
+			if strings.Contains(p, "=") {
+				options = append(options, p)
+			} else if len(options) > 0 {
+				return nil, fmt.Errorf("bad class %q: options go last", f)
+			} else {
+				parts = append(parts, p)
+			}
+		}
+		if len(parts) < 2 || len(parts) > 4 || parts[0] == "" {
+			return nil, fmt.Errorf("bad class %q: want tag:weight[:demandMs[:kind]][:option...]", f)
+		}
+		c := Class{Tag: parts[0]}
+		var err error
+		if c.Weight, err = strconv.ParseFloat(parts[1], 64); err != nil || c.Weight <= 0 {
+			return nil, fmt.Errorf("class %s: bad weight %q", c.Tag, parts[1])
+		}
+		if len(parts) > 2 {
+			if c.DemandMeanMs, err = strconv.ParseFloat(parts[2], 64); err != nil || c.DemandMeanMs < 0 {
+				return nil, fmt.Errorf("class %s: bad demand %q", c.Tag, parts[2])
+			}
+		}
+		if len(parts) > 3 {
+			if parts[3] != "cpu" && parts[3] != "sleep" && parts[3] != "io" {
+				return nil, fmt.Errorf("class %s: demand kind %q is not cpu, sleep, or io", c.Tag, parts[3])
+			}
+			c.CPU, c.IO = parts[3] == "cpu", parts[3] == "io"
+		}
+		for _, o := range options {
+			if err := c.setOption(o); err != nil {
+				return nil, fmt.Errorf("class %s: %v", c.Tag, err)
+			}
+		}
+		if c.Sigma > 0 && c.Dist != DemandLognormal {
+			return nil, fmt.Errorf("class %s: only lognormal demands take a sigma", c.Tag)
+		}
+		if findClass(out, c.Tag) != nil {
+			return nil, fmt.Errorf("class %s: duplicate tag", c.Tag)
+		}
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+// setOption sets the option o, given as name=value, of a class being parsed.
+func (c *Class) setOption(o string) error {
+	name, val, _ := strings.Cut(o, "=")
+	var err error
+	switch name {
+	case "dist":
+		c.Dist = DemandDist(val)
+		if c.Dist != DemandExp && c.Dist != DemandConst && c.Dist != DemandLognormal {
+			return fmt.Errorf("unknown demand distribution %q: want exp, const, or lognormal", val)
+		}
+	case "sigma":
+		if c.Sigma, err = strconv.ParseFloat(val, 64); err != nil || c.Sigma <= 0 {
+			return fmt.Errorf("bad sigma %q", val)
+		}
+	case "prio":
+		if c.Priority, err = strconv.Atoi(val); err != nil {
+			return fmt.Errorf("bad priority %q", val)
+		}
+	default:
+		return fmt.Errorf("unknown option %q: want dist, sigma, or prio", name)
+	}
+	return nil
+}
+
+// tagStat holds the statistics of the requests with one tag.
+type tagStat struct {
+	sent     int
+	skipped  int
+	received int
+	outcomes map[ReplyStatus]int
+	sum      time.Duration
+	samples  []time.Duration // subject to the sample limit, like samples
+}
+
+// tagLocked returns the statistics for tag, creating them if needed.
+func (c *Collector) tagLocked(tag string) *tagStat {
+	t := c.tagStats[tag]
+	if t == nil {
+		t = &tagStat{outcomes: make(map[ReplyStatus]int)}
+		c.tagStats[tag] = t
+	}
+	return t
+}
+
+// TagStats summarizes the requests with one tag.
+type TagStats struct {
+	Tag      string
+	Sent     int
+	Skipped  int
+	Received int                 // replies with StatusOK
+	Outcomes map[ReplyStatus]int // sent requests that ended otherwise
+	MeanRT   float64             // milliseconds
+	P50      float64             // milliseconds
+	P99      float64             // milliseconds
+}
+
+// GetTagStats returns the statistics of tagged requests since the last ResetStats,
+// one entry per tag, sorted by tag. Untagged requests are not included.
+func GetTagStats() []TagStats { return defaultCollector.GetTagStats() }
+
+// GetTagStats is the package function GetTagStats for c.
+func (c *Collector) GetTagStats() []TagStats {
+	c.mu.Lock()
+	var out []TagStats
+	var samps [][]time.Duration
+	for tag, t := range c.tagStats {
+		ts := TagStats{Tag: tag, Sent: t.sent, Skipped: t.skipped, Received: t.received,
+			Outcomes: make(map[ReplyStatus]int, len(t.outcomes))}
+		for st, c := range t.outcomes {
+			ts.Outcomes[st] = c
+		}
+		if t.received > 0 {
+			ts.MeanRT = float64(t.sum.Microseconds()) / 1000.0 / float64(t.received)
+		}
+		out = append(out, ts)
+		samps = append(samps, append([]time.Duration(nil), t.samples...))
+	}
+	c.mu.Unlock()
+
+	for i := range out {
+		out[i].P50 = percentileOf(samps[i], 50)
+		out[i].P99 = percentileOf(samps[i], 99)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Tag < out[j].Tag })
+	return out
+}
+
+// GetTagSamples returns a copy of the response-time samples of the requests with tag.
+func GetTagSamples(tag string) []time.Duration { return defaultCollector.GetTagSamples(tag) }
+
+// GetTagSamples is the package function GetTagSamples for c.
+func (c *Collector) GetTagSamples(tag string) []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t := c.tagStats[tag]; t != nil {
+		return append([]time.Duration(nil), t.samples...)
+	}
+	return nil
+}
+
+// PrintTagStats prints one line per tag seen, followed by its response-time
+// histogram if bins > 0 (bins linear bins up to maxMs, as in HistogramLinear).
+func PrintTagStats(bins int, maxMs float64) {
+	for _, t := range GetTagStats() {
+		failed := 0
+		for _, c := range t.Outcomes {
+			failed += c
+		}
+		fmt.Printf("tag=%s sent=%d skipped=%d received=%d other=%d meanRT=%.3fms p50=%.3fms p99=%.3fms\n",
+			t.Tag, t.Sent, t.Skipped, t.Received, failed, t.MeanRT, t.P50, t.P99)
+		if bins > 0 {
+			counts, labels := histogramOf(GetTagSamples(t.Tag), bins, maxMs)
+			PrintHistogramASCII(counts, labels, 60)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package goose
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// -------------------- tenants and fair queuing --------------------
+
+// A shared server is fair if one tenant's flood of requests cannot starve the
+// others. Loadgen gives each tenant its own Poisson arrival process, by splitting
+// the arrivals at random in proportion to the tenants' shares (a random split of a
+// Poisson process is a set of independent ones), and marks each request with its
+// TenantID. DisciplineFair serves the admission queue by deficit round robin over
+// the tenants: each gets a turn in which it may spend its weight times fairQuantumMs
+// of demand, so over time the service is split by weight, whatever the arrival
+// rates. The package stats keep each tenant's counts and response times.
+
+// Tenant is one tenant of a multi-tenant workload.
+type Tenant struct {
+	Name   string
+	Share  float64 // the tenant's part of the arrival rate, relative to the others'
+	Weight float64 // its part of the service under DisciplineFair; default 1
+}
+
+// ParseTenants parses tenants such as "a:3,b:1:w=2", a comma-separated list of
+// name:share[:w=weight]. The tenants get TenantIDs 1, 2, ... in the order given.
+func ParseTenants(spec string) ([]Tenant, error) {
+	var out []Tenant
+	for _, f := range strings.Split(spec, ",") {
+		parts := strings.Split(strings.TrimSpace(f), ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" {
+			return nil, fmt.Errorf("bad tenant %q: want name:share[:w=weight]", f)
+		}
+		t := Tenant{Name: parts[0], Weight: 1}
+		var err error
+		if t.Share, err = strconv.ParseFloat(parts[1], 64); err != nil || t.Share <= 0 {
+			return nil, fmt.Errorf("tenant %s: bad share %q", t.Name, parts[1])
+		}
+		if len(parts) == 3 {
+			w, ok := strings.CutPrefix(parts[2], "w=")
+			if t.Weight, err = strconv.ParseFloat(w, 64); !ok || err != nil || t.Weight <= 0 {
+				return nil, fmt.Errorf("tenant %s: bad weight %q: want w=weight", t.Name, parts[2])
+			}
+		}
+		for _, o := range out {
+			if o.Name == t.Name {
+				return nil, fmt.Errorf("tenant %s: duplicate name", t.Name)
+			}
+		}
+		out = append(out, t)
+	}
+	return out, nil
+}
+
+// TenantWeights returns the weights of tenants, indexed by TenantID-1, for
+// QueueConfig.Weights.
+func TenantWeights(tenants []Tenant) []float64 {
+	w := make([]float64, len(tenants))
+	for i, t := range tenants {
+		w[i] = t.Weight
+	}
+	return w
+}
+
+// pickTenant returns the TenantID whose share of the total contains x in [0, 1).
+func pickTenant(tenants []Tenant, x float64) int {
+	total := 0.0
+	for _, t := range tenants {
+		total += t.Share
+	}
+	x *= total
+	for i, t := range tenants {
+		if x -= t.Share; x < 0 {
+			return i + 1
+		}
+	}
+	return len(tenants)
+}
+
+// fairQuantumMs is the demand a tenant of weight 1 may be served per round.
+const fairQuantumMs = 10
+
+// fairQueue is a bounded queue served by deficit round robin over TenantIDs.
+// Requests cost their demand, as in DisciplineSJF, and at least 1ms.
+type fairQueue struct {
+	capacity int
+	n        int
+	weights  []float64
+	tenants  map[int]*fairTenant
+	active   []int // tenants with requests queued, in round-robin order
+}
+
+// fairTenant is one tenant's queue and deficit.
+type fairTenant struct {
+	reqs    []Request
+	deficit float64
+}
+
+func newFairQueue(capacity int, weights []float64) *fairQueue {
+	return &fairQueue{capacity: capacity, weights: weights, tenants: make(map[int]*fairTenant)}
+}
+
+func (q *fairQueue) len() int   { return q.n }
+func (q *fairQueue) full() bool { return q.n >= q.capacity }
+
+func (q *fairQueue) push(r Request) {
+	t := q.tenants[r.TenantID]
+	if t == nil {
+		t = &fairTenant{}
+		q.tenants[r.TenantID] = t
+	}
+	if len(t.reqs) == 0 {
+		q.active = append(q.active, r.TenantID)
+	}
+	t.reqs = append(t.reqs, r)
+	q.n++
+}
+
+// weight returns the weight of tenant id; tenants without one weigh 1.
+func (q *fairQueue) weight(id int) float64 {
+	if id >= 1 && id <= len(q.weights) && q.weights[id-1] > 0 {
+		return q.weights[id-1]
+	}
+	return 1
+}
+
+func fairCost(r Request) float64 {
+	return float64(max(r.WorkDemand+r.WaitDemand+r.ReplyCost, 1))
+}
+
+func (q *fairQueue) pop() Request {
+	for {
+		id := q.active[0]
+		t := q.tenants[id]
+		if cost := fairCost(t.reqs[0]); t.deficit >= cost {
+			t.deficit -= cost
+			return q.take(id, 0)
+		}
+		// the head does not fit in what is left of the turn: the turn passes
+		t.deficit += q.weight(id) * fairQuantumMs
+		q.active = append(q.active[1:], id)
+	}
+}
+
+// popOldest removes the oldest request of the tenant with the most queued, so
+// that making room costs the tenant that is taking it.
+func (q *fairQueue) popOldest() Request {
+	hog := q.active[0]
+	for _, id := range q.active {
+		if len(q.tenants[id].reqs) > len(q.tenants[hog].reqs) {
+			hog = id
+		}
+	}
+	return q.take(hog, 0)
+}
+
+// take removes and returns the i'th request queued for tenant id.
+func (q *fairQueue) take(id, i int) Request {
+	t := q.tenants[id]
+	r := t.reqs[i]
+	t.reqs = append(t.reqs[:i], t.reqs[i+1:]...)
+	q.n--
+	if len(t.reqs) == 0 {
+		t.deficit = 0 // an idle tenant does not save up turns
+		for j, a := range q.active {
+			if a == id {
+				q.active = append(q.active[:j], q.active[j+1:]...)
+				break
+			}
+		}
+	}
+	return r
+}
+
+// tenantLocked returns the statistics for the tenant of r, creating them if
+// needed, or nil if r has no tenant.
+func (c *Collector) tenantLocked(r Request) *tagStat {
+	if r.TenantID == 0 {
+		return nil
+	}
+	t := c.tenantStats[r.TenantID]
+	if t == nil {
+		t = &tagStat{outcomes: make(map[ReplyStatus]int)}
+		c.tenantStats[r.TenantID] = t
+	}
+	return t
+}
+
+// TenantStats summarizes the requests of one tenant.
+type TenantStats struct {
+	TenantID   int
+	Name       string // from the tenants given to GetTenantStats, if any
+	Sent       int
+	Skipped    int
+	Received   int                 // replies with StatusOK
+	Outcomes   map[ReplyStatus]int // sent requests that ended otherwise
+	Throughput float64             // replies with StatusOK per second
+	MeanRT     float64             // milliseconds
+	P50        float64             // milliseconds
+	P99        float64             // milliseconds
+}
+
+// GetTenantStats returns the statistics of each tenant since the last ResetStats,
+// sorted by TenantID, with throughputs over elapsed. tenants, if given, name them.
+func GetTenantStats(tenants []Tenant, elapsed time.Duration) []TenantStats {
+	return defaultCollector.GetTenantStats(tenants, elapsed)
+}
+
+// GetTenantStats is the package function GetTenantStats for c.
+func (c *Collector) GetTenantStats(tenants []Tenant, elapsed time.Duration) []TenantStats {
+	c.mu.Lock()
+	var out []TenantStats
+	var samps [][]time.Duration
+	for id, t := range c.tenantStats {
+		ts := TenantStats{TenantID: id, Name: strconv.Itoa(id), Sent: t.sent, Skipped: t.skipped,
+			Received: t.received, Outcomes: make(map[ReplyStatus]int, len(t.outcomes))}
+		if id >= 1 && id <= len(tenants) {
+			ts.Name = tenants[id-1].Name
+		}
+		for st, c := range t.outcomes {
+			ts.Outcomes[st] = c
+		}
+		if t.received > 0 {
+			ts.MeanRT = durationMs(t.sum) / float64(t.received)
+		}
+		if s := elapsed.Seconds(); s > 0 {
+			ts.Throughput = float64(t.received) / s
+		}
+		out = append(out, ts)
+		samps = append(samps, append([]time.Duration(nil), t.samples...))
+	}
+	c.mu.Unlock()
+
+	for i := range out {
+		out[i].P50 = percentileOf(samps[i], 50)
+		out[i].P99 = percentileOf(samps[i], 99)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].TenantID < out[j].TenantID })
+	return out
+}
+
+// JainIndex returns Jain's fairness index of the tenants' throughputs, each as a
+// fraction of its max-min fair share: the capacity they got in all, split by
+// weight, except that a tenant offering less than its part is owed only what it
+// offered and the rest goes to the others. It is 1 when every tenant got its
+// fair share, down to 1/n when one tenant got everything.
+func JainIndex(stats []TenantStats, tenants []Tenant, elapsed time.Duration) float64 {
+	secs := elapsed.Seconds()
+	if len(stats) == 0 || secs <= 0 {
+		return 0
+	}
+	weight := func(s TenantStats) float64 {
+		if s.TenantID >= 1 && s.TenantID <= len(tenants) {
+			return tenants[s.TenantID-1].Weight
+		}
+		return 1
+	}
+	capacity := 0.0
+	for _, s := range stats {
+		capacity += s.Throughput
+	}
+	// water-filling: hand out the capacity by weight, settling first the tenants
+	// that offered less than that
+	fair := make([]float64, len(stats))
+	open := make([]bool, len(stats))
+	for i := range open {
+		open[i] = true
+	}
+	for settled := true; settled; {
+		settled = false
+		weights := 0.0
+		for i, s := range stats {
+			if open[i] {
+				weights += weight(s)
+			}
+		}
+		if weights == 0 {
+			break
+		}
+		level := capacity / weights
+		for i, s := range stats {
+			if offered := float64(s.Sent) / secs; open[i] && offered <= level*weight(s) {
+				fair[i], open[i], settled = offered, false, true
+				capacity -= offered
+			}
+		}
+		if !settled {
+			for i, s := range stats {
+				if open[i] {
+					fair[i] = level * weight(s)
+				}
+			}
+		}
+	}
+	sum, sumSq := 0.0, 0.0
+	for i, s := range stats {
+		x := 1.0
+		if fair[i] > 0 {
+			x = s.Throughput / fair[i]
+		}
+		sum += x
+		sumSq += x * x
+	}
+	if sumSq == 0 {
+		return 0
+	}
+	return sum * sum / (float64(len(stats)) * sumSq)
+}
+
+// PrintTenantStats prints one line per tenant of res and Jain's fairness index.
+func PrintTenantStats(res Result) {
+	stats := GetTenantStats(res.Load.Tenants, res.Elapsed)
+	if len(stats) == 0 {
+		return
+	}
+	for _, t := range stats {
+		other := 0
+		for _, c := range t.Outcomes {
+			other += c
+		}
+		fmt.Printf("tenant=%s sent=%d skipped=%d received=%d other=%d throughput=%.1f/sec meanRT=%.3fms p50=%.3fms p99=%.3fms\n",
+			t.Name, t.Sent, t.Skipped, t.Received, other, t.Throughput, t.MeanRT, t.P50, t.P99)
+	}
+	fmt.Printf("tenants: jain=%.3f (throughput against the max-min fair share; 1 is fair)\n", JainIndex(stats, res.Load.Tenants, res.Elapsed))
+}
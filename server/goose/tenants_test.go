@@ -0,0 +1,72 @@
+package goose
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParseTenants(t *testing.T) {
+	got, err := ParseTenants("a:3, b:1:w=2")
+	want := []Tenant{{"a", 3, 1}, {"b", 1, 2}}
+	if err != nil || len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("ParseTenants = %+v, %v; want %+v", got, err, want)
+	}
+	for _, spec := range []string{"a", "a:0", "a:1:2", "a:1:w=0", "a:1,a:2", ":1"} {
+		if _, err := ParseTenants(spec); err == nil {
+			t.Errorf("ParseTenants(%q) succeeded, want an error", spec)
+		}
+	}
+}
+
+func TestPickTenant(t *testing.T) {
+	tenants := []Tenant{{Name: "a", Share: 3}, {Name: "b", Share: 1}}
+	for _, tc := range []struct {
+		x    float64
+		want int
+	}{{0, 1}, {0.74, 1}, {0.75, 2}, {0.999, 2}} {
+		if got := pickTenant(tenants, tc.x); got != tc.want {
+			t.Errorf("pickTenant(%g) = %d, want %d", tc.x, got, tc.want)
+		}
+	}
+}
+
+func TestJainIndex(t *testing.T) {
+	tenants := []Tenant{{Name: "a", Weight: 1}, {Name: "b", Weight: 1}}
+	near := func(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+	for _, tc := range []struct {
+		name  string
+		stats []TenantStats
+		want  float64
+	}{
+		// both offer more than half and get half: fair
+		{"even", []TenantStats{{TenantID: 1, Sent: 100, Throughput: 50}, {TenantID: 2, Sent: 100, Throughput: 50}}, 1},
+		// b offers only 10 and gets it; a gets the other 90: fair
+		{"light tenant", []TenantStats{{TenantID: 1, Sent: 200, Throughput: 90}, {TenantID: 2, Sent: 10, Throughput: 10}}, 1},
+		// a takes everything
+		{"starved", []TenantStats{{TenantID: 1, Sent: 200, Throughput: 100}, {TenantID: 2, Sent: 200, Throughput: 0}}, 0.5},
+	} {
+		if got := JainIndex(tc.stats, tenants, time.Second); !near(got, tc.want) {
+			t.Errorf("%s: Jain index %g, want %g", tc.name, got, tc.want)
+		}
+	}
+}
+
+// GetTenantStats keeps each tenant's counts apart and names them.
+func TestTenantStats(t *testing.T) {
+	ResetStats()
+	SendUpcall(Request{ClientID: 1, TenantID: 1}, false)
+	SendUpcall(Request{ClientID: 2, TenantID: 2}, false)
+	SendUpcall(Request{ClientID: 3, TenantID: 2}, true)
+	ReceiveUpcall(Request{ClientID: 1, TenantID: 1})
+	stats := GetTenantStats([]Tenant{{Name: "a"}, {Name: "b"}}, time.Second)
+	if len(stats) != 2 {
+		t.Fatalf("%d tenants, want 2", len(stats))
+	}
+	if a := stats[0]; a.Name != "a" || a.Sent != 1 || a.Received != 1 || a.Throughput != 1 {
+		t.Errorf("tenant a: %+v, want 1 sent and received", a)
+	}
+	if b := stats[1]; b.Name != "b" || b.Sent != 1 || b.Skipped != 1 || b.Received != 0 {
+		t.Errorf("tenant b: %+v, want 1 sent, 1 skipped, none received", b)
+	}
+}
@@ -0,0 +1,111 @@
+package goose
+
+import (
+	"container/heap"
+	"time"
+)
+
+// -------------------- think-time scheduling --------------------
+
+// With thousands of closed-loop clients, a timer per client per think time means
+// thousands of runtime timers started and stopped every second, and the clients'
+// wake-ups drift as the timer heap churns. The think scheduler keeps the pending
+// wake-ups in one min-heap ordered by due time, served by a single timer armed for
+// the earliest: when it fires, every client that is due is woken at once.
+
+// wakeup is a client waiting in the think scheduler until at.
+type wakeup struct {
+	at time.Time
+	ch chan struct{} // the client's wake channel, buffered with room for one
+}
+
+// wakeHeap implements heap.Interface over wake-ups, earliest first.
+type wakeHeap []wakeup
+
+func (h wakeHeap) Len() int           { return len(h) }
+func (h wakeHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+func (h wakeHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *wakeHeap) Push(x any)        { *h = append(*h, x.(wakeup)) }
+func (h *wakeHeap) Pop() any {
+	w := (*h)[len(*h)-1]
+	*h = (*h)[:len(*h)-1]
+	return w
+}
+
+// thinkScheduler wakes sleeping clients from one goroutine and one timer.
+type thinkScheduler struct {
+	add  chan wakeup
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newThinkScheduler starts a scheduler for up to clients sleeping clients.
+func newThinkScheduler(clients int) *thinkScheduler {
+	s := &thinkScheduler{
+		add:  make(chan wakeup, clients),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *thinkScheduler) run() {
+	defer close(s.done)
+	var pending wakeHeap
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		var fired <-chan time.Time
+		if len(pending) > 0 {
+			timer.Reset(time.Until(pending[0].at))
+			fired = timer.C
+		}
+		select {
+		case w := <-s.add:
+			heap.Push(&pending, w)
+		case now := <-fired:
+			for len(pending) > 0 && !pending[0].at.After(now) {
+				w := heap.Pop(&pending).(wakeup)
+				select {
+				case w.ch <- struct{}{}:
+				default: // the client gave up waiting, and the channel still holds a wake-up
+				}
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// sleep blocks for d, or until stop is closed, and reports whether d elapsed. ch is
+// the calling client's wake channel, which must have a buffer of one; a client
+// always passes the same one.
+func (s *thinkScheduler) sleep(ch chan struct{}, d time.Duration, stop <-chan struct{}) bool {
+	if d <= 0 {
+		select {
+		case <-stop:
+			return false
+		default:
+			return true
+		}
+	}
+	select {
+	case <-ch: // left over from a sleep that stop cut short
+	default:
+	}
+	s.add <- wakeup{at: time.Now().Add(d), ch: ch}
+	select {
+	case <-ch:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// close stops the scheduler; clients must not sleep after it is called.
+func (s *thinkScheduler) close() {
+	close(s.stop)
+	<-s.done
+}
@@ -0,0 +1,63 @@
+package goose
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// Clients wake in order of their due times, none before it.
+func TestThinkSchedulerWakesInOrder(t *testing.T) {
+	s := newThinkScheduler(4)
+	defer s.close()
+	var mu sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	for i, d := range []time.Duration{30, 10, 20, 0} {
+		wg.Add(1)
+		go func(i int, d time.Duration) {
+			defer wg.Done()
+			ch := make(chan struct{}, 1)
+			start := time.Now()
+			if !s.sleep(ch, d, nil) {
+				t.Errorf("client %d: sleep cut short", i)
+			}
+			if slept := time.Since(start); slept < d {
+				t.Errorf("client %d: woke after %v, want at least %v", i, slept, d)
+			}
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+		}(i, d*time.Millisecond)
+	}
+	wg.Wait()
+	if !equalIDs(order, []int{3, 1, 2, 0}) {
+		t.Errorf("wake order %v, want [3 1 2 0]", order)
+	}
+}
+
+// Closing stop ends a sleep early, and its late wake-up does not end the next one.
+func TestThinkSchedulerStop(t *testing.T) {
+	s := newThinkScheduler(1)
+	defer s.close()
+	ch := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		close(stop)
+	}()
+	if s.sleep(ch, 20*time.Millisecond, stop) {
+		t.Error("sleep elapsed, want it cut short by stop")
+	}
+	time.Sleep(30 * time.Millisecond) // the stale wake-up arrives
+	start := time.Now()
+	if !s.sleep(ch, 10*time.Millisecond, nil) {
+		t.Error("sleep cut short")
+	}
+	if slept := time.Since(start); slept < 10*time.Millisecond {
+		t.Errorf("woke after %v, want the stale wake-up ignored", slept)
+	}
+	if s.sleep(ch, 0, stop) {
+		t.Error("zero sleep with stop closed reported elapsed")
+	}
+}
@@ -0,0 +1,69 @@
+package goose
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// -------------------- TLS --------------------
+
+// The network transport runs over TLS when the server has a certificate: set
+// ServerConfig.TLS to ServerTLS(...), and dial with a client configuration from
+// ClientTLS. Given a CA, the server also requires each client to present a
+// certificate it signed (mutual TLS), which authenticates the client.
+
+// ServerTLS returns the TLS configuration of a server with the certificate and
+// key in the PEM files certFile and keyFile. If clientCA is not empty, clients
+// must present a certificate signed by a CA in that PEM file.
+func ServerTLS(certFile, keyFile, clientCA string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if clientCA != "" {
+		pool, err := loadCAPool(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// ClientTLS returns the TLS configuration of a client: it trusts the CAs in the
+// PEM file ca, or the system's if ca is empty, and presents the certificate and
+// key in certFile and keyFile, if given, to a server that asks for one.
+func ClientTLS(ca, certFile, keyFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if ca != "" {
+		pool, err := loadCAPool(ca)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+func loadCAPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no PEM certificates", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,72 @@
+package goose
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// selfSigned returns a certificate for 127.0.0.1 that is its own CA.
+func selfSigned(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "goose test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+// RunRemoteExperiment connects over TLS with the experiment's configuration, and
+// a client that does not trust the server's certificate gets nowhere.
+func TestRemoteExperimentTLS(t *testing.T) {
+	cert, pool := selfSigned(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go ServeListener(ln, ServerConfig{MaxConcurrent: 4, TLS: &tls.Config{Certificates: []tls.Certificate{cert}}})
+
+	const n = 20
+	e := Experiment{N: n, IatMean: 1, DemandMean: 1, Remote: RemoteConfig{TLS: &tls.Config{RootCAs: pool}}}
+	res, err := RunRemoteExperiment(ln.Addr().String(), e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Received != n {
+		t.Fatalf("received %d of %d", res.Received, n)
+	}
+
+	e.Remote.TLS = &tls.Config{RootCAs: x509.NewCertPool()}
+	if _, err := RunRemoteExperiment(ln.Addr().String(), e); err == nil {
+		t.Fatal("connected to a server with an untrusted certificate")
+	}
+}
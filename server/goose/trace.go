@@ -0,0 +1,169 @@
+package goose
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -------------------- trace replay --------------------
+
+// TraceEntry is one arrival of a load trace.
+type TraceEntry struct {
+	OffsetMs float64 // arrival time, in milliseconds from the start of the trace
+	WorkMs   int     // WorkDemand
+	WaitMs   int     // WaitDemand
+	ObjectID int
+	Skipped  bool // in a recorded trace: Loadgen could not send this arrival
+}
+
+// ReadTrace reads a trace in CSV form, one arrival per line as
+// offset_ms,work_ms,wait_ms,objectID[,skipped], in order of offset. A header line
+// is allowed. The skipped column, written by WriteTrace, is 1 for arrivals that
+// were skipped when the trace was recorded; replay sends them all the same.
+func ReadTrace(r io.Reader) ([]TraceEntry, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	var out []TraceEntry
+	for line := 1; ; line++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if line == 1 && len(rec) > 0 && strings.HasPrefix(rec[0], "offset") {
+			continue // header
+		}
+		if len(rec) < 4 {
+			return nil, fmt.Errorf("trace line %d: want offset_ms,work_ms,wait_ms,objectID", line)
+		}
+		var e TraceEntry
+		if e.OffsetMs, err = strconv.ParseFloat(rec[0], 64); err != nil || e.OffsetMs < 0 {
+			return nil, fmt.Errorf("trace line %d: bad offset %q", line, rec[0])
+		}
+		if e.WorkMs, err = strconv.Atoi(rec[1]); err != nil || e.WorkMs < 0 {
+			return nil, fmt.Errorf("trace line %d: bad work %q", line, rec[1])
+		}
+		if e.WaitMs, err = strconv.Atoi(rec[2]); err != nil || e.WaitMs < 0 {
+			return nil, fmt.Errorf("trace line %d: bad wait %q", line, rec[2])
+		}
+		if e.ObjectID, err = strconv.Atoi(rec[3]); err != nil {
+			return nil, fmt.Errorf("trace line %d: bad objectID %q", line, rec[3])
+		}
+		if len(rec) > 4 {
+			switch rec[4] {
+			case "0", "":
+			case "1":
+				e.Skipped = true
+			default:
+				return nil, fmt.Errorf("trace line %d: bad skipped flag %q", line, rec[4])
+			}
+		}
+		if len(out) > 0 && e.OffsetMs < out[len(out)-1].OffsetMs {
+			return nil, fmt.Errorf("trace line %d: offset %g is before the previous one", line, e.OffsetMs)
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+// LoadTrace reads the trace in the named file; see ReadTrace.
+func LoadTrace(path string) ([]TraceEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadTrace(f)
+}
+
+// WriteTrace writes trace in the CSV form ReadTrace reads, with a header line.
+func WriteTrace(w io.Writer, trace []TraceEntry) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"offset_ms", "work_ms", "wait_ms", "objectID", "skipped"}); err != nil {
+		return err
+	}
+	for _, e := range trace {
+		skipped := "0"
+		if e.Skipped {
+			skipped = "1"
+		}
+		row := []string{
+			strconv.FormatFloat(e.OffsetMs, 'f', 3, 64),
+			strconv.Itoa(e.WorkMs),
+			strconv.Itoa(e.WaitMs),
+			strconv.Itoa(e.ObjectID),
+			skipped,
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// SaveTrace writes trace to the named file; see WriteTrace.
+func SaveTrace(path string, trace []TraceEntry) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := WriteTrace(f, trace); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// TraceRecorder collects the arrivals of a Loadgen run (see LoadOptions.Record), so
+// that the run can be saved and replayed against other server configurations.
+type TraceRecorder struct {
+	mu      sync.Mutex
+	entries []TraceEntry
+}
+
+// Entries returns the arrivals recorded in the most recent run, in order.
+func (tr *TraceRecorder) Entries() []TraceEntry {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return append([]TraceEntry(nil), tr.entries...)
+}
+
+func (tr *TraceRecorder) reset() {
+	tr.mu.Lock()
+	tr.entries = nil
+	tr.mu.Unlock()
+}
+
+func (tr *TraceRecorder) add(e TraceEntry) {
+	tr.mu.Lock()
+	tr.entries = append(tr.entries, e)
+	tr.mu.Unlock()
+}
+
+// traceArrivals returns a generator of the inter-arrival times of trace, each
+// divided by speed (so speed 2 replays the trace twice as fast).
+func traceArrivals(trace []TraceEntry, speed float64) func() time.Duration {
+	if speed <= 0 {
+		speed = 1
+	}
+	i, prev := 0, 0.0
+	return func() time.Duration {
+		if i >= len(trace) {
+			return 0
+		}
+		gap := trace[i].OffsetMs - prev
+		prev = trace[i].OffsetMs
+		i++
+		return time.Duration(gap / speed * float64(time.Millisecond))
+	}
+}
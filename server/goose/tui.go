@@ -0,0 +1,209 @@
+package goose
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// -------------------- interactive terminal UI --------------------
+
+// RateDial scales the arrival rate of a running Loadgen (LoadOptions.RateDial):
+// at 2 requests arrive twice as often as configured, at 0.5 half as often.
+type RateDial struct {
+	bits atomic.Uint64
+}
+
+// NewRateDial returns a RateDial set to 1, the configured rate.
+func NewRateDial() *RateDial {
+	d := &RateDial{}
+	d.Set(1)
+	return d
+}
+
+// Set changes the scale; it must be positive.
+func (d *RateDial) Set(scale float64) {
+	d.bits.Store(math.Float64bits(scale))
+}
+
+// Scale returns the current scale; a nil RateDial is always 1.
+func (d *RateDial) Scale() float64 {
+	if d == nil {
+		return 1
+	}
+	return math.Float64frombits(d.bits.Load())
+}
+
+// TUIConfig configures StartTUI.
+type TUIConfig struct {
+	In       io.Reader // keystrokes, one byte each: put the terminal in raw mode (see RawTerminal)
+	Out      io.Writer // an ANSI terminal
+	Interval time.Duration
+	BaseRate float64   // arrivals per second at scale 1, for display
+	Dial     *RateDial // adjusted with + and -; nil to disable
+	Limiter  *Limiter  // adjusted with [ and ]; nil to disable
+}
+
+// tuiHistory is the number of intervals the charts show.
+const tuiHistory = 60
+
+// StartTUI takes over the terminal for the run: every interval it redraws the
+// run's counters and charts of throughput, p99 response time, and requests in
+// flight over the last tuiHistory intervals, and it reads keystrokes to steer the
+// run: + and - raise and lower the arrival rate by a quarter, ] and [ raise and
+// lower the concurrency limit by one, and q puts the terminal back. The returned
+// stop function does the same. Reading cfg.In continues until it ends.
+func StartTUI(cfg TUIConfig) (stop func()) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 250 * time.Millisecond
+	}
+	keys := make(chan byte, 16)
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if n, err := cfg.In.Read(buf); err != nil {
+				return
+			} else if n == 1 {
+				keys <- buf[0]
+			}
+		}
+	}()
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		fmt.Fprint(cfg.Out, "\x1b[?1049h\x1b[?25l") // alternate screen, hide cursor
+		defer fmt.Fprint(cfg.Out, "\x1b[?25h\x1b[?1049l")
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		sampler := newIntervalSampler(defaultCollector)
+		var hist []IntervalStats
+		msg := ""
+		for {
+			select {
+			case <-done:
+				return
+			case k := <-keys:
+				if k == 'q' {
+					return
+				}
+				msg = cfg.key(k)
+			case now := <-ticker.C:
+				hist = append(hist, sampler.sample(now))
+				if len(hist) > tuiHistory {
+					hist = hist[1:]
+				}
+			}
+			cfg.draw(hist, msg)
+		}
+	}()
+
+	return func() {
+		select {
+		case <-done:
+		default:
+			close(done)
+		}
+		<-finished
+	}
+}
+
+// key applies a keystroke and returns what it did.
+func (cfg TUIConfig) key(k byte) string {
+	switch {
+	case (k == '+' || k == '=') && cfg.Dial != nil:
+		cfg.Dial.Set(cfg.Dial.Scale() * 1.25)
+		return fmt.Sprintf("rate x%.2f", cfg.Dial.Scale())
+	case k == '-' && cfg.Dial != nil:
+		cfg.Dial.Set(cfg.Dial.Scale() / 1.25)
+		return fmt.Sprintf("rate x%.2f", cfg.Dial.Scale())
+	case k == ']' && cfg.Limiter != nil:
+		cfg.Limiter.SetLimit(cfg.Limiter.Limit() + 1)
+		return fmt.Sprintf("limit %d", cfg.Limiter.Limit())
+	case k == '[' && cfg.Limiter != nil:
+		cfg.Limiter.SetLimit(cfg.Limiter.Limit() - 1)
+		return fmt.Sprintf("limit %d", cfg.Limiter.Limit())
+	}
+	return ""
+}
+
+// draw redraws the screen from the interval history.
+func (cfg TUIConfig) draw(hist []IntervalStats, msg string) {
+	var sb strings.Builder
+	sb.WriteString("\x1b[H\x1b[2J")
+	sb.WriteString("goose: live experiment\r\n\r\n")
+	if len(hist) > 0 {
+		st := hist[len(hist)-1]
+		fmt.Fprintf(&sb, "sent=%d skipped=%d received=%d outstanding=%d\r\n", st.Sent, st.Skipped, st.Received, st.Outstanding)
+	}
+	if cfg.Dial != nil {
+		fmt.Fprintf(&sb, "arrival rate: %.0f/sec (x%.2f)   ", cfg.BaseRate*cfg.Dial.Scale(), cfg.Dial.Scale())
+	}
+	if cfg.Limiter != nil {
+		fmt.Fprintf(&sb, "concurrency limit: %d (in use %d)", cfg.Limiter.Limit(), cfg.Limiter.InUse())
+	}
+	sb.WriteString("\r\n\r\n")
+	series := func(name, unit string, f func(IntervalStats) float64) {
+		vals := make([]float64, len(hist))
+		for i, st := range hist {
+			vals[i] = f(st)
+		}
+		last := 0.0
+		if len(vals) > 0 {
+			last = vals[len(vals)-1]
+		}
+		fmt.Fprintf(&sb, "%-10s %10.1f%-5s |%s\r\n", name, last, unit, sparkline(vals))
+	}
+	series("throughput", "/s", func(st IntervalStats) float64 { return st.Throughput })
+	series("p99", "ms", func(st IntervalStats) float64 { return st.P99 })
+	series("in flight", "", func(st IntervalStats) float64 { return float64(st.InFlight) })
+	sb.WriteString("\r\nkeys: + faster  - slower  ] more concurrency  [ less  q leave\r\n")
+	if msg != "" {
+		fmt.Fprintf(&sb, "%s\r\n", msg)
+	}
+	io.WriteString(cfg.Out, sb.String())
+}
+
+// sparkline draws vals as a row of block characters scaled to their maximum.
+func sparkline(vals []float64) string {
+	const ticks = "▁▂▃▄▅▆▇█"
+	steps := []rune(ticks)
+	top := 0.0
+	for _, v := range vals {
+		top = max(top, v)
+	}
+	var sb strings.Builder
+	for _, v := range vals {
+		i := 0
+		if top > 0 {
+			i = min(int(v/top*float64(len(steps))), len(steps)-1)
+		}
+		sb.WriteRune(steps[i])
+	}
+	return sb.String()
+}
+
+// RawTerminal switches the terminal on f to raw input, so that each keystroke
+// is read as it is typed and not echoed, using stty. It returns a function that
+// restores the previous settings.
+func RawTerminal(f *os.File) (restore func(), err error) {
+	stty := func(args ...string) ([]byte, error) {
+		cmd := exec.Command("stty", args...)
+		cmd.Stdin = f
+		return cmd.Output()
+	}
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, fmt.Errorf("not a terminal: %v", err)
+	}
+	if _, err := stty("-icanon", "-echo", "min", "1"); err != nil {
+		return nil, err
+	}
+	return func() { stty(strings.TrimSpace(string(saved))) }, nil
+}
@@ -0,0 +1,155 @@
+package goose
+
+import (
+	"fmt"
+	"time"
+)
+
+// -------------------- reply validation --------------------
+
+// The stats only time replies: a server that answers with the wrong object, or
+// sends one client's reply to another, looks as fast as a correct one. With
+// LoadOptions.Validate set, every reply that matches an outstanding request is
+// checked against that request as it was sent, and a reply that matches none
+// (a duplicate, or one with an ID that was never sent) counts as unmatched.
+// Failures are counted, and the first few kept for the report.
+
+// Validator checks a reply against the request it answers, returning nil if the
+// reply is acceptable. It is called with the stats locked, so it must not call
+// the stats functions or the Collector's methods.
+type Validator func(req, rep Request) error
+
+// validationSampleLimit is the number of failures kept for PrintValidation.
+const validationSampleLimit = 10
+
+// ValidationFailure is a reply that failed validation.
+type ValidationFailure struct {
+	At  time.Time
+	Req Request // the request as sent; zero for an unmatched reply
+	Rep Request
+	Err error
+}
+
+// validationState is the part of a Collector kept here.
+type validationState struct {
+	validator    Validator       // set from LoadOptions.Validate by Loadgen
+	validateReqs map[int]Request // ClientID -> the request as sent, while a validator is set
+	validated    int             // replies checked
+	invalid      int             // replies the validator rejected
+	unmatched    int             // replies that matched no outstanding request
+	failures     []ValidationFailure
+}
+
+// resetValidationLocked clears the validation state; ResetStats calls it.
+func (c *Collector) resetValidationLocked() {
+	c.validator = nil
+	c.validateReqs = make(map[int]Request)
+	c.validated, c.invalid, c.unmatched = 0, 0, 0
+	c.failures = nil
+}
+
+// setValidator installs v for the run that is starting.
+func (c *Collector) setValidator(v Validator) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.validator = v
+}
+
+// rememberLocked keeps r, which is being sent, for validating its reply.
+func (c *Collector) rememberLocked(r Request) {
+	if c.validator != nil {
+		c.validateReqs[r.ClientID] = r
+	}
+}
+
+// validateLocked checks rep, the reply to an outstanding request.
+func (c *Collector) validateLocked(rep Request) {
+	req, ok := c.validateReqs[rep.ClientID]
+	if c.validator == nil || !ok {
+		return
+	}
+	c.validated++
+	if err := c.validator(req, rep); err != nil {
+		c.invalid++
+		c.recordFailureLocked(ValidationFailure{At: time.Now(), Req: req, Rep: rep, Err: err})
+	}
+}
+
+// unmatchedLocked counts rep, a reply that matches no outstanding request.
+func (c *Collector) unmatchedLocked(rep Request, err error) {
+	if c.validator == nil {
+		return
+	}
+	c.unmatched++
+	c.recordFailureLocked(ValidationFailure{At: time.Now(), Rep: rep, Err: err})
+}
+
+// unmatchedReply is unmatchedLocked for transports that find a reply unmatched
+// before it reaches ReceiveUpcall, such as a RemoteClient given an unknown ID.
+func (c *Collector) unmatchedReply(rep Request, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.unmatchedLocked(rep, err)
+}
+
+// recordFailureLocked keeps f if fewer than validationSampleLimit are kept.
+func (c *Collector) recordFailureLocked(f ValidationFailure) {
+	if len(c.failures) < validationSampleLimit {
+		c.failures = append(c.failures, f)
+	}
+}
+
+// EchoValidator accepts a reply that names the object and tag of its request
+// and has a known status. Servers copy the request into the reply, so any
+// difference means the reply was corrupted or went to the wrong client.
+func EchoValidator(req, rep Request) error {
+	if rep.ObjectID != req.ObjectID {
+		return fmt.Errorf("object %d, want %d", rep.ObjectID, req.ObjectID)
+	}
+	if rep.Tag != req.Tag {
+		return fmt.Errorf("tag %q, want %q", rep.Tag, req.Tag)
+	}
+	if rep.Status < StatusOK || rep.Status > StatusFailed {
+		return fmt.Errorf("unknown status %d", rep.Status)
+	}
+	return nil
+}
+
+// ValidationStats counts the replies validated since the last ResetStats.
+type ValidationStats struct {
+	Enabled   bool
+	Validated int                 // replies to outstanding requests that were checked
+	Invalid   int                 // of those, the ones the validator rejected
+	Unmatched int                 // replies that matched no outstanding request
+	Failures  []ValidationFailure // the first few failures of either kind
+}
+
+// GetValidationStats returns the validation counters.
+func GetValidationStats() ValidationStats { return defaultCollector.GetValidationStats() }
+
+// GetValidationStats is the package function GetValidationStats for c.
+func (c *Collector) GetValidationStats() ValidationStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return ValidationStats{
+		Enabled:   c.validator != nil,
+		Validated: c.validated,
+		Invalid:   c.invalid,
+		Unmatched: c.unmatched,
+		Failures:  append([]ValidationFailure(nil), c.failures...),
+	}
+}
+
+// PrintValidation prints the validation counters and the failures kept.
+func PrintValidation(v ValidationStats) {
+	if !v.Enabled {
+		return
+	}
+	fmt.Printf("validation: checked=%d c.invalid=%d c.unmatched=%d\n", v.Validated, v.Invalid, v.Unmatched)
+	for _, f := range v.Failures {
+		fmt.Printf("  INVALID client=%d object=%d status=%d: %v\n", f.Rep.ClientID, f.Rep.ObjectID, f.Rep.Status, f.Err)
+	}
+	if n := v.Invalid + v.Unmatched; n > len(v.Failures) {
+		fmt.Printf("  ... and %d more\n", n-len(v.Failures))
+	}
+}
@@ -0,0 +1,163 @@
+package goose
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// -------------------- starvation watchdog --------------------
+
+// A scheduler that starves some requests (SJF behind a stream of short jobs, a
+// priority queue with a flood of high priorities) shows it only in the tail of the
+// final histogram, after the run. The watchdog looks at the requests still
+// outstanding while the run goes on, and names each one that has waited longer
+// than a multiple of the mean response time so far, or than an absolute bound,
+// with its tag, tenant, and object, so the pattern can be seen as it forms.
+
+// WatchdogConfig sets when the watchdog flags an outstanding request.
+type WatchdogConfig struct {
+	Multiple float64       // flag requests waiting longer than this times the mean response time; 0 means no such bound
+	AbsMs    float64       // flag requests waiting longer than this many milliseconds; 0 means no such bound
+	Every    time.Duration // how often to look; default 100ms
+}
+
+// watchdogMinReplies is how many replies the mean must rest on before Multiple applies.
+const watchdogMinReplies = 20
+
+// watchdogMaxLines caps the alerts printed per look; the rest are counted.
+const watchdogMaxLines = 10
+
+// watchdogState is the part of a Collector kept here.
+type watchdogState struct {
+	watchOn      bool            // set while a watchdog runs; kept across ResetStats
+	watchReqs    map[int]Request // outstanding requests by ClientID, while watchOn
+	watchFlagged map[int]bool    // ClientIDs already flagged
+}
+
+// resetWatchdogLocked clears the watchdog's state; ResetStats calls it.
+func (c *Collector) resetWatchdogLocked() {
+	c.watchReqs = make(map[int]Request)
+	c.watchFlagged = make(map[int]bool)
+}
+
+// watchSentLocked remembers the sent request r for the watchdog.
+func (c *Collector) watchSentLocked(r Request) {
+	if c.watchOn {
+		c.watchReqs[r.ClientID] = r
+	}
+}
+
+// watchSettledLocked forgets the request with the given ClientID.
+func (c *Collector) watchSettledLocked(clientID int) {
+	delete(c.watchReqs, clientID)
+}
+
+// WatchdogAlert is an outstanding request the watchdog flagged.
+type WatchdogAlert struct {
+	Req    Request
+	Waited time.Duration
+	Bound  time.Duration // the bound it passed
+	MeanRT time.Duration // the mean response time then; 0 if the absolute bound applied
+}
+
+// String describes a, with the request's class, tenant, and object.
+func (a WatchdogAlert) String() string {
+	s := fmt.Sprintf("request %d waiting %.1fms", a.Req.ClientID, durationMs(a.Waited))
+	if a.MeanRT > 0 {
+		s += fmt.Sprintf(" (%.1fx the mean %.1fms)", float64(a.Waited)/float64(a.MeanRT), durationMs(a.MeanRT))
+	} else {
+		s += fmt.Sprintf(" (over %.1fms)", durationMs(a.Bound))
+	}
+	if a.Req.Tag != "" {
+		s += " tag=" + a.Req.Tag
+	}
+	if a.Req.TenantID != 0 {
+		s += fmt.Sprintf(" tenant=%d", a.Req.TenantID)
+	}
+	if a.Req.Priority != 0 {
+		s += fmt.Sprintf(" priority=%d", a.Req.Priority)
+	}
+	return s + fmt.Sprintf(" object=%d demand=%dms", a.Req.ObjectID, a.Req.WorkDemand+a.Req.WaitDemand)
+}
+
+// watchCheckLocked returns the outstanding requests that have passed the bound of
+// cfg for the first time, oldest first.
+func (c *Collector) watchCheckLocked(cfg WatchdogConfig, now time.Time) []WatchdogAlert {
+	var bound, mean time.Duration
+	if cfg.AbsMs > 0 {
+		bound = time.Duration(cfg.AbsMs * float64(time.Millisecond))
+	}
+	if cfg.Multiple > 0 && c.received >= watchdogMinReplies {
+		m := c.sampleSum / time.Duration(c.received)
+		if b := time.Duration(cfg.Multiple * float64(m)); bound == 0 || b < bound {
+			bound, mean = b, m
+		}
+	}
+	if bound <= 0 {
+		return nil
+	}
+	var out []WatchdogAlert
+	for id, at := range c.sendTimes {
+		if waited := now.Sub(at); waited > bound && !c.watchFlagged[id] {
+			c.watchFlagged[id] = true
+			out = append(out, WatchdogAlert{Req: c.watchReqs[id], Waited: waited, Bound: bound, MeanRT: mean})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Waited > out[j].Waited })
+	return out
+}
+
+// StartWatchdog checks the outstanding requests every cfg.Every while an experiment
+// runs and prints a line to w for each one that has waited past the bounds of cfg,
+// once per request. Call the returned function to stop it; it returns the number of
+// requests flagged since it started.
+func StartWatchdog(w io.Writer, cfg WatchdogConfig) (stop func() int) {
+	return defaultCollector.StartWatchdog(w, cfg)
+}
+
+// StartWatchdog is the package function StartWatchdog, watching the requests of c.
+func (c *Collector) StartWatchdog(w io.Writer, cfg WatchdogConfig) (stop func() int) {
+	if cfg.Every <= 0 {
+		cfg.Every = 100 * time.Millisecond
+	}
+	c.mu.Lock()
+	c.watchOn = true
+	c.mu.Unlock()
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	flagged := 0
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(cfg.Every)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				c.mu.Lock()
+				alerts := c.watchCheckLocked(cfg, now)
+				c.mu.Unlock()
+				flagged += len(alerts)
+				for i, a := range alerts {
+					if i == watchdogMaxLines {
+						fmt.Fprintf(w, "[watchdog] ... and %d more\n", len(alerts)-i)
+						break
+					}
+					fmt.Fprintf(w, "[watchdog] %s\n", a)
+				}
+			}
+		}
+	}()
+	return func() int {
+		close(done)
+		<-finished
+		c.mu.Lock()
+		c.watchOn = false
+		c.mu.Unlock()
+		return flagged
+	}
+}
@@ -0,0 +1,73 @@
+package goose
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// watchRequests resets the stats with the watchdog on and sends reqs.
+func watchRequests(reqs ...Request) {
+	c := defaultCollector
+	ResetStats()
+	c.mu.Lock()
+	c.watchOn = true
+	c.mu.Unlock()
+	for _, r := range reqs {
+		SendUpcall(r, false)
+	}
+}
+
+func TestWatchdogBounds(t *testing.T) {
+	c := defaultCollector
+	defer func() { c.watchOn = false }()
+	watchRequests(Request{ClientID: 1, Tag: "slow", TenantID: 2}, Request{ClientID: 2})
+	ReceiveUpcall(Request{ClientID: 2})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	later := time.Now().Add(50 * time.Millisecond)
+	alerts := c.watchCheckLocked(WatchdogConfig{AbsMs: 20}, later)
+	if len(alerts) != 1 || alerts[0].Req.ClientID != 1 || alerts[0].Bound != 20*time.Millisecond || alerts[0].MeanRT != 0 {
+		t.Fatalf("alerts %v, want request 1 over the 20ms bound", alerts)
+	}
+	if s := alerts[0].String(); !strings.Contains(s, "tag=slow") || !strings.Contains(s, "tenant=2") {
+		t.Errorf("alert %q, want its tag and tenant", s)
+	}
+	if again := c.watchCheckLocked(WatchdogConfig{AbsMs: 20}, later); len(again) != 0 {
+		t.Errorf("request flagged again: %v", again)
+	}
+
+	// with enough replies, a multiple of the mean applies if it is the tighter bound
+	c.watchFlagged = make(map[int]bool)
+	c.received, c.sampleSum = watchdogMinReplies, watchdogMinReplies*time.Millisecond
+	alerts = c.watchCheckLocked(WatchdogConfig{Multiple: 5, AbsMs: 20}, later)
+	if len(alerts) != 1 || alerts[0].Bound != 5*time.Millisecond || alerts[0].MeanRT != time.Millisecond {
+		t.Errorf("alerts %v, want a 5ms bound from the 1ms mean", alerts)
+	}
+	if got := c.watchCheckLocked(WatchdogConfig{}, later.Add(time.Hour)); got != nil {
+		t.Errorf("alerts %v with no bounds, want none", got)
+	}
+}
+
+func TestStartWatchdog(t *testing.T) {
+	c := defaultCollector
+	ResetStats()
+	var out bytes.Buffer
+	stop := StartWatchdog(&out, WatchdogConfig{AbsMs: 5, Every: 2 * time.Millisecond})
+	SendUpcall(Request{ClientID: 7}, false)
+	time.Sleep(30 * time.Millisecond)
+	if n := stop(); n != 1 {
+		t.Errorf("%d requests flagged, want 1", n)
+	}
+	if !strings.HasPrefix(out.String(), "[watchdog] request 7 waiting") {
+		t.Errorf("output %q, want a line for request 7", out.String())
+	}
+	c.mu.Lock()
+	on := c.watchOn
+	c.mu.Unlock()
+	if on {
+		t.Error("watchdog still on after stop")
+	}
+}
@@ -0,0 +1,109 @@
+package goose
+
+import (
+	"fmt"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// -------------------- per-worker accounting --------------------
+
+// In pool mode every worker takes the next request from the same channel, so the
+// work should spread evenly over them. Counting what each worker served, and for
+// how long it was busy, shows when it does not: a scheduling policy or a handler
+// that pins work to some workers leaves others idle while requests wait.
+
+// WorkerStats counts what one worker of a pool served.
+type WorkerStats struct {
+	Served int           // requests taken and handled
+	Busy   time.Duration // time spent in the handler
+}
+
+// workerCounters are the live counters behind a WorkerStats.
+type workerCounters struct {
+	served    atomic.Int64
+	busyNanos atomic.Int64
+}
+
+// wrap returns serve with its requests and time counted against w.
+func (w *workerCounters) wrap(serve func(Request) Request) Handler {
+	return HandlerFunc(func(r Request) Request {
+		start := time.Now()
+		rep := serve(r)
+		w.busyNanos.Add(int64(time.Since(start)))
+		w.served.Add(1)
+		return rep
+	})
+}
+
+func (w *workerCounters) stats() WorkerStats {
+	return WorkerStats{Served: int(w.served.Load()), Busy: time.Duration(w.busyNanos.Load())}
+}
+
+// WorkerBalance summarizes how evenly a pool's work was spread.
+type WorkerBalance struct {
+	Workers               int
+	MinServed, MaxServed  int
+	MeanServed, StdServed float64
+	MinBusyMs, MaxBusyMs  float64
+	MeanBusyMs, StdBusyMs float64
+	Imbalance             float64 // busiest worker's busy time over the mean; 1 is perfectly even
+}
+
+// Balance computes the WorkerBalance of ws.
+func Balance(ws []WorkerStats) WorkerBalance {
+	b := WorkerBalance{Workers: len(ws)}
+	if len(ws) == 0 {
+		return b
+	}
+	served := make([]float64, len(ws))
+	busy := make([]float64, len(ws))
+	for i, w := range ws {
+		served[i], busy[i] = float64(w.Served), durationMs(w.Busy)
+	}
+	var minS, maxS float64
+	b.MeanServed, b.StdServed, minS, maxS = spread(served)
+	b.MinServed, b.MaxServed = int(minS), int(maxS)
+	b.MeanBusyMs, b.StdBusyMs, b.MinBusyMs, b.MaxBusyMs = spread(busy)
+	if b.MeanBusyMs > 0 {
+		b.Imbalance = b.MaxBusyMs / b.MeanBusyMs
+	}
+	return b
+}
+
+// spread returns the mean, the population standard deviation, the minimum, and
+// the maximum of vals, which must not be empty.
+func spread(vals []float64) (mean, std, lo, hi float64) {
+	lo, hi = vals[0], vals[0]
+	for _, v := range vals {
+		mean += v
+		lo, hi = min(lo, v), max(hi, v)
+	}
+	mean /= float64(len(vals))
+	for _, v := range vals {
+		std += (v - mean) * (v - mean)
+	}
+	return mean, math.Sqrt(std / float64(len(vals))), lo, hi
+}
+
+// workerImbalanceWarn is the Imbalance beyond which PrintWorkerBalance warns.
+const workerImbalanceWarn = 1.5
+
+// PrintWorkerBalance prints the balance of ws, and each worker if there are few.
+func PrintWorkerBalance(ws []WorkerStats) {
+	if len(ws) == 0 {
+		return
+	}
+	b := Balance(ws)
+	fmt.Printf("workers=%d served min=%d max=%d mean=%.1f sd=%.1f busy min=%.1fms max=%.1fms mean=%.1fms sd=%.1fms imbalance=%.2f\n",
+		b.Workers, b.MinServed, b.MaxServed, b.MeanServed, b.StdServed, b.MinBusyMs, b.MaxBusyMs, b.MeanBusyMs, b.StdBusyMs, b.Imbalance)
+	if len(ws) <= 16 {
+		for i, w := range ws {
+			fmt.Printf("  worker %2d: served=%d busy=%.1fms\n", i, w.Served, durationMs(w.Busy))
+		}
+	}
+	if b.Imbalance > workerImbalanceWarn {
+		fmt.Printf("WARNING: the busiest worker was busy %.1fx the mean: the pool's work is unevenly spread\n", b.Imbalance)
+	}
+}
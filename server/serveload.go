@@ -1,71 +1,1125 @@
 package main
 
 import (
+	"crypto/tls"
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"runtime"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	. "courses.cs.duke.edu/go/goose"
 )
 
 func main() {
-	const N = 1000 // number of requests
+	dispatch(commands(), os.Args[1:])
+}
+
+// ----- Subcommands -----
+
+// The subcommands of serveload are one table, which both picks the subcommand to
+// run and writes the usage message. kvrun.go, in the duality module, has the same
+// table for its own. They cannot be one program: the server and duality modules
+// are handed out on their own and are both named courses.cs.duke.edu/go, so no
+// main package can import goose and kvcache at once.
+
+// command is a subcommand: its name, the arguments shown for it in the usage
+// message, one line each, and what runs it.
+type command struct {
+	name  string
+	usage []string
+	run   func(args []string)
+}
+
+// commands returns the subcommands of serveload, the default first.
+func commands() []command {
+	return []command{
+		{"load", []string{
+			"[flags] <iatMean> <demandMean> <maxConcurrent>",
+			"-config <file.json> [flags] [<iatMean> <demandMean> <maxConcurrent>]",
+			"-serve <addr> [flags] <maxConcurrent>",
+		}, runLoad},
+		{"sweep", []string{"[-n N] [-csv file] [flags] <iatMean,...> <demandMean,...> <maxConcurrent,...>"},
+			func(args []string) { runLoad(append([]string{"-sweep"}, args...)) }},
+		{"plot", []string{"[-x column] [-y column] <results.csv>"}, runPlot},
+		{"regress", []string{"[-golden file] [-timing] [-update]"}, runRegress},
+	}
+}
+
+// dispatch runs the command of cmds that args[0] names on the rest of args, or
+// else the default, the first of cmds, on all of args. "help [command]" runs the
+// command, the default if none, with -h.
+func dispatch(cmds []command, args []string) {
+	if len(args) > 0 && args[0] == "help" {
+		name := cmds[0].name
+		if len(args) > 1 {
+			name = args[1]
+		}
+		args = []string{name, "-h"}
+	}
+	if len(args) > 0 {
+		for _, c := range cmds {
+			if c.name == args[0] {
+				c.run(args[1:])
+				return
+			}
+		}
+	}
+	cmds[0].run(args)
+}
+
+// printUsage prints the usage lines of cmds, the default's name in brackets.
+func printUsage(cmds []command) {
+	prefix := "Usage:"
+	for i, c := range cmds {
+		name := c.name
+		if i == 0 {
+			name = "[" + name + "]"
+		}
+		for _, u := range c.usage {
+			fmt.Printf("%s %s %s %s\n", prefix, os.Args[0], name, u)
+			prefix = "      "
+		}
+	}
+	fmt.Printf("%s %s help [command]\n", prefix, os.Args[0])
+}
+
+// runLoad runs the load subcommand: one experiment, or with -sweep, many.
+func runLoad(args []string) {
+	n := flag.Int("n", 1000, "number of requests per experiment")
+	mode := flag.String("mode", string(ModeSemaphore), "server mode: semaphore (goroutine per request) or pool (fixed workers)")
+	queueLen := flag.Int("queue", 0, "with -policy, length of the admission queue in front of the semaphore")
+	policy := flag.String("policy", "", "admission queue policy when full: block, drop-tail, drop-head, or reject")
+	sched := flag.String("sched", "", "admission queue service order: fifo, sjf, edf, priority (by -classes prio=), or fair (by -tenants)")
+	deadline := flag.Float64("deadline", 0, "mean relative request deadline in milliseconds (for -sched edf)")
+	replyCost := flag.Float64("replycost", 0, "mean extra reply cost per request in milliseconds")
+	replyCPU := flag.Bool("replycpu", false, "spend the reply cost burning CPU instead of sleeping")
+	timeout := flag.Float64("timeout", 0, "give up on requests not answered within this many milliseconds")
+	hedgePct := flag.Float64("hedgepct", 0, "send a duplicate of any request unanswered past this percentile of response times so far")
+	hedgeAfter := flag.Float64("hedgeafter", 0, "duplicate requests unanswered after this many milliseconds (until -hedgepct has enough samples)")
+	rate := flag.Float64("ratelimit", 0, "limit requests to this many per second before serving them")
+	burst := flag.Int("burst", 1, "with -ratelimit, bucket size")
+	rateAlgo := flag.String("ratealgo", string(RateTokenBucket), "with -ratelimit, algorithm: token or leaky")
+	rateExcess := flag.String("rateexcess", string(ExcessReject), "with -ratelimit, what to do with excess requests: reject or delay")
+	errorProb := flag.Float64("errorprob", 0, "probability that the server fails a request with an error reply")
+	panicProb := flag.Float64("panicprob", 0, "probability that the application panics on a request (the server recovers)")
+	stallProb := flag.Float64("stallprob", 0, "probability that a request stalls before service, like a long GC pause")
+	stallMs := flag.Float64("stallms", 200, "with -stallprob, length of a stall in milliseconds")
+	breaker := flag.Float64("breaker", 0, "open a circuit breaker when this fraction of recent requests fail (e.g. 0.5)")
+	breakerSlow := flag.Float64("breakerslow", 0, "with -breaker, count requests slower than this many milliseconds as failures")
+	breakerOpen := flag.Duration("breakeropen", time.Second, "with -breaker, how long the breaker stays open before probing")
+	adapt := flag.String("adapt", "", "adjust the concurrency limit during the run: aimd or gradient")
+	target := flag.Float64("target", 50, "with -adapt aimd, p99 service-time target in milliseconds")
+	maxLimit := flag.Int("maxlimit", 64, "with -adapt, upper bound on the concurrency limit")
+	pipeSpec := flag.String("pipeline", "", "serve each request through a chain of stages name:conc[:demandMs],... (e.g. parse:2:3,compute:4:10)")
+	fanout := flag.Int("fanout", 0, "split each request into this many subrequests with demandMean each, replying when all are done")
+	hedge := flag.Float64("hedge", 0, "with -fanout, duplicate subrequests not finished within this many milliseconds")
+	backendSpec := flag.String("backends", "", "balance requests over server instances with these service-time multipliers (e.g. 1,1,2,4), each with maxConcurrent slots")
+	balance := flag.String("balance", "all", "with -backends, balancing policy: rr, random, least, p2c, or all to compare them")
+	serveAddr := flag.String("serve", "", "run only the server, for remote loadgens, listening on this TCP address (e.g. :7070)")
+	connectAddr := flag.String("connect", "", "send the load to a server started with -serve at this address instead of an in-process one")
+	useTLS := flag.Bool("tls", false, "with -connect or -grpc, connect over TLS, trusting the system CAs unless -tlsca is given")
+	tlsCert := flag.String("tlscert", "", "PEM certificate: with -serve, the server's (enables TLS); with -connect or -grpc, the client's, for mutual TLS")
+	tlsKey := flag.String("tlskey", "", "PEM private key of -tlscert")
+	tlsCA := flag.String("tlsca", "", "PEM CA certificates: with -serve, require client certificates they signed (mutual TLS); with -connect or -grpc, trust them for the server's (implies -tls)")
+	targetURL := flag.String("url", "", "send the load as HTTP requests to this URL template (e.g. http://localhost:8000/item/{{.ObjectID}})")
+	method := flag.String("method", "GET", "with -url, HTTP method")
+	body := flag.String("body", "", "with -url, request body template (e.g. {\"wait\":{{.WaitDemand}}})")
+	grpcAddr := flag.String("grpc", "", "send the load as unary gRPC calls to the server at this host:port (plaintext HTTP/2 unless -tls)")
+	grpcMethod := flag.String("grpcmethod", "/grpc.testing.BenchmarkService/UnaryCall", "with -grpc, full method name to call")
+	grpcPayload := flag.Int("payload", 0, "with -grpc, bytes in each request's payload field")
+	grpcField := flag.Int("payloadfield", 1, "with -grpc, protobuf field number of the payload (a bytes field)")
+	writeRatio := flag.Float64("writeratio", 0, "with -url, send this fraction of the requests as writes with -writemethod and -writebody (key skew comes from -objects)")
+	writeMethod := flag.String("writemethod", "PUT", "with -writeratio, HTTP method of writes")
+	writeBody := flag.String("writebody", "", "with -writeratio, body template of writes (e.g. {\"value\":\"v{{.ClientID}}\"})")
+	coCorrect := flag.Bool("co", false, "also report response times corrected for coordinated omission, including skipped arrivals")
+	tenantSpec := flag.String("tenants", "", "split the arrivals among tenants name:share[:w=weight],... (e.g. big:9,small:1) and report each; -sched fair shares the server among them by weight")
+	classSpec := flag.String("classes", "", "mix request classes tag:weight[:demandMs[:sleep|cpu|io]][:dist=exp|const|lognormal][:sigma=S][:prio=P],... (e.g. cpu:1:5:cpu,io:3:20) and report each separately")
+	checkGen := flag.Bool("checkgen", false, "compare the generated inter-arrival times and demands with the configured distributions")
+	cdfPoints := flag.Int("cdf", 0, "also print the response-time CDF as an ASCII chart with this many rows")
+	cdfLog := flag.Bool("cdflog", false, "with -cdf, space the rows on a log scale of the tail (p90, p99, p99.9, ...)")
+	drainers := flag.Int("drainers", 0, "process replies in this many goroutines of their own rather than in loadgen's arrival loop")
+	arrivals := flag.String("arrivals", "poisson", "arrival process: poisson, batch[:meanSize], or mmpp[:burstFactor[:burstMs:calmMs]], all at the same mean rate")
+	replay := flag.String("replay", "", "replay the arrivals and demands of this trace file (CSV offset_ms,work_ms,wait_ms,objectID) instead of generating them")
+	record := flag.String("record", "", "write the generated arrivals, including skipped ones, to this trace file for -replay")
+	speed := flag.Float64("speed", 1, "with -replay, replay the trace this many times as fast")
+	objects := flag.String("objects", "", "object popularity: uniform, zipf[:s], hotspot[:hotFraction:hotShare], or shift[:workingSet:shiftMs]; reports per-object counts")
+	clients := flag.Int("clients", 0, "drive the server with this many closed-loop virtual clients instead of open arrivals (iatMean is then ignored)")
+	think := flag.String("think", "exp:0", "with -clients, think time between a reply and the next request: exp:meanMs or lognormal:meanMs[:sigma]")
+	sloMs := flag.Float64("slo", 0, "report the fraction of requests answered within this many milliseconds, and the Apdex score")
+	sloTarget := flag.Float64("slotarget", 0.99, "with -slo, the fraction of requests that must meet it")
+	runtimeStats := flag.Bool("runtime", false, "report GC pauses, scheduler latency, and goroutine counts for each run")
+	profileDir := flag.String("profile", "", "write a CPU profile and a goroutine profile of the run to this directory")
+	replyChans := flag.Int("replychans", 0, "give requests this many reply channels, merged by a fan-in goroutine, instead of one shared channel")
+	replyBuf := flag.Int("replybuf", 1, "with -replychans, buffer slots per reply channel")
+	bpThreshold := flag.Float64("backpressure", 0, "have the server report its load and slow arrivals while (in service + waiting)/limit exceeds this (e.g. 1.5)")
+	bpBackoff := flag.Float64("backoff", 0.5, "with -backpressure, factor by which each overload report cuts the arrival rate")
+	ioMean := flag.Float64("iomean", 0, "mean disk read per request in kilobytes, served by the simulated disk")
+	allocMean := flag.Float64("allocmean", 0, "mean memory per request in kilobytes, allocated and held for its service (see -runtime, -gcseries)")
+	diskSpec := flag.String("disk", "", "simulated disk parallelism[:seekMs[:kbPerMs]] (default 1:4:100)")
+	netDelaySpec := flag.String("netdelay", "", "hold each reply for a simulated network delay fixedMs[:jitterMs[:uniform|exp]] after service (e.g. 0.5:2)")
+	shed := flag.Bool("shed", false, "with -deadline, discard requests whose deadline has passed when they would start service")
+	bottleneck := flag.Bool("bottleneck", false, "report the utilization of CPU, disk, and concurrency slots, and which is the bottleneck")
+	replyOrder := flag.Bool("order", false, "report whether replies come back in arrival order, how far they are reordered, and per-object reordering")
+	watchdog := flag.Float64("watchdog", 0, "while running, flag outstanding requests waiting longer than this multiple of the mean response time so far")
+	watchdogMs := flag.Float64("watchdogms", 0, "while running, flag outstanding requests waiting longer than this many milliseconds")
+	chaosPath := flag.String("chaos", "", "play the chaos scenario in this file during the run: timed changes to the rate, the concurrency limit, and injected faults (see -gcseries)")
+	procs := flag.Int("procs", 0, "set GOMAXPROCS for the runs (default: leave it as it is)")
+	cpuWorkers := flag.Int("cpuworkers", 0, "burn the requests' CPU work on this many goroutines locked to OS threads, instead of on each serving goroutine")
+	workerBalance := flag.Bool("workers", false, "in pool mode, report the requests served and busy time of each worker and how evenly they were spread")
+	heatmapPath := flag.String("heatmap", "", "write a latency heatmap (time x latency bucket) to this file: CSV, or PNG if it ends in .png")
+	hdrLogPath := flag.String("hdrlog", "", "write the response times as an HdrHistogram interval log (for hdr-plot and other HdrHistogram tools) to this file")
+	hdrLogEvery := flag.Duration("hdrbin", time.Second, "with -hdrlog, the length of each interval")
+	heatmapEvery := flag.Duration("heatmapbin", 100*time.Millisecond, "with -heatmap, the width of each time interval")
+	gcSeries := flag.Duration("gcseries", 0, "print a latency time series in buckets of this width, annotated with GC pauses (e.g. 100ms)")
+	leakCheck := flag.Bool("leaks", false, "after the run, report goroutines it left behind (stuck senders, receivers, waiters) and exit with status 1 if any")
+	otlpEndpoint := flag.String("otlp", "", "at the end of the run, push the summary to this OTLP/HTTP collector (e.g. http://localhost:4318)")
+	otlpSpans := flag.Int("otlpspans", 0, "with -otlp, also export a span for each of the first this many requests")
+	batch := flag.Bool("batch", false, "send all arrivals already due at each timer firing, keeping the intended rate at sub-millisecond inter-arrival times")
+	batchReplies := flag.Bool("batchreplies", false, "take every reply already waiting each time loadgen takes one, instead of one per loop iteration")
+	catchUp := flag.Float64("catchup", 0, "when arrivals fall more than this many milliseconds behind schedule, send all those due at once")
+	skipWarn := flag.Float64("skipwarn", 0.05, "warn when more than this fraction of arrivals are skipped, and report offered vs intended load (0 disables)")
+	sendTimeout := flag.Float64("sendtimeout", 0, "when the request channel is full, wait up to this many milliseconds for room before skipping")
+	autoBuffer := flag.Int("autobuffer", 0, "when arrivals are being skipped, queue them in loadgen instead, growing the queue up to this many")
+	validate := flag.Bool("validate", false, "check that every reply names the object and tag of its request and answers an outstanding one, and report the failures")
+	soakPath := flag.String("soak", "", "soak test: run until interrupted (or -soakfor), writing a summary of each -window to this CSV file")
+	soakWindow := flag.Duration("window", time.Minute, "with -soak, the length of each stats window")
+	format := flag.String("format", "text", "output format: text, or json for one JSON document of the results on stdout in place of everything else printed there")
+	quiet := flag.Bool("quiet", false, "the same as -format json")
+	abSpec := flag.String("ab", "", "run the same arrivals against two server variants name:key=value,...;name:key=value,... with keys conc, mode, queue, policy, sched, shed, and compare them")
+	soakFor := flag.Duration("soakfor", 0, "with -soak, stop after this long (0 runs until interrupted)")
+	repeat := flag.Int("repeat", 0, "run the experiment this many times with different seeds and report each metric as mean ± 95% confidence interval")
+	seed := flag.Int64("seed", 0, "seed the random arrivals and demands, to repeat a workload (0 picks one, reported with -meta and in -csv)")
+	showMeta := flag.Bool("meta", false, "print the run's metadata: parameters, seed, Go version, GOMAXPROCS, host, git commit, and times")
+	maxSamples := flag.Int("maxsamples", 0, "keep at most this many response-time samples (a uniform random sample) so long runs use bounded memory; 0 keeps all")
+	sweep := flag.Bool("sweep", false, "treat each argument as a comma-separated list and run every combination")
+	compare := flag.Bool("compare", false, "with -sweep, compare the first configuration with each of the others")
+	csvPath := flag.String("csv", "", "with -sweep, also write the results as CSV to this file")
+	dashAddr := flag.String("dashboard", "", "serve a live dashboard at this address (e.g. :8080)")
+	metricsAddr := flag.String("metrics", "", "serve Prometheus metrics at /metrics on this address (e.g. :9100)")
+	progress := flag.Duration("progress", 0, "print live progress at this interval while running (e.g. 1s)")
+	model := flag.Bool("model", false, "compare the results with the M/M/c queueing model of the configured rate, demand, and concurrency")
+	tui := flag.Bool("tui", false, "show live charts in the terminal during the run and adjust the arrival rate (+/-) and concurrency limit ([/]) with keystrokes")
+	configPath := flag.String("config", "", "read settings, including the arguments, from this JSON experiment file; flags given on the command line override it")
+	flag.Usage = func() {
+		printUsage(commands())
+		flag.PrintDefaults()
+	}
+	flag.CommandLine.Parse(args)
+	external := *targetURL != "" || *grpcAddr != "" // an HTTP or gRPC target
 
 	// --- NEW: Read Parameters from Command Line ---
-	if len(os.Args) < 4 {
-		fmt.Printf("Usage: %s <iatMean> <demandMean> <maxConcurrent>\n", os.Args[0])
+	args = flag.Args()
+	if *configPath != "" {
+		cfg, err := LoadConfig(*configPath)
+		if err != nil {
+			log.Fatalf("Cannot read config: %v", err)
+		}
+		if args, err = cfg.Apply(flag.CommandLine, []string{"iatMean", "demandMean", "maxConcurrent"}, args); err != nil {
+			log.Fatalf("Invalid config: %v", err)
+		}
+	}
+	if len(args) < 3 && !(*serveAddr != "" && len(args) == 1) {
+		flag.Usage()
 		os.Exit(1)
 	}
+	if !*sweep && (*compare || *csvPath != "") {
+		log.Fatalf("-compare and -csv need sweep")
+	}
+	var params []string
+	flag.Visit(func(f *flag.Flag) { params = append(params, f.Name+"="+f.Value.String()) })
+	if *procs > 0 {
+		runtime.GOMAXPROCS(*procs) // now, so that the metadata records it
+	}
+	meta := CaptureMetadata(append(params, args...))
+	SetSampleLimit(*maxSamples)
+	serverMode := ServerMode(*mode)
+	if serverMode != ModeSemaphore && serverMode != ModePool {
+		log.Fatalf("Invalid mode: %q", *mode)
+	}
+	queue := QueueConfig{Len: *queueLen, Policy: QueuePolicy(*policy), Discipline: Discipline(*sched)}
+	if queue.Policy != "" && !ValidPolicy(queue.Policy) {
+		log.Fatalf("Invalid policy: %q", *policy)
+	}
+	if queue.Discipline != "" && !ValidDiscipline(queue.Discipline) {
+		log.Fatalf("Invalid sched: %q", *sched)
+	}
+	algorithm := ControlAlgorithm(*adapt)
+	if algorithm != "" && algorithm != ControlAIMD && algorithm != ControlGradient {
+		log.Fatalf("Invalid adapt: %q", *adapt)
+	}
+	if algorithm != "" && *sweep {
+		log.Fatalf("-adapt cannot be combined with -sweep")
+	}
+	if *hedge > 0 && *fanout <= 0 {
+		*fanout = 1
+	}
+	if *fanout > 0 && *sweep {
+		log.Fatalf("-fanout cannot be combined with -sweep")
+	}
+	if *backendSpec != "" && *sweep {
+		log.Fatalf("-backends cannot be combined with -sweep")
+	}
+	if *balance != "all" && !ValidBalancePolicy(BalancePolicy(*balance)) {
+		log.Fatalf("Invalid balance: %q", *balance)
+	}
+	if *breaker > 0 && *sweep {
+		log.Fatalf("-breaker cannot be combined with -sweep")
+	}
+	if *fanout > 0 && *pipeSpec != "" {
+		log.Fatalf("-fanout cannot be combined with -pipeline")
+	}
+	rateCfg := RateConfig{Algorithm: RateAlgorithm(*rateAlgo), Rate: *rate, Burst: *burst, Excess: RateExcess(*rateExcess)}
+	if rateCfg.Algorithm != RateTokenBucket && rateCfg.Algorithm != RateLeakyBucket {
+		log.Fatalf("Invalid ratealgo: %q", *rateAlgo)
+	}
+	if rateCfg.Excess != ExcessReject && rateCfg.Excess != ExcessDelay {
+		log.Fatalf("Invalid rateexcess: %q", *rateExcess)
+	}
+	faults := FaultConfig{ErrorProb: *errorProb, PanicProb: *panicProb, StallProb: *stallProb, StallMs: *stallMs}
+	if queue.Enabled() {
+		if queue.Policy == "" {
+			queue.Policy = PolicyBlock
+		}
+		if queue.Discipline == "" {
+			queue.Discipline = DisciplineFIFO
+		}
+	}
+	var netDelay NetDelay
+	if *netDelaySpec != "" {
+		var err error
+		if netDelay, err = ParseNetDelay(*netDelaySpec); err != nil {
+			log.Fatalf("Invalid -netdelay: %v", err)
+		}
+	}
+	base := Experiment{N: *n, Mode: serverMode, Queue: queue, NetDelay: netDelay, Load: LoadOptions{
+		DeadlineMeanMs:  *deadline,
+		ReplyCostMeanMs: *replyCost,
+		ReplyCPU:        *replyCPU,
+		TimeoutMs:       *timeout,
+		HedgePercentile: *hedgePct,
+		HedgeAfterMs:    *hedgeAfter,
+		ReplyDrainers:   *drainers,
+		ReplyChannels:   *replyChans,
+		ReplyBuffer:     *replyBuf,
+		IOMeanKB:        *ioMean,
+		AllocMeanKB:     *allocMean,
+		Backpressure:    BackpressureConfig{Threshold: *bpThreshold, Backoff: *bpBackoff},
+		BatchArrivals:   *batch,
+		Seed:            *seed,
+		SkipWarn:        *skipWarn,
+		SendTimeoutMs:   *sendTimeout,
+		AutoBuffer:      *autoBuffer,
+		CatchUpMs:       *catchUp,
+		BatchReplies:    *batchReplies,
+	}, Runtime: *runtimeStats, ShedExpired: *shed, Procs: *procs, CPUWorkers: *cpuWorkers}
+	if *validate {
+		base.Load.Validate = EchoValidator
+	}
 
-	iatMean, err := strconv.ParseFloat(os.Args[1], 64)
+	if *replay != "" {
+		trace, err := LoadTrace(*replay)
+		if err != nil {
+			log.Fatalf("Cannot read trace: %v", err)
+		}
+		base.N = len(trace)
+		base.Load.Trace, base.Load.TraceSpeed = trace, *speed
+	}
+	var recorder *TraceRecorder
+	if *record != "" {
+		if *sweep {
+			log.Fatalf("-record cannot be combined with -sweep")
+		}
+		recorder = &TraceRecorder{}
+		base.Load.Record = recorder
+	}
+	if *clients > 0 {
+		thinkCfg, err := ParseThink(*think)
+		if err != nil {
+			log.Fatalf("Invalid think time: %v", err)
+		}
+		base.Load.Clients, base.Load.Think = *clients, thinkCfg
+	}
+	SetSLO(SLO{ThresholdMs: *sloMs, Target: *sloTarget})
+	SetSpanCapture(*otlpSpans)
+	SetLatencySeries(*gcSeries)
+	SetReplyOrder(*replyOrder)
+	if *diskSpec != "" {
+		diskCfg, err := ParseDisk(*diskSpec)
+		if err != nil {
+			log.Fatalf("Invalid disk: %v", err)
+		}
+		SetDisk(diskCfg)
+	}
+	if *heatmapPath != "" {
+		if *sweep {
+			log.Fatalf("-heatmap cannot be combined with -sweep")
+		}
+		SetHeatmap(*heatmapEvery)
+	}
+	if *hdrLogPath != "" {
+		if *sweep {
+			log.Fatalf("-hdrlog cannot be combined with -sweep")
+		}
+		SetHDRLog(*hdrLogEvery)
+	}
+	if *gcSeries > 0 {
+		if *sweep {
+			log.Fatalf("-gcseries cannot be combined with -sweep")
+		}
+		stop := StartGCWatch()
+		defer stop()
+	}
+	arrivalCfg, err := ParseArrivals(*arrivals)
+	if err != nil {
+		log.Fatalf("Invalid arrivals: %v", err)
+	}
+	base.Load.Arrivals = arrivalCfg
+	if *objects != "" {
+		if base.Load.Objects, err = ParseObjects(*objects); err != nil {
+			log.Fatalf("Invalid objects: %v", err)
+		}
+	}
+	if *classSpec != "" {
+		classes, err := ParseClasses(*classSpec)
+		if err != nil {
+			log.Fatalf("Invalid classes: %v", err)
+		}
+		base.Load.Classes = classes
+	}
+	if *tenantSpec != "" {
+		tenants, err := ParseTenants(*tenantSpec)
+		if err != nil {
+			log.Fatalf("Invalid tenants: %v", err)
+		}
+		if *clients > 0 {
+			log.Fatalf("-tenants cannot be combined with -clients")
+		}
+		base.Load.Tenants = tenants
+		queue.Weights = TenantWeights(tenants) // also for -serve, whose clients send TenantIDs
+		base.Queue.Weights = queue.Weights
+	}
+
+	var pipeline *Pipeline
+	if *pipeSpec != "" {
+		stages, err := ParseStages(*pipeSpec)
+		if err != nil {
+			log.Fatalf("Invalid pipeline: %v", err)
+		}
+		pipeline = NewPipeline(stages...)
+		defer pipeline.Close()
+		base.Handler = pipeline
+	}
+
+	if *serveAddr != "" {
+		maxConcurrent, err := strconv.Atoi(args[len(args)-1])
+		if err != nil {
+			log.Fatalf("Invalid maxConcurrent: %v", err)
+		}
+		h := base.Handler
+		if faults.ErrorProb > 0 || faults.PanicProb > 0 || faults.StallProb > 0 {
+			h = NewFaultInjector(h, faults)
+		}
+		SetCPUWorkers(*cpuWorkers)
+		var tlsCfg *tls.Config
+		if *tlsCert != "" {
+			if tlsCfg, err = ServerTLS(*tlsCert, *tlsKey, *tlsCA); err != nil {
+				log.Fatalf("TLS: %v", err)
+			}
+		} else if *tlsCA != "" {
+			log.Fatal("-tlsca with -serve needs the server's -tlscert and -tlskey")
+		}
+		fmt.Fprintf(os.Stderr, "serving on %s\n", *serveAddr)
+		log.Fatal(ServeConfig(*serveAddr, ServerConfig{Mode: serverMode, MaxConcurrent: maxConcurrent, Queue: queue, Handler: h, ShedExpired: *shed, NetDelay: netDelay, NetDelaySeed: *seed, TLS: tlsCfg}))
+	}
+	if *targetURL != "" && *grpcAddr != "" {
+		log.Fatalf("-url and -grpc cannot be combined")
+	}
+	if (*connectAddr != "" || external) && *sweep {
+		log.Fatalf("-connect, -url, and -grpc cannot be combined with -sweep")
+	}
+	if *tui && (*sweep || *connectAddr != "" || external) {
+		log.Fatalf("-tui cannot be combined with -sweep, -connect, -url, or -grpc")
+	}
+	if *repeat > 1 && (*sweep || *tui || *connectAddr != "" || external) {
+		log.Fatalf("-repeat cannot be combined with -sweep, -tui, -connect, -url, or -grpc")
+	}
+	if *soakPath != "" && (*sweep || *tui || *repeat > 1 || *connectAddr != "" || external || *replay != "" || *record != "") {
+		log.Fatalf("-soak cannot be combined with -sweep, -tui, -repeat, -connect, -url, -grpc, -replay, or -record")
+	}
+	if *format != "text" && *format != "json" {
+		log.Fatalf("Invalid format: %q (want text or json)", *format)
+	}
+	jsonOut := *format == "json" || *quiet
+	if jsonOut && (*tui || *soakPath != "" || *serveAddr != "") {
+		log.Fatalf("-format json cannot be combined with -tui, -soak, or -serve")
+	}
+	var variants []ABVariant
+	if *abSpec != "" {
+		if *sweep || *tui || *repeat > 1 || *soakPath != "" || *connectAddr != "" || external || *backendSpec != "" || *adapt != "" || *record != "" || *clients > 0 {
+			log.Fatalf("-ab cannot be combined with -sweep, -tui, -repeat, -soak, -connect, -url, -grpc, -backends, -adapt, -record, or -clients")
+		}
+		specs := strings.Split(*abSpec, ";")
+		if len(specs) != 2 {
+			log.Fatalf("Invalid -ab: want two variants separated by ';'")
+		}
+		for _, spec := range specs {
+			v, err := ParseABVariant(spec)
+			if err != nil {
+				log.Fatalf("Invalid -ab: %v", err)
+			}
+			variants = append(variants, v)
+		}
+	}
+	var scenario ChaosScenario
+	if *chaosPath != "" {
+		if *sweep || *repeat > 1 || *soakPath != "" || *abSpec != "" || *connectAddr != "" || external {
+			log.Fatalf("-chaos cannot be combined with -sweep, -repeat, -soak, -ab, -connect, -url, or -grpc")
+		}
+		if scenario, err = LoadChaos(*chaosPath); err != nil {
+			log.Fatalf("Invalid chaos scenario: %v", err)
+		}
+		if *clients > 0 && scenario.Uses("rate") {
+			log.Fatalf("Invalid chaos scenario: -clients has no arrival rate to change")
+		}
+	}
+
+	if *dashAddr != "" {
+		if err := StartDashboard(*dashAddr); err != nil {
+			log.Fatalf("Cannot start dashboard: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "dashboard at http://%s/\n", *dashAddr)
+	}
+
+	if *metricsAddr != "" {
+		if err := StartMetrics(*metricsAddr); err != nil {
+			log.Fatalf("Cannot start metrics endpoint: %v", err)
+		}
+	}
+
+	if *progress > 0 {
+		stop := StartProgress(os.Stderr, *progress)
+		defer stop()
+	}
+	if *watchdog > 0 || *watchdogMs > 0 {
+		stop := StartWatchdog(os.Stderr, WatchdogConfig{Multiple: *watchdog, AbsMs: *watchdogMs})
+		defer func() {
+			if n := stop(); n > 0 {
+				fmt.Fprintf(os.Stderr, "[watchdog] %d requests flagged\n", n)
+			}
+		}()
+	}
+
+	if *profileDir != "" {
+		stop, err := StartProfiles(*profileDir)
+		if err != nil {
+			log.Fatalf("Cannot start profiling: %v", err)
+		}
+		defer func() {
+			if err := stop(); err != nil {
+				log.Printf("Cannot write profiles: %v", err)
+			}
+		}()
+	}
+
+	// An interrupt ends the experiment early, with a report of what ran.
+	stop := interrupts()
+	base.Load.Stop = stop
+
+	// In JSON mode everything printed for people goes nowhere, and the results
+	// are written as one document once all else is done.
+	var report Report
+	if jsonOut {
+		human := os.Stdout
+		devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		if err != nil {
+			log.Fatalf("Cannot open %s: %v", os.DevNull, err)
+		}
+		os.Stdout = devNull
+		defer func() {
+			os.Stdout = human
+			devNull.Close()
+			report.Metadata = meta
+			report.Metadata.End = time.Now()
+			report.Interrupted = interrupted(stop)
+			if err := report.WriteJSON(human); err != nil {
+				log.Fatalf("Cannot write report: %v", err)
+			}
+		}()
+	}
+
+	if *sweep {
+		iatMeans := parseFloats("iatMean", args[0])
+		demandMeans := parseFloats("demandMean", args[1])
+		maxConcurrents := parseInts("maxConcurrent", args[2])
+		if faults.ErrorProb > 0 || faults.PanicProb > 0 || faults.StallProb > 0 {
+			base.Handler = NewFaultInjector(base.Handler, faults)
+		}
+		if *rate > 0 {
+			base.Handler = NewRateLimiter(base.Handler, rateCfg)
+		}
+
+		snap := TakeLeakSnapshot()
+		results := Sweep(base, iatMeans, demandMeans, maxConcurrents)
+		report.Add(results...)
+		PrintResultsTable(results)
+		if interrupted(stop) {
+			fmt.Printf("interrupted: %d of %d configurations ran, the last one partly\n",
+				len(results), len(iatMeans)*len(demandMeans)*len(maxConcurrents))
+		}
+		if *model {
+			for _, r := range results {
+				fmt.Printf("\niat=%g demand=%g conc=%d\n", r.IatMean, r.DemandMean, r.MaxConcurrent)
+				PrintModelComparison(r)
+			}
+		}
+		if *leakCheck {
+			defer exitOnLeaks(snap)
+		}
+		if *sloMs > 0 {
+			best := -1
+			for i, r := range results {
+				fmt.Printf("iat=%g dem=%g conc=%d ", r.IatMean, r.DemandMean, r.MaxConcurrent)
+				PrintSLOStats(r.SLO)
+				if r.SLO.OK() && (best < 0 || r.Throughput > results[best].Throughput) {
+					best = i
+				}
+			}
+			if best >= 0 {
+				r := results[best]
+				fmt.Printf("max throughput meeting the SLO: %.1f/s (iat=%g dem=%g conc=%d)\n", r.Throughput, r.IatMean, r.DemandMean, r.MaxConcurrent)
+			} else {
+				fmt.Println("no configuration met the SLO")
+			}
+		}
+		if *runtimeStats {
+			for _, r := range results {
+				fmt.Printf("iat=%g dem=%g conc=%d ", r.IatMean, r.DemandMean, r.MaxConcurrent)
+				PrintRuntimeStats(r.Runtime)
+			}
+		}
+		if *validate {
+			for _, r := range results {
+				fmt.Printf("iat=%g dem=%g conc=%d ", r.IatMean, r.DemandMean, r.MaxConcurrent)
+				PrintValidation(r.Validation)
+			}
+		}
+		if *compare {
+			for _, r := range results[1:] {
+				fmt.Println()
+				PrintComparison(results[0], r, 10)
+			}
+		}
+
+		if *csvPath != "" {
+			f, err := os.Create(*csvPath)
+			if err != nil {
+				log.Fatalf("Cannot create %s: %v", *csvPath, err)
+			}
+			meta.End = time.Now()
+			if err := WriteMetadata(f, meta); err != nil {
+				log.Fatalf("Cannot write %s: %v", *csvPath, err)
+			}
+			if err := WriteResultsCSV(f, results); err != nil {
+				log.Fatalf("Cannot write %s: %v", *csvPath, err)
+			}
+			f.Close()
+		}
+		return
+	}
+
+	iatMean, err := strconv.ParseFloat(args[0], 64)
 	if err != nil {
 		log.Fatalf("Invalid iatMean: %v", err)
 	}
 
-	demandMean, err := strconv.ParseFloat(os.Args[2], 64)
+	demandMean, err := strconv.ParseFloat(args[1], 64)
 	if err != nil {
 		log.Fatalf("Invalid demandMean: %v", err)
 	}
 
-	maxConcurrent, err := strconv.Atoi(os.Args[3])
+	maxConcurrent, err := strconv.Atoi(args[2])
 	if err != nil {
 		log.Fatalf("Invalid maxConcurrent: %v", err)
 	}
 	// ----------------------------------------------
 
-	reqCh := make(chan Request, 16)
-	repCh := make(chan Request, 16)
+	// Let's go goose!
+	e := base
+	e.IatMean, e.DemandMean, e.MaxConcurrent = iatMean, demandMean, maxConcurrent
+
+	if *backendSpec != "" {
+		backends, err := ParseBackends(*backendSpec, maxConcurrent)
+		if err != nil {
+			log.Fatalf("Invalid backends: %v", err)
+		}
+		policies := BalancePolicies
+		if *balance != "all" {
+			policies = []BalancePolicy{BalancePolicy(*balance)}
+		}
+		// The backends limit concurrency; keep the front server out of the way.
+		e.MaxConcurrent = e.N
+		balanced := CompareBalancers(e, backends, policies)
+		for _, br := range balanced {
+			report.Add(br.Result)
+		}
+		PrintBalanceTable(balanced)
+		return
+	}
 
-	// Start handler
-	go ReqHandler(reqCh, maxConcurrent)
+	var scatter *ScatterGather
+	if *fanout > 0 {
+		scatter = &ScatterGather{K: *fanout, LeafDemandMeanMs: demandMean, HedgeAfterMs: *hedge}
+		e.Handler = scatter
+	}
 
-	startup := time.Now()
+	var injector *FaultInjector
+	if faults.ErrorProb > 0 || faults.PanicProb > 0 || faults.StallProb > 0 || scenario.Uses("fail") || scenario.Uses("drop") || scenario.Uses("stall") {
+		injector = NewFaultInjector(e.Handler, faults)
+		e.Handler = injector
+	}
 
-	// Let's go goose!
-	Loadgen(reqCh, repCh, N, iatMean, demandMean)
+	var cb *CircuitBreaker
+	if *breaker > 0 {
+		cb = NewCircuitBreaker(e.Handler, BreakerConfig{FailureRate: *breaker, SlowMs: *breakerSlow, OpenFor: *breakerOpen})
+		e.Handler = cb
+	}
 
-	elapsed := time.Since(startup)
+	var limited *RateLimiter
+	if *rate > 0 {
+		limited = NewRateLimiter(e.Handler, rateCfg)
+		e.Handler = limited
+	}
+
+	var ctrl *Controller
+	if algorithm != "" {
+		e.Limiter = NewLimiter(maxConcurrent)
+		defer e.Limiter.Close()
+		ctrl = StartController(e.Limiter, ControllerConfig{Algorithm: algorithm, TargetMs: *target, MaxLimit: *maxLimit})
+	}
+
+	stopTUI := func() {}
+	if *tui {
+		restore, err := RawTerminal(os.Stdin)
+		if err != nil {
+			log.Fatalf("Cannot start the TUI: %v", err)
+		}
+		e.Load.RateDial = NewRateDial()
+		if e.Limiter == nil && serverMode == ModeSemaphore {
+			e.Limiter = NewLimiter(maxConcurrent)
+			defer e.Limiter.Close()
+		}
+		stop := StartTUI(TUIConfig{In: os.Stdin, Out: os.Stderr, BaseRate: 1000 / iatMean, Dial: e.Load.RateDial, Limiter: e.Limiter})
+		stopTUI = func() {
+			stop()
+			restore()
+		}
+	}
+
+	if len(scenario) > 0 {
+		if e.Load.RateDial == nil {
+			e.Load.RateDial = NewRateDial()
+		}
+		if e.Limiter == nil && serverMode == ModeSemaphore && scenario.Uses("conc") {
+			e.Limiter = NewLimiter(maxConcurrent)
+			defer e.Limiter.Close()
+		}
+		targets := ChaosTargets{Dial: e.Load.RateDial, Limiter: e.Limiter, Faults: injector}
+		if err := targets.Check(scenario); err != nil {
+			log.Fatalf("Cannot play the chaos scenario: %v", err)
+		}
+		e.Chaos = &Chaos{Scenario: scenario, Targets: targets, Log: os.Stderr}
+	}
+
+	// Everything started so far lives for the whole process; anything started
+	// from here on should be gone by the end of the run.
+	snap := TakeLeakSnapshot()
+	if *leakCheck {
+		defer exitOnLeaks(snap)
+	}
+
+	if len(variants) == 2 {
+		ab, err := RunAB(e, variants[0], variants[1])
+		if err != nil {
+			log.Fatalf("A/B run failed: %v", err)
+		}
+		report.Add(ab.A)
+		if ab.B.Attempts > 0 {
+			report.Add(ab.B)
+		}
+		PrintAB(ab, 10)
+		return
+	}
+
+	if *repeat > 1 {
+		results := Repeat(e, *repeat)
+		report.Add(results...)
+		PrintEstimates(len(results), Summarize(results))
+		return
+	}
+
+	if *soakPath != "" {
+		f, err := os.Create(*soakPath)
+		if err != nil {
+			log.Fatalf("Cannot create %s: %v", *soakPath, err)
+		}
+		defer f.Close()
+		if err := WriteMetadata(f, meta); err != nil {
+			log.Fatalf("Cannot write %s: %v", *soakPath, err)
+		}
+		cfg := SoakConfig{Window: *soakWindow, Duration: *soakFor, Stop: stop, MaxSamples: *maxSamples}
+		windows, err := RunSoak(e, cfg, f, PrintSoakWindow)
+		if err != nil {
+			log.Fatalf("Soak failed: %v", err)
+		}
+		fmt.Printf("soak: %d windows written to %s\n", windows, *soakPath)
+		return
+	}
+
+	var res Result
+	var grpcCodes map[int]int
+	if *connectAddr != "" {
+		if *useTLS || *tlsCA != "" || *tlsCert != "" {
+			if e.Remote.TLS, err = ClientTLS(*tlsCA, *tlsCert, *tlsKey); err != nil {
+				log.Fatalf("TLS: %v", err)
+			}
+		}
+		res, err = RunRemoteExperiment(*connectAddr, e)
+		if err != nil {
+			log.Fatalf("Cannot connect: %v", err)
+		}
+	} else if *grpcAddr != "" {
+		var tlsCfg *tls.Config
+		if *useTLS || *tlsCA != "" || *tlsCert != "" {
+			if tlsCfg, err = ClientTLS(*tlsCA, *tlsCert, *tlsKey); err != nil {
+				log.Fatalf("TLS: %v", err)
+			}
+		}
+		res, grpcCodes, err = RunGRPCExperiment(GRPCTargetConfig{Addr: *grpcAddr, Method: *grpcMethod,
+			PayloadSize: *grpcPayload, Field: *grpcField, TLS: tlsCfg}, e)
+		if err != nil {
+			log.Fatalf("Cannot load %s: %v", *grpcAddr, err)
+		}
+	} else if *targetURL != "" {
+		res, err = RunHTTPExperiment(HTTPTargetConfig{URL: *targetURL, Method: *method, Body: *body,
+			WriteRatio: *writeRatio, WriteMethod: *writeMethod, WriteBody: *writeBody}, e)
+		if err != nil {
+			log.Fatalf("Cannot load %s: %v", *targetURL, err)
+		}
+	} else {
+		res = RunExperiment(e)
+	}
+	report.Add(res)
+	stopTUI()
+	if interrupted(stop) {
+		fmt.Printf("interrupted: partial results of %d of %d arrivals\n", res.Attempts, e.N)
+	}
 
 	//--------------------------------------------------------------------------------------
 
-	// After Loadgen returns, get stats and histogram
-	attempts, sent, skipped, recv, mean := GetStats()
-	if attempts != sent+skipped {
-		fmt.Printf("Dropped %d attempts somehow: should not happen.\n", attempts-(sent+skipped))
+	if *otlpEndpoint != "" {
+		if err := ExportOTLP(*otlpEndpoint, res); err != nil {
+			log.Printf("OTLP export failed: %v", err)
+		}
 	}
-	if recv != sent {
-		fmt.Printf("Reported %d sends without replies: should not happen.\n", sent-recv)
+	if recorder != nil {
+		if err := SaveTrace(*record, recorder.Entries()); err != nil {
+			log.Fatalf("Cannot write trace: %v", err)
+		}
+	}
+
+	// After the run, check stats and print the histogram
+	if res.Attempts != res.Sent+res.Skipped {
+		fmt.Printf("Dropped %d attempts somehow: should not happen.\n", res.Attempts-(res.Sent+res.Skipped))
+	}
+	if unanswered := res.Sent - (res.Received + res.Dropped + res.Rejected + res.Failed + res.TimedOut); unanswered != 0 {
+		fmt.Printf("Reported %d sends without replies: should not happen.\n", unanswered)
 	}
-	seconds := elapsed.Seconds()
-	throughput := float64(recv) / seconds
 	fmt.Printf("sent=%d skipped=%d throughput=%.0f/sec meanRT=%.3fms\n",
-		sent, skipped, throughput, mean)
+		res.Sent, res.Skipped, res.Throughput, res.MeanRT)
+	PrintCapacity(res)
+	if *runtimeStats {
+		PrintRuntimeStats(res.Runtime)
+	}
+	if *deadline > 0 && *connectAddr == "" && !external {
+		fmt.Printf("deadlines: served=%d late=%d shed=%d\n", res.Server.Served, res.Server.Late, res.Server.Shed)
+	}
+	if *showMeta {
+		meta.End = time.Now()
+		WriteMetadata(os.Stdout, meta)
+		fmt.Printf("# seed: %d\n", res.Load.Seed)
+	}
+	if *model {
+		PrintModelComparison(res)
+	}
+	if *procs > 0 || *cpuWorkers > 0 {
+		PrintCPU(res.CPU)
+	}
+	if *bottleneck || res.Disk.Ops > 0 {
+		PrintBottleneck(res)
+	}
+	if *gcSeries > 0 {
+		PrintLatencySeries(GetLatencySeries())
+		PrintGCImpact()
+	}
+	if *replyOrder {
+		PrintReplyOrder(GetReplyOrder())
+	}
+	if netDelay.Enabled() && *connectAddr == "" && !external {
+		PrintNetDelay(netDelay, res.Server)
+	}
+	if *workerBalance {
+		PrintWorkerBalance(res.Server.Workers)
+	}
+	if *heatmapPath != "" {
+		if err := writeHeatmap(*heatmapPath, GetHeatmap()); err != nil {
+			log.Fatalf("Cannot write heatmap: %v", err)
+		}
+	}
+	if *hdrLogPath != "" {
+		if err := writeHDRLog(*hdrLogPath, GetHDRLog()); err != nil {
+			log.Fatalf("Cannot write HDR log: %v", err)
+		}
+	}
+	if queue.Enabled() {
+		fmt.Printf("queue=%d policy=%s sched=%s dropped=%d rejected=%d p99RT=%.3fms\n",
+			queue.Len, queue.Policy, queue.Discipline, res.Dropped, res.Rejected, res.P99)
+	}
+
+	if *timeout > 0 {
+		timedOut, abandoned, late := GetCancelStats()
+		fmt.Printf("timeout=%.0fms timedout=%d abandoned=%d completedLate=%d\n", *timeout, timedOut, abandoned, late)
+	}
+
+	if *hedgePct > 0 || *hedgeAfter > 0 {
+		fmt.Printf("hedges=%d hedgeWins=%d wasted=%dms p99RT=%.3fms\n", res.Hedges, res.HedgeWins, res.WastedMs, res.P99)
+	}
+	if res.Duplicates > 0 {
+		fmt.Printf("duplicates=%d replies to settled requests were ignored\n", res.Duplicates)
+	}
+
+	if *coCorrect {
+		cs := GetCorrectedStats(true)
+		fmt.Printf("raw:       n=%d meanRT=%.3fms p50=%.3fms p99=%.3fms\n", res.Received, res.MeanRT, Percentile(50), res.P99)
+		fmt.Printf("corrected: n=%d meanRT=%.3fms p50=%.3fms p99=%.3fms (synthesized=%d)\n",
+			cs.N, cs.MeanRT, cs.P50, cs.P99, cs.Synthesized)
+	}
+
+	if *sloMs > 0 {
+		PrintSLOStats(res.SLO)
+	}
+
+	if *checkGen {
+		PrintGeneratorCheck(CheckGenerator(res.IatMean, res.DemandMean, res.Load.Classes))
+	}
+	if *checkGen || *batch || *catchUp > 0 {
+		PrintSlippage()
+	}
+	if *batchReplies || *catchUp > 0 {
+		PrintBatchStats()
+	}
+	PrintValidation(res.Validation)
+
+	if *targetURL != "" {
+		PrintStatusCodes()
+	}
+	if *grpcAddr != "" {
+		PrintGRPCCodes(grpcCodes)
+	}
 
 	// build histogram: 10 bins up to 100ms, last bin is >=100ms
 	counts, labels := HistogramLinear(10, 100.0)
 	PrintHistogramASCII(counts, labels, 60)
+	if *cdfPoints > 0 {
+		if *cdfLog {
+			PrintCDFASCIILog(*cdfPoints)
+		} else {
+			PrintCDFASCII(*cdfPoints)
+		}
+	}
+
+	if *classSpec != "" {
+		PrintTagStats(10, 100.0)
+	}
+	if *tenantSpec != "" {
+		PrintTenantStats(res)
+	}
+
+	if *objects != "" {
+		PrintObjectStats(10)
+	}
+
+	if faults.ErrorProb > 0 || faults.PanicProb > 0 || faults.StallProb > 0 {
+		PrintFaultStats(res.Sent)
+	}
+
+	if cb != nil {
+		PrintBreaker(cb)
+	}
 
-	close(reqCh) // let handler finish (it will close repCh)
+	if limited != nil {
+		PrintRateStats(limited)
+	}
+
+	if scatter != nil {
+		PrintFanoutStats(scatter)
+	}
+
+	if pipeline != nil {
+		PrintStageStats(pipeline.Stats())
+	}
+
+	if ctrl != nil {
+		fmt.Printf("limit decisions (%s):\n", algorithm)
+		PrintDecisions(ctrl.Stop())
+	}
+}
+
+// parseFloats parses a comma-separated list of floats, exiting on error.
+func parseFloats(name, list string) []float64 {
+	var out []float64
+	for _, s := range strings.Split(list, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil {
+			log.Fatalf("Invalid %s: %v", name, err)
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+// parseInts parses a comma-separated list of ints, exiting on error.
+func parseInts(name, list string) []int {
+	var out []int
+	for _, s := range strings.Split(list, ",") {
+		v, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			log.Fatalf("Invalid %s: %v", name, err)
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+// writeHeatmap writes h to path as a PNG image if the name ends in .png, and as
+// CSV otherwise.
+func writeHeatmap(path string, h Heatmap) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(path, ".png") {
+		err = h.WritePNG(f)
+	} else {
+		err = h.WriteCSV(f)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeHDRLog writes l to path.
+func writeHDRLog(path string, l HDRLog) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = l.Write(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// interrupts returns a channel that is closed on the first SIGINT or SIGTERM, so
+// that the experiment stops and the partial results are still reported and
+// written; a second signal exits at once.
+func interrupts() <-chan struct{} {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	stop := make(chan struct{})
+	go func() {
+		sig := <-sigs
+		fmt.Fprintf(os.Stderr, "\n%v: finishing the outstanding requests for a partial report (again to quit now)\n", sig)
+		close(stop)
+		<-sigs
+		os.Exit(130)
+	}()
+	return stop
+}
+
+// interrupted reports whether stop, from interrupts, has been closed.
+func interrupted(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// exitOnLeaks reports the goroutines started since snap that are still there a
+// second later, and exits with status 1 if there are any.
+func exitOnLeaks(snap LeakSnapshot) {
+	leaks := snap.Leaks(time.Second)
+	PrintLeaks(os.Stdout, leaks)
+	if len(leaks) > 0 {
+		os.Exit(1)
+	}
+}
+
+// runPlot runs the plot subcommand: it charts a column of a -csv results file.
+func runPlot(args []string) {
+	fs := flag.NewFlagSet("plot", flag.ExitOnError)
+	x := fs.String("x", "iat_mean_ms", "column to label the bars with")
+	y := fs.String("y", "p99_rt_ms", "column to plot (e.g. mean_rt_ms, throughput_per_sec, skipped)")
+	width := fs.Int("width", 50, "length of the longest bar")
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s plot [flags] <results.csv>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("Cannot open results: %v", err)
+	}
+	defer f.Close()
+	if err := PlotCSV(f, *x, *y, *width); err != nil {
+		log.Fatalf("Cannot plot %s: %v", fs.Arg(0), err)
+	}
+}
+
+// runRegress runs the regress subcommand: it runs the regression suite and exits
+// with status 1 if any case departs from its golden results.
+func runRegress(args []string) {
+	fs := flag.NewFlagSet("regress", flag.ExitOnError)
+	golden := fs.String("golden", "regression.json", "golden file of cases and expected results")
+	update := fs.Bool("update", false, "replace the golden results with this run's, keeping the tolerances")
+	timing := fs.Bool("timing", false, "check throughput, latency, and skips against the golden results too")
+	fs.Parse(args)
+	cases, err := LoadRegression(*golden)
+	if err != nil {
+		log.Fatalf("Cannot read golden file: %v", err)
+	}
+	outcomes := RunRegression(cases, *timing)
+	if *update {
+		if err := SaveRegression(*golden, Regolden(outcomes)); err != nil {
+			log.Fatalf("Cannot write golden file: %v", err)
+		}
+		fmt.Printf("updated %s\n", *golden)
+		return
+	}
+	if !PrintRegression(outcomes) {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,204 @@
+// Package testkit helps write short integration tests against goose. Server
+// starts an in-process server with small defaults and answers requests one at a
+// time; Run runs an experiment with defaults for whatever the test leaves out,
+// and checks the invariants every run keeps and the expectations the test sets.
+// For the key-value cache, the duality module has a testkit package of its own.
+//
+//	func TestPoolKeepsUp(t *testing.T) {
+//		testkit.RunCases(t, []testkit.Case{{
+//			Name:       "pool",
+//			Experiment: goose.Experiment{Mode: goose.ModePool, MaxConcurrent: 2},
+//			Expect:     testkit.Expect{MaxMeanRT: 5},
+//		}})
+//	}
+package testkit
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"courses.cs.duke.edu/go/goose"
+)
+
+// -------------------- servers --------------------
+
+// TB is the part of testing.TB that testkit uses.
+type TB interface {
+	Helper()
+	Errorf(format string, args ...any)
+	Fatalf(format string, args ...any)
+}
+
+// ReplyTimeout is how long Server.Do waits for a reply before it fails the test.
+var ReplyTimeout = 5 * time.Second
+
+// Server is an in-process goose server and the channels it is reached on.
+type Server struct {
+	*goose.Server
+	reqCh chan goose.Request
+	repCh chan goose.Request
+	next  int
+}
+
+// StartServer starts a server configured by cfg, with four concurrent requests
+// if cfg does not say.
+func StartServer(cfg goose.ServerConfig) *Server {
+	if cfg.MaxConcurrent <= 0 && cfg.Limiter == nil {
+		cfg.MaxConcurrent = 4
+	}
+	s := &Server{reqCh: make(chan goose.Request, 16), repCh: make(chan goose.Request, 16)}
+	s.Server = goose.StartServer(s.reqCh, s.repCh, cfg)
+	return s
+}
+
+// Do sends r to the server and returns the reply, failing t if there is none in
+// ReplyTimeout. r's ClientID and ReplyCh are set by Do.
+func (s *Server) Do(t TB, r goose.Request) goose.Request {
+	t.Helper()
+	r.ClientID, r.ReplyCh = s.next, s.repCh
+	s.next++
+	s.reqCh <- r
+	select {
+	case rep := <-s.repCh:
+		return rep
+	case <-time.After(ReplyTimeout):
+		t.Fatalf("request %d: no reply in %v", r.ClientID, ReplyTimeout)
+		return goose.Request{}
+	}
+}
+
+// Close shuts the server down, failing t if it takes longer than ReplyTimeout,
+// and returns its counters.
+func (s *Server) Close(t TB) goose.ServerStats {
+	t.Helper()
+	go func() {
+		for range s.repCh {
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), ReplyTimeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Errorf("server shutdown: %v", err)
+	}
+	close(s.reqCh)
+	return s.Stats()
+}
+
+// -------------------- experiments --------------------
+
+// Defaults returns e with its zero fields filled in for a quick, quiet,
+// reproducible run: 200 requests 2ms apart with 1ms demands on four slots, a
+// fixed seed, and no printing.
+func Defaults(e goose.Experiment) goose.Experiment {
+	if e.N <= 0 {
+		e.N = 200
+	}
+	if e.IatMean <= 0 {
+		e.IatMean = 2
+	}
+	if e.DemandMean <= 0 {
+		e.DemandMean = 1
+	}
+	if e.MaxConcurrent <= 0 && e.Limiter == nil {
+		e.MaxConcurrent = 4
+	}
+	if e.Load.Seed == 0 {
+		e.Load.Seed = 1
+	}
+	if e.Load.Log == nil {
+		e.Load.Log = io.Discard
+	}
+	return e
+}
+
+// Expect is what a test requires of a run's results. Zero fields set no bound.
+type Expect struct {
+	MinThroughput float64 // replies per second
+	MaxMeanRT     float64 // milliseconds
+	MaxP99        float64 // milliseconds
+	Lossy         bool    // allow requests to end other than with an OK reply
+}
+
+// Run runs Defaults(e) against an in-process server and fails t if the result
+// breaks an invariant (see CheckInvariants).
+func Run(t TB, e goose.Experiment) goose.Result {
+	t.Helper()
+	res := goose.RunExperiment(Defaults(e))
+	CheckInvariants(t, res)
+	return res
+}
+
+// CheckInvariants fails t for each accounting identity res breaks: every attempt
+// is sent or skipped, every request sent ends exactly one way, and there are no
+// more samples than replies.
+func CheckInvariants(t TB, res goose.Result) {
+	t.Helper()
+	for _, err := range invariants(res) {
+		t.Errorf("%v", err)
+	}
+}
+
+func invariants(res goose.Result) []error {
+	var out []error
+	if res.Attempts != res.Sent+res.Skipped {
+		out = append(out, fmt.Errorf("attempts=%d, want sent+skipped=%d", res.Attempts, res.Sent+res.Skipped))
+	}
+	if ended := res.Received + res.Rejected + res.Failed + res.Dropped + res.TimedOut; ended != res.Sent {
+		out = append(out, fmt.Errorf("received+rejected+failed+dropped+timedOut=%d, want sent=%d", ended, res.Sent))
+	}
+	if len(res.Samples) > res.Received {
+		out = append(out, fmt.Errorf("%d samples for %d replies", len(res.Samples), res.Received))
+	}
+	return out
+}
+
+// Check fails t for each expectation res does not meet.
+func Check(t TB, res goose.Result, x Expect) {
+	t.Helper()
+	for _, err := range x.check(res) {
+		t.Errorf("%v", err)
+	}
+}
+
+func (x Expect) check(res goose.Result) []error {
+	var out []error
+	if !x.Lossy && res.Received != res.N {
+		out = append(out, fmt.Errorf("received=%d of n=%d (sent=%d skipped=%d rejected=%d failed=%d dropped=%d timedOut=%d)",
+			res.Received, res.N, res.Sent, res.Skipped, res.Rejected, res.Failed, res.Dropped, res.TimedOut))
+	}
+	if x.MinThroughput > 0 && res.Throughput < x.MinThroughput {
+		out = append(out, fmt.Errorf("throughput=%.1f/sec, want at least %.1f", res.Throughput, x.MinThroughput))
+	}
+	if x.MaxMeanRT > 0 && res.MeanRT > x.MaxMeanRT {
+		out = append(out, fmt.Errorf("meanRT=%.3fms, want at most %.3fms", res.MeanRT, x.MaxMeanRT))
+	}
+	if x.MaxP99 > 0 && res.P99 > x.MaxP99 {
+		out = append(out, fmt.Errorf("p99=%.3fms, want at most %.3fms", res.P99, x.MaxP99))
+	}
+	return out
+}
+
+// Case is a named experiment and what its results must meet.
+type Case struct {
+	Name       string
+	Experiment goose.Experiment
+	Expect     Expect
+}
+
+// RunCases runs each case in turn, as Run does, and fails t for every broken
+// invariant and unmet expectation, prefixed with the name of its case. It
+// returns the results in order.
+func RunCases(t TB, cases []Case) []goose.Result {
+	t.Helper()
+	var out []goose.Result
+	for _, c := range cases {
+		res := goose.RunExperiment(Defaults(c.Experiment))
+		for _, err := range append(invariants(res), c.Expect.check(res)...) {
+			t.Errorf("%s: %v", c.Name, err)
+		}
+		out = append(out, res)
+	}
+	return out
+}
@@ -0,0 +1,72 @@
+package testkit_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"courses.cs.duke.edu/go/goose"
+	"courses.cs.duke.edu/go/testkit"
+)
+
+// recorder is a TB that keeps the failures instead of reporting them.
+type recorder struct {
+	errs []string
+}
+
+func (r *recorder) Helper() {}
+func (r *recorder) Errorf(format string, args ...any) {
+	r.errs = append(r.errs, fmt.Sprintf(format, args...))
+}
+func (r *recorder) Fatalf(format string, args ...any) { r.Errorf(format, args...) }
+
+func TestServerDoAndClose(t *testing.T) {
+	s := testkit.StartServer(goose.ServerConfig{})
+	for range 3 {
+		if rep := s.Do(t, goose.Request{WorkDemand: 1}); rep.Status != goose.StatusOK {
+			t.Errorf("status %v, want ok", rep.Status)
+		}
+	}
+	if st := s.Close(t); st.Served != 3 || st.Limit != 4 {
+		t.Errorf("stats %+v, want 3 served under the default limit of 4", st)
+	}
+}
+
+func TestRunCases(t *testing.T) {
+	res := testkit.RunCases(t, []testkit.Case{
+		{Name: "semaphore", Experiment: goose.Experiment{N: 50}},
+		{Name: "pool", Experiment: goose.Experiment{N: 50, Mode: goose.ModePool, MaxConcurrent: 2}},
+	})
+	if len(res) != 2 || res[0].Received != 50 || res[1].Received != 50 {
+		t.Errorf("results %+v", res)
+	}
+}
+
+// An expectation the run cannot meet is reported, with the case's name.
+func TestRunCasesReportsUnmetExpectation(t *testing.T) {
+	var r recorder
+	testkit.RunCases(&r, []testkit.Case{{
+		Name:       "impossible",
+		Experiment: goose.Experiment{N: 20},
+		Expect:     testkit.Expect{MaxMeanRT: 1e-9},
+	}})
+	if len(r.errs) != 1 || !strings.HasPrefix(r.errs[0], "impossible: meanRT=") {
+		t.Errorf("failures %q, want one about meanRT", r.errs)
+	}
+}
+
+func TestCheckInvariants(t *testing.T) {
+	var r recorder
+	testkit.CheckInvariants(&r, goose.Result{Attempts: 10, Sent: 9, Received: 8})
+	if len(r.errs) != 2 {
+		t.Errorf("failures %q, want the attempts and the endings", r.errs)
+	}
+}
+
+func Example() {
+	var t recorder // a *testing.T in a real test
+	res := testkit.Run(&t, goose.Experiment{N: 100})
+	testkit.Check(&t, res, testkit.Expect{MinThroughput: 1})
+	fmt.Println(res.Received, len(t.errs))
+	// Output: 100 0
+}